@@ -0,0 +1,181 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+
+	"go.temporal.io/api/common/v1"
+)
+
+var (
+	// errBatchUnsupported is returned if the LPS server does not offer the get-batch endpoint.
+	errBatchUnsupported = errors.New("server does not support batch downloads")
+)
+
+type batchGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// prefetchedBlob is a blob downloaded with a batch request, which still needs to be verified.
+type prefetchedBlob struct {
+	data     []byte
+	checkSum string
+}
+
+// prefetchBlobs downloads the blobs of all v2 payloads which are not cached with a single
+// batch request, if WithBatchDownloads is configured. Blobs which are missing from the
+// result, e.g. because they were not found or the batch request failed, are downloaded
+// individually by decodePayload.
+func (c *Codec) prefetchBlobs(ctx context.Context, payloads []*common.Payload) map[string]prefetchedBlob {
+	if !c.batchDownloads || c.batchUnsupported.Load() {
+		return nil
+	}
+	if _, ok := c.transport.(*httpTransport); !ok {
+		return nil
+	}
+
+	sizes := make(map[string]uint)
+	var keys []string
+	for _, payload := range payloads {
+		if string(payload.GetMetadata()[remoteCodecName]) != "v2" {
+			continue
+		}
+		remoteP, err := fromEnvelope(payload)
+		if err != nil || remoteP.Key == "" {
+			continue
+		}
+		if _, ok := sizes[remoteP.Key]; ok {
+			continue
+		}
+		if c.cache != nil {
+			if _, ok := c.cache.get(remoteP.Key); ok {
+				continue
+			}
+		}
+		sizes[remoteP.Key] = remoteP.Size
+		keys = append(keys, remoteP.Key)
+	}
+	// a single blob is downloaded more efficiently with a plain GET
+	if len(keys) < 2 {
+		return nil
+	}
+
+	blobs, err := c.getBatch(ctx, keys, sizes)
+	if errors.Is(err, errBatchUnsupported) {
+		c.logger.Info("server does not support batch downloads, falling back to individual downloads")
+		c.batchUnsupported.Store(true)
+		return nil
+	}
+	if err != nil {
+		c.logger.Error("batch download failed, falling back to individual downloads", "error", err)
+	}
+	for _, blob := range blobs {
+		c.stats.bytesDownloaded.Add(int64(len(blob.data)))
+	}
+	return blobs
+}
+
+// getBatch downloads the blobs with the given keys with a single request to the get-batch
+// endpoint of the LPS server. Blobs which could not be downloaded are omitted from the result.
+func (c *Codec) getBatch(ctx context.Context, keys []string, sizes map[string]uint) (_ map[string]prefetchedBlob, err error) {
+	ctx, span := c.startSpan(ctx, "lps.blobs.get-batch",
+		attrNamespace.String(c.namespace),
+		attrBatchSize.Int(len(keys)),
+	)
+	defer func() { endSpan(span, err) }()
+
+	body, err := json.Marshal(batchGetRequest{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		c.url.JoinPath("v2").String(),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path = path.Join(req.URL.Path, "blobs/get-batch")
+	q := req.URL.Query()
+	c.setNamespaceParam(q)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := c.setRequestHeaders(req); err != nil {
+		return nil, err
+	}
+	injectTraceContext(ctx, span, req)
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	setSpanAttributes(span, attrHTTPStatus.Int(resp.StatusCode))
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// older servers do not know the get-batch endpoint
+		return nil, errBatchUnsupported
+	default:
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, newStatusError(resp.StatusCode, responseRequestID(resp), respBody)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/mixed" {
+		return nil, fmt.Errorf("unexpected batch response content type %s", mediaType)
+	}
+
+	sha2 := hashPool.Get().(hash.Hash)
+	defer putHash(sha2)
+
+	blobs := make(map[string]prefetchedBlob, len(keys))
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return blobs, nil
+		}
+		if err != nil {
+			return blobs, err
+		}
+
+		key := part.Header.Get("X-Payload-Key")
+		size, requested := sizes[key]
+		if status := part.Header.Get("X-Payload-Status"); !requested || status != strconv.Itoa(http.StatusOK) {
+			c.logger.Debug("blob missing from batch response", "key", key, "status", status)
+			continue
+		}
+
+		sha2.Reset()
+		b, err := readBlob(part, sha2, size)
+		if err != nil {
+			return blobs, err
+		}
+		checkSum := hexSum(sha2)
+		if digest := part.Header.Get("X-Payload-Digest"); digest != "" && digest != "sha256:"+checkSum {
+			return blobs, fmt.Errorf("blob %s was corrupted in transit, wanted sha %s, got %s", key, digest, checkSum)
+		}
+		blobs[key] = prefetchedBlob{data: b, checkSum: checkSum}
+	}
+}
@@ -0,0 +1,120 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_batch_downloads(t *testing.T) {
+	tests := []struct {
+		name            string
+		batchSupported  bool
+		wantBatches     int32
+		wantSingleGets  int32
+		wantUnsupported bool
+	}{
+		{name: "supported", batchSupported: true, wantBatches: 1, wantSingleGets: 0},
+		{name: "unsupported", batchSupported: false, wantBatches: 1, wantSingleGets: 3, wantUnsupported: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := server.NewHttpHandler(&memory.Driver{})
+			var batches, gets int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/blobs/get-batch"):
+					atomic.AddInt32(&batches, 1)
+					if !tt.batchSupported {
+						http.NotFound(w, r)
+						return
+					}
+				case strings.HasSuffix(r.URL.Path, "/blobs/get"):
+					atomic.AddInt32(&gets, 1)
+				}
+				handler.ServeHTTP(w, r)
+			}))
+			defer s.Close()
+
+			c, err := New(
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithMinBytes(32),
+				WithBatchDownloads(),
+			)
+			require.NoError(t, err)
+
+			payloads := []*common.Payload{
+				{Data: []byte("this is the first longer message blah blah blah blah")},
+				{Data: []byte("small")},
+				{Data: []byte("this is the second longer message blah blah blah blah")},
+				{Data: []byte("this is the third longer message blah blah blah blah")},
+			}
+			encoded, err := c.Encode(payloads)
+			require.NoError(t, err)
+
+			decoded, err := c.Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, payloads, decoded)
+			require.Equal(t, tt.wantBatches, atomic.LoadInt32(&batches))
+			require.Equal(t, tt.wantSingleGets, atomic.LoadInt32(&gets))
+			require.Equal(t, tt.wantUnsupported, c.batchUnsupported.Load())
+
+			// the batch endpoint is not used again once it is known to be unsupported
+			_, err = c.Decode(encoded)
+			require.NoError(t, err)
+			if tt.wantUnsupported {
+				require.Equal(t, tt.wantBatches, atomic.LoadInt32(&batches))
+			}
+		})
+	}
+}
+
+func Test_batch_downloads_are_verified(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithBatchDownloads(),
+	)
+	require.NoError(t, err)
+
+	encoded, err := c.Encode([]*common.Payload{
+		{Data: []byte("this is the first longer message blah blah blah blah")},
+		{Data: []byte("this is the second longer message blah blah blah blah")},
+	})
+	require.NoError(t, err)
+
+	// swap the envelopes' digests so that each blob fails verification
+	first, err := fromEnvelope(encoded[0])
+	require.NoError(t, err)
+	second, err := fromEnvelope(encoded[1])
+	require.NoError(t, err)
+	first.Digest, second.Digest = second.Digest, first.Digest
+	for i, remoteP := range []*remotePayload{first, second} {
+		envelope, err := c.toEnvelope(*remoteP)
+		require.NoError(t, err)
+		envelope.Metadata[remoteCodecName] = []byte("v2")
+		encoded[i] = envelope
+	}
+
+	_, err = c.Decode(encoded)
+	require.ErrorContains(t, err, "wanted object sha")
+}
@@ -0,0 +1,99 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	// a success resets the consecutive failures
+	require.NoError(t, b.allow())
+	b.record(false)
+	require.NoError(t, b.allow())
+	b.record(true)
+	require.NoError(t, b.allow())
+	b.record(false)
+	require.Equal(t, CircuitClosed, b.currentState())
+
+	// the second consecutive failure opens the circuit
+	require.NoError(t, b.allow())
+	b.record(false)
+	require.Equal(t, CircuitOpen, b.currentState())
+	require.ErrorIs(t, b.allow(), ErrCircuitOpen)
+
+	// after the cooldown a single probe is let through
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow())
+	require.Equal(t, CircuitHalfOpen, b.currentState())
+	require.ErrorIs(t, b.allow(), ErrCircuitOpen)
+
+	// a failed probe opens the circuit again
+	b.record(false)
+	require.Equal(t, CircuitOpen, b.currentState())
+	require.ErrorIs(t, b.allow(), ErrCircuitOpen)
+
+	// a successful probe closes the circuit
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow())
+	b.record(true)
+	require.Equal(t, CircuitClosed, b.currentState())
+	require.NoError(t, b.allow())
+	require.NoError(t, b.allow())
+}
+
+func Test_circuit_breaker_fails_fast_when_lps_is_down(t *testing.T) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithoutUrlHealthCheck(),
+		WithExistenceCheck(false),
+		WithCircuitBreaker(3, time.Hour),
+	)
+	require.NoError(t, err)
+	require.Equal(t, CircuitClosed, c.CircuitBreakerState())
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err = c.Encode([]*common.Payload{&payload})
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	require.Equal(t, CircuitOpen, c.CircuitBreakerState())
+
+	_, err = c.Encode([]*common.Payload{&payload})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithCircuitBreaker(0, time.Hour),
+	)
+	require.Error(t, err)
+}
@@ -0,0 +1,102 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"sync"
+)
+
+var hashPool = sync.Pool{
+	New: func() interface{} { return sha256.New() },
+}
+
+// sha256Digest returns the digest of data in the format sha256:<hex encoded value>.
+func sha256Digest(data []byte) string {
+	h := hashPool.Get().(hash.Hash)
+	defer putHash(h)
+
+	h.Write(data)
+	return "sha256:" + hexSum(h)
+}
+
+// hexSum returns the hex encoded current sum of h.
+func hexSum(h hash.Hash) string {
+	var sum [sha256.Size]byte
+	return hex.EncodeToString(h.Sum(sum[:0]))
+}
+
+func putHash(h hash.Hash) {
+	h.Reset()
+	hashPool.Put(h)
+}
+
+// readBlob reads r to the end, hashing the data with h. sizeHint is the expected size of
+// the data, see newBlobWriter.
+func readBlob(r io.Reader, h hash.Hash, sizeHint uint) ([]byte, error) {
+	w := newBlobWriter(sizeHint)
+	if _, err := w.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	h.Write(w.buf)
+	return w.buf, nil
+}
+
+// blobWriter collects the data written to it in a single buffer, which is handed out as the
+// data of a decoded payload without copying it.
+type blobWriter struct {
+	buf []byte
+}
+
+// newBlobWriter returns a blobWriter for a blob of the expected size sizeHint. Its buffer is
+// allocated with the capacity sizeHint and only grows if more data is written.
+func newBlobWriter(sizeHint uint) *blobWriter {
+	return &blobWriter{buf: make([]byte, 0, sizeHint)}
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// ReadFrom reads r directly into the buffer, which is used by io.Copy.
+func (w *blobWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		if len(w.buf) == cap(w.buf) {
+			// the buffer is full, and growing it is only needed if there is more data
+			var extra [bytes.MinRead]byte
+			n, err := r.Read(extra[:])
+			w.buf = append(w.buf, extra[:n]...)
+			total += int64(n)
+			if err == io.EOF {
+				return total, nil
+			}
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+
+		n, err := r.Read(w.buf[len(w.buf):cap(w.buf)])
+		w.buf = w.buf[:len(w.buf)+n]
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// bytes returns the data written so far.
+func (w *blobWriter) bytes() []byte {
+	return w.buf
+}
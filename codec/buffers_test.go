@@ -0,0 +1,210 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"go.temporal.io/api/common/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sha256Digest(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("foo"), bytes.Repeat([]byte("bar"), 10_000)} {
+		sum := sha256.Sum256(data)
+		// pooled hashes are reset between uses
+		require.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), sha256Digest(data))
+	}
+}
+
+func Test_decoded_payloads_do_not_share_pooled_buffers(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+
+	payloads := []*common.Payload{
+		{Data: bytes.Repeat([]byte("a"), 4096)},
+		{Data: bytes.Repeat([]byte("b"), 4096)},
+	}
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+
+	first, err := c.Decode(encoded[:1])
+	require.NoError(t, err)
+	second, err := c.Decode(encoded[1:])
+	require.NoError(t, err)
+
+	require.Equal(t, payloads[0].Data, first[0].Data)
+	require.Equal(t, payloads[1].Data, second[0].Data)
+	require.Equal(t, len(first[0].Data), cap(first[0].Data))
+}
+
+func Test_blobWriter_reads_into_a_single_buffer(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	for _, scenario := range []struct {
+		name     string
+		sizeHint uint
+	}{
+		{name: "exact size", sizeHint: 10_000},
+		{name: "fewer bytes than expected", sizeHint: 20_000},
+		{name: "more bytes than expected", sizeHint: 5_000},
+		{name: "unknown size"},
+	} {
+		t.Run(scenario.name, func(t *testing.T) {
+			w := newBlobWriter(scenario.sizeHint)
+			// hide bytes.Reader.WriteTo, so that the writer reads from the reader
+			n, err := io.Copy(w, struct{ io.Reader }{bytes.NewReader(data)})
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), n)
+			require.Equal(t, data, w.bytes())
+			if scenario.sizeHint >= uint(len(data)) {
+				require.Equal(t, int(scenario.sizeHint), cap(w.bytes()))
+			}
+		})
+	}
+}
+
+func Test_decoding_fails_if_the_server_sends_unexpected_data(t *testing.T) {
+	payload := &common.Payload{Data: bytes.Repeat([]byte("a"), 4096)}
+
+	for _, scenario := range []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "fewer bytes", data: payload.Data[:4000], wantErr: "wanted object of size 4096, got 4000"},
+		{name: "more bytes", data: append(bytes.Repeat([]byte("a"), 4096), 'a'), wantErr: "server returned more than the expected 4096 bytes"},
+		{name: "other bytes", data: bytes.Repeat([]byte("b"), 4096), wantErr: "wanted object sha"},
+	} {
+		t.Run(scenario.name, func(t *testing.T) {
+			handler := server.NewHttpHandler(&memory.Driver{})
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v2/blobs/get" {
+					handler.ServeHTTP(w, r)
+					return
+				}
+				// flushing before writing sends the body without Content-Length
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.(http.Flusher).Flush()
+				_, _ = w.Write(scenario.data)
+			}))
+			defer s.Close()
+
+			c, err := New(
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithMinBytes(32),
+			)
+			require.NoError(t, err)
+			encoded, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+
+			_, err = c.Decode(encoded)
+			require.ErrorContains(t, err, scenario.wantErr)
+		})
+	}
+}
+
+// benchmarkPayloadSize returns the size of the payloads used in benchmarks, which is
+// reduced in short mode so that benchmarks can run in CI.
+func benchmarkPayloadSize() int {
+	if testing.Short() {
+		return 1 << 20
+	}
+	return 16 << 20
+}
+
+func setUpBenchmark(b *testing.B) (*Codec, *common.Payload) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	b.Cleanup(s.Close)
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithExistenceCheck(false),
+	)
+	require.NoError(b, err)
+	b.Cleanup(func() { c.Close() })
+
+	data := make([]byte, benchmarkPayloadSize())
+	rand.New(rand.NewSource(1)).Read(data)
+	return c, &common.Payload{Data: data}
+}
+
+func BenchmarkEncodeLarge(b *testing.B) {
+	c, payload := setUpBenchmark(b)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload.Data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Encode([]*common.Payload{payload}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeLarge(b *testing.B) {
+	c, payload := setUpBenchmark(b)
+	encoded, err := c.Encode([]*common.Payload{payload})
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload.Data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Decode(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark_readBlob compares reading a 10MB blob into a buffer of the expected size with
+// reading it with io.ReadAll through a TeeReader, as the codec used to.
+func Benchmark_readBlob(b *testing.B) {
+	data := make([]byte, 10<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	b.Run("ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			h := sha256.New()
+			if _, err := io.ReadAll(io.TeeReader(bytes.NewReader(data), h)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("blobWriter", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			h := sha256.New()
+			if _, err := readBlob(struct{ io.Reader }{bytes.NewReader(data)}, h, uint(len(data))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,85 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"container/list"
+	"sync"
+)
+
+// decodeCache is an LRU cache of decoded payload data, bounded by the total
+// number of cached bytes. It is safe for concurrent use.
+type decodeCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	curBytes int
+	ll       *list.List
+	entries  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newDecodeCache(maxBytes int) *decodeCache {
+	return &decodeCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the data cached for key.
+func (c *decodeCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return cloneBytes(e.Value.(*cacheEntry).data), true
+}
+
+// add caches a copy of data for key, evicting the least recently used entries
+// as needed. Data larger than the cache itself is not cached.
+func (c *decodeCache) add(key string, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&cacheEntry{key: key, data: cloneBytes(data)})
+	c.curBytes += len(data)
+	for c.curBytes > c.maxBytes {
+		c.removeOldest()
+	}
+}
+
+func (c *decodeCache) removeOldest() {
+	e := c.ll.Back()
+	if e == nil {
+		return
+	}
+	entry := c.ll.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.curBytes -= len(entry.data)
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
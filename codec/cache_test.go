@@ -0,0 +1,116 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"go.temporal.io/api/common/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeCache(t *testing.T) {
+	c := newDecodeCache(10)
+
+	c.add("a", []byte("aaaa"))
+	c.add("b", []byte("bbbb"))
+
+	// returned data is a copy
+	b, ok := c.get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte("aaaa"), b)
+	b[0] = 'x'
+	b, ok = c.get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte("aaaa"), b)
+
+	// "b" is the least recently used entry and gets evicted
+	c.add("c", []byte("cccc"))
+	_, ok = c.get("b")
+	require.False(t, ok)
+	_, ok = c.get("a")
+	require.True(t, ok)
+	_, ok = c.get("c")
+	require.True(t, ok)
+	require.Equal(t, 8, c.curBytes)
+
+	// entries larger than the cache are not cached
+	c.add("d", []byte("ddddddddddd"))
+	_, ok = c.get("d")
+	require.False(t, ok)
+	require.Equal(t, 8, c.curBytes)
+
+	// a large entry evicts several smaller ones
+	c.add("e", []byte("eeeeeeeeee"))
+	_, ok = c.get("a")
+	require.False(t, ok)
+	_, ok = c.get("c")
+	require.False(t, ok)
+	require.Equal(t, 10, c.curBytes)
+	require.Equal(t, 1, c.ll.Len())
+}
+
+func Test_decode_cache_avoids_repeated_downloads(t *testing.T) {
+	var gets int32
+	handler := server.NewHttpHandler(&memory.Driver{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithDecodeCache(1024),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Metadata: map[string][]byte{
+			"foo": []byte("bar"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				decoded, err := c.Decode(encoded)
+				if !assert.NoError(t, err) || !assert.Equal(t, &payload, decoded[0]) {
+					return
+				}
+				// mutating the result must not affect other callers
+				decoded[0].Data[0] = 'x'
+				decoded[0].Metadata["foo"] = []byte("qux")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// concurrent misses may download the blob more than once, but never once per decode
+	require.Less(t, atomic.LoadInt32(&gets), int32(16*10))
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, &payload, decoded[0])
+}
@@ -0,0 +1,206 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// defaultChunkSize is the size of the parts of chunked uploads unless configured with WithChunkSize.
+	defaultChunkSize = 64 << 20
+	// abortUploadTimeout bounds aborting a failed upload session, which is not bound to the
+	// context of the upload since it may be done already.
+	abortUploadTimeout = 10 * time.Second
+)
+
+var (
+	// ErrPayloadTooLarge is returned if a payload exceeds the maximum blob size of the LPS
+	// server. The returned error is a *PayloadTooLargeError, which holds the sizes.
+	ErrPayloadTooLarge = errors.New("payload too large")
+
+	// errChunkedUnsupported is returned if the LPS server does not offer chunked uploads.
+	errChunkedUnsupported = errors.New("server does not support chunked uploads")
+
+	// maxSizePattern matches the limit in the error message of the LPS server for payloads
+	// which are too large.
+	maxSizePattern = regexp.MustCompile(`max size of (\d+) bytes`)
+)
+
+// PayloadTooLargeError is returned if a payload exceeds the maximum blob size of the LPS
+// server. It matches ErrPayloadTooLarge with errors.Is.
+type PayloadTooLargeError struct {
+	// Size is the size of the payload data in bytes.
+	Size int64
+	// Limit is the maximum blob size of the server in bytes, or zero if unknown.
+	Limit int64
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	if e.Limit == 0 {
+		return fmt.Sprintf("%v: %d bytes exceed the limit of the server", ErrPayloadTooLarge, e.Size)
+	}
+	return fmt.Sprintf("%v: %d bytes exceed the limit of %d bytes of the server", ErrPayloadTooLarge, e.Size, e.Limit)
+}
+
+func (e *PayloadTooLargeError) Is(target error) bool {
+	return target == ErrPayloadTooLarge
+}
+
+// newPayloadTooLargeError returns the error for a payload of size bytes rejected by the
+// LPS server with the given response body.
+func newPayloadTooLargeError(size int64, respBody []byte) *PayloadTooLargeError {
+	err := &PayloadTooLargeError{Size: size}
+	if m := maxSizePattern.FindStringSubmatch(parseErrorResponse(respBody).Message); m != nil {
+		err.Limit, _ = strconv.ParseInt(string(m[1]), 10, 64)
+	}
+	return err
+}
+
+type uploadSessionResponse struct {
+	ID string `json:"id"`
+}
+
+// putChunked uploads size bytes read from body in parts of chunkSize bytes using an upload
+// session of the LPS server. It returns the key of the stored blob, which is the same as for
+// a single upload of the blob.
+//
+// Upload sessions are started with POST /v2/blobs/uploads, taking the same parameters as
+// /v2/blobs/put. Each part is uploaded with PUT /v2/blobs/uploads/{id}?part=N&digest=D,
+// where N counts from 1 and D is the checksum of the part. The session is completed with
+// POST /v2/blobs/uploads/{id}/complete, which returns the key. Sessions which fail once
+// started are aborted with DELETE /v2/blobs/uploads/{id}. If the server does not offer upload
+// sessions, errChunkedUnsupported is returned.
+func (c *Codec) putChunked(ctx context.Context, span trace.Span, namespace string, body io.Reader, size int64, digest string, metadata []byte, contentType string) (string, error) {
+	uploadsURL := c.url.JoinPath(c.version, "blobs", "uploads")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadsURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	q.Set("digest", digest)
+	q.Set("namespace", namespace)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("X-Payload-Expected-Content-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString(metadata))
+	if contentType != "" {
+		req.Header.Set("X-Payload-Content-Type", contentType)
+	}
+
+	var session uploadSessionResponse
+	status, err := c.sendUploadRequest(ctx, span, req, &session)
+	// servers predating upload sessions, or whose storage does not support them
+	if status == http.StatusNotFound || status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented {
+		return "", errChunkedUnsupported
+	}
+	if err != nil {
+		return "", err
+	}
+	sessionURL := uploadsURL.JoinPath(session.ID)
+
+	key, err := c.uploadParts(ctx, span, sessionURL, body, size)
+	if err != nil {
+		// the parts uploaded so far are discarded rather than kept until the session expires
+		c.abortUpload(span, sessionURL)
+		return "", err
+	}
+	return key, nil
+}
+
+// uploadParts uploads size bytes read from body in parts of chunkSize bytes to the upload
+// session at sessionURL, and completes it. It returns the key of the stored blob.
+func (c *Codec) uploadParts(ctx context.Context, span trace.Span, sessionURL *url.URL, body io.Reader, size int64) (string, error) {
+	chunk := make([]byte, c.chunkSize)
+	for part, offset := 1, int64(0); offset < size; part++ {
+		n := int64(len(chunk))
+		if size-offset < n {
+			n = size - offset
+		}
+		if _, err := io.ReadFull(body, chunk[:n]); err != nil {
+			return "", err
+		}
+		offset += n
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, sessionURL.String(), bytes.NewReader(chunk[:n]))
+		if err != nil {
+			return "", err
+		}
+		q := req.URL.Query()
+		q.Set("part", strconv.Itoa(part))
+		q.Set("digest", sha256Digest(chunk[:n]))
+		req.URL.RawQuery = q.Encode()
+		req.Header.Set("Content-Type", "application/octet-stream")
+		if _, err := c.sendUploadRequest(ctx, span, req, nil); err != nil {
+			return "", fmt.Errorf("unable to upload part %d: %w", part, err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sessionURL.JoinPath("complete").String(), nil)
+	if err != nil {
+		return "", err
+	}
+	var key keyResponse
+	if _, err := c.sendUploadRequest(ctx, span, req, &key); err != nil {
+		return "", err
+	}
+	return key.Key, nil
+}
+
+// abortUpload aborts the upload session at sessionURL, so that the server discards its parts
+// and releases the quota reserved for it. Failures are only logged, since sessions expire.
+func (c *Codec) abortUpload(span trace.Span, sessionURL *url.URL) {
+	ctx, cancel := context.WithTimeout(context.Background(), abortUploadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, sessionURL.String(), nil)
+	if err != nil {
+		return
+	}
+	// sessions whose completion failed may have ended already
+	if status, err := c.sendUploadRequest(ctx, span, req, nil); err != nil && status != http.StatusNotFound {
+		c.logger.Error("unable to abort upload session", "url", sessionURL.String(), "error", err)
+	}
+}
+
+// sendUploadRequest sends a request of an upload session and unmarshals the response into
+// v, unless v is nil. It returns the status code of the response, if any.
+func (c *Codec) sendUploadRequest(ctx context.Context, span trace.Span, req *http.Request, v interface{}) (int, error) {
+	if err := c.setRequestHeaders(req); err != nil {
+		return 0, err
+	}
+	injectTraceContext(ctx, span, req)
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	setSpanAttributes(span, attrHTTPStatus.Int(resp.StatusCode))
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, newStatusError(resp.StatusCode, responseRequestID(resp), respBody)
+	}
+	if v != nil {
+		if err := json.Unmarshal(respBody, v); err != nil {
+			return resp.StatusCode, fmt.Errorf("unable to unmarshal upload response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
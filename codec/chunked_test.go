@@ -0,0 +1,279 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkedServer is a fake LPS server rejecting uploads larger than limit, which optionally
+// offers upload sessions storing the assembled blobs in driver.
+type chunkedServer struct {
+	handler http.Handler
+	driver  storage.Driver
+	limit   int
+	chunked bool
+	// failPart is the number of a part whose upload fails, if any.
+	failPart int
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+	parts    []int
+	aborted  []string
+}
+
+type uploadSession struct {
+	namespace string
+	digest    string
+	metadata  map[string][]byte
+	data      bytes.Buffer
+}
+
+func (s *chunkedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/blobs/put") && r.ContentLength > int64(s.limit):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = fmt.Fprintf(w, "payload exceeds max size of %d bytes", s.limit)
+	case strings.Contains(r.URL.Path, "/blobs/uploads") && s.chunked:
+		s.serveUpload(w, r)
+	case strings.Contains(r.URL.Path, "/blobs/uploads"):
+		// servers predating upload sessions
+		http.NotFound(w, r)
+	default:
+		s.handler.ServeHTTP(w, r)
+	}
+}
+
+func (s *chunkedServer) serveUpload(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/blobs/uploads"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(segments) == 1:
+		md, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Temporal-Metadata"))
+		var metadata map[string][]byte
+		if err := json.Unmarshal(md, &metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := strconv.Itoa(len(s.sessions) + 1)
+		s.sessions[id] = &uploadSession{
+			namespace: r.URL.Query().Get("namespace"),
+			digest:    r.URL.Query().Get("digest"),
+			metadata:  metadata,
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(uploadSessionResponse{ID: id})
+	case r.Method == http.MethodPut && len(segments) == 2:
+		session := s.sessions[segments[1]]
+		data, _ := io.ReadAll(r.Body)
+		if sha256Digest(data) != r.URL.Query().Get("digest") {
+			http.Error(w, "part digest mismatch", http.StatusBadRequest)
+			return
+		}
+		part, _ := strconv.Atoi(r.URL.Query().Get("part"))
+		if part == s.failPart {
+			http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.parts = append(s.parts, part)
+		session.data.Write(data)
+	case r.Method == http.MethodDelete && len(segments) == 2:
+		delete(s.sessions, segments[1])
+		s.aborted = append(s.aborted, segments[1])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && len(segments) == 3 && segments[2] == "complete":
+		session := s.sessions[segments[1]]
+		if sha256Digest(session.data.Bytes()) != session.digest {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		key, err := v2.ComputeKey(session.namespace, session.digest, session.metadata)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := s.driver.PutPayload(r.Context(), &storage.PutRequest{
+			Data:          &session.data,
+			Key:           key,
+			Digest:        session.digest,
+			ContentLength: uint64(session.data.Len()),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(keyResponse{Key: key})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_payloads_too_large_for_the_server_are_uploaded_in_chunks(t *testing.T) {
+	driver := &memory.Driver{}
+	fake := &chunkedServer{
+		handler:  server.NewHttpHandler(driver),
+		driver:   driver,
+		limit:    100,
+		chunked:  true,
+		sessions: map[string]*uploadSession{},
+	}
+	s := httptest.NewServer(fake)
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithChunkSize(40),
+	)
+	require.NoError(t, err)
+
+	payload := &common.Payload{
+		Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+		Data:     bytes.Repeat([]byte("0123456789"), 25),
+	}
+	encoded, err := c.Encode([]*common.Payload{payload})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7}, fake.parts)
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{payload}, decoded)
+
+	// the envelope is the same as for a single upload
+	plain := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer plain.Close()
+	other, err := New(
+		WithURL(plain.URL),
+		WithHTTPClient(plain.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+	single, err := other.Encode([]*common.Payload{payload})
+	require.NoError(t, err)
+	require.Equal(t, single, encoded)
+
+	// streamed blobs are uploaded in chunks, too
+	data := bytes.Repeat([]byte("abcdefghij"), 15)
+	key, _, err := c.PutBlob(context.Background(), struct{ io.Reader }{bytes.NewReader(data)}, int64(len(data)), nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, c.GetBlob(context.Background(), key, &buf))
+	require.Equal(t, data, buf.Bytes())
+}
+
+func Test_failed_chunked_uploads_abort_their_session(t *testing.T) {
+	testCases := []struct {
+		name     string
+		failPart int
+		// size is the number of bytes of the blob of 150 bytes which can be read
+		size int
+		// digest is the digest of the session, which defaults to the digest of the blob
+		digest  string
+		wantErr string
+	}{
+		{name: "Part upload", failPart: 2, size: 150, wantErr: "unable to upload part 2"},
+		{name: "Read", size: 130, wantErr: "unexpected EOF"},
+		{name: "Completion", size: 150, digest: sha256Digest([]byte("other")), wantErr: "digest mismatch"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &chunkedServer{
+				handler:  server.NewHttpHandler(&memory.Driver{}),
+				driver:   &memory.Driver{},
+				limit:    100,
+				chunked:  true,
+				failPart: tc.failPart,
+				sessions: map[string]*uploadSession{},
+			}
+			s := httptest.NewServer(fake)
+			defer s.Close()
+			c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithChunkSize(40))
+			require.NoError(t, err)
+
+			data := bytes.Repeat([]byte("abcdefghij"), 15)
+			digest := tc.digest
+			if digest == "" {
+				digest = sha256Digest(data)
+			}
+			_, err = c.putChunked(context.Background(), nil, "test", bytes.NewReader(data[:tc.size]), int64(len(data)), digest, []byte("{}"), "")
+			require.ErrorContains(t, err, tc.wantErr)
+			require.Equal(t, []string{"1"}, fake.aborted)
+			require.Empty(t, fake.sessions)
+		})
+	}
+}
+
+func Test_payloads_too_large_for_the_server_are_uploaded_in_upload_sessions(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandlerWithOptions(&memory.Driver{}, server.WithMaxBlobBytes(100)))
+	defer s.Close()
+
+	c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithMinBytes(32), WithChunkSize(64))
+	require.NoError(t, err)
+
+	payloads := []*common.Payload{{
+		Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+		Data:     bytes.Repeat([]byte("0123456789"), 25),
+	}}
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+
+	// storage drivers without multipart uploads do not offer upload sessions
+	unsupported := httptest.NewServer(server.NewHttpHandlerWithOptions(struct{ storage.Driver }{&memory.Driver{}}, server.WithMaxBlobBytes(100)))
+	defer unsupported.Close()
+	c, err = New(WithURL(unsupported.URL), WithHTTPClient(unsupported.Client()), WithNamespace("test"), WithMinBytes(32), WithChunkSize(64))
+	require.NoError(t, err)
+	_, err = c.Encode(payloads)
+	require.ErrorIs(t, err, ErrPayloadTooLarge)
+}
+
+func Test_payloads_too_large_fail_without_chunked_uploads(t *testing.T) {
+	fake := &chunkedServer{handler: server.NewHttpHandler(&memory.Driver{}), limit: 100}
+	s := httptest.NewServer(fake)
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+
+	_, err = c.Encode([]*common.Payload{{Data: bytes.Repeat([]byte("a"), 150)}})
+	require.ErrorIs(t, err, ErrPayloadTooLarge)
+	var tooLarge *PayloadTooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, &PayloadTooLargeError{Size: 150, Limit: 100}, tooLarge)
+	require.EqualError(t, err, "payload too large: 150 bytes exceed the limit of 100 bytes of the server")
+
+	_, err = New(WithURL(s.URL), WithNamespace("test"), WithChunkSize(0))
+	require.Error(t, err)
+}
@@ -7,46 +7,235 @@ package codec
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"hash"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+	lpsmetadata "github.com/DataDog/temporal-large-payload-codec/server/metadata"
+	"go.opentelemetry.io/otel/trace"
 	"go.temporal.io/api/common/v1"
+	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/converter"
+	"golang.org/x/net/http2"
 )
 
 const (
 	remoteCodecName = "temporal.io/remote-codec"
+	// codecMetadataPrefix prefixes all metadata used by the codec.
+	codecMetadataPrefix = "remote-codec/"
+	// originalMetadataPrefix prefixes the original metadata copied to encoded payloads.
+	originalMetadataPrefix = codecMetadataPrefix + "original-"
+	// originalSizeName holds the size of the original payload data on encoded payloads.
+	originalSizeName = originalMetadataPrefix + "size"
+	// MetadataMissingBlob marks placeholder payloads returned by Decode for blobs which no
+	// longer exist in LargePayloadService, see WithMissingBlobPlaceholder.
+	MetadataMissingBlob = codecMetadataPrefix + "missing"
+	// unixSocketHost is the host of requests sent to LargePayloadService over a unix domain socket.
+	unixSocketHost = "lps"
+	// withheldMetadataPrefix prefixes the metadata which is not sent to LargePayloadService,
+	// but only kept on encoded payloads.
+	withheldMetadataPrefix = codecMetadataPrefix + "withheld-"
+	// originKeyName holds the key of the blob a payload was decoded from, if the blob belongs
+	// to another namespace, see WithPreserveNamespaceOnReencode.
+	originKeyName = codecMetadataPrefix + "origin-key"
+)
+
+var (
+	// ErrClosed is returned when using a Codec after it has been closed.
+	ErrClosed = errors.New("codec is closed")
+
+	// ErrUnhealthy is returned by Encode without contacting LargePayloadService while the
+	// health monitor configured with WithHealthMonitor considers it unhealthy.
+	ErrUnhealthy = errors.New("LPS unhealthy")
+
+	// ErrBlobNotFound is returned if LargePayloadService does not know a blob. Errors returned
+	// by a Transport for blobs which do not exist must wrap it.
+	ErrBlobNotFound = errors.New("blob not found")
 )
 
 type Codec struct {
 	// client is the HTTP client used for talking to the LPS server.
 	client *http.Client
+	// ownsClient tells whether client was built by the codec, whose idle connections are
+	// closed by Close, rather than passed with WithHTTPClient or http.DefaultClient.
+	ownsClient bool
 	// url is the base URL of the LPS server.
 	url *url.URL
+	// readURLs are the base URLs of additional LPS servers blobs are downloaded from if
+	// they are not found at url.
+	readURLs []*url.URL
+	// basePath is the path prefix under which the LPS server at url is mounted.
+	basePath string
 	// version is the LPS API version (v1 or v2).
 	version string
 	// minBytes is the minimum size of the payload in order to use remote codec.
 	minBytes int
+	// minBytesByEncoding overrides minBytes for payloads with the given encoding metadata.
+	minBytesByEncoding map[string]int
 	// namespace is the Temporal namespace the client using this codec is connected to.
 	namespace string
+	// namespaceProvider returns the namespace of an encoded payload, overriding namespace. Not used if nil.
+	namespaceProvider func(context.Context, *common.Payload) string
 	// skipUrlHealthCheck when set to true will skip url health check during initialisation.
 	skipUrlHealthCheck bool
 	// disableEncoding when set to true encoding will be disabled.
 	disableEncoding bool
 	// customHeaders http headers to add the request sent to LargePayloadService
 	customHeaders map[string][]string
+	// headerProvider returns headers to add to each request sent to LargePayloadService, overriding customHeaders. Not used if nil.
+	headerProvider func(context.Context) (http.Header, error)
+	// tracer creates spans for requests sent to LargePayloadService. No spans are created if nil.
+	tracer trace.Tracer
+	// logger is used to log offload decisions and requests sent to LargePayloadService.
+	logger logging.Logger
+	// metricsHandler records metrics of encoded and decoded payloads.
+	metricsHandler client.MetricsHandler
+	// cache holds recently decoded payload data. Caching is disabled if nil.
+	cache *decodeCache
+	// presignedTransfers when set to true transfers blobs directly to and from object storage using presigned URLs.
+	presignedTransfers bool
+	// presignUnsupported is set once the server reported that it cannot issue presigned URLs.
+	presignUnsupported atomic.Bool
+	// batchDownloads when set to true downloads the blobs of a batch of payloads with a single request.
+	batchDownloads bool
+	// batchUnsupported is set once the server reported that it does not offer batch downloads.
+	batchUnsupported atomic.Bool
+	// tokenProvider returns the bearer token to authenticate requests sent to LargePayloadService.
+	tokenProvider func(context.Context) (string, error)
+	// basicAuth holds the credentials to authenticate requests sent to LargePayloadService. Not used if nil.
+	basicAuth *url.Userinfo
+	// tlsConfig is applied to the transport of the http client. Not used if nil.
+	tlsConfig *tls.Config
+	// customRoundTripper is set to true if the transport was set using WithHTTPRoundTripper.
+	customRoundTripper bool
+	// http2 sends requests over HTTP/2, without TLS for http URLs.
+	http2 bool
+	// keyPrefixFunc returns the key prefix to use for a payload. Not used if nil.
+	keyPrefixFunc func(payload *common.Payload) string
+	// stripCodecMetadata removes the remote-codec/* metadata from decoded payloads.
+	stripCodecMetadata bool
+	// missingBlobPlaceholder when set to true decodes blobs which do not exist to a placeholder payload.
+	missingBlobPlaceholder bool
+	// chunkSize is the size of the parts of chunked uploads.
+	chunkSize int
+	// uploadMethod is the HTTP method of blob uploads, PUT or POST.
+	uploadMethod string
+	// expectContinue sends blob uploads with the Expect: 100-continue header.
+	expectContinue bool
+	// maxConcurrentUploads is the maximum number of blobs uploaded concurrently by an Encode call.
+	maxConcurrentUploads int
+	// maxInflightBytes is the maximum number of payload bytes uploaded concurrently by an Encode call. Not limited if zero.
+	maxInflightBytes int64
+	// maxConcurrentDownloads is the maximum number of blobs downloaded concurrently by a Decode call.
+	maxConcurrentDownloads int
+	// metadataAllowlist are the only metadata keys sent to LargePayloadService. All keys are sent if nil.
+	metadataAllowlist map[string]bool
+	// metadataDenylist are the metadata keys which are never sent to LargePayloadService.
+	metadataDenylist map[string]bool
+	// preserveNamespace when set to true re-encodes payloads decoded from blobs of other namespaces to the same blobs.
+	preserveNamespace bool
+	// existenceCheck when set to true checks whether a blob already exists before uploading it.
+	existenceCheck bool
+	// transport transfers blobs to and from LargePayloadService.
+	transport Transport
+	// retryAttempts is the number of attempts of requests sent to LargePayloadService.
+	retryAttempts int
+	// retryInterval is the initial interval between attempts of a request.
+	retryInterval time.Duration
+	// retryableStatusCodes are the status codes of responses which are retried.
+	retryableStatusCodes map[int]bool
+	// sleep waits between attempts of a request. Replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+	// healthCheckAttempts is the number of attempts of the health check.
+	healthCheckAttempts int
+	// healthCheckInterval is the initial interval between health check attempts.
+	healthCheckInterval time.Duration
+	// lazyHealthCheck when set to true defers the health check to the first Encode or Decode call.
+	lazyHealthCheck bool
+	// healthy is set once the deferred health check succeeded.
+	healthy atomic.Bool
+	// healthMu serializes deferred health checks.
+	healthMu sync.Mutex
+	// healthMonitorInterval is the interval of the background health checks. The health monitor is disabled if zero.
+	healthMonitorInterval time.Duration
+	// unhealthy is set while the last background health check failed.
+	unhealthy atomic.Bool
+	// maxBlobBytes is the maximum blob size advertised by the server, or zero if unknown.
+	maxBlobBytes atomic.Int64
+	// inlineFallback when set to true keeps payloads inline instead of failing while LargePayloadService is unhealthy.
+	inlineFallback bool
+	// digestVerification controls how size and checksum mismatches of decoded payloads are handled.
+	digestVerification DigestVerificationMode
+	// digestVerifier returns the hashes of digest algorithms other than sha256. Not used if nil.
+	digestVerifier DigestVerifier
+	// digestAlgorithm is the algorithm of the digests of encoded payloads.
+	digestAlgorithm string
+	// stubMetadataKeys are the keys of the original metadata copied to encoded payloads.
+	stubMetadataKeys []string
+	// envelopeFormat is the format of the remote payload envelope stored in workflow history.
+	envelopeFormat string
+	// userAgent is sent in the User-Agent header of all requests to LargePayloadService.
+	userAgent string
+	// breaker fails requests to LargePayloadService fast after repeated failures. Not used if nil.
+	breaker *circuitBreaker
+	// hedgeDelay is the delay after which another identical GET is sent. Hedging is disabled if zero.
+	hedgeDelay time.Duration
+	// hedgeMaxExtra is the maximum number of additional GETs sent per download.
+	hedgeMaxExtra int
+	// closed is set once Close has been called.
+	closed atomic.Bool
+	// closeOnce ensures resources are released only once.
+	closeOnce sync.Once
+	// done is closed by Close to stop background goroutines.
+	done chan struct{}
+	// stats are the cumulative statistics returned by Stats.
+	stats stats
+	// expvarName is the name under which the statistics are published with expvar. Not published if empty.
+	expvarName string
+	// dryRun when set to true only records the offload decisions of Encode without offloading payloads.
+	dryRun bool
+	// dryRunPayloads, dryRunBytes, dryRunOffloadedPayloads, dryRunOffloadedBytes and dryRunSavedBytes back DryRunStats.
+	dryRunPayloads          atomic.Int64
+	dryRunBytes             atomic.Int64
+	dryRunOffloadedPayloads atomic.Int64
+	dryRunOffloadedBytes    atomic.Int64
+	dryRunSavedBytes        atomic.Int64
+	// background tracks the background goroutines, so that Close can wait for them to stop.
+	background sync.WaitGroup
 }
 
+// DigestVerificationMode controls how the size and checksum of decoded payloads are verified.
+type DigestVerificationMode int
+
+const (
+	// DigestVerificationStrict fails decoding if the size or checksum of a payload does not match.
+	DigestVerificationStrict DigestVerificationMode = iota
+	// DigestVerificationWarn logs size or checksum mismatches as errors, but returns the payload.
+	DigestVerificationWarn
+	// DigestVerificationSkip does not verify the size or checksum of payloads.
+	DigestVerificationSkip
+)
+
 type keyResponse struct {
 	Key string `json:"key"`
 }
@@ -60,6 +249,8 @@ type remotePayload struct {
 	Digest string `json:"digest"`
 	// The key to retrieve the payload from remote storage.
 	Key string `json:"key"`
+	// Digest of the Metadata, see metadata.Hash. Empty for payloads encoded by older codecs.
+	MetadataDigest string `json:"metadataDigest,omitempty"`
 }
 
 type Option interface {
@@ -80,8 +271,47 @@ func addCustomHeaders(req *http.Request, headers map[string][]string) {
 	}
 }
 
+// setRequestHeaders adds the User-Agent, request ID, custom and authentication headers to a request sent to LargePayloadService.
+func (c *Codec) setRequestHeaders(req *http.Request) error {
+	req.Header.Set("User-Agent", c.userAgent)
+	addCustomHeaders(req, c.customHeaders)
+	if c.headerProvider != nil {
+		headers, err := c.headerProvider(req.Context())
+		if err != nil {
+			return fmt.Errorf("unable to get request headers: %w", err)
+		}
+		for header, values := range headers {
+			req.Header.Del(header)
+			for _, value := range values {
+				req.Header.Add(header, value)
+			}
+		}
+	}
+	if c.tokenProvider != nil {
+		token, err := c.tokenProvider(req.Context())
+		if err != nil {
+			return fmt.Errorf("unable to get bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.basicAuth != nil {
+		password, _ := c.basicAuth.Password()
+		req.SetBasicAuth(c.basicAuth.Username(), password)
+	}
+	// IDs set with custom headers are kept, retries of the request are sent with the same ID
+	if req.Header.Get(requestIDHeader) == "" {
+		if id := newRequestID(); id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+	}
+	return nil
+}
+
 // WithURL sets the endpoint for the remote payload storage service.
 // This option is mandatory.
+//
+// URLs of the form unix:///var/run/lps.sock connect to a service listening on a unix domain
+// socket, e.g. when it runs as a sidecar.
 func WithURL(u string) Option {
 	return applier(func(c *Codec) error {
 		lpsURL, err := url.Parse(u)
@@ -93,10 +323,45 @@ func WithURL(u string) Option {
 	})
 }
 
+// WithReadURL adds the endpoint of an additional remote payload storage service, which is
+// used for downloading payloads that are not found at the endpoint configured with WithURL.
+// This allows migrating to a new service while payloads are still stored in the old one.
+//
+// The option can be repeated, in which case the endpoints are tried in order. Payloads are
+// only uploaded to, and health checks only sent to, the endpoint configured with WithURL.
+// Successful downloads from additional endpoints are logged.
+func WithReadURL(u string) Option {
+	return applier(func(c *Codec) error {
+		readURL, err := url.Parse(u)
+		if err != nil {
+			return errors.New("invalid remote codec read URL")
+		}
+		if readURL.Scheme == "unix" {
+			return errors.New("unix socket URLs are not supported as read URL")
+		}
+		c.readURLs = append(c.readURLs, readURL)
+		return nil
+	})
+}
+
+// WithBasePath sets the path prefix under which the remote payload storage service configured
+// with WithURL is mounted, e.g. "/lps" for a server created with server.WithBasePath("/lps").
+// It is appended to the path of the URL, and is needed with unix socket URLs, whose path is
+// the socket. Leading and trailing slashes are optional.
+func WithBasePath(basePath string) Option {
+	return applier(func(c *Codec) error {
+		c.basePath = strings.Trim(basePath, "/")
+		return nil
+	})
+}
+
 // WithMinBytes configures the minimum size of an event payload needed to trigger
 // encoding using the large payload codec. Any payload smaller than this value
 // will be transparently persisted in workflow history.
 //
+// The size of a payload is the length of its data, which is also the size of the
+// stored blob. Payload metadata and protobuf framing are not taken into account.
+//
 // The default value is 128000, or 128KB.
 //
 // Setting this too low can lead to degraded performance, since decoding requires
@@ -125,6 +390,24 @@ func WithMinBytes(bytes uint32) Option {
 	})
 }
 
+// WithMinBytesForEncoding overrides the minimum size configured with WithMinBytes for
+// payloads whose "encoding" metadata matches encoding, e.g. "json/plain" or
+// "binary/protobuf".
+//
+// Payloads with other encodings keep using the size configured with WithMinBytes.
+func WithMinBytesForEncoding(encoding string, bytes uint32) Option {
+	return applier(func(c *Codec) error {
+		if encoding == "" {
+			return errors.New("encoding cannot be empty")
+		}
+		if c.minBytesByEncoding == nil {
+			c.minBytesByEncoding = make(map[string]int)
+		}
+		c.minBytesByEncoding[encoding] = int(bytes)
+		return nil
+	})
+}
+
 // WithHTTPClient sets a custom http.Client.
 //
 // If unspecified, http.DefaultClient will be used.
@@ -136,14 +419,34 @@ func WithHTTPClient(client *http.Client) Option {
 }
 
 // WithNamespace sets the Temporal namespace the client using this codec is connected to.
-// This option is mandatory.
+// This option is mandatory. The namespace may only contain letters, digits, '_', '-' and '.',
+// as the server rejects other namespaces.
 func WithNamespace(namespace string) Option {
 	return applier(func(c *Codec) error {
+		if err := v2.ValidateNamespace(namespace); err != nil {
+			return err
+		}
 		c.namespace = namespace
 		return nil
 	})
 }
 
+// WithNamespaceProvider sets a function returning the Temporal namespace under which an
+// encoded payload is stored. It is called for every offloaded payload with the context
+// passed to EncodeWithContext, which allows a single codec to serve several namespaces.
+//
+// If the function returns an empty string, the namespace configured with WithNamespace is
+// used. Decoding is unaffected, since the key of a stored payload includes its namespace.
+func WithNamespaceProvider(provider func(ctx context.Context, payload *common.Payload) string) Option {
+	return applier(func(c *Codec) error {
+		if provider == nil {
+			return errors.New("namespace provider cannot be nil")
+		}
+		c.namespaceProvider = provider
+		return nil
+	})
+}
+
 // WithVersion sets the version of the LPS API to use.
 func WithVersion(version string) Option {
 	return applier(func(c *Codec) error {
@@ -160,6 +463,315 @@ func WithoutUrlHealthCheck() Option {
 	})
 }
 
+// WithStartupHealthCheckRetry retries a failed health check up to attempts times in total,
+// waiting interval before the first retry and doubling the interval after each retry.
+//
+// This allows the codec to be created while LargePayloadService is still starting up.
+func WithStartupHealthCheckRetry(attempts int, interval time.Duration) Option {
+	return applier(func(c *Codec) error {
+		if attempts < 1 {
+			return errors.New("health check attempts must be at least 1")
+		}
+		if interval <= 0 {
+			return errors.New("health check interval must be positive")
+		}
+		c.healthCheckAttempts = attempts
+		c.healthCheckInterval = interval
+		return nil
+	})
+}
+
+// WithTransport sets the Transport used to store and retrieve blobs, replacing the default
+// transport which talks to the LPS server over HTTP. WithURL is optional if a custom
+// transport is configured; without it, Exists and Delete are not available.
+//
+// Options configuring HTTP requests, such as WithHTTPClient, WithRetries or
+// WithPresignedTransfers, have no effect on custom transports.
+func WithTransport(transport Transport) Option {
+	return applier(func(c *Codec) error {
+		if transport == nil {
+			return errors.New("transport cannot be nil")
+		}
+		c.transport = transport
+		return nil
+	})
+}
+
+// WithRetries retries failed requests sent to LargePayloadService up to attempts times in
+// total, waiting interval before the first retry and doubling the interval after each retry.
+// If a response carries a Retry-After header, the codec waits at least as long as requested.
+//
+// Transport errors and responses with retryable status codes are retried, see
+// WithRetryableStatusCodes. Requests whose body cannot be sent again, e.g. uploads of
+// PutBlob, are never retried.
+//
+// Uploads are sent with a random Idempotency-Key header, which is kept for their retries, so
+// that servers answer retries of uploads which completed with the same response.
+//
+// Downloads interrupted while reading the blob are resumed where they stopped using a Range
+// request. If the server does not support ranges, the blob is downloaded again entirely.
+func WithRetries(attempts int, interval time.Duration) Option {
+	return applier(func(c *Codec) error {
+		if attempts < 1 {
+			return errors.New("retry attempts must be at least 1")
+		}
+		if interval <= 0 {
+			return errors.New("retry interval must be positive")
+		}
+		c.retryAttempts = attempts
+		c.retryInterval = interval
+		return nil
+	})
+}
+
+// WithRetryableStatusCodes sets the status codes of responses which are retried if
+// WithRetries is configured. By default, 429, 502, 503 and 504 responses are retried.
+//
+// Client errors other than 429 are never retried, even if listed, since they are not
+// expected to go away.
+func WithRetryableStatusCodes(codes ...int) Option {
+	return applier(func(c *Codec) error {
+		c.retryableStatusCodes = make(map[int]bool, len(codes))
+		for _, code := range codes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid status code: %d", code)
+			}
+			c.retryableStatusCodes[code] = true
+		}
+		return nil
+	})
+}
+
+// WithLazyHealthCheck defers the health check from initialisation to the first Encode or Decode call.
+//
+// Until a health check succeeds, each Encode and Decode call performs the health check and
+// returns an error if it fails.
+func WithLazyHealthCheck() Option {
+	return applier(func(c *Codec) error {
+		c.lazyHealthCheck = true
+		return nil
+	})
+}
+
+// WithHealthMonitor checks the health of LargePayloadService every interval in the
+// background, as reported by Healthy. While the last check failed, Encode fails fast with
+// ErrUnhealthy for payloads which would be offloaded, or keeps them inline if
+// WithInlineFallback is configured. The monitor stops when the codec is closed.
+func WithHealthMonitor(interval time.Duration) Option {
+	return applier(func(c *Codec) error {
+		if interval <= 0 {
+			return errors.New("health monitor interval must be positive")
+		}
+		c.healthMonitorInterval = interval
+		return nil
+	})
+}
+
+// WithInlineFallback keeps payloads inline instead of offloading them while the health
+// monitor configured with WithHealthMonitor considers LargePayloadService unhealthy.
+//
+// Payloads kept inline count towards the Temporal history size and may exceed its limits.
+func WithInlineFallback() Option {
+	return applier(func(c *Codec) error {
+		c.inlineFallback = true
+		return nil
+	})
+}
+
+// WithDigestVerification sets how the size and checksum of decoded payloads are verified.
+// The mode applies to the checksum of the payload metadata as well.
+//
+// The default is DigestVerificationStrict. The other modes are meant as an escape hatch
+// for recovering from incidents in which stored blobs were modified, for example by
+// storage lifecycle tooling.
+func WithDigestVerification(mode DigestVerificationMode) Option {
+	return applier(func(c *Codec) error {
+		switch mode {
+		case DigestVerificationStrict, DigestVerificationWarn, DigestVerificationSkip:
+			c.digestVerification = mode
+			return nil
+		default:
+			return fmt.Errorf("invalid digest verification mode: %d", mode)
+		}
+	})
+}
+
+// WithDigestVerifier registers digest algorithms other than sha256, e.g. for blobs written
+// by other systems with their own checksums. Payloads whose digest uses such an algorithm
+// are verified with the hashes returned by verifier.
+//
+// Only sha256 is supported unless a verifier is configured. See WithDigestAlgorithm for
+// encoding payloads with other algorithms.
+func WithDigestVerifier(verifier DigestVerifier) Option {
+	return applier(func(c *Codec) error {
+		if verifier == nil {
+			return errors.New("digest verifier cannot be nil")
+		}
+		c.digestVerifier = verifier
+		return nil
+	})
+}
+
+// WithDigestAlgorithm sets the algorithm of the digests computed for encoded payloads. The
+// default is sha256. Other algorithms must be supported by the verifier configured with
+// WithDigestVerifier, as well as by the LPS server, see v2.RegisterHash.
+func WithDigestAlgorithm(algorithm string) Option {
+	return applier(func(c *Codec) error {
+		if algorithm == "" || strings.Contains(algorithm, ":") {
+			return fmt.Errorf("invalid digest algorithm: %q", algorithm)
+		}
+		c.digestAlgorithm = algorithm
+		return nil
+	})
+}
+
+// WithCircuitBreaker enables a circuit breaker for requests sent to LargePayloadService.
+//
+// After threshold consecutive failed requests (transport errors or 5xx responses), all
+// requests fail immediately with ErrCircuitOpen for the cooldown duration. Afterwards a
+// single probe request is let through, which either closes the circuit again or keeps it
+// open for another cooldown. The breaker is shared by all goroutines using the codec.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return applier(func(c *Codec) error {
+		if threshold < 1 {
+			return errors.New("circuit breaker threshold must be at least 1")
+		}
+		if cooldown <= 0 {
+			return errors.New("circuit breaker cooldown must be positive")
+		}
+		c.breaker = newCircuitBreaker(threshold, cooldown)
+		return nil
+	})
+}
+
+// WithHedgedReads enables hedging of payload downloads to reduce tail latency.
+//
+// If a GET has not returned within delay, another identical request is sent, up to maxExtra
+// additional requests per download. The first response is used and all other requests are
+// canceled. Uploads are never hedged. The number of additional requests is reported by
+// HedgedRequests and Stats, and counted as lps_hedged_requests_total by the metrics handler
+// set with WithTemporalMetricsHandler.
+func WithHedgedReads(delay time.Duration, maxExtra int) Option {
+	return applier(func(c *Codec) error {
+		if delay <= 0 {
+			return errors.New("hedge delay must be positive")
+		}
+		if maxExtra < 1 {
+			return errors.New("hedge max extra requests must be at least 1")
+		}
+		c.hedgeDelay = delay
+		c.hedgeMaxExtra = maxExtra
+		return nil
+	})
+}
+
+// WithEnvelopeFormat sets the format of the envelope referencing an offloaded payload,
+// which is stored in workflow history in place of the original payload. Valid formats are
+// EnvelopeFormatJSON (the default) and EnvelopeFormatProto, which produces smaller
+// envelopes since binary metadata values are not base64 encoded.
+//
+// Decoding supports both formats, independent of this option.
+func WithEnvelopeFormat(format string) Option {
+	return applier(func(c *Codec) error {
+		switch format {
+		case EnvelopeFormatJSON, EnvelopeFormatProto:
+			c.envelopeFormat = format
+			return nil
+		default:
+			return fmt.Errorf("unknown envelope format %q", format)
+		}
+	})
+}
+
+// WithStubMetadataKeys sets the keys of the original payload metadata which are copied to
+// the encoded payload stored in workflow history, prefixed with "remote-codec/original-".
+// This allows identifying offloaded payloads, e.g. in the Temporal UI. The size of the
+// original payload data is always added as "remote-codec/original-size".
+//
+// By default, the "encoding" and "messageType" metadata are copied. Calling this option
+// without keys disables copying metadata, e.g. to avoid exposing sensitive values.
+func WithStubMetadataKeys(keys ...string) Option {
+	return applier(func(c *Codec) error {
+		for _, key := range keys {
+			if key == "" {
+				return errors.New("stub metadata key cannot be empty")
+			}
+		}
+		c.stubMetadataKeys = keys
+		return nil
+	})
+}
+
+// WithMissingBlobPlaceholder makes Decode return a placeholder payload for blobs which do
+// not exist in LargePayloadService anymore, e.g. because they were deleted by a retention
+// policy, instead of failing. This allows inspecting the history of old workflows.
+//
+// The data of the placeholder is a JSON document describing the missing blob, with the
+// "key", "digest" and "size" of the original payload. Its metadata marks it with
+// MetadataMissingBlob.
+//
+// This option must not be used by workers, since replaying workflows with placeholder
+// payloads would silently produce wrong results.
+func WithMissingBlobPlaceholder() Option {
+	return applier(func(c *Codec) error {
+		c.missingBlobPlaceholder = true
+		return nil
+	})
+}
+
+// WithMetadataAllowlist restricts the payload metadata sent to LargePayloadService and
+// stored in the envelope to the given keys. The remote-codec/* metadata used by the codec
+// is always sent.
+//
+// All other metadata is withheld from LargePayloadService: it is only kept in the encoded
+// payload stored in workflow history, prefixed with "remote-codec/withheld-", and merged
+// back into the metadata of the decoded payload. Withheld metadata is not covered by the
+// integrity check of decoded payloads.
+//
+// If combined with WithMetadataDenylist, keys on both lists are withheld.
+func WithMetadataAllowlist(keys ...string) Option {
+	return applier(func(c *Codec) error {
+		c.metadataAllowlist = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			if key == "" {
+				return errors.New("metadata allowlist key cannot be empty")
+			}
+			c.metadataAllowlist[key] = true
+		}
+		return nil
+	})
+}
+
+// WithMetadataDenylist withholds the payload metadata with the given keys from
+// LargePayloadService, as described for WithMetadataAllowlist. The denylist takes
+// precedence over the allowlist.
+func WithMetadataDenylist(keys ...string) Option {
+	return applier(func(c *Codec) error {
+		c.metadataDenylist = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			if key == "" {
+				return errors.New("metadata denylist key cannot be empty")
+			}
+			if strings.HasPrefix(key, codecMetadataPrefix) {
+				return fmt.Errorf("metadata key %s used by the codec cannot be denied", key)
+			}
+			c.metadataDenylist[key] = true
+		}
+		return nil
+	})
+}
+
+// WithDryRun makes Encode evaluate which payloads would be offloaded, computing their keys
+// and logging and recording the decisions, without uploading anything. Encode returns the
+// payloads unchanged. Decode is not affected, so payloads which were offloaded before can
+// still be decoded. The decisions are summarized by DryRunStats.
+func WithDryRun() Option {
+	return applier(func(c *Codec) error {
+		c.dryRun = true
+		return nil
+	})
+}
+
 // WithDecodeOnly set whether to skip the Url health check during initialisation.
 func WithDecodeOnly() Option {
 	return applier(func(c *Codec) error {
@@ -195,6 +807,36 @@ func WithCustomHeader(header string, value string) Option {
 	})
 }
 
+// WithHeaderProvider sets a function returning headers to add to each request sent to
+// LargePayloadService, e.g. headers depending on the workflow being processed. The function
+// is called with the context passed to EncodeWithContext or DecodeWithContext, so that
+// interceptors can pass information to it. The returned headers replace custom headers of
+// the same name configured with WithCustomHeader. A nil result adds no headers.
+//
+// If the function returns an error, the request is not sent and the error is returned.
+func WithHeaderProvider(provider func(ctx context.Context) (http.Header, error)) Option {
+	return applier(func(c *Codec) error {
+		if provider == nil {
+			return errors.New("header provider cannot be nil")
+		}
+		c.headerProvider = provider
+		return nil
+	})
+}
+
+// WithUserAgentSuffix appends suffix to the User-Agent header sent to LargePayloadService,
+// which identifies the codec version by default. This allows identifying individual
+// applications in the server access logs.
+func WithUserAgentSuffix(suffix string) Option {
+	return applier(func(c *Codec) error {
+		if suffix == "" {
+			return errors.New("empty user agent suffix")
+		}
+		c.userAgent = defaultUserAgent + " " + suffix
+		return nil
+	})
+}
+
 // WithHTTPRoundTripper sets custom Transport on the http.Client.
 //
 // This may be used to implement use cases including authentication or tracing.
@@ -204,186 +846,1263 @@ func WithHTTPRoundTripper(rt http.RoundTripper) Option {
 			return fmt.Errorf("no http client option set")
 		}
 		c.client.Transport = rt
+		c.customRoundTripper = true
 		return nil
 	})
 }
 
-// New instantiates a Codec. WithURL is a required option.
+// WithTracerProvider enables OpenTelemetry tracing of the requests sent to LargePayloadService.
 //
-// An error may be returned if incompatible options are configured or if a
-// connection to the remote payload storage service cannot be established.
-func New(opts ...Option) (*Codec, error) {
-	c := Codec{
-		client: http.DefaultClient,
-		// 128KB happens to be the lower bound for blobs eligible for AWS S3
-		// Intelligent-Tiering:
-		// https://aws.amazon.com/s3/storage-classes/intelligent-tiering/
-		minBytes: 128_000,
-	}
-
-	for _, opt := range opts {
-		if err := opt.apply(&c); err != nil {
-			return nil, err
+// A client span is created for each blob PUT and GET, and the W3C trace context is
+// propagated to the server via the traceparent header.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return applier(func(c *Codec) error {
+		if tp == nil {
+			return errors.New("tracer provider cannot be nil")
 		}
-	}
-
-	if c.namespace == "" {
-		return nil, fmt.Errorf("a namespace is required")
-	}
-
-	// Check for required attributes
-	if c.client == nil {
-		return nil, fmt.Errorf("an http client is required")
-	}
-	if c.url == nil {
-		return nil, fmt.Errorf("a remote codec URL is required")
-	}
-
-	if c.version == "" {
-		c.version = "v2"
-	}
-
-	if c.version != "v2" {
-		return nil, fmt.Errorf("invalid codec version: %s", c.version)
-	}
-
-	if !c.skipUrlHealthCheck {
-		// Check connectivity
-		headURL := c.url.JoinPath(c.version, "health", "head")
-		req, err := http.NewRequest(http.MethodHead, headURL.String(), nil)
-		addCustomHeaders(req, c.customHeaders)
-		resp, err := c.client.Do(req)
+		c.tracer = tp.Tracer(tracerName)
+		return nil
+	})
+}
 
-		if err != nil {
-			return nil, err
+// WithLogger sets the logger used by the codec.
+//
+// Offload decisions and requests sent to LargePayloadService are logged at debug level,
+// failures at error level. If unspecified, no logs are emitted.
+func WithLogger(logger logging.Logger) Option {
+	return applier(func(c *Codec) error {
+		if logger == nil {
+			return errors.New("logger cannot be nil")
 		}
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("got status code %d from storage service at %s", resp.StatusCode, headURL)
+		c.logger = logger
+		return nil
+	})
+}
+
+// WithTemporalMetricsHandler records metrics of encoded and decoded payloads with handler,
+// e.g. the metrics handler of the Temporal client. The counters lps_encode_total,
+// lps_decode_total, lps_errors_total and lps_payload_bytes and the timers lps_put_latency
+// and lps_get_latency are tagged with the namespace and the operation (encode or decode).
+// The counter lps_hedged_requests_total counts the additional GETs sent with WithHedgedReads.
+func WithTemporalMetricsHandler(handler client.MetricsHandler) Option {
+	return applier(func(c *Codec) error {
+		if handler == nil {
+			return errors.New("metrics handler cannot be nil")
 		}
-	}
+		c.metricsHandler = handler
+		return nil
+	})
+}
 
-	return &c, nil
+// WithExpvar publishes the statistics returned by Stats with the expvar package under name,
+// e.g. for inspecting them at /debug/vars. Since expvar does not allow removing variables,
+// name cannot be used by another codec in the same process, even after this one is closed.
+func WithExpvar(name string) Option {
+	return applier(func(c *Codec) error {
+		if name == "" {
+			return errors.New("expvar name cannot be empty")
+		}
+		c.expvarName = name
+		return nil
+	})
+}
+
+// WithDecodeCache enables an in-memory LRU cache of decoded payloads, bounded by
+// maxBytes of payload data.
+//
+// This avoids downloading the same blobs over and over again, for example during
+// workflow replay. Payloads larger than maxBytes are never cached.
+func WithDecodeCache(maxBytes int) Option {
+	return applier(func(c *Codec) error {
+		if maxBytes <= 0 {
+			return errors.New("decode cache size must be positive")
+		}
+		c.cache = newDecodeCache(maxBytes)
+		return nil
+	})
+}
+
+// WithChunkSize sets the size of the parts in which payloads are uploaded if the LPS server
+// rejects them as too large for a single upload. The default is 64MiB. If the server does
+// not offer chunked uploads, Encode fails with ErrPayloadTooLarge.
+func WithChunkSize(n int) Option {
+	return applier(func(c *Codec) error {
+		if n < 1 {
+			return errors.New("chunk size must be positive")
+		}
+		c.chunkSize = n
+		return nil
+	})
+}
+
+// WithUploadMethod sets the HTTP method of blob uploads, which is PUT by default. POST is
+// accepted by LPS servers as well, for proxies which block PUT requests. The parts of chunked
+// uploads, see WithChunkSize, are always sent with PUT.
+func WithUploadMethod(method string) Option {
+	return applier(func(c *Codec) error {
+		method = strings.ToUpper(method)
+		if method != http.MethodPut && method != http.MethodPost {
+			return fmt.Errorf("invalid upload method %q: must be PUT or POST", method)
+		}
+		c.uploadMethod = method
+		return nil
+	})
+}
+
+// WithExpectContinue sends blob uploads with the Expect: 100-continue header, so that their
+// data is only transmitted once the LPS server accepted the request, e.g. its size and
+// authorization, and not at all for blobs which exist already. Requests are only held back
+// by http.Transport if its ExpectContinueTimeout is set, as it is for http.DefaultTransport.
+func WithExpectContinue() Option {
+	return applier(func(c *Codec) error {
+		c.expectContinue = true
+		return nil
+	})
+}
+
+// WithMaxConcurrentUploads uploads the blobs of the payloads passed to a single Encode call
+// concurrently, with up to n uploads in flight. The order of the encoded payloads is
+// preserved. If a payload cannot be encoded, the uploads in flight are canceled and Encode
+// returns the error. By default, blobs are uploaded one after the other.
+func WithMaxConcurrentUploads(n int) Option {
+	return applier(func(c *Codec) error {
+		if n < 1 {
+			return errors.New("max concurrent uploads must be at least 1")
+		}
+		c.maxConcurrentUploads = n
+		return nil
+	})
+}
+
+// WithMaxInflightBytes uploads the blobs of the payloads passed to a single Encode call
+// concurrently, as long as their total size does not exceed n bytes. This bounds the memory
+// held by an Encode call for large batches. A payload larger than n is uploaded alone.
+//
+// The number of concurrent uploads can be limited further with WithMaxConcurrentUploads.
+func WithMaxInflightBytes(n int64) Option {
+	return applier(func(c *Codec) error {
+		if n < 1 {
+			return errors.New("max inflight bytes must be positive")
+		}
+		c.maxInflightBytes = n
+		return nil
+	})
+}
+
+// WithMaxConcurrentDownloads downloads the blobs of the payloads passed to a single Decode
+// call concurrently, with up to n downloads in flight. The order of the decoded payloads is
+// preserved. If a payload cannot be decoded, the downloads in flight are canceled and Decode
+// returns the error. By default, blobs are downloaded one after the other.
+//
+// Blobs referenced by several payloads of a Decode call are downloaded only once, whether
+// or not downloads are concurrent.
+func WithMaxConcurrentDownloads(n int) Option {
+	return applier(func(c *Codec) error {
+		if n < 1 {
+			return errors.New("max concurrent downloads must be at least 1")
+		}
+		c.maxConcurrentDownloads = n
+		return nil
+	})
+}
+
+// WithPresignedTransfers enables direct transfers of blobs to and from the object storage
+// backing LargePayloadService using presigned URLs, so that blob data does not flow through
+// the LPS server.
+//
+// If the server's storage driver does not support presigned URLs, the codec falls back to
+// transferring blobs via the LPS server.
+func WithPresignedTransfers() Option {
+	return applier(func(c *Codec) error {
+		c.presignedTransfers = true
+		return nil
+	})
+}
+
+// WithBatchDownloads enables downloading the blobs of all payloads passed to Decode with a
+// single request, which saves round trips when decoding many small payloads, for example
+// during workflow replay. The size and digest of each payload are verified as usual.
+//
+// Blobs which are missing from the batch response are downloaded individually. If the
+// server does not support batch downloads, the codec falls back to individual downloads.
+func WithBatchDownloads() Option {
+	return applier(func(c *Codec) error {
+		c.batchDownloads = true
+		return nil
+	})
+}
+
+// WithBearerToken sets a static bearer token which is sent in the Authorization header
+// of every request sent to LargePayloadService.
+func WithBearerToken(token string) Option {
+	return WithTokenProvider(func(context.Context) (string, error) {
+		return token, nil
+	})
+}
+
+// WithTokenProvider sets a function returning the bearer token which is sent in the
+// Authorization header of every request sent to LargePayloadService.
+//
+// The provider is invoked for each request, which allows expiring tokens to be refreshed.
+// If the provider returns an error, the request is not sent and the error is returned.
+func WithTokenProvider(provider func(ctx context.Context) (string, error)) Option {
+	return applier(func(c *Codec) error {
+		if provider == nil {
+			return errors.New("token provider cannot be nil")
+		}
+		if c.tokenProvider != nil {
+			return errors.New("only one of WithBearerToken and WithTokenProvider may be set")
+		}
+		c.tokenProvider = provider
+		return nil
+	})
+}
+
+// WithBasicAuth sets the credentials sent in the Authorization header of every request sent
+// to LargePayloadService using HTTP basic authentication.
+//
+// This option cannot be combined with WithBearerToken or WithTokenProvider.
+func WithBasicAuth(username string, password string) Option {
+	return applier(func(c *Codec) error {
+		if username == "" {
+			return errors.New("basic auth username cannot be empty")
+		}
+		c.basicAuth = url.UserPassword(username, password)
+		return nil
+	})
+}
+
+// WithTLSConfig sets the TLS configuration used for connecting to LargePayloadService.
+//
+// The configuration is applied to a clone of the transport of the http client, or of
+// http.DefaultTransport if the client does not specify one. It cannot be combined with
+// WithHTTPRoundTripper.
+func WithTLSConfig(config *tls.Config) Option {
+	return applier(func(c *Codec) error {
+		if config == nil {
+			return errors.New("TLS config cannot be nil")
+		}
+		c.tlsConfig = config.Clone()
+		return nil
+	})
+}
+
+// WithHTTP2 sends requests to LargePayloadService over HTTP/2, so that concurrent uploads and
+// downloads share a single connection. Requests to http and unix socket URLs use HTTP/2
+// without TLS (h2c) with prior knowledge, which the server must accept, see server.WithH2C,
+// while requests to https URLs negotiate HTTP/2 during the TLS handshake.
+//
+// The option is applied to a clone of the transport of the http client, or of
+// http.DefaultTransport if the client does not specify one. It cannot be combined with
+// WithHTTPRoundTripper.
+func WithHTTP2() Option {
+	return applier(func(c *Codec) error {
+		c.http2 = true
+		return nil
+	})
+}
+
+// WithCACertFile sets the PEM encoded CA certificates used to verify the certificate of
+// LargePayloadService, for example when it uses an internal CA.
+//
+// It may be combined with WithTLSConfig, in which case the root CAs of that configuration
+// are replaced.
+func WithCACertFile(path string) Option {
+	return applier(func(c *Codec) error {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read CA certificate file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid CA certificates found in %s", path)
+		}
+		if c.tlsConfig == nil {
+			c.tlsConfig = &tls.Config{}
+		}
+		c.tlsConfig.RootCAs = pool
+		return nil
+	})
+}
+
+// WithKeyPrefixFunc sets a function which is called for each payload to be stored in
+// LargePayloadService, returning the prefix of the key under which the payload is stored.
+//
+// The prefix is sent as remote-codec/key-prefix metadata, taking precedence over any prefix
+// already present in the payload's metadata. The caller's payload is not modified.
+// Returning an empty string means no prefix is added. Prefixes may only contain
+// alphanumeric characters, '_', '-' and '/'.
+func WithKeyPrefixFunc(f func(payload *common.Payload) string) Option {
+	return applier(func(c *Codec) error {
+		if f == nil {
+			return errors.New("key prefix func cannot be nil")
+		}
+		c.keyPrefixFunc = f
+		return nil
+	})
+}
+
+// WithPreserveNamespaceOnReencode keeps payloads in the namespace they were originally
+// encoded in, e.g. for workflow histories replicated to another namespace for disaster
+// recovery. Payloads decoded from blobs of another namespace carry the key of the blob in
+// the remote-codec/origin-key metadata. When such a payload is encoded again unchanged,
+// the envelope references the original blob instead of storing a copy of it under the
+// configured namespace. The remote-codec/origin-key metadata is never stored.
+func WithPreserveNamespaceOnReencode() Option {
+	return applier(func(c *Codec) error {
+		c.preserveNamespace = true
+		return nil
+	})
+}
+
+// WithStripKeyPrefixOnDecode removes the remote-codec/key-prefix metadata, and any other
+// metadata with the remote-codec/ prefix, from decoded payloads. The metadata is still sent
+// to LargePayloadService when encoding payloads.
+func WithStripKeyPrefixOnDecode() Option {
+	return applier(func(c *Codec) error {
+		c.stripCodecMetadata = true
+		return nil
+	})
+}
+
+// WithExistenceCheck configures whether the codec checks if a blob already exists in
+// LargePayloadService before uploading it.
+//
+// The check is a cheap HEAD request which avoids sending the payload data if it is already
+// stored, for example when the same large input is passed to many activities. Disabling the
+// check saves a round trip per encoded payload if payloads are mostly unique.
+//
+// The existence check is enabled by default.
+func WithExistenceCheck(enabled bool) Option {
+	return applier(func(c *Codec) error {
+		c.existenceCheck = enabled
+		return nil
+	})
+}
+
+// New instantiates a Codec. WithURL is a required option.
+//
+// An error may be returned if incompatible options are configured or if a
+// connection to the remote payload storage service cannot be established.
+func New(opts ...Option) (*Codec, error) {
+	c := Codec{
+		client: http.DefaultClient,
+		// 128KB happens to be the lower bound for blobs eligible for AWS S3
+		// Intelligent-Tiering:
+		// https://aws.amazon.com/s3/storage-classes/intelligent-tiering/
+		minBytes:             128_000,
+		logger:               logging.NewNoopLogger(),
+		metricsHandler:       client.MetricsNopHandler,
+		existenceCheck:       true,
+		digestAlgorithm:      defaultDigestAlgorithm,
+		retryAttempts:        1,
+		chunkSize:            defaultChunkSize,
+		uploadMethod:         http.MethodPut,
+		retryableStatusCodes: defaultRetryableStatusCodes,
+		sleep:                sleep,
+		healthCheckAttempts:  1,
+		userAgent:            defaultUserAgent,
+		stubMetadataKeys:     []string{converter.MetadataEncoding, converter.MetadataMessageType},
+		done:                 make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		if err := opt.apply(&c); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.namespace == "" {
+		return nil, fmt.Errorf("a namespace is required")
+	}
+
+	// Check for required attributes
+	if c.client == nil {
+		return nil, fmt.Errorf("an http client is required")
+	}
+	if c.url == nil && c.transport == nil {
+		return nil, fmt.Errorf("a remote codec URL is required")
+	}
+	if c.transport == nil {
+		c.transport = &httpTransport{c: &c}
+	}
+
+	if c.url != nil && c.url.Scheme == "unix" {
+		if err := c.applyUnixSocket(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.url != nil && c.basePath != "" {
+		c.url = c.url.JoinPath(c.basePath)
+	}
+
+	if c.tlsConfig != nil {
+		if err := c.applyTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.http2 && c.url != nil {
+		if err := c.applyHTTP2(); err != nil {
+			return nil, err
+		}
+	}
+
+	// custom digest algorithms must be supported by the digest verifier
+	_, release, err := c.newHash(c.digestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	release()
+
+	if c.basicAuth != nil && c.tokenProvider != nil {
+		return nil, fmt.Errorf("basic auth cannot be combined with a bearer token")
+	}
+
+	if c.version == "" {
+		c.version = "v2"
+	}
+
+	if c.version != "v2" {
+		return nil, fmt.Errorf("invalid codec version: %s", c.version)
+	}
+
+	if !c.skipUrlHealthCheck && !c.lazyHealthCheck {
+		// Check connectivity
+		if err := c.checkHealthWithRetry(context.Background()); err != nil {
+			return nil, err
+		}
+		c.fetchServerLimits(context.Background())
+	}
+
+	if c.expvarName != "" {
+		if expvar.Get(c.expvarName) != nil {
+			return nil, fmt.Errorf("expvar %s is already published", c.expvarName)
+		}
+		expvar.Publish(c.expvarName, expvar.Func(func() interface{} { return c.Stats() }))
+	}
+
+	if c.healthMonitorInterval > 0 {
+		c.background.Add(1)
+		go c.monitorHealth()
+	}
+
+	return &c, nil
+}
+
+// applyTLSConfig replaces the http client with a copy using a transport configured with c.tlsConfig.
+// The original client and its transport are left untouched.
+func (c *Codec) applyTLSConfig() error {
+	if c.customRoundTripper {
+		return errors.New("TLS config cannot be combined with a custom round tripper")
+	}
+
+	var transport *http.Transport
+	switch rt := c.client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = rt.Clone()
+	default:
+		return fmt.Errorf("TLS config cannot be applied to http client transport of type %T", rt)
+	}
+	transport.TLSClientConfig = c.tlsConfig
+
+	client := *c.client
+	client.Transport = transport
+	c.client = &client
+	c.ownsClient = true
+	return nil
+}
+
+// applyHTTP2 replaces the http client with a copy using a transport which sends requests over
+// HTTP/2, dialing connections like the transport of the original client for h2c. The original
+// client and its transport are left untouched.
+func (c *Codec) applyHTTP2() error {
+	if c.customRoundTripper {
+		return errors.New("HTTP/2 cannot be combined with a custom round tripper")
+	}
+
+	var transport *http.Transport
+	switch rt := c.client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = rt.Clone()
+	default:
+		return fmt.Errorf("HTTP/2 cannot be used with http client transport of type %T", rt)
+	}
+
+	client := *c.client
+	if c.url.Scheme == "https" {
+		transport.ForceAttemptHTTP2 = true
+		client.Transport = transport
+	} else {
+		dial := transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		client.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+	}
+	c.client = &client
+	c.ownsClient = true
+	return nil
+}
+
+// applyUnixSocket replaces the http client with a copy using a transport which connects to
+// the unix domain socket of c.url, and rewrites c.url to the dummy host used for requests.
+// The original client and its transport are left untouched.
+func (c *Codec) applyUnixSocket() error {
+	if c.customRoundTripper {
+		return errors.New("unix socket URL cannot be combined with a custom round tripper")
+	}
+	socketPath := c.url.Path
+	if socketPath == "" {
+		return errors.New("unix socket URL requires a socket path")
+	}
+
+	var transport *http.Transport
+	switch rt := c.client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = rt.Clone()
+	default:
+		return fmt.Errorf("unix socket URL cannot be used with http client transport of type %T", rt)
+	}
+	var dialer net.Dialer
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+	transport.Proxy = nil
+
+	client := *c.client
+	client.Transport = transport
+	c.client = &client
+	c.ownsClient = true
+	c.url = &url.URL{Scheme: "http", Host: unixSocketHost}
+	return nil
+}
+
+// Close releases the resources held by the codec, closing the idle connections of the HTTP
+// client it built, e.g. for WithTLSConfig, and stopping background goroutines. Afterwards, all methods of the codec return ErrClosed.
+//
+// Closing a codec more than once has no effect.
+func (c *Codec) Close() error {
+	c.closeOnce.Do(func() {
+		c.closed.Store(true)
+		close(c.done)
+		c.background.Wait()
+		// the connections of clients shared with other users are left open
+		if c.ownsClient {
+			c.client.CloseIdleConnections()
+		}
+	})
+	return nil
 }
 
 func (c *Codec) Encode(payloads []*common.Payload) ([]*common.Payload, error) {
+	return c.EncodeWithContext(context.Background(), payloads)
+}
+
+// EncodeWithContext is like Encode, but uses ctx for the requests sent to LargePayloadService
+// and passes it to the function configured with WithNamespaceProvider.
+func (c *Codec) EncodeWithContext(ctx context.Context, payloads []*common.Payload) ([]*common.Payload, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
 	if c.disableEncoding {
+		c.stats.passthrough.Add(int64(len(payloads)))
 		return payloads, nil
 	}
-	var (
-		ctx    = context.Background()
-		result = make([]*common.Payload, len(payloads))
-	)
+	result := make([]*common.Payload, len(payloads))
+
+	if err := c.ensureHealthy(ctx); err != nil {
+		return nil, err
+	}
+
+	var offload []int
+	originKeys := make([]string, len(payloads))
+	for i, payload := range payloads {
+		payload, originKey := withoutOriginKey(payload)
+		minBytes := c.minBytesFor(payload)
+		size := len(payload.GetData())
+		result[i] = payload
+		if c.dryRun {
+			if err := c.dryRunEncode(ctx, payload, size >= minBytes); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if size >= minBytes && c.unhealthy.Load() {
+			if !c.inlineFallback {
+				return nil, ErrUnhealthy
+			}
+			c.logger.Debug("not offloading payload, LPS is unhealthy", "size", size, "minBytes", minBytes)
+		} else if size >= minBytes {
+			c.logger.Debug("offloading payload", "size", size, "minBytes", minBytes)
+			offload = append(offload, i)
+			originKeys[i] = originKey
+		} else {
+			c.logger.Debug("not offloading payload", "size", size, "minBytes", minBytes)
+		}
+	}
+
+	c.stats.passthrough.Add(int64(len(payloads) - len(offload)))
+
+	encode := func(ctx context.Context, i int) error {
+		encodePayload, err := c.encodePayload(ctx, result[i], originKeys[i])
+		if err != nil {
+			c.logger.Error("unable to encode payload", "error", err)
+			return err
+		}
+		result[i] = encodePayload
+		return nil
+	}
+
+	if (c.maxConcurrentUploads > 1 || c.maxInflightBytes > 0) && len(offload) > 1 {
+		limit := c.maxConcurrentUploads
+		if limit < 1 {
+			limit = len(offload)
+		}
+		var budget *byteBudget
+		if c.maxInflightBytes > 0 {
+			budget = newByteBudget(c.maxInflightBytes)
+		}
+		weight := func(i int) int64 { return int64(len(result[i].GetData())) }
+		if err := forEachConcurrently(ctx, offload, limit, budget, weight, encode); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	for _, i := range offload {
+		if err := encode(ctx, i); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// minBytesFor returns the minimum size of payload in order to use remote codec, based on its encoding.
+func (c *Codec) minBytesFor(payload *common.Payload) int {
+	if minBytes, ok := c.minBytesByEncoding[string(payload.GetMetadata()[converter.MetadataEncoding])]; ok {
+		return minBytes
+	}
+	return c.minBytes
+}
+
+// namespaceFor returns the namespace under which payload is stored.
+func (c *Codec) namespaceFor(ctx context.Context, payload *common.Payload) string {
+	if c.namespaceProvider != nil {
+		if namespace := c.namespaceProvider(ctx, payload); namespace != "" {
+			return namespace
+		}
+	}
+	return c.namespace
+}
+
+// encodePayload offloads payload. If WithPreserveNamespaceOnReencode is configured and
+// payload was decoded from the blob with originKey, the original blob is referenced if
+// the payload is unchanged.
+func (c *Codec) encodePayload(ctx context.Context, payload *common.Payload, originKey string) (_ *common.Payload, err error) {
+	namespace := c.namespaceFor(ctx, payload)
+	ctx, span := c.startSpan(ctx, "lps.blobs.put",
+		attrNamespace.String(namespace),
+		attrBlobSize.Int(len(payload.GetData())),
+	)
+	defer func() { endSpan(span, err) }()
+	metrics := c.metrics(namespace, operationEncode)
+	defer func() {
+		recordPayload(metrics, metricEncodeTotal, len(payload.GetData()), err)
+		c.stats.recordEncode(len(payload.GetData()), err)
+	}()
+
+	digest, err := c.digest(payload.GetData())
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := c.metadataWithKeyPrefix(payload)
+	if err != nil {
+		return nil, err
+	}
+	metadata, withheld := c.filterMetadata(metadata)
+
+	if c.preserveNamespace && originKey != "" {
+		key, err := v2.ComputeKey(namespaceFromKey(originKey), digest, metadata)
+		if err == nil && key == originKey {
+			c.logger.Debug("payload is unchanged, referencing blob of original namespace", "key", key)
+			setSpanAttributes(span, attrBlobKey.String(key))
+			return c.encodedPayload(payload, remotePayload{
+				Metadata:       metadata,
+				Size:           uint(len(payload.GetData())),
+				Digest:         digest,
+				Key:            key,
+				MetadataDigest: lpsmetadata.Hash(metadata),
+			}, withheld)
+		}
+	}
 
-	for i, payload := range payloads {
-		if payload.Size() > c.minBytes {
-			encodePayload, err := c.encodePayload(ctx, payload)
-			if err != nil {
-				return nil, err
-			}
-			result[i] = encodePayload
-		} else {
-			result[i] = payload
+	start := time.Now()
+	key, err := c.transport.PutBlob(ctx, PutInput{
+		Namespace: namespace,
+		Data:      bytes.NewReader(payload.GetData()),
+		Size:      int64(len(payload.GetData())),
+		Digest:    digest,
+		Metadata:  metadata,
+	})
+	duration := time.Since(start)
+	metrics.Timer(metricPutLatency).Record(duration)
+	if err != nil {
+		return nil, err
+	}
+	setSpanAttributes(span, attrBlobKey.String(key))
+	c.logger.Debug("uploaded payload", "key", key, "duration", duration)
+
+	return c.encodedPayload(payload, remotePayload{
+		Metadata:       metadata,
+		Size:           uint(len(payload.GetData())),
+		Digest:         digest,
+		Key:            key,
+		MetadataDigest: lpsmetadata.Hash(metadata),
+	}, withheld)
+}
+
+// encodedPayload returns the payload replacing payload in the workflow history, which
+// references the blob described by remoteP. The withheld metadata is kept in the envelope.
+func (c *Codec) encodedPayload(payload *common.Payload, remoteP remotePayload, withheld map[string][]byte) (*common.Payload, error) {
+	result, err := c.toEnvelope(remoteP)
+	if err != nil {
+		return nil, err
+	}
+	result.Metadata[remoteCodecName] = []byte(c.version)
+	for _, k := range c.stubMetadataKeys {
+		if v, ok := payload.GetMetadata()[k]; ok {
+			result.Metadata[originalMetadataPrefix+k] = v
 		}
 	}
+	result.Metadata[originalSizeName] = []byte(strconv.Itoa(len(payload.GetData())))
+	for k, v := range withheld {
+		result.Metadata[withheldMetadataPrefix+k] = v
+	}
 
 	return result, nil
 }
 
-func (c *Codec) encodePayload(ctx context.Context, payload *common.Payload) (*common.Payload, error) {
+// metadataWithKeyPrefix returns the metadata of payload, including the key prefix returned
+// by keyPrefixFunc if one is configured. The payload's metadata is copied rather than modified.
+func (c *Codec) metadataWithKeyPrefix(payload *common.Payload) (map[string][]byte, error) {
+	if c.keyPrefixFunc == nil {
+		return payload.GetMetadata(), nil
+	}
+	prefix := c.keyPrefixFunc(payload)
+	if prefix == "" {
+		return payload.GetMetadata(), nil
+	}
+	if err := v2.ValidateKeyPrefix(prefix); err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string][]byte, len(payload.GetMetadata())+1)
+	for k, v := range payload.GetMetadata() {
+		metadata[k] = v
+	}
+	metadata[v2.KeyPrefixMetadataKey] = []byte(prefix)
+	return metadata, nil
+}
+
+// filterMetadata splits metadata into the entries which are sent to LargePayloadService and
+// the entries withheld according to WithMetadataAllowlist and WithMetadataDenylist.
+func (c *Codec) filterMetadata(metadata map[string][]byte) (sent map[string][]byte, withheld map[string][]byte) {
+	if c.metadataAllowlist == nil && c.metadataDenylist == nil {
+		return metadata, nil
+	}
+	sent = make(map[string][]byte, len(metadata))
+	for k, v := range metadata {
+		allowed := c.metadataAllowlist == nil || c.metadataAllowlist[k] || strings.HasPrefix(k, codecMetadataPrefix)
+		if allowed && !c.metadataDenylist[k] {
+			sent[k] = v
+			continue
+		}
+		if withheld == nil {
+			withheld = make(map[string][]byte)
+		}
+		withheld[k] = v
+	}
+	return sent, withheld
+}
+
+// storeBlob stores size bytes read from body in LargePayloadService, unless they already
+// exist, and returns the key of the stored blob.
+func (c *Codec) storeBlob(ctx context.Context, span trace.Span, namespace string, body io.Reader, size int64, digest string, metadata []byte, contentType string) (string, error) {
+	if c.presignedTransfers && !c.presignUnsupported.Load() {
+		key, err := c.putPresigned(ctx, span, namespace, body, size, digest, metadata, contentType)
+		if !errors.Is(err, errPresignUnsupported) {
+			return key, err
+		}
+		c.logger.Info("server does not support presigned transfers, falling back to proxied transfers")
+		c.presignUnsupported.Store(true)
+	}
+
+	if c.existenceCheck {
+		key, exists, err := c.headBlob(ctx, span, namespace, digest, metadata)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			c.logger.Debug("payload already exists, skipping upload", "key", key)
+			return key, nil
+		}
+	}
+
+	// remember the position of seekable bodies, which can be uploaded in chunks if the
+	// server rejects them as too large
+	seeker, _ := body.(io.Seeker)
+	var start int64
+	putBody := body
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+		if _, ok := body.(io.Closer); ok {
+			// prevent the http client from closing the body
+			putBody = struct{ io.Reader }{body}
+		}
+	}
+
+	if limit := c.maxBlobBytes.Load(); limit > 0 && size > limit {
+		// the upload would be rejected
+		c.logger.Info("payload exceeds the server limit, uploading it in chunks", "size", size, "limit", limit)
+		key, err := c.putChunked(ctx, span, namespace, body, size, digest, metadata, contentType)
+		if errors.Is(err, errChunkedUnsupported) {
+			return "", &PayloadTooLargeError{Size: size, Limit: limit}
+		}
+		return key, err
+	}
+
+	key, err := c.putBlob(ctx, span, namespace, putBody, size, digest, metadata, contentType)
+	var tooLarge *PayloadTooLargeError
+	if !errors.As(err, &tooLarge) || seeker == nil {
+		return key, err
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	c.logger.Info("payload exceeds the server limit, uploading it in chunks", "size", size, "limit", tooLarge.Limit)
+	key, err = c.putChunked(ctx, span, namespace, body, size, digest, metadata, contentType)
+	if errors.Is(err, errChunkedUnsupported) {
+		return "", tooLarge
+	}
+	return key, err
+}
+
+// headBlob checks whether a blob with the given digest and metadata already exists in
+// LargePayloadService, returning its key if it does.
+func (c *Codec) headBlob(ctx context.Context, span trace.Span, namespace string, digest string, metadata []byte) (string, bool, error) {
 	req, err := http.NewRequestWithContext(
 		ctx,
-		http.MethodPut,
+		http.MethodHead,
 		c.url.JoinPath(c.version).String(),
-		bytes.NewReader(payload.GetData()),
+		nil,
 	)
 	if err != nil {
-		return nil, err
+		return "", false, err
 	}
-	req.URL.Path = path.Join(req.URL.Path, "blobs/put")
+	req.URL.Path = path.Join(req.URL.Path, "blobs/head")
+
+	q := req.URL.Query()
+	q.Set("digest", digest)
+	q.Set("namespace", namespace)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString(metadata))
+
+	if err := c.setRequestHeaders(req); err != nil {
+		return "", false, err
+	}
+	injectTraceContext(ctx, span, req)
+	resp, err := c.do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("X-Payload-Key"), true, nil
+	case http.StatusNotFound:
+		// also returned by servers which do not support the head endpoint
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("server returned status code %d", resp.StatusCode)
+	}
+}
 
-	sha2 := sha256.New()
-	sha2.Write(payload.GetData())
-	digest := "sha256:" + hex.EncodeToString(sha2.Sum(nil))
+// putBlob uploads size bytes read from body via the LPS server and returns the key of the stored blob.
+func (c *Codec) putBlob(ctx context.Context, span trace.Span, namespace string, body io.Reader, size int64, digest string, metadata []byte, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		c.uploadMethod,
+		c.url.JoinPath(c.version).String(),
+		body,
+	)
+	if err != nil {
+		return "", err
+	}
+	req.URL.Path = path.Join(req.URL.Path, "blobs/put")
 
 	q := req.URL.Query()
 	q.Set("digest", digest)
-	q.Set("namespace", c.namespace)
+	q.Set("namespace", namespace)
 	req.URL.RawQuery = q.Encode()
 	req.Header.Set("Content-Type", "application/octet-stream")
-	req.ContentLength = int64(len(payload.GetData()))
+	req.ContentLength = size
 
 	// Set metadata header
-	md, err := json.Marshal(payload.GetMetadata())
-	if err != nil {
-		return nil, err
+	req.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString(metadata))
+	if contentType != "" {
+		req.Header.Set("X-Payload-Content-Type", contentType)
+	}
+	if c.expectContinue {
+		req.Header.Set("Expect", "100-continue")
 	}
-	req.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString(md))
 
-	addCustomHeaders(req, c.customHeaders)
-	resp, err := c.client.Do(req)
+	if err := c.setRequestHeaders(req); err != nil {
+		return "", err
+	}
+	// retries of the upload are sent with the same key, so that the server answers them with
+	// the response of the first one instead of storing the blob again
+	if c.retryAttempts > 1 && req.Header.Get(idempotencyKeyHeader) == "" {
+		if key := newRequestID(); key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+	}
+	injectTraceContext(ctx, span, req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	defer resp.Body.Close()
+	setSpanAttributes(span, attrHTTPStatus.Int(resp.StatusCode))
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
+	if resp.StatusCode == http.StatusRequestEntityTooLarge || parseErrorResponse(respBody).Code == errorCodePayloadTooLarge {
+		return "", newPayloadTooLargeError(size, respBody)
+	}
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status code %d: %s", resp.StatusCode, respBody)
+		return "", newStatusError(resp.StatusCode, responseRequestID(resp), respBody)
 	}
 
 	var key keyResponse
 	if err := json.Unmarshal(respBody, &key); err != nil {
-		return nil, fmt.Errorf("unable to unmarshal put response: %w", err)
+		return "", fmt.Errorf("unable to unmarshal put response: %w", err)
 	}
+	return key.Key, nil
+}
 
-	result, err := converter.GetDefaultDataConverter().ToPayload(remotePayload{
-		Metadata: payload.GetMetadata(),
-		Size:     uint(len(payload.GetData())),
-		Digest:   digest,
-		Key:      key.Key,
-	})
-	if err != nil {
+func (c *Codec) Decode(payloads []*common.Payload) ([]*common.Payload, error) {
+	return c.DecodeWithContext(context.Background(), payloads)
+}
+
+// DecodeWithContext is like Decode, but uses ctx for the requests sent to LargePayloadService.
+func (c *Codec) DecodeWithContext(ctx context.Context, payloads []*common.Payload) ([]*common.Payload, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	if err := c.ensureHealthy(ctx); err != nil {
 		return nil, err
 	}
-	result.Metadata[remoteCodecName] = []byte(c.version)
-
-	return result, nil
-}
 
-func (c *Codec) Decode(payloads []*common.Payload) ([]*common.Payload, error) {
 	result := make([]*common.Payload, len(payloads))
+	var remote []int
 	for i, payload := range payloads {
-		if codecVersion, ok := payload.GetMetadata()[remoteCodecName]; ok {
-			switch string(codecVersion) {
-			case "v1", "v2":
-				decodedPayload, err := c.decodePayload(context.Background(), payload, string(codecVersion))
-				if err != nil {
-					return nil, err
-				}
-				result[i] = decodedPayload
-			default:
-				return nil, fmt.Errorf("unknown version for %s: %s", remoteCodecName, codecVersion)
-			}
-		} else {
+		codecVersion, ok := payload.GetMetadata()[remoteCodecName]
+		if !ok {
 			result[i] = payload
+			continue
+		}
+		switch string(codecVersion) {
+		case "v1", "v2":
+			remote = append(remote, i)
+		default:
+			return nil, fmt.Errorf("unknown version for %s: %s", remoteCodecName, codecVersion)
+		}
+	}
+
+	prefetched := c.prefetchBlobs(ctx, payloads)
+	downloads := newDownloadGroup()
+	decode := func(ctx context.Context, i int) error {
+		payload := payloads[i]
+		decodedPayload, err := c.decodePayload(ctx, payload, string(payload.GetMetadata()[remoteCodecName]), prefetched, downloads)
+		if err != nil {
+			c.logger.Error("unable to decode payload", "error", err)
+			return err
+		}
+		result[i] = decodedPayload
+		return nil
+	}
+
+	if c.maxConcurrentDownloads > 1 && len(remote) > 1 {
+		if err := forEachConcurrently(ctx, remote, c.maxConcurrentDownloads, nil, nil, decode); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	for _, i := range remote {
+		if err := decode(ctx, i); err != nil {
+			return nil, err
 		}
 	}
 	return result, nil
 }
 
-func (c *Codec) decodePayload(ctx context.Context, payload *common.Payload, version string) (*common.Payload, error) {
-	var remoteP remotePayload
-	if err := converter.GetDefaultDataConverter().FromPayload(payload, &remoteP); err != nil {
+// decodePayload decodes payload, using the blob from prefetched if it was downloaded already.
+// Blobs referenced by several payloads are downloaded once through downloads.
+func (c *Codec) decodePayload(ctx context.Context, payload *common.Payload, version string, prefetched map[string]prefetchedBlob, downloads *downloadGroup) (result *common.Payload, err error) {
+	metrics := c.metrics(c.namespace, operationDecode)
+	defer func() {
+		var size int
+		if err == nil {
+			size = len(result.GetData())
+		}
+		recordPayload(metrics, metricDecodeTotal, size, err)
+		c.stats.recordDecode(err)
+	}()
+
+	remoteP, err := fromEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := remoteP.Key
+	if cacheKey == "" {
+		cacheKey = remoteP.Digest
+	}
+	if c.cache != nil {
+		if b, ok := c.cache.get(cacheKey); ok {
+			c.logger.Debug("decode cache hit", "key", cacheKey)
+			return &common.Payload{
+				Metadata: c.decodedMetadata(remoteP, payload.GetMetadata()),
+				Data:     b,
+			}, nil
+		}
+	}
+
+	if blob, ok := prefetched[remoteP.Key]; ok && remoteP.Key != "" {
+		if err := c.verifyPayload(remoteP, blob.data, blob.checkSum); err != nil {
+			return nil, err
+		}
+		if c.cache != nil {
+			c.cache.add(cacheKey, blob.data)
+		}
+		return &common.Payload{
+			Metadata: c.decodedMetadata(remoteP, payload.GetMetadata()),
+			Data:     blob.data,
+		}, nil
+	}
+
+	ctx, span := c.startSpan(ctx, "lps.blobs.get",
+		attrNamespace.String(c.namespace),
+		attrBlobSize.Int64(int64(remoteP.Size)),
+		attrBlobKey.String(remoteP.Key),
+	)
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	b, checkSum, err := downloads.do(cacheKey, func() ([]byte, string, error) {
+		w := newBlobWriter(remoteP.Size)
+
+		err := c.transport.GetBlob(ctx, GetInput{
+			Key:      remoteP.Key,
+			Digest:   remoteP.Digest,
+			Size:     int64(remoteP.Size),
+			Metadata: remoteP.Metadata,
+			version:  version,
+		}, w)
+		metrics.Timer(metricGetLatency).Record(time.Since(start))
+		if err != nil {
+			return nil, "", err
+		}
+		b := w.bytes()
+		c.stats.bytesDownloaded.Add(int64(len(b)))
+		sha2 := hashPool.Get().(hash.Hash)
+		defer putHash(sha2)
+		sha2.Write(b)
+		return b, hexSum(sha2), nil
+	})
+	if errors.Is(err, ErrBlobNotFound) && c.missingBlobPlaceholder {
+		c.logger.Error("blob not found, returning placeholder payload", "key", remoteP.Key, "error", err)
+		return missingBlobPayload(remoteP)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.verifyPayload(remoteP, b, checkSum); err != nil {
+		return nil, err
+	}
+	c.logger.Debug("downloaded payload", "key", remoteP.Key, "duration", time.Since(start))
+
+	if c.cache != nil {
+		c.cache.add(cacheKey, b)
+	}
+
+	return &common.Payload{
+		Metadata: c.decodedMetadata(remoteP, payload.GetMetadata()),
+		Data:     b,
+	}, nil
+}
+
+// missingBlob is the data of the placeholder payload returned for a missing blob.
+type missingBlob struct {
+	Key    string `json:"key,omitempty"`
+	Digest string `json:"digest"`
+	Size   uint   `json:"size"`
+}
+
+// missingBlobPayload returns the placeholder payload for the missing blob referenced by remoteP.
+func missingBlobPayload(remoteP *remotePayload) (*common.Payload, error) {
+	data, err := json.Marshal(missingBlob{
+		Key:    remoteP.Key,
+		Digest: remoteP.Digest,
+		Size:   remoteP.Size,
+	})
+	if err != nil {
 		return nil, err
 	}
+	return &common.Payload{
+		Metadata: map[string][]byte{
+			converter.MetadataEncoding: []byte(converter.MetadataEncodingJSON),
+			MetadataMissingBlob:        []byte("true"),
+		},
+		Data: data,
+	}, nil
+}
+
+// decodedMetadata returns the metadata of a decoded payload, merging the metadata withheld
+// from LargePayloadService back from the encoded payload's metadata. The remote-codec/*
+// metadata is removed if WithStripKeyPrefixOnDecode is configured. If
+// WithPreserveNamespaceOnReencode is configured and the blob belongs to another namespace,
+// its key is added as remote-codec/origin-key.
+func (c *Codec) decodedMetadata(remoteP *remotePayload, encodedMetadata map[string][]byte) map[string][]byte {
+	metadata := remoteP.Metadata
+	var withheld bool
+	for k := range encodedMetadata {
+		if strings.HasPrefix(k, withheldMetadataPrefix) {
+			withheld = true
+			break
+		}
+	}
+	origin := c.preserveNamespace && namespaceFromKey(remoteP.Key) != "" && namespaceFromKey(remoteP.Key) != c.namespace
+	if !c.stripCodecMetadata && !withheld && !origin {
+		return metadata
+	}
 
+	result := make(map[string][]byte, len(metadata))
+	for k, v := range metadata {
+		if !c.stripCodecMetadata || !strings.HasPrefix(k, codecMetadataPrefix) {
+			result[k] = v
+		}
+	}
+	for k, v := range encodedMetadata {
+		if name := strings.TrimPrefix(k, withheldMetadataPrefix); name != k {
+			result[name] = v
+		}
+	}
+	if origin {
+		result[originKeyName] = []byte(remoteP.Key)
+	}
+	return result
+}
+
+// withoutOriginKey returns a copy of payload without the remote-codec/origin-key metadata
+// and the value of that metadata. payload is returned as is if it does not carry the metadata.
+func withoutOriginKey(payload *common.Payload) (*common.Payload, string) {
+	originKey, ok := payload.GetMetadata()[originKeyName]
+	if !ok {
+		return payload, ""
+	}
+	metadata := make(map[string][]byte, len(payload.GetMetadata())-1)
+	for k, v := range payload.GetMetadata() {
+		if k != originKeyName {
+			metadata[k] = v
+		}
+	}
+	return &common.Payload{Metadata: metadata, Data: payload.GetData()}, string(originKey)
+}
+
+// namespaceFromKey returns the namespace of the blob with the given v2 key, or an empty
+// string if the key does not contain a namespace.
+func namespaceFromKey(key string) string {
+	parts := strings.SplitN(key, "/", 4)
+	if len(parts) < 4 || parts[0] != "" || parts[1] != "blobs" {
+		return ""
+	}
+	return parts[2]
+}
+
+// verifyPayload checks the size and checksum of the downloaded data as well as the checksum
+// of the metadata against remoteP, according to the configured DigestVerificationMode.
+func (c *Codec) verifyPayload(remoteP *remotePayload, data []byte, checkSum string) error {
+	if c.digestVerification == DigestVerificationSkip {
+		return nil
+	}
+
+	var err error
+	if uint(len(data)) != remoteP.Size {
+		err = fmt.Errorf("wanted object of size %d, got %d", remoteP.Size, len(data))
+	} else if digest, digestErr := c.digestFor(remoteP.Digest, data, checkSum); digestErr != nil {
+		err = digestErr
+	} else if digest != remoteP.Digest {
+		err = fmt.Errorf("wanted object sha %s, got %s", remoteP.Digest, digest)
+	} else if remoteP.MetadataDigest != "" {
+		// envelopes written by older codecs do not have a metadata digest
+		if metadataDigest := lpsmetadata.Hash(remoteP.Metadata); metadataDigest != remoteP.MetadataDigest {
+			err = fmt.Errorf("wanted metadata sha %s, got %s", remoteP.MetadataDigest, metadataDigest)
+		}
+	}
+
+	if err != nil && c.digestVerification == DigestVerificationWarn {
+		c.logger.Error("payload verification failed, continuing", "key", remoteP.Key, "error", err)
+		return nil
+	}
+	return err
+}
+
+// getBlob downloads the blob referenced by remoteP starting at offset, falling back to the
+// read URLs if it is not found. The caller is responsible for closing the returned body.
+func (c *Codec) getBlob(ctx context.Context, span trace.Span, remoteP *remotePayload, version string, offset int64) (io.ReadCloser, error) {
+	body, err := c.getBlobFrom(ctx, span, c.url, remoteP, version, offset)
+	for _, readURL := range c.readURLs {
+		if !errors.Is(err, ErrBlobNotFound) {
+			break
+		}
+		body, err = c.getBlobFrom(ctx, span, readURL, remoteP, version, offset)
+		if err == nil {
+			c.logger.Info("downloaded payload from read URL", "key", remoteP.Key, "url", readURL.Redacted())
+		}
+	}
+	return body, err
+}
+
+// getBlobFrom downloads the blob referenced by remoteP from baseURL. If offset is not zero,
+// only the remainder of the blob starting at offset is requested. Servers which do not
+// support ranges send the entire blob, in which case the first offset bytes are skipped.
+func (c *Codec) getBlobFrom(ctx context.Context, span trace.Span, baseURL *url.URL, remoteP *remotePayload, version string, offset int64) (io.ReadCloser, error) {
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodGet,
-		c.url.JoinPath(version).String(),
+		baseURL.JoinPath(version).String(),
 		nil,
 	)
 	if err != nil {
@@ -397,43 +2116,187 @@ func (c *Codec) decodePayload(ctx context.Context, payload *common.Payload, vers
 	}
 	if version == "v2" {
 		q.Set("key", remoteP.Key)
+		c.setNamespaceParam(q)
 	}
 	req.URL.RawQuery = q.Encode()
 
 	req.Header.Set("Content-Type", "application/octet-stream")
 
-	addCustomHeaders(req, c.customHeaders)
-	// TODO: we temporarily need this because we aren't checking object metadata on the server
-	req.Header.Set("X-Payload-Expected-Content-Length", strconv.FormatUint(uint64(remoteP.Size), 10))
+	if err := c.setRequestHeaders(req); err != nil {
+		return nil, err
+	}
+	// TODO: remove once all servers take the size from storage, which they only check against
+	// this header. The size of blobs fetched by key only is unknown.
+	if remoteP.Digest != "" {
+		req.Header.Set("X-Payload-Expected-Content-Length", strconv.FormatUint(uint64(remoteP.Size), 10))
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		// the server decides based on the payload encoding whether compressing the blob is worthwhile
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if encoding, ok := remoteP.Metadata[converter.MetadataEncoding]; ok {
+		req.Header.Set("X-Payload-Encoding", string(encoding))
+	}
 
-	resp, err := c.client.Do(req)
+	injectTraceContext(ctx, span, req)
+	resp, err := c.doHedged(req)
 	if err != nil {
 		return nil, err
 	}
+	setSpanAttributes(span, attrHTTPStatus.Int(resp.StatusCode))
 
-	if resp.StatusCode != http.StatusOK {
+	partial := offset > 0 && resp.StatusCode == http.StatusPartialContent
+	if resp.StatusCode != http.StatusOK && !partial {
+		defer resp.Body.Close()
 		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("server returned status code %d: %s", resp.StatusCode, respBody)
+		err := newStatusError(resp.StatusCode, responseRequestID(resp), respBody)
+		if resp.StatusCode == http.StatusNotFound && !errors.Is(err, ErrBlobNotFound) {
+			// servers sending plain text errors
+			err = fmt.Errorf("%w: %v", ErrBlobNotFound, err)
+		}
+		return nil, err
+	}
+	var skip int64
+	if !partial {
+		skip, offset = offset, 0
+	}
+	if err := checkBlobResponse(resp, remoteP, offset); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	body := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if body, err = newGzipReadCloser(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	if skip > 0 {
+		c.logger.Debug("server does not support ranges, skipping downloaded bytes", "key", remoteP.Key, "bytes", skip)
+		if _, err := io.CopyN(io.Discard, body, skip); err != nil {
+			body.Close()
+			return nil, err
+		}
 	}
+	return body, nil
+}
+
+// errorPageMediaTypes are the media types of responses which cannot be blobs, such as the
+// error pages of proxies. Servers of previous releases do not set the Content-Type of blobs,
+// which net/http then sniffs, e.g. text/plain for JSON payloads, so other types are accepted.
+var errorPageMediaTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+}
+
+// checkBlobResponse checks the headers of a successful blob download starting at offset
+// before the body is read, so that e.g. an error page returned by a proxy fails immediately.
+func checkBlobResponse(resp *http.Response, remoteP *remotePayload, offset int64) error {
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); errorPageMediaTypes[mediaType] {
+		return fmt.Errorf("server returned blob with unexpected Content-Type %q", contentType)
+	}
+	if offset > 0 {
+		if contentRange := resp.Header.Get("Content-Range"); !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) {
+			return fmt.Errorf("server returned unexpected Content-Range %q for range starting at %d", contentRange, offset)
+		}
+	}
+	// the size of blobs fetched by key only is unknown, and compressed blobs differ in size
+	if remoteP.Digest == "" || resp.Header.Get("Content-Encoding") != "" || resp.ContentLength < 0 {
+		return nil
+	}
+	if resp.ContentLength != int64(remoteP.Size)-offset {
+		return fmt.Errorf("wanted object of size %d, server returned Content-Length %d", int64(remoteP.Size)-offset, resp.ContentLength)
+	}
+	return nil
+}
 
-	sha2 := sha256.New()
-	tee := io.TeeReader(resp.Body, sha2)
-	b, err := io.ReadAll(tee)
+// Key returns the storage key of a payload encoded by the codec.
+//
+// An error is returned if the payload was not encoded by the codec.
+func (c *Codec) Key(payload *common.Payload) (string, error) {
+	if _, ok := payload.GetMetadata()[remoteCodecName]; !ok {
+		return "", fmt.Errorf("payload is not encoded with %s", remoteCodecName)
+	}
+	remoteP, err := fromEnvelope(payload)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	return remoteP.Key, nil
+}
+
+// Exists checks whether the blob with the given key exists in LargePayloadService.
+func (c *Codec) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := c.doKeyRequest(ctx, http.MethodHead, "blobs/head", key)
+	if err != nil {
+		return false, err
 	}
+	defer resp.Body.Close()
 
-	if uint(len(b)) != remoteP.Size {
-		return nil, fmt.Errorf("wanted object of size %d, got %d", remoteP.Size, len(b))
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("server returned status code %d", resp.StatusCode)
 	}
+}
 
-	checkSum := hex.EncodeToString(sha2.Sum(nil))
-	if fmt.Sprintf("sha256:%s", checkSum) != remoteP.Digest {
-		return nil, fmt.Errorf("wanted object sha %s, got %s", remoteP.Digest, checkSum)
+// Delete removes the blob with the given key from LargePayloadService.
+func (c *Codec) Delete(ctx context.Context, key string) error {
+	resp, err := c.doKeyRequest(ctx, http.MethodDelete, "blobs/delete", key)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	return &common.Payload{
-		Metadata: remoteP.Metadata,
-		Data:     b,
-	}, nil
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return newStatusError(resp.StatusCode, responseRequestID(resp), respBody)
+	}
+	return nil
+}
+
+// setNamespaceParam sets the namespace query parameter of a request identifying blobs by their
+// key to the configured namespace, if any, which servers scoping keys to namespaces require.
+func (c *Codec) setNamespaceParam(q url.Values) {
+	if c.namespace != "" {
+		q.Set("namespace", c.namespace)
+	}
+}
+
+// doKeyRequest sends a request for the blob with the given key to the endpoint of LargePayloadService.
+func (c *Codec) doKeyRequest(ctx context.Context, method string, endpoint string, key string) (*http.Response, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+	if c.url == nil {
+		return nil, errors.New("a remote codec URL is required")
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		method,
+		c.url.JoinPath(c.version).String(),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path = path.Join(req.URL.Path, endpoint)
+
+	q := req.URL.Query()
+	q.Set("key", key)
+	c.setNamespaceParam(q)
+	req.URL.RawQuery = q.Encode()
+
+	if err := c.setRequestHeaders(req); err != nil {
+		return nil, err
+	}
+	return c.do(req)
 }
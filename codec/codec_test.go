@@ -5,16 +5,40 @@
 package codec
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/DataDog/temporal-large-payload-codec/server"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.temporal.io/api/common/v1"
+	"go.temporal.io/sdk/converter"
 
 	"github.com/stretchr/testify/require"
 )
@@ -55,8 +79,9 @@ func TestV2Codec(t *testing.T) {
 			},
 			encodedPayload: common.Payload{
 				Metadata: map[string][]byte{
-					"encoding":                 []byte("json/plain"),
-					"temporal.io/remote-codec": []byte("v2"),
+					"encoding":                   []byte("json/plain"),
+					"temporal.io/remote-codec":   []byte("v2"),
+					"remote-codec/original-size": []byte("59"),
 				},
 			},
 		},
@@ -71,8 +96,9 @@ func TestV2Codec(t *testing.T) {
 			},
 			encodedPayload: common.Payload{
 				Metadata: map[string][]byte{
-					"encoding":                 []byte("json/plain"),
-					"temporal.io/remote-codec": []byte("v2"),
+					"encoding":                   []byte("json/plain"),
+					"temporal.io/remote-codec":   []byte("v2"),
+					"remote-codec/original-size": []byte("52"),
 				},
 			},
 		},
@@ -103,6 +129,93 @@ func TestV2Codec(t *testing.T) {
 	}
 }
 
+func TestV2CodecProtoEnvelope(t *testing.T) {
+	testCase := []struct {
+		name    string
+		payload common.Payload
+	}{
+		{
+			name: "large payload with prefix",
+			payload: common.Payload{
+				Metadata: map[string][]byte{
+					"foo":                     []byte("bar"),
+					"baz":                     []byte("qux"),
+					"remote-codec/key-prefix": []byte("1234"),
+				},
+				Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+			},
+		},
+		{
+			name: "large payload no prefix",
+			payload: common.Payload{
+				Metadata: map[string][]byte{
+					"foo": []byte("bar"),
+					"baz": []byte("qux"),
+				},
+				Data: []byte("This message is also longer than the 32 bytes limit!"),
+			},
+		},
+	}
+
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithEnvelopeFormat(EnvelopeFormatProto),
+	)
+	require.NoError(t, err)
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			actualEncodedPayload, err := c.Encode([]*common.Payload{&scenario.payload})
+			require.NoError(t, err)
+
+			if updateEncodedPayload {
+				toFile(t, actualEncodedPayload[0].Data)
+			}
+
+			encodedPayload := common.Payload{
+				Metadata: map[string][]byte{
+					"encoding":                   []byte("binary/protobuf"),
+					"messageType":                []byte("temporal.largepayloadcodec.v2.RemotePayload"),
+					"temporal.io/remote-codec":   []byte("v2"),
+					"remote-codec/original-size": []byte(strconv.Itoa(len(scenario.payload.Data))),
+				},
+				Data: fromFile(t),
+			}
+			require.Equal(t, &encodedPayload, actualEncodedPayload[0])
+
+			actualPayload, err := c.Decode([]*common.Payload{&encodedPayload})
+			require.NoError(t, err)
+			require.Equal(t, &scenario.payload, actualPayload[0])
+		})
+	}
+
+	// payloads with JSON envelopes in existing histories can still be decoded
+	jsonEncoded := []*common.Payload{{
+		Metadata: map[string][]byte{
+			"encoding":                 []byte("json/plain"),
+			"temporal.io/remote-codec": []byte("v2"),
+		},
+		Data: []byte(`{"metadata":{"baz":"cXV4","foo":"YmFy","remote-codec/key-prefix":"MTIzNA=="},"size":59,` +
+			`"digest":"sha256:041ae008aa23e071b5f04ae1b75847c7b135269239833501f0929b212c95935c",` +
+			`"key":"/blobs/test/custom/1234/sha256:041ae008aa23e071b5f04ae1b75847c7b135269239833501f0929b212c95935c/sha256:b70fd38ed8eb9135fb4f1e6d296cf4a61ae8fd310fd07c4bd788d20fe0a86e95"}`),
+	}}
+	decoded, err := c.Decode(jsonEncoded)
+	require.NoError(t, err)
+	require.Equal(t, &testCase[0].payload, decoded[0])
+
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithEnvelopeFormat("xml"),
+	)
+	require.Error(t, err)
+}
+
 func Test_setting_withDecodeOnly_disables_encoding(t *testing.T) {
 	d := &memory.Driver{}
 	srv := httptest.NewServer(server.NewHttpHandler(d))
@@ -205,6 +318,67 @@ func Test_codec_sets_custom_headers_when_sending_request_to_lps(t *testing.T) {
 	_, _ = client.Encode([]*common.Payload{&payload})
 }
 
+func Test_codec_sets_headers_from_provider_when_sending_request_to_lps(t *testing.T) {
+	lps := server.NewHttpHandler(&memory.Driver{})
+	var tenants []string
+	var mu sync.Mutex
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tenants = append(tenants, strings.Join(r.Header.Values("X-Tenant"), ","))
+		mu.Unlock()
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	type tenantKey struct{}
+	providerErr := errors.New("no tenant")
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithoutUrlHealthCheck(),
+		WithExistenceCheck(false),
+		WithCustomHeader("X-Tenant", "static"),
+		WithHeaderProvider(func(ctx context.Context) (http.Header, error) {
+			switch tenant := ctx.Value(tenantKey{}); tenant {
+			case nil:
+				return nil, nil
+			case "":
+				return nil, providerErr
+			default:
+				return http.Header{"X-Tenant": {tenant.(string)}}, nil
+			}
+		}),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	// provided headers replace the static custom headers
+	ctx := context.WithValue(context.Background(), tenantKey{}, "tenant-a")
+	encoded, err := c.EncodeWithContext(ctx, []*common.Payload{&payload})
+	require.NoError(t, err)
+	ctx = context.WithValue(context.Background(), tenantKey{}, "tenant-b")
+	_, err = c.DecodeWithContext(ctx, encoded)
+	require.NoError(t, err)
+	// a nil result adds no headers
+	_, err = c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant-a", "tenant-b", "static"}, tenants)
+
+	// provider errors abort the request
+	ctx = context.WithValue(context.Background(), tenantKey{}, "")
+	_, err = c.DecodeWithContext(ctx, encoded)
+	require.ErrorIs(t, err, providerErr)
+	require.Len(t, tenants, 3)
+
+	_, err = New(WithURL(s.URL), WithNamespace("test"), WithHeaderProvider(nil))
+	require.Error(t, err)
+}
+
 func TestNewCodec(t *testing.T) {
 	d := &memory.Driver{}
 	s := httptest.NewServer(server.NewHttpHandler(d))
@@ -238,6 +412,16 @@ func TestNewCodec(t *testing.T) {
 	require.Error(t, err)
 	require.Nil(t, client)
 
+	// invalid namespaces
+	for _, namespace := range []string{"", "..", "../etc", "a/b", "/", "a b", "team:a"} {
+		client, err = New(
+			WithURL(s.URL),
+			WithNamespace(namespace),
+		)
+		require.Error(t, err, namespace)
+		require.Nil(t, client)
+	}
+
 	// HTTP client is optional
 	client, err = New(
 		WithURL(s.URL),
@@ -322,6 +506,52 @@ func TestNewCodec(t *testing.T) {
 
 }
 
+func Test_closed_codec_returns_ErrClosed(t *testing.T) {
+	s, c, _ := setUp(t, "v2")
+	defer s.Close()
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	key, err := c.Key(encoded[0])
+	require.NoError(t, err)
+
+	require.NoError(t, c.Close())
+	// closing twice is a no-op
+	require.NoError(t, c.Close())
+
+	_, err = c.Encode([]*common.Payload{&payload})
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = c.Decode(encoded)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = c.Exists(context.Background(), key)
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, c.Delete(context.Background(), key), ErrClosed)
+}
+
+// closeIdleCounter is a round tripper counting the calls to CloseIdleConnections.
+type closeIdleCounter struct {
+	http.RoundTripper
+	calls int
+}
+
+func (c *closeIdleCounter) CloseIdleConnections() {
+	c.calls++
+}
+
+func Test_close_leaves_connections_of_shared_clients_open(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+	transport := &closeIdleCounter{RoundTripper: http.DefaultTransport}
+	c, err := New(WithURL(s.URL), WithHTTPClient(&http.Client{Transport: transport}), WithNamespace("test"))
+	require.NoError(t, err)
+
+	require.NoError(t, c.Close())
+	require.Zero(t, transport.calls)
+}
+
 func setUp(t *testing.T, version string) (*httptest.Server, *Codec, storage.Driver) {
 	// Create test remote codec service
 	d := &memory.Driver{}
@@ -349,6 +579,9 @@ func setUpWithServer(t *testing.T, version string, server *httptest.Server, with
 		opts...,
 	)
 	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
 
 	c.version = version
 
@@ -370,3 +603,1890 @@ func toFile(t *testing.T, data []byte) {
 		require.NoError(t, err)
 	}
 }
+
+func Test_codec_traces_requests_sent_to_lps(t *testing.T) {
+	d := &memory.Driver{}
+	s := httptest.NewServer(server.NewHttpHandler(d))
+	defer s.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithTracerProvider(tp),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Metadata: map[string][]byte{
+			"foo": []byte("bar"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	_, err = c.Decode(encoded)
+	require.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	require.Equal(t, "lps.blobs.put", spans[0].Name)
+	require.Equal(t, "lps.blobs.get", spans[1].Name)
+	for _, span := range spans {
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes {
+			attrs[kv.Key] = kv.Value
+		}
+		require.Equal(t, "test", attrs[attrNamespace].AsString())
+		require.Equal(t, int64(len(payload.Data)), attrs[attrBlobSize].AsInt64())
+		require.NotEmpty(t, attrs[attrBlobKey].AsString())
+		require.Contains(t, []int64{http.StatusOK, http.StatusCreated}, attrs[attrHTTPStatus].AsInt64())
+	}
+}
+
+func Test_codec_propagates_trace_context_to_lps(t *testing.T) {
+	var traceparent string
+	testSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer testSrv.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	c, err := New(
+		WithURL(testSrv.URL),
+		WithHTTPClient(testSrv.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithoutUrlHealthCheck(),
+		WithTracerProvider(tp),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	_, err = c.Encode([]*common.Payload{&payload})
+	require.Error(t, err)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	require.Equal(t, codes.Error, spans[0].Status.Code)
+	require.Contains(t, traceparent, spans[0].SpanContext.TraceID().String())
+}
+
+type recordingLogger struct {
+	mu     sync.Mutex
+	debugs []string
+	infos  []string
+	errors []string
+}
+
+func (l *recordingLogger) Debug(msg string, _ ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.debugs = append(l.debugs, msg)
+}
+
+func (l *recordingLogger) Info(msg string, _ ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.infos = append(l.infos, msg)
+}
+
+func (l *recordingLogger) Error(msg string, _ ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, msg)
+}
+
+func Test_codec_logs_offload_decisions_and_requests(t *testing.T) {
+	d := &memory.Driver{}
+	s := httptest.NewServer(server.NewHttpHandler(d))
+	defer s.Close()
+
+	logger := &recordingLogger{}
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithLogger(logger),
+	)
+	require.NoError(t, err)
+
+	payloads := []*common.Payload{
+		{Data: []byte("small")},
+		{Data: []byte("this is a longer message blah blah blah blah blah blah blah")},
+	}
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+	_, err = c.Decode(encoded)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"fetched server limits",
+		"not offloading payload",
+		"offloading payload",
+		"uploaded payload",
+		"downloaded payload",
+	}, logger.debugs)
+	require.Empty(t, logger.errors)
+
+	// Failing to reach the server is logged as an error
+	s.Close()
+	_, err = c.Decode(encoded)
+	require.Error(t, err)
+	require.Equal(t, []string{"unable to decode payload"}, logger.errors)
+}
+
+func Test_codec_sets_bearer_token_on_requests_to_lps(t *testing.T) {
+	lps := server.NewHttpHandler(&memory.Driver{})
+	var authorized int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer token-1", "Bearer token-2", "Bearer token-3":
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&authorized, 1)
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	// static token
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithBearerToken("token-1"),
+	)
+	require.NoError(t, err)
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	_, err = c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, int32(5), atomic.LoadInt32(&authorized)) // health check, limits, head, put and get
+
+	// token provider is invoked per request
+	var calls int
+	c, err = New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithExistenceCheck(false),
+		WithTokenProvider(func(ctx context.Context) (string, error) {
+			calls++
+			return fmt.Sprintf("token-%d", calls), nil
+		}),
+	)
+	require.NoError(t, err)
+	encoded, err = c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	_, err = c.Decode(encoded)
+	require.Error(t, err) // token-4 is rejected
+	require.Equal(t, 4, calls)
+
+	// token provider errors are returned
+	providerErr := errors.New("token expired")
+	c, err = New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithoutUrlHealthCheck(),
+		WithTokenProvider(func(ctx context.Context) (string, error) {
+			return "", providerErr
+		}),
+	)
+	require.NoError(t, err)
+	_, err = c.Encode([]*common.Payload{&payload})
+	require.ErrorIs(t, err, providerErr)
+	_, err = c.Decode(encoded)
+	require.ErrorIs(t, err, providerErr)
+
+	// only one token option may be set
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithBearerToken("token-1"),
+		WithTokenProvider(func(ctx context.Context) (string, error) {
+			return "token-2", nil
+		}),
+	)
+	require.Error(t, err)
+}
+
+func Test_codec_sets_basic_auth_on_requests_to_lps(t *testing.T) {
+	lps := server.NewHttpHandler(&memory.Driver{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.Equal(t, []string{"VALUE"}, r.Header.Values("CUSTOM-HEADER"))
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	// wrong credentials fail the health check
+	_, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithBasicAuth("user", "wrong"),
+	)
+	require.Error(t, err)
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithBasicAuth("user", "secret"),
+		WithCustomHeader("CUSTOM-HEADER", "VALUE"),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payload.Data, decoded[0].Data)
+
+	// basic auth and bearer tokens are mutually exclusive
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithBasicAuth("user", "secret"),
+		WithBearerToken("token"),
+	)
+	require.Error(t, err)
+}
+
+func Test_codec_sets_user_agent_on_requests_to_lps(t *testing.T) {
+	lps := server.NewHttpHandler(&memory.Driver{})
+	var mu sync.Mutex
+	userAgents := map[string]string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents[r.URL.Path] = r.Header.Get("User-Agent")
+		mu.Unlock()
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithUserAgentSuffix("my-worker/1.2.3"),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	_, err = c.Decode(encoded)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range []string{"/v2/health/head", "/v2/blobs/put", "/v2/blobs/get"} {
+		require.Contains(t, userAgents, path)
+		require.True(t, strings.HasPrefix(userAgents[path], "temporal-large-payload-codec/"), userAgents[path])
+		require.Contains(t, userAgents[path], " go/go")
+		require.True(t, strings.HasSuffix(userAgents[path], " my-worker/1.2.3"), userAgents[path])
+	}
+
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithUserAgentSuffix(""),
+	)
+	require.Error(t, err)
+}
+
+func Test_codec_sends_request_ids_to_lps(t *testing.T) {
+	driver := &memory.Driver{}
+	lps := server.NewHttpHandlerWithOptions(driver, server.WithRequestIDs())
+	var mu sync.Mutex
+	var requestIDs []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requestIDs = append(requestIDs, r.Header.Get("X-Request-ID"))
+		mu.Unlock()
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithMinBytes(32))
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+
+	// errors of the server hold the ID of the failed request
+	blobs, err := driver.ListPayloads(context.Background(), &storage.ListRequest{Prefix: "/blobs/"})
+	require.NoError(t, err)
+	require.Len(t, blobs.Blobs, 1)
+	_, err = driver.DeletePayload(context.Background(), &storage.DeleteRequest{Key: blobs.Blobs[0].Key})
+	require.NoError(t, err)
+	_, err = c.Decode(encoded)
+	require.ErrorIs(t, err, ErrBlobNotFound)
+
+	mu.Lock()
+	defer mu.Unlock()
+	unique := map[string]bool{}
+	for _, id := range requestIDs {
+		require.NotEmpty(t, id)
+		unique[id] = true
+	}
+	require.Len(t, unique, len(requestIDs))
+	require.Contains(t, err.Error(), fmt.Sprintf("(request ID %s)", requestIDs[len(requestIDs)-1]))
+}
+
+func Test_codec_connects_to_lps_using_tls_config(t *testing.T) {
+	s := httptest.NewTLSServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0600)
+	require.NoError(t, err)
+
+	// the default client does not trust the self-signed certificate
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+	)
+	require.Error(t, err)
+
+	// TLS config
+	c, err := New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithTLSConfig(&tls.Config{RootCAs: pool}),
+	)
+	require.NoError(t, err)
+	require.Nil(t, http.DefaultClient.Transport)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payload.Data, decoded[0].Data)
+
+	// CA certificate file applied to a custom http client
+	client := &http.Client{Transport: &http.Transport{}}
+	c, err = New(
+		WithURL(s.URL),
+		WithHTTPClient(client),
+		WithNamespace("test"),
+		WithCACertFile(caFile),
+	)
+	require.NoError(t, err)
+	require.NotSame(t, client, c.client)
+	require.NotSame(t, client.Transport, c.client.Transport)
+
+	// invalid CA certificate file
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithCACertFile(filepath.Join(t.TempDir(), "missing.pem")),
+	)
+	require.Error(t, err)
+
+	// conflicting round tripper
+	_, err = New(
+		WithURL(s.URL),
+		WithHTTPClient(&http.Client{}),
+		WithNamespace("test"),
+		WithHTTPRoundTripper(&http.Transport{}),
+		WithTLSConfig(&tls.Config{RootCAs: pool}),
+	)
+	require.Error(t, err)
+}
+
+func Test_codec_connects_to_lps_over_unix_socket(t *testing.T) {
+	// socket paths are limited to about 100 characters, which t.TempDir may exceed
+	dir, err := os.MkdirTemp("", "lps")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "lps.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	s := &http.Server{Handler: server.NewHttpHandler(&memory.Driver{})}
+	go func() { _ = s.Serve(listener) }()
+	defer s.Close()
+
+	// the startup health check is performed over the socket as well
+	c, err := New(
+		WithURL("unix://"+socketPath),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+	require.Nil(t, http.DefaultClient.Transport, "the default client must not be modified")
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{&payload}, decoded)
+
+	for _, opts := range [][]Option{
+		{WithURL("unix://")},
+		{WithURL("unix://" + socketPath), WithHTTPClient(&http.Client{}), WithHTTPRoundTripper(roundTripperFunc(nil))},
+		{WithURL("http://localhost"), WithReadURL("unix://" + socketPath)},
+	} {
+		_, err := New(append(opts, WithNamespace("test"), WithoutUrlHealthCheck())...)
+		require.Error(t, err)
+	}
+}
+
+func Test_codec_connects_to_lps_over_http2(t *testing.T) {
+	var mu sync.Mutex
+	var protos []int
+	recordProtos := server.WithMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			protos = append(protos, r.ProtoMajor)
+			mu.Unlock()
+			next.ServeHTTP(w, r)
+		})
+	})
+	serve := func(network, address string) string {
+		listener, err := net.Listen(network, address)
+		require.NoError(t, err)
+		s := server.New(&memory.Driver{}, recordProtos, server.WithH2C())
+		go func() { _ = s.Serve(listener) }()
+		t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+		if network == "unix" {
+			return "unix://" + address
+		}
+		return "http://" + listener.Addr().String()
+	}
+	// socket paths are limited to about 100 characters, which t.TempDir may exceed
+	dir, err := os.MkdirTemp("", "lps")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tlsServer := httptest.NewUnstartedServer(server.NewHttpHandlerWithOptions(&memory.Driver{}, recordProtos))
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsServer.Certificate())
+
+	for name, tc := range map[string]struct {
+		opts      []Option
+		wantProto int
+	}{
+		"h2c":                 {opts: []Option{WithURL(serve("tcp", "127.0.0.1:0")), WithHTTP2()}, wantProto: 2},
+		"h2c over socket":     {opts: []Option{WithURL(serve("unix", filepath.Join(dir, "lps.sock"))), WithHTTP2()}, wantProto: 2},
+		"https":               {opts: []Option{WithURL(tlsServer.URL), WithTLSConfig(&tls.Config{RootCAs: pool}), WithHTTP2()}, wantProto: 2},
+		"http/1.1 by default": {opts: []Option{WithURL(serve("tcp", "127.0.0.1:0"))}, wantProto: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			protos = nil
+			c, err := New(append(tc.opts, WithNamespace("test"), WithMinBytes(1))...)
+			require.NoError(t, err)
+			defer c.Close()
+			require.Nil(t, http.DefaultClient.Transport, "the default client must not be modified")
+
+			payload := common.Payload{Data: []byte("hello world")}
+			encoded, err := c.Encode([]*common.Payload{&payload})
+			require.NoError(t, err)
+			decoded, err := c.Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, payload.Data, decoded[0].Data)
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.NotEmpty(t, protos)
+			for _, proto := range protos {
+				require.Equal(t, tc.wantProto, proto)
+			}
+		})
+	}
+
+	_, err = New(
+		WithURL("http://localhost"),
+		WithHTTPClient(&http.Client{}),
+		WithHTTPRoundTripper(&http.Transport{}),
+		WithHTTP2(),
+		WithNamespace("test"),
+		WithoutUrlHealthCheck(),
+	)
+	require.Error(t, err)
+}
+
+// BenchmarkConcurrentDownloads compares decoding 50 small blobs concurrently over HTTP/1.1,
+// which opens a connection per download in flight, with h2c, which multiplexes them.
+func BenchmarkConcurrentDownloads(b *testing.B) {
+	const blobs = 50
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	s := server.New(&memory.Driver{}, server.WithH2C())
+	go func() { _ = s.Serve(listener) }()
+	defer s.Shutdown(context.Background())
+
+	for name, opts := range map[string][]Option{
+		"HTTP/1.1": nil,
+		"h2c":      {WithHTTP2()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			c, err := New(append(opts,
+				WithURL("http://"+listener.Addr().String()),
+				WithNamespace("test"),
+				WithMinBytes(1),
+				WithMaxConcurrentDownloads(blobs),
+			)...)
+			require.NoError(b, err)
+			defer c.Close()
+			payloads := make([]*common.Payload, blobs)
+			for i := range payloads {
+				payloads[i] = &common.Payload{Data: []byte(fmt.Sprintf("small blob %d", i))}
+			}
+			encoded, err := c.Encode(payloads)
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Decode(encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_codec_connects_to_lps_mounted_under_base_path(t *testing.T) {
+	testServer := httptest.NewServer(server.NewHttpHandlerWithOptions(&memory.Driver{}, server.WithBasePath("/lps/")))
+	defer testServer.Close()
+
+	for name, opts := range map[string][]Option{
+		"base path":                   {WithURL(testServer.URL), WithBasePath("/lps")},
+		"base path without slashes":   {WithURL(testServer.URL + "/"), WithBasePath("lps")},
+		"base path with slashes":      {WithURL(testServer.URL), WithBasePath("/lps/")},
+		"base path of URL":            {WithURL(testServer.URL + "/lps")},
+		"base path of URL with slash": {WithURL(testServer.URL + "/lps/")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the startup health check is sent under the base path as well
+			c, err := New(append(opts, WithNamespace("test"), WithMinBytes(1), WithHTTPClient(testServer.Client()))...)
+			require.NoError(t, err)
+			defer c.Close()
+
+			payload := common.Payload{Data: []byte("hello world")}
+			encoded, err := c.Encode([]*common.Payload{&payload})
+			require.NoError(t, err)
+			decoded, err := c.Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, []*common.Payload{&payload}, decoded)
+		})
+	}
+
+	_, err := New(WithURL(testServer.URL), WithNamespace("test"), WithHTTPClient(testServer.Client()))
+	require.Error(t, err, "the server is not mounted at the root path")
+}
+
+func Test_codec_uploads_blobs_with_configured_method(t *testing.T) {
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			var uploadMethods []string
+			recordUploads := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/v2/blobs/put" {
+						uploadMethods = append(uploadMethods, r.Method)
+					}
+					next.ServeHTTP(w, r)
+				})
+			}
+			testServer := httptest.NewServer(server.NewHttpHandlerWithOptions(&memory.Driver{}, server.WithMiddleware(recordUploads)))
+			defer testServer.Close()
+
+			c, err := New(
+				WithURL(testServer.URL),
+				WithNamespace("test"),
+				WithMinBytes(1),
+				WithHTTPClient(testServer.Client()),
+				WithUploadMethod(method),
+			)
+			require.NoError(t, err)
+			defer c.Close()
+
+			payload := common.Payload{Data: []byte("hello world")}
+			encoded, err := c.Encode([]*common.Payload{&payload})
+			require.NoError(t, err)
+			decoded, err := c.Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, []*common.Payload{&payload}, decoded)
+			require.Equal(t, []string{method}, uploadMethods)
+		})
+	}
+
+	_, err := New(WithURL("http://localhost"), WithNamespace("test"), WithoutUrlHealthCheck(), WithUploadMethod(http.MethodPatch))
+	require.EqualError(t, err, `invalid upload method "PATCH": must be PUT or POST`)
+}
+
+func Test_codec_sends_expect_continue_with_uploads(t *testing.T) {
+	var expectations []string
+	recordUploads := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/blobs/put" {
+				expectations = append(expectations, r.Header.Get("Expect"))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	testServer := httptest.NewServer(server.NewHttpHandlerWithOptions(&memory.Driver{}, server.WithMiddleware(recordUploads)))
+	defer testServer.Close()
+	client := testServer.Client()
+	client.Transport.(*http.Transport).ExpectContinueTimeout = time.Second
+
+	c, err := New(
+		WithURL(testServer.URL),
+		WithNamespace("test"),
+		WithMinBytes(1),
+		WithHTTPClient(client),
+		WithExpectContinue(),
+		WithExistenceCheck(false),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	payload := common.Payload{Data: []byte("hello world")}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{&payload}, decoded)
+	require.Equal(t, []string{"100-continue"}, expectations)
+}
+
+func Test_key_prefix_func_sets_key_prefix(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithKeyPrefixFunc(func(payload *common.Payload) string {
+			return string(payload.GetMetadata()["team"])
+		}),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Metadata: map[string][]byte{
+			"team": []byte("team-a/project"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+
+	// the caller's payload is not modified
+	require.Equal(t, map[string][]byte{"team": []byte("team-a/project")}, payload.Metadata)
+
+	var remoteP remotePayload
+	require.NoError(t, converter.GetDefaultDataConverter().FromPayload(encoded[0], &remoteP))
+	require.True(t, strings.HasPrefix(remoteP.Key, "/blobs/test/custom/team-a/project/"))
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, []byte("team-a/project"), decoded[0].Metadata[v2.KeyPrefixMetadataKey])
+
+	// an empty prefix means no prefix
+	payload.Metadata["team"] = nil
+	encoded, err = c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	require.NoError(t, converter.GetDefaultDataConverter().FromPayload(encoded[0], &remoteP))
+	require.True(t, strings.HasPrefix(remoteP.Key, "/blobs/test/common/"))
+
+	// invalid prefixes are rejected before sending the payload, including the ones with empty
+	// segments which the server rejects
+	for _, prefix := range []string{"../../a", "a//b", "a/"} {
+		payload.Metadata["team"] = []byte(prefix)
+		_, err = c.Encode([]*common.Payload{&payload})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not a valid prefix")
+	}
+}
+
+func Test_namespace_provider_sets_namespace_per_payload(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	type namespaceKey struct{}
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("default"),
+		WithMinBytes(32),
+		WithNamespaceProvider(func(ctx context.Context, payload *common.Payload) string {
+			namespace, _ := ctx.Value(namespaceKey{}).(string)
+			return namespace
+		}),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		keyContains string
+	}{
+		{"provided namespace", context.WithValue(context.Background(), namespaceKey{}, "tenant-a"), "/blobs/tenant-a/"},
+		{"fallback to static namespace", context.Background(), "/blobs/default/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := c.EncodeWithContext(tt.ctx, []*common.Payload{&payload})
+			require.NoError(t, err)
+			key, err := c.Key(encoded[0])
+			require.NoError(t, err)
+			require.Contains(t, key, tt.keyContains)
+
+			// decoding does not depend on the namespace
+			decoded, err := c.Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, []*common.Payload{&payload}, decoded)
+		})
+	}
+
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("default"),
+		WithNamespaceProvider(nil),
+	)
+	require.Error(t, err)
+}
+
+func Test_key_prefix_can_be_stripped_on_decode(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	payload := &common.Payload{
+		Metadata: map[string][]byte{
+			"encoding":                []byte("json/plain"),
+			"remote-codec/key-prefix": []byte("1234"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected map[string][]byte
+	}{
+		{
+			name:     "metadata is restored verbatim by default",
+			expected: payload.Metadata,
+		},
+		{
+			name: "key prefix is stripped",
+			opts: []Option{WithStripKeyPrefixOnDecode()},
+			expected: map[string][]byte{
+				"encoding": []byte("json/plain"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(append([]Option{
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithMinBytes(32),
+				WithDecodeCache(1024),
+			}, tt.opts...)...)
+			require.NoError(t, err)
+
+			encoded, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+			key, err := c.Key(encoded[0])
+			require.NoError(t, err)
+			require.Contains(t, key, "/custom/1234/")
+
+			// the second decode is served from the cache
+			for i := 0; i < 2; i++ {
+				decoded, err := c.Decode(encoded)
+				require.NoError(t, err)
+				require.Equal(t, tt.expected, decoded[0].Metadata)
+				require.Equal(t, payload.Data, decoded[0].Data)
+			}
+		})
+	}
+	require.Contains(t, payload.Metadata, "remote-codec/key-prefix")
+}
+
+func Test_existence_check_skips_upload_of_existing_blobs(t *testing.T) {
+	var puts, heads int32
+	lps := server.NewHttpHandler(&memory.Driver{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			atomic.AddInt32(&puts, 1)
+		case http.MethodHead:
+			if strings.HasSuffix(r.URL.Path, "/blobs/head") {
+				atomic.AddInt32(&heads, 1)
+			}
+		}
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	payload := common.Payload{
+		Metadata: map[string][]byte{
+			"foo": []byte("bar"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+
+	encoded1, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	encoded2, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	require.Equal(t, encoded1, encoded2)
+	require.Equal(t, int32(2), atomic.LoadInt32(&heads))
+	require.Equal(t, int32(1), atomic.LoadInt32(&puts))
+
+	// without existence check, the payload is always uploaded
+	c, err = New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithExistenceCheck(false),
+	)
+	require.NoError(t, err)
+
+	encoded3, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	require.Equal(t, encoded1, encoded3)
+	require.Equal(t, int32(2), atomic.LoadInt32(&heads))
+	require.Equal(t, int32(2), atomic.LoadInt32(&puts))
+}
+
+func Test_codec_checks_existence_of_and_deletes_blobs(t *testing.T) {
+	lps := server.NewHttpHandler(&memory.Driver{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithBearerToken("token"),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+
+	key, err := c.Key(encoded[0])
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(key, "/blobs/test/common/"))
+
+	_, err = c.Key(&payload)
+	require.Error(t, err)
+
+	ctx := context.Background()
+	exists, err := c.Exists(ctx, key)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	require.NoError(t, c.Delete(ctx, key))
+
+	exists, err = c.Exists(ctx, key)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	_, err = c.Decode(encoded)
+	require.Error(t, err)
+
+	_, err = c.Exists(ctx, "")
+	require.Error(t, err)
+}
+
+func Test_read_urls_are_used_for_payloads_not_found_at_primary_url(t *testing.T) {
+	oldServer := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer oldServer.Close()
+	newServer := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer newServer.Close()
+
+	newCodec := func(opts ...Option) *Codec {
+		c, err := New(append([]Option{
+			WithHTTPClient(newServer.Client()),
+			WithNamespace("test"),
+			WithMinBytes(32),
+		}, opts...)...)
+		require.NoError(t, err)
+		return c
+	}
+
+	oldPayload := common.Payload{Data: []byte("this payload was stored before the migration started")}
+	oldEncoded, err := newCodec(WithURL(oldServer.URL)).Encode([]*common.Payload{&oldPayload})
+	require.NoError(t, err)
+
+	logger := &recordingLogger{}
+	c := newCodec(WithURL(newServer.URL), WithReadURL(oldServer.URL), WithLogger(logger))
+
+	// old payloads are read from the read URL
+	decoded, err := c.Decode(oldEncoded)
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{&oldPayload}, decoded)
+	require.Equal(t, []string{"downloaded payload from read URL"}, logger.infos)
+
+	// new payloads are only written to the primary URL
+	newPayload := common.Payload{Data: []byte("this payload was stored after the migration started")}
+	newEncoded, err := c.Encode([]*common.Payload{&newPayload})
+	require.NoError(t, err)
+	decoded, err = newCodec(WithURL(newServer.URL)).Decode(newEncoded)
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{&newPayload}, decoded)
+	_, err = newCodec(WithURL(oldServer.URL)).Decode(newEncoded)
+	require.ErrorIs(t, err, ErrBlobNotFound)
+
+	// without read URLs, old payloads are not found
+	_, err = newCodec(WithURL(newServer.URL)).Decode(oldEncoded)
+	require.ErrorIs(t, err, ErrBlobNotFound)
+}
+
+func Test_missing_blobs_are_decoded_to_placeholders(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	newCodec := func(opts ...Option) *Codec {
+		c, err := New(append([]Option{
+			WithURL(s.URL),
+			WithHTTPClient(s.Client()),
+			WithNamespace("test"),
+			WithMinBytes(32),
+		}, opts...)...)
+		require.NoError(t, err)
+		return c
+	}
+
+	payloads := []*common.Payload{
+		{Data: []byte("this is the first longer message blah blah blah blah")},
+		{Data: []byte("this is the second longer message blah blah blah blah")},
+		{Data: []byte("small")},
+	}
+	encoded, err := newCodec().Encode(payloads)
+	require.NoError(t, err)
+	key, err := newCodec().Key(encoded[1])
+	require.NoError(t, err)
+	require.NoError(t, newCodec().Delete(context.Background(), key))
+
+	// decoding fails by default
+	_, err = newCodec().Decode(encoded)
+	require.ErrorIs(t, err, ErrBlobNotFound)
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "individual downloads"},
+		{name: "batch downloads", opts: []Option{WithBatchDownloads()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := newCodec(append(tt.opts, WithMissingBlobPlaceholder())...).Decode(encoded)
+			require.NoError(t, err)
+			require.Len(t, decoded, 3)
+			require.Equal(t, payloads[0], decoded[0])
+			require.Equal(t, payloads[2], decoded[2])
+
+			placeholder := decoded[1]
+			require.Equal(t, map[string][]byte{
+				"encoding":             []byte("json/plain"),
+				"remote-codec/missing": []byte("true"),
+			}, placeholder.Metadata)
+			require.JSONEq(t, fmt.Sprintf(
+				`{"key":%q,"digest":%q,"size":%d}`,
+				key, sha256Digest(payloads[1].Data), len(payloads[1].Data),
+			), string(placeholder.Data))
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func Test_blob_downloads_are_compressed_for_compressible_encodings(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandlerWithOptions(&memory.Driver{}, server.WithCompressibleEncodings("json/custom")))
+	defer s.Close()
+
+	var mu sync.Mutex
+	var contentEncodings []string
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := s.Client().Transport.RoundTrip(req)
+			if err == nil && strings.HasSuffix(req.URL.Path, "/blobs/get") {
+				mu.Lock()
+				contentEncodings = append(contentEncodings, resp.Header.Get("Content-Encoding"))
+				mu.Unlock()
+			}
+			return resp, err
+		}),
+	}
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(client),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte(`{"message":"this is a longer message blah blah blah"}`), 100)
+	tests := []struct {
+		name            string
+		encoding        string
+		contentEncoding string
+	}{
+		{"compressed", "json/plain", "gzip"},
+		{"compressed custom encoding", "json/custom", "gzip"},
+		{"uncompressed", "binary/plain", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := &common.Payload{
+				Metadata: map[string][]byte{"encoding": []byte(tt.encoding)},
+				Data:     data,
+			}
+			encoded, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+
+			contentEncodings = nil
+			// the digest of the decompressed data is verified
+			decoded, err := c.Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, []*common.Payload{payload}, decoded)
+			require.Equal(t, []string{tt.contentEncoding}, contentEncodings)
+		})
+	}
+}
+
+func Test_min_bytes_can_be_overridden_per_encoding(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(128),
+		WithMinBytesForEncoding("binary/protobuf", 32),
+		WithMinBytesForEncoding("binary/plain", 1024),
+	)
+	require.NoError(t, err)
+
+	data := []byte("this is a longer message blah blah blah blah blah blah blah")
+	payloads := []*common.Payload{
+		{Metadata: map[string][]byte{"encoding": []byte("binary/protobuf")}, Data: data},
+		{Metadata: map[string][]byte{"encoding": []byte("json/plain")}, Data: data},
+		{Metadata: map[string][]byte{"encoding": []byte("binary/protobuf")}, Data: []byte("short")},
+		{Metadata: map[string][]byte{"encoding": []byte("json/plain")}, Data: bytes.Repeat(data, 4)},
+		{Metadata: map[string][]byte{"encoding": []byte("binary/plain")}, Data: bytes.Repeat(data, 4)},
+		{Data: bytes.Repeat(data, 4)},
+	}
+
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+
+	var offloaded []bool
+	for _, payload := range encoded {
+		_, ok := payload.GetMetadata()[remoteCodecName]
+		offloaded = append(offloaded, ok)
+	}
+	require.Equal(t, []bool{true, false, false, true, false, true}, offloaded)
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+}
+
+// unhealthyUntil returns a server which fails the first n health checks.
+func unhealthyUntil(n int32) (*httptest.Server, *int32) {
+	var healthChecks int32
+	lps := server.NewHttpHandler(&memory.Driver{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/health/head") && atomic.AddInt32(&healthChecks, 1) <= n {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		lps.ServeHTTP(w, r)
+	}))
+	return s, &healthChecks
+}
+
+func Test_min_bytes_is_compared_to_data_length(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(64),
+	)
+	require.NoError(t, err)
+
+	largeMetadata := map[string][]byte{
+		"encoding": []byte("json/plain"),
+		"extra":    bytes.Repeat([]byte("x"), 128),
+	}
+	tests := []struct {
+		name      string
+		payload   *common.Payload
+		offloaded bool
+	}{
+		{"data below threshold", &common.Payload{Data: bytes.Repeat([]byte("a"), 63)}, false},
+		{"data at threshold", &common.Payload{Data: bytes.Repeat([]byte("a"), 64)}, true},
+		{"data above threshold", &common.Payload{Data: bytes.Repeat([]byte("a"), 65)}, true},
+		{"large metadata with small data", &common.Payload{Metadata: largeMetadata, Data: []byte("a")}, false},
+		{"large metadata with data at threshold", &common.Payload{Metadata: largeMetadata, Data: bytes.Repeat([]byte("a"), 64)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := c.Encode([]*common.Payload{tt.payload})
+			require.NoError(t, err)
+			_, offloaded := encoded[0].GetMetadata()[remoteCodecName]
+			require.Equal(t, tt.offloaded, offloaded)
+
+			decoded, err := c.Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, tt.payload, decoded[0])
+		})
+	}
+}
+
+func Test_stub_metadata_keys_are_copied_to_encoded_payloads(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	payload := &common.Payload{
+		Metadata: map[string][]byte{
+			"encoding":    []byte("binary/protobuf"),
+			"messageType": []byte("foo.Bar"),
+			"secret":      []byte("hunter2"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected map[string]string
+	}{
+		{
+			name: "default keys",
+			expected: map[string]string{
+				"remote-codec/original-encoding":    "binary/protobuf",
+				"remote-codec/original-messageType": "foo.Bar",
+				"remote-codec/original-size":        "59",
+			},
+		},
+		{
+			name: "custom keys",
+			opts: []Option{WithStubMetadataKeys("encoding", "secret", "missing")},
+			expected: map[string]string{
+				"remote-codec/original-encoding": "binary/protobuf",
+				"remote-codec/original-secret":   "hunter2",
+				"remote-codec/original-size":     "59",
+			},
+		},
+		{
+			name: "no keys",
+			opts: []Option{WithStubMetadataKeys()},
+			expected: map[string]string{
+				"remote-codec/original-size": "59",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(append([]Option{
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithMinBytes(32),
+			}, tt.opts...)...)
+			require.NoError(t, err)
+
+			encoded, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+			actual := map[string]string{}
+			for k, v := range encoded[0].GetMetadata() {
+				if strings.HasPrefix(k, "remote-codec/original-") {
+					actual[k] = string(v)
+				}
+			}
+			require.Equal(t, tt.expected, actual)
+
+			decoded, err := c.Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, []*common.Payload{payload}, decoded)
+		})
+	}
+
+	_, err := New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithStubMetadataKeys(""),
+	)
+	require.Error(t, err)
+}
+
+func Test_metadata_lists_withhold_metadata_from_lps(t *testing.T) {
+	handler := server.NewHttpHandler(&memory.Driver{})
+	var sentMetadata []map[string][]byte
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/blobs/put") {
+			raw, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Temporal-Metadata"))
+			require.NoError(t, err)
+			var metadata map[string][]byte
+			require.NoError(t, json.Unmarshal(raw, &metadata))
+			sentMetadata = append(sentMetadata, metadata)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	payload := &common.Payload{
+		Metadata: map[string][]byte{
+			"encoding":                []byte("json/plain"),
+			"route":                   []byte("eu-west"),
+			"user":                    []byte("jdoe"),
+			"remote-codec/key-prefix": []byte("1234"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	tests := []struct {
+		name     string
+		opts     []Option
+		sent     []string
+		withheld []string
+	}{
+		{
+			name: "all metadata is sent by default",
+			sent: []string{"encoding", "remote-codec/key-prefix", "route", "user"},
+		},
+		{
+			name:     "allowlist",
+			opts:     []Option{WithMetadataAllowlist("encoding", "route", "missing")},
+			sent:     []string{"encoding", "remote-codec/key-prefix", "route"},
+			withheld: []string{"remote-codec/withheld-user"},
+		},
+		{
+			name:     "denylist",
+			opts:     []Option{WithMetadataDenylist("route", "user")},
+			sent:     []string{"encoding", "remote-codec/key-prefix"},
+			withheld: []string{"remote-codec/withheld-route", "remote-codec/withheld-user"},
+		},
+		{
+			name:     "denylist takes precedence over allowlist",
+			opts:     []Option{WithMetadataAllowlist("encoding", "route"), WithMetadataDenylist("route")},
+			sent:     []string{"encoding", "remote-codec/key-prefix"},
+			withheld: []string{"remote-codec/withheld-route", "remote-codec/withheld-user"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(append([]Option{
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithMinBytes(32),
+				WithExistenceCheck(false),
+				WithDecodeCache(1024),
+			}, tt.opts...)...)
+			require.NoError(t, err)
+
+			sentMetadata = nil
+			encoded, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+			require.Len(t, sentMetadata, 1)
+			require.ElementsMatch(t, tt.sent, metadataKeys(sentMetadata[0]))
+
+			remoteP, err := fromEnvelope(encoded[0])
+			require.NoError(t, err)
+			require.ElementsMatch(t, tt.sent, metadataKeys(remoteP.Metadata))
+
+			var withheld []string
+			for k, v := range encoded[0].GetMetadata() {
+				if strings.HasPrefix(k, "remote-codec/withheld-") {
+					withheld = append(withheld, k)
+					require.Equal(t, payload.Metadata[strings.TrimPrefix(k, "remote-codec/withheld-")], v)
+				}
+			}
+			require.ElementsMatch(t, tt.withheld, withheld)
+
+			// withheld metadata is merged back, also when served from the cache
+			for i := 0; i < 2; i++ {
+				decoded, err := c.Decode(encoded)
+				require.NoError(t, err)
+				require.Equal(t, []*common.Payload{payload}, decoded)
+			}
+		})
+	}
+
+	for _, opt := range []Option{
+		WithMetadataAllowlist(""),
+		WithMetadataDenylist(""),
+		WithMetadataDenylist("remote-codec/key-prefix"),
+	} {
+		_, err := New(WithURL(s.URL), WithNamespace("test"), opt)
+		require.Error(t, err)
+	}
+}
+
+func metadataKeys(metadata map[string][]byte) []string {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func Test_startup_health_check_is_retried(t *testing.T) {
+	s, healthChecks := unhealthyUntil(2)
+	defer s.Close()
+
+	// a single attempt fails
+	_, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+	)
+	require.Error(t, err)
+
+	// the second attempt fails and the third succeeds
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithStartupHealthCheckRetry(3, time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	require.Equal(t, int32(3), atomic.LoadInt32(healthChecks))
+
+	// retries are exhausted
+	s2, _ := unhealthyUntil(5)
+	defer s2.Close()
+	_, err = New(
+		WithURL(s2.URL),
+		WithHTTPClient(s2.Client()),
+		WithNamespace("test"),
+		WithStartupHealthCheckRetry(3, time.Millisecond),
+	)
+	require.Error(t, err)
+
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithStartupHealthCheckRetry(0, time.Millisecond),
+	)
+	require.Error(t, err)
+}
+
+func Test_lazy_health_check_is_deferred_to_first_use(t *testing.T) {
+	s, healthChecks := unhealthyUntil(2)
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithLazyHealthCheck(),
+	)
+	require.NoError(t, err)
+	require.Zero(t, atomic.LoadInt32(healthChecks))
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	_, err = c.Encode([]*common.Payload{&payload})
+	require.Error(t, err)
+	_, err = c.Decode([]*common.Payload{&payload})
+	require.Error(t, err)
+
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payload.Data, decoded[0].Data)
+
+	// no further checks once healthy
+	require.Equal(t, int32(3), atomic.LoadInt32(healthChecks))
+}
+
+func Test_health_monitor_tracks_health_in_background(t *testing.T) {
+	handler := server.NewHttpHandler(&memory.Driver{})
+	var down atomic.Bool
+	var healthChecks int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/health/head") {
+			atomic.AddInt32(&healthChecks, 1)
+			if down.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	payloads := []*common.Payload{
+		{Data: []byte("this is a longer message blah blah blah blah blah blah blah")},
+		{Data: []byte("small")},
+	}
+	for _, tt := range []struct {
+		name           string
+		inlineFallback bool
+	}{
+		{name: "fail fast"},
+		{name: "inline fallback", inlineFallback: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			down.Store(false)
+			opts := []Option{
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithMinBytes(32),
+				WithHealthMonitor(time.Millisecond),
+			}
+			if tt.inlineFallback {
+				opts = append(opts, WithInlineFallback())
+			}
+			c, err := New(opts...)
+			require.NoError(t, err)
+			require.True(t, c.Healthy())
+
+			down.Store(true)
+			require.Eventually(t, func() bool { return !c.Healthy() }, time.Second, time.Millisecond)
+
+			encoded, err := c.Encode(payloads)
+			if tt.inlineFallback {
+				require.NoError(t, err)
+				require.Equal(t, payloads, encoded)
+			} else {
+				require.ErrorIs(t, err, ErrUnhealthy)
+			}
+			// payloads which are not offloaded are not affected
+			_, err = c.Encode(payloads[1:])
+			require.NoError(t, err)
+
+			down.Store(false)
+			require.Eventually(t, c.Healthy, time.Second, time.Millisecond)
+			encoded, err = c.Encode(payloads)
+			require.NoError(t, err)
+			require.Contains(t, encoded[0].Metadata, remoteCodecName)
+
+			// the monitor stops when the codec is closed
+			require.NoError(t, c.Close())
+			require.False(t, c.Healthy())
+			// a check aborted by Close may still reach the server
+			time.Sleep(10 * time.Millisecond)
+			checks := atomic.LoadInt32(&healthChecks)
+			time.Sleep(10 * time.Millisecond)
+			require.Equal(t, checks, atomic.LoadInt32(&healthChecks))
+		})
+	}
+
+	_, err := New(WithURL(s.URL), WithNamespace("test"), WithHealthMonitor(0))
+	require.Error(t, err)
+}
+
+func Test_dry_run_records_offload_decisions_without_uploading(t *testing.T) {
+	handler := server.NewHttpHandler(&memory.Driver{})
+	var puts int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			atomic.AddInt32(&puts, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	metrics := newCapturingMetricsHandler()
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithDryRun(),
+		WithTemporalMetricsHandler(metrics),
+	)
+	require.NoError(t, err)
+
+	large := &common.Payload{Data: bytes.Repeat([]byte("a"), 1024)}
+	small := &common.Payload{Data: []byte("small")}
+	encoded, err := c.Encode([]*common.Payload{large, small})
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{large, small}, encoded)
+	require.Zero(t, atomic.LoadInt32(&puts))
+
+	stats := c.DryRunStats()
+	require.Equal(t, int64(2), stats.Payloads)
+	require.Equal(t, int64(1029), stats.Bytes)
+	require.Equal(t, int64(1), stats.OffloadedPayloads)
+	require.Equal(t, int64(1024), stats.OffloadedBytes)
+	require.Greater(t, stats.SavedBytes, int64(0))
+	require.Less(t, stats.SavedBytes, int64(1024))
+	require.Equal(t, int64(1), metrics.counters["lps_dry_run_total{namespace=test,operation=encode}"])
+	require.Equal(t, stats.SavedBytes, metrics.counters["lps_dry_run_saved_bytes{namespace=test,operation=encode}"])
+
+	// payloads offloaded before are still decoded
+	other, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+	offloaded, err := other.Encode([]*common.Payload{large})
+	require.NoError(t, err)
+	decoded, err := c.Decode(offloaded)
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{large}, decoded)
+}
+
+func Test_reencoding_in_another_namespace_preserves_original_blob(t *testing.T) {
+	handler := server.NewHttpHandler(&memory.Driver{})
+	var puts int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			atomic.AddInt32(&puts, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	newCodec := func(namespace string, opts ...Option) *Codec {
+		c, err := New(append([]Option{
+			WithURL(s.URL),
+			WithHTTPClient(s.Client()),
+			WithNamespace(namespace),
+			WithMinBytes(32),
+		}, opts...)...)
+		require.NoError(t, err)
+		return c
+	}
+	payload := &common.Payload{
+		Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+		Data:     []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	// the workflow history is encoded in ns-a and replicated to ns-b
+	encoded, err := newCodec("ns-a").Encode([]*common.Payload{payload})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&puts))
+	info, err := Inspect(encoded[0])
+	require.NoError(t, err)
+	require.Equal(t, "ns-a", info.Namespace)
+
+	replica := newCodec("ns-b", WithPreserveNamespaceOnReencode())
+	decoded, err := replica.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payload.Data, decoded[0].Data)
+	require.Equal(t, []byte(info.Key), decoded[0].Metadata[originKeyName])
+
+	// re-encoding the unchanged payload references the blob in ns-a
+	reencoded, err := replica.Encode(decoded)
+	require.NoError(t, err)
+	require.Equal(t, encoded, reencoded)
+	require.Equal(t, int32(1), atomic.LoadInt32(&puts))
+	redecoded, err := replica.Decode(reencoded)
+	require.NoError(t, err)
+	require.Equal(t, decoded, redecoded)
+
+	// a modified payload is stored in ns-b
+	modified := &common.Payload{Metadata: decoded[0].Metadata, Data: append([]byte("modified: "), decoded[0].Data...)}
+	reencoded, err = replica.Encode([]*common.Payload{modified})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&puts))
+	info, err = Inspect(reencoded[0])
+	require.NoError(t, err)
+	require.Equal(t, "ns-b", info.Namespace)
+	require.NotContains(t, info.Metadata, originKeyName)
+
+	// without the option, payloads are stored in the configured namespace
+	decoded, err = newCodec("ns-b").Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payload, decoded[0])
+	reencoded, err = newCodec("ns-b").Encode(decoded)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&puts))
+	info, err = Inspect(reencoded[0])
+	require.NoError(t, err)
+	require.Equal(t, "ns-b", info.Namespace)
+}
+
+func Test_digest_verification_modes(t *testing.T) {
+	d := &memory.Driver{}
+	s := httptest.NewServer(server.NewHttpHandler(d))
+	defer s.Close()
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	key, err := c.Key(encoded[0])
+	require.NoError(t, err)
+
+	for _, scenario := range []struct {
+		name     string
+		data     []byte
+		mode     DigestVerificationMode
+		wantErr  bool
+		wantLogs int
+	}{
+		{name: "strict", data: bytes.ToUpper(payload.Data), mode: DigestVerificationStrict, wantErr: true, wantLogs: 1},
+		{name: "warn", data: bytes.ToUpper(payload.Data), mode: DigestVerificationWarn, wantLogs: 1},
+		{name: "skip", data: bytes.ToUpper(payload.Data), mode: DigestVerificationSkip},
+	} {
+		t.Run(scenario.name, func(t *testing.T) {
+			// tamper with the stored blob
+			_, err := d.PutPayload(context.Background(), &storage.PutRequest{
+				Data: bytes.NewReader(scenario.data),
+				Key:  key,
+			})
+			require.NoError(t, err)
+
+			logger := &recordingLogger{}
+			c, err := New(
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithLogger(logger),
+				WithDigestVerification(scenario.mode),
+			)
+			require.NoError(t, err)
+
+			decoded, err := c.Decode(encoded)
+			if scenario.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, scenario.data, decoded[0].Data)
+			}
+			require.Len(t, logger.errors, scenario.wantLogs)
+		})
+	}
+
+	// size mismatches are handled the same way
+	remoteP := &remotePayload{Size: 10, Digest: "sha256:foo"}
+	c.digestVerification = DigestVerificationStrict
+	require.Error(t, c.verifyPayload(remoteP, []byte("short"), "foo"))
+	c.digestVerification = DigestVerificationWarn
+	require.NoError(t, c.verifyPayload(remoteP, []byte("short"), "foo"))
+	c.digestVerification = DigestVerificationSkip
+	require.NoError(t, c.verifyPayload(remoteP, []byte("short"), "foo"))
+
+	// as are metadata mismatches, while envelopes without metadata digest are accepted
+	data := []byte("foo")
+	sum := sha256.Sum256(data)
+	remoteP = &remotePayload{
+		Metadata:       map[string][]byte{"encoding": []byte("json/plain")},
+		Size:           3,
+		Digest:         "sha256:" + hex.EncodeToString(sum[:]),
+		MetadataDigest: "sha256:bar",
+	}
+	c.digestVerification = DigestVerificationStrict
+	require.ErrorContains(t, c.verifyPayload(remoteP, data, hex.EncodeToString(sum[:])), "wanted metadata sha")
+	c.digestVerification = DigestVerificationWarn
+	require.NoError(t, c.verifyPayload(remoteP, data, hex.EncodeToString(sum[:])))
+	c.digestVerification = DigestVerificationStrict
+	remoteP.MetadataDigest = ""
+	require.NoError(t, c.verifyPayload(remoteP, data, hex.EncodeToString(sum[:])))
+
+	_, err = New(
+		WithURL(s.URL),
+		WithNamespace("test"),
+		WithDigestVerification(DigestVerificationMode(42)),
+	)
+	require.Error(t, err)
+}
+
+func Test_blob_downloads_without_content_type_succeed(t *testing.T) {
+	// servers of previous releases set no Content-Type, which net/http sniffs from the body
+	payload := &common.Payload{Data: []byte(`{"message":"this is a longer message blah blah blah blah blah"}`)}
+	handler := server.NewHttpHandler(&memory.Driver{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/blobs/get" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		for name, values := range recorder.Header() {
+			if name != "Content-Type" {
+				w.Header()[name] = values
+			}
+		}
+		w.WriteHeader(recorder.Code)
+		_, _ = w.Write(recorder.Body.Bytes())
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+	encoded, err := c.Encode([]*common.Payload{payload})
+	require.NoError(t, err)
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payload.Data, decoded[0].Data)
+
+	key, err := c.Key(encoded[0])
+	require.NoError(t, err)
+	resp, err := s.Client().Get(s.URL + "/v2/blobs/get?key=" + url.QueryEscape(key))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+}
+
+func Test_blob_downloads_with_unexpected_responses_fail(t *testing.T) {
+	payload := &common.Payload{Data: []byte("this is a longer message blah blah blah blah blah blah blah")}
+
+	for _, scenario := range []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+		wantErr string
+	}{
+		{
+			name: "html error page",
+			respond: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, _ = w.Write([]byte("<html><body>Bad Gateway</body></html>"))
+			},
+			wantErr: `server returned blob with unexpected Content-Type "text/html; charset=utf-8"`,
+		},
+		{
+			name: "wrong content length",
+			respond: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				_, _ = w.Write(bytes.Repeat(payload.Data, 3))
+			},
+			wantErr: "wanted object of size 59, server returned Content-Length 177",
+		},
+		{
+			name: "over-long body of unknown length",
+			respond: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				for i := 0; i < 1000; i++ {
+					_, _ = w.Write(bytes.Repeat(payload.Data, 100))
+					w.(http.Flusher).Flush()
+				}
+			},
+			wantErr: "server returned more than the expected 59 bytes",
+		},
+	} {
+		t.Run(scenario.name, func(t *testing.T) {
+			handler := server.NewHttpHandler(&memory.Driver{})
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/blobs/get" {
+					scenario.respond(w)
+					return
+				}
+				handler.ServeHTTP(w, r)
+			}))
+			defer s.Close()
+
+			c, err := New(
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithMinBytes(32),
+			)
+			require.NoError(t, err)
+			encoded, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+
+			_, err = c.Decode(encoded)
+			require.ErrorContains(t, err, scenario.wantErr)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"sync"
+)
+
+// forEachConcurrently calls f for each of indexes with up to limit calls in flight. If budget
+// is not nil, the calls in flight additionally share it according to their weight. Once a
+// call fails, the context of the other calls is canceled, no further calls are made and the
+// error is returned.
+func forEachConcurrently(ctx context.Context, indexes []int, limit int, budget *byteBudget, weight func(int) int64, f func(context.Context, int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, limit)
+loop:
+	for _, i := range indexes {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+		var n int64
+		if budget != nil {
+			n = weight(i)
+			if err := budget.acquire(ctx, n); err != nil {
+				<-sem
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func(i int, n int64) {
+			defer wg.Done()
+			defer func() {
+				if budget != nil {
+					budget.release(n)
+				}
+				<-sem
+			}()
+			if err := f(ctx, i); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i, n)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// byteBudget is a weighted semaphore bounding the number of bytes in flight. A weight larger
+// than the capacity is acquired once nothing else is in flight, rather than never.
+//
+// Only a single goroutine may acquire the budget, while any goroutine may release it.
+type byteBudget struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	// released is signaled whenever a weight is released.
+	released chan struct{}
+}
+
+func newByteBudget(capacity int64) *byteBudget {
+	return &byteBudget{capacity: capacity, released: make(chan struct{}, 1)}
+}
+
+// acquire waits until n bytes are available or ctx is done.
+func (b *byteBudget) acquire(ctx context.Context, n int64) error {
+	n = b.clamp(n)
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.capacity {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes acquired before.
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= b.clamp(n)
+	b.mu.Unlock()
+
+	select {
+	case b.released <- struct{}{}:
+	default:
+	}
+}
+
+// clamp limits n to the capacity, so that large weights can be acquired alone.
+func (b *byteBudget) clamp(n int64) int64 {
+	if n > b.capacity {
+		return b.capacity
+	}
+	return n
+}
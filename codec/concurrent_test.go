@@ -0,0 +1,112 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// inflightRecorder is a fake LPS server recording the peak number of bytes uploaded concurrently.
+type inflightRecorder struct {
+	handler http.Handler
+	mu      sync.Mutex
+	bytes   int64
+	peak    int64
+}
+
+func (r *inflightRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPut {
+		r.mu.Lock()
+		r.bytes += req.ContentLength
+		if r.bytes > r.peak {
+			r.peak = r.bytes
+		}
+		r.mu.Unlock()
+		defer func() {
+			r.mu.Lock()
+			r.bytes -= req.ContentLength
+			r.mu.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	r.handler.ServeHTTP(w, req)
+}
+
+func (r *inflightRecorder) resetPeak() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peak := r.peak
+	r.peak = 0
+	return peak
+}
+
+func Test_concurrent_uploads_are_bounded_by_inflight_bytes(t *testing.T) {
+	recorder := &inflightRecorder{handler: server.NewHttpHandler(&memory.Driver{})}
+	s := httptest.NewServer(recorder)
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithMaxInflightBytes(1000),
+	)
+	require.NoError(t, err)
+
+	var payloads []*common.Payload
+	for i := 0; i < 6; i++ {
+		payloads = append(payloads, &common.Payload{Data: bytes.Repeat([]byte{byte('a' + i)}, 400)})
+	}
+	payloads = append(payloads, &common.Payload{Data: []byte("small")})
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+	// two uploads of 400 bytes fit into the budget, three do not
+	peak := recorder.resetPeak()
+	require.LessOrEqual(t, peak, int64(1000))
+	require.Greater(t, peak, int64(400))
+
+	// a payload exceeding the budget is uploaded alone
+	large := &common.Payload{Data: bytes.Repeat([]byte("z"), 1500)}
+	_, err = c.Encode([]*common.Payload{large, payloads[0], payloads[1]})
+	require.NoError(t, err)
+	require.Equal(t, int64(1500), recorder.resetPeak())
+
+	// the number of concurrent uploads is limited further
+	c, err = New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithMaxInflightBytes(1000),
+		WithMaxConcurrentUploads(1),
+	)
+	require.NoError(t, err)
+	for i := range payloads {
+		payloads[i] = &common.Payload{Data: append([]byte("other "), payloads[i].Data...)}
+	}
+	_, err = c.Encode(payloads)
+	require.NoError(t, err)
+	require.Equal(t, int64(406), recorder.resetPeak())
+
+	_, err = New(WithURL(s.URL), WithNamespace("test"), WithMaxInflightBytes(0))
+	require.Error(t, err)
+	_, err = New(WithURL(s.URL), WithNamespace("test"), WithMaxConcurrentUploads(0))
+	require.Error(t, err)
+}
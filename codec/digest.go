@@ -0,0 +1,69 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// defaultDigestAlgorithm is the digest algorithm used unless configured with WithDigestAlgorithm.
+const defaultDigestAlgorithm = "sha256"
+
+// DigestVerifier returns the hashes of digest algorithms other than sha256, see WithDigestVerifier.
+type DigestVerifier interface {
+	// New returns a new hash of the given algorithm, or an error if it is not supported.
+	New(algorithm string) (hash.Hash, error)
+}
+
+// newHash returns a hash of the given digest algorithm, along with a function which must be
+// called once the hash is no longer used.
+func (c *Codec) newHash(algorithm string) (hash.Hash, func(), error) {
+	if algorithm == defaultDigestAlgorithm {
+		h := hashPool.Get().(hash.Hash)
+		return h, func() { putHash(h) }, nil
+	}
+	if c.digestVerifier == nil {
+		return nil, nil, fmt.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+	h, err := c.digestVerifier.New(algorithm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unsupported digest algorithm %s: %w", algorithm, err)
+	}
+	return h, func() {}, nil
+}
+
+// digest returns the digest of data in the format <algorithm>:<hex encoded value>, using the
+// algorithm configured with WithDigestAlgorithm.
+func (c *Codec) digest(data []byte) (string, error) {
+	if c.digestAlgorithm == defaultDigestAlgorithm {
+		return sha256Digest(data), nil
+	}
+	h, release, err := c.newHash(c.digestAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	h.Write(data)
+	return c.digestAlgorithm + ":" + hexSum(h), nil
+}
+
+// digestFor returns the digest of data computed with the algorithm of the given digest, in
+// the same format. checkSum is the hex encoded sha256 checksum of data, which is computed
+// while downloading it.
+func (c *Codec) digestFor(digest string, data []byte, checkSum string) (string, error) {
+	algorithm, _, _ := strings.Cut(digest, ":")
+	if algorithm == defaultDigestAlgorithm {
+		return algorithm + ":" + checkSum, nil
+	}
+	h, release, err := c.newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	h.Write(data)
+	return algorithm + ":" + hexSum(h), nil
+}
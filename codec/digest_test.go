@@ -0,0 +1,93 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// fnvVerifier supports the fnv64a digest algorithm.
+type fnvVerifier struct{}
+
+func (fnvVerifier) New(algorithm string) (hash.Hash, error) {
+	if algorithm != "fnv64a" {
+		return nil, fmt.Errorf("unknown algorithm %s", algorithm)
+	}
+	return fnv.New64a(), nil
+}
+
+func init() {
+	v2.RegisterHash("fnv64a", func() hash.Hash { return fnv.New64a() })
+}
+
+func Test_payloads_are_encoded_and_verified_with_custom_digest_algorithms(t *testing.T) {
+	d := &memory.Driver{}
+	s := httptest.NewServer(server.NewHttpHandler(d))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithDigestVerifier(fnvVerifier{}),
+		WithDigestAlgorithm("fnv64a"),
+	)
+	require.NoError(t, err)
+
+	payloads := []*common.Payload{{Data: []byte("this is a longer message blah blah blah blah blah blah blah")}}
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+	info, err := Inspect(encoded[0])
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(info.Digest, "fnv64a:"), info.Digest)
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+
+	// codecs without the verifier cannot verify the payload
+	plain, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"))
+	require.NoError(t, err)
+	_, err = plain.Decode(encoded)
+	require.EqualError(t, err, "unsupported digest algorithm fnv64a")
+
+	// sha256 digests are still verified by codecs with a verifier
+	sha256Encoded, err := plain.Encode([]*common.Payload{{Data: bytes.Repeat([]byte("a"), 200_000)}})
+	require.NoError(t, err)
+	_, err = c.Decode(sha256Encoded)
+	require.NoError(t, err)
+
+	// modified blobs are detected
+	_, err = d.PutPayload(context.Background(), &storage.PutRequest{
+		Data: bytes.NewReader(bytes.ToUpper(payloads[0].Data)),
+		Key:  info.Key,
+	})
+	require.NoError(t, err)
+	_, err = c.Decode(encoded)
+	require.ErrorContains(t, err, "wanted object sha fnv64a:")
+
+	_, err = New(WithURL(s.URL), WithNamespace("test"), WithoutUrlHealthCheck(), WithDigestAlgorithm("fnv64a"))
+	require.EqualError(t, err, "unsupported digest algorithm fnv64a")
+	_, err = New(WithURL(s.URL), WithNamespace("test"), WithoutUrlHealthCheck(), WithDigestVerifier(fnvVerifier{}), WithDigestAlgorithm("xxh64"))
+	require.EqualError(t, err, "unsupported digest algorithm xxh64: unknown algorithm xxh64")
+	_, err = New(WithURL(s.URL), WithNamespace("test"), WithoutUrlHealthCheck(), WithDigestAlgorithm("a:b"))
+	require.Error(t, err)
+}
@@ -0,0 +1,47 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"sync"
+)
+
+// downloadGroup deduplicates the downloads of a Decode call, so that a blob referenced by
+// several payloads is downloaded once, even if the payloads are decoded concurrently.
+type downloadGroup struct {
+	mu        sync.Mutex
+	downloads map[string]*download
+}
+
+// download is a download of a blob which is in flight or completed.
+type download struct {
+	done     chan struct{}
+	data     []byte
+	checkSum string
+	err      error
+}
+
+func newDownloadGroup() *downloadGroup {
+	return &downloadGroup{downloads: make(map[string]*download)}
+}
+
+// do returns the data and checksum of the blob with key, calling fetch to download it unless
+// a download of the blob is in flight or completed already. Callers sharing a download get a
+// copy of the data.
+func (g *downloadGroup) do(key string, fetch func() ([]byte, string, error)) ([]byte, string, error) {
+	g.mu.Lock()
+	if d, ok := g.downloads[key]; ok {
+		g.mu.Unlock()
+		<-d.done
+		return cloneBytes(d.data), d.checkSum, d.err
+	}
+	d := &download{done: make(chan struct{})}
+	g.downloads[key] = d
+	g.mu.Unlock()
+
+	d.data, d.checkSum, d.err = fetch()
+	close(d.done)
+	return d.data, d.checkSum, d.err
+}
@@ -0,0 +1,124 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_blobs_are_downloaded_concurrently(t *testing.T) {
+	handler := server.NewHttpHandler(&memory.Driver{})
+	var gets, inFlight, maxInFlight int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/blobs/get") {
+			atomic.AddInt32(&gets, 1)
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithMaxConcurrentDownloads(3),
+	)
+	require.NoError(t, err)
+
+	var payloads []*common.Payload
+	for i := 0; i < 6; i++ {
+		payloads = append(payloads, &common.Payload{
+			Data: []byte(fmt.Sprintf("this is the longer message number %d blah blah blah", i)),
+		})
+	}
+	payloads = append(payloads, &common.Payload{Data: []byte("small")})
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+	require.Equal(t, int32(6), atomic.LoadInt32(&gets))
+	require.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(3))
+	require.Greater(t, atomic.LoadInt32(&maxInFlight), int32(1))
+
+	// a blob referenced by several payloads is downloaded once
+	atomic.StoreInt32(&gets, 0)
+	decoded, err = c.Decode([]*common.Payload{encoded[0], encoded[1], encoded[0], encoded[0]})
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{payloads[0], payloads[1], payloads[0], payloads[0]}, decoded)
+	require.Equal(t, int32(2), atomic.LoadInt32(&gets))
+}
+
+func Test_concurrent_downloads_are_canceled_on_error(t *testing.T) {
+	handler := server.NewHttpHandler(&memory.Driver{})
+	var canceled int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/blobs/get") && !strings.Contains(r.URL.Query().Get("key"), "unknown") {
+			select {
+			case <-r.Context().Done():
+				atomic.AddInt32(&canceled, 1)
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithMaxConcurrentDownloads(4),
+	)
+	require.NoError(t, err)
+
+	encoded, err := c.Encode([]*common.Payload{
+		{Data: []byte("this is the first longer message blah blah blah blah")},
+		{Data: []byte("this is the second longer message blah blah blah blah")},
+	})
+	require.NoError(t, err)
+
+	// a payload referencing a blob which does not exist
+	remoteP, err := fromEnvelope(encoded[0])
+	require.NoError(t, err)
+	remoteP.Key = "/blobs/test/common/unknown"
+	missing, err := c.toEnvelope(*remoteP)
+	require.NoError(t, err)
+	missing.Metadata[remoteCodecName] = []byte("v2")
+
+	start := time.Now()
+	_, err = c.Decode([]*common.Payload{encoded[0], encoded[1], missing})
+	require.ErrorIs(t, err, ErrBlobNotFound)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&canceled) == 2 }, time.Second, time.Millisecond)
+
+	_, err = New(WithURL(s.URL), WithNamespace("test"), WithMaxConcurrentDownloads(0))
+	require.Error(t, err)
+}
@@ -0,0 +1,86 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+// driverTransport is a Transport which stores blobs with a storage driver in the same
+// process, arranging them the same way as the v2 LPS server.
+type driverTransport struct {
+	driver storage.Driver
+}
+
+// NewDriverTransport returns a Transport which stores blobs with driver in the same process
+// instead of sending them to an LPS server, e.g. for tests and local tools. Blobs are stored
+// under the same keys as by the v2 LPS server, so payloads can be decoded with either.
+func NewDriverTransport(driver storage.Driver) Transport {
+	return &driverTransport{driver: driver}
+}
+
+// PutBlob stores a blob unless it exists already, verifying its digest as the v2 LPS server
+// does with the algorithms registered with v2.RegisterHash. Blobs which do not match their
+// digest are deleted, since their key encodes the digest.
+func (t *driverTransport) PutBlob(ctx context.Context, input PutInput) (string, error) {
+	digest, h, err := v2.ParseDigest(input.Digest)
+	if err != nil {
+		return "", err
+	}
+	key, err := v2.ComputeKey(input.Namespace, input.Digest, input.Metadata)
+	if err != nil {
+		return "", err
+	}
+
+	exists, err := t.driver.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+	if err != nil {
+		return "", err
+	}
+	if exists.Exists {
+		return key, nil
+	}
+
+	if _, err := t.driver.PutPayload(ctx, &storage.PutRequest{
+		Data:          io.TeeReader(input.Data, h),
+		Key:           key,
+		Digest:        input.Digest,
+		ContentLength: uint64(input.Size),
+		ContentType:   contentTypeFor(input.Metadata),
+		Metadata:      input.Metadata,
+	}); err != nil {
+		return "", err
+	}
+	if checkSum := hexSum(h); checkSum != digest {
+		err := fmt.Errorf("checksum mismatch, wanted %s, got %s%s", input.Digest, strings.TrimSuffix(input.Digest, digest), checkSum)
+		if _, deleteErr := t.driver.DeletePayload(ctx, &storage.DeleteRequest{Key: key}); deleteErr != nil {
+			return "", fmt.Errorf("%w, and the stored data could not be deleted: %v", err, deleteErr)
+		}
+		return "", err
+	}
+	return key, nil
+}
+
+func (t *driverTransport) GetBlob(ctx context.Context, input GetInput, w io.Writer) error {
+	_, err := t.driver.GetPayload(ctx, &storage.GetRequest{Key: input.Key, Writer: w})
+	var blobNotFound *storage.ErrBlobNotFound
+	if errors.As(err, &blobNotFound) {
+		return fmt.Errorf("%w: %v", ErrBlobNotFound, err)
+	}
+	return err
+}
+
+func (t *driverTransport) Health(ctx context.Context) error {
+	if v, ok := t.driver.(storage.Validatable); ok {
+		return v.Validate(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	lpsmetadata "github.com/DataDog/temporal-large-payload-codec/server/metadata"
+	"go.temporal.io/api/common/v1"
+)
+
+const (
+	// metricDryRunTotal counts the payloads which would have been offloaded in dry-run mode.
+	metricDryRunTotal = "lps_dry_run_total"
+	// metricDryRunSavedBytes counts the bytes which offloading would have saved in dry-run mode.
+	metricDryRunSavedBytes = "lps_dry_run_saved_bytes"
+)
+
+// DryRunStats summarizes the offload decisions taken in dry-run mode, see WithDryRun.
+type DryRunStats struct {
+	// Payloads is the number of payloads passed to Encode.
+	Payloads int64
+	// Bytes is the size of the data of all payloads passed to Encode.
+	Bytes int64
+	// OffloadedPayloads is the number of payloads which would have been offloaded.
+	OffloadedPayloads int64
+	// OffloadedBytes is the size of the data of the payloads which would have been offloaded.
+	OffloadedBytes int64
+	// SavedBytes is the number of bytes offloading would have saved in the workflow
+	// history, i.e. the size of the offloaded payloads minus the size of their envelopes.
+	SavedBytes int64
+}
+
+// DryRunStats returns a summary of the offload decisions taken since the codec was created
+// with WithDryRun. It returns zero stats if dry-run mode is not enabled.
+func (c *Codec) DryRunStats() DryRunStats {
+	return DryRunStats{
+		Payloads:          c.dryRunPayloads.Load(),
+		Bytes:             c.dryRunBytes.Load(),
+		OffloadedPayloads: c.dryRunOffloadedPayloads.Load(),
+		OffloadedBytes:    c.dryRunOffloadedBytes.Load(),
+		SavedBytes:        c.dryRunSavedBytes.Load(),
+	}
+}
+
+// dryRunEncode records the offload decision for payload without contacting
+// LargePayloadService. If offload is true, the key and envelope the payload would have
+// been encoded to are computed, logged and recorded.
+func (c *Codec) dryRunEncode(ctx context.Context, payload *common.Payload, offload bool) error {
+	size := len(payload.GetData())
+	c.dryRunPayloads.Add(1)
+	c.dryRunBytes.Add(int64(size))
+	if !offload {
+		return nil
+	}
+
+	namespace := c.namespaceFor(ctx, payload)
+	digest, err := c.digest(payload.GetData())
+	if err != nil {
+		return err
+	}
+	metadata, err := c.metadataWithKeyPrefix(payload)
+	if err != nil {
+		return err
+	}
+	metadata, withheld := c.filterMetadata(metadata)
+	key, err := v2.ComputeKey(namespace, digest, metadata)
+	if err != nil {
+		return err
+	}
+	encoded, err := c.encodedPayload(payload, remotePayload{
+		Metadata:       metadata,
+		Size:           uint(size),
+		Digest:         digest,
+		Key:            key,
+		MetadataDigest: lpsmetadata.Hash(metadata),
+	}, withheld)
+	if err != nil {
+		return err
+	}
+	saved := int64(payload.Size() - encoded.Size())
+
+	c.dryRunOffloadedPayloads.Add(1)
+	c.dryRunOffloadedBytes.Add(int64(size))
+	c.dryRunSavedBytes.Add(saved)
+	metrics := c.metrics(namespace, operationEncode)
+	metrics.Counter(metricDryRunTotal).Inc(1)
+	metrics.Counter(metricDryRunSavedBytes).Inc(saved)
+	c.logger.Info("dry run: would offload payload", "key", key, "size", size, "savedBytes", saved)
+	return nil
+}
@@ -0,0 +1,71 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Environment variables read by NewFromEnv.
+const (
+	// EnvURL is the environment variable holding the endpoint of LargePayloadService, see WithURL.
+	EnvURL = "LPS_URL"
+	// EnvNamespace is the environment variable holding the Temporal namespace, see WithNamespace.
+	EnvNamespace = "LPS_NAMESPACE"
+	// EnvMinBytes is the environment variable holding the minimum size of offloaded payloads,
+	// see WithMinBytes.
+	EnvMinBytes = "LPS_MIN_BYTES"
+	// EnvDisableHealthCheck is the environment variable which skips the health check during
+	// initialisation if set to a true value, see WithoutUrlHealthCheck.
+	EnvDisableHealthCheck = "LPS_DISABLE_HEALTH_CHECK"
+)
+
+// NewFromEnv instantiates a Codec like New, configured from the environment variables
+// LPS_URL, LPS_NAMESPACE, LPS_MIN_BYTES and LPS_DISABLE_HEALTH_CHECK. Unset or empty
+// variables are ignored. The given options take precedence over the environment.
+//
+// An error naming the variable is returned if a variable holds a malformed value.
+func NewFromEnv(opts ...Option) (*Codec, error) {
+	envOpts, err := optionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return New(append(envOpts, opts...)...)
+}
+
+// optionsFromEnv returns the options configured by the environment variables read by NewFromEnv.
+func optionsFromEnv() ([]Option, error) {
+	var opts []Option
+	if u := os.Getenv(EnvURL); u != "" {
+		opts = append(opts, applier(func(c *Codec) error {
+			if err := WithURL(u).apply(c); err != nil {
+				return fmt.Errorf("invalid %s %q: %w", EnvURL, u, err)
+			}
+			return nil
+		}))
+	}
+	if namespace := os.Getenv(EnvNamespace); namespace != "" {
+		opts = append(opts, WithNamespace(namespace))
+	}
+	if s := os.Getenv(EnvMinBytes); s != "" {
+		minBytes, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: must be a non-negative number of bytes", EnvMinBytes, s)
+		}
+		opts = append(opts, WithMinBytes(uint32(minBytes)))
+	}
+	if s := os.Getenv(EnvDisableHealthCheck); s != "" {
+		disable, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: must be a boolean", EnvDisableHealthCheck, s)
+		}
+		if disable {
+			opts = append(opts, WithoutUrlHealthCheck())
+		}
+	}
+	return opts, nil
+}
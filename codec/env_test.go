@@ -0,0 +1,95 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFromEnv(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	t.Setenv(EnvURL, s.URL)
+	t.Setenv(EnvNamespace, "env")
+	t.Setenv(EnvMinBytes, "1024")
+
+	c, err := NewFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, s.URL, c.url.String())
+	require.Equal(t, "env", c.namespace)
+	require.Equal(t, 1024, c.minBytes)
+	require.False(t, c.skipUrlHealthCheck)
+
+	// explicit options take precedence
+	c, err = NewFromEnv(WithNamespace("explicit"), WithMinBytes(64))
+	require.NoError(t, err)
+	require.Equal(t, s.URL, c.url.String())
+	require.Equal(t, "explicit", c.namespace)
+	require.Equal(t, 64, c.minBytes)
+}
+
+func TestNewFromEnv_health_check(t *testing.T) {
+	t.Setenv(EnvURL, "http://127.0.0.1:1")
+	t.Setenv(EnvNamespace, "env")
+
+	_, err := NewFromEnv()
+	require.Error(t, err)
+
+	t.Setenv(EnvDisableHealthCheck, "true")
+	c, err := NewFromEnv()
+	require.NoError(t, err)
+	require.True(t, c.skipUrlHealthCheck)
+}
+
+func TestNewFromEnv_malformed_values(t *testing.T) {
+	tests := []struct {
+		name     string
+		variable string
+		value    string
+		err      string
+	}{
+		{
+			name:     "non-numeric min bytes",
+			variable: EnvMinBytes,
+			value:    "128KB",
+			err:      `invalid LPS_MIN_BYTES "128KB": must be a non-negative number of bytes`,
+		},
+		{
+			name:     "negative min bytes",
+			variable: EnvMinBytes,
+			value:    "-1",
+			err:      `invalid LPS_MIN_BYTES "-1": must be a non-negative number of bytes`,
+		},
+		{
+			name:     "unknown health check value",
+			variable: EnvDisableHealthCheck,
+			value:    "maybe",
+			err:      `invalid LPS_DISABLE_HEALTH_CHECK "maybe": must be a boolean`,
+		},
+		{
+			name:     "malformed url",
+			variable: EnvURL,
+			value:    "http://[::1",
+			err:      `invalid LPS_URL "http://[::1": invalid remote codec URL`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvURL, "http://localhost")
+			t.Setenv(EnvNamespace, "env")
+			t.Setenv(EnvDisableHealthCheck, "true")
+			t.Setenv(tt.variable, tt.value)
+
+			_, err := NewFromEnv()
+			require.EqualError(t, err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.temporal.io/api/common/v1"
+	"go.temporal.io/sdk/converter"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// EnvelopeFormatJSON stores the remote payload envelope as JSON. This is the default.
+	EnvelopeFormatJSON = "json"
+	// EnvelopeFormatProto stores the remote payload envelope as binary protobuf.
+	EnvelopeFormatProto = "proto"
+
+	// envelopeMessageType is the message type of the binary protobuf envelope, which is
+	// encoded according to the following schema:
+	//
+	//	message RemotePayload {
+	//	  map<string, bytes> metadata = 1;
+	//	  uint64 size = 2;
+	//	  string digest = 3;
+	//	  string key = 4;
+	//	  string metadata_digest = 5;
+	//	}
+	envelopeMessageType = "temporal.largepayloadcodec.v2.RemotePayload"
+)
+
+const (
+	envelopeMetadataField       protowire.Number = 1
+	envelopeSizeField           protowire.Number = 2
+	envelopeDigestField         protowire.Number = 3
+	envelopeKeyField            protowire.Number = 4
+	envelopeMetadataDigestField protowire.Number = 5
+
+	mapEntryKeyField   protowire.Number = 1
+	mapEntryValueField protowire.Number = 2
+)
+
+// toEnvelope converts remoteP into the payload stored in workflow history, using the
+// configured envelope format.
+func (c *Codec) toEnvelope(remoteP remotePayload) (*common.Payload, error) {
+	if c.envelopeFormat != EnvelopeFormatProto {
+		return converter.GetDefaultDataConverter().ToPayload(remoteP)
+	}
+	return &common.Payload{
+		Metadata: map[string][]byte{
+			converter.MetadataEncoding:    []byte(converter.MetadataEncodingProto),
+			converter.MetadataMessageType: []byte(envelopeMessageType),
+		},
+		Data: marshalEnvelope(remoteP),
+	}, nil
+}
+
+// fromEnvelope extracts the remote payload from an encoded payload. The envelope format
+// is detected from the payload's encoding, independent of the configured format.
+func fromEnvelope(payload *common.Payload) (*remotePayload, error) {
+	var remoteP remotePayload
+	if string(payload.GetMetadata()[converter.MetadataEncoding]) == converter.MetadataEncodingProto {
+		if err := unmarshalEnvelope(payload.GetData(), &remoteP); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal remote payload: %w", err)
+		}
+		return &remoteP, nil
+	}
+	if err := converter.GetDefaultDataConverter().FromPayload(payload, &remoteP); err != nil {
+		return nil, err
+	}
+	return &remoteP, nil
+}
+
+func marshalEnvelope(remoteP remotePayload) []byte {
+	// sort the metadata to get a deterministic encoding
+	keys := make([]string, 0, len(remoteP.Metadata))
+	for k := range remoteP.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b []byte
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, mapEntryKeyField, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, mapEntryValueField, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, remoteP.Metadata[k])
+
+		b = protowire.AppendTag(b, envelopeMetadataField, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if remoteP.Size != 0 {
+		b = protowire.AppendTag(b, envelopeSizeField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(remoteP.Size))
+	}
+	if remoteP.Digest != "" {
+		b = protowire.AppendTag(b, envelopeDigestField, protowire.BytesType)
+		b = protowire.AppendString(b, remoteP.Digest)
+	}
+	if remoteP.Key != "" {
+		b = protowire.AppendTag(b, envelopeKeyField, protowire.BytesType)
+		b = protowire.AppendString(b, remoteP.Key)
+	}
+	if remoteP.MetadataDigest != "" {
+		b = protowire.AppendTag(b, envelopeMetadataDigestField, protowire.BytesType)
+		b = protowire.AppendString(b, remoteP.MetadataDigest)
+	}
+	return b
+}
+
+func unmarshalEnvelope(b []byte, remoteP *remotePayload) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == envelopeMetadataField && typ == protowire.BytesType:
+			entry, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			k, v, err := unmarshalMapEntry(entry)
+			if err != nil {
+				return err
+			}
+			if remoteP.Metadata == nil {
+				remoteP.Metadata = make(map[string][]byte)
+			}
+			remoteP.Metadata[k] = v
+		case num == envelopeSizeField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			remoteP.Size = uint(v)
+		case num == envelopeDigestField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			remoteP.Digest = v
+		case num == envelopeKeyField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			remoteP.Key = v
+		case num == envelopeMetadataDigestField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			remoteP.MetadataDigest = v
+		default:
+			// skip unknown fields for forward compatibility
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func unmarshalMapEntry(b []byte) (string, []byte, error) {
+	var (
+		key   string
+		value []byte
+	)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType || (num != mapEntryKeyField && num != mapEntryValueField) {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return "", nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == mapEntryKeyField {
+			key = string(v)
+		} else {
+			value = append([]byte{}, v...)
+		}
+	}
+	if key == "" && value == nil {
+		return "", nil, errors.New("empty metadata entry")
+	}
+	return key, value, nil
+}
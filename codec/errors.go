@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codes of the error responses of the LPS server which are mapped to errors of the codec.
+const (
+	errorCodeBlobNotFound    = "BLOB_NOT_FOUND"
+	errorCodePayloadTooLarge = "PAYLOAD_TOO_LARGE"
+)
+
+// errorResponse is the body of the error responses of the LPS server. Older servers, or
+// servers configured with plain text errors, send the message as the body instead.
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// parseErrorResponse returns the error response in body. Plain text bodies are returned as
+// the message of a response without a code.
+func parseErrorResponse(body []byte) errorResponse {
+	var resp errorResponse
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Code == "" {
+		return errorResponse{Message: string(body)}
+	}
+	return resp
+}
+
+// newStatusError returns the error for a response of the LPS server with the given status
+// code and body to the request with the given ID, which may be empty. Error responses whose
+// code is known to the codec wrap its matching error, e.g. ErrBlobNotFound.
+func newStatusError(statusCode int, requestID string, body []byte) error {
+	resp := parseErrorResponse(body)
+	message := resp.Message
+	if requestID != "" {
+		message = fmt.Sprintf("%s (request ID %s)", message, requestID)
+	}
+	if resp.Code == "" {
+		return fmt.Errorf("server returned status code %d: %s", statusCode, message)
+	}
+	err := fmt.Errorf("server returned status code %d (%s): %s", statusCode, resp.Code, message)
+	if resp.Code == errorCodeBlobNotFound {
+		return fmt.Errorf("%w: %v", ErrBlobNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_error_responses_are_mapped_to_errors(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		statusCode   int
+		requestID    string
+		body         string
+		want         string
+		blobNotFound bool
+	}{
+		{
+			name:         "blob not found",
+			statusCode:   http.StatusNotFound,
+			body:         `{"code":"BLOB_NOT_FOUND","message":"blob not found: key /blobs/test"}`,
+			want:         "blob not found: server returned status code 404 (BLOB_NOT_FOUND): blob not found: key /blobs/test",
+			blobNotFound: true,
+		},
+		{
+			name:         "with request ID",
+			statusCode:   http.StatusNotFound,
+			requestID:    "abc",
+			body:         `{"code":"BLOB_NOT_FOUND","message":"blob not found: key /blobs/test","requestId":"abc"}`,
+			want:         "blob not found: server returned status code 404 (BLOB_NOT_FOUND): blob not found: key /blobs/test (request ID abc)",
+			blobNotFound: true,
+		},
+		{
+			name:       "other code",
+			statusCode: http.StatusBadRequest,
+			body:       `{"code":"INVALID_DIGEST","message":"invalid hash type 'md5'"}`,
+			want:       "server returned status code 400 (INVALID_DIGEST): invalid hash type 'md5'",
+		},
+		{
+			name:       "plain text",
+			statusCode: http.StatusNotFound,
+			body:       "blob not found: key /blobs/test",
+			want:       "server returned status code 404: blob not found: key /blobs/test",
+		},
+		{
+			name:       "JSON without code",
+			statusCode: http.StatusInternalServerError,
+			body:       `{"error":"internal server error"}`,
+			want:       `server returned status code 500: {"error":"internal server error"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newStatusError(tc.statusCode, tc.requestID, []byte(tc.body))
+			require.EqualError(t, err, tc.want)
+			require.Equal(t, tc.blobNotFound, errors.Is(err, ErrBlobNotFound))
+		})
+	}
+}
+
+func Test_payload_too_large_errors_hold_the_limit_of_the_server(t *testing.T) {
+	for _, body := range []string{
+		`{"code":"PAYLOAD_TOO_LARGE","message":"payload of 150 bytes exceeds the global max size of 100 bytes"}`,
+		"payload of 150 bytes exceeds the global max size of 100 bytes",
+	} {
+		require.Equal(t, &PayloadTooLargeError{Size: 150, Limit: 100}, newPayloadTooLargeError(150, []byte(body)))
+	}
+	require.Equal(t, &PayloadTooLargeError{Size: 150}, newPayloadTooLargeError(150, []byte(`{"code":"PAYLOAD_TOO_LARGE","message":"request body exceeds the declared Content-Length of 150 bytes"}`)))
+}
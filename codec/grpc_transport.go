@@ -0,0 +1,132 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	lpsgrpc "github.com/DataDog/temporal-large-payload-codec/server/grpc"
+	"github.com/DataDog/temporal-large-payload-codec/server/grpc/lpspb"
+)
+
+// grpcTransport is a Transport which talks to the LPS server using its gRPC API.
+type grpcTransport struct {
+	client lpspb.LargePayloadServiceClient
+	health healthpb.HealthClient
+}
+
+// NewGRPCTransport returns a Transport which talks to the LPS server over the given gRPC
+// connection instead of HTTP, e.g. one created with grpc.Dial for the address set by the
+// --grpc-port flag of the server. Blobs are sent in chunks of bounded size, so that neither
+// side buffers them. The connection is not closed by the codec.
+func NewGRPCTransport(conn grpc.ClientConnInterface) Transport {
+	return &grpcTransport{
+		client: lpspb.NewLargePayloadServiceClient(conn),
+		health: healthpb.NewHealthClient(conn),
+	}
+}
+
+func (t *grpcTransport) PutBlob(ctx context.Context, input PutInput) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := t.client.PutBlob(ctx)
+	if err != nil {
+		return "", grpcError(err, input.Size)
+	}
+	if err := stream.Send(&lpspb.PutBlobRequest{Request: &lpspb.PutBlobRequest_Description{Description: &lpspb.BlobDescription{
+		Namespace:     input.Namespace,
+		Digest:        input.Digest,
+		Metadata:      input.Metadata,
+		ContentLength: uint64(input.Size),
+		ContentType:   contentTypeFor(input.Metadata),
+	}}}); err != nil && err != io.EOF {
+		return "", grpcError(err, input.Size)
+	}
+
+	buf := make([]byte, lpsgrpc.ChunkSize)
+	for {
+		n, err := io.ReadFull(input.Data, buf)
+		if n > 0 {
+			if err := stream.Send(&lpspb.PutBlobRequest{Request: &lpspb.PutBlobRequest_Chunk{Chunk: buf[:n]}}); err == io.EOF {
+				// the server ended the stream, its status is returned by CloseAndRecv
+				break
+			} else if err != nil {
+				return "", grpcError(err, input.Size)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		return "", grpcError(err, input.Size)
+	}
+	return response.Key, nil
+}
+
+func (t *grpcTransport) GetBlob(ctx context.Context, input GetInput, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := t.client.GetBlob(ctx, &lpspb.GetBlobRequest{Key: input.Key, ExpectedContentLength: uint64(input.Size)})
+	if err != nil {
+		return grpcError(err, input.Size)
+	}
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return grpcError(err, input.Size)
+		}
+		if _, err := w.Write(response.Chunk); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *grpcTransport) Health(ctx context.Context) error {
+	response, err := t.health.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if response.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("server is %s", response.Status)
+	}
+	return nil
+}
+
+// grpcError returns the error of the codec for a failed call of the gRPC API with a blob of
+// size bytes.
+func grpcError(err error, size int64) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.NotFound:
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, s.Message())
+	case codes.ResourceExhausted:
+		tooLarge := &PayloadTooLargeError{Size: size}
+		if m := maxSizePattern.FindStringSubmatch(s.Message()); m != nil {
+			tooLarge.Limit, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+		return tooLarge
+	}
+	return err
+}
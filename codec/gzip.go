@@ -0,0 +1,34 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipReadCloser decompresses a gzip compressed response body.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func newGzipReadCloser(body io.ReadCloser) (io.ReadCloser, error) {
+	r, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("unable to decompress response: %w", err)
+	}
+	return &gzipReadCloser{Reader: r, body: body}, nil
+}
+
+func (g *gzipReadCloser) Close() error {
+	if err := g.Reader.Close(); err != nil {
+		g.body.Close()
+		return err
+	}
+	return g.body.Close()
+}
@@ -0,0 +1,118 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// checkHealth sends a single HEAD request to the health endpoint of LargePayloadService.
+func (c *Codec) checkHealth(ctx context.Context) error {
+	headURL := c.url.JoinPath(c.version, "health", "head")
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, headURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := c.setRequestHeaders(req); err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status code %d from storage service at %s", resp.StatusCode, headURL)
+	}
+	return nil
+}
+
+// checkHealthWithRetry checks the health of LargePayloadService, retrying failed checks
+// with exponential backoff as configured with WithStartupHealthCheckRetry.
+func (c *Codec) checkHealthWithRetry(ctx context.Context) error {
+	interval := c.healthCheckInterval
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = c.transport.Health(ctx); err == nil {
+			return nil
+		}
+		if attempt >= c.healthCheckAttempts {
+			return err
+		}
+
+		c.logger.Debug("health check failed, retrying", "attempt", attempt, "interval", interval, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// ensureHealthy performs the deferred health check if WithLazyHealthCheck is configured.
+// Once a check succeeded, no further checks are performed.
+func (c *Codec) ensureHealthy(ctx context.Context) error {
+	if c.skipUrlHealthCheck || !c.lazyHealthCheck || c.healthy.Load() {
+		return nil
+	}
+
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+	if c.healthy.Load() {
+		return nil
+	}
+	if err := c.checkHealthWithRetry(ctx); err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	c.fetchServerLimits(ctx)
+	c.healthy.Store(true)
+	return nil
+}
+
+// Healthy returns whether the last background health check configured with
+// WithHealthMonitor succeeded, e.g. for readiness probes. Without a health monitor,
+// Healthy returns true unless the codec has been closed.
+func (c *Codec) Healthy() bool {
+	return !c.closed.Load() && !c.unhealthy.Load()
+}
+
+// monitorHealth checks the health of LargePayloadService every healthMonitorInterval
+// until the codec is closed.
+func (c *Codec) monitorHealth() {
+	defer c.background.Done()
+
+	ticker := time.NewTicker(c.healthMonitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.healthMonitorInterval)
+		go func() {
+			// abort a pending check when the codec is closed
+			select {
+			case <-c.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := c.transport.Health(ctx)
+		cancel()
+
+		if err != nil && !c.unhealthy.Swap(true) {
+			c.logger.Error("LPS became unhealthy", "error", err)
+		} else if err == nil && c.unhealthy.Swap(false) {
+			c.logger.Info("LPS became healthy again")
+		}
+	}
+}
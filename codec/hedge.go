@@ -0,0 +1,104 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// cancelOnClose cancels the context of a request once its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// doHedged sends the idempotent request req to LargePayloadService. If no response arrived
+// within the delay configured with WithHedgedReads, up to the configured number of identical
+// requests are sent in addition. The first response is returned and all other requests are
+// canceled.
+func (c *Codec) doHedged(req *http.Request) (*http.Response, error) {
+	if c.hedgeDelay <= 0 {
+		return c.do(req)
+	}
+
+	results := make(chan hedgeResult, c.hedgeMaxExtra+1)
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := c.do(req.Clone(ctx))
+			results <- hedgeResult{attempt: attempt, resp: resp, err: err}
+		}()
+	}
+
+	send()
+	inFlight := 1
+	timer := time.NewTimer(c.hedgeDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if len(cancels) <= c.hedgeMaxExtra {
+				send()
+				inFlight++
+				c.stats.hedged.Add(1)
+				c.metricsHandler.Counter(metricHedgedRequestsTotal).Inc(1)
+				c.logger.Debug("hedging request", "url", req.URL.Redacted(), "requests", len(cancels))
+				timer.Reset(c.hedgeDelay)
+			}
+		case r := <-results:
+			inFlight--
+			if r.err != nil && inFlight > 0 {
+				// wait for the remaining requests
+				cancels[r.attempt]()
+				continue
+			}
+
+			// cancel all other requests and release their responses
+			for i, cancel := range cancels {
+				if i != r.attempt {
+					cancel()
+				}
+			}
+			go func(remaining int) {
+				for i := 0; i < remaining; i++ {
+					if loser := <-results; loser.err == nil {
+						loser.resp.Body.Close()
+					}
+				}
+			}(inFlight)
+
+			if r.err != nil {
+				cancels[r.attempt]()
+				return nil, r.err
+			}
+			r.resp.Body = &cancelOnClose{ReadCloser: r.resp.Body, cancel: cancels[r.attempt]}
+			return r.resp, nil
+		}
+	}
+}
+
+// HedgedRequests returns the number of additional requests sent because of
+// WithHedgedReads, e.g. for reporting it as a metric.
+func (c *Codec) HedgedRequests() int64 {
+	return c.stats.hedged.Load()
+}
@@ -0,0 +1,89 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_hedged_reads_use_the_fastest_response(t *testing.T) {
+	handler := server.NewHttpHandler(&memory.Driver{})
+	var gets, puts int32
+	canceled := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/blobs/get"):
+			if atomic.AddInt32(&gets, 1) == 1 {
+				// the first download hangs until it is canceled
+				<-r.Context().Done()
+				close(canceled)
+				return
+			}
+		case strings.HasSuffix(r.URL.Path, "/blobs/put"):
+			atomic.AddInt32(&puts, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	metrics := newCapturingMetricsHandler()
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithExistenceCheck(false),
+		WithCircuitBreaker(1, time.Hour),
+		WithHedgedReads(10*time.Millisecond, 2),
+		WithTemporalMetricsHandler(metrics),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&puts))
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, []*common.Payload{&payload}, decoded)
+	require.Equal(t, int64(1), c.HedgedRequests())
+	require.Equal(t, int64(1), c.Stats().HedgedRequests)
+	metrics.mu.Lock()
+	require.Equal(t, int64(1), metrics.counters["lps_hedged_requests_total{}"])
+	metrics.mu.Unlock()
+	require.Equal(t, int32(2), atomic.LoadInt32(&gets))
+
+	// the slow request is canceled and does not open the circuit
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request was not canceled")
+	}
+	require.Equal(t, CircuitClosed, c.CircuitBreakerState())
+}
+
+func Test_hedged_reads_options_are_validated(t *testing.T) {
+	for _, opt := range []Option{
+		WithHedgedReads(0, 1),
+		WithHedgedReads(time.Millisecond, 0),
+	} {
+		_, err := New(WithURL("http://localhost"), WithNamespace("test"), WithoutUrlHealthCheck(), opt)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,76 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.temporal.io/api/common/v1"
+)
+
+var (
+	// ErrNotRemotePayload is returned by Inspect for payloads which were not encoded by the codec.
+	ErrNotRemotePayload = errors.New("not a remote payload")
+)
+
+// RemotePayloadInfo describes the blob an encoded payload refers to.
+type RemotePayloadInfo struct {
+	// Version is the version of the codec which encoded the payload (v1 or v2).
+	Version string
+	// Key is the key of the blob. It is empty for payloads encoded by the v1 codec.
+	Key string
+	// Namespace is the namespace the payload was originally encoded in, as recorded in the
+	// key. It is empty for payloads encoded by the v1 codec.
+	Namespace string
+	// Digest is the checksum of the payload data, e.g. sha256:deadbeef.
+	Digest string
+	// Size is the number of bytes of the payload data.
+	Size uint
+	// MetadataDigest is the checksum of the metadata stored with the blob. It is empty for
+	// payloads encoded by older codecs.
+	MetadataDigest string
+	// Metadata is the metadata of the original payload, including metadata which was
+	// withheld from LargePayloadService.
+	Metadata map[string][]byte
+}
+
+// Inspect returns the description of the blob payload refers to, without retrieving the
+// blob. Both the JSON and the protobuf envelope format are supported. If payload was not
+// encoded by the codec, an error wrapping ErrNotRemotePayload is returned.
+//
+// This is meant for tooling, e.g. for finding the blob referenced by a payload copied from
+// a workflow history.
+func Inspect(payload *common.Payload) (*RemotePayloadInfo, error) {
+	version, ok := payload.GetMetadata()[remoteCodecName]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s metadata", ErrNotRemotePayload, remoteCodecName)
+	}
+	remoteP, err := fromEnvelope(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotRemotePayload, err)
+	}
+
+	metadata := make(map[string][]byte, len(remoteP.Metadata))
+	for k, v := range remoteP.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range payload.GetMetadata() {
+		if name := strings.TrimPrefix(k, withheldMetadataPrefix); name != k {
+			metadata[name] = v
+		}
+	}
+
+	return &RemotePayloadInfo{
+		Version:        string(version),
+		Key:            remoteP.Key,
+		Namespace:      namespaceFromKey(remoteP.Key),
+		Digest:         remoteP.Digest,
+		Size:           remoteP.Size,
+		MetadataDigest: remoteP.MetadataDigest,
+		Metadata:       metadata,
+	}, nil
+}
@@ -0,0 +1,105 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	jsonMetadata := map[string][]byte{
+		"encoding":                 []byte("json/plain"),
+		"temporal.io/remote-codec": []byte("v2"),
+	}
+	protoMetadata := map[string][]byte{
+		"encoding":                 []byte("binary/protobuf"),
+		"messageType":              []byte("temporal.largepayloadcodec.v2.RemotePayload"),
+		"temporal.io/remote-codec": []byte("v2"),
+	}
+	noPrefix := &RemotePayloadInfo{
+		Version:        "v2",
+		Namespace:      "test",
+		Key:            "/blobs/test/common/sha256:62c5b63b2e7bccbddd931c896593b25fbab2ea1c12b0e1fb34ca083536c2c066/sha256:49c18013bca3da7d14edff8e1c2703d60ff89df6a11e0c02b673d0c935c90bfb",
+		Digest:         "sha256:62c5b63b2e7bccbddd931c896593b25fbab2ea1c12b0e1fb34ca083536c2c066",
+		Size:           52,
+		MetadataDigest: "sha256:49c18013bca3da7d14edff8e1c2703d60ff89df6a11e0c02b673d0c935c90bfb",
+		Metadata:       map[string][]byte{"foo": []byte("bar"), "baz": []byte("qux")},
+	}
+	withPrefix := &RemotePayloadInfo{
+		Version:        "v2",
+		Namespace:      "test",
+		Key:            "/blobs/test/custom/1234/sha256:041ae008aa23e071b5f04ae1b75847c7b135269239833501f0929b212c95935c/sha256:b70fd38ed8eb9135fb4f1e6d296cf4a61ae8fd310fd07c4bd788d20fe0a86e95",
+		Digest:         "sha256:041ae008aa23e071b5f04ae1b75847c7b135269239833501f0929b212c95935c",
+		Size:           59,
+		MetadataDigest: "sha256:b70fd38ed8eb9135fb4f1e6d296cf4a61ae8fd310fd07c4bd788d20fe0a86e95",
+		Metadata: map[string][]byte{
+			"foo":                     []byte("bar"),
+			"baz":                     []byte("qux"),
+			"remote-codec/key-prefix": []byte("1234"),
+		},
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		metadata map[string][]byte
+		want     *RemotePayloadInfo
+		wantErr  error
+	}{
+		{name: "json no prefix", file: "TestV2Codec/large_payload_no_prefix", metadata: jsonMetadata, want: noPrefix},
+		{name: "json with prefix", file: "TestV2Codec/large_payload_with_prefix", metadata: jsonMetadata, want: withPrefix},
+		{name: "proto no prefix", file: "TestV2CodecProtoEnvelope/large_payload_no_prefix", metadata: protoMetadata, want: noPrefix},
+		{name: "proto with prefix", file: "TestV2CodecProtoEnvelope/large_payload_with_prefix", metadata: protoMetadata, want: withPrefix},
+		{
+			name:     "not encoded",
+			file:     "TestV2Codec/no_large_payload_encoding_needed",
+			metadata: map[string][]byte{"encoding": []byte("json/plain")},
+			wantErr:  ErrNotRemotePayload,
+		},
+		{
+			name:     "invalid envelope",
+			file:     "TestV2Codec/no_large_payload_encoding_needed",
+			metadata: jsonMetadata,
+			wantErr:  ErrNotRemotePayload,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			require.NoError(t, err)
+
+			info, err := Inspect(&common.Payload{Metadata: tt.metadata, Data: data})
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, info)
+		})
+	}
+}
+
+func Test_inspect_restores_withheld_metadata(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "TestV2Codec/large_payload_no_prefix"))
+	require.NoError(t, err)
+
+	info, err := Inspect(&common.Payload{
+		Metadata: map[string][]byte{
+			"encoding":                        []byte("json/plain"),
+			"temporal.io/remote-codec":        []byte("v2"),
+			withheldMetadataPrefix + "secret": []byte("value"),
+		},
+		Data: data,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), info.Metadata["secret"])
+	require.Equal(t, []byte("bar"), info.Metadata["foo"])
+}
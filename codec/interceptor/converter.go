@@ -0,0 +1,126 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package interceptor
+
+import (
+	"context"
+
+	"go.temporal.io/api/common/v1"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/workflow"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+)
+
+// DataConverter converts values using a parent data converter and encodes the resulting
+// payloads with the given codecs, like converter.NewCodecDataConverter. Within workflows
+// and activities, it sets the key prefix of the current workflow run on all payloads
+// before encoding them.
+type DataConverter struct {
+	converter.DataConverter
+
+	parent converter.DataConverter
+	codecs []converter.PayloadCodec
+}
+
+var _ workflow.ContextAware = &DataConverter{}
+
+// NewDataConverter returns a data converter which sets the key prefix of the current
+// workflow run on payloads converted by parent, before encoding them with codecs.
+func NewDataConverter(parent converter.DataConverter, codecs ...converter.PayloadCodec) *DataConverter {
+	return &DataConverter{
+		DataConverter: converter.NewCodecDataConverter(parent, codecs...),
+		parent:        parent,
+		codecs:        codecs,
+	}
+}
+
+// WithWorkflowContext returns a data converter using the key prefix of the workflow run ctx
+// belongs to.
+func (d *DataConverter) WithWorkflowContext(ctx workflow.Context) converter.DataConverter {
+	prefix, _ := ctx.Value(keyPrefixContextKey{}).(string)
+	if prefix == "" {
+		// payloads such as the workflow result are converted with the context the
+		// workflow interceptors were called with
+		prefix = workflowKeyPrefix(ctx)
+	}
+	return d.withKeyPrefix(prefix)
+}
+
+// WithContext returns a data converter using the key prefix of the workflow run which
+// scheduled the activity ctx belongs to. Outside of activities, d is returned as is.
+func (d *DataConverter) WithContext(ctx context.Context) converter.DataConverter {
+	prefix, _ := ctx.Value(keyPrefixContextKey{}).(string)
+	if prefix == "" {
+		// payloads such as the activity result are converted with the context the
+		// activity interceptors were called with
+		prefix, _ = activityKeyPrefix(ctx)
+	}
+	return d.withKeyPrefix(prefix)
+}
+
+func (d *DataConverter) withKeyPrefix(prefix string) converter.DataConverter {
+	if prefix == "" {
+		return d
+	}
+	return converter.NewCodecDataConverter(&keyPrefixConverter{
+		DataConverter: d.parent,
+		prefix:        prefix,
+	}, d.codecs...)
+}
+
+func workflowKeyPrefix(ctx workflow.Context) string {
+	info := workflow.GetInfo(ctx)
+	return KeyPrefix(info.WorkflowExecution.ID, info.WorkflowExecution.RunID)
+}
+
+// activityKeyPrefix returns the key prefix of the workflow run which scheduled the activity
+// ctx belongs to. It returns false if ctx is not an activity context.
+func activityKeyPrefix(ctx context.Context) (prefix string, ok bool) {
+	// the SDK panics if ctx is not an activity context
+	defer func() {
+		if recover() != nil {
+			prefix, ok = "", false
+		}
+	}()
+	info := activity.GetInfo(ctx)
+	return KeyPrefix(info.WorkflowExecution.ID, info.WorkflowExecution.RunID), true
+}
+
+// keyPrefixConverter sets the key prefix metadata on all payloads converted by the embedded
+// data converter.
+type keyPrefixConverter struct {
+	converter.DataConverter
+
+	prefix string
+}
+
+func (k *keyPrefixConverter) ToPayload(value interface{}) (*common.Payload, error) {
+	payload, err := k.DataConverter.ToPayload(value)
+	if payload == nil || err != nil {
+		return payload, err
+	}
+	k.setKeyPrefix(payload)
+	return payload, nil
+}
+
+func (k *keyPrefixConverter) ToPayloads(values ...interface{}) (*common.Payloads, error) {
+	payloads, err := k.DataConverter.ToPayloads(values...)
+	if payloads == nil || err != nil {
+		return payloads, err
+	}
+	for _, payload := range payloads.GetPayloads() {
+		k.setKeyPrefix(payload)
+	}
+	return payloads, nil
+}
+
+func (k *keyPrefixConverter) setKeyPrefix(payload *common.Payload) {
+	if payload.Metadata == nil {
+		payload.Metadata = make(map[string][]byte)
+	}
+	payload.Metadata[v2.KeyPrefixMetadataKey] = []byte(k.prefix)
+}
@@ -0,0 +1,116 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package interceptor stores large payloads under the ID of the workflow they originate from.
+//
+// The worker interceptor returned by NewWorkerInterceptor stashes the workflow ID and run ID
+// in the workflow and activity contexts. The data converter returned by NewDataConverter
+// picks them up and sets them as remote-codec/key-prefix metadata on every payload before
+// it is passed to the large payload codec, so that all blobs of a workflow run are stored
+// under a common prefix and can be deleted together.
+//
+//	lpc, _ := codec.New(codec.WithURL(lpsEndpoint), codec.WithNamespace(namespace))
+//	c, _ := client.Dial(client.Options{
+//		DataConverter: interceptor.NewDataConverter(converter.GetDefaultDataConverter(), lpc),
+//	})
+//	w := worker.New(c, taskQueue, worker.Options{
+//		Interceptors: []sdkinterceptor.WorkerInterceptor{interceptor.NewWorkerInterceptor()},
+//	})
+package interceptor
+
+import (
+	"context"
+	"regexp"
+
+	sdkinterceptor "go.temporal.io/sdk/interceptor"
+	"go.temporal.io/sdk/workflow"
+)
+
+// invalidPrefixChars matches the characters not accepted in key prefixes by the v2 LPS handler.
+// The slash is replaced as well, since it separates the workflow ID from the run ID.
+var invalidPrefixChars = regexp.MustCompile(`[^0-9a-zA-Z_\-]`)
+
+type keyPrefixContextKey struct{}
+
+// KeyPrefix returns the key prefix for blobs of the given workflow run. Characters not
+// accepted by LargePayloadService are replaced with underscores.
+func KeyPrefix(workflowID string, runID string) string {
+	return sanitize(workflowID) + "/" + sanitize(runID)
+}
+
+func sanitize(id string) string {
+	if id == "" {
+		return "_"
+	}
+	return invalidPrefixChars.ReplaceAllString(id, "_")
+}
+
+// NewWorkerInterceptor returns a worker interceptor which stashes the key prefix of the
+// current workflow run in workflow and activity contexts, to be used by the data converter
+// returned by NewDataConverter.
+func NewWorkerInterceptor() sdkinterceptor.WorkerInterceptor {
+	return &workerInterceptor{}
+}
+
+type workerInterceptor struct {
+	sdkinterceptor.WorkerInterceptorBase
+}
+
+func (w *workerInterceptor) InterceptActivity(
+	ctx context.Context,
+	next sdkinterceptor.ActivityInboundInterceptor,
+) sdkinterceptor.ActivityInboundInterceptor {
+	i := &activityInboundInterceptor{}
+	i.Next = next
+	return i
+}
+
+func (w *workerInterceptor) InterceptWorkflow(
+	ctx workflow.Context,
+	next sdkinterceptor.WorkflowInboundInterceptor,
+) sdkinterceptor.WorkflowInboundInterceptor {
+	i := &workflowInboundInterceptor{}
+	i.Next = next
+	return i
+}
+
+type activityInboundInterceptor struct {
+	sdkinterceptor.ActivityInboundInterceptorBase
+}
+
+func (a *activityInboundInterceptor) ExecuteActivity(
+	ctx context.Context,
+	in *sdkinterceptor.ExecuteActivityInput,
+) (interface{}, error) {
+	if prefix, ok := activityKeyPrefix(ctx); ok {
+		ctx = context.WithValue(ctx, keyPrefixContextKey{}, prefix)
+	}
+	return a.Next.ExecuteActivity(ctx, in)
+}
+
+type workflowInboundInterceptor struct {
+	sdkinterceptor.WorkflowInboundInterceptorBase
+}
+
+func (w *workflowInboundInterceptor) ExecuteWorkflow(
+	ctx workflow.Context,
+	in *sdkinterceptor.ExecuteWorkflowInput,
+) (interface{}, error) {
+	return w.Next.ExecuteWorkflow(withWorkflowKeyPrefix(ctx), in)
+}
+
+func (w *workflowInboundInterceptor) HandleSignal(ctx workflow.Context, in *sdkinterceptor.HandleSignalInput) error {
+	return w.Next.HandleSignal(withWorkflowKeyPrefix(ctx), in)
+}
+
+func (w *workflowInboundInterceptor) HandleQuery(
+	ctx workflow.Context,
+	in *sdkinterceptor.HandleQueryInput,
+) (interface{}, error) {
+	return w.Next.HandleQuery(withWorkflowKeyPrefix(ctx), in)
+}
+
+func withWorkflowKeyPrefix(ctx workflow.Context) workflow.Context {
+	return workflow.WithValue(ctx, keyPrefixContextKey{}, workflowKeyPrefix(ctx))
+}
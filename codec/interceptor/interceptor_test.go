@@ -0,0 +1,63 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package interceptor
+
+import (
+	"context"
+	"testing"
+
+	"go.temporal.io/sdk/converter"
+
+	"github.com/stretchr/testify/require"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		workflowID string
+		runID      string
+		expected   string
+	}{
+		{"valid IDs", "my-workflow_1", "2c9b8b7e-1a2b-4c3d-9e8f-0a1b2c3d4e5f", "my-workflow_1/2c9b8b7e-1a2b-4c3d-9e8f-0a1b2c3d4e5f"},
+		{"invalid characters", "orders/42:retry #1", "run.1", "orders_42_retry__1/run_1"},
+		{"empty IDs", "", "", "_/_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, KeyPrefix(tt.workflowID, tt.runID))
+			// the sanitized prefix is accepted by LargePayloadService
+			require.NoError(t, v2.ValidateKeyPrefix(KeyPrefix(tt.workflowID, tt.runID)))
+		})
+	}
+}
+
+func TestDataConverter(t *testing.T) {
+	dc := NewDataConverter(converter.GetDefaultDataConverter())
+
+	// outside of workflows and activities, no key prefix is set
+	require.Same(t, dc, dc.WithContext(context.Background()))
+	payload, err := dc.ToPayload("foo")
+	require.NoError(t, err)
+	require.NotContains(t, payload.GetMetadata(), v2.KeyPrefixMetadataKey)
+
+	// a key prefix stashed in the context is set on all payloads
+	ctx := context.WithValue(context.Background(), keyPrefixContextKey{}, "wf/run")
+	payload, err = dc.WithContext(ctx).ToPayload("foo")
+	require.NoError(t, err)
+	require.Equal(t, []byte("wf/run"), payload.GetMetadata()[v2.KeyPrefixMetadataKey])
+
+	payloads, err := dc.WithContext(ctx).ToPayloads("foo", 42)
+	require.NoError(t, err)
+	require.Len(t, payloads.GetPayloads(), 2)
+	for _, payload := range payloads.GetPayloads() {
+		require.Equal(t, []byte("wf/run"), payload.GetMetadata()[v2.KeyPrefixMetadataKey])
+	}
+
+	var decoded string
+	require.NoError(t, dc.FromPayload(payload, &decoded))
+	require.Equal(t, "foo", decoded)
+}
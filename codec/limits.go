@@ -0,0 +1,93 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ServerLimits are the limits advertised by the LPS server, see Codec.ServerLimits.
+type ServerLimits struct {
+	// MaxBlobBytes is the maximum size of a blob uploaded in a single request, or zero if
+	// the limit is unknown.
+	MaxBlobBytes int64 `json:"maxBlobBytes"`
+}
+
+// ServerLimits returns the limits advertised by the LPS server, e.g. for logging them at
+// startup. The limits are fetched along with the health check of the server. They are
+// unknown if the health check is skipped, or if the server does not advertise its limits.
+//
+// Payloads exceeding MaxBlobBytes are not uploaded in a single request. They are uploaded in
+// chunks if the server supports it, and rejected with ErrPayloadTooLarge otherwise.
+func (c *Codec) ServerLimits() ServerLimits {
+	return ServerLimits{MaxBlobBytes: c.maxBlobBytes.Load()}
+}
+
+// fetchServerLimits fetches the limits of the LPS server. Servers which predate the limits
+// endpoint, as well as failures, leave the limits unknown.
+func (c *Codec) fetchServerLimits(ctx context.Context) {
+	if _, ok := c.transport.(*httpTransport); !ok {
+		return
+	}
+	limits, err := c.getServerLimits(ctx)
+	if err != nil {
+		c.logger.Info("unable to fetch server limits", "error", err)
+		return
+	}
+	if limits == nil {
+		c.logger.Debug("server does not advertise its limits")
+		return
+	}
+	c.logger.Debug("fetched server limits", "maxBlobBytes", limits.MaxBlobBytes)
+	c.maxBlobBytes.Store(limits.MaxBlobBytes)
+}
+
+// getServerLimits returns the limits of the LPS server, or nil if it does not advertise them.
+// Unless the namespace varies by payload, the limits of the namespace of the codec are
+// requested, which may differ from the global limits of the server.
+func (c *Codec) getServerLimits(ctx context.Context) (*ServerLimits, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url.JoinPath(c.version, "limits").String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.namespaceProvider == nil && c.namespace != "" {
+		q := req.URL.Query()
+		q.Set("namespace", c.namespace)
+		req.URL.RawQuery = q.Encode()
+	}
+	if err := c.setRequestHeaders(req); err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, nil
+	default:
+		return nil, newStatusError(resp.StatusCode, responseRequestID(resp), respBody)
+	}
+
+	var limits ServerLimits
+	if err := json.Unmarshal(respBody, &limits); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal limits: %w", err)
+	}
+	if limits.MaxBlobBytes < 0 {
+		return nil, fmt.Errorf("invalid max blob size %d", limits.MaxBlobBytes)
+	}
+	return &limits, nil
+}
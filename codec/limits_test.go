@@ -0,0 +1,146 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// limitsServer is a fake LPS server advertising maxBlobBytes, or no limits if it is zero,
+// which counts the single uploads it receives.
+type limitsServer struct {
+	handler      http.Handler
+	maxBlobBytes int
+	puts         atomic.Int32
+}
+
+func (s *limitsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v2/limits":
+		if s.maxBlobBytes == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"maxBlobBytes":%d}`, s.maxBlobBytes)
+	case "/v2/blobs/put":
+		s.puts.Add(1)
+		s.handler.ServeHTTP(w, r)
+	default:
+		s.handler.ServeHTTP(w, r)
+	}
+}
+
+func Test_server_limits_are_discovered(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"))
+	require.NoError(t, err)
+	require.Equal(t, ServerLimits{MaxBlobBytes: 1 << 30}, c.ServerLimits())
+
+	// the limits are fetched along with the health check
+	c, err = New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithoutUrlHealthCheck())
+	require.NoError(t, err)
+	require.Equal(t, ServerLimits{}, c.ServerLimits())
+
+	c, err = New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithLazyHealthCheck())
+	require.NoError(t, err)
+	require.Equal(t, ServerLimits{}, c.ServerLimits())
+	_, err = c.Encode([]*common.Payload{{Data: []byte("small")}})
+	require.NoError(t, err)
+	require.Equal(t, ServerLimits{MaxBlobBytes: 1 << 30}, c.ServerLimits())
+}
+
+func Test_server_limits_of_the_namespace_are_discovered(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandlerWithOptions(&memory.Driver{},
+		server.WithNamespaceMaxBlobBytes(map[string]uint64{"test": 1 << 20}),
+	))
+	defer s.Close()
+
+	c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"))
+	require.NoError(t, err)
+	require.Equal(t, ServerLimits{MaxBlobBytes: 1 << 20}, c.ServerLimits())
+
+	c, err = New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("other"))
+	require.NoError(t, err)
+	require.Equal(t, ServerLimits{MaxBlobBytes: 1 << 30}, c.ServerLimits())
+}
+
+func Test_payloads_exceeding_server_limits_are_rejected_before_uploading(t *testing.T) {
+	// the storage driver does not support upload sessions
+	driver := struct{ storage.Driver }{&memory.Driver{}}
+	fake := &limitsServer{handler: server.NewHttpHandler(driver), maxBlobBytes: 100}
+	s := httptest.NewServer(fake)
+	defer s.Close()
+
+	c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithMinBytes(32))
+	require.NoError(t, err)
+	require.Equal(t, ServerLimits{MaxBlobBytes: 100}, c.ServerLimits())
+
+	_, err = c.Encode([]*common.Payload{{Data: bytes.Repeat([]byte("a"), 150)}})
+	require.ErrorIs(t, err, ErrPayloadTooLarge)
+	var tooLarge *PayloadTooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, &PayloadTooLargeError{Size: 150, Limit: 100}, tooLarge)
+	require.Equal(t, int32(0), fake.puts.Load())
+
+	// payloads within the limit are uploaded
+	_, err = c.Encode([]*common.Payload{{Data: bytes.Repeat([]byte("a"), 100)}})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), fake.puts.Load())
+}
+
+func Test_payloads_exceeding_server_limits_are_uploaded_in_chunks(t *testing.T) {
+	driver := &memory.Driver{}
+	fake := &limitsServer{
+		handler: &chunkedServer{
+			handler:  server.NewHttpHandler(driver),
+			driver:   driver,
+			limit:    100,
+			chunked:  true,
+			sessions: map[string]*uploadSession{},
+		},
+		maxBlobBytes: 100,
+	}
+	s := httptest.NewServer(fake)
+	defer s.Close()
+
+	c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithMinBytes(32), WithChunkSize(64))
+	require.NoError(t, err)
+
+	payloads := []*common.Payload{{Data: bytes.Repeat([]byte("a"), 150)}}
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+	require.Equal(t, int32(0), fake.puts.Load())
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+}
+
+func Test_server_limits_are_unknown_for_older_servers(t *testing.T) {
+	fake := &limitsServer{handler: server.NewHttpHandler(&memory.Driver{})}
+	s := httptest.NewServer(fake)
+	defer s.Close()
+
+	c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithMinBytes(32))
+	require.NoError(t, err)
+	require.Equal(t, ServerLimits{}, c.ServerLimits())
+
+	_, err = c.Encode([]*common.Payload{{Data: bytes.Repeat([]byte("a"), 150)}})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), fake.puts.Load())
+}
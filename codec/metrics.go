@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"go.temporal.io/sdk/client"
+)
+
+const (
+	// metricEncodeTotal counts the payloads offloaded to LargePayloadService.
+	metricEncodeTotal = "lps_encode_total"
+	// metricDecodeTotal counts the payloads retrieved from LargePayloadService.
+	metricDecodeTotal = "lps_decode_total"
+	// metricErrorsTotal counts the payloads which failed to be encoded or decoded.
+	metricErrorsTotal = "lps_errors_total"
+	// metricPutLatency is the duration of blob uploads.
+	metricPutLatency = "lps_put_latency"
+	// metricGetLatency is the duration of blob downloads.
+	metricGetLatency = "lps_get_latency"
+	// metricPayloadBytes counts the bytes of the payloads successfully encoded or decoded.
+	// The SDK's metrics handler offers no histograms, so a counter is used.
+	metricPayloadBytes = "lps_payload_bytes"
+	// metricHedgedRequestsTotal counts the additional GETs sent because of hedging.
+	metricHedgedRequestsTotal = "lps_hedged_requests_total"
+
+	metricTagNamespace = "namespace"
+	metricTagOperation = "operation"
+
+	operationEncode = "encode"
+	operationDecode = "decode"
+)
+
+// metrics returns the metrics handler for operation on payloads of namespace.
+func (c *Codec) metrics(namespace string, operation string) client.MetricsHandler {
+	return c.metricsHandler.WithTags(map[string]string{
+		metricTagNamespace: namespace,
+		metricTagOperation: operation,
+	})
+}
+
+// recordPayload records an encoded or decoded payload of size bytes, counting it as
+// an error if err is not nil.
+func recordPayload(metrics client.MetricsHandler, counter string, size int, err error) {
+	metrics.Counter(counter).Inc(1)
+	if err != nil {
+		metrics.Counter(metricErrorsTotal).Inc(1)
+		return
+	}
+	metrics.Counter(metricPayloadBytes).Inc(int64(size))
+}
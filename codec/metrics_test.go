@@ -0,0 +1,141 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.temporal.io/api/common/v1"
+	"go.temporal.io/sdk/client"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// capturingMetricsHandler records the values of counters and the number of recorded timers,
+// by metric name and tags. The SDK's capturing handler is internal, so it cannot be used here.
+type capturingMetricsHandler struct {
+	mu       *sync.Mutex
+	tags     map[string]string
+	counters map[string]int64
+	timers   map[string]int
+}
+
+type counterFunc func(int64)
+
+func (f counterFunc) Inc(d int64) { f(d) }
+
+type timerFunc func(time.Duration)
+
+func (f timerFunc) Record(d time.Duration) { f(d) }
+
+func newCapturingMetricsHandler() *capturingMetricsHandler {
+	return &capturingMetricsHandler{
+		mu:       &sync.Mutex{},
+		counters: map[string]int64{},
+		timers:   map[string]int{},
+	}
+}
+
+func (h *capturingMetricsHandler) WithTags(tags map[string]string) client.MetricsHandler {
+	merged := map[string]string{}
+	for k, v := range h.tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return &capturingMetricsHandler{mu: h.mu, tags: merged, counters: h.counters, timers: h.timers}
+}
+
+// name returns the name of a metric including the handler's tags, e.g. name{k1=v1,k2=v2}.
+func (h *capturingMetricsHandler) name(name string) string {
+	var tags []string
+	for k, v := range h.tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return name + "{" + strings.Join(tags, ",") + "}"
+}
+
+func (h *capturingMetricsHandler) Counter(name string) client.MetricsCounter {
+	name = h.name(name)
+	return counterFunc(func(d int64) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.counters[name] += d
+	})
+}
+
+func (h *capturingMetricsHandler) Gauge(string) client.MetricsGauge {
+	return client.MetricsNopHandler.Gauge("")
+}
+
+func (h *capturingMetricsHandler) Timer(name string) client.MetricsTimer {
+	name = h.name(name)
+	return timerFunc(func(time.Duration) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.timers[name]++
+	})
+}
+
+func Test_metrics_are_recorded_with_temporal_metrics_handler(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	metrics := newCapturingMetricsHandler()
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithTemporalMetricsHandler(metrics),
+	)
+	require.NoError(t, err)
+
+	payloads := []*common.Payload{
+		{Data: []byte("this is a longer message blah blah blah blah blah blah")},
+		{Data: []byte("small")},
+	}
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+	_, err = c.Decode(encoded)
+	require.NoError(t, err)
+
+	// a blob which does not exist
+	remoteP, err := fromEnvelope(encoded[0])
+	require.NoError(t, err)
+	remoteP.Key = "/blobs/test/common/unknown"
+	missing, err := c.toEnvelope(*remoteP)
+	require.NoError(t, err)
+	missing.Metadata[remoteCodecName] = []byte("v2")
+	_, err = c.Decode([]*common.Payload{missing})
+	require.ErrorIs(t, err, ErrBlobNotFound)
+
+	size := int64(len(payloads[0].Data))
+	require.Equal(t, map[string]int64{
+		"lps_encode_total{namespace=test,operation=encode}":  1,
+		"lps_payload_bytes{namespace=test,operation=encode}": size,
+		"lps_decode_total{namespace=test,operation=decode}":  2,
+		"lps_payload_bytes{namespace=test,operation=decode}": size,
+		"lps_errors_total{namespace=test,operation=decode}":  1,
+	}, metrics.counters)
+	require.Equal(t, map[string]int{
+		"lps_put_latency{namespace=test,operation=encode}": 1,
+		"lps_get_latency{namespace=test,operation=decode}": 2,
+	}, metrics.timers)
+}
+
+func Test_nil_temporal_metrics_handler_is_rejected(t *testing.T) {
+	_, err := New(WithTemporalMetricsHandler(nil))
+	require.EqualError(t, err, "metrics handler cannot be nil")
+}
@@ -0,0 +1,184 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// errPresignUnsupported is returned if the LPS server cannot issue presigned URLs.
+	errPresignUnsupported = errors.New("server does not support presigned URLs")
+)
+
+type presignResponse struct {
+	Key     string              `json:"key"`
+	URL     string              `json:"url"`
+	Method  string              `json:"method"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// putPresigned requests a presigned upload URL from the LPS server and uploads size bytes
+// read from body directly to object storage. It returns the key of the stored blob.
+func (c *Codec) putPresigned(ctx context.Context, span trace.Span, namespace string, body io.Reader, size int64, digest string, metadata []byte, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		c.url.JoinPath(c.version).String(),
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	req.URL.Path = path.Join(req.URL.Path, "blobs/presign-put")
+
+	q := req.URL.Query()
+	q.Set("digest", digest)
+	q.Set("namespace", namespace)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("X-Payload-Expected-Content-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString(metadata))
+	if contentType != "" {
+		req.Header.Set("X-Payload-Content-Type", contentType)
+	}
+
+	presigned, err := c.presign(ctx, span, req)
+	if err != nil {
+		return "", err
+	}
+	if presigned.URL == "" {
+		// the blob already exists
+		return presigned.Key, nil
+	}
+
+	uploadReq, err := presigned.newRequest(ctx, body)
+	if err != nil {
+		return "", err
+	}
+	uploadReq.ContentLength = size
+
+	resp, err := c.client.Do(uploadReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	setSpanAttributes(span, attrHTTPStatus.Int(resp.StatusCode))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("object storage returned status code %d: %s", resp.StatusCode, respBody)
+	}
+
+	return presigned.Key, nil
+}
+
+// getPresigned requests a presigned download URL from the LPS server and downloads the
+// blob referenced by remoteP directly from object storage. The caller is responsible for
+// closing the returned body.
+func (c *Codec) getPresigned(ctx context.Context, span trace.Span, remoteP *remotePayload) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		c.url.JoinPath(c.version).String(),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path = path.Join(req.URL.Path, "blobs/presign-get")
+
+	q := req.URL.Query()
+	q.Set("key", remoteP.Key)
+	req.URL.RawQuery = q.Encode()
+
+	presigned, err := c.presign(ctx, span, req)
+	if err != nil {
+		return nil, err
+	}
+
+	downloadReq, err := presigned.newRequest(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(downloadReq)
+	if err != nil {
+		return nil, err
+	}
+	setSpanAttributes(span, attrHTTPStatus.Int(resp.StatusCode))
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("object storage returned status code %d: %s", resp.StatusCode, respBody)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", ErrBlobNotFound, err)
+		}
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// presign sends req to the LPS server and decodes the presigned URL response.
+func (c *Codec) presign(ctx context.Context, span trace.Span, req *http.Request) (*presignResponse, error) {
+	if err := c.setRequestHeaders(req); err != nil {
+		return nil, err
+	}
+	injectTraceContext(ctx, span, req)
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotImplemented, http.StatusNotFound:
+		// older servers do not know the presign endpoints at all
+		return nil, errPresignUnsupported
+	default:
+		return nil, newStatusError(resp.StatusCode, responseRequestID(resp), respBody)
+	}
+
+	var presigned presignResponse
+	if err := json.Unmarshal(respBody, &presigned); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal presign response: %w", err)
+	}
+	return &presigned, nil
+}
+
+// newRequest creates a request against the presigned URL, including all signed headers.
+func (p *presignResponse) newRequest(ctx context.Context, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, p.Method, p.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for header, values := range p.Headers {
+		// Host and Content-Length are derived from the request itself
+		if http.CanonicalHeaderKey(header) == "Host" || http.CanonicalHeaderKey(header) == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(header, value)
+		}
+	}
+	return req, nil
+}
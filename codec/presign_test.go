@@ -0,0 +1,155 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"go.temporal.io/api/common/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// presigningDriver is a memory driver which issues "presigned" URLs pointing to
+// an object store served by objectStoreHandler.
+type presigningDriver struct {
+	memory.Driver
+	objectStoreURL string
+}
+
+func (d *presigningDriver) PresignPut(_ context.Context, r *storage.PresignPutRequest) (*storage.PresignResponse, error) {
+	return &storage.PresignResponse{
+		URL:    d.objectStoreURL + "/" + url.PathEscape(r.Key),
+		Method: http.MethodPut,
+		Header: map[string][]string{
+			"X-Signed-Length": {strconv.FormatUint(r.ContentLength, 10)},
+		},
+	}, nil
+}
+
+func (d *presigningDriver) PresignGet(_ context.Context, r *storage.PresignGetRequest) (*storage.PresignResponse, error) {
+	return &storage.PresignResponse{
+		URL:    d.objectStoreURL + "/" + url.PathEscape(r.Key),
+		Method: http.MethodGet,
+	}, nil
+}
+
+func (d *presigningDriver) objectStoreHandler(w http.ResponseWriter, r *http.Request) {
+	key, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("X-Signed-Length") != strconv.FormatInt(r.ContentLength, 10) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, err := d.PutPayload(r.Context(), &storage.PutRequest{Data: r.Body, Key: key, ContentLength: uint64(r.ContentLength)})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case http.MethodGet:
+		if _, err := d.GetPayload(r.Context(), &storage.GetRequest{Key: key, Writer: w}); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func Test_presigned_transfers_bypass_the_lps_server(t *testing.T) {
+	d := &presigningDriver{}
+	objectStore := httptest.NewServer(http.HandlerFunc(d.objectStoreHandler))
+	defer objectStore.Close()
+	d.objectStoreURL = objectStore.URL
+
+	var proxiedBytes int64
+	lps := server.NewHttpHandler(d)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		atomic.AddInt64(&proxiedBytes, int64(len(body)))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithPresignedTransfers(),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Metadata: map[string][]byte{
+			"foo": []byte("bar"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+
+	// encoding again finds the existing blob
+	encodedAgain, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+	require.Equal(t, encoded, encodedAgain)
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, &payload, decoded[0])
+
+	require.Zero(t, atomic.LoadInt64(&proxiedBytes))
+	require.False(t, c.presignUnsupported.Load())
+}
+
+func Test_presigned_transfers_fall_back_to_proxying(t *testing.T) {
+	var presignRequests int32
+	lps := server.NewHttpHandler(&memory.Driver{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/presign-") {
+			atomic.AddInt32(&presignRequests, 1)
+		}
+		lps.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithPresignedTransfers(),
+	)
+	require.NoError(t, err)
+
+	payload := common.Payload{
+		Metadata: map[string][]byte{
+			"foo": []byte("bar"),
+		},
+		Data: []byte("this is a longer message blah blah blah blah blah blah blah"),
+	}
+
+	encoded, err := c.Encode([]*common.Payload{&payload})
+	require.NoError(t, err)
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, &payload, decoded[0])
+
+	// the server is only asked once for a presigned URL
+	require.True(t, c.presignUnsupported.Load())
+	require.Equal(t, int32(1), atomic.LoadInt32(&presignRequests))
+}
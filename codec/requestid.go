@@ -0,0 +1,43 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// requestIDHeader is the header holding the ID of a request sent to LargePayloadService,
+// which servers log and echo in their responses.
+const requestIDHeader = "X-Request-ID"
+
+// idempotencyKeyHeader is the header identifying an upload, so that LargePayloadService answers
+// its retries with the response of the first one.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// newRequestID returns a random version 4 UUID identifying a request.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// the ID only correlates logs, requests are sent without it
+		return ""
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// responseRequestID returns the ID of the request which led to resp, as echoed by the server
+// or otherwise as sent by the codec.
+func responseRequestID(resp *http.Response) string {
+	if id := resp.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	if resp.Request != nil {
+		return resp.Request.Header.Get(requestIDHeader)
+	}
+	return ""
+}
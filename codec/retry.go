@@ -0,0 +1,115 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultRetryableStatusCodes are the status codes of responses retried if WithRetries is configured.
+var defaultRetryableStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// do sends a request to LargePayloadService, retrying transport errors and responses with
+// retryable status codes as configured with WithRetries. The last response or error is
+// returned once all attempts are exhausted.
+func (c *Codec) do(req *http.Request) (*http.Response, error) {
+	interval := c.retryInterval
+	for attempt := 1; ; attempt++ {
+		resp, err := c.doOnce(req)
+		if attempt >= c.retryAttempts || !c.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		wait := interval
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok && retryAfter > wait {
+				wait = retryAfter
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			c.logger.Debug("request failed, retrying", "url", req.URL.Redacted(), "attempt", attempt, "status", resp.StatusCode, "interval", wait)
+		} else {
+			c.logger.Debug("request failed, retrying", "url", req.URL.Redacted(), "attempt", attempt, "error", err, "interval", wait)
+		}
+		if err := c.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		interval *= 2
+
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable returns whether the request which led to resp or err may be sent again.
+func (c *Codec) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// the body cannot be sent again
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil && !errors.Is(err, ErrCircuitOpen)
+	}
+	// other client errors are permanent
+	if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	return c.retryableStatusCodes[resp.StatusCode]
+}
+
+// rewind returns a copy of req with a fresh body, so that it can be sent again.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
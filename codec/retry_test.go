@@ -0,0 +1,497 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedResponse is a response of scriptedHandler.
+type scriptedResponse struct {
+	status     int
+	retryAfter string
+}
+
+// scriptedHandler responds to the requests it receives with the scripted responses in
+// order, recording the bodies of the requests.
+type scriptedHandler struct {
+	mu        sync.Mutex
+	responses []scriptedResponse
+	bodies    []string
+}
+
+func (h *scriptedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	h.bodies = append(h.bodies, string(body))
+	resp := scriptedResponse{status: http.StatusOK}
+	if len(h.bodies) <= len(h.responses) {
+		resp = h.responses[len(h.bodies)-1]
+	}
+	if resp.retryAfter != "" {
+		w.Header().Set("Retry-After", resp.retryAfter)
+	}
+	w.WriteHeader(resp.status)
+}
+
+func Test_requests_are_retried(t *testing.T) {
+	retryAfterDate := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name       string
+		opts       []Option
+		responses  []scriptedResponse
+		wantStatus int
+		wantDelays []time.Duration
+	}{
+		{
+			name:       "no retries by default",
+			responses:  []scriptedResponse{{status: http.StatusServiceUnavailable}},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "default status codes with exponential backoff",
+			opts: []Option{WithRetries(4, time.Second)},
+			responses: []scriptedResponse{
+				{status: http.StatusBadGateway},
+				{status: http.StatusServiceUnavailable},
+				{status: http.StatusGatewayTimeout},
+			},
+			wantStatus: http.StatusOK,
+			wantDelays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name: "attempts are exhausted",
+			opts: []Option{WithRetries(2, time.Second)},
+			responses: []scriptedResponse{
+				{status: http.StatusBadGateway},
+				{status: http.StatusBadGateway},
+				{status: http.StatusBadGateway},
+			},
+			wantStatus: http.StatusBadGateway,
+			wantDelays: []time.Duration{time.Second},
+		},
+		{
+			name: "retry after in seconds",
+			opts: []Option{WithRetries(3, time.Second)},
+			responses: []scriptedResponse{
+				{status: http.StatusTooManyRequests, retryAfter: "10"},
+				// a shorter retry after does not shorten the backoff
+				{status: http.StatusTooManyRequests, retryAfter: "1"},
+			},
+			wantStatus: http.StatusOK,
+			wantDelays: []time.Duration{10 * time.Second, 2 * time.Second},
+		},
+		{
+			name: "custom status codes",
+			opts: []Option{
+				WithRetries(3, time.Second),
+				WithRetryableStatusCodes(http.StatusInternalServerError, http.StatusNotFound),
+			},
+			responses: []scriptedResponse{
+				{status: http.StatusInternalServerError},
+				{status: http.StatusBadGateway},
+			},
+			wantStatus: http.StatusBadGateway,
+			wantDelays: []time.Duration{time.Second},
+		},
+		{
+			name: "client errors are never retried",
+			opts: []Option{
+				WithRetries(3, time.Second),
+				WithRetryableStatusCodes(http.StatusNotFound),
+			},
+			responses:  []scriptedResponse{{status: http.StatusNotFound}},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &scriptedHandler{responses: tt.responses}
+			s := httptest.NewServer(handler)
+			defer s.Close()
+
+			c, err := New(append([]Option{
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithoutUrlHealthCheck(),
+			}, tt.opts...)...)
+			require.NoError(t, err)
+			var delays []time.Duration
+			c.sleep = func(ctx context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				return nil
+			}
+
+			req, err := http.NewRequest(http.MethodPut, s.URL, strings.NewReader("payload"))
+			require.NoError(t, err)
+			resp, err := c.do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+			require.Equal(t, tt.wantDelays, delays)
+			// the body is sent again with every attempt
+			require.Len(t, handler.bodies, len(tt.wantDelays)+1)
+			for _, body := range handler.bodies {
+				require.Equal(t, "payload", body)
+			}
+		})
+	}
+
+	t.Run("retry after as http date", func(t *testing.T) {
+		handler := &scriptedHandler{responses: []scriptedResponse{
+			{status: http.StatusServiceUnavailable, retryAfter: retryAfterDate},
+		}}
+		s := httptest.NewServer(handler)
+		defer s.Close()
+
+		c, err := New(
+			WithURL(s.URL),
+			WithHTTPClient(s.Client()),
+			WithNamespace("test"),
+			WithoutUrlHealthCheck(),
+			WithRetries(2, time.Second),
+		)
+		require.NoError(t, err)
+		var delays []time.Duration
+		c.sleep = func(ctx context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		}
+
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		require.NoError(t, err)
+		resp, err := c.do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, delays, 1)
+		require.InDelta(t, 30*time.Second, delays[0], float64(2*time.Second))
+	})
+}
+
+// blockingPutDriver blocks puts until release is closed, signaling started when they begin.
+type blockingPutDriver struct {
+	memory.Driver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingPutDriver) PutPayload(ctx context.Context, request *storage.PutRequest) (*storage.PutResponse, error) {
+	d.started <- struct{}{}
+	<-d.release
+	return d.Driver.PutPayload(ctx, request)
+}
+
+func Test_codec_waits_for_retry_after_of_saturated_lps(t *testing.T) {
+	driver := &blockingPutDriver{started: make(chan struct{}, 2), release: make(chan struct{})}
+	s := httptest.NewServer(server.NewHttpHandlerWithOptions(driver, server.WithMaxConcurrentPuts(1)))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithoutUrlHealthCheck(),
+		WithMinBytes(32),
+		WithRetries(2, time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	// another upload takes the only slot until the codec backs off
+	done := make(chan struct{})
+	other := []byte("other")
+	sum := sha256.Sum256(other)
+	req, err := http.NewRequest(http.MethodPut, s.URL+"/v2/blobs/put?namespace=test&digest=sha256:"+hex.EncodeToString(sum[:]), bytes.NewReader(other))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString([]byte(`{}`)))
+	go func() {
+		defer close(done)
+		if resp, err := s.Client().Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	select {
+	case <-driver.started:
+	case <-done:
+		t.Fatal("the other upload was not stored")
+	}
+	var delays []time.Duration
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		close(driver.release)
+		<-done
+		return nil
+	}
+
+	payloads, err := c.Encode([]*common.Payload{{Data: make([]byte, 64)}})
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+	// the retry interval is raised to the Retry-After header of the server
+	require.Equal(t, []time.Duration{time.Second}, delays)
+}
+
+// lostResponseHandler forwards requests to an LPS handler, but replaces the response of the
+// first upload with 502 Bad Gateway, as a proxy timing out would. It records the
+// Idempotency-Key headers of uploads, and the Idempotent-Replayed headers of their responses.
+type lostResponseHandler struct {
+	handler         http.Handler
+	mu              sync.Mutex
+	idempotencyKeys []string
+	replayed        []string
+}
+
+func (h *lostResponseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v2/blobs/put" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	h.mu.Lock()
+	h.idempotencyKeys = append(h.idempotencyKeys, r.Header.Get("Idempotency-Key"))
+	first := len(h.idempotencyKeys) == 1
+	h.mu.Unlock()
+	if !first {
+		h.handler.ServeHTTP(w, r)
+		h.mu.Lock()
+		h.replayed = append(h.replayed, w.Header().Get("Idempotent-Replayed"))
+		h.mu.Unlock()
+		return
+	}
+	h.handler.ServeHTTP(httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// countingPutDriver counts the calls to PutPayload.
+type countingPutDriver struct {
+	memory.Driver
+	mu   sync.Mutex
+	puts int
+}
+
+func (d *countingPutDriver) PutPayload(ctx context.Context, request *storage.PutRequest) (*storage.PutResponse, error) {
+	d.mu.Lock()
+	d.puts++
+	d.mu.Unlock()
+	return d.Driver.PutPayload(ctx, request)
+}
+
+func Test_codec_sends_idempotency_key_with_retries(t *testing.T) {
+	for _, retries := range []bool{false, true} {
+		t.Run("retries "+strconv.FormatBool(retries), func(t *testing.T) {
+			driver := &countingPutDriver{}
+			handler := &lostResponseHandler{handler: server.NewHttpHandler(driver)}
+			s := httptest.NewServer(handler)
+			defer s.Close()
+
+			opts := []Option{
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+				WithoutUrlHealthCheck(),
+				WithMinBytes(32),
+			}
+			if retries {
+				opts = append(opts, WithRetries(3, time.Millisecond))
+			}
+			c, err := New(opts...)
+			require.NoError(t, err)
+
+			_, err = c.Encode([]*common.Payload{{Data: make([]byte, 64)}})
+			if !retries {
+				require.Error(t, err)
+				require.Equal(t, []string{""}, handler.idempotencyKeys)
+				return
+			}
+			require.NoError(t, err)
+			// the retry is answered with the response of the completed upload
+			require.Len(t, handler.idempotencyKeys, 2)
+			require.NotEmpty(t, handler.idempotencyKeys[0])
+			require.Equal(t, handler.idempotencyKeys[0], handler.idempotencyKeys[1])
+			require.Equal(t, []string{"true"}, handler.replayed)
+			require.Equal(t, 1, driver.puts)
+
+			// other uploads are sent with another key
+			_, err = c.Encode([]*common.Payload{{Data: bytes.Repeat([]byte("a"), 64)}})
+			require.NoError(t, err)
+			require.Len(t, handler.idempotencyKeys, 3)
+			require.NotEqual(t, handler.idempotencyKeys[0], handler.idempotencyKeys[2])
+		})
+	}
+}
+
+func Test_requests_with_unrewindable_bodies_are_not_retried(t *testing.T) {
+	handler := &scriptedHandler{responses: []scriptedResponse{{status: http.StatusServiceUnavailable}}}
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithoutUrlHealthCheck(),
+		WithRetries(3, time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPut, s.URL, io.NopCloser(strings.NewReader("payload")))
+	require.NoError(t, err)
+	req.ContentLength = int64(len("payload"))
+	resp, err := c.do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Len(t, handler.bodies, 1)
+}
+
+// interruptingHandler aborts the first download of a blob after writing half of it, and
+// records the Range headers of the downloads. If ignoreRanges is set, ranges are not
+// forwarded to the LPS handler, which sends the entire blob instead.
+type interruptingHandler struct {
+	handler      http.Handler
+	ignoreRanges bool
+	mu           sync.Mutex
+	ranges       []string
+}
+
+func (h *interruptingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v2/blobs/get" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	h.mu.Lock()
+	h.ranges = append(h.ranges, r.Header.Get("Range"))
+	first := len(h.ranges) == 1
+	h.mu.Unlock()
+	if h.ignoreRanges {
+		r.Header.Del("Range")
+	}
+	if !first {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	h.handler.ServeHTTP(rec, r)
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	_, _ = w.Write(rec.Body.Bytes()[:rec.Body.Len()/2])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func Test_interrupted_downloads_are_resumed(t *testing.T) {
+	data := make([]byte, 1<<20)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	payload := &common.Payload{Data: data}
+
+	for _, scenario := range []struct {
+		name         string
+		ignoreRanges bool
+		opts         []Option
+		wantRanges   []string
+		wantErr      bool
+	}{
+		{
+			name:       "range",
+			opts:       []Option{WithRetries(3, time.Millisecond)},
+			wantRanges: []string{"", "bytes=524288-"},
+		},
+		{
+			name:         "full download if ranges are not supported",
+			ignoreRanges: true,
+			opts:         []Option{WithRetries(3, time.Millisecond)},
+			wantRanges:   []string{"", "bytes=524288-"},
+		},
+		{
+			name:       "no retries",
+			wantRanges: []string{""},
+			wantErr:    true,
+		},
+	} {
+		t.Run(scenario.name, func(t *testing.T) {
+			handler := &interruptingHandler{handler: server.NewHttpHandler(&memory.Driver{}), ignoreRanges: scenario.ignoreRanges}
+			s := httptest.NewServer(handler)
+			defer s.Close()
+
+			c, err := New(append([]Option{
+				WithURL(s.URL),
+				WithHTTPClient(s.Client()),
+				WithNamespace("test"),
+			}, scenario.opts...)...)
+			require.NoError(t, err)
+
+			encoded, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+			decoded, err := c.Decode(encoded)
+			require.Equal(t, scenario.wantRanges, handler.ranges)
+			if scenario.wantErr {
+				require.Error(t, err)
+				return
+			}
+			// the digest of the stitched blob is verified
+			require.NoError(t, err)
+			require.Equal(t, []*common.Payload{payload}, decoded)
+		})
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "0", want: 0, ok: true},
+		{value: "120", want: 2 * time.Minute, ok: true},
+		{value: "-1", ok: false},
+		{value: "soon", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Quote(tt.value), func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	for _, opt := range []Option{
+		WithRetries(0, time.Second),
+		WithRetries(1, 0),
+		WithRetryableStatusCodes(600),
+	} {
+		_, err := New(WithURL("http://localhost"), WithNamespace("test"), WithoutUrlHealthCheck(), opt)
+		require.Error(t, err)
+	}
+}
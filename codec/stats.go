@@ -0,0 +1,72 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"sync/atomic"
+)
+
+// Stats are cumulative statistics of a codec since it was created, see Codec.Stats.
+type Stats struct {
+	// EncodedCount is the number of payloads offloaded to LargePayloadService by Encode.
+	EncodedCount int64
+	// PassthroughCount is the number of payloads Encode returned unchanged.
+	PassthroughCount int64
+	// DecodedCount is the number of payloads Decode retrieved from LargePayloadService,
+	// including payloads served from the decode cache.
+	DecodedCount int64
+	// BytesUploaded is the number of bytes of payload data offloaded by Encode.
+	BytesUploaded int64
+	// BytesDownloaded is the number of bytes of blobs downloaded by Decode.
+	BytesDownloaded int64
+	// Errors is the number of payloads which could not be encoded or decoded.
+	Errors int64
+	// HedgedRequests is the number of additional GETs sent because of WithHedgedReads.
+	HedgedRequests int64
+}
+
+// stats holds the counters behind Stats.
+type stats struct {
+	encoded         atomic.Int64
+	passthrough     atomic.Int64
+	decoded         atomic.Int64
+	bytesUploaded   atomic.Int64
+	bytesDownloaded atomic.Int64
+	errors          atomic.Int64
+	hedged          atomic.Int64
+}
+
+// Stats returns a snapshot of the cumulative statistics of the codec, e.g. for capacity
+// planning. The statistics can be published with expvar using WithExpvar.
+func (c *Codec) Stats() Stats {
+	return Stats{
+		EncodedCount:     c.stats.encoded.Load(),
+		PassthroughCount: c.stats.passthrough.Load(),
+		DecodedCount:     c.stats.decoded.Load(),
+		BytesUploaded:    c.stats.bytesUploaded.Load(),
+		BytesDownloaded:  c.stats.bytesDownloaded.Load(),
+		Errors:           c.stats.errors.Load(),
+		HedgedRequests:   c.stats.hedged.Load(),
+	}
+}
+
+// recordEncode records a payload of size bytes offloaded by Encode, or an error.
+func (s *stats) recordEncode(size int, err error) {
+	if err != nil {
+		s.errors.Add(1)
+		return
+	}
+	s.encoded.Add(1)
+	s.bytesUploaded.Add(int64(size))
+}
+
+// recordDecode records a payload decoded by Decode, or an error.
+func (s *stats) recordDecode(err error) {
+	if err != nil {
+		s.errors.Add(1)
+		return
+	}
+	s.decoded.Add(1)
+}
@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_stats_are_counted_across_concurrent_calls(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+		WithExpvar("lps_test_stats"),
+	)
+	require.NoError(t, err)
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payloads := []*common.Payload{
+				{Data: []byte(fmt.Sprintf("this is the longer message of worker %d blah blah", i))},
+				{Data: []byte("small")},
+			}
+			encoded, err := c.Encode(payloads)
+			require.NoError(t, err)
+			_, err = c.Decode(encoded)
+			require.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	// a blob which does not exist
+	encoded, err := c.Encode([]*common.Payload{{Data: []byte("this is yet another longer message blah blah")}})
+	require.NoError(t, err)
+	remoteP, err := fromEnvelope(encoded[0])
+	require.NoError(t, err)
+	remoteP.Key = "/blobs/test/common/unknown"
+	missing, err := c.toEnvelope(*remoteP)
+	require.NoError(t, err)
+	missing.Metadata[remoteCodecName] = []byte("v2")
+	_, err = c.Decode([]*common.Payload{missing})
+	require.Error(t, err)
+
+	// the larger message of each worker is 48 bytes long
+	want := Stats{
+		EncodedCount:     workers + 1,
+		PassthroughCount: workers,
+		DecodedCount:     workers,
+		BytesUploaded:    48*workers + 44,
+		BytesDownloaded:  48 * workers,
+		Errors:           1,
+	}
+	require.Equal(t, want, c.Stats())
+
+	var published Stats
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("lps_test_stats").String()), &published))
+	require.Equal(t, want, published)
+
+	// the name is taken
+	_, err = New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithExpvar("lps_test_stats"))
+	require.Error(t, err)
+}
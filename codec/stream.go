@@ -0,0 +1,154 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"go.temporal.io/api/common/v1"
+)
+
+// PutBlob stores the data read from r in LargePayloadService without buffering it in
+// memory, and returns the key and digest of the stored blob. r must yield exactly size
+// bytes. The metadata is stored with the blob the same way as the metadata of an encoded
+// payload.
+//
+// The key of a blob depends on its digest, so the data is read twice: if r implements
+// io.Seeker, it is rewound after computing the digest, otherwise the data is spooled to a
+// temporary file. Functions configured with WithNamespaceProvider and WithKeyPrefixFunc are
+// called with a payload carrying only the metadata.
+func (c *Codec) PutBlob(ctx context.Context, r io.Reader, size int64, metadata map[string][]byte) (key string, digest string, err error) {
+	if c.closed.Load() {
+		return "", "", ErrClosed
+	}
+	if size < 0 {
+		return "", "", errors.New("size cannot be negative")
+	}
+	if err := c.ensureHealthy(ctx); err != nil {
+		return "", "", err
+	}
+
+	payload := &common.Payload{Metadata: metadata}
+	namespace := c.namespaceFor(ctx, payload)
+	ctx, span := c.startSpan(ctx, "lps.blobs.put",
+		attrNamespace.String(namespace),
+		attrBlobSize.Int64(size),
+	)
+	defer func() { endSpan(span, err) }()
+
+	metadata, err = c.metadataWithKeyPrefix(payload)
+	if err != nil {
+		return "", "", err
+	}
+
+	h, release, err := c.newHash(c.digestAlgorithm)
+	if err != nil {
+		return "", "", err
+	}
+	defer release()
+	body, err := rewindable(r, h, size)
+	if err != nil {
+		return "", "", err
+	}
+	defer body.Close()
+	digest = c.digestAlgorithm + ":" + hexSum(h)
+
+	key, err = c.transport.PutBlob(ctx, PutInput{
+		Namespace: namespace,
+		Data:      body,
+		Size:      size,
+		Digest:    digest,
+		Metadata:  metadata,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	setSpanAttributes(span, attrBlobKey.String(key))
+	return key, digest, nil
+}
+
+// GetBlob writes the blob with the given key, as returned by PutBlob, to w without
+// buffering it in memory. The data is not verified; callers may compare it to the digest
+// returned by PutBlob.
+//
+// Fetching a blob by its key only over HTTP requires a server which does not insist on the
+// X-Payload-Expected-Content-Length header. Servers serving the size of blobs from storage
+// do not need it.
+func (c *Codec) GetBlob(ctx context.Context, key string, w io.Writer) (err error) {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	ctx, span := c.startSpan(ctx, "lps.blobs.get", attrBlobKey.String(key))
+	defer func() { endSpan(span, err) }()
+
+	return c.transport.GetBlob(ctx, GetInput{Key: key}, w)
+}
+
+// rewindable hashes the size bytes read from r with h and returns a reader which yields
+// the same bytes again. The returned reader must be closed.
+func rewindable(r io.Reader, h hash.Hash, size int64) (io.ReadCloser, error) {
+	if s, ok := r.(io.ReadSeeker); ok {
+		start, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if err := copyExactly(h, s, size); err != nil {
+			return nil, err
+		}
+		if _, err := s.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(io.LimitReader(s, size)), nil
+	}
+
+	f, err := os.CreateTemp("", "lps-blob-*")
+	if err != nil {
+		return nil, err
+	}
+	spool := &tempFile{File: f}
+	if err := copyExactly(f, io.TeeReader(r, h), size); err != nil {
+		spool.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+// copyExactly copies size bytes from r to w, failing if r holds fewer or more bytes.
+func copyExactly(w io.Writer, r io.Reader, size int64) error {
+	n, err := io.Copy(w, io.LimitReader(r, size+1))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("read %d bytes, expected %d", n, size)
+	}
+	return nil
+}
+
+// tempFile is a temporary file which is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
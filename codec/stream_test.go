@@ -0,0 +1,61 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_blobs_are_streamed_to_and_from_lps(t *testing.T) {
+	s := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer s.Close()
+
+	c, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+	)
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("this is a large artifact "), 1<<12)
+	metadata := map[string][]byte{"artifact": []byte("report")}
+	tests := []struct {
+		name   string
+		reader func() io.Reader
+	}{
+		{"seekable", func() io.Reader { return bytes.NewReader(data) }},
+		// hide the io.Seeker implementation, forcing the data to be spooled
+		{"not seekable", func() io.Reader { return struct{ io.Reader }{bytes.NewReader(data)} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			key, digest, err := c.PutBlob(ctx, tt.reader(), int64(len(data)), metadata)
+			require.NoError(t, err)
+			require.NotEmpty(t, key)
+			require.Equal(t, sha256Digest(data), digest)
+
+			var buf bytes.Buffer
+			require.NoError(t, c.GetBlob(ctx, key, &buf))
+			require.Equal(t, data, buf.Bytes())
+		})
+	}
+
+	_, _, err = c.PutBlob(context.Background(), bytes.NewReader(data), int64(len(data))+1, metadata)
+	require.ErrorContains(t, err, "expected")
+	_, _, err = c.PutBlob(context.Background(), struct{ io.Reader }{bytes.NewReader(data)}, int64(len(data))-1, metadata)
+	require.ErrorContains(t, err, "expected")
+
+	err = c.GetBlob(context.Background(), "/blobs/test/common/unknown", io.Discard)
+	require.ErrorIs(t, err, ErrBlobNotFound)
+}
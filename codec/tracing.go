@@ -0,0 +1,66 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/DataDog/temporal-large-payload-codec/codec"
+
+	attrNamespace  = attribute.Key("lps.namespace")
+	attrBlobSize   = attribute.Key("lps.blob.size")
+	attrBlobKey    = attribute.Key("lps.blob.key")
+	attrBatchSize  = attribute.Key("lps.batch.size")
+	attrHTTPStatus = attribute.Key("http.status_code")
+)
+
+// startSpan starts a client span for a request to the LPS server. If no tracer
+// has been configured, no span is created and the returned span is nil.
+func (c *Codec) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if c.tracer == nil {
+		return ctx, nil
+	}
+	return c.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// injectTraceContext propagates the span context of ctx to the LPS server
+// using W3C traceparent headers.
+func injectTraceContext(ctx context.Context, span trace.Span, req *http.Request) {
+	if span == nil {
+		return
+	}
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// setSpanAttributes sets attrs on span, if any.
+func setSpanAttributes(span trace.Span, attrs ...attribute.KeyValue) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(attrs...)
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
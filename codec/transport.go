@@ -0,0 +1,187 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.temporal.io/sdk/converter"
+)
+
+// Transport transfers blobs between the codec and the storage of LargePayloadService.
+//
+// By default, the codec talks to the LPS server over HTTP. A custom implementation can be
+// configured with WithTransport, e.g. NewDriverTransport for using a storage driver in the
+// same process. Implementations must be safe for concurrent use.
+type Transport interface {
+	// PutBlob stores a blob and returns its key. Storing a blob which already exists must
+	// succeed and return the key of the existing blob.
+	PutBlob(ctx context.Context, input PutInput) (string, error)
+	// GetBlob writes the data of a blob to w. If the blob does not exist, an error wrapping
+	// ErrBlobNotFound is returned.
+	GetBlob(ctx context.Context, input GetInput, w io.Writer) error
+	// Health returns an error if blobs cannot be stored or retrieved.
+	Health(ctx context.Context) error
+}
+
+// PutInput describes a blob to store with a Transport.
+type PutInput struct {
+	// Namespace is the Temporal namespace the blob belongs to.
+	Namespace string
+	// Data yields the data of the blob.
+	Data io.Reader
+	// Size is the number of bytes yielded by Data.
+	Size int64
+	// Digest is the checksum of the data in the format sha256:<hex encoded value>.
+	Digest string
+	// Metadata is the Temporal metadata of the blob, which is part of its key.
+	Metadata map[string][]byte
+}
+
+// GetInput describes a blob to retrieve with a Transport.
+type GetInput struct {
+	// Key is the key returned when storing the blob.
+	Key string
+	// Digest is the checksum of the data in the format sha256:<hex encoded value>. It is
+	// empty if the blob is retrieved by its key only.
+	Digest string
+	// Size is the expected size of the data. It is zero if Digest is empty.
+	Size int64
+	// Metadata is the Temporal metadata of the blob. It is nil if Digest is empty.
+	Metadata map[string][]byte
+
+	// version is the version of the codec which encoded the payload.
+	version string
+}
+
+// contentTypes are the content types of the stored blobs of payloads with the given
+// encoding, which help inspecting blobs in the backing object store.
+var contentTypes = map[string]string{
+	converter.MetadataEncodingJSON:      "application/json",
+	converter.MetadataEncodingProtoJSON: "application/json",
+	converter.MetadataEncodingProto:     "application/x-protobuf",
+	converter.MetadataEncodingBinary:    "application/octet-stream",
+}
+
+// contentTypeFor returns the content type of the blob of a payload with the given metadata,
+// or an empty string if its encoding is unknown.
+func contentTypeFor(metadata map[string][]byte) string {
+	return contentTypes[string(metadata[converter.MetadataEncoding])]
+}
+
+// httpTransport is the default Transport, which talks to the LPS server over HTTP using the
+// configuration of the codec.
+type httpTransport struct {
+	c *Codec
+}
+
+func (t *httpTransport) PutBlob(ctx context.Context, input PutInput) (string, error) {
+	md, err := json.Marshal(input.Metadata)
+	if err != nil {
+		return "", err
+	}
+	return t.c.storeBlob(ctx, t.span(ctx), input.Namespace, input.Data, input.Size, input.Digest, md, contentTypeFor(input.Metadata))
+}
+
+func (t *httpTransport) GetBlob(ctx context.Context, input GetInput, w io.Writer) error {
+	c := t.c
+	span := t.span(ctx)
+	version := input.version
+	if version == "" {
+		version = c.version
+	}
+	remoteP := &remotePayload{
+		Metadata: input.Metadata,
+		Size:     uint(input.Size),
+		Digest:   input.Digest,
+		Key:      input.Key,
+	}
+
+	var body io.ReadCloser
+	var err error
+	if c.presignedTransfers && version == "v2" && !c.presignUnsupported.Load() {
+		body, err = c.getPresigned(ctx, span, remoteP)
+		if errors.Is(err, errPresignUnsupported) {
+			c.logger.Info("server does not support presigned transfers, falling back to proxied transfers")
+			c.presignUnsupported.Store(true)
+			body, err = c.getBlob(ctx, span, remoteP, version, 0)
+		}
+	} else {
+		body, err = c.getBlob(ctx, span, remoteP, version, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	if input.Digest == "" {
+		defer body.Close()
+		_, err = io.Copy(w, body)
+		return err
+	}
+
+	// if retries are configured, interrupted downloads of blobs of known size are resumed
+	// where they stopped, continuing to write to w
+	var written int64
+	interval := c.retryInterval
+	for attempt := 1; ; attempt++ {
+		// reading one byte more than expected detects over-long responses without reading them entirely
+		r := &readErrorRecorder{r: io.LimitReader(body, input.Size+1-written)}
+		n, err := io.Copy(w, r)
+		body.Close()
+		written += n
+		if err == nil {
+			break
+		}
+		if r.err == nil || written >= input.Size || attempt >= c.retryAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		c.logger.Debug("download interrupted, resuming", "key", input.Key, "offset", written, "attempt", attempt, "error", err, "interval", interval)
+		if err := c.sleep(ctx, interval); err != nil {
+			return err
+		}
+		interval *= 2
+		if body, err = c.getBlob(ctx, span, remoteP, version, written); err != nil {
+			return err
+		}
+	}
+	if written > input.Size {
+		return fmt.Errorf("server returned more than the expected %d bytes", input.Size)
+	}
+	return nil
+}
+
+// readErrorRecorder records the error of a failed read, which tells interrupted downloads
+// apart from failed writes.
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (t *httpTransport) Health(ctx context.Context) error {
+	return t.c.checkHealth(ctx)
+}
+
+// span returns the span started by the codec for the current request, which is nil if no
+// tracer is configured.
+func (t *httpTransport) span(ctx context.Context) trace.Span {
+	if t.c.tracer == nil {
+		return nil
+	}
+	return trace.SpanFromContext(ctx)
+}
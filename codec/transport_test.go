@@ -0,0 +1,260 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.temporal.io/api/common/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	lpsgrpc "github.com/DataDog/temporal-large-payload-codec/server/grpc"
+	"github.com/DataDog/temporal-large-payload-codec/server/grpc/lpspb"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_driver_transport_stores_blobs_in_process(t *testing.T) {
+	driver := &memory.Driver{}
+	c, err := New(
+		WithTransport(NewDriverTransport(driver)),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+
+	payloads := []*common.Payload{
+		{
+			Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+			Data:     []byte("this is a longer message blah blah blah blah blah blah"),
+		},
+		{Data: []byte("small")},
+	}
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), encoded[0].Metadata[remoteCodecName])
+	require.Equal(t, payloads[1], encoded[1])
+
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+
+	// blobs are stored under the same key as by the LPS server, so they can be decoded over HTTP
+	s := httptest.NewServer(server.NewHttpHandler(driver))
+	defer s.Close()
+	httpCodec, err := New(
+		WithURL(s.URL),
+		WithHTTPClient(s.Client()),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+	decoded, err = httpCodec.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+	reencoded, err := httpCodec.Encode(payloads)
+	require.NoError(t, err)
+	require.Equal(t, encoded, reencoded)
+
+	// streamed blobs
+	data := bytes.Repeat([]byte("this is a large artifact "), 1<<10)
+	key, _, err := c.PutBlob(context.Background(), bytes.NewReader(data), int64(len(data)), nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, c.GetBlob(context.Background(), key, &buf))
+	require.Equal(t, data, buf.Bytes())
+
+	err = c.GetBlob(context.Background(), "/blobs/test/common/unknown", io.Discard)
+	require.ErrorIs(t, err, ErrBlobNotFound)
+
+	require.NoError(t, c.checkHealthWithRetry(context.Background()))
+}
+
+func Test_driver_transport_verifies_digest(t *testing.T) {
+	data := []byte("some data")
+	sha512Sum := sha512.Sum512([]byte("other data"))
+	metadata := map[string][]byte{"encoding": []byte("json/plain")}
+
+	for _, digest := range []string{sha256Digest([]byte("other data")), "sha512:" + hex.EncodeToString(sha512Sum[:])} {
+		t.Run(digest, func(t *testing.T) {
+			driver := &memory.Driver{}
+			_, err := NewDriverTransport(driver).PutBlob(context.Background(), PutInput{
+				Namespace: "test",
+				Data:      bytes.NewReader(data),
+				Size:      int64(len(data)),
+				Digest:    digest,
+				Metadata:  metadata,
+			})
+			require.ErrorContains(t, err, "checksum mismatch")
+
+			// the data is not kept under the key of the digest
+			key, err := v2.ComputeKey("test", digest, metadata)
+			require.NoError(t, err)
+			exists, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: key})
+			require.NoError(t, err)
+			require.False(t, exists.Exists)
+		})
+	}
+
+	// the Temporal metadata is stored along with the blob
+	driver := &memory.Driver{}
+	key, err := NewDriverTransport(driver).PutBlob(context.Background(), PutInput{
+		Namespace: "test",
+		Data:      bytes.NewReader(data),
+		Size:      int64(len(data)),
+		Digest:    sha256Digest(data),
+		Metadata:  metadata,
+	})
+	require.NoError(t, err)
+	require.Equal(t, metadata, driver.Metadata(key))
+}
+
+func Test_grpc_transport_stores_blobs_with_the_grpc_api(t *testing.T) {
+	driver := &memory.Driver{}
+	listener := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	lpspb.RegisterLargePayloadServiceServer(s, lpsgrpc.NewServer(driver, lpsgrpc.WithMaxBlobBytes(4<<20)))
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go func() {
+		_ = s.Serve(listener)
+	}()
+	defer s.Stop()
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	c, err := New(
+		WithTransport(NewGRPCTransport(conn)),
+		WithNamespace("test"),
+		WithMinBytes(32),
+	)
+	require.NoError(t, err)
+
+	payloads := []*common.Payload{
+		{
+			Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+			Data:     []byte("this is a longer message blah blah blah blah blah blah"),
+		},
+	}
+	encoded, err := c.Encode(payloads)
+	require.NoError(t, err)
+	decoded, err := c.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+
+	// blobs are stored under the same key as over HTTP, so they can be decoded with either
+	driverCodec, err := New(WithTransport(NewDriverTransport(driver)), WithNamespace("test"), WithMinBytes(32))
+	require.NoError(t, err)
+	decoded, err = driverCodec.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payloads, decoded)
+
+	// blobs larger than a message are streamed in chunks
+	data := bytes.Repeat([]byte("this is a large artifact "), 100<<10)
+	key, _, err := c.PutBlob(context.Background(), bytes.NewReader(data), int64(len(data)), nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, c.GetBlob(context.Background(), key, &buf))
+	require.Equal(t, data, buf.Bytes())
+
+	err = c.GetBlob(context.Background(), "/blobs/test/common/unknown", io.Discard)
+	require.ErrorIs(t, err, ErrBlobNotFound)
+
+	tooLarge := bytes.Repeat([]byte("x"), 5<<20)
+	_, err = NewGRPCTransport(conn).PutBlob(context.Background(), PutInput{
+		Namespace: "test",
+		Data:      bytes.NewReader(tooLarge),
+		Size:      int64(len(tooLarge)),
+		Digest:    sha256Digest(tooLarge),
+	})
+	require.ErrorIs(t, err, ErrPayloadTooLarge)
+	require.Equal(t, int64(4<<20), err.(*PayloadTooLargeError).Limit)
+
+	require.NoError(t, c.checkHealthWithRetry(context.Background()))
+}
+
+func Test_transport_options(t *testing.T) {
+	_, err := New(WithTransport(nil))
+	require.EqualError(t, err, "transport cannot be nil")
+
+	_, err = New(WithNamespace("test"))
+	require.Error(t, err)
+}
+
+// contentTypeRecorder is a driver recording the content types of the stored blobs.
+type contentTypeRecorder struct {
+	memory.Driver
+	mu           sync.Mutex
+	contentTypes []string
+}
+
+func (d *contentTypeRecorder) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
+	d.mu.Lock()
+	d.contentTypes = append(d.contentTypes, r.ContentType)
+	d.mu.Unlock()
+	return d.Driver.PutPayload(ctx, r)
+}
+
+func Test_blobs_are_stored_with_the_content_type_of_their_encoding(t *testing.T) {
+	payloads := []*common.Payload{
+		{Metadata: map[string][]byte{"encoding": []byte("json/plain")}},
+		{Metadata: map[string][]byte{"encoding": []byte("json/protobuf")}},
+		{Metadata: map[string][]byte{"encoding": []byte("binary/protobuf")}},
+		{Metadata: map[string][]byte{"encoding": []byte("binary/plain")}},
+		{Metadata: map[string][]byte{"encoding": []byte("binary/custom")}},
+		{},
+	}
+	for i, payload := range payloads {
+		payload.Data = []byte(fmt.Sprintf("this is a longer message number %d blah blah blah", i))
+	}
+	want := []string{"application/json", "application/json", "application/x-protobuf", "application/octet-stream", "", ""}
+
+	t.Run("HTTP", func(t *testing.T) {
+		driver := &contentTypeRecorder{}
+		s := httptest.NewServer(server.NewHttpHandler(driver))
+		defer s.Close()
+		c, err := New(WithURL(s.URL), WithHTTPClient(s.Client()), WithNamespace("test"), WithMinBytes(32))
+		require.NoError(t, err)
+
+		for _, payload := range payloads {
+			_, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+		}
+		require.Equal(t, want, driver.contentTypes)
+	})
+
+	t.Run("Driver", func(t *testing.T) {
+		driver := &contentTypeRecorder{}
+		c, err := New(WithTransport(NewDriverTransport(driver)), WithNamespace("test"), WithMinBytes(32))
+		require.NoError(t, err)
+
+		for _, payload := range payloads {
+			_, err := c.Encode([]*common.Payload{payload})
+			require.NoError(t, err)
+		}
+		require.Equal(t, want, driver.contentTypes)
+	})
+}
@@ -0,0 +1,42 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codec
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+const (
+	modulePath = "github.com/DataDog/temporal-large-payload-codec/codec"
+	// develVersion is reported if the version of the codec module cannot be determined.
+	develVersion = "(devel)"
+)
+
+// defaultUserAgent identifies the codec and its version in requests sent to LargePayloadService.
+var defaultUserAgent = "temporal-large-payload-codec/" + moduleVersion() + " go/" + runtime.Version()
+
+// moduleVersion returns the version of the codec module the running binary was built with.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return develVersion
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != modulePath {
+			continue
+		}
+		if dep.Replace != nil && dep.Replace.Version != "" {
+			return dep.Replace.Version
+		}
+		if dep.Version != "" {
+			return dep.Version
+		}
+	}
+	return develVersion
+}
@@ -0,0 +1,214 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.temporal.io/sdk/client"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/internal/response"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+)
+
+const (
+	// DefaultAuditQueueSize is the number of audit entries waiting to be logged beyond which
+	// further entries are dropped.
+	DefaultAuditQueueSize = 10000
+
+	// metricAuditEntriesDroppedTotal is the number of audit entries dropped because the
+	// queue was full.
+	metricAuditEntriesDroppedTotal = "lps_audit_entries_dropped_total"
+
+	// auditRedacted replaces the values of the fields redacted by RedactAuditFields.
+	auditRedacted = "redacted"
+)
+
+// AuditFieldFilter is called with each field of the audit entries, see WithAuditFieldFilter.
+// It returns the value to log, or false to omit the field.
+type AuditFieldFilter func(field string, value interface{}) (interface{}, bool)
+
+// SetPrincipal records the principal which sent r in its audit entries, e.g. the name of the
+// client identified by an Authorizer or a middleware. It does nothing unless WithAuditLogger
+// is passed.
+var SetPrincipal = v2.SetPrincipal
+
+// WithAuditLogger logs an entry with logger for each access of a request to a blob, e.g. to
+// a dedicated file separate from the logs of the server, see WithLogger. Entries hold the
+// fields time, principal, operation, namespace, key, bytes and status, and requestId if
+// request IDs are assigned.
+//
+// The principal is set by authorizers with SetPrincipal, BearerTokenAuthorizer setting the
+// fingerprint of the token. The bytes are the size of the request body for puts and of the
+// response body otherwise, which is shared by the blobs of batches. Accesses rejected by the
+// authorizer are logged with its status code, and requests rejected before their access is
+// checked, e.g. for invalid parameters, are not logged.
+//
+// Entries are logged from a goroutine, so that slow loggers do not delay requests. Entries
+// sent while DefaultAuditQueueSize entries wait are dropped, and counted by the metrics
+// handler set with WithMetricsHandler as lps_audit_entries_dropped_total. Server.Shutdown
+// waits for the queued entries to be logged. Calls to the gRPC API of the server/grpc package
+// are not logged.
+func WithAuditLogger(logger logging.Logger) Option {
+	return applier(func(o *options) {
+		o.auditLogger = logger
+	})
+}
+
+// WithAuditFieldFilter sets a filter called with each field of the entries logged by the
+// audit logger, see WithAuditLogger, e.g. to redact keys. Fields are not filtered by default.
+func WithAuditFieldFilter(filter AuditFieldFilter) Option {
+	return applier(func(o *options) {
+		o.auditFieldFilter = filter
+	})
+}
+
+// RedactAuditFields returns an AuditFieldFilter replacing the values of the given fields.
+func RedactAuditFields(fields ...string) AuditFieldFilter {
+	redacted := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		redacted[field] = true
+	}
+	return func(field string, value interface{}) (interface{}, bool) {
+		if redacted[field] {
+			return auditRedacted, true
+		}
+		return value, true
+	}
+}
+
+// auditLog logs the audit entries sent to it from its own goroutine.
+type auditLog struct {
+	entries        chan auditEntry
+	metricsHandler client.MetricsHandler
+}
+
+// auditEntry is the key-value pairs of an entry, or a request to be notified once the
+// preceding entries are logged.
+type auditEntry struct {
+	keyvals []interface{}
+	flushed chan struct{}
+}
+
+// newAuditLog returns the audit log configured by o, or nil if there is no audit logger.
+func newAuditLog(o *options) *auditLog {
+	if o.auditLogger == nil {
+		return nil
+	}
+	a := &auditLog{entries: make(chan auditEntry, DefaultAuditQueueSize), metricsHandler: o.metricsHandler}
+	if a.metricsHandler == nil {
+		a.metricsHandler = client.MetricsNopHandler
+	}
+	logger, filter := o.auditLogger, o.auditFieldFilter
+	go func() {
+		for entry := range a.entries {
+			if entry.flushed != nil {
+				close(entry.flushed)
+				continue
+			}
+			logger.Info("audit", filterAuditFields(entry.keyvals, filter)...)
+		}
+	}()
+	return a
+}
+
+// filterAuditFields returns the key-value pairs kept by filter, which may be nil.
+func filterAuditFields(keyvals []interface{}, filter AuditFieldFilter) []interface{} {
+	if filter == nil {
+		return keyvals
+	}
+	filtered := keyvals[:0]
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if value, ok := filter(keyvals[i].(string), keyvals[i+1]); ok {
+			filtered = append(filtered, keyvals[i], value)
+		}
+	}
+	return filtered
+}
+
+// log queues an entry unless the queue is full.
+func (a *auditLog) log(keyvals []interface{}) {
+	select {
+	case a.entries <- auditEntry{keyvals: keyvals}:
+	default:
+		a.metricsHandler.Counter(metricAuditEntriesDroppedTotal).Inc(1)
+	}
+}
+
+// flush waits until the entries queued so far are logged or ctx is done. It does nothing if a
+// is nil.
+func (a *auditLog) flush(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	flushed := make(chan struct{})
+	select {
+	case a.entries <- auditEntry{flushed: flushed}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// auditRequests returns a middleware logging the accesses to blobs of the requests passed to
+// next with a.
+func auditRequests(a *auditLog) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			record := &v2.AuditRecord{}
+			rw := response.Wrap(w)
+			body := &countingReader{r: r.Body}
+			if r.Body != nil {
+				r.Body = body
+			}
+
+			next.ServeHTTP(rw, r.WithContext(v2.ContextWithAuditRecord(r.Context(), record)))
+
+			accesses := record.Accesses()
+			if len(accesses) == 0 {
+				return
+			}
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			principal := record.Principal()
+			requestID := v2.RequestIDFromContext(r.Context())
+			status := rw.Status()
+			if status == 0 {
+				// handlers which write nothing implicitly respond with 200
+				status = http.StatusOK
+			}
+			for _, access := range accesses {
+				bytes := rw.BytesWritten()
+				if access.Operation == v2.OperationPut {
+					bytes = body.n
+				}
+				entryStatus := status
+				if access.Status != 0 {
+					entryStatus = access.Status
+				}
+				keyvals := []interface{}{
+					"time", now,
+					"principal", principal,
+					"operation", string(access.Operation),
+					"namespace", access.Namespace,
+					"key", access.Key,
+					"bytes", bytes,
+					"status", entryStatus,
+				}
+				if requestID != "" {
+					keyvals = append(keyvals, "requestId", requestID)
+				}
+				a.log(keyvals)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/client"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+func TestWithAuditLogger(t *testing.T) {
+	data := []byte("hello world")
+	principal := TokenFingerprint("secret")
+	otherKey := "/blobs/other/common/sha256:12345/sha256:abcd"
+	testCases := []struct {
+		name        string
+		opts        []Option
+		wantEntries func(key string) []map[string]interface{}
+	}{
+		{
+			name: "Logged",
+			wantEntries: func(key string) []map[string]interface{} {
+				return []map[string]interface{}{
+					{"principal": principal, "operation": "put", "namespace": "test", "key": key, "bytes": int64(len(data)), "status": http.StatusCreated},
+					{"principal": principal, "operation": "get", "namespace": "test", "key": key, "bytes": int64(len(data)), "status": http.StatusOK},
+					{"principal": "", "operation": "get", "namespace": "test", "key": key, "bytes": int64(76), "status": http.StatusUnauthorized},
+					{"principal": principal, "operation": "get", "namespace": "test", "key": key, "bytes": int64(784), "status": http.StatusOK},
+					{"principal": principal, "operation": "get", "namespace": "other", "key": otherKey, "bytes": int64(784), "status": http.StatusOK},
+				}
+			},
+		},
+		{
+			name: "Redacted",
+			opts: []Option{WithAuditFieldFilter(RedactAuditFields("key"))},
+			wantEntries: func(key string) []map[string]interface{} {
+				return []map[string]interface{}{
+					{"principal": principal, "operation": "put", "namespace": "test", "key": "redacted", "bytes": int64(len(data)), "status": http.StatusCreated},
+					{"principal": principal, "operation": "get", "namespace": "test", "key": "redacted", "bytes": int64(len(data)), "status": http.StatusOK},
+					{"principal": "", "operation": "get", "namespace": "test", "key": "redacted", "bytes": int64(76), "status": http.StatusUnauthorized},
+					{"principal": principal, "operation": "get", "namespace": "test", "key": "redacted", "bytes": int64(784), "status": http.StatusOK},
+					{"principal": principal, "operation": "get", "namespace": "other", "key": "redacted", "bytes": int64(784), "status": http.StatusOK},
+				}
+			},
+		},
+		{
+			name: "Omitted",
+			opts: []Option{WithAuditFieldFilter(func(field string, value interface{}) (interface{}, bool) {
+				return value, field == "operation" || field == "status"
+			})},
+			wantEntries: func(string) []map[string]interface{} {
+				return []map[string]interface{}{
+					{"operation": "put", "status": http.StatusCreated},
+					{"operation": "get", "status": http.StatusOK},
+					{"operation": "get", "status": http.StatusUnauthorized},
+					{"operation": "get", "status": http.StatusOK},
+					{"operation": "get", "status": http.StatusOK},
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			o := newOptions(append([]Option{WithAuditLogger(logger), WithAuthorizer(BearerTokenAuthorizer("secret"))}, tc.opts...))
+			audit := newAuditLog(&o)
+			handler := newHandler(&memory.Driver{}, o, audit)
+			serve := func(request *http.Request, authorized bool) *httptest.ResponseRecorder {
+				if authorized {
+					request.Header.Set("Authorization", "Bearer secret")
+				}
+				responseRecorder := httptest.NewRecorder()
+				handler.ServeHTTP(responseRecorder, request)
+				return responseRecorder
+			}
+
+			responseRecorder := serve(newPutRequestV2(data, len(data)), true)
+			require.Equal(t, http.StatusCreated, responseRecorder.Code, responseRecorder.Body.String())
+			var response struct{ Key string }
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+			key := response.Key
+
+			get := "/v2/blobs/get?key=" + url.QueryEscape(key)
+			require.Equal(t, http.StatusOK, serve(httptest.NewRequest(http.MethodGet, get, nil), true).Code)
+			require.Equal(t, http.StatusUnauthorized, serve(httptest.NewRequest(http.MethodGet, get, nil), false).Code)
+			// requests rejected before accessing a blob are not logged
+			require.Equal(t, http.StatusBadRequest, serve(httptest.NewRequest(http.MethodGet, "/v2/blobs/get", nil), true).Code)
+			require.Equal(t, http.StatusOK, serve(httptest.NewRequest(http.MethodGet, "/v2/limits", nil), true).Code)
+			// batches log an entry per blob
+			batch, err := json.Marshal(map[string][]string{"keys": {key, otherKey}})
+			require.NoError(t, err)
+			request := httptest.NewRequest(http.MethodPost, "/v2/blobs/get-batch", bytes.NewReader(batch))
+			request.Header.Set("Content-Type", "application/json")
+			require.Equal(t, http.StatusOK, serve(request, true).Code)
+
+			require.NoError(t, audit.flush(context.Background()))
+			logger.mu.Lock()
+			defer logger.mu.Unlock()
+			var entries []map[string]interface{}
+			for _, line := range logger.lines {
+				assert.Equal(t, "audit", line["msg"])
+				delete(line, "msg")
+				if _, ok := line["time"]; !ok && tc.name != "Omitted" {
+					assert.Fail(t, "entry without time", "%v", line)
+				}
+				delete(line, "time")
+				entries = append(entries, line)
+			}
+			assert.Equal(t, tc.wantEntries(key), entries)
+		})
+	}
+}
+
+// blockingLogger is a logger whose first entry blocks until release is closed, after
+// signaling that it started by closing started.
+type blockingLogger struct {
+	logging.NoopLogger
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (l *blockingLogger) Info(string, ...interface{}) {
+	l.once.Do(func() {
+		close(l.started)
+		<-l.release
+	})
+}
+
+func TestAuditLogDropsEntries(t *testing.T) {
+	logger := &blockingLogger{started: make(chan struct{}), release: make(chan struct{})}
+	metrics := &counterMetricsHandler{MetricsHandler: client.MetricsNopHandler, mu: &sync.Mutex{}, counters: map[string]int64{}}
+	audit := newAuditLog(&options{auditLogger: logger, metricsHandler: metrics})
+
+	audit.log([]interface{}{"key", "first"})
+	<-logger.started
+	// the logger is blocked on the first entry, so one more than the queue holds is dropped
+	for i := 0; i <= DefaultAuditQueueSize; i++ {
+		audit.log([]interface{}{"key", "next"})
+	}
+	close(logger.release)
+	require.NoError(t, audit.flush(context.Background()))
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.Equal(t, map[string]int64{"lps_audit_entries_dropped_total{}": 1}, metrics.counters)
+}
@@ -0,0 +1,142 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+)
+
+// Operation is the kind of access to a blob requested from the handler, see Authorizer.
+type Operation = v2.Operation
+
+const (
+	// OperationPut stores a blob, including presigned uploads.
+	OperationPut = v2.OperationPut
+	// OperationGet retrieves a blob, including batches and presigned downloads.
+	OperationGet = v2.OperationGet
+	// OperationHead checks whether a blob exists.
+	OperationHead = v2.OperationHead
+	// OperationDelete removes a blob.
+	OperationDelete = v2.OperationDelete
+	// OperationList lists the blobs of a namespace, the key being the listed key prefix.
+	OperationList = v2.OperationList
+	// OperationDeleteByPrefix removes all blobs of a namespace whose keys start with a prefix,
+	// the key being the prefix.
+	OperationDeleteByPrefix = v2.OperationDeleteByPrefix
+)
+
+// Authorizer decides whether a request may access a blob, see WithAuthorizer.
+type Authorizer = v2.Authorizer
+
+// ErrUnauthenticated is wrapped by the errors of an Authorizer for requests without valid
+// credentials, which are rejected with the HTTP response status code 401 instead of 403.
+var ErrUnauthenticated = v2.ErrUnauthenticated
+
+const (
+	// HMACSignatureHeader is the header carrying the signature checked by HMACAuthorizer.
+	HMACSignatureHeader = "X-LPS-Signature"
+	// HMACTimestampHeader is the header carrying the Unix time in seconds at which a request
+	// was signed for HMACAuthorizer.
+	HMACTimestampHeader = "X-LPS-Timestamp"
+)
+
+// WithAuthorizer sets an Authorizer which is called with the operation, namespace and key of
+// each request before the storage driver is accessed. Requests it returns an error for are
+// rejected with the HTTP response status code 403, or 401 if the error wraps
+// ErrUnauthenticated. The health check and limits endpoints are not authorized.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return applier(func(o *options) {
+		o.authorizer = authorizer
+	})
+}
+
+// ChainAuthorizers returns an Authorizer which accepts requests accepted by all the given
+// authorizers, e.g. to check a credential and then restrict the namespaces it grants access to.
+func ChainAuthorizers(authorizers ...Authorizer) Authorizer {
+	return func(r *http.Request, op Operation, namespace, key string) error {
+		for _, authorizer := range authorizers {
+			if err := authorizer(r, op, namespace, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// BearerTokenAuthorizer returns an Authorizer which accepts requests with one of the given
+// tokens in the Authorization header, as sent by codecs configured with WithBearerToken. The
+// principal of accepted requests is the fingerprint of their token, see TokenFingerprint.
+func BearerTokenAuthorizer(tokens ...string) Authorizer {
+	return func(r *http.Request, _ Operation, _, _ string) error {
+		authorization := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token == authorization || token == "" {
+			return fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+		}
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				SetPrincipal(r, TokenFingerprint(token))
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: invalid bearer token", ErrUnauthenticated)
+	}
+}
+
+// TokenFingerprint returns the identifier of a bearer token in audit entries, which is
+// token: followed by the first 16 hex digits of its SHA-256 checksum, so that tokens can be
+// told apart without logging them.
+func TokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:8])
+}
+
+// HMACAuthorizer returns an Authorizer which accepts requests signed by SignHMAC with the
+// given secret less than maxAge ago. The signature covers the method and the URI of the
+// request, so requests must not be rewritten by proxies in front of the server.
+func HMACAuthorizer(secret []byte, maxAge time.Duration) Authorizer {
+	return func(r *http.Request, _ Operation, _, _ string) error {
+		signature, err := hex.DecodeString(r.Header.Get(HMACSignatureHeader))
+		if err != nil || len(signature) == 0 {
+			return fmt.Errorf("%w: missing or invalid %s header", ErrUnauthenticated, HMACSignatureHeader)
+		}
+		timestamp, err := strconv.ParseInt(r.Header.Get(HMACTimestampHeader), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: missing or invalid %s header", ErrUnauthenticated, HMACTimestampHeader)
+		}
+		if age := time.Since(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+			return fmt.Errorf("%w: signature expired", ErrUnauthenticated)
+		}
+		if !hmac.Equal(signature, hmacSignature(secret, r, timestamp)) {
+			return fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+		}
+		return nil
+	}
+}
+
+// SignHMAC signs r with secret at the given time for HMACAuthorizer, e.g. in a
+// http.RoundTripper passed to the codec with WithHTTPRoundTripper.
+func SignHMAC(r *http.Request, secret []byte, now time.Time) {
+	timestamp := now.Unix()
+	r.Header.Set(HMACTimestampHeader, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(HMACSignatureHeader, hex.EncodeToString(hmacSignature(secret, r, timestamp)))
+}
+
+// hmacSignature returns the HMAC-SHA256 of the timestamp, method and URI of r.
+func hmacSignature(secret []byte, r *http.Request, timestamp int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "%d\n%s\n%s", timestamp, r.Method, r.URL.RequestURI())
+	return mac.Sum(nil)
+}
@@ -0,0 +1,201 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+// authorizedCall is a call of an Authorizer.
+type authorizedCall struct {
+	op        Operation
+	namespace string
+	key       string
+}
+
+func TestWithAuthorizer(t *testing.T) {
+	var calls []authorizedCall
+	handler := NewHttpHandlerWithOptions(&memory.Driver{}, WithAuthorizer(ChainAuthorizers(
+		BearerTokenAuthorizer("secret"),
+		func(r *http.Request, op Operation, namespace, key string) error {
+			calls = append(calls, authorizedCall{op, namespace, key})
+			if namespace != "test" {
+				return fmt.Errorf("access to namespace '%s' denied", namespace)
+			}
+			return nil
+		},
+	)))
+	serve := func(request *http.Request, token string) *httptest.ResponseRecorder {
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	data := []byte("hello world")
+	response := serve(newPutRequestV2(data, len(data)), "")
+	require.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeUnauthenticated, "unauthenticated: missing bearer token"), response.Body.String())
+	response = serve(newPutRequestV2(data, len(data)), "wrong")
+	require.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeUnauthenticated, "unauthenticated: invalid bearer token"), response.Body.String())
+	assert.Empty(t, calls)
+
+	response = serve(newPutRequestV2(data, len(data)), "secret")
+	require.Equal(t, http.StatusCreated, response.Code, response.Body.String())
+	var putResponse storage.PutResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &putResponse))
+	key := putResponse.Key
+
+	request := newPutRequestV2(data, len(data))
+	q := request.URL.Query()
+	q.Set("namespace", "other")
+	request.URL.RawQuery = q.Encode()
+	response = serve(request, "secret")
+	require.Equal(t, http.StatusForbidden, response.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeForbidden, "access to namespace 'other' denied"), response.Body.String())
+
+	response = serve(httptest.NewRequest(http.MethodHead, "/v2/blobs/head?key="+url.QueryEscape(key), nil), "secret")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	request = httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+url.QueryEscape(key), nil)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response = serve(request, "secret")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, data, response.Body.Bytes())
+
+	otherKey := strings.Replace(key, "/test/", "/other/", 1)
+	request = httptest.NewRequest(http.MethodPost, "/v2/blobs/get-batch", strings.NewReader(fmt.Sprintf(`{"keys":[%q,%q]}`, key, otherKey)))
+	request.Header.Set("Content-Type", "application/json")
+	response = serve(request, "secret")
+	require.Equal(t, http.StatusOK, response.Code)
+	_, params, err := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	require.NoError(t, err)
+	mr := multipart.NewReader(response.Body, params["boundary"])
+	var statuses []string
+	for {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		statuses = append(statuses, p.Header.Get("X-Payload-Status"))
+	}
+	assert.Equal(t, []string{"200", "403"}, statuses)
+
+	response = serve(httptest.NewRequest(http.MethodDelete, "/v2/blobs/delete?key="+url.QueryEscape(otherKey), nil), "secret")
+	require.Equal(t, http.StatusForbidden, response.Code)
+	response = serve(httptest.NewRequest(http.MethodDelete, "/v2/blobs/delete?key="+url.QueryEscape(key), nil), "secret")
+	require.Equal(t, http.StatusNoContent, response.Code)
+
+	assert.Equal(t, []authorizedCall{
+		{OperationPut, "test", key},
+		{OperationPut, "other", otherKey},
+		{OperationHead, "test", key},
+		{OperationGet, "test", key},
+		{OperationGet, "test", key},
+		{OperationGet, "other", otherKey},
+		{OperationDelete, "other", otherKey},
+		{OperationDelete, "test", key},
+	}, calls)
+
+	// health checks and limits are not authorized
+	response = serve(httptest.NewRequest(http.MethodHead, "/v2/health/head", nil), "")
+	require.Equal(t, http.StatusOK, response.Code)
+	response = serve(httptest.NewRequest(http.MethodGet, "/v2/limits", nil), "")
+	require.Equal(t, http.StatusOK, response.Code)
+}
+
+func TestHMACAuthorizer(t *testing.T) {
+	secret := []byte("secret")
+	authorizer := HMACAuthorizer(secret, time.Minute)
+	newRequest := func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key=%2Fblobs%2Ftest", nil)
+	}
+
+	testCase := []struct {
+		name    string
+		sign    func(r *http.Request)
+		wantErr string
+	}{
+		{
+			name: "Valid signature",
+			sign: func(r *http.Request) { SignHMAC(r, secret, time.Now()) },
+		},
+		{
+			name:    "Missing signature",
+			sign:    func(r *http.Request) {},
+			wantErr: "unauthenticated: missing or invalid X-LPS-Signature header",
+		},
+		{
+			name:    "Wrong secret",
+			sign:    func(r *http.Request) { SignHMAC(r, []byte("other"), time.Now()) },
+			wantErr: "unauthenticated: invalid signature",
+		},
+		{
+			name:    "Expired signature",
+			sign:    func(r *http.Request) { SignHMAC(r, secret, time.Now().Add(-2*time.Minute)) },
+			wantErr: "unauthenticated: signature expired",
+		},
+		{
+			name: "Tampered request",
+			sign: func(r *http.Request) {
+				SignHMAC(r, secret, time.Now())
+				r.URL.RawQuery = "key=%2Fblobs%2Fother"
+			},
+			wantErr: "unauthenticated: invalid signature",
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			request := newRequest()
+			scenario.sign(request)
+			err := authorizer(request, OperationGet, "test", "/blobs/test")
+			if scenario.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, scenario.wantErr)
+				require.ErrorIs(t, err, ErrUnauthenticated)
+			}
+		})
+	}
+
+	// requests signed by clients are accepted by the server
+	s := httptest.NewServer(NewHttpHandlerWithOptions(&memory.Driver{}, WithAuthorizer(authorizer)))
+	defer s.Close()
+	request, err := http.NewRequest(http.MethodHead, s.URL+"/v2/blobs/head?key=%2Fblobs%2Ftest%2Fcommon%2Fsha256%3A1234%2Fsha256%3Aabcd", bytes.NewReader(nil))
+	require.NoError(t, err)
+	resp, err := s.Client().Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	SignHMAC(request, secret, time.Now())
+	resp, err = s.Client().Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -6,40 +6,130 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/DataDog/temporal-large-payload-codec/codec"
 	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/codecserver"
+	lpsgrpc "github.com/DataDog/temporal-large-payload-codec/server/grpc"
+	"github.com/DataDog/temporal-large-payload-codec/server/grpc/lpspb"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
 	"github.com/DataDog/temporal-large-payload-codec/server/logging"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/azure"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/gcs"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/router"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/s3"
+	"github.com/DataDog/temporal-large-payload-codec/server/sweeper"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 var (
-	logger = logging.NewBuiltinLogger()
+	logger logging.Logger = logging.NewBuiltinLogger()
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == migrateV1Command {
+		if err := runMigrateV1(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	driverName := flag.String("driver", "memory", "name of the storage driver [memory|s3]")
+	namespaceDrivers := flag.String("namespace-drivers", "", "JSON file mapping namespaces whose blobs are stored with another driver than --driver to its configuration, e.g. {\"team-eu\": {\"driver\": \"s3\", \"bucket\": \"payloads-eu\", \"region\": \"eu-west-1\"}}")
 	port := flag.Int("port", 8577, "server port")
+	grpcPort := flag.Int("grpc-port", 0, "port of the gRPC API, which is not served if 0, and cannot be used with --namespace-quota, --namespace-blob-ttl, --audit-log or --event-webhook-url")
+	grpcTLSCert := flag.String("grpc-tls-cert", "", "PEM certificate file with which the gRPC API is served over TLS, together with --grpc-tls-key")
+	grpcTLSKey := flag.String("grpc-tls-key", "", "PEM private key file of --grpc-tls-cert")
+	grpcTLSClientCA := flag.String("grpc-tls-client-ca", "", "PEM file of the CA certificates verifying the certificates which gRPC clients must present (mTLS)")
+	h2cEnabled := flag.Bool("h2c", false, "accept HTTP/2 without TLS from clients with prior knowledge, e.g. behind a proxy terminating TLS, in addition to HTTP/1.1")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "period for which requests being served may complete when the server is shut down")
+	logFormat := flag.String("log-format", "text", "format of the logs [text|json]")
+	logRequests := flag.Bool("log-requests", false, "log each request with its status code, size and duration")
+	basePath := flag.String("base-path", "", "path prefix under which the endpoints are served, e.g. /lps")
+	requestIDs := flag.Bool("request-ids", false, "assign an ID to each request, taken from its X-Request-ID header if set, which is echoed in responses and logged")
+	readinessCacheTTL := flag.Duration("readiness-cache-ttl", v2.DefaultReadinessCacheTTL, "period for which readiness checks of the storage are reused")
+	idempotencyTTL := flag.Duration("idempotency-ttl", v2.DefaultIdempotencyTTL, "period for which the responses of uploads with an Idempotency-Key header are recorded")
+	uploadSessionTTL := flag.Duration("upload-session-ttl", v2.DefaultUploadSessionTTL, "period of inactivity after which upload sessions expire")
+	maxUploadBytes := flag.Uint64("max-upload-bytes", v2.DefaultMaxUploadBytes, "maximum size in bytes of a blob uploaded in parts with an upload session")
+	presignExpiry := flag.Duration("presign-expiry", v2.DefaultPresignExpiry, "period for which presigned URLs are valid, at most 168h")
+	blobListing := flag.Bool("blob-listing", false, "enable the /v2/blobs/list endpoint listing the blobs of a namespace")
+	namespaceQuota := flag.String("namespace-quota", "", "comma-separated maximum numbers of bytes stored by namespaces, e.g. team-a=1099511627776")
+	namespaceBlobTTL := flag.String("namespace-blob-ttl", "", "comma-separated periods after which the blobs of namespaces expire, e.g. team-a=720h,team-b=2160h")
+	sweepInterval := flag.Duration("sweep-interval", 0, "period between two deletions of expired blobs, which are not deleted if 0")
+	namespaceScopedKeys := flag.Bool("namespace-scoped-keys", false, "require requests for a blob key to set the namespace query parameter to the namespace of the key")
+	skipDigestVerification := flag.Bool("skip-digest-verification", false, "do not verify the digest of the blobs sent by /v2/blobs/get")
+	verifyExisting := flag.Bool("verify-existing", false, "reject uploads whose key holds a blob with a different digest or metadata")
+	skipExistCheck := flag.Bool("skip-exist-check", false, "store uploaded blobs without checking whether they exist")
+	auditLog := flag.String("audit-log", "", "file to which an entry is appended as JSON for each access to a blob, recording its principal, operation, key, size and status")
+	auditRedactFields := flag.String("audit-redact-fields", "", "comma-separated fields whose values are redacted from the audit log, e.g. key,principal")
+	eventWebhookURL := flag.String("event-webhook-url", "", "URL to which an event is posted as JSON for each blob stored or deleted")
+	disableCompression := flag.Bool("disable-compression", false, "do not compress the blobs sent by /v2/blobs/get")
+	compressibleEncodings := flag.String("compressible-encodings", "", "comma-separated payload encodings whose blobs are compressed in addition to json/plain and json/protobuf")
+	corsAllowedOrigins := flag.String("cors-allowed-origins", "", "comma-separated origins from which browsers may send requests, or * for all origins")
+	corsAllowedHeaders := flag.String("cors-allowed-headers", "", "comma-separated request headers which browsers may send in addition to the ones of the API, e.g. Authorization")
+	maxConcurrentRequests := flag.Int("max-concurrent-requests", 0, "maximum number of requests served at once, further ones being rejected with 503, unlimited if 0")
+	maxConcurrentGets := flag.Int("max-concurrent-gets", 0, "maximum number of requests getting blobs served at once, unlimited if 0")
+	maxConcurrentPuts := flag.Int("max-concurrent-puts", 0, "maximum number of requests putting blobs served at once, unlimited if 0")
+	concurrencyWait := flag.Duration("concurrency-wait", 0, "period for which requests exceeding the concurrency limits wait before being rejected")
+	codecServer := flag.Bool("codec-server", false, "serve the remote codec server protocol of Temporal under /codec, so that the Temporal Web UI can decode payloads with the /codec/decode endpoint, which cannot be used with --namespace-quota, --namespace-blob-ttl, --audit-log or --event-webhook-url")
+	codecServerEncoding := flag.Bool("codec-server-encoding", false, "also serve the /codec/encode endpoint storing blobs in the namespace of its X-Namespace header")
+	plainTextErrors := flag.Bool("plain-text-errors", false, "send error messages as plain text instead of JSON (deprecated)")
+	maxBlobBytes, err := maxBlobBytesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	flag.Uint64Var(&maxBlobBytes, "max-blob-bytes", maxBlobBytes, "maximum size of a blob in bytes, also set by the MAX_BLOB_BYTES environment variable")
+	namespaceMaxBlobBytes, err := namespaceMaxBlobBytesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	flag.Parse()
+	if logger, err = newLogger(*logFormat); err != nil {
+		log.Fatal(err)
+	}
 
 	ctx := context.Background()
 	driver, err := createDriver(ctx, *driverName)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *namespaceDrivers != "" {
+		if driver, err = createRoutingDriver(ctx, driver, *namespaceDrivers); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	quotas, err := parseNamespaceQuota(*namespaceQuota)
+	if err != nil {
+		log.Fatal(err)
+	}
+	blobTTLs, err := parseNamespaceBlobTTL(*namespaceBlobTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	validatable, ok := driver.(storage.Validatable)
 	if ok {
@@ -49,17 +139,386 @@ func main() {
 		}
 	}
 
-	httpHandler := server.NewHttpHandlerWithLogger(driver, logger)
+	// the expired blobs deleted by the sweeper are credited back to the namespace quotas
+	deletions := &server.Deletions{}
+	opts := []server.Option{
+		server.WithBasePath(*basePath),
+		server.WithLogger(logger),
+		server.WithMaxBlobBytes(maxBlobBytes),
+		server.WithNamespaceMaxBlobBytes(namespaceMaxBlobBytes),
+		server.WithReadinessCacheTTL(*readinessCacheTTL),
+		server.WithReadinessObserver(logReadiness),
+		server.WithUploadSessionTTL(*uploadSessionTTL),
+		server.WithIdempotencyTTL(*idempotencyTTL),
+		server.WithMaxUploadBytes(*maxUploadBytes),
+		server.WithPresignExpiry(*presignExpiry),
+		server.WithNamespaceBlobTTL(blobTTLs),
+		server.WithNamespaceQuota(quotas),
+		server.WithDeletions(deletions),
+		server.WithMaxConcurrentRequests(*maxConcurrentRequests),
+		server.WithMaxConcurrentGets(*maxConcurrentGets),
+		server.WithMaxConcurrentPuts(*maxConcurrentPuts),
+		server.WithConcurrencyWait(*concurrencyWait),
+	}
+	if *h2cEnabled {
+		opts = append(opts, server.WithH2C())
+	}
+	if *logRequests {
+		opts = append(opts, server.WithRequestLogging())
+	}
+	if *requestIDs {
+		opts = append(opts, server.WithRequestIDs())
+	}
+	if *blobListing {
+		opts = append(opts, server.WithBlobListing())
+	}
+	if *namespaceScopedKeys {
+		opts = append(opts, server.WithNamespaceScopedKeys())
+	}
+	if *skipDigestVerification {
+		opts = append(opts, server.WithoutDigestVerification())
+	}
+	if *verifyExisting {
+		opts = append(opts, server.WithVerifyExisting())
+	}
+	if *skipExistCheck {
+		opts = append(opts, server.WithSkipExistCheck())
+	}
+	if *auditLog != "" {
+		// the file is only appended to, so that existing entries are not overwritten
+		file, err := os.OpenFile(*auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		opts = append(opts, server.WithAuditLogger(logging.NewJSONLogger(file)))
+		if fields := splitList(*auditRedactFields); len(fields) > 0 {
+			opts = append(opts, server.WithAuditFieldFilter(server.RedactAuditFields(fields...)))
+		}
+	}
+	// the expired blobs deleted by the sweeper are sent to the same sink
+	var eventSink server.EventSink
+	if *eventWebhookURL != "" {
+		webhook := &server.WebhookSink{URL: *eventWebhookURL, Logger: logger}
+		eventSink = webhook.Send
+		opts = append(opts, server.WithEventSink(eventSink))
+	}
+	if *disableCompression {
+		opts = append(opts, server.WithoutCompression())
+	}
+	if encodings := splitList(*compressibleEncodings); len(encodings) > 0 {
+		opts = append(opts, server.WithCompressibleEncodings(encodings...))
+	}
+	if origins := splitList(*corsAllowedOrigins); len(origins) > 0 {
+		opts = append(opts, server.WithCORS(origins, splitList(*corsAllowedHeaders)))
+	}
+	if *plainTextErrors {
+		opts = append(opts, server.WithPlainTextErrors())
+	}
+	if *codecServer {
+		if err := checkPolicyFlags(flag.CommandLine, "codec-server"); err != nil {
+			log.Fatal(err)
+		}
+		handler, err := newCodecServer(*codecServerEncoding)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, server.WithCodecServer(handler))
+	}
+	httpServer := server.New(driver, opts...)
+
+	if *sweepInterval != 0 {
+		sweeperOpts := []sweeper.Option{
+			sweeper.WithInterval(*sweepInterval),
+			sweeper.WithLogger(logger),
+			sweeper.WithDeletionObserver(deletions.Deleted),
+		}
+		if eventSink != nil {
+			sweeperOpts = append(sweeperOpts, sweeper.WithEventSink(eventSink))
+		}
+		s, err := sweeper.New(driver, sweeperOpts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Info(fmt.Sprintf("deleting expired blobs every %v", *sweepInterval))
+		go s.Run(ctx)
+	}
 
-	logger.Info(fmt.Sprintf("starting server on port %d", *port))
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), httpHandler); err != nil {
+	if *grpcPort != 0 {
+		// the gRPC API does not enforce the policies
+		if err := checkPolicyFlags(flag.CommandLine, "grpc-port"); err != nil {
+			log.Fatal(err)
+		}
+		creds, err := grpcCredentials(*grpcTLSCert, *grpcTLSKey, *grpcTLSClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *grpcPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcServer := newGRPCServer(driver, creds,
+			lpsgrpc.WithLogger(logger),
+			lpsgrpc.WithMaxBlobBytes(maxBlobBytes),
+			lpsgrpc.WithNamespaceMaxBlobBytes(namespaceMaxBlobBytes),
+		)
+		logger.Info(fmt.Sprintf("starting gRPC server on port %d", *grpcPort))
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// requests being served complete before the server exits, Start returning once shutdown begins
+	signals, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-signals.Done()
+		logger.Info("shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(ctx, *shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("unable to shut down server gracefully", "error", err)
+		}
+	}()
+
+	logger.Info(fmt.Sprintf("starting server on port %d with a max blob size of %d bytes", *port, maxBlobBytes))
+	if err := httpServer.Start(fmt.Sprintf(":%d", *port)); err != nil {
 		log.Fatal(err)
 	}
+	<-shutdown
+}
+
+// newCodecServer returns the handler of the remote codec server protocol of Temporal, whose
+// codec reads and stores blobs with the v2 API of the server, see server.CodecServerTransport.
+// Blobs encoded without X-Namespace header are stored in the namespace "default" of Temporal.
+func newCodecServer(encoding bool) (http.Handler, error) {
+	c, err := codec.New(
+		codec.WithURL(server.CodecServerURL),
+		codec.WithHTTPClient(&http.Client{Transport: server.CodecServerTransport{}}),
+		codec.WithoutUrlHealthCheck(),
+		codec.WithNamespace("default"),
+		codec.WithNamespaceProvider(codecserver.Namespace),
+		codec.WithLogger(logger),
+	)
+	if err != nil {
+		return nil, err
+	}
+	opts := []codecserver.Option{codecserver.WithLogger(logger)}
+	if !encoding {
+		opts = append(opts, codecserver.WithoutEncoding())
+	}
+	return codecserver.New(c, opts...), nil
 }
 
+// policyFlags are the flags of policies applying to the blobs stored through the v2 API.
+var policyFlags = []string{"namespace-quota", "namespace-blob-ttl", "audit-log", "event-webhook-url"}
+
+// checkPolicyFlags returns an error if one of policyFlags is set in flags, which cannot be
+// used with the given flag of an API they are not meant for.
+func checkPolicyFlags(flags *flag.FlagSet, api string) error {
+	for _, name := range policyFlags {
+		if f := flags.Lookup(name); f != nil && f.Value.String() != "" {
+			return errors.Errorf("--%s cannot be used with --%s", api, name)
+		}
+	}
+	return nil
+}
+
+// grpcCredentials returns the TLS credentials of the gRPC server loaded from the given PEM
+// files, requiring clients to present a certificate verified by clientCAFile if it is set, or
+// nil to serve the gRPC API without TLS if no certificate is set.
+func grpcCredentials(certFile, keyFile, clientCAFile string) (credentials.TransportCredentials, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("--grpc-tls-client-ca requires --grpc-tls-cert and --grpc-tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("--grpc-tls-cert and --grpc-tls-key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load the certificate of the gRPC API")
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in '%s'", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// newGRPCServer returns a gRPC server serving the gRPC API of the Large Payload Service and
+// the standard health service, over TLS if creds is set.
+func newGRPCServer(driver storage.Driver, creds credentials.TransportCredentials, opts ...lpsgrpc.Option) *grpc.Server {
+	var serverOpts []grpc.ServerOption
+	if creds != nil {
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+	}
+	s := grpc.NewServer(serverOpts...)
+	lpspb.RegisterLargePayloadServiceServer(s, lpsgrpc.NewServer(driver, opts...))
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	return s
+}
+
+// logReadiness logs the transitions of the readiness of the storage driver.
+func logReadiness(err error) {
+	if err != nil {
+		logger.Error("storage driver is not ready", "error", err)
+	} else {
+		logger.Info("storage driver is ready")
+	}
+}
+
+// newLogger returns the logger writing logs to stdout in the given format.
+func newLogger(format string) (logging.Logger, error) {
+	switch format {
+	case "text":
+		return logging.NewBuiltinLogger(), nil
+	case "json":
+		return logging.NewJSONLogger(os.Stdout), nil
+	default:
+		return nil, errors.Errorf("invalid log format '%s': must be text or json", format)
+	}
+}
+
+// maxBlobBytesFromEnv returns the maximum blob size set by the MAX_BLOB_BYTES environment
+// variable, or v2.DefaultMaxBlobBytes if it is not set.
+func maxBlobBytesFromEnv() (uint64, error) {
+	value, set := os.LookupEnv("MAX_BLOB_BYTES")
+	if !set || value == "" {
+		return v2.DefaultMaxBlobBytes, nil
+	}
+	maxBlobBytes, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || maxBlobBytes == 0 {
+		return 0, errors.Errorf("invalid MAX_BLOB_BYTES '%s': must be a positive number of bytes", value)
+	}
+	return maxBlobBytes, nil
+}
+
+// namespaceMaxBlobBytesFromEnv returns the maximum blob sizes of namespaces set by the
+// NAMESPACE_MAX_BLOB_BYTES environment variable, either as a JSON object such as
+// {"team-a":33554432} or as a comma-separated list such as team-a=33554432,team-b=536870912.
+func namespaceMaxBlobBytesFromEnv() (map[string]uint64, error) {
+	value := strings.TrimSpace(os.Getenv("NAMESPACE_MAX_BLOB_BYTES"))
+	if value == "" {
+		return nil, nil
+	}
+
+	limits := map[string]uint64{}
+	if strings.HasPrefix(value, "{") {
+		if err := json.Unmarshal([]byte(value), &limits); err != nil {
+			return nil, errors.Errorf("invalid NAMESPACE_MAX_BLOB_BYTES: %v", err)
+		}
+	} else {
+		for _, entry := range strings.Split(value, ",") {
+			namespace, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				return nil, errors.Errorf("invalid NAMESPACE_MAX_BLOB_BYTES entry '%s': must be namespace=bytes", entry)
+			}
+			maxBlobBytes, err := strconv.ParseUint(limit, 10, 64)
+			if err != nil {
+				return nil, errors.Errorf("invalid NAMESPACE_MAX_BLOB_BYTES entry '%s': must be namespace=bytes", entry)
+			}
+			limits[namespace] = maxBlobBytes
+		}
+	}
+	for namespace, limit := range limits {
+		if namespace == "" || limit == 0 {
+			return nil, errors.Errorf("invalid NAMESPACE_MAX_BLOB_BYTES: namespaces and positive sizes are required")
+		}
+	}
+	return limits, nil
+}
+
+// splitList returns the non-empty entries of a comma-separated list.
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// parseNamespaceBlobTTL returns the blob TTLs of namespaces set by the --namespace-blob-ttl
+// flag as a comma-separated list such as team-a=720h,team-b=2160h.
+func parseNamespaceBlobTTL(value string) (map[string]time.Duration, error) {
+	ttls := map[string]time.Duration{}
+	if strings.TrimSpace(value) == "" {
+		return ttls, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		namespace, period, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		ttl, err := time.ParseDuration(period)
+		if !ok || namespace == "" || err != nil || ttl <= 0 {
+			return nil, errors.Errorf("invalid --namespace-blob-ttl entry '%s': must be namespace=duration", entry)
+		}
+		ttls[namespace] = ttl
+	}
+	return ttls, nil
+}
+
+// parseNamespaceQuota returns the storage quotas of namespaces set by the --namespace-quota
+// flag as a comma-separated list such as team-a=1099511627776,team-b=10995116277760.
+func parseNamespaceQuota(value string) (map[string]uint64, error) {
+	quotas := map[string]uint64{}
+	for _, entry := range splitList(value) {
+		namespace, bytes, ok := strings.Cut(entry, "=")
+		quota, err := strconv.ParseUint(bytes, 10, 64)
+		if !ok || namespace == "" || err != nil || quota == 0 {
+			return nil, errors.Errorf("invalid --namespace-quota entry '%s': must be namespace=bytes", entry)
+		}
+		quotas[namespace] = quota
+	}
+	return quotas, nil
+}
+
+// createDriver returns the storage driver with the given name, configured by the environment.
 func createDriver(ctx context.Context, driverName string) (storage.Driver, error) {
+	return newDriver(ctx, driverConfig{Driver: driverName})
+}
+
+// driverConfig configures a storage driver. Settings which are not set are read from the
+// environment variables BUCKET, AWS_REGION and AZURE_STORAGE_ACCOUNT_NAME.
+type driverConfig struct {
+	// Driver is the name of the driver [memory|s3|gcs|azure].
+	Driver string `json:"driver"`
+	// Bucket is the bucket of the s3 and gcs drivers, or the container of the azure driver.
+	Bucket string `json:"bucket"`
+	// Region is the AWS region of the s3 driver.
+	Region string `json:"region"`
+	// StorageAccount is the storage account of the azure driver.
+	StorageAccount string `json:"storageAccount"`
+}
+
+// lookupSetting returns value, or the value of the environment variable env if it is empty.
+func lookupSetting(value string, env string) (string, bool) {
+	if value != "" {
+		return value, true
+	}
+	return os.LookupEnv(env)
+}
+
+// newDriver returns the storage driver configured by c.
+func newDriver(ctx context.Context, c driverConfig) (storage.Driver, error) {
 	var driver storage.Driver
 
+	driverName := c.Driver
 	normalizedDriverName := strings.ToLower(driverName)
 	switch normalizedDriverName {
 	case "memory":
@@ -67,11 +526,11 @@ func createDriver(ctx context.Context, driverName string) (storage.Driver, error
 		driver = &memory.Driver{}
 	case "s3":
 		logger.Info(fmt.Sprintf("creating %s driver", driverName))
-		region, set := os.LookupEnv("AWS_REGION")
+		region, set := lookupSetting(c.Region, "AWS_REGION")
 		if !set {
 			return nil, errors.New("AWS_REGION environment variable not set")
 		}
-		bucket, set := os.LookupEnv("BUCKET")
+		bucket, set := lookupSetting(c.Bucket, "BUCKET")
 		if !set {
 			return nil, errors.New("BUCKET environment variable not set")
 		}
@@ -87,7 +546,7 @@ func createDriver(ctx context.Context, driverName string) (storage.Driver, error
 		})
 	case "gcs":
 		log.Printf("creating %s driver", driverName)
-		bucket, set := os.LookupEnv("BUCKET")
+		bucket, set := lookupSetting(c.Bucket, "BUCKET")
 		if !set {
 			return nil, errors.New("BUCKET environment variable not set")
 		}
@@ -99,12 +558,12 @@ func createDriver(ctx context.Context, driverName string) (storage.Driver, error
 		}
 	case "azure":
 		log.Printf("creating %s driver", driverName)
-		bucket, set := os.LookupEnv("BUCKET")
+		bucket, set := lookupSetting(c.Bucket, "BUCKET")
 		if !set {
 			return nil, errors.New("BUCKET environment variable not set")
 		}
 
-		storageAccount, set := os.LookupEnv("AZURE_STORAGE_ACCOUNT_NAME")
+		storageAccount, set := lookupSetting(c.StorageAccount, "AZURE_STORAGE_ACCOUNT_NAME")
 		if !set {
 			return nil, errors.New("AZURE_STORAGE_ACCOUNT_NAME environment variable not set")
 		}
@@ -123,3 +582,34 @@ func createDriver(ctx context.Context, driverName string) (storage.Driver, error
 	}
 	return driver, nil
 }
+
+// createRoutingDriver returns a driver storing the blobs of the namespaces configured in the
+// JSON file at path with their own driver, and the blobs of other namespaces with
+// defaultDriver. The file maps namespaces to driver configurations, e.g.
+// {"team-eu": {"driver": "s3", "bucket": "payloads-eu", "region": "eu-west-1"}}.
+func createRoutingDriver(ctx context.Context, defaultDriver storage.Driver, path string) (storage.Driver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read --namespace-drivers")
+	}
+	defer f.Close()
+	var configs map[string]driverConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&configs); err != nil {
+		return nil, errors.Errorf("invalid --namespace-drivers %s: %v", path, err)
+	}
+
+	drivers := make(map[string]storage.Driver, len(configs))
+	for namespace, c := range configs {
+		if namespace == "" {
+			return nil, errors.Errorf("invalid --namespace-drivers %s: namespaces are required", path)
+		}
+		driver, err := newDriver(ctx, c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to create the driver of namespace '%s'", namespace)
+		}
+		drivers[namespace] = driver
+	}
+	return router.New(defaultDriver, drivers), nil
+}
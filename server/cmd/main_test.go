@@ -5,16 +5,41 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/gcs"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/router"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/s3"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 const (
@@ -122,6 +147,38 @@ func TestCreateDriver(t *testing.T) {
 	}
 }
 
+func TestCreateRoutingDriver(t *testing.T) {
+	writeConfig := func(config string) string {
+		path := filepath.Join(t.TempDir(), "drivers.json")
+		require.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+		return path
+	}
+	ctx := context.Background()
+	defaultDriver := &memory.Driver{}
+
+	driver, err := createRoutingDriver(ctx, defaultDriver, writeConfig(`{"team-eu": {"driver": "memory"}, "team-apac": {"driver": "s3", "bucket": "payloads-apac", "region": "ap-south-1"}}`))
+	require.NoError(t, err)
+	require.IsType(t, &router.Driver{}, driver)
+	description := driver.(storage.Describer).Describe()
+	require.Equal(t, map[string]string{
+		"default":             "memory",
+		"namespace:team-eu":   "memory",
+		"namespace:team-apac": "s3 bucket=payloads-apac",
+	}, description.Config)
+
+	for _, config := range []string{
+		`{"team-eu": {"driver": "snafu"}}`,
+		`{"team-eu": {"driver": "memory", "unknown": true}}`,
+		`{"": {"driver": "memory"}}`,
+		`["team-eu"]`,
+	} {
+		_, err := createRoutingDriver(ctx, defaultDriver, writeConfig(config))
+		require.Error(t, err, config)
+	}
+	_, err = createRoutingDriver(ctx, defaultDriver, filepath.Join(t.TempDir(), "missing.json"))
+	require.Error(t, err)
+}
+
 func envSetter(envs map[string]string) (closer func()) {
 	originalEnvs := map[string]string{}
 
@@ -143,3 +200,260 @@ func envSetter(envs map[string]string) (closer func()) {
 		}
 	}
 }
+
+func TestNewCodecServer(t *testing.T) {
+	post := func(handler http.Handler, path, body, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		request.Header.Set("X-Namespace", "test")
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+	newHandler := func(encoding bool) http.Handler {
+		codecServer, err := newCodecServer(encoding)
+		require.NoError(t, err)
+		return server.NewHttpHandlerWithOptions(&memory.Driver{}, server.WithCodecServer(codecServer), server.WithAuthorizer(server.BearerTokenAuthorizer("secret")))
+	}
+	small := `{"payloads":[{"data":"aGVsbG8="}]}`
+
+	handler := newHandler(false)
+	require.Equal(t, http.StatusOK, post(handler, "/codec/decode", small, "").Code)
+	require.Equal(t, http.StatusNotFound, post(handler, "/codec/encode", small, "secret").Code)
+
+	// blobs are stored and read through the API, so its authorizer applies
+	handler = newHandler(true)
+	large := fmt.Sprintf(`{"payloads":[{"data":"%s"}]}`, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("a"), 200_000)))
+	require.Equal(t, http.StatusInternalServerError, post(handler, "/codec/encode", large, "").Code)
+	encoded := post(handler, "/codec/encode", large, "secret")
+	require.Equal(t, http.StatusOK, encoded.Code, encoded.Body.String())
+	require.Equal(t, http.StatusInternalServerError, post(handler, "/codec/decode", encoded.Body.String(), "other").Code)
+	decoded := post(handler, "/codec/decode", encoded.Body.String(), "secret")
+	require.Equal(t, http.StatusOK, decoded.Code, decoded.Body.String())
+	require.JSONEq(t, large, decoded.Body.String())
+}
+
+func TestMaxBlobBytesFromEnv(t *testing.T) {
+	for _, scenario := range []struct {
+		description  string
+		value        string
+		maxBlobBytes uint64
+		expectError  bool
+	}{
+		{description: "unset", maxBlobBytes: v2.DefaultMaxBlobBytes},
+		{description: "valid", value: "67108864", maxBlobBytes: 64 << 20},
+		{description: "zero", value: "0", expectError: true},
+		{description: "invalid", value: "64MB", expectError: true},
+	} {
+		t.Run(scenario.description, func(t *testing.T) {
+			t.Setenv("MAX_BLOB_BYTES", scenario.value)
+
+			maxBlobBytes, err := maxBlobBytesFromEnv()
+			if scenario.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, scenario.maxBlobBytes, maxBlobBytes)
+			}
+		})
+	}
+}
+
+func TestNamespaceMaxBlobBytesFromEnv(t *testing.T) {
+	for _, scenario := range []struct {
+		description string
+		value       string
+		limits      map[string]uint64
+		expectError bool
+	}{
+		{description: "unset"},
+		{description: "JSON", value: `{"team-a":33554432,"team-b":536870912}`, limits: map[string]uint64{"team-a": 32 << 20, "team-b": 512 << 20}},
+		{description: "comma-separated", value: "team-a=33554432, team-b=536870912", limits: map[string]uint64{"team-a": 32 << 20, "team-b": 512 << 20}},
+		{description: "invalid JSON", value: `{"team-a":"32MB"}`, expectError: true},
+		{description: "missing size", value: "team-a", expectError: true},
+		{description: "invalid size", value: "team-a=32MB", expectError: true},
+		{description: "zero size", value: "team-a=0", expectError: true},
+		{description: "missing namespace", value: "=33554432", expectError: true},
+	} {
+		t.Run(scenario.description, func(t *testing.T) {
+			t.Setenv("NAMESPACE_MAX_BLOB_BYTES", scenario.value)
+
+			limits, err := namespaceMaxBlobBytesFromEnv()
+			if scenario.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, scenario.limits, limits)
+			}
+		})
+	}
+}
+
+func TestParseNamespaceBlobTTL(t *testing.T) {
+	for _, scenario := range []struct {
+		description string
+		value       string
+		ttls        map[string]time.Duration
+		expectError bool
+	}{
+		{description: "unset", ttls: map[string]time.Duration{}},
+		{description: "comma-separated", value: "team-a=720h, team-b=90m", ttls: map[string]time.Duration{"team-a": 720 * time.Hour, "team-b": 90 * time.Minute}},
+		{description: "missing period", value: "team-a", expectError: true},
+		{description: "invalid period", value: "team-a=30d", expectError: true},
+		{description: "zero period", value: "team-a=0s", expectError: true},
+		{description: "missing namespace", value: "=720h", expectError: true},
+	} {
+		t.Run(scenario.description, func(t *testing.T) {
+			ttls, err := parseNamespaceBlobTTL(scenario.value)
+			if scenario.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, scenario.ttls, ttls)
+			}
+		})
+	}
+}
+
+func TestParseNamespaceQuota(t *testing.T) {
+	for _, scenario := range []struct {
+		description string
+		value       string
+		quotas      map[string]uint64
+		expectError bool
+	}{
+		{description: "unset", quotas: map[string]uint64{}},
+		{description: "comma-separated", value: "team-a=1024, team-b=2048", quotas: map[string]uint64{"team-a": 1024, "team-b": 2048}},
+		{description: "missing size", value: "team-a", expectError: true},
+		{description: "invalid size", value: "team-a=1GB", expectError: true},
+		{description: "zero size", value: "team-a=0", expectError: true},
+		{description: "missing namespace", value: "=1024", expectError: true},
+	} {
+		t.Run(scenario.description, func(t *testing.T) {
+			quotas, err := parseNamespaceQuota(scenario.value)
+			if scenario.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, scenario.quotas, quotas)
+			}
+		})
+	}
+}
+
+func TestCheckPolicyFlags(t *testing.T) {
+	newFlags := func() *flag.FlagSet {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.String("namespace-quota", "", "")
+		flags.String("namespace-blob-ttl", "", "")
+		flags.String("audit-log", "", "")
+		flags.String("event-webhook-url", "", "")
+		flags.Bool("blob-listing", false, "")
+		return flags
+	}
+
+	flags := newFlags()
+	require.NoError(t, flags.Parse([]string{"-blob-listing"}))
+	require.NoError(t, checkPolicyFlags(flags, "grpc-port"))
+
+	flags = newFlags()
+	require.NoError(t, flags.Parse([]string{"-audit-log", "audit.log"}))
+	require.EqualError(t, checkPolicyFlags(flags, "codec-server"), "--codec-server cannot be used with --audit-log")
+}
+
+// writeCertificate writes a self-signed certificate for localhost, which is used by both the
+// server and the client, and its private key to PEM files, returning their paths.
+func writeCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestGRPCCredentials(t *testing.T) {
+	certFile, keyFile := writeCertificate(t)
+
+	creds, err := grpcCredentials("", "", "")
+	require.NoError(t, err)
+	require.Nil(t, creds)
+	_, err = grpcCredentials(certFile, "", "")
+	require.EqualError(t, err, "--grpc-tls-cert and --grpc-tls-key must be set together")
+	_, err = grpcCredentials("", "", certFile)
+	require.EqualError(t, err, "--grpc-tls-client-ca requires --grpc-tls-cert and --grpc-tls-key")
+	_, err = grpcCredentials(certFile, keyFile, keyFile)
+	require.EqualError(t, err, fmt.Sprintf("no certificate found in '%s'", keyFile))
+
+	creds, err = grpcCredentials(certFile, keyFile, certFile)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	s := newGRPCServer(&memory.Driver{}, creds)
+	go func() {
+		_ = s.Serve(listener)
+	}()
+	defer s.Stop()
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	check := func(clientCerts []tls.Certificate) error {
+		config := &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: clientCerts}
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(config)))
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		return err
+	}
+	require.NoError(t, check([]tls.Certificate{cert}))
+	// clients without a certificate are rejected
+	require.Error(t, check(nil))
+}
+
+func TestSplitList(t *testing.T) {
+	require.Nil(t, splitList(""))
+	require.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, splitList(" https://a.example.com,,https://b.example.com "))
+}
+
+func TestNewLogger(t *testing.T) {
+	logger, err := newLogger("text")
+	require.NoError(t, err)
+	require.IsType(t, &logging.BuiltinLogger{}, logger)
+
+	logger, err = newLogger("json")
+	require.NoError(t, err)
+	require.IsType(t, &logging.JSONLogger{}, logger)
+
+	_, err = newLogger("xml")
+	require.EqualError(t, err, "invalid log format 'xml': must be text or json")
+}
+
+func TestRunMigrateV1(t *testing.T) {
+	require.NoError(t, runMigrateV1([]string{"-namespace", "test"}))
+	require.EqualError(t, runMigrateV1([]string{"-driver", "memory"}), "namespace is required")
+}
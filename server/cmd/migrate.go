@@ -0,0 +1,63 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/migration"
+)
+
+// migrateV1Command is the name of the command copying v1 blobs to their v2 keys.
+const migrateV1Command = "migrate-v1"
+
+// runMigrateV1 copies the blobs stored by the v1 handler to their v2 keys, see the migration
+// package. It fails if any blob could not be migrated, so that it can be run again.
+func runMigrateV1(args []string) error {
+	flags := flag.NewFlagSet(migrateV1Command, flag.ExitOnError)
+	driverName := flags.String("driver", "memory", "name of the storage driver [memory|s3|gcs|azure]")
+	namespace := flags.String("namespace", "", "namespace under which the v1 blobs are stored with v2 keys")
+	deleteV1Blobs := flags.Bool("delete-v1-blobs", false, "delete the v1 blobs once their copy was verified against their digest")
+	logFormat := flags.String("log-format", "text", "format of the logs [text|json]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var err error
+	if logger, err = newLogger(*logFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	driver, err := createDriver(ctx, *driverName)
+	if err != nil {
+		return err
+	}
+	opts := []migration.Option{migration.WithLogger(logger)}
+	if *deleteV1Blobs {
+		opts = append(opts, migration.WithDeleteV1Blobs())
+	}
+	m, err := migration.New(driver, *namespace, opts...)
+	if err != nil {
+		return err
+	}
+
+	result, err := m.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+	logger.Info("migrated v1 blobs",
+		"migrated", result.Migrated,
+		"skipped", result.Skipped,
+		"deleted", result.Deleted,
+		"failed", result.Failed,
+	)
+	if result.Failed > 0 {
+		return errors.Errorf("unable to migrate %d v1 blobs, see the logs", result.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+// CodecServerURL is the URL of the server for the codec of the handler passed to
+// WithCodecServer, whose requests are sent with CodecServerTransport.
+const CodecServerURL = "http://codec-server.lps"
+
+// codecServerCredentialHeaders are the headers of the requests to the codec server which are
+// passed on to the requests of its codec, so that authorizers see the same credentials.
+var codecServerCredentialHeaders = []string{"Authorization", "Cookie"}
+
+// CodecServerTransport is a http.RoundTripper serving the requests of the codec of the handler
+// passed to WithCodecServer with the v2 API of the same server, in process. The blobs read
+// and stored by the codec are then subject to the authorizer, the audit log, the quotas, the
+// blob TTLs and the events of the server, as if the client of the codec server requested them.
+//
+// Requests must be sent with the context of the request to the codec server, as done by
+// codecs of the codecserver package, and are sent with its Authorization and Cookie headers.
+// The codec should be created with the URL CodecServerURL and without health check, e.g.
+//
+//	codec.New(codec.WithURL(server.CodecServerURL), codec.WithHTTPClient(&http.Client{Transport: server.CodecServerTransport{}}), codec.WithoutUrlHealthCheck())
+type CodecServerTransport struct{}
+
+type codecServerRequestKey struct{}
+
+// codecServerRequest is a request to the codec server, and the v2 API serving the requests of
+// its codec.
+type codecServerRequest struct {
+	r   *http.Request
+	api http.Handler
+}
+
+// RoundTrip serves req with the v2 API of the server whose codec server is serving the request
+// of the context of req.
+func (CodecServerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	outer, ok := req.Context().Value(codecServerRequestKey{}).(*codecServerRequest)
+	if !ok {
+		return nil, errors.New("server: requests sent with CodecServerTransport must have the context of a request to the codec server")
+	}
+	inner := req.Clone(req.Context())
+	for _, name := range codecServerCredentialHeaders {
+		if values, ok := outer.r.Header[name]; ok && inner.Header.Get(name) == "" {
+			inner.Header[name] = values
+		}
+	}
+	// servers set the Content-Length header of requests, which the API reads
+	if req.ContentLength >= 0 && (req.Method == http.MethodPut || req.Method == http.MethodPost) {
+		inner.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	if inner.Body == nil {
+		inner.Body = http.NoBody
+	}
+	inner.RequestURI = req.URL.RequestURI()
+	inner.RemoteAddr = outer.r.RemoteAddr
+
+	recorder := httptest.NewRecorder()
+	outer.api.ServeHTTP(recorder, inner)
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// serveCodecServer returns a middleware passing the requests to the codec server and api, the
+// v2 API without base path, to CodecServerTransport through their context.
+func serveCodecServer(api http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), codecServerRequestKey{}, &codecServerRequest{r: r, api: api})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
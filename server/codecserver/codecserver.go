@@ -0,0 +1,141 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package codecserver implements the remote codec server protocol of Temporal, which the
+// Temporal Web UI and tctl use to decode payloads, on top of a codec.Codec.
+//
+// The handler answers POST requests to /encode and /decode, whose bodies are Payloads in the
+// JSON format of protobuf, with the encoded or decoded Payloads. The namespace of the
+// request is taken from its X-Namespace header, see Namespace. CORS is not handled by the
+// handler, which is meant to be served behind the CORS middleware of the server, see
+// server.WithCodecServer.
+package codecserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/codec"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+)
+
+const (
+	// EncodePath is the path of the endpoint encoding payloads.
+	EncodePath = "/encode"
+	// DecodePath is the path of the endpoint decoding payloads.
+	DecodePath = "/decode"
+	// NamespaceHeader is the header in which the Temporal Web UI sends the namespace of the
+	// payloads of a request.
+	NamespaceHeader = "X-Namespace"
+)
+
+// Option configures the handler created by New.
+type Option interface {
+	apply(*handler)
+}
+
+type applier func(*handler)
+
+func (a applier) apply(h *handler) {
+	a(h)
+}
+
+// WithLogger sets the logger of the handler, which logs the payloads it fails to encode or
+// decode. Defaults to a noop logger.
+func WithLogger(logger logging.Logger) Option {
+	return applier(func(h *handler) {
+		h.logger = logger
+	})
+}
+
+// WithoutEncoding disables the /encode endpoint, e.g. for servers only used to display
+// payloads, so that clients cannot store blobs through the handler.
+func WithoutEncoding() Option {
+	return applier(func(h *handler) {
+		h.encodingDisabled = true
+	})
+}
+
+type handler struct {
+	codec            *codec.Codec
+	logger           logging.Logger
+	encodingDisabled bool
+}
+
+// New creates a handler encoding and decoding payloads with c. To store the blobs of
+// encoded payloads in the namespace of the request, c should be configured with
+// codec.WithNamespaceProvider(Namespace).
+func New(c *codec.Codec, opts ...Option) http.Handler {
+	h := &handler{
+		codec:  c,
+		logger: logging.NewNoopLogger(),
+	}
+	for _, opt := range opts {
+		opt.apply(h)
+	}
+	return h
+}
+
+type namespaceKey struct{}
+
+// Namespace returns the namespace of the request being encoded, or an empty string if its
+// X-Namespace header is not set. Its signature matches codec.WithNamespaceProvider.
+func Namespace(ctx context.Context, _ *common.Payload) string {
+	namespace, _ := ctx.Value(namespaceKey{}).(string)
+	return namespace
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var process func(context.Context, []*common.Payload) ([]*common.Payload, error)
+	switch {
+	case r.URL.Path == DecodePath:
+		process = h.codec.DecodeWithContext
+	case r.URL.Path == EncodePath && !h.encodingDisabled:
+		process = h.codec.EncodeWithContext
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	if namespace := r.Header.Get(NamespaceHeader); namespace != "" {
+		if err := v2.ValidateNamespace(namespace); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx = context.WithValue(ctx, namespaceKey{}, namespace)
+	}
+
+	var payloads common.Payloads
+	if err := jsonpb.Unmarshal(r.Body, &payloads); err != nil {
+		http.Error(w, "invalid payloads: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	processed, err := process(ctx, payloads.Payloads)
+	if err != nil {
+		h.logger.Error("unable to process payloads", "path", r.URL.Path, "error", err)
+		// errors of the codec may hold details of the storage, which are not sent to clients
+		if errors.Is(err, codec.ErrBlobNotFound) {
+			http.Error(w, "blob not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "unable to process payloads", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := (&jsonpb.Marshaler{}).Marshal(w, &common.Payloads{Payloads: processed}); err != nil {
+		h.logger.Error("unable to write payloads", "error", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package codecserver_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/common/v1"
+
+	"github.com/DataDog/temporal-large-payload-codec/codec"
+	"github.com/DataDog/temporal-large-payload-codec/server/codecserver"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+func newCodec(t *testing.T, driver *memory.Driver) *codec.Codec {
+	c, err := codec.New(
+		codec.WithTransport(codec.NewDriverTransport(driver)),
+		codec.WithNamespace("default"),
+		codec.WithNamespaceProvider(codecserver.Namespace),
+		codec.WithMinBytes(8),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// post sends payloads to the given path of handler, with the namespace header if set.
+func post(t *testing.T, handler http.Handler, path string, namespace string, payloads []*common.Payload) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	require.NoError(t, (&jsonpb.Marshaler{}).Marshal(&body, &common.Payloads{Payloads: payloads}))
+	request := httptest.NewRequest(http.MethodPost, path, &body)
+	request.Header.Set("Content-Type", "application/json")
+	if namespace != "" {
+		request.Header.Set(codecserver.NamespaceHeader, namespace)
+	}
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	return responseRecorder
+}
+
+// keys returns the keys of the blobs stored with driver.
+func keys(t *testing.T, driver *memory.Driver) []string {
+	response, err := driver.ListPayloads(context.Background(), &storage.ListRequest{Prefix: "/"})
+	require.NoError(t, err)
+	var keys []string
+	for _, blob := range response.Blobs {
+		keys = append(keys, blob.Key)
+	}
+	return keys
+}
+
+func payloadsOf(t *testing.T, responseRecorder *httptest.ResponseRecorder) []*common.Payload {
+	require.Equal(t, http.StatusOK, responseRecorder.Code, responseRecorder.Body.String())
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	var payloads common.Payloads
+	require.NoError(t, jsonpb.Unmarshal(responseRecorder.Body, &payloads))
+	return payloads.Payloads
+}
+
+func TestHandler(t *testing.T) {
+	driver := &memory.Driver{}
+	handler := codecserver.New(newCodec(t, driver))
+	payloads := []*common.Payload{
+		{Metadata: map[string][]byte{"encoding": []byte("json/plain")}, Data: []byte(`"a large payload"`)},
+		{Metadata: map[string][]byte{"encoding": []byte("json/plain")}, Data: []byte(`"small"`)},
+	}
+
+	encoded := payloadsOf(t, post(t, handler, codecserver.EncodePath, "team-a", payloads))
+	require.Len(t, encoded, 2)
+	assert.Contains(t, encoded[0].GetMetadata(), "temporal.io/remote-codec")
+	assert.Equal(t, payloads[1], encoded[1])
+	// blobs are stored in the namespace of the request
+	stored := keys(t, driver)
+	require.Len(t, stored, 1)
+	assert.True(t, strings.HasPrefix(stored[0], "/blobs/team-a/"), stored[0])
+
+	decoded := payloadsOf(t, post(t, handler, codecserver.DecodePath, "team-a", encoded))
+	assert.Equal(t, payloads, decoded)
+
+	// the namespace of the codec is used without namespace header
+	payloadsOf(t, post(t, handler, codecserver.EncodePath, "", payloads))
+	assert.Len(t, keys(t, driver), 2)
+}
+
+func TestHandlerErrors(t *testing.T) {
+	driver := &memory.Driver{}
+	handler := codecserver.New(newCodec(t, driver))
+	payloads := []*common.Payload{{Data: []byte(`"a large payload"`)}}
+
+	responseRecorder := post(t, handler, codecserver.DecodePath, "../etc", payloads)
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+
+	responseRecorder = post(t, handler, "/other", "", payloads)
+	assert.Equal(t, http.StatusNotFound, responseRecorder.Code)
+
+	request := httptest.NewRequest(http.MethodGet, codecserver.DecodePath, nil)
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Code)
+	assert.Equal(t, http.MethodPost, responseRecorder.Header().Get("Allow"))
+
+	request = httptest.NewRequest(http.MethodPost, codecserver.DecodePath, strings.NewReader("not json"))
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+
+	// payloads whose blob is missing are not found
+	encoded := payloadsOf(t, post(t, handler, codecserver.EncodePath, "team-a", payloads))
+	for _, key := range keys(t, driver) {
+		_, err := driver.DeletePayload(context.Background(), &storage.DeleteRequest{Key: key})
+		require.NoError(t, err)
+	}
+	responseRecorder = post(t, handler, codecserver.DecodePath, "team-a", encoded)
+	assert.Equal(t, http.StatusNotFound, responseRecorder.Code)
+	assert.Equal(t, "blob not found\n", responseRecorder.Body.String())
+}
+
+func TestWithoutEncoding(t *testing.T) {
+	driver := &memory.Driver{}
+	handler := codecserver.New(newCodec(t, driver), codecserver.WithoutEncoding())
+	payloads := []*common.Payload{{Data: []byte(`"a large payload"`)}}
+
+	assert.Equal(t, http.StatusNotFound, post(t, handler, codecserver.EncodePath, "team-a", payloads).Code)
+	assert.Empty(t, keys(t, driver))
+	assert.Equal(t, payloads, payloadsOf(t, post(t, handler, codecserver.DecodePath, "team-a", payloads)))
+}
@@ -0,0 +1,206 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.temporal.io/sdk/client"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+)
+
+const (
+	// metricRequestsInFlight is the number of requests being served, by operation.
+	metricRequestsInFlight = "lps_server_requests_in_flight"
+	// metricRequestsRejectedTotal counts the requests rejected because the server was saturated.
+	metricRequestsRejectedTotal = "lps_server_requests_rejected_total"
+
+	metricTagOperation = "operation"
+)
+
+// requestClass is the kind of operation of a request, which may be limited separately.
+type requestClass string
+
+const (
+	requestClassGet   requestClass = "get"
+	requestClassPut   requestClass = "put"
+	requestClassOther requestClass = "other"
+)
+
+// WithMaxConcurrentRequests limits the number of requests served at once, further requests
+// being rejected with the HTTP response status code 503 and a Retry-After header, see
+// WithConcurrencyWait. Health
+// checks are not limited. By default, the number of requests is not limited.
+func WithMaxConcurrentRequests(n int) Option {
+	return applier(func(o *options) {
+		o.maxConcurrentRequests = n
+	})
+}
+
+// WithMaxConcurrentGets limits the number of requests getting blobs served at once, in
+// addition to the limit set by WithMaxConcurrentRequests.
+func WithMaxConcurrentGets(n int) Option {
+	return applier(func(o *options) {
+		o.maxConcurrentGets = n
+	})
+}
+
+// WithMaxConcurrentPuts limits the number of requests putting blobs, including the parts of
+// upload sessions, served at once, in addition to the limit set by WithMaxConcurrentRequests.
+func WithMaxConcurrentPuts(n int) Option {
+	return applier(func(o *options) {
+		o.maxConcurrentPuts = n
+	})
+}
+
+// WithConcurrencyWait sets the period for which requests exceeding the limits set by
+// WithMaxConcurrentRequests, WithMaxConcurrentGets or WithMaxConcurrentPuts wait for another
+// request to complete before being rejected. By default, they are rejected immediately.
+// Rejected requests are asked to retry after the same period, rounded up to whole seconds, as
+// no request completed while they waited, or after a second if they did not wait.
+func WithConcurrencyWait(wait time.Duration) Option {
+	return applier(func(o *options) {
+		o.concurrencyWait = wait
+	})
+}
+
+// WithMetricsHandler sets the handler recording the number of requests in flight and of
+// requests rejected by the limits set by WithMaxConcurrentRequests, WithMaxConcurrentGets and
+// WithMaxConcurrentPuts, tagged by operation, the usage of the namespaces with a quota set
+// by WithNamespaceQuota, and the results of the existence checks of uploads, see
+// WithSkipExistCheck. Defaults to client.MetricsNopHandler.
+func WithMetricsHandler(handler client.MetricsHandler) Option {
+	return applier(func(o *options) {
+		o.metricsHandler = handler
+	})
+}
+
+// concurrencyLimit is a semaphore bounding the number of requests served at once. Its channel
+// is nil if the number of requests is not limited.
+type concurrencyLimit struct {
+	slots    chan struct{}
+	inFlight atomic.Int64
+	gauge    client.MetricsGauge
+	rejected client.MetricsCounter
+}
+
+func newConcurrencyLimit(n int, metricsHandler client.MetricsHandler, operation string) *concurrencyLimit {
+	handler := metricsHandler.WithTags(map[string]string{metricTagOperation: operation})
+	l := &concurrencyLimit{
+		gauge:    handler.Gauge(metricRequestsInFlight),
+		rejected: handler.Counter(metricRequestsRejectedTotal),
+	}
+	if n > 0 {
+		l.slots = make(chan struct{}, n)
+	}
+	return l
+}
+
+// acquire takes a slot, waiting up to wait for one to be released, and tells whether it did.
+func (l *concurrencyLimit) acquire(r *http.Request, wait time.Duration) bool {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if !l.await(r, wait) {
+				l.rejected.Inc(1)
+				return false
+			}
+		}
+	}
+	l.gauge.Update(float64(l.inFlight.Add(1)))
+	return true
+}
+
+func (l *concurrencyLimit) await(r *http.Request, wait time.Duration) bool {
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// release releases a slot taken by acquire.
+func (l *concurrencyLimit) release() {
+	l.gauge.Update(float64(l.inFlight.Add(-1)))
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// limitConcurrency returns a middleware rejecting the requests exceeding the limits of o with
+// the HTTP response status code 503. The limit of the operation of a request is checked
+// before the limit of all requests, so that waiting requests of one operation do not take
+// the slots of the others.
+func limitConcurrency(o *options) func(http.Handler) http.Handler {
+	metricsHandler := o.metricsHandler
+	if metricsHandler == nil {
+		metricsHandler = client.MetricsNopHandler
+	}
+	all := newConcurrencyLimit(o.maxConcurrentRequests, metricsHandler, "all")
+	classes := map[requestClass]*concurrencyLimit{
+		requestClassGet:   newConcurrencyLimit(o.maxConcurrentGets, metricsHandler, string(requestClassGet)),
+		requestClassPut:   newConcurrencyLimit(o.maxConcurrentPuts, metricsHandler, string(requestClassPut)),
+		requestClassOther: newConcurrencyLimit(0, metricsHandler, string(requestClassOther)),
+	}
+	wait := o.concurrencyWait
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			class, limited := classifyRequest(r, o.basePath)
+			if !limited {
+				next.ServeHTTP(w, r)
+				return
+			}
+			limit := classes[class]
+			if !limit.acquire(r, wait) {
+				rejectBusy(w, r, wait)
+				return
+			}
+			defer limit.release()
+			if !all.acquire(r, wait) {
+				rejectBusy(w, r, wait)
+				return
+			}
+			defer all.release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// classifyRequest returns the operation of a request and whether it is subject to the
+// concurrency limits, which health checks are not. Paths are relative to basePath.
+func classifyRequest(r *http.Request, basePath string) (requestClass, bool) {
+	path := strings.TrimPrefix(r.URL.Path, basePath)
+	switch {
+	case strings.HasPrefix(path, "/v2/health/"):
+		return "", false
+	case path == "/v2/blobs/get" || path == "/v2/blobs/get-batch":
+		return requestClassGet, true
+	case path == "/v2/blobs/put" || path == "/v2/blobs/uploads" || strings.HasPrefix(path, "/v2/blobs/uploads/"):
+		return requestClassPut, true
+	default:
+		return requestClassOther, true
+	}
+}
+
+// rejectBusy answers a request rejected because the server is saturated after waiting for
+// wait, asking the client to retry after as long.
+func rejectBusy(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	v2.SetRetryAfter(w, wait)
+	writeError(w, r, http.StatusServiceUnavailable, v2.ErrorCodeServerBusy, "too many requests in flight, retry later")
+}
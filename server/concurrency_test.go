@@ -0,0 +1,178 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/client"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+// blockingDriver is a driver whose gets block until release is closed, after signaling that
+// they started on started.
+type blockingDriver struct {
+	existingDriver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDriver) GetPayload(_ context.Context, r *storage.GetRequest) (*storage.GetResponse, error) {
+	d.started <- struct{}{}
+	<-d.release
+	_, _ = r.Writer.Write([]byte("hello"))
+	return &storage.GetResponse{ContentLength: 5}, nil
+}
+
+// gaugeMetricsHandler records the last values of gauges by name and tags.
+type gaugeMetricsHandler struct {
+	client.MetricsHandler
+	mu     *sync.Mutex
+	tags   string
+	gauges map[string]float64
+}
+
+func (h *gaugeMetricsHandler) WithTags(tags map[string]string) client.MetricsHandler {
+	var pairs []string
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	return &gaugeMetricsHandler{MetricsHandler: h.MetricsHandler, mu: h.mu, tags: strings.Join(pairs, ","), gauges: h.gauges}
+}
+
+func (h *gaugeMetricsHandler) Gauge(name string) client.MetricsGauge {
+	return gauge(func(v float64) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.gauges[name+"{"+h.tags+"}"] = v
+	})
+}
+
+func (h *gaugeMetricsHandler) gauge(name string) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.gauges[name]
+}
+
+type gauge func(float64)
+
+func (g gauge) Update(v float64) {
+	g(v)
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	newGet := func() *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key=/blobs/test/abc", nil)
+		request.Header.Set("Content-Type", "application/octet-stream")
+		return request
+	}
+
+	testCases := []struct {
+		name string
+		opts []Option
+		// putStatus is the status code of a put while a get is in flight.
+		putStatus int
+	}{
+		{name: "all requests", opts: []Option{WithMaxConcurrentRequests(1)}, putStatus: http.StatusServiceUnavailable},
+		{name: "gets", opts: []Option{WithMaxConcurrentGets(1)}, putStatus: http.StatusOK},
+		{name: "puts", opts: []Option{WithMaxConcurrentPuts(1), WithMaxConcurrentGets(2)}, putStatus: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			driver := &blockingDriver{started: make(chan struct{}, 2), release: make(chan struct{})}
+			metrics := &gaugeMetricsHandler{MetricsHandler: client.MetricsNopHandler, mu: &sync.Mutex{}, gauges: map[string]float64{}}
+			handler := NewHttpHandlerWithOptions(driver, append(tc.opts, WithMetricsHandler(metrics))...)
+
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				responseRecorder := httptest.NewRecorder()
+				handler.ServeHTTP(responseRecorder, newGet())
+				done <- responseRecorder
+			}()
+			<-driver.started
+			assert.Equal(t, float64(1), metrics.gauge(metricRequestsInFlight+"{operation=get}"))
+			assert.Equal(t, float64(1), metrics.gauge(metricRequestsInFlight+"{operation=all}"))
+
+			if tc.name != "puts" {
+				responseRecorder := httptest.NewRecorder()
+				handler.ServeHTTP(responseRecorder, newGet())
+				require.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+				assert.Equal(t, "1", responseRecorder.Header().Get("Retry-After"))
+				assert.JSONEq(t, errorBody(v2.ErrorCodeServerBusy, "too many requests in flight, retry later"), responseRecorder.Body.String())
+			}
+
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, newPutRequestV2([]byte("hello"), 5))
+			assert.Equal(t, tc.putStatus, responseRecorder.Code)
+
+			// health checks are not limited
+			responseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodHead, "/v2/health/head", nil))
+			assert.Equal(t, http.StatusOK, responseRecorder.Code)
+
+			close(driver.release)
+			assert.Equal(t, http.StatusOK, (<-done).Code)
+			assert.Equal(t, float64(0), metrics.gauge(metricRequestsInFlight+"{operation=get}"))
+			assert.Equal(t, float64(0), metrics.gauge(metricRequestsInFlight+"{operation=all}"))
+		})
+	}
+}
+
+func TestConcurrencyWait(t *testing.T) {
+	driver := &blockingDriver{started: make(chan struct{}, 2), release: make(chan struct{})}
+	handler := NewHttpHandlerWithOptions(driver, WithMaxConcurrentGets(1), WithConcurrencyWait(time.Minute))
+	newGet := func() *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key=/blobs/test/abc", nil)
+		request.Header.Set("Content-Type", "application/octet-stream")
+		return request
+	}
+
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, newGet())
+			done <- responseRecorder.Code
+		}()
+	}
+	// the second request waits for the first one to complete instead of being rejected
+	<-driver.started
+	select {
+	case <-driver.started:
+		t.Fatal("requests exceeded the concurrency limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(driver.release)
+	<-driver.started
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	// requests are rejected once the wait elapsed
+	driver = &blockingDriver{started: make(chan struct{}, 1), release: make(chan struct{})}
+	handler = NewHttpHandlerWithOptions(driver, WithMaxConcurrentGets(1), WithConcurrencyWait(10*time.Millisecond))
+	go func() {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, newGet())
+		done <- responseRecorder.Code
+	}()
+	<-driver.started
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, newGet())
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	// the wait is rounded up to whole seconds
+	assert.Equal(t, "1", responseRecorder.Header().Get("Retry-After"))
+	close(driver.release)
+	assert.Equal(t, http.StatusOK, <-done)
+}
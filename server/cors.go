@@ -0,0 +1,109 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// corsMethods are the methods of the API allowed in cross-origin requests.
+	corsMethods = "GET, HEAD, PUT, POST, DELETE"
+	// corsMaxAge is the number of seconds for which browsers may cache preflight responses.
+	corsMaxAge = "600"
+)
+
+var (
+	// corsRequestHeaders are the request headers of the API allowed in cross-origin requests,
+	// in addition to the ones passed to WithCORS.
+	corsRequestHeaders = []string{
+		"Content-Type",
+		"Range",
+		"X-Temporal-Metadata",
+		"X-Payload-Expected-Content-Length",
+		"X-Payload-Encoding",
+		"X-Payload-TTL",
+		"X-Request-ID",
+		"Idempotency-Key",
+		// sent by the Temporal Web UI to the codec server, see WithCodecServer
+		"X-Namespace",
+	}
+	// corsExposedHeaders are the response headers of the API which browsers expose to
+	// cross-origin requests.
+	corsExposedHeaders = []string{
+		"Accept-Ranges",
+		"Content-Range",
+		"X-Payload-Key",
+		"X-Payload-Digest",
+		"X-Payload-Digest-Verified",
+		"X-Request-ID",
+		"Idempotent-Replayed",
+	}
+)
+
+// WithCORS allows browsers to send cross-origin requests from the given origins, e.g. for web
+// UIs decoding payloads, which may send the given request headers in addition to the ones of
+// the API, such as X-Temporal-Metadata and X-Payload-Expected-Content-Length. The origin "*"
+// allows all origins. Headers checked by an Authorizer, such as Authorization, must be
+// allowed explicitly.
+//
+// Preflight requests from allowed origins are answered with the HTTP response status code
+// 204, and the ones from other origins with 403. Other requests from other origins are served
+// without CORS headers, so that browsers do not expose their response. Cross-origin requests
+// are disallowed by default.
+func WithCORS(allowedOrigins []string, allowedHeaders []string) Option {
+	return applier(func(o *options) {
+		o.corsOrigins = append([]string(nil), allowedOrigins...)
+		o.corsHeaders = append([]string(nil), allowedHeaders...)
+	})
+}
+
+// handleCORS returns a middleware answering preflight requests and setting the CORS headers
+// of requests from the allowed origins.
+func handleCORS(allowedOrigins []string, allowedHeaders []string) func(http.Handler) http.Handler {
+	anyOrigin := false
+	origins := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			anyOrigin = true
+		}
+		origins[origin] = true
+	}
+	requestHeaders := strings.Join(append(append([]string(nil), corsRequestHeaders...), allowedHeaders...), ", ")
+	exposedHeaders := strings.Join(corsExposedHeaders, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// responses differ by origin, so caches must not share them
+			w.Header().Add("Vary", "Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if !anyOrigin && !origins[origin] {
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+				w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
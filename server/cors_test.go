@@ -0,0 +1,137 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+func TestWithCORS(t *testing.T) {
+	const key = "/blobs/test/common/sha256:1234/sha256:abcd"
+	driver := &memory.Driver{}
+	_, err := driver.PutPayload(context.Background(), &storage.PutRequest{Data: strings.NewReader("hello"), Key: key, ContentLength: 5})
+	require.NoError(t, err)
+
+	// requests are rejected without credentials, except for preflight requests
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	newHandler := func(opts ...Option) http.Handler {
+		return NewHttpHandlerWithOptions(driver, append(opts, WithMiddleware(authenticate))...)
+	}
+	cors := WithCORS([]string{"https://ui.example.com"}, []string{"Authorization"})
+
+	newPreflight := func(origin string) *http.Request {
+		request := httptest.NewRequest(http.MethodOptions, "/v2/blobs/get?key="+url.QueryEscape(key), nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		request.Header.Set("Access-Control-Request-Headers", "authorization,x-payload-expected-content-length")
+		return request
+	}
+	newGet := func(origin string) *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+url.QueryEscape(key), nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Authorization", "token")
+		request.Header.Set("Content-Type", "application/octet-stream")
+		return request
+	}
+
+	testCase := []struct {
+		name        string
+		opts        []Option
+		request     *http.Request
+		wantStatus  int
+		wantOrigin  string
+		wantHeaders []string
+	}{
+		{
+			name:        "Preflight from allowed origin",
+			opts:        []Option{cors},
+			request:     newPreflight("https://ui.example.com"),
+			wantStatus:  http.StatusNoContent,
+			wantOrigin:  "https://ui.example.com",
+			wantHeaders: []string{"X-Temporal-Metadata", "X-Payload-Expected-Content-Length", "Idempotency-Key", "X-Namespace", "Authorization"},
+		},
+		{
+			name:       "Preflight from disallowed origin",
+			opts:       []Option{cors},
+			request:    newPreflight("https://evil.example.com"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Preflight from any origin",
+			opts:       []Option{WithCORS([]string{"*"}, nil)},
+			request:    newPreflight("https://evil.example.com"),
+			wantStatus: http.StatusNoContent,
+			wantOrigin: "https://evil.example.com",
+		},
+		{
+			name:       "Preflight without CORS",
+			request:    newPreflight("https://ui.example.com"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Request from allowed origin",
+			opts:       []Option{cors},
+			request:    newGet("https://ui.example.com"),
+			wantStatus: http.StatusOK,
+			wantOrigin: "https://ui.example.com",
+		},
+		{
+			name:       "Request from disallowed origin",
+			opts:       []Option{cors},
+			request:    newGet("https://evil.example.com"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Request without origin",
+			opts:       []Option{cors},
+			request:    newGet(""),
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			responseRecorder := httptest.NewRecorder()
+			newHandler(scenario.opts...).ServeHTTP(responseRecorder, scenario.request)
+
+			require.Equal(t, scenario.wantStatus, responseRecorder.Code)
+			header := responseRecorder.Header()
+			assert.Equal(t, scenario.wantOrigin, header.Get("Access-Control-Allow-Origin"))
+			if scenario.request.Method == http.MethodOptions && scenario.wantOrigin != "" {
+				assert.Equal(t, "GET, HEAD, PUT, POST, DELETE", header.Get("Access-Control-Allow-Methods"))
+				for _, allowed := range scenario.wantHeaders {
+					assert.Contains(t, header.Get("Access-Control-Allow-Headers"), allowed)
+				}
+				assert.Empty(t, responseRecorder.Body.String())
+			}
+			if scenario.request.Method == http.MethodGet && scenario.wantOrigin != "" {
+				assert.Contains(t, header.Get("Access-Control-Expose-Headers"), "X-Payload-Digest-Verified")
+				assert.Equal(t, "hello", responseRecorder.Body.String())
+			}
+			if scenario.request.Header.Get("Origin") != "" && len(scenario.opts) > 0 {
+				assert.Equal(t, "Origin", header.Get("Vary"))
+			}
+		})
+	}
+}
@@ -5,22 +5,30 @@
 package server_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/DataDog/temporal-large-payload-codec/codec"
+	"github.com/DataDog/temporal-large-payload-codec/codec/interceptor"
 	"github.com/DataDog/temporal-large-payload-codec/server"
+	"github.com/DataDog/temporal-large-payload-codec/server/codecserver"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"go.temporal.io/api/common/v1"
 	"go.temporal.io/api/enums/v1"
 
+	"github.com/gogo/protobuf/jsonpb"
 	"github.com/stretchr/testify/require"
 	"github.com/temporalio/temporalite/temporaltest"
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/converter"
+	sdkinterceptor "go.temporal.io/sdk/interceptor"
 	"go.temporal.io/sdk/worker"
 	"go.temporal.io/sdk/workflow"
 )
@@ -84,6 +92,7 @@ func TestWorker(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer testCodec.Close()
 	testDataConverter := converter.NewCodecDataConverter(converter.GetDefaultDataConverter(), testCodec)
 
 	// Create test Temporal server and client
@@ -125,3 +134,190 @@ func TestWorker(t *testing.T) {
 		}
 	}
 }
+
+func TestWorkerWithKeyPrefixInterceptor(t *testing.T) {
+	// Create test remote codec service
+	testCodecServer := httptest.NewServer(server.NewHttpHandler(&memory.Driver{}))
+	defer testCodecServer.Close()
+	// Create test codec (to be used from Go SDK)
+	testCodec, err := codec.New(
+		codec.WithURL(testCodecServer.URL),
+		codec.WithNamespace("e2e-test"),
+		codec.WithHTTPClient(testCodecServer.Client()),
+		codec.WithMinBytes(1_000_000),
+	)
+	require.NoError(t, err)
+	defer testCodec.Close()
+
+	// Create test Temporal server and client
+	ts := temporaltest.NewServer(temporaltest.WithT(t))
+	testClient := ts.NewClientWithOptions(client.Options{
+		DataConverter: interceptor.NewDataConverter(converter.GetDefaultDataConverter(), testCodec),
+	})
+
+	// Register a new worker
+	testWorker := worker.New(testClient, taskQueue, worker.Options{
+		Interceptors: []sdkinterceptor.WorkerInterceptor{interceptor.NewWorkerInterceptor()},
+	})
+	defer testWorker.Stop()
+
+	testWorker.RegisterWorkflow(Workflow)
+	testWorker.RegisterActivity(LargePayloadActivity)
+	err = testWorker.Start()
+	require.NoError(t, err)
+
+	wfr, err := testClient.ExecuteWorkflow(context.Background(), client.StartWorkflowOptions{
+		ID:                       "orders/42:large",
+		TaskQueue:                taskQueue,
+		WorkflowExecutionTimeout: time.Second * 60,
+	}, Workflow)
+	require.NoError(t, err)
+
+	err = wfr.Get(context.Background(), nil)
+	require.NoError(t, err)
+
+	// Validate that the activity input and result are stored under the workflow run
+	prefix := interceptor.KeyPrefix(wfr.GetID(), wfr.GetRunID())
+	require.Contains(t, prefix, "orders_42_large/")
+
+	var keys []string
+	wfHistory := testClient.GetWorkflowHistory(context.Background(), wfr.GetID(), wfr.GetRunID(), false, enums.HISTORY_EVENT_FILTER_TYPE_ALL_EVENT)
+	for wfHistory.HasNext() {
+		event, err := wfHistory.Next()
+		require.NoError(t, err)
+		var payloads []*common.Payload
+		switch event.GetEventType() {
+		case enums.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED:
+			payloads = event.GetActivityTaskScheduledEventAttributes().GetInput().GetPayloads()
+		case enums.EVENT_TYPE_ACTIVITY_TASK_COMPLETED:
+			payloads = event.GetActivityTaskCompletedEventAttributes().GetResult().GetPayloads()
+		}
+		for _, payload := range payloads {
+			key, err := testCodec.Key(payload)
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+	}
+	require.Len(t, keys, 2)
+	for _, key := range keys {
+		require.Contains(t, key, "/custom/"+prefix+"/")
+	}
+}
+
+func TestCodecWithNamespaceScopedKeys(t *testing.T) {
+	testCodecServer := httptest.NewServer(server.NewHttpHandlerWithOptions(&memory.Driver{}, server.WithNamespaceScopedKeys()))
+	defer testCodecServer.Close()
+	newCodec := func(namespace string) *codec.Codec {
+		c, err := codec.New(
+			codec.WithURL(testCodecServer.URL),
+			codec.WithNamespace(namespace),
+			codec.WithHTTPClient(testCodecServer.Client()),
+			codec.WithMinBytes(1),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	testCodec := newCodec("e2e-test")
+
+	payload, err := converter.GetDefaultDataConverter().ToPayload("hello world")
+	require.NoError(t, err)
+	encoded, err := testCodec.Encode([]*common.Payload{payload})
+	require.NoError(t, err)
+	decoded, err := testCodec.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, payload.GetData(), decoded[0].GetData())
+
+	key, err := testCodec.Key(encoded[0])
+	require.NoError(t, err)
+	exists, err := testCodec.Exists(context.Background(), key)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// codecs of other namespaces cannot access the blob
+	otherCodec := newCodec("other")
+	_, err = otherCodec.Decode(encoded)
+	require.Error(t, err)
+	require.Error(t, otherCodec.Delete(context.Background(), key))
+
+	require.NoError(t, testCodec.Delete(context.Background(), key))
+	exists, err = testCodec.Exists(context.Background(), key)
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestCodecServerDecodesHistory(t *testing.T) {
+	// the codec server reads the blobs stored through the API with the same driver
+	driver := &memory.Driver{}
+	codecServerCodec, err := codec.New(
+		codec.WithTransport(codec.NewDriverTransport(driver)),
+		codec.WithNamespace("default"),
+		codec.WithNamespaceProvider(codecserver.Namespace),
+	)
+	require.NoError(t, err)
+	defer codecServerCodec.Close()
+	testCodecServer := httptest.NewServer(server.NewHttpHandlerWithOptions(driver,
+		server.WithCodecServer(codecserver.New(codecServerCodec)),
+		server.WithCORS([]string{"http://localhost:8233"}, nil),
+	))
+	defer testCodecServer.Close()
+	testCodec, err := codec.New(
+		codec.WithURL(testCodecServer.URL),
+		codec.WithNamespace("e2e-test"),
+		codec.WithHTTPClient(testCodecServer.Client()),
+		codec.WithMinBytes(1_000_000),
+	)
+	require.NoError(t, err)
+	defer testCodec.Close()
+
+	ts := temporaltest.NewServer(temporaltest.WithT(t))
+	testClient := ts.NewClientWithOptions(client.Options{
+		DataConverter: converter.NewCodecDataConverter(converter.GetDefaultDataConverter(), testCodec),
+	})
+	testWorker := worker.New(testClient, taskQueue, worker.Options{})
+	defer testWorker.Stop()
+	testWorker.RegisterWorkflow(Workflow)
+	testWorker.RegisterActivity(LargePayloadActivity)
+	require.NoError(t, testWorker.Start())
+
+	wfr, err := testClient.ExecuteWorkflow(context.Background(), client.StartWorkflowOptions{
+		TaskQueue:                taskQueue,
+		WorkflowExecutionTimeout: time.Second * 60,
+	}, Workflow)
+	require.NoError(t, err)
+	require.NoError(t, wfr.Get(context.Background(), nil))
+
+	// read the activity result from the history as the Temporal Web UI does, without codec
+	var result *common.Payloads
+	wfHistory := ts.NewClientWithOptions(client.Options{}).GetWorkflowHistory(context.Background(), wfr.GetID(), wfr.GetRunID(), false, enums.HISTORY_EVENT_FILTER_TYPE_ALL_EVENT)
+	for wfHistory.HasNext() {
+		event, err := wfHistory.Next()
+		require.NoError(t, err)
+		if event.GetEventType() == enums.EVENT_TYPE_ACTIVITY_TASK_COMPLETED {
+			result = event.GetActivityTaskCompletedEventAttributes().GetResult()
+		}
+	}
+	require.NotNil(t, result)
+	require.Contains(t, result.GetPayloads()[0].GetMetadata(), "temporal.io/remote-codec")
+
+	var body bytes.Buffer
+	require.NoError(t, (&jsonpb.Marshaler{}).Marshal(&body, result))
+	request, err := http.NewRequest(http.MethodPost, testCodecServer.URL+"/codec/decode", &body)
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Origin", "http://localhost:8233")
+	request.Header.Set(codecserver.NamespaceHeader, "e2e-test")
+	response, err := testCodecServer.Client().Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "http://localhost:8233", response.Header.Get("Access-Control-Allow-Origin"))
+
+	var decoded common.Payloads
+	require.NoError(t, jsonpb.Unmarshal(response.Body, &decoded))
+	require.Len(t, decoded.GetPayloads(), 1)
+	require.Equal(t, "json/plain", string(decoded.GetPayloads()[0].GetMetadata()["encoding"]))
+	var activityResult LargePayloadActivityResponse
+	require.NoError(t, json.Unmarshal(decoded.GetPayloads()[0].GetData(), &activityResult))
+	require.Len(t, activityResult.Data, largePayloadSize)
+}
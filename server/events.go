@@ -0,0 +1,145 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+)
+
+const (
+	// DefaultWebhookAttempts is the number of times a WebhookSink sends an event unless
+	// configured otherwise.
+	DefaultWebhookAttempts = 3
+	// DefaultWebhookBackoff is the period a WebhookSink waits before sending an event again
+	// unless configured otherwise, which doubles with each attempt.
+	DefaultWebhookBackoff = time.Second
+	// DefaultWebhookTimeout is the period after which a WebhookSink gives up on a request
+	// unless configured otherwise.
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
+// Event is a change of the blobs stored by the server, see WithEventSink.
+type Event = v2.Event
+
+// EventSink is called with the events of the blobs stored by the server, see WithEventSink.
+type EventSink = v2.EventSink
+
+// WithEventSink sets a function called with an Event after each blob stored or deleted through
+// the server, e.g. to feed an inventory of the blobs without relying on the notifications of
+// the object store. Blobs which exist already, presigned uploads and requests to the gRPC API
+// do not send events, and the expired blobs deleted by the sweeper only do if it is created
+// with sweeper.WithEventSink.
+//
+// The sink is called from a single goroutine, so that slow sinks do not delay requests.
+// Events sent while v2.DefaultEventQueueSize events wait for the sink are dropped, and
+// counted by the metrics handler set with WithMetricsHandler as lps_events_dropped_total.
+func WithEventSink(sink EventSink) Option {
+	return applier(func(o *options) {
+		o.eventSink = sink
+	})
+}
+
+// WebhookSink sends events as JSON to a URL with POST requests, see Send.
+type WebhookSink struct {
+	// URL is the URL to which events are sent.
+	URL string
+	// Client sends the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+	// Attempts is the number of times an event is sent before giving up on it. Defaults to
+	// DefaultWebhookAttempts.
+	Attempts int
+	// Backoff is the period to wait before sending an event again, which doubles with each
+	// attempt. Defaults to DefaultWebhookBackoff.
+	Backoff time.Duration
+	// Timeout is the period after which a request is abandoned. Defaults to
+	// DefaultWebhookTimeout.
+	Timeout time.Duration
+	// Logger logs the events which could not be sent. Defaults to a no-op logger.
+	Logger logging.Logger
+}
+
+// Send posts event to the URL of the webhook, e.g. when passed to WithEventSink. Requests
+// failing or answered with a 5xx or 429 status code are sent again, other status codes
+// above 299 are not since the event would be rejected again.
+func (s *WebhookSink) Send(ctx context.Context, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		s.logger().Error("unable to encode event", "key", event.Key, "error", err)
+		return
+	}
+
+	attempts := s.Attempts
+	if attempts <= 0 {
+		attempts = DefaultWebhookAttempts
+	}
+	backoff := s.Backoff
+	if backoff <= 0 {
+		backoff = DefaultWebhookBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == attempts {
+			s.logger().Error("unable to send event", "operation", event.Operation, "key", event.Key, "attempts", attempt, "error", err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post sends an encoded event, and tells whether it should be sent again if it failed.
+func (s *WebhookSink) post(ctx context.Context, body []byte) (bool, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := v2.RequestIDFromContext(ctx); id != "" {
+		req.Header.Set(v2.RequestIDHeader, id)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook responded with status code %d", resp.StatusCode)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+func (s *WebhookSink) logger() logging.Logger {
+	if s.Logger == nil {
+		return logging.NewNoopLogger()
+	}
+	return s.Logger
+}
@@ -0,0 +1,175 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/client"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+// receiveEvent returns the next event sent on events, failing the test if there is none.
+func receiveEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no event was sent")
+		return Event{}
+	}
+}
+
+func TestEventSink(t *testing.T) {
+	events := make(chan Event, 10)
+	handler := NewHttpHandlerWithOptions(&memory.Driver{}, WithEventSink(func(_ context.Context, event Event) {
+		events <- event
+	}))
+
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	var key string
+	for _, status := range []int{http.StatusCreated, http.StatusOK} {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, newPutRequestV2(data, len(data)))
+		require.Equal(t, status, responseRecorder.Code, responseRecorder.Body.String())
+		var response struct{ Key string }
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+		key = response.Key
+	}
+
+	request := httptest.NewRequest(http.MethodDelete, "/v2/blobs/delete?key="+url.QueryEscape(key), nil)
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusNoContent, responseRecorder.Code, responseRecorder.Body.String())
+
+	// events are sent in order, so an event of the duplicate upload would come before the deletion
+	put := receiveEvent(t, events)
+	assert.Equal(t, v2.OperationPut, put.Operation)
+	assert.Equal(t, "test", put.Namespace)
+	assert.Equal(t, key, put.Key)
+	assert.Equal(t, uint64(len(data)), put.Size)
+	assert.Equal(t, digest, put.Digest)
+	assert.False(t, put.Time.IsZero())
+
+	deleted := receiveEvent(t, events)
+	assert.Equal(t, v2.OperationDelete, deleted.Operation)
+	assert.Equal(t, "test", deleted.Namespace)
+	assert.Equal(t, key, deleted.Key)
+	assert.Equal(t, uint64(len(data)), deleted.Size)
+	assert.Equal(t, digest, deleted.Digest)
+
+	select {
+	case event := <-events:
+		assert.Fail(t, "unexpected event", "%+v", event)
+	default:
+	}
+}
+
+func TestEventSinkDropsEvents(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	sink := func(context.Context, Event) {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+	}
+	metrics := &counterMetricsHandler{MetricsHandler: client.MetricsNopHandler, mu: &sync.Mutex{}, counters: map[string]int64{}}
+	handler := NewHttpHandlerWithOptions(&memory.Driver{}, WithEventSink(sink), WithMetricsHandler(metrics))
+	defer close(release)
+
+	put := func(i int) {
+		data := []byte(strconv.Itoa(i))
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, newPutRequestV2(data, len(data)))
+		require.Equal(t, http.StatusCreated, responseRecorder.Code, responseRecorder.Body.String())
+	}
+	put(0)
+	<-started
+	// the sink is blocked on the first event, so one more than the queue holds is dropped
+	for i := 1; i <= v2.DefaultEventQueueSize+1; i++ {
+		put(i)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.Equal(t, int64(1), metrics.counters["lps_events_dropped_total{namespace=test,operation=put}"])
+}
+
+func TestWebhookSink(t *testing.T) {
+	event := Event{
+		Operation: v2.OperationPut,
+		Namespace: "test",
+		Key:       "/blobs/test/common/sha256:abc/sha256:def",
+		Size:      11,
+		Digest:    "sha256:abc",
+		Time:      time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	testCases := []struct {
+		name         string
+		statusCodes  []int
+		wantRequests int
+	}{
+		{
+			name:         "Sent",
+			statusCodes:  []int{http.StatusNoContent},
+			wantRequests: 1,
+		},
+		{
+			name:         "Retried",
+			statusCodes:  []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			wantRequests: 3,
+		},
+		{
+			name:         "Attempts exhausted",
+			statusCodes:  []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK},
+			wantRequests: 3,
+		},
+		{
+			name:         "Rejected",
+			statusCodes:  []int{http.StatusBadRequest, http.StatusOK},
+			wantRequests: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				assert.Equal(t, "request-1", r.Header.Get(v2.RequestIDHeader))
+				var received Event
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+				assert.Equal(t, event, received)
+				w.WriteHeader(tc.statusCodes[requests])
+				requests++
+			}))
+			defer server.Close()
+
+			sink := &WebhookSink{URL: server.URL, Backoff: time.Millisecond}
+			sink.Send(v2.ContextWithRequestID(context.Background(), "request-1"), event)
+			assert.Equal(t, tc.wantRequests, requests)
+		})
+	}
+}
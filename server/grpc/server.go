@@ -0,0 +1,425 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package grpc implements the gRPC API of the Large Payload Service, see lpspb.LargePayloadService.
+//
+// Blobs are stored under the same keys as by the v2 HTTP API, so both APIs can be served on
+// top of the same storage driver. Unlike the HTTP API, the server does not enforce the quotas
+// and blob TTLs of namespaces, log audit entries or send events, so it must not be exposed to
+// clients which these policies apply to. Clients are authenticated by the transport
+// credentials of the gRPC server, e.g. with mTLS, and authorized by WithAuthorizer.
+package grpc
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/grpc/lpspb"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+// ChunkSize is the maximum size of the data in a message, so that neither side buffers
+// whole blobs.
+const ChunkSize = 1 << 20
+
+// Option configures the server created by NewServer.
+type Option interface {
+	apply(*Server)
+}
+
+type applier func(*Server)
+
+func (a applier) apply(s *Server) {
+	a(s)
+}
+
+// WithLogger sets the logger of the server. Defaults to a noop logger.
+func WithLogger(logger logging.Logger) Option {
+	return applier(func(s *Server) {
+		s.logger = logger
+	})
+}
+
+// WithMaxBlobBytes sets the maximum size of a blob, larger blobs are rejected. Defaults to
+// v2.DefaultMaxBlobBytes.
+func WithMaxBlobBytes(maxBlobBytes uint64) Option {
+	return applier(func(s *Server) {
+		s.maxBlobBytes = maxBlobBytes
+	})
+}
+
+// WithNamespaceMaxBlobBytes overrides the maximum blob size for the blobs of the given
+// namespaces. Zero values are ignored.
+func WithNamespaceMaxBlobBytes(limits map[string]uint64) Option {
+	return applier(func(s *Server) {
+		s.namespaceMaxBlobBytes = limits
+	})
+}
+
+// WithKeyBuilder sets the builder of the keys under which blobs are stored, which must match
+// the one of the HTTP handler serving the same blobs. Defaults to v2.DefaultKeyBuilder.
+func WithKeyBuilder(builder v2.KeyBuilder) Option {
+	return applier(func(s *Server) {
+		s.keyBuilder = builder
+	})
+}
+
+// Authorizer decides whether a call may perform op on the blob with the given key in the given
+// namespace, returning a non-nil error to reject it, like v2.Authorizer for the HTTP API. The
+// client is identified from ctx, e.g. by its certificate with peer.FromContext when the gRPC
+// server requires mTLS, or by its metadata with metadata.FromIncomingContext. The namespace of
+// calls which identify a blob by its key is taken from the key.
+//
+// Rejected calls fail with the status code PermissionDenied and the message of the error, or
+// Unauthenticated if the error wraps v2.ErrUnauthenticated.
+type Authorizer func(ctx context.Context, op v2.Operation, namespace, key string) error
+
+// WithAuthorizer sets the authorizer called before accessing a blob. By default, all calls are
+// accepted.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return applier(func(s *Server) {
+		s.authorizer = authorizer
+	})
+}
+
+// Server implements lpspb.LargePayloadServiceServer on top of a storage driver.
+type Server struct {
+	lpspb.UnimplementedLargePayloadServiceServer
+
+	driver                storage.Driver
+	logger                logging.Logger
+	maxBlobBytes          uint64
+	namespaceMaxBlobBytes map[string]uint64
+	keyBuilder            v2.KeyBuilder
+	authorizer            Authorizer
+}
+
+// NewServer creates a server storing blobs with driver, which is registered with a gRPC
+// server using lpspb.RegisterLargePayloadServiceServer.
+func NewServer(driver storage.Driver, opts ...Option) *Server {
+	s := &Server{
+		driver:       driver,
+		logger:       logging.NewNoopLogger(),
+		maxBlobBytes: v2.DefaultMaxBlobBytes,
+		keyBuilder:   v2.DefaultKeyBuilder,
+	}
+	for _, opt := range opts {
+		opt.apply(s)
+	}
+	return s
+}
+
+// PutBlob stores a blob whose description is sent in the first request, verifying its size
+// and checksum. Blobs which fail verification are deleted.
+func (s *Server) PutBlob(stream lpspb.LargePayloadService_PutBlobServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	description := first.GetDescription()
+	if description == nil {
+		return status.Error(codes.InvalidArgument, "the first request must hold the description of the blob")
+	}
+	key, digest, err := s.describedKey(description)
+	if err != nil {
+		return err
+	}
+	if limit := s.maxBlobBytesFor(description.Namespace); description.ContentLength > limit {
+		return status.Error(codes.ResourceExhausted, s.blobTooLargeMessage(description.Namespace, description.ContentLength))
+	}
+	if err := s.authorize(stream.Context(), v2.OperationPut, description.Namespace, key); err != nil {
+		return err
+	}
+
+	exists, err := s.driver.ExistPayload(stream.Context(), &storage.ExistRequest{Key: key})
+	if err != nil {
+		return s.storageError(err)
+	}
+	if exists.Exists {
+		// the remaining chunks are discarded with the stream
+		return stream.SendAndClose(&lpspb.PutBlobResponse{Key: key})
+	}
+
+	_, hasher, _ := v2.ParseDigest(description.Digest)
+	body := &chunkReader{stream: stream, remaining: description.ContentLength}
+	_, err = s.driver.PutPayload(stream.Context(), &storage.PutRequest{
+		Data:          io.TeeReader(body, hasher),
+		Key:           key,
+		Digest:        description.Digest,
+		ContentLength: description.ContentLength,
+		ContentType:   description.ContentType,
+		Metadata:      description.Metadata,
+	})
+	switch {
+	case body.err != nil:
+		s.deletePartialBlob(key)
+		return body.err
+	case body.eof && body.remaining != 0:
+		// drivers may fail as well, or store the truncated blob
+		s.deletePartialBlob(key)
+		return status.Errorf(codes.InvalidArgument, "received %d bytes, but %d bytes were declared", description.ContentLength-body.remaining, description.ContentLength)
+	case err != nil:
+		return s.storageError(err)
+	case hex.EncodeToString(hasher.Sum(nil)) != digest:
+		s.deletePartialBlob(key)
+		return status.Error(codes.InvalidArgument, "checksum mismatch")
+	}
+	return stream.SendAndClose(&lpspb.PutBlobResponse{Key: key})
+}
+
+// GetBlob sends the data of a blob in chunks of up to ChunkSize bytes.
+func (s *Server) GetBlob(request *lpspb.GetBlobRequest, stream lpspb.LargePayloadService_GetBlobServer) error {
+	namespace, err := s.validateKey(request.Key)
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(stream.Context(), v2.OperationGet, namespace, request.Key); err != nil {
+		return err
+	}
+	exists, err := s.driver.ExistPayload(stream.Context(), &storage.ExistRequest{Key: request.Key})
+	if err != nil {
+		return s.storageError(err)
+	}
+	if !exists.Exists {
+		return status.Errorf(codes.NotFound, "blob not found: key %s", request.Key)
+	}
+	length := exists.ContentLength
+	if request.ExpectedContentLength != 0 {
+		if length != 0 && length != request.ExpectedContentLength {
+			return status.Errorf(codes.FailedPrecondition, "stored blob has %d bytes, but %d bytes are expected", length, request.ExpectedContentLength)
+		}
+		length = request.ExpectedContentLength
+	}
+
+	w := &chunkWriter{stream: stream, contentLength: length, buf: make([]byte, 0, ChunkSize)}
+	if _, err := s.driver.GetPayload(stream.Context(), &storage.GetRequest{Key: request.Key, Writer: w}); err != nil {
+		var blobNotFound *storage.ErrBlobNotFound
+		if errors.As(err, &blobNotFound) {
+			return status.Errorf(codes.NotFound, "blob not found: key %s", request.Key)
+		}
+		if w.err != nil {
+			return w.err
+		}
+		return s.storageError(err)
+	}
+	return w.flush(true)
+}
+
+// HeadBlob checks whether a blob, identified by its key or its description, exists.
+func (s *Server) HeadBlob(ctx context.Context, request *lpspb.HeadBlobRequest) (*lpspb.HeadBlobResponse, error) {
+	key := request.Key
+	var namespace string
+	var err error
+	if key == "" {
+		if request.Description == nil {
+			return nil, status.Error(codes.InvalidArgument, "key or description is required")
+		}
+		if key, _, err = s.describedKey(request.Description); err != nil {
+			return nil, err
+		}
+		namespace = request.Description.Namespace
+	} else if namespace, err = s.validateKey(key); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, v2.OperationHead, namespace, key); err != nil {
+		return nil, err
+	}
+
+	exists, err := s.driver.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+	if err != nil {
+		return nil, s.storageError(err)
+	}
+	return &lpspb.HeadBlobResponse{Exists: exists.Exists, Key: key, ContentLength: exists.ContentLength}, nil
+}
+
+// DeleteBlob removes a blob. Deleting a blob which does not exist succeeds.
+func (s *Server) DeleteBlob(ctx context.Context, request *lpspb.DeleteBlobRequest) (*lpspb.DeleteBlobResponse, error) {
+	namespace, err := s.validateKey(request.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, v2.OperationDelete, namespace, request.Key); err != nil {
+		return nil, err
+	}
+	if _, err := s.driver.DeletePayload(ctx, &storage.DeleteRequest{Key: request.Key}); err != nil {
+		return nil, s.storageError(err)
+	}
+	return &lpspb.DeleteBlobResponse{}, nil
+}
+
+// describedKey returns the key of a described blob and the hex encoded value of its digest.
+func (s *Server) describedKey(description *lpspb.BlobDescription) (string, string, error) {
+	if description.Namespace == "" {
+		return "", "", status.Error(codes.InvalidArgument, "namespace is required")
+	}
+	if err := v2.ValidateNamespace(description.Namespace); err != nil {
+		return "", "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	if description.Digest == "" {
+		return "", "", status.Error(codes.InvalidArgument, "digest is required")
+	}
+	digest, _, err := v2.ParseDigest(description.Digest)
+	if err != nil {
+		return "", "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := v2.ValidateMetadata(description.Metadata); err != nil {
+		return "", "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	key, err := v2.BuildKey(s.keyBuilder, description.Namespace, description.Digest, description.Metadata)
+	if err != nil {
+		return "", "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return key, digest, nil
+}
+
+// validateKey returns the namespace of key, or an InvalidArgument error if key is empty or not
+// a valid key, see v2.ValidateBuiltKey.
+func (s *Server) validateKey(key string) (string, error) {
+	if key == "" {
+		return "", status.Error(codes.InvalidArgument, "key is required")
+	}
+	namespace, err := v2.ValidateBuiltKey(s.keyBuilder, key)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return namespace, nil
+}
+
+// authorize returns the status of a call rejected by the authorizer, if any.
+func (s *Server) authorize(ctx context.Context, op v2.Operation, namespace, key string) error {
+	if s.authorizer == nil {
+		return nil
+	}
+	if err := s.authorizer(ctx, op, namespace, key); err != nil {
+		if errors.Is(err, v2.ErrUnauthenticated) {
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// maxBlobBytesFor returns the maximum size of a blob in the given namespace.
+func (s *Server) maxBlobBytesFor(namespace string) uint64 {
+	if limit := s.namespaceMaxBlobBytes[namespace]; limit != 0 {
+		return limit
+	}
+	return s.maxBlobBytes
+}
+
+// blobTooLargeMessage returns the same message as the v2 HTTP API for a blob exceeding the
+// maximum size in the given namespace.
+func (s *Server) blobTooLargeMessage(namespace string, size uint64) string {
+	if limit := s.namespaceMaxBlobBytes[namespace]; limit != 0 {
+		return fmt.Sprintf("payload of %d bytes exceeds the max size of %d bytes of namespace '%s'", size, limit, namespace)
+	}
+	return fmt.Sprintf("payload of %d bytes exceeds the global max size of %d bytes", size, s.maxBlobBytes)
+}
+
+// storageError logs an error of the storage driver and returns the status sent instead, which
+// does not expose its details.
+func (s *Server) storageError(err error) error {
+	s.logger.Error(err.Error())
+	return status.Error(codes.Internal, "internal storage error")
+}
+
+// deletePartialBlob deletes a blob which failed verification after it was stored.
+func (s *Server) deletePartialBlob(key string) {
+	// the stream may have been canceled already
+	if _, err := s.driver.DeletePayload(context.Background(), &storage.DeleteRequest{Key: key}); err != nil {
+		s.logger.Error(fmt.Sprintf("unable to delete partially uploaded blob %s: %v", key, err))
+	}
+}
+
+// chunkReader reads the chunks of a PutBlob stream, up to the declared length of the blob.
+type chunkReader struct {
+	stream    lpspb.LargePayloadService_PutBlobServer
+	remaining uint64
+	chunk     []byte
+	// eof is set once the client closed the stream.
+	eof bool
+	// err is the status of a failed stream or of chunks exceeding the declared length.
+	err error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		request, err := r.stream.Recv()
+		if err == io.EOF {
+			r.eof = true
+			return 0, io.EOF
+		}
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.chunk = request.GetChunk()
+		if request.GetDescription() != nil {
+			r.err = status.Error(codes.InvalidArgument, "the description of the blob must be sent once")
+			return 0, r.err
+		}
+		if uint64(len(r.chunk)) > r.remaining {
+			r.err = status.Error(codes.InvalidArgument, "received more data than declared")
+			return 0, r.err
+		}
+		r.remaining -= uint64(len(r.chunk))
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// chunkWriter sends the data written to it in chunks of up to ChunkSize bytes.
+type chunkWriter struct {
+	stream lpspb.LargePayloadService_GetBlobServer
+	// contentLength is sent with the first chunk.
+	contentLength uint64
+	sent          bool
+	buf           []byte
+	// err is the error of a failed send.
+	err error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush sends the buffered data. The last flush sends a response even if nothing is buffered,
+// so that empty blobs are answered with their length.
+func (w *chunkWriter) flush(last bool) error {
+	if len(w.buf) == 0 && (w.sent || !last) {
+		return nil
+	}
+	response := &lpspb.GetBlobResponse{Chunk: w.buf}
+	if !w.sent {
+		response.ContentLength = w.contentLength
+	}
+	if err := w.stream.Send(response); err != nil {
+		w.err = err
+		return err
+	}
+	w.sent = true
+	w.buf = w.buf[:0]
+	return nil
+}
@@ -0,0 +1,326 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package grpc_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	lpsgrpc "github.com/DataDog/temporal-large-payload-codec/server/grpc"
+	"github.com/DataDog/temporal-large-payload-codec/server/grpc/lpspb"
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+// newClient serves the gRPC API on top of driver in memory and returns a client for it.
+func newClient(t *testing.T, driver storage.Driver, opts ...lpsgrpc.Option) lpspb.LargePayloadServiceClient {
+	listener := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	lpspb.RegisterLargePayloadServiceServer(s, lpsgrpc.NewServer(driver, opts...))
+	go func() {
+		_ = s.Serve(listener)
+	}()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return lpspb.NewLargePayloadServiceClient(conn)
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// putBlob stores data described by description in chunks of chunkSize bytes.
+func putBlob(client lpspb.LargePayloadServiceClient, description *lpspb.BlobDescription, data []byte, chunkSize int) (string, error) {
+	stream, err := client.PutBlob(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if err := stream.Send(&lpspb.PutBlobRequest{Request: &lpspb.PutBlobRequest_Description{Description: description}}); err != nil {
+		return "", err
+	}
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := stream.Send(&lpspb.PutBlobRequest{Request: &lpspb.PutBlobRequest_Chunk{Chunk: data[offset:end]}}); err == io.EOF {
+			// the server ended the stream, its status is returned by CloseAndRecv
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		return "", err
+	}
+	return response.Key, nil
+}
+
+// getBlob returns the data of a blob and the responses it was sent in.
+func getBlob(client lpspb.LargePayloadServiceClient, request *lpspb.GetBlobRequest) ([]byte, []*lpspb.GetBlobResponse, error) {
+	stream, err := client.GetBlob(context.Background(), request)
+	if err != nil {
+		return nil, nil, err
+	}
+	var data []byte
+	var responses []*lpspb.GetBlobResponse
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return data, responses, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data = append(data, response.Chunk...)
+		responses = append(responses, response)
+	}
+}
+
+func TestServer(t *testing.T) {
+	driver := &memory.Driver{}
+	client := newClient(t, driver)
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("0123456789"), lpsgrpc.ChunkSize/4)
+	description := &lpspb.BlobDescription{
+		Namespace:     "test",
+		Digest:        sha256Digest(data),
+		Metadata:      map[string][]byte{"encoding": []byte("json/plain")},
+		ContentLength: uint64(len(data)),
+	}
+	key, err := putBlob(client, description, data, 64<<10)
+	require.NoError(t, err)
+
+	// blobs are stored under the same keys as with the v2 HTTP API
+	wantKey, err := v2.ComputeKey("test", description.Digest, description.Metadata)
+	require.NoError(t, err)
+	require.Equal(t, wantKey, key)
+
+	// storing the blob again returns its key
+	key, err = putBlob(client, description, data, len(data))
+	require.NoError(t, err)
+	require.Equal(t, wantKey, key)
+
+	head, err := client.HeadBlob(ctx, &lpspb.HeadBlobRequest{Key: key})
+	require.NoError(t, err)
+	assert.True(t, head.Exists)
+	assert.Equal(t, key, head.Key)
+	assert.Equal(t, uint64(len(data)), head.ContentLength)
+	head, err = client.HeadBlob(ctx, &lpspb.HeadBlobRequest{Description: description})
+	require.NoError(t, err)
+	assert.True(t, head.Exists)
+	assert.Equal(t, key, head.Key)
+
+	// blobs are sent in bounded chunks, the first one holding the length
+	got, responses, err := getBlob(client, &lpspb.GetBlobRequest{Key: key, ExpectedContentLength: uint64(len(data))})
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	require.Len(t, responses, 3)
+	assert.Equal(t, uint64(len(data)), responses[0].ContentLength)
+	for _, response := range responses {
+		assert.LessOrEqual(t, len(response.Chunk), lpsgrpc.ChunkSize)
+	}
+
+	_, _, err = getBlob(client, &lpspb.GetBlobRequest{Key: key, ExpectedContentLength: 10})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = client.DeleteBlob(ctx, &lpspb.DeleteBlobRequest{Key: key})
+	require.NoError(t, err)
+	head, err = client.HeadBlob(ctx, &lpspb.HeadBlobRequest{Key: key})
+	require.NoError(t, err)
+	assert.False(t, head.Exists)
+	_, _, err = getBlob(client, &lpspb.GetBlobRequest{Key: key})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// keys with another layout or traversals are rejected
+	for _, invalidKey := range []string{"/backups/dump", "/blobs/test/../other/common/sha256:1234/sha256:abcd"} {
+		_, _, err = getBlob(client, &lpspb.GetBlobRequest{Key: invalidKey})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), invalidKey)
+		_, err = client.HeadBlob(ctx, &lpspb.HeadBlobRequest{Key: invalidKey})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), invalidKey)
+		_, err = client.DeleteBlob(ctx, &lpspb.DeleteBlobRequest{Key: invalidKey})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), invalidKey)
+	}
+}
+
+func TestServerEmptyBlob(t *testing.T) {
+	client := newClient(t, &memory.Driver{})
+
+	key, err := putBlob(client, &lpspb.BlobDescription{Namespace: "test", Digest: sha256Digest(nil)}, nil, 1)
+	require.NoError(t, err)
+
+	got, responses, err := getBlob(client, &lpspb.GetBlobRequest{Key: key})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	assert.Len(t, responses, 1)
+}
+
+func TestServerPutErrors(t *testing.T) {
+	data := []byte("hello world")
+
+	testCase := []struct {
+		name        string
+		description *lpspb.BlobDescription
+		data        []byte
+		code        codes.Code
+		message     string
+	}{
+		{
+			name:        "Missing namespace",
+			description: &lpspb.BlobDescription{Digest: sha256Digest(data), ContentLength: 11},
+			data:        data,
+			code:        codes.InvalidArgument,
+			message:     "namespace is required",
+		},
+		{
+			name:        "Invalid namespace",
+			description: &lpspb.BlobDescription{Namespace: "../etc", Digest: sha256Digest(data), ContentLength: 11},
+			data:        data,
+			code:        codes.InvalidArgument,
+			message:     "'../etc' is not a valid namespace: '.' and '..' are not allowed",
+		},
+		{
+			name:        "Invalid digest",
+			description: &lpspb.BlobDescription{Namespace: "test", Digest: "md5:1234", ContentLength: 11},
+			data:        data,
+			code:        codes.InvalidArgument,
+			message:     "invalid hash type 'md5'",
+		},
+		{
+			name:        "Invalid metadata",
+			description: &lpspb.BlobDescription{Namespace: "test", Digest: sha256Digest(data), ContentLength: 11, Metadata: map[string][]byte{"a b": []byte("c")}},
+			data:        data,
+			code:        codes.InvalidArgument,
+			message:     `metadata key "a b" is not valid: only letters, digits, '_', '-', '.' and '/' are allowed`,
+		},
+		{
+			name:        "Too large",
+			description: &lpspb.BlobDescription{Namespace: "test", Digest: sha256Digest(data), ContentLength: 11},
+			data:        data,
+			code:        codes.ResourceExhausted,
+			message:     "payload of 11 bytes exceeds the max size of 10 bytes of namespace 'test'",
+		},
+		{
+			name:        "Checksum mismatch",
+			description: &lpspb.BlobDescription{Namespace: "other", Digest: sha256Digest([]byte("other")), ContentLength: 11},
+			data:        data,
+			code:        codes.InvalidArgument,
+			message:     "checksum mismatch",
+		},
+		{
+			name:        "Less data than declared",
+			description: &lpspb.BlobDescription{Namespace: "other", Digest: sha256Digest(data), ContentLength: 12},
+			data:        data,
+			code:        codes.InvalidArgument,
+			message:     "received 11 bytes, but 12 bytes were declared",
+		},
+		{
+			name:        "More data than declared",
+			description: &lpspb.BlobDescription{Namespace: "other", Digest: sha256Digest(data), ContentLength: 10},
+			data:        data,
+			code:        codes.InvalidArgument,
+			message:     "received more data than declared",
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			driver := &memory.Driver{}
+			client := newClient(t, driver, lpsgrpc.WithNamespaceMaxBlobBytes(map[string]uint64{"test": 10}))
+
+			_, err := putBlob(client, scenario.description, scenario.data, 4)
+			require.Error(t, err)
+			assert.Equal(t, scenario.code, status.Code(err))
+			assert.Equal(t, scenario.message, status.Convert(err).Message())
+
+			// blobs failing verification are deleted
+			if key, err := v2.ComputeKey(scenario.description.Namespace, scenario.description.Digest, nil); err == nil {
+				exists, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: key})
+				require.NoError(t, err)
+				assert.False(t, exists.Exists)
+			}
+		})
+	}
+}
+
+func TestServerAuthorizer(t *testing.T) {
+	type access struct {
+		op        v2.Operation
+		namespace string
+		key       string
+	}
+	var accesses []access
+	authorizer := func(_ context.Context, op v2.Operation, namespace, key string) error {
+		accesses = append(accesses, access{op: op, namespace: namespace, key: key})
+		switch {
+		case namespace == "anonymous":
+			return fmt.Errorf("%w: missing credentials", v2.ErrUnauthenticated)
+		case op == v2.OperationDelete:
+			return errors.New("blobs cannot be deleted")
+		}
+		return nil
+	}
+	driver := &memory.Driver{}
+	client := newClient(t, driver, lpsgrpc.WithAuthorizer(authorizer))
+	ctx := context.Background()
+	data := []byte("hello world")
+
+	key, err := putBlob(client, &lpspb.BlobDescription{Namespace: "test", Digest: sha256Digest(data), ContentLength: uint64(len(data))}, data, 4)
+	require.NoError(t, err)
+	got, _, err := getBlob(client, &lpspb.GetBlobRequest{Key: key})
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	head, err := client.HeadBlob(ctx, &lpspb.HeadBlobRequest{Key: key})
+	require.NoError(t, err)
+	assert.True(t, head.Exists)
+
+	_, err = client.DeleteBlob(ctx, &lpspb.DeleteBlobRequest{Key: key})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, "blobs cannot be deleted", status.Convert(err).Message())
+	exists, err := driver.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+	require.NoError(t, err)
+	assert.True(t, exists.Exists)
+
+	_, err = putBlob(client, &lpspb.BlobDescription{Namespace: "anonymous", Digest: sha256Digest(data), ContentLength: uint64(len(data))}, data, 4)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, "unauthenticated: missing credentials", status.Convert(err).Message())
+
+	anonymousKey, err := v2.ComputeKey("anonymous", sha256Digest(data), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []access{
+		{op: v2.OperationPut, namespace: "test", key: key},
+		{op: v2.OperationGet, namespace: "test", key: key},
+		{op: v2.OperationHead, namespace: "test", key: key},
+		{op: v2.OperationDelete, namespace: "test", key: key},
+		{op: v2.OperationPut, namespace: "anonymous", key: anonymousKey},
+	}, accesses)
+}
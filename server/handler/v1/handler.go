@@ -11,10 +11,15 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/DataDog/temporal-large-payload-codec/server/internal/limit"
 	"github.com/DataDog/temporal-large-payload-codec/server/logging"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 )
 
+// defaultMaxBlobBytes is the maximum size of a blob accepted by the handler unless
+// configured otherwise.
+const defaultMaxBlobBytes = 1024 * 1024 * 1024 // 1 GB
+
 // NewHandler creates a v1 HTTP handler for the Large Payload Service.
 //
 // Deprecated: This handler exists for backwards compatibility in order to
@@ -24,7 +29,7 @@ func NewHandler(driver storage.Driver, logger logging.Logger) http.Handler {
 	r := http.NewServeMux()
 	handler := &blobHandler{
 		driver,
-		1024 * 1024 * 1024, // 1 GB
+		defaultMaxBlobBytes,
 		logger,
 	}
 
@@ -73,10 +78,13 @@ func (b *blobHandler) getBlob(w http.ResponseWriter, r *http.Request) {
 		b.handleError(w, fmt.Errorf("expected content length header %s is invalid: %w", expectedLengthHeader, err), http.StatusBadRequest)
 		return
 	}
+	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Length", strconv.FormatUint(expectedLength, 10))
 
 	if _, err := b.driver.GetPayload(r.Context(), &storage.GetRequest{Key: b.computeKey(digest), Writer: w}); err != nil {
-		w.Header().Del("Content-Length") // unset Content-Length on errors
+		// unset Content-Type and Content-Length on errors
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
 
 		var blobNotFound *storage.ErrBlobNotFound
 		if errors.As(err, &blobNotFound) {
@@ -116,12 +124,17 @@ func (b *blobHandler) putBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body := &limit.Reader{R: r.Body, Remaining: b.maxBlobBytes, Err: errBlobTooLarge}
 	result, err := b.driver.PutPayload(r.Context(), &storage.PutRequest{
-		Data:          r.Body,
+		Data:          body,
 		Key:           b.computeKey(digest),
 		Digest:        digest,
 		ContentLength: contentLength,
 	})
+	if body.Exceeded {
+		b.handleError(w, fmt.Errorf("payload exceeds max size of %d bytes", b.maxBlobBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		b.handleError(w, err, http.StatusInternalServerError)
 		return
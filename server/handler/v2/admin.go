@@ -0,0 +1,79 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+// deleteByPrefixResponse is the response of DELETE /v2/admin/blobs.
+type deleteByPrefixResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// deleteBlobsByPrefix deletes the blobs of a namespace whose keys start with
+// /blobs/<namespace>/ followed by the prefix query parameter, e.g. when the namespace is
+// decommissioned. To avoid accidental wipes, the confirm query parameter must be true and the
+// endpoint is only served if an Authorizer is configured, which authorizes
+// OperationDeleteByPrefix with the prefix as key. Since deletions may take minutes, their
+// progress is logged.
+func (b *blobHandler) deleteBlobsByPrefix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+	if b.authorizer == nil {
+		b.handleError(w, errors.New("admin endpoints require an authorizer"), http.StatusForbidden)
+		return
+	}
+	deleter, ok := b.driver.(storage.PrefixDeleter)
+	if !ok {
+		b.handleError(w, errors.New("storage driver does not support deleting blobs by prefix"), http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	namespace, ok := b.namespaceParam(w, r)
+	if !ok {
+		return
+	}
+	if query.Get("confirm") != "true" {
+		b.handleError(w, errors.New("confirm query parameter must be true to delete blobs by prefix"), http.StatusBadRequest)
+		return
+	}
+
+	prefix := fmt.Sprintf("/blobs/%s/%s", namespace, query.Get("prefix"))
+	if !b.authorize(w, r, OperationDeleteByPrefix, namespace, prefix) {
+		return
+	}
+
+	logger := b.requestLogger(w)
+	logger.Info("deleting blobs by prefix", "prefix", prefix)
+	deleted, err := deleter.DeleteByPrefix(r.Context(), &storage.DeleteByPrefixRequest{
+		Prefix: prefix,
+		Progress: func(deleted int) {
+			logger.Info("deleting blobs by prefix", "prefix", prefix, "deleted", deleted)
+		},
+	})
+	// the usage is listed again rather than tracking the size of each deleted blob
+	b.quotas.reset(namespace)
+	if err != nil {
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	logger.Info("deleted blobs by prefix", "prefix", prefix, "deleted", deleted.Deleted)
+	b.events.send(r.Context(), Event{Operation: OperationDeleteByPrefix, Namespace: namespace, Key: prefix})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(deleteByPrefixResponse{Deleted: deleted.Deleted}); err != nil {
+		logger.Error(err.Error())
+	}
+}
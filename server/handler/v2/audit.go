@@ -0,0 +1,75 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Access is an access of a request to a blob, as checked by the Authorizer.
+type Access struct {
+	Operation Operation
+	Namespace string
+	Key       string
+	// Status is the HTTP response status code with which the access was rejected by the
+	// Authorizer, or zero if it was authorized.
+	Status int
+}
+
+// AuditRecord collects the principal and the accesses to blobs of a request for audit logs.
+// It is attached to the context of the request with ContextWithAuditRecord.
+type AuditRecord struct {
+	mu        sync.Mutex
+	principal string
+	accesses  []Access
+}
+
+// Principal returns the principal set with SetPrincipal, or an empty string.
+func (a *AuditRecord) Principal() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.principal
+}
+
+// Accesses returns the accesses to blobs checked for the request, in order. Batches access
+// several blobs, while requests rejected before their access is checked, e.g. for invalid
+// parameters, access none.
+func (a *AuditRecord) Accesses() []Access {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Access(nil), a.accesses...)
+}
+
+func (a *AuditRecord) add(access Access) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accesses = append(a.accesses, access)
+}
+
+type auditRecordKey struct{}
+
+// ContextWithAuditRecord returns a copy of ctx holding record, to which the handler adds the
+// accesses of the request.
+func ContextWithAuditRecord(ctx context.Context, record *AuditRecord) context.Context {
+	return context.WithValue(ctx, auditRecordKey{}, record)
+}
+
+// auditRecordFromContext returns the record set with ContextWithAuditRecord, or nil.
+func auditRecordFromContext(ctx context.Context) *AuditRecord {
+	record, _ := ctx.Value(auditRecordKey{}).(*AuditRecord)
+	return record
+}
+
+// SetPrincipal records the principal which sent r in its audit record, e.g. the name of a
+// client identified by an Authorizer. It does nothing if the request is not audited.
+func SetPrincipal(r *http.Request, principal string) {
+	if record := auditRecordFromContext(r.Context()); record != nil {
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		record.principal = principal
+	}
+}
@@ -0,0 +1,94 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Operation is the kind of access to a blob requested from the handler, see Authorizer.
+type Operation string
+
+const (
+	// OperationPut stores a blob, including presigned uploads.
+	OperationPut Operation = "put"
+	// OperationGet retrieves a blob, including batches and presigned downloads.
+	OperationGet Operation = "get"
+	// OperationHead checks whether a blob exists.
+	OperationHead Operation = "head"
+	// OperationDelete removes a blob.
+	OperationDelete Operation = "delete"
+	// OperationList lists the blobs of a namespace, the key being the listed key prefix.
+	OperationList Operation = "list"
+	// OperationDeleteByPrefix removes all blobs of a namespace whose keys start with a prefix,
+	// the key being the prefix.
+	OperationDeleteByPrefix Operation = "delete-by-prefix"
+)
+
+// ErrUnauthenticated is wrapped by the errors of an Authorizer for requests without valid
+// credentials, which are rejected with the HTTP response status code 401 instead of 403.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Authorizer decides whether a request may perform op on the blob with the given key in the
+// given namespace, returning a non-nil error to reject it. The namespace of requests which
+// identify a blob by its key is taken from the key, and is empty if the key was not computed
+// by ComputeKey.
+//
+// Rejected requests are answered with the HTTP response status code 403 and the message of
+// the error, or 401 if the error wraps ErrUnauthenticated.
+type Authorizer func(r *http.Request, op Operation, namespace, key string) error
+
+// authorize checks whether the request may perform op on the blob with the given key,
+// writing an error response if it may not.
+func (b *blobHandler) authorize(w http.ResponseWriter, r *http.Request, op Operation, namespace, key string) bool {
+	if err := b.checkAuthorization(r, op, namespace, key); err != nil {
+		b.handleError(w, err, authorizationStatus(err))
+		return false
+	}
+	return true
+}
+
+// checkAuthorization returns the error of the authorizer for the request, if any, and adds
+// the access to the audit record of the request.
+func (b *blobHandler) checkAuthorization(r *http.Request, op Operation, namespace, key string) error {
+	var err error
+	if b.authorizer != nil {
+		err = b.authorizer(r, op, namespace, key)
+	}
+	if record := auditRecordFromContext(r.Context()); record != nil {
+		access := Access{Operation: op, Namespace: namespace, Key: key}
+		if err != nil {
+			access.Status = authorizationStatus(err)
+		}
+		record.add(access)
+	}
+	return err
+}
+
+// authorizationStatus returns the HTTP response status code of a request rejected by an
+// Authorizer with err.
+func authorizationStatus(err error) int {
+	if errors.Is(err, ErrUnauthenticated) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+// ParseKey returns the namespace and data digest of a key computed by ComputeKey, or an error
+// if key has a different format.
+func ParseKey(key string) (namespace string, digest string, err error) {
+	tokens := strings.Split(key, "/")
+	// /blobs/<namespace>/common/<digest>/<metadata hash> or
+	// /blobs/<namespace>/custom/<prefix>/<digest>/<metadata hash> with a prefix of one or more tokens
+	valid := len(tokens) >= 6 && tokens[0] == "" && tokens[1] == "blobs" && tokens[2] != "" &&
+		(tokens[3] == "common" && len(tokens) == 6 || tokens[3] == "custom" && len(tokens) >= 7)
+	if !valid || !strings.Contains(tokens[len(tokens)-2], ":") {
+		return "", "", fmt.Errorf("'%s' is not a valid v2 key", key)
+	}
+	return tokens[2], tokens[len(tokens)-2], nil
+}
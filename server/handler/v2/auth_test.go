@@ -0,0 +1,75 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseKey(t *testing.T) {
+	testCase := []struct {
+		name        string
+		key         string
+		namespace   string
+		digest      string
+		expectError bool
+	}{
+		{
+			name:      "no prefix",
+			key:       "/blobs/foo/common/sha256:1234/sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			namespace: "foo",
+			digest:    "sha256:1234",
+		},
+		{
+			name:      "prefix",
+			key:       "/blobs/foo/custom/a/b/c/sha256:1234/sha256:02b711154c4e88a46ff26dc96f492ce38c8c9fe00f3b6b2ea1ef6c209a2f3bd7",
+			namespace: "foo",
+			digest:    "sha256:1234",
+		},
+		{
+			name:        "missing prefix",
+			key:         "/blobs/foo/custom/sha256:1234/sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			expectError: true,
+		},
+		{
+			name:        "missing namespace",
+			key:         "/blobs//common/sha256:1234/sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			expectError: true,
+		},
+		{
+			name:        "v1 key",
+			key:         "blobs/sha256:1234",
+			expectError: true,
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			namespace, digest, err := ParseKey(scenario.key)
+			if scenario.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, scenario.namespace, namespace)
+			assert.Equal(t, scenario.digest, digest)
+		})
+	}
+}
+
+func Test_ParseKey_inverts_ComputeKey(t *testing.T) {
+	for _, meta := range []map[string][]byte{{}, {KeyPrefixMetadataKey: []byte("a/b/c")}} {
+		key, err := ComputeKey("foo", "sha256:1234", meta)
+		require.NoError(t, err)
+
+		namespace, digest, err := ParseKey(key)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", namespace)
+		assert.Equal(t, "sha256:1234", digest)
+	}
+}
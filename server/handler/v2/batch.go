@@ -0,0 +1,129 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// maxBatchKeys is the maximum number of blobs which can be requested in a single batch.
+	maxBatchKeys = 1000
+	// maxBatchRequestBytes is the maximum size of the JSON body of a batch request.
+	maxBatchRequestBytes = 1024 * 1024
+)
+
+// batchGetRequest is the body of a request to the get-batch endpoint.
+type batchGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// getBlobBatch writes the blobs with the requested keys as a multipart/mixed response,
+// with one part per key in the order of the request. Each part carries the key in the
+// X-Payload-Key header and a per-blob status code in the X-Payload-Status header. Parts of
+// blobs which were found also carry the digest of the blob in the X-Payload-Digest header.
+func (b *blobHandler) getBlobBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		b.handleError(w, fmt.Errorf("missing or incorrect Content-Type header"), http.StatusBadRequest)
+		return
+	}
+
+	var req batchGetRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequestBytes)).Decode(&req); err != nil {
+		b.handleError(w, fmt.Errorf("invalid batch request: %w", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Keys) == 0 {
+		b.handleError(w, errors.New("keys are required"), http.StatusBadRequest)
+		return
+	}
+	if len(req.Keys) > maxBatchKeys {
+		b.handleError(w, fmt.Errorf("batch exceeds max size of %d keys", maxBatchKeys), http.StatusBadRequest)
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusOK)
+
+	// blobs are buffered to send their digest and length ahead of the data
+	var buf bytes.Buffer
+	for _, key := range req.Keys {
+		buf.Reset()
+		header := textproto.MIMEHeader{}
+		header.Set("X-Payload-Key", key)
+
+		if namespace, status, err := b.checkKey(r, key); err != nil {
+			b.writeBatchError(header, &buf, err, status)
+		} else if err := b.checkAuthorization(r, OperationGet, namespace, key); err != nil {
+			b.writeBatchError(header, &buf, err, authorizationStatus(err))
+		} else {
+			b.getBatchPart(r.Context(), key, header, &buf)
+		}
+
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			b.requestLogger(w).Error(fmt.Sprintf("unable to write batch response: %v", err))
+			return
+		}
+		if _, err := part.Write(buf.Bytes()); err != nil {
+			b.requestLogger(w).Error(fmt.Sprintf("unable to write batch response: %v", err))
+			return
+		}
+	}
+	if err := mw.Close(); err != nil {
+		b.requestLogger(w).Error(fmt.Sprintf("unable to write batch response: %v", err))
+	}
+}
+
+// getBatchPart writes the blob with the given key to buf and sets the headers of its part in
+// the batch response, writing the error message instead if it cannot be retrieved.
+func (b *blobHandler) getBatchPart(ctx context.Context, key string, header textproto.MIMEHeader, buf *bytes.Buffer) {
+	_, err := b.driver.GetPayload(ctx, &storage.GetRequest{Key: key, Writer: buf})
+	var blobNotFound *storage.ErrBlobNotFound
+	switch {
+	case err == nil:
+		sum := sha256.Sum256(buf.Bytes())
+		header.Set("X-Payload-Status", strconv.Itoa(http.StatusOK))
+		header.Set("X-Payload-Digest", "sha256:"+hex.EncodeToString(sum[:]))
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	case errors.As(err, &blobNotFound):
+		buf.Reset()
+		b.writeBatchError(header, buf, &storage.ErrBlobNotFound{Err: fmt.Errorf("key %s", key)}, http.StatusNotFound)
+	default:
+		withRequestID(b.logger, RequestIDFromContext(ctx)).Error(fmt.Sprintf("unable to get blob %s: %v", key, err))
+		buf.Reset()
+		b.writeBatchError(header, buf, err, http.StatusInternalServerError)
+	}
+}
+
+// writeBatchError writes err to buf as the body of a part of the batch response, which is
+// sent like the error response of a single request with the given status code.
+func (b *blobHandler) writeBatchError(header textproto.MIMEHeader, buf *bytes.Buffer, err error, statusCode int) {
+	// the request ID is sent with the whole batch response
+	contentType, body := b.errorBody(err, statusCode, "")
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("X-Payload-Status", strconv.Itoa(statusCode))
+	buf.Write(body)
+}
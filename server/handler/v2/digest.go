@@ -0,0 +1,134 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	hashesMu sync.RWMutex
+	// hashes are the digest algorithms accepted on upload, see RegisterHash.
+	hashes = map[string]func() hash.Hash{
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+)
+
+// RegisterHash registers a digest algorithm in addition to sha256 and sha512, so that blobs whose
+// digest has the form <algorithm>:<hex encoded value> are accepted and verified on upload,
+// e.g. for codecs configured with a custom digest algorithm.
+//
+// RegisterHash panics if the algorithm is registered already or its name is invalid.
+func RegisterHash(algorithm string, newHash func() hash.Hash) {
+	if algorithm == "" || strings.Contains(algorithm, ":") {
+		panic(fmt.Sprintf("v2: invalid digest algorithm '%s'", algorithm))
+	}
+	if newHash == nil {
+		panic("v2: hash constructor cannot be nil")
+	}
+
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+	if _, ok := hashes[algorithm]; ok {
+		panic(fmt.Sprintf("v2: digest algorithm '%s' is registered already", algorithm))
+	}
+	hashes[algorithm] = newHash
+}
+
+// newHash returns a hash of the given digest algorithm, if it is registered.
+func newHash(algorithm string) (hash.Hash, bool) {
+	hashesMu.RLock()
+	defer hashesMu.RUnlock()
+	newHash, ok := hashes[algorithm]
+	if !ok {
+		return nil, false
+	}
+	return newHash(), true
+}
+
+// isDigestValue returns whether value is the lower case hex encoding of a checksum of h.
+func isDigestValue(value string, h hash.Hash) bool {
+	if len(value) != hex.EncodedLen(h.Size()) || strings.ToLower(value) != value {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// digestVerifiedTrailer is the trailer of the responses of /v2/blobs/get telling whether the
+// sent data matches the digest of the blob.
+const digestVerifiedTrailer = "X-Payload-Digest-Verified"
+
+// digestVerifier computes the checksum of the data of a blob, to verify it against the digest
+// in the key of the blob.
+type digestVerifier struct {
+	hash hash.Hash
+	// digest is the hex encoded value of the digest.
+	digest string
+}
+
+// digestVerifier returns a verifier of the blob with the given key, or nil if digests are not
+// verified or the key does not hold a known digest, e.g. for keys of v1 blobs.
+func (b *blobHandler) digestVerifier(key string) *digestVerifier {
+	if !b.verifyDigests {
+		return nil
+	}
+	_, digest, err := ParseKey(key)
+	if err != nil {
+		return nil
+	}
+	value, h, err := ParseDigest(digest)
+	if err != nil {
+		return nil
+	}
+	return &digestVerifier{hash: h, digest: value}
+}
+
+// verify tells whether the data written to the hash matches the digest.
+func (v *digestVerifier) verify() bool {
+	return hex.EncodeToString(v.hash.Sum(nil)) == v.digest
+}
+
+// acceptsTrailers tells whether the client accepts trailers with the TE header.
+func acceptsTrailers(r *http.Request) bool {
+	for _, value := range r.Header.Values("TE") {
+		for _, coding := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyingReader hashes the data read from r, and fails with errChecksumMismatch instead of
+// returning io.EOF if its checksum is not digest, the hex encoded value. Drivers storing blobs
+// atomically then discard the data rather than replace an existing blob with it.
+type verifyingReader struct {
+	r      io.Reader
+	hasher hash.Hash
+	digest string
+	// mismatch is set once r was read entirely with a different checksum.
+	mismatch bool
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hasher.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hasher.Sum(nil)) != v.digest {
+		v.mismatch = true
+		return n, errChecksumMismatch
+	}
+	return n, err
+}
@@ -0,0 +1,55 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"hash"
+	"hash/fnv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_digestAndHash_accepts_registered_algorithms(t *testing.T) {
+	h := blobHandler{}
+
+	_, _, err := h.digestAndHash("fnv64a-test:cafebabecafebabe")
+	require.EqualError(t, err, "invalid hash type 'fnv64a-test'")
+
+	RegisterHash("fnv64a-test", func() hash.Hash { return fnv.New64a() })
+	digest, hasher, err := h.digestAndHash("fnv64a-test:cafebabecafebabe")
+	require.NoError(t, err)
+	assert.Equal(t, "cafebabecafebabe", digest)
+	assert.Equal(t, 8, hasher.Size())
+
+	for alg, size := range map[string]int{"sha256": 32, "sha512": 64} {
+		value := strings.Repeat("be", size)
+		digest, hasher, err = h.digestAndHash(alg + ":" + value)
+		require.NoError(t, err)
+		assert.Equal(t, value, digest)
+		assert.Equal(t, size, hasher.Size())
+	}
+
+	assert.Panics(t, func() { RegisterHash("fnv64a-test", func() hash.Hash { return fnv.New64a() }) })
+	assert.Panics(t, func() { RegisterHash("sha256", func() hash.Hash { return fnv.New64a() }) })
+	assert.Panics(t, func() { RegisterHash("a:b", func() hash.Hash { return fnv.New64a() }) })
+	assert.Panics(t, func() { RegisterHash("other", nil) })
+}
+
+func Test_digestAndHash_rejects_invalid_values(t *testing.T) {
+	h := blobHandler{}
+	for _, digest := range []string{
+		"sha256:beef",
+		"sha256:" + strings.Repeat("be", 64),
+		"sha512:" + strings.Repeat("be", 32),
+		"sha256:" + strings.Repeat("BE", 32),
+		"sha256:" + strings.Repeat("xy", 32),
+	} {
+		_, _, err := h.digestAndHash(digest)
+		assert.Error(t, err, digest)
+	}
+}
@@ -0,0 +1,222 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/internal/response"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+// ErrorCode is the machine-readable code of an error response, see ErrorResponse.
+type ErrorCode string
+
+const (
+	// ErrorCodeInvalidRequest is sent for requests with missing or invalid parameters or headers.
+	ErrorCodeInvalidRequest ErrorCode = "INVALID_REQUEST"
+	// ErrorCodeInvalidDigest is sent for digests with an unknown algorithm or an invalid value.
+	ErrorCodeInvalidDigest ErrorCode = "INVALID_DIGEST"
+	// ErrorCodeInvalidKey is sent for keys with an unexpected layout or invalid characters.
+	ErrorCodeInvalidKey ErrorCode = "INVALID_KEY"
+	// ErrorCodeInvalidNamespace is sent for namespaces with invalid characters, see
+	// ValidateNamespace.
+	ErrorCodeInvalidNamespace ErrorCode = "INVALID_NAMESPACE"
+	// ErrorCodeInvalidMetadata is sent for Temporal metadata with invalid keys or too long
+	// values, see ValidateMetadata. The message names the offending key.
+	ErrorCodeInvalidMetadata ErrorCode = "INVALID_METADATA"
+	// ErrorCodeChecksumMismatch is sent if uploaded data does not match its digest.
+	ErrorCodeChecksumMismatch ErrorCode = "CHECKSUM_MISMATCH"
+	// ErrorCodePayloadTooLarge is sent for blobs exceeding the maximum blob size, the message
+	// holds the limit as "max size of N bytes".
+	ErrorCodePayloadTooLarge ErrorCode = "PAYLOAD_TOO_LARGE"
+	// ErrorCodeLengthRequired is sent for uploads without a Content-Length header.
+	ErrorCodeLengthRequired ErrorCode = "LENGTH_REQUIRED"
+	// ErrorCodeLengthMismatch is sent if a stored blob does not have the expected size.
+	ErrorCodeLengthMismatch ErrorCode = "LENGTH_MISMATCH"
+	// ErrorCodeRangeNotSatisfiable is sent for ranges starting beyond the end of a blob.
+	ErrorCodeRangeNotSatisfiable ErrorCode = "RANGE_NOT_SATISFIABLE"
+	// ErrorCodeBlobNotFound is sent if the requested blob does not exist.
+	ErrorCodeBlobNotFound ErrorCode = "BLOB_NOT_FOUND"
+	// ErrorCodeUploadSessionNotFound is sent if an upload session does not exist, e.g. because it
+	// expired.
+	ErrorCodeUploadSessionNotFound ErrorCode = "UPLOAD_SESSION_NOT_FOUND"
+	// ErrorCodeConflict is sent for requests conflicting with concurrent ones.
+	ErrorCodeConflict ErrorCode = "CONFLICT"
+	// ErrorCodeKeyCollision is sent for uploads whose key holds a different blob, if the handler
+	// verifies existing blobs. The response holds the digests of both blobs, if known.
+	ErrorCodeKeyCollision ErrorCode = "KEY_COLLISION"
+	// ErrorCodeUnauthenticated is sent for requests without valid credentials.
+	ErrorCodeUnauthenticated ErrorCode = "UNAUTHENTICATED"
+	// ErrorCodeForbidden is sent for requests rejected by the Authorizer.
+	ErrorCodeForbidden ErrorCode = "FORBIDDEN"
+	// ErrorCodeMethodNotAllowed is sent for requests with an unsupported HTTP method.
+	ErrorCodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+	// ErrorCodeNotSupported is sent for features which the storage driver does not support.
+	ErrorCodeNotSupported ErrorCode = "NOT_SUPPORTED"
+	// ErrorCodeStorageError is sent if the storage driver failed. The details are logged, but
+	// not sent to clients.
+	ErrorCodeStorageError ErrorCode = "STORAGE_ERROR"
+	// ErrorCodeStorageUnavailable is sent by the readiness endpoint if the storage driver is
+	// not usable.
+	ErrorCodeStorageUnavailable ErrorCode = "STORAGE_UNAVAILABLE"
+	// ErrorCodeServerBusy is sent if the server has too many requests in flight, which may be
+	// retried after the period of the Retry-After header.
+	ErrorCodeServerBusy ErrorCode = "SERVER_BUSY"
+	// ErrorCodeQuotaExceeded is sent for blobs exceeding the storage quota of their namespace,
+	// the message holds its current usage.
+	ErrorCodeQuotaExceeded ErrorCode = "QUOTA_EXCEEDED"
+	// ErrorCodeInternal is sent for unexpected errors of the server.
+	ErrorCodeInternal ErrorCode = "INTERNAL_ERROR"
+)
+
+// statusErrorCodes are the codes of errors sent with a status code, unless the error has a
+// more specific code.
+var statusErrorCodes = map[int]ErrorCode{
+	http.StatusBadRequest:                   ErrorCodeInvalidRequest,
+	http.StatusUnauthorized:                 ErrorCodeUnauthenticated,
+	http.StatusForbidden:                    ErrorCodeForbidden,
+	http.StatusNotFound:                     ErrorCodeBlobNotFound,
+	http.StatusMethodNotAllowed:             ErrorCodeMethodNotAllowed,
+	http.StatusConflict:                     ErrorCodeConflict,
+	http.StatusLengthRequired:               ErrorCodeLengthRequired,
+	http.StatusPreconditionFailed:           ErrorCodeLengthMismatch,
+	http.StatusRequestEntityTooLarge:        ErrorCodePayloadTooLarge,
+	http.StatusRequestedRangeNotSatisfiable: ErrorCodeRangeNotSatisfiable,
+	http.StatusInternalServerError:          ErrorCodeStorageError,
+	http.StatusNotImplemented:               ErrorCodeNotSupported,
+	http.StatusServiceUnavailable:           ErrorCodeStorageUnavailable,
+	http.StatusInsufficientStorage:          ErrorCodeQuotaExceeded,
+}
+
+// hiddenErrorMessages replace the messages of errors which may expose internal details, such
+// as bucket names, to clients.
+var hiddenErrorMessages = map[ErrorCode]string{
+	ErrorCodeStorageError:       "internal storage error",
+	ErrorCodeStorageUnavailable: "storage driver is not ready",
+	ErrorCodeInternal:           "internal server error",
+}
+
+// ErrorResponse is the JSON body of error responses.
+type ErrorResponse struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// RequestID is the ID of the request, if it has one, see RequestIDHeader.
+	RequestID string `json:"requestId,omitempty"`
+	// RequestedDigest and StoredDigest are the digests of the uploaded blob and of the blob
+	// stored under its key, for KEY_COLLISION errors. StoredDigest is empty if the driver did
+	// not record it.
+	RequestedDigest string `json:"requestedDigest,omitempty"`
+	StoredDigest    string `json:"storedDigest,omitempty"`
+}
+
+// codedError is an error sent with a code which differs from the one of its status code.
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withCode returns err, to be sent with the given code.
+func withCode(code ErrorCode, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// SetRetryAfter sets the Retry-After header of an overload response, asking clients to wait
+// for d before retrying. The delay is rounded up to whole seconds, and is at least a second.
+func SetRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// errChecksumMismatch is sent if uploaded data does not match its digest.
+var errChecksumMismatch = withCode(ErrorCodeChecksumMismatch, errors.New("checksum mismatch"))
+
+// errorResponse returns the code and message sent to clients for err, which may be nil, with
+// the given status code.
+func errorResponse(err error, statusCode int) ErrorResponse {
+	code, ok := statusErrorCodes[statusCode]
+	if !ok {
+		code = ErrorCodeInternal
+	}
+	var coded *codedError
+	if errors.As(err, &coded) {
+		code = coded.code
+	}
+
+	message := http.StatusText(statusCode)
+	if hidden, ok := hiddenErrorMessages[code]; ok {
+		message = hidden
+	} else if err != nil {
+		message = err.Error()
+	}
+	resp := ErrorResponse{Code: code, Message: message}
+	var collision *collisionError
+	if errors.As(err, &collision) {
+		resp.RequestedDigest = collision.requestedDigest
+		resp.StoredDigest = collision.storedDigest
+	}
+	return resp
+}
+
+// errorBody returns the content type and body of the response for err, which may be nil, with
+// the given status code. Unless the handler sends plain text errors, the body is a JSON encoded
+// ErrorResponse including the request ID, if any.
+func (b *blobHandler) errorBody(err error, statusCode int, requestID string) (string, []byte) {
+	if b.plainTextErrors {
+		if err == nil {
+			return "", nil
+		}
+		return "", []byte(err.Error())
+	}
+	resp := errorResponse(err, statusCode)
+	resp.RequestID = requestID
+	body, _ := json.Marshal(resp)
+	return "application/json", body
+}
+
+// handleError logs err, which may be nil, and sends it with the given status code unless the
+// response was started already.
+func (b *blobHandler) handleError(w http.ResponseWriter, err error, statusCode int) {
+	// drivers implementing an optional interface may not support it for all blobs
+	if errors.Is(err, storage.ErrNotSupported) {
+		statusCode = http.StatusNotImplemented
+	}
+	if err != nil {
+		b.requestLogger(w).Error(err.Error())
+	}
+	b.writeError(w, err, statusCode)
+}
+
+// writeError sends err, which may be nil, with the given status code unless the response was
+// started already.
+func (b *blobHandler) writeError(w http.ResponseWriter, err error, statusCode int) {
+	if response.Started(w) {
+		// the response, e.g. a partially sent blob, cannot be replaced by the error anymore
+		return
+	}
+	contentType, body := b.errorBody(err, statusCode, w.Header().Get(RequestIDHeader))
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(statusCode)
+	if len(body) != 0 {
+		_, _ = w.Write(body)
+	}
+}
@@ -0,0 +1,88 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"context"
+	"time"
+
+	"go.temporal.io/sdk/client"
+)
+
+const (
+	// DefaultEventQueueSize is the number of events waiting for the EventSink beyond which
+	// further events are dropped, unless configured otherwise.
+	DefaultEventQueueSize = 1000
+
+	// metricEventsDroppedTotal is the number of events dropped because the queue was full.
+	metricEventsDroppedTotal = "lps_events_dropped_total"
+	metricTagOperation       = "operation"
+)
+
+// Event is a change of the blobs stored through the handler, see EventSink.
+type Event struct {
+	// Operation is OperationPut for stored blobs, OperationDelete for deleted ones and
+	// OperationDeleteByPrefix for the deletion of the blobs whose keys start with Key.
+	Operation Operation `json:"operation"`
+	Namespace string    `json:"namespace"`
+	Key       string    `json:"key"`
+	// Size is the number of bytes of the blob, or zero for deletions by prefix.
+	Size uint64 `json:"size"`
+	// Digest is the digest of the blob in the format <algorithm>:<hex encoded value>, or
+	// empty if the key of a deleted blob does not hold it.
+	Digest string `json:"digest,omitempty"`
+	// Time is the time at which the operation completed.
+	Time time.Time `json:"time"`
+}
+
+// EventSink is called with an Event after each blob stored or deleted through the handler,
+// e.g. to feed an inventory of the blobs. Uploads of blobs which exist already and presigned
+// uploads, which bypass the handler, do not send events.
+//
+// Events are sent one at a time from a goroutine of the handler, so that slow sinks do not
+// delay the requests. The context holds the ID of the request if request IDs are enabled.
+type EventSink func(ctx context.Context, event Event)
+
+// eventQueue passes events to an EventSink from its own goroutine. Events sent while the
+// queue is full are dropped and counted.
+type eventQueue struct {
+	events         chan queuedEvent
+	metricsHandler client.MetricsHandler
+}
+
+type queuedEvent struct {
+	requestID string
+	event     Event
+}
+
+// newEventQueue returns a queue of up to size events passed to sink, or nil if sink is nil.
+func newEventQueue(sink EventSink, size int, metricsHandler client.MetricsHandler) *eventQueue {
+	if sink == nil {
+		return nil
+	}
+	q := &eventQueue{events: make(chan queuedEvent, size), metricsHandler: metricsHandler}
+	go func() {
+		for e := range q.events {
+			sink(ContextWithRequestID(context.Background(), e.requestID), e.event)
+		}
+	}()
+	return q
+}
+
+// send queues event unless the queue is full. It does nothing if q is nil.
+func (q *eventQueue) send(ctx context.Context, event Event) {
+	if q == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case q.events <- queuedEvent{requestID: RequestIDFromContext(ctx), event: event}:
+	default:
+		q.metricsHandler.WithTags(map[string]string{
+			metricTagNamespace: event.Namespace,
+			metricTagOperation: string(event.Operation),
+		}).Counter(metricEventsDroppedTotal).Inc(1)
+	}
+}
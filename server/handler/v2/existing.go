@@ -0,0 +1,120 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+// collisionError is sent for uploads whose key holds a different blob.
+type collisionError struct {
+	key             string
+	requestedDigest string
+	storedDigest    string
+	reason          string
+}
+
+func (e *collisionError) Error() string {
+	return fmt.Sprintf("blob %s already exists with different content: %s", e.key, e.reason)
+}
+
+// checkExisting returns a KEY_COLLISION error and 409 Conflict if the handler verifies
+// existing blobs and the blob stored under key does not match the uploaded blob with the given
+// digest, size and Temporal metadata, or an error and its status code if the stored blob
+// cannot be described.
+//
+// Keys are computed from the digest and metadata of blobs, so this only happens if the object
+// store was modified outside of the server, e.g. by a botched restore. Returning the key would
+// make the codec fail to verify the digest of the blob when downloading it, with no hint why.
+func (b *blobHandler) checkExisting(r *http.Request, key, digest string, contentLength uint64, metadata map[string][]byte, existing *storage.ExistResponse) (int, error) {
+	if !b.verifyExisting {
+		return 0, nil
+	}
+	collision := func(storedDigest, reason string, args ...interface{}) (int, error) {
+		return http.StatusConflict, withCode(ErrorCodeKeyCollision, &collisionError{
+			key:             key,
+			requestedDigest: digest,
+			storedDigest:    storedDigest,
+			reason:          fmt.Sprintf(reason, args...),
+		})
+	}
+
+	inspector, ok := b.driver.(storage.Inspector)
+	if !ok {
+		return b.verifyExistingSize(existing, contentLength, collision)
+	}
+	head, err := inspector.HeadPayload(r.Context(), &storage.HeadRequest{Key: key})
+	if errors.Is(err, storage.ErrNotSupported) {
+		return b.verifyExistingSize(existing, contentLength, collision)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if head.Digest != "" && !strings.EqualFold(head.Digest, digest) {
+		return collision(head.Digest, "stored digest %s does not match %s", head.Digest, digest)
+	}
+	if head.ContentLength != contentLength {
+		return collision(head.Digest, "stored size of %d bytes does not match %d bytes", head.ContentLength, contentLength)
+	}
+	// the metadata recorded by object stores is sanitized, so it is compared to the uploaded
+	// metadata as it would be recorded. Custom key builders may ignore the metadata, so that
+	// blobs with the same data and other metadata legitimately share a key.
+	if head.Metadata != nil && b.keyBuilder == nil {
+		expected := storage.RestorePayloadMetadata(storage.PayloadMetadata(metadata))
+		if !reflect.DeepEqual(head.Metadata, expected) {
+			return collision(head.Digest, "stored Temporal metadata does not match")
+		}
+	}
+	return 0, nil
+}
+
+// verifyExistingSize compares the size of an existing blob to the uploaded one, for drivers
+// which cannot describe blobs. Drivers report a zero size if they cannot tell.
+func (b *blobHandler) verifyExistingSize(existing *storage.ExistResponse, contentLength uint64, collision func(string, string, ...interface{}) (int, error)) (int, error) {
+	if existing.ContentLength != 0 && existing.ContentLength != contentLength {
+		return collision("", "stored size of %d bytes does not match %d bytes", existing.ContentLength, contentLength)
+	}
+	return 0, nil
+}
+
+const (
+	// metricExistChecksTotal counts the existence checks of uploads by namespace and result.
+	metricExistChecksTotal = "lps_put_exist_checks_total"
+	metricTagResult        = "result"
+
+	// existCheckHit is the result of checks which found the blob, saving its upload.
+	existCheckHit = "hit"
+	// existCheckMiss is the result of checks after which the blob was uploaded, because it
+	// did not exist or its expiry had to be extended.
+	existCheckMiss = "miss"
+	// existCheckSkipped is the result of uploads stored without a check, see
+	// Config.SkipExistCheck.
+	existCheckSkipped = "skipped"
+)
+
+// skipsExistCheck returns whether a blob uploaded to namespace with the given expiry is stored
+// without checking whether it exists. Uploads with an expiry are checked since storing them
+// again could shorten the expiry of the existing blob, uploads to namespaces with a quota
+// since only new blobs count towards it, and uploads verified by checkExisting since they
+// compare the existing blob.
+func (b *blobHandler) skipsExistCheck(namespace string, expiresAt time.Time) bool {
+	return b.skipExistCheck && expiresAt.IsZero() && !b.quotas.has(namespace) && !b.verifyExisting
+}
+
+// recordExistCheck counts an existence check of an upload to namespace with the given result.
+func (b *blobHandler) recordExistCheck(namespace, result string) {
+	b.metricsHandler.WithTags(map[string]string{
+		metricTagNamespace: namespace,
+		metricTagResult:    result,
+	}).Counter(metricExistChecksTotal).Inc(1)
+}
@@ -5,7 +5,7 @@
 package v2
 
 import (
-	"crypto/sha256"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -13,35 +13,232 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"go.temporal.io/sdk/client"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/internal/limit"
+	"github.com/DataDog/temporal-large-payload-codec/server/internal/response"
 	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+	"github.com/DataDog/temporal-large-payload-codec/server/metadata"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 )
 
 const (
-	keyPrefixName = "remote-codec/key-prefix"
-)
+	// KeyPrefixMetadataKey is the Temporal metadata holding the prefix of the key under
+	// which a blob is stored, see ComputeKey and ValidateKeyPrefix.
+	KeyPrefixMetadataKey = "remote-codec/key-prefix"
 
-var (
-	validPrefix = regexp.MustCompile(`^[0-9a-zA-Z_\-/]+$`).MatchString
+	// DefaultMaxBlobBytes is the maximum size of a blob accepted by the handler unless
+	// configured otherwise.
+	DefaultMaxBlobBytes = 1024 * 1024 * 1024 // 1 GB
 )
 
+// rangePattern matches Range headers requesting the remainder of a blob starting at an offset,
+// which are sent by clients resuming an interrupted download. Other ranges are ignored.
+var rangePattern = regexp.MustCompile(`^bytes=(\d+)-$`)
+
+// defaultCompressibleEncodings are the payload encodings, as sent by the codec in the
+// X-Payload-Encoding header, for which blobs are compressed if the client supports it, see
+// Config.CompressibleEncodings.
+var defaultCompressibleEncodings = map[string]bool{
+	"json/plain":    true,
+	"json/protobuf": true,
+}
+
+// validPrefix matches key prefixes of segments separated by slashes, without empty segments
+// which ValidateKey rejects.
+var validPrefix = regexp.MustCompile(`^[0-9a-zA-Z_\-]+(/[0-9a-zA-Z_\-]+)*$`).MatchString
+
+// ValidateKeyPrefix returns an error if prefix is not accepted by ComputeKey, which accepts
+// segments of letters, digits, underscores and hyphens separated by slashes.
+func ValidateKeyPrefix(prefix string) error {
+	if !validPrefix(prefix) {
+		return fmt.Errorf("'%s' is not a valid prefix", prefix)
+	}
+	return nil
+}
+
 // NewHandler creates a v2 HTTP handler for the Large Payload Service.
 //
 // Compared to v1, this version decouples the storage path from the digest/checksum.
 // It also implements checksum validation.
 func NewHandler(driver storage.Driver, logger logging.Logger) http.Handler {
+	return NewHandlerWithConfig(Config{Driver: driver, Logger: logger})
+}
+
+// Config is the configuration of a v2 HTTP handler.
+type Config struct {
+	// Driver stores the blobs.
+	Driver storage.Driver
+	// Logger logs errors. Defaults to a noop logger.
+	Logger logging.Logger
+	// MaxBlobBytes is the maximum size of a blob, larger blobs are rejected. Defaults to
+	// DefaultMaxBlobBytes.
+	MaxBlobBytes uint64
+	// NamespaceMaxBlobBytes overrides MaxBlobBytes for the blobs of the given namespaces.
+	// Zero values are ignored.
+	NamespaceMaxBlobBytes map[string]uint64
+	// Authorizer is called before accessing a blob, if set. By default, all requests are
+	// accepted.
+	Authorizer Authorizer
+	// ReadinessCacheTTL is the period for which the result of a readiness check of the
+	// storage driver is reused. Defaults to DefaultReadinessCacheTTL, results are not reused
+	// if it is negative.
+	ReadinessCacheTTL time.Duration
+	// ReadinessObserver is called with the result of a readiness check if the readiness of
+	// the storage driver changed, which is nil if it is ready. Not used if nil.
+	ReadinessObserver func(err error)
+	// UploadSessionTTL is the period of inactivity after which upload sessions expire and
+	// their parts are discarded. Defaults to DefaultUploadSessionTTL.
+	UploadSessionTTL time.Duration
+	// IdempotencyTTL is the period for which the responses of put requests with an
+	// Idempotency-Key header are recorded, so that retries of the upload are answered without
+	// storing the blob again. Defaults to DefaultIdempotencyTTL.
+	IdempotencyTTL time.Duration
+	// MaxUploadBytes is the maximum size of a blob uploaded in parts with an upload session,
+	// whose parts are limited by MaxBlobBytes. Defaults to DefaultMaxUploadBytes.
+	MaxUploadBytes uint64
+	// PresignExpiry is the period for which presigned URLs are valid. Defaults to
+	// DefaultPresignExpiry, and is capped at MaxPresignExpiry.
+	PresignExpiry time.Duration
+	// NamespaceBlobTTL is the period after which the blobs of the given namespaces may be
+	// deleted, unless put requests set another one with the X-Payload-TTL header. By default,
+	// blobs never expire.
+	NamespaceBlobTTL map[string]time.Duration
+	// KeyBuilder builds the keys under which blobs are stored. Defaults to DefaultKeyBuilder.
+	KeyBuilder KeyBuilder
+	// NamespaceScopedKeys requires requests identifying blobs by their key to set the namespace
+	// query parameter to the namespace of the key, so that clients of a namespace cannot access
+	// blobs of other namespaces by guessing their keys.
+	NamespaceScopedKeys bool
+	// DisableDigestVerification disables the verification of the digest of the blobs sent by
+	// /v2/blobs/get, e.g. for performance-sensitive deployments.
+	DisableDigestVerification bool
+	// VerifyExisting compares the blobs already stored under the key of uploads to the uploaded
+	// ones, and rejects uploads which do not match with 409 Conflict and KEY_COLLISION instead
+	// of returning the key of the stored blob. Their digest and Temporal metadata are compared
+	// if the driver implements storage.Inspector, their size otherwise.
+	VerifyExisting bool
+	// SkipExistCheck stores uploaded blobs without checking whether they exist already, which
+	// saves a request to the object store per upload for workloads whose payloads are rarely
+	// duplicated. Keys are derived from the content of blobs, so overwriting them is harmless.
+	// Uploads with an expiry, to namespaces with a quota, or to a handler verifying existing
+	// blobs are still checked, as they depend on the existing blob.
+	SkipExistCheck bool
+	// DisableCompression disables the gzip compression of the blobs sent by /v2/blobs/get,
+	// e.g. for deployments in which CPU is scarcer than bandwidth.
+	DisableCompression bool
+	// CompressibleEncodings are payload encodings whose blobs are compressed in addition to
+	// json/plain and json/protobuf, e.g. the encodings of custom JSON payload converters.
+	// Encodings of data which is compressed already are not worth adding.
+	CompressibleEncodings []string
+	// NamespaceQuotas are the maximum number of bytes stored by the blobs of the given
+	// namespaces, further blobs are rejected with 507 Insufficient Storage. The usage of a
+	// namespace is computed by listing its blobs when it is first needed, if the driver
+	// implements storage.Lister, and then tracked in memory. Zero values are ignored.
+	NamespaceQuotas map[string]uint64
+	// Deletions reports the blobs deleted without going through the handler, e.g. by the
+	// sweeper, so that they are credited back to NamespaceQuotas. Otherwise, their size counts
+	// towards the quota of their namespace until the handler is created again.
+	Deletions *Deletions
+	// EventSink is called with an Event after each blob stored or deleted through the handler.
+	// Events are queued, and dropped while EventQueueSize events wait for the sink.
+	EventSink EventSink
+	// EventQueueSize is the number of events waiting for the EventSink beyond which further
+	// events are dropped. Defaults to DefaultEventQueueSize.
+	EventQueueSize int
+	// MetricsHandler records the usage of the namespaces with a quota as the gauge
+	// lps_namespace_usage_bytes, the results of the existence checks of uploads as the
+	// counter lps_put_exist_checks_total, and the events dropped because the EventSink lags
+	// behind as the counter lps_events_dropped_total. Defaults to client.MetricsNopHandler.
+	MetricsHandler client.MetricsHandler
+	// Listing enables /v2/blobs/list, which lists the blobs of a namespace if the driver
+	// implements storage.Lister. It is disabled by default since listings can be expensive.
+	Listing bool
+	// PlainTextErrors sends the message of errors as the plain text body of error responses
+	// instead of an ErrorResponse, as in previous releases.
+	//
+	// Deprecated: plain text error responses will be removed in the next release.
+	PlainTextErrors bool
+}
+
+// NewHandlerWithConfig creates a v2 HTTP handler for the Large Payload Service with the given
+// configuration.
+func NewHandlerWithConfig(cfg Config) http.Handler {
+	if cfg.Logger == nil {
+		cfg.Logger = logging.NewNoopLogger()
+	}
+	if cfg.MaxBlobBytes == 0 {
+		cfg.MaxBlobBytes = DefaultMaxBlobBytes
+	}
+	if cfg.ReadinessCacheTTL == 0 {
+		cfg.ReadinessCacheTTL = DefaultReadinessCacheTTL
+	}
+	if cfg.UploadSessionTTL <= 0 {
+		cfg.UploadSessionTTL = DefaultUploadSessionTTL
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		cfg.IdempotencyTTL = DefaultIdempotencyTTL
+	}
+	if cfg.MaxUploadBytes == 0 {
+		cfg.MaxUploadBytes = DefaultMaxUploadBytes
+	}
+	if cfg.MetricsHandler == nil {
+		cfg.MetricsHandler = client.MetricsNopHandler
+	}
+	if cfg.EventQueueSize <= 0 {
+		cfg.EventQueueSize = DefaultEventQueueSize
+	}
+	if cfg.PresignExpiry <= 0 {
+		cfg.PresignExpiry = DefaultPresignExpiry
+	} else if cfg.PresignExpiry > MaxPresignExpiry {
+		cfg.PresignExpiry = MaxPresignExpiry
+	}
 	r := http.NewServeMux()
 	handler := &blobHandler{
-		driver,
-		1024 * 1024 * 1024, // 1 GB
-		logger,
+		driver:                cfg.Driver,
+		maxBlobBytes:          cfg.MaxBlobBytes,
+		namespaceMaxBlobBytes: cfg.NamespaceMaxBlobBytes,
+		logger:                cfg.Logger,
+		authorizer:            cfg.Authorizer,
+		readiness:             &readiness{ttl: cfg.ReadinessCacheTTL, observer: cfg.ReadinessObserver},
+		uploads:               &uploadSessions{ttl: cfg.UploadSessionTTL, maxBytes: cfg.MaxUploadBytes},
+		idempotentUploads:     &idempotentUploads{ttl: cfg.IdempotencyTTL, now: time.Now},
+		quotas:                newQuotas(cfg.Driver, cfg.NamespaceQuotas, cfg.KeyBuilder, cfg.MetricsHandler),
+		presignExpiry:         cfg.PresignExpiry,
+		listing:               cfg.Listing,
+		namespaceBlobTTL:      cfg.NamespaceBlobTTL,
+		keyBuilder:            cfg.KeyBuilder,
+		namespaceScopedKeys:   cfg.NamespaceScopedKeys,
+		verifyDigests:         !cfg.DisableDigestVerification,
+		verifyExisting:        cfg.VerifyExisting,
+		skipExistCheck:        cfg.SkipExistCheck,
+		metricsHandler:        cfg.MetricsHandler,
+		events:                newEventQueue(cfg.EventSink, cfg.EventQueueSize, cfg.MetricsHandler),
+		plainTextErrors:       cfg.PlainTextErrors,
+		version:               serverVersion(),
+		startedAt:             time.Now(),
+	}
+	if cfg.Deletions != nil {
+		cfg.Deletions.handle(func(namespace, _ string, size uint64) {
+			handler.quotas.release(namespace, size)
+		})
+	}
+	if !cfg.DisableCompression {
+		handler.compressibleEncodings = make(map[string]bool, len(defaultCompressibleEncodings)+len(cfg.CompressibleEncodings))
+		for encoding := range defaultCompressibleEncodings {
+			handler.compressibleEncodings[encoding] = true
+		}
+		for _, encoding := range cfg.CompressibleEncodings {
+			handler.compressibleEncodings[encoding] = true
+		}
 	}
 
 	r.HandleFunc("/v2/health/head", func(w http.ResponseWriter, r *http.Request) {
@@ -51,66 +248,421 @@ func NewHandler(driver storage.Driver, logger logging.Logger) http.Handler {
 		}
 		w.WriteHeader(http.StatusOK)
 	})
+	r.HandleFunc("/v2/health/ready", handler.getReadiness)
+	r.HandleFunc("/v2/health/info", handler.getInfo)
+	r.HandleFunc("/v2/limits", handler.getLimits)
 	r.HandleFunc("/v2/blobs/put", handler.putBlob)
 	r.HandleFunc("/v2/blobs/get", handler.getBlob)
-
-	return r
+	r.HandleFunc("/v2/blobs/get-batch", handler.getBlobBatch)
+	r.HandleFunc("/v2/blobs/head", handler.headBlob)
+	r.HandleFunc("/v2/blobs/delete", handler.deleteBlob)
+	r.HandleFunc("/v2/blobs/list", handler.listBlobs)
+	r.HandleFunc("/v2/admin/blobs", handler.deleteBlobsByPrefix)
+	r.HandleFunc("/v2/blobs/presign-put", handler.presignPutBlob)
+	r.HandleFunc("/v2/blobs/presign-get", handler.presignGetBlob)
+	r.HandleFunc("/v2/blobs/uploads", handler.serveUploads)
+	r.HandleFunc("/v2/blobs/uploads/", handler.serveUploads)
+
+	// responses are recorded to tell whether errors can still be sent
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if id := RequestIDFromContext(req.Context()); id != "" {
+			w.Header().Set(RequestIDHeader, id)
+		}
+		r.ServeHTTP(response.Wrap(w), req)
+	})
 }
 
 type blobHandler struct {
 	driver       storage.Driver
 	maxBlobBytes uint64
-	logger       logging.Logger
+	// namespaceMaxBlobBytes overrides maxBlobBytes for some namespaces.
+	namespaceMaxBlobBytes map[string]uint64
+	logger                logging.Logger
+	authorizer            Authorizer
+	readiness             *readiness
+	uploads               *uploadSessions
+	idempotentUploads     *idempotentUploads
+	quotas                *quotas
+	presignExpiry         time.Duration
+	listing               bool
+	// namespaceBlobTTL is the default TTL of the blobs of some namespaces.
+	namespaceBlobTTL map[string]time.Duration
+	// keyBuilder builds the keys of blobs, DefaultKeyBuilder is used if nil.
+	keyBuilder KeyBuilder
+	// namespaceScopedKeys requires the namespace of keys to match the namespace query parameter.
+	namespaceScopedKeys bool
+	// verifyDigests verifies the digest of the blobs sent by getBlob.
+	verifyDigests bool
+	// verifyExisting verifies that blobs stored under the key of uploads match them.
+	verifyExisting bool
+	// skipExistCheck stores uploaded blobs without checking whether they exist when possible.
+	skipExistCheck bool
+	metricsHandler client.MetricsHandler
+	// events passes the events of stored and deleted blobs to the EventSink, it is nil if
+	// there is none.
+	events *eventQueue
+	// compressibleEncodings are the payload encodings whose blobs are compressed by getBlob,
+	// it is nil if compression is disabled.
+	compressibleEncodings map[string]bool
+	// plainTextErrors sends error messages as plain text instead of JSON.
+	plainTextErrors bool
+	// version is the version of the server reported by /v2/health/info.
+	version string
+	// startedAt is the time the handler was created, from which the uptime is computed.
+	startedAt time.Time
 }
 
+// getBlob sends the blob with the given key. HEAD requests only get its size and digest, which
+// allows monitoring whether a blob exists without transferring it.
 func (b *blobHandler) getBlob(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		b.handleError(w, nil, http.StatusMethodNotAllowed)
 		return
 	}
-	if contentType := r.Header.Get("Content-Type"); contentType != "application/octet-stream" {
+	// plain HTTP clients, such as curl, do not set a Content-Type
+	if contentType := r.Header.Get("Content-Type"); contentType != "" && contentType != "application/octet-stream" {
 		b.handleError(w, fmt.Errorf("missing or incorrect Content-Type header"), http.StatusBadRequest)
 		return
 	}
 
+	// the expected length is unknown to clients which fetch a blob by its key only, and only
+	// checked against the stored size otherwise
 	expectedLengthHeader := r.Header.Get("X-Payload-Expected-Content-Length")
-	if expectedLengthHeader == "" {
-		b.handleError(w, fmt.Errorf("expected content length header is required"), http.StatusBadRequest)
+	var expectedLength uint64
+	if expectedLengthHeader != "" {
+		var err error
+		if expectedLength, err = strconv.ParseUint(expectedLengthHeader, 10, 64); err != nil {
+			b.handleError(w, fmt.Errorf("expected content length header %s is invalid: %w", expectedLengthHeader, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	keyParam := r.URL.Query().Get("key")
+	if keyParam == "" {
+		b.handleError(w, errors.New("key query parameter is required"), http.StatusBadRequest)
 		return
 	}
-	expectedLength, err := strconv.ParseUint(expectedLengthHeader, 10, 64)
+	key, err := url.QueryUnescape(keyParam)
 	if err != nil {
-		b.handleError(w, fmt.Errorf("expected content length header %s is invalid: %w", expectedLengthHeader, err), http.StatusBadRequest)
+		b.handleError(w, fmt.Errorf("key query parameter %s cannot be unescaped: %w", keyParam, err), http.StatusBadRequest)
+		return
+	}
+	namespace, status, err := b.checkKey(r, key)
+	if err != nil {
+		b.handleError(w, err, status)
+		return
+	}
+	if !b.authorize(w, r, OperationGet, namespace, key) {
 		return
 	}
 
-	w.Header().Set("Content-Length", strconv.FormatUint(expectedLength, 10))
+	// the size is served from storage, drivers which do not know it report zero
+	exists, err := b.driver.ExistPayload(r.Context(), &storage.ExistRequest{Key: key})
+	if err != nil {
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !exists.Exists {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b.handleError(w, &storage.ErrBlobNotFound{Err: fmt.Errorf("key %s", key)}, http.StatusNotFound)
+		return
+	}
+	// clients other than the codec, which keeps the digest in its envelope, verify the
+	// downloaded blob against the digest of the key, unless it has a custom layout
+	w.Header().Set("X-Payload-Key", key)
+	if digest := digestFromKey(key); digest != "" {
+		w.Header().Set("X-Payload-Digest", digest)
+	}
+	length := exists.ContentLength
+	if expectedLengthHeader != "" {
+		if length != 0 && length != expectedLength {
+			b.handleError(w, fmt.Errorf("stored blob has %d bytes, but %d bytes are expected", length, expectedLength), http.StatusPreconditionFailed)
+			return
+		}
+		length = expectedLength
+	}
 
-	keyParam := r.URL.Query().Get("key")
-	if keyParam == "" {
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if length != 0 {
+			w.Header().Set("Content-Length", strconv.FormatUint(length, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// compressed responses and responses of unknown length use chunked encoding
+	var writer io.Writer = w
+	var gz *gzip.Writer
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	// resumed downloads request the remainder of a blob of known length, which is sent uncompressed
+	if rangeGetter, ok := b.driver.(storage.RangeGetter); ok && length != 0 {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if m := rangePattern.FindStringSubmatch(r.Header.Get("Range")); m != nil {
+			offset, err := strconv.ParseUint(m[1], 10, 64)
+			if err == nil {
+				b.getBlobRange(w, r, rangeGetter, key, offset, length)
+				return
+			}
+		}
+	}
+
+	verifier := b.digestVerifier(key)
+	// trailers are only sent with chunked encoding, so the length is omitted for clients
+	// accepting them
+	trailers := verifier != nil && acceptsTrailers(r)
+	if trailers {
+		w.Header().Set("Trailer", digestVerifiedTrailer)
+	}
+
+	if acceptsGzip(r) && b.compressibleEncodings[r.Header.Get("X-Payload-Encoding")] {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(w)
+		writer = gz
+	} else if length != 0 && !trailers {
+		w.Header().Set("Content-Length", strconv.FormatUint(length, 10))
+	}
+	if verifier != nil {
+		writer = io.MultiWriter(writer, verifier.hash)
+	}
+
+	if _, err := b.driver.GetPayload(r.Context(), &storage.GetRequest{Key: key, Writer: writer}); err != nil {
+		// unset Content-Type, Content-Length and Content-Encoding on errors
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Encoding")
+
+		var blobNotFound *storage.ErrBlobNotFound
+		if errors.As(err, &blobNotFound) {
+			b.handleError(w, err, http.StatusNotFound)
+		} else {
+			b.handleError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			b.requestLogger(w).Error(fmt.Sprintf("unable to compress blob %s: %v", key, err))
+		}
+	}
+	if verifier != nil {
+		verified := verifier.verify()
+		if !verified {
+			b.requestLogger(w).Error("stored blob does not match its digest", "key", key)
+		}
+		if trailers {
+			w.Header().Set(digestVerifiedTrailer, strconv.FormatBool(verified))
+		}
+	}
+}
+
+// getBlobRange sends the blob with the given key and length starting at offset, with the
+// status code 206 Partial Content.
+func (b *blobHandler) getBlobRange(w http.ResponseWriter, r *http.Request, driver storage.RangeGetter, key string, offset uint64, length uint64) {
+	if offset >= length {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+		b.handleError(w, fmt.Errorf("range start %d exceeds blob size %d", offset, length), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, length-1, length))
+	w.Header().Set("Content-Length", strconv.FormatUint(length-offset, 10))
+
+	writer := &partialContentWriter{w: w}
+	if _, err := driver.GetPayloadRange(r.Context(), &storage.GetRangeRequest{Key: key, Writer: writer, Offset: offset}); err != nil {
+		// unset Content-Type, Content-Length and Content-Range on errors
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Range")
+
+		var blobNotFound *storage.ErrBlobNotFound
+		if errors.As(err, &blobNotFound) {
+			b.handleError(w, err, http.StatusNotFound)
+		} else {
+			b.handleError(w, err, http.StatusInternalServerError)
+		}
+	}
+}
+
+// partialContentWriter sends the status code 206 Partial Content before the first write, so
+// that errors occurring before any data is written can still be reported.
+type partialContentWriter struct {
+	w           http.ResponseWriter
+	wroteHeader bool
+}
+
+func (p *partialContentWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		p.w.WriteHeader(http.StatusPartialContent)
+		p.wroteHeader = true
+	}
+	return p.w.Write(b)
+}
+
+// acceptsGzip returns whether the client accepts gzip compressed responses, which it does not
+// if it lists gzip with the quality value 0.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			encoding, params, _ := strings.Cut(encoding, ";")
+			if strings.TrimSpace(encoding) != "gzip" {
+				continue
+			}
+			name, value, _ := strings.Cut(strings.TrimSpace(params), "=")
+			if quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64); strings.TrimSpace(name) == "q" && err == nil && quality == 0 {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// headBlob checks whether a blob exists. The blob is either identified by its key, or by
+// the same namespace, digest and metadata which are used to compute the key on upload.
+func (b *blobHandler) headBlob(w http.ResponseWriter, r *http.Request) {
+	// GET is accepted for clients which cannot send HEAD requests, but no body is sent
+	if r.Method != http.MethodHead && r.Method != http.MethodGet {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	var namespace string
+	if key == "" {
+		namespaceParam := r.URL.Query().Get("namespace")
+		if namespaceParam == "" {
+			b.handleError(w, errors.New("key or namespace query parameter is required"), http.StatusBadRequest)
+			return
+		}
+		if err := ValidateNamespace(namespaceParam); err != nil {
+			b.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		digestParam := r.URL.Query().Get("digest")
+		if digestParam == "" {
+			b.handleError(w, errors.New("digest query parameter is required"), http.StatusBadRequest)
+			return
+		}
+		if _, _, err := b.digestAndHash(digestParam); err != nil {
+			b.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		temporalMetadata, err := b.decodeTemporalMetadata(r)
+		if err != nil {
+			b.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		key, err = b.computeKey(namespaceParam, digestParam, temporalMetadata)
+		if err != nil {
+			b.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+		namespace = namespaceParam
+	} else {
+		keyNamespace, status, err := b.checkKey(r, key)
+		if err != nil {
+			b.handleError(w, err, status)
+			return
+		}
+		namespace = keyNamespace
+	}
+	if !b.authorize(w, r, OperationHead, namespace, key) {
+		return
+	}
+
+	existResponse, err := b.driver.ExistPayload(r.Context(), &storage.ExistRequest{Key: key})
+	if err != nil {
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !existResponse.Exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("X-Payload-Key", key)
+	if digest := digestFromKey(key); digest != "" {
+		w.Header().Set("X-Payload-Digest", digest)
+	}
+	w.Header().Set("Content-Length", strconv.FormatUint(existResponse.ContentLength, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// digestFromKey returns the data digest part of a key computed by ComputeKey, or an empty
+// string if key has a different format.
+func digestFromKey(key string) string {
+	_, digest, err := ParseKey(key)
+	if err != nil {
+		return ""
+	}
+	alg, _, _ := strings.Cut(digest, ":")
+	if _, ok := newHash(alg); !ok {
+		return ""
+	}
+	return digest
+}
+
+func (b *blobHandler) deleteBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
 		b.handleError(w, errors.New("key query parameter is required"), http.StatusBadRequest)
 		return
 	}
-	key, err := url.QueryUnescape(keyParam)
+	namespace, status, err := b.checkKey(r, key)
 	if err != nil {
-		b.handleError(w, fmt.Errorf("key query parameter %s cannot be unescaped: %w", keyParam, err), http.StatusBadRequest)
+		b.handleError(w, err, status)
+		return
+	}
+	if !b.authorize(w, r, OperationDelete, namespace, key) {
+		return
 	}
 
-	if _, err := b.driver.GetPayload(r.Context(), &storage.GetRequest{Key: key, Writer: w}); err != nil {
-		w.Header().Del("Content-Length") // unset Content-Length on errors
+	// the size of the blob is credited back to the quota of its namespace and sent with the
+	// event of the deletion
+	var size uint64
+	if b.quotas.has(namespace) || b.events != nil {
+		exists, err := b.driver.ExistPayload(r.Context(), &storage.ExistRequest{Key: key})
+		if err != nil {
+			b.handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		size = exists.ContentLength
+	}
 
+	if _, err := b.driver.DeletePayload(r.Context(), &storage.DeleteRequest{Key: key}); err != nil {
 		var blobNotFound *storage.ErrBlobNotFound
 		if errors.As(err, &blobNotFound) {
 			b.handleError(w, err, http.StatusNotFound)
 		} else {
 			b.handleError(w, err, http.StatusInternalServerError)
 		}
+		return
 	}
+	b.quotas.release(namespace, size)
+	_, digest, _ := ParseKey(key)
+	b.events.send(r.Context(), Event{Operation: OperationDelete, Namespace: namespace, Key: key, Size: size, Digest: digest})
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (b *blobHandler) putBlob(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut {
-		b.handleError(w, nil, http.StatusMethodNotAllowed)
+	// POST is accepted as well for proxies which block PUT requests
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		b.writeError(w, fmt.Errorf("method %s is not allowed, use PUT or POST", r.Method), http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -129,14 +681,13 @@ func (b *blobHandler) putBlob(w http.ResponseWriter, r *http.Request) {
 		b.handleError(w, err, http.StatusBadRequest)
 		return
 	}
-	if contentLength > b.maxBlobBytes {
-		b.handleError(w, fmt.Errorf("payload exceeds max size of %d bytes", b.maxBlobBytes), http.StatusRequestEntityTooLarge)
+
+	namespaceParam, ok := b.namespaceParam(w, r)
+	if !ok {
 		return
 	}
-
-	namespaceParam := r.URL.Query().Get("namespace")
-	if namespaceParam == "" {
-		b.handleError(w, errors.New("namespace query parameter is required"), http.StatusBadRequest)
+	if contentLength > b.maxBlobBytesFor(namespaceParam) {
+		b.handleError(w, b.blobTooLargeError(namespaceParam, contentLength), http.StatusRequestEntityTooLarge)
 		return
 	}
 
@@ -163,13 +714,52 @@ func (b *blobHandler) putBlob(w http.ResponseWriter, r *http.Request) {
 		b.handleError(w, err, http.StatusBadRequest)
 		return
 	}
-
-	existResponse, err := b.driver.ExistPayload(r.Context(), &storage.ExistRequest{Key: key})
+	expiresAt, err := b.blobExpiry(r, namespaceParam)
 	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !b.authorize(w, r, OperationPut, namespaceParam, key) {
+		return
+	}
+
+	// retries of an upload are answered with the response of the first one, concurrent ones
+	// wait for it. Idempotency keys are scoped to the blob key, so that reusing them for other
+	// blobs does not return the key of the wrong blob.
+	if id := r.Header.Get(IdempotencyKeyHeader); id != "" {
+		recorded, complete, err := b.idempotentUploads.claim(r.Context(), id+" "+key)
+		if err != nil {
+			b.handleError(w, err, http.StatusServiceUnavailable)
+			return
+		}
+		if recorded != nil {
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(recorded.status)
+			_ = json.NewEncoder(w).Encode(storage.PutResponse{Key: recorded.key})
+			return
+		}
+		rw := response.Wrap(w)
+		w = rw
+		defer func() { complete(rw.Status(), key) }()
+	}
+
+	existResponse := &storage.ExistResponse{}
+	skipExistCheck := b.skipsExistCheck(namespaceParam, expiresAt)
+	if skipExistCheck {
+		b.recordExistCheck(namespaceParam, existCheckSkipped)
+	} else if existResponse, err = b.driver.ExistPayload(r.Context(), &storage.ExistRequest{Key: key}); err != nil {
 		b.handleError(w, err, http.StatusInternalServerError)
 		return
 	}
 	if existResponse.Exists {
+		if status, err := b.checkExisting(r, key, digestParam, contentLength, temporalMetadata, existResponse); err != nil {
+			b.handleError(w, err, status)
+			return
+		}
+	}
+	// blobs expiring too early are stored again to extend their expiry
+	if existResponse.Exists && !expiresBefore(existResponse.ExpiresAt, expiresAt) {
+		b.recordExistCheck(namespaceParam, existCheckHit)
 		w.WriteHeader(http.StatusOK)
 		r := storage.PutResponse{
 			Key: key,
@@ -179,29 +769,100 @@ func (b *blobHandler) putBlob(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !skipExistCheck {
+		b.recordExistCheck(namespaceParam, existCheckMiss)
+	}
+	// blobs stored again have the same size, so only new ones count towards the quota
+	if !existResponse.Exists && !b.reserveQuota(w, r, namespaceParam, key, contentLength) {
+		return
+	}
 
-	tee := io.TeeReader(r.Body, hasher)
+	// the body is read only once the request is validated, so that clients sending
+	// Expect: 100-continue do not transmit rejected blobs. The declared length does not exceed
+	// the maximum blob size, so limiting the body to it also enforces the limit for clients
+	// sending more data than declared.
+	body := &limit.Reader{R: r.Body, Remaining: contentLength, Err: errBlobTooLarge}
+	verified := &verifyingReader{r: body, hasher: hasher, digest: digest}
 	result, err := b.driver.PutPayload(r.Context(), &storage.PutRequest{
-		Data:          tee,
+		Data:          verified,
 		Key:           key,
 		Digest:        digestParam,
 		ContentLength: contentLength,
+		ContentType:   payloadContentType(r),
+		ExpiresAt:     expiresAt,
+		Metadata:      temporalMetadata,
 	})
-	if err != nil {
+	// drivers reading exactly the declared length do not reach the end of the body, which is
+	// where its checksum is verified
+	stored := err == nil
+	mismatch := verified.mismatch || (stored && hex.EncodeToString(hasher.Sum(nil)) != digest)
+	if !existResponse.Exists {
+		b.quotas.settle(namespaceParam, key, stored && !body.Exceeded && !mismatch)
+	}
+	if body.Exceeded || mismatch {
+		b.discardFailedUpload(r, namespaceParam, key, stored, skipExistCheck, existResponse)
+	}
+	switch {
+	case body.Exceeded:
+		b.handleError(w, fmt.Errorf("request body exceeds the declared Content-Length of %d bytes", contentLength), http.StatusRequestEntityTooLarge)
+		return
+	case mismatch:
+		b.handleError(w, errChecksumMismatch, http.StatusBadRequest)
+		return
+	case !stored:
 		b.handleError(w, err, http.StatusInternalServerError)
 		return
 	}
+	b.events.send(r.Context(), Event{Operation: OperationPut, Namespace: namespaceParam, Key: key, Size: contentLength, Digest: digestParam})
 
-	checkSum := hex.EncodeToString(hasher.Sum(nil))
-	if checkSum != digest {
-		b.handleError(w, errors.New("checksum mismatch"), http.StatusBadRequest)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
 		return
 	}
+}
 
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(result); err != nil {
+// discardFailedUpload cleans up after an upload whose body exceeded its declared length or
+// did not match its digest, and releases the quota of the existing blob if it is deleted.
+// stored tells whether the driver reported storing the data, and existing whether the key
+// existed before, which is unknown if skipExistCheck is set.
+//
+// Data stored by the driver is deleted. Otherwise, existing blobs are kept since the driver
+// failed without replacing them, and so are the keys which may have existed, at the cost of
+// leaving the partial data stored by drivers which do not store blobs atomically.
+func (b *blobHandler) discardFailedUpload(r *http.Request, namespace, key string, stored, skipExistCheck bool, existing *storage.ExistResponse) {
+	if !stored && (skipExistCheck || existing.Exists) {
 		return
 	}
+	if b.deletePartialBlob(r, key) && stored && existing.Exists {
+		// the existing blob was replaced with the data, so it is deleted as well
+		b.quotas.release(namespace, existing.ContentLength)
+		_, digest, _ := ParseKey(key)
+		b.events.send(r.Context(), Event{Operation: OperationDelete, Namespace: namespace, Key: key, Size: existing.ContentLength, Digest: digest})
+	}
+}
+
+// deletePartialBlob deletes the blob with the given key after an aborted upload, in case the
+// driver stored the data it received up to the failure, or after a checksum mismatch, since
+// the key encodes the digest and the data must not be served or mistaken for an existing blob
+// by later uploads of the right data. It returns whether the blob was deleted.
+func (b *blobHandler) deletePartialBlob(r *http.Request, key string) bool {
+	_, err := b.driver.DeletePayload(r.Context(), &storage.DeleteRequest{Key: key})
+	var blobNotFound *storage.ErrBlobNotFound
+	if err != nil && !errors.As(err, &blobNotFound) {
+		withRequestID(b.logger, RequestIDFromContext(r.Context())).Error(fmt.Sprintf("unable to delete partially uploaded blob %s: %v", key, err))
+		return false
+	}
+	return err == nil
+}
+
+// payloadContentType returns the content type of the uploaded blob sent by the codec in the
+// X-Payload-Content-Type header. It is informational only, so invalid values are ignored.
+func payloadContentType(r *http.Request) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("X-Payload-Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mime.FormatMediaType(mediaType, params)
 }
 
 func (b *blobHandler) decodeTemporalMetadata(r *http.Request) (map[string][]byte, error) {
@@ -213,67 +874,58 @@ func (b *blobHandler) decodeTemporalMetadata(r *http.Request) (map[string][]byte
 	if err := json.Unmarshal(rawMetadata, &metadata); err != nil {
 		return nil, err
 	}
+	if err := ValidateMetadata(metadata); err != nil {
+		return nil, err
+	}
 	return metadata, nil
 }
 
 func (b *blobHandler) digestAndHash(digest string) (string, hash.Hash, error) {
+	return ParseDigest(digest)
+}
+
+// ParseDigest returns the hex encoded value of a digest in the format
+// <algorithm>:<hex encoded value> and a new hash of its algorithm, or an error if the
+// algorithm is not registered with RegisterHash or the value is invalid.
+func ParseDigest(digest string) (string, hash.Hash, error) {
 	tokens := strings.Split(digest, ":")
 	if len(tokens) != 2 {
-		return "", nil, fmt.Errorf("invalid digest format '%s'", digest)
+		return "", nil, withCode(ErrorCodeInvalidDigest, fmt.Errorf("invalid digest format '%s'", digest))
 	}
 
-	var h hash.Hash
-	switch tokens[0] {
-	case "sha256":
-		h = sha256.New()
-	default:
-		return "", nil, fmt.Errorf("invalid hash type '%s'", tokens[0])
+	h, ok := newHash(tokens[0])
+	if !ok {
+		return "", nil, withCode(ErrorCodeInvalidDigest, fmt.Errorf("invalid hash type '%s'", tokens[0]))
+	}
+	if !isDigestValue(tokens[1], h) {
+		return "", nil, withCode(ErrorCodeInvalidDigest, fmt.Errorf("invalid %s digest value '%s', expected %d hex encoded bytes", tokens[0], tokens[1], h.Size()))
 	}
 	return tokens[1], h, nil
 }
 
-func (b *blobHandler) handleError(w http.ResponseWriter, err error, statusCode int) {
-	if err != nil {
-		b.logger.Error(err.Error())
-	}
-	w.WriteHeader(statusCode)
-	if err != nil {
-		_, _ = w.Write([]byte(err.Error()))
+func (b *blobHandler) computeKey(namespace string, dataDigest string, temporalMetadata map[string][]byte) (string, error) {
+	builder := b.keyBuilder
+	if builder == nil {
+		builder = DefaultKeyBuilder
 	}
-	return
+	return BuildKey(builder, namespace, dataDigest, temporalMetadata)
 }
 
-func (b *blobHandler) computeKey(namespace string, dataDigest string, metadata map[string][]byte) (string, error) {
-	metadataHash := hashMetadata(metadata)
+// ComputeKey returns the key under which the v2 handler stores a blob with the given data
+// digest and Temporal metadata in the given namespace. The key honors the key prefix set in
+// the remote-codec/key-prefix metadata.
+func ComputeKey(namespace string, dataDigest string, temporalMetadata map[string][]byte) (string, error) {
+	metadataHash := metadata.Hash(temporalMetadata)
 	var key string
 
-	prefix := string(metadata[keyPrefixName])
+	prefix := string(temporalMetadata[KeyPrefixMetadataKey])
 	if prefix == "" {
 		key = fmt.Sprintf("/blobs/%s/common/%s/%s", namespace, dataDigest, metadataHash)
 	} else {
-		if !validPrefix(prefix) {
-			return "", fmt.Errorf("'%s' is not a valid prefix", prefix)
+		if err := ValidateKeyPrefix(prefix); err != nil {
+			return "", err
 		}
 		key = fmt.Sprintf("/blobs/%s/custom/%s/%s/%s", namespace, prefix, dataDigest, metadataHash)
 	}
 	return key, nil
 }
-
-func hashMetadata(metadata map[string][]byte) string {
-	i := 0
-	keys := make([]string, len(metadata))
-	for k := range metadata {
-		keys[i] = k
-		i++
-	}
-	sort.Strings(keys)
-
-	h := sha256.New()
-	for _, k := range keys {
-		v := metadata[k]
-		h.Write([]byte(k))
-		h.Write(v)
-	}
-
-	return fmt.Sprintf("sha256:%s", hex.EncodeToString(h.Sum(nil)))
-}
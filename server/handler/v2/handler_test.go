@@ -5,9 +5,15 @@
 package v2
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_computeKey(t *testing.T) {
@@ -33,7 +39,7 @@ func Test_computeKey(t *testing.T) {
 			name:        "valid prefix",
 			namespace:   "foo",
 			digest:      "sha256:1234",
-			meta:        map[string][]byte{keyPrefixName: []byte("a/b/c")},
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("a/b/c")},
 			expectedKey: "/blobs/foo/custom/a/b/c/sha256:1234/sha256:02b711154c4e88a46ff26dc96f492ce38c8c9fe00f3b6b2ea1ef6c209a2f3bd7",
 			expectError: false,
 		},
@@ -41,7 +47,7 @@ func Test_computeKey(t *testing.T) {
 			name:        "invalid prefix",
 			namespace:   "foo",
 			digest:      "sha256:1234",
-			meta:        map[string][]byte{keyPrefixName: []byte("../../a")},
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("../../a")},
 			expectedKey: "",
 			expectError: true,
 		},
@@ -49,7 +55,23 @@ func Test_computeKey(t *testing.T) {
 			name:        "invalid prefix ii",
 			namespace:   "foo",
 			digest:      "sha256:1234",
-			meta:        map[string][]byte{keyPrefixName: []byte("a$(foo)b")},
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("a$(foo)b")},
+			expectedKey: "",
+			expectError: true,
+		},
+		{
+			name:        "prefix with empty segment",
+			namespace:   "foo",
+			digest:      "sha256:1234",
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("a//b")},
+			expectedKey: "",
+			expectError: true,
+		},
+		{
+			name:        "prefix with trailing slash",
+			namespace:   "foo",
+			digest:      "sha256:1234",
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("a/")},
 			expectedKey: "",
 			expectError: true,
 		},
@@ -68,3 +90,98 @@ func Test_computeKey(t *testing.T) {
 		})
 	}
 }
+
+func Test_digestFromKey(t *testing.T) {
+	testCase := []struct {
+		name   string
+		key    string
+		digest string
+	}{
+		{
+			name:   "no prefix",
+			key:    "/blobs/foo/common/sha256:1234/sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			digest: "sha256:1234",
+		},
+		{
+			name:   "prefix",
+			key:    "/blobs/foo/custom/a/b/c/sha256:1234/sha256:02b711154c4e88a46ff26dc96f492ce38c8c9fe00f3b6b2ea1ef6c209a2f3bd7",
+			digest: "sha256:1234",
+		},
+		{
+			name: "unknown algorithm",
+			key:  "/blobs/foo/common/md5:1234/sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			name: "other format",
+			key:  "blobs/sha256:1234",
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			assert.Equal(t, scenario.digest, digestFromKey(scenario.key))
+		})
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		-time.Second:            "1",
+		0:                       "1",
+		10 * time.Millisecond:   "1",
+		time.Second:             "1",
+		1500 * time.Millisecond: "2",
+		time.Minute:             "60",
+	} {
+		w := httptest.NewRecorder()
+		SetRetryAfter(w, d)
+		assert.Equal(t, want, w.Header().Get("Retry-After"), d)
+	}
+}
+
+func TestIdempotentUploads(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	uploads := &idempotentUploads{ttl: time.Minute, now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	// failed uploads are forgotten
+	recorded, complete, err := uploads.claim(ctx, "a")
+	require.NoError(t, err)
+	require.Nil(t, recorded)
+	complete(http.StatusBadRequest, "")
+	recorded, complete, err = uploads.claim(ctx, "a")
+	require.NoError(t, err)
+	require.Nil(t, recorded)
+
+	// successful uploads are recorded until they expire
+	complete(http.StatusCreated, "/blobs/a")
+	recorded, _, err = uploads.claim(ctx, "a")
+	require.NoError(t, err)
+	require.NotNil(t, recorded)
+	assert.Equal(t, http.StatusCreated, recorded.status)
+	assert.Equal(t, "/blobs/a", recorded.key)
+	now = now.Add(time.Minute)
+	recorded, complete, err = uploads.claim(ctx, "a")
+	require.NoError(t, err)
+	require.Nil(t, recorded)
+	complete(http.StatusOK, "/blobs/a")
+	assert.Len(t, uploads.completed, 1)
+
+	// requests waiting for an upload give up with their context
+	_, _, err = uploads.claim(ctx, "b")
+	require.NoError(t, err)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = uploads.claim(canceled, "b")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the oldest uploads are dropped beyond the maximum number of recorded uploads
+	for i := 0; i < maxIdempotentUploads; i++ {
+		_, complete, err := uploads.claim(ctx, strconv.Itoa(i))
+		require.NoError(t, err)
+		complete(http.StatusCreated, "/blobs/"+strconv.Itoa(i))
+	}
+	assert.Len(t, uploads.completed, maxIdempotentUploads)
+	assert.NotContains(t, uploads.uploads, "a")
+	assert.Contains(t, uploads.uploads, "0")
+}
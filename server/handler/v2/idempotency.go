@@ -0,0 +1,127 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader is the header of put requests identifying an upload, so that
+	// retries of the upload are answered with the response of the first completed one instead
+	// of storing the blob again. Codecs send a random key per upload if they retry requests.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set to true on responses replayed for an idempotency key.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// DefaultIdempotencyTTL is the period for which the responses of uploads with an
+	// idempotency key are recorded unless configured otherwise.
+	DefaultIdempotencyTTL = 5 * time.Minute
+	// maxIdempotentUploads bounds the number of recorded responses, the oldest ones are
+	// dropped first.
+	maxIdempotentUploads = 10000
+)
+
+// idempotentUpload is an upload with an idempotency key, which is in progress until done is
+// closed.
+type idempotentUpload struct {
+	done chan struct{}
+	// status and key are the status code and blob key of the response of the upload, or zero
+	// and empty if it failed. They are set before done is closed.
+	status    int
+	key       string
+	expiresAt time.Time
+}
+
+// idempotentUploads records the responses of recently completed uploads by their idempotency
+// key. Only successful responses are recorded, failed uploads may be retried with the same key.
+type idempotentUploads struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	uploads map[string]*idempotentUpload
+	// completed are the recorded uploads in the order of their completion, which is the
+	// order of their expiry.
+	completed []completedUpload
+}
+
+type completedUpload struct {
+	id     string
+	upload *idempotentUpload
+}
+
+// claim returns the recorded upload with the given ID, waiting for a concurrent upload with the
+// same ID to complete. If there is none, or the concurrent upload failed, the caller performs
+// the upload and must call the returned function with the status code of its response and
+// the key of the blob once done. It returns an error if ctx is done while waiting.
+func (s *idempotentUploads) claim(ctx context.Context, id string) (*idempotentUpload, func(status int, key string), error) {
+	for {
+		s.mu.Lock()
+		s.prune()
+		upload, ok := s.uploads[id]
+		if !ok {
+			upload = &idempotentUpload{done: make(chan struct{})}
+			if s.uploads == nil {
+				s.uploads = make(map[string]*idempotentUpload)
+			}
+			s.uploads[id] = upload
+			s.mu.Unlock()
+			return nil, func(status int, key string) { s.complete(id, upload, status, key) }, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-upload.done:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if upload.status != 0 {
+			return upload, nil, nil
+		}
+		// the concurrent upload failed, so this one is attempted instead
+	}
+}
+
+// complete records the response of a claimed upload if it succeeded, or forgets the upload
+// otherwise, and wakes up the requests waiting for it.
+func (s *idempotentUploads) complete(id string, upload *idempotentUpload, status int, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status == http.StatusOK || status == http.StatusCreated {
+		upload.status = status
+		upload.key = key
+		upload.expiresAt = s.now().Add(s.ttl)
+		s.completed = append(s.completed, completedUpload{id: id, upload: upload})
+		if len(s.completed) > maxIdempotentUploads {
+			s.drop()
+		}
+	} else {
+		delete(s.uploads, id)
+	}
+	close(upload.done)
+}
+
+// prune drops the expired uploads. It must be called with the lock held.
+func (s *idempotentUploads) prune() {
+	now := s.now()
+	for len(s.completed) > 0 && !now.Before(s.completed[0].upload.expiresAt) {
+		s.drop()
+	}
+}
+
+// drop drops the oldest recorded upload. It must be called with the lock held.
+func (s *idempotentUploads) drop() {
+	oldest := s.completed[0]
+	// the ID may have been claimed again since
+	if s.uploads[oldest.id] == oldest.upload {
+		delete(s.uploads, oldest.id)
+	}
+	s.completed[0] = completedUpload{}
+	s.completed = s.completed[1:]
+}
@@ -0,0 +1,109 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+// serverModulePath is the path of the module of the server, whose version is reported by
+// /v2/health/info.
+const serverModulePath = "github.com/DataDog/temporal-large-payload-codec/server"
+
+// infoResponse is the response of /v2/health/info.
+type infoResponse struct {
+	Driver  driverInfo `json:"driver"`
+	Version string     `json:"version"`
+	// UptimeSeconds is the time elapsed since the handler was created.
+	UptimeSeconds int64 `json:"uptimeSeconds"`
+	// Validation is omitted if the storage driver does not implement storage.Validatable.
+	Validation *validationInfo `json:"validation,omitempty"`
+}
+
+// driverInfo describes the storage driver in an infoResponse, see storage.Describer.
+type driverInfo struct {
+	Name   string            `json:"name"`
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// validationInfo describes the last validation of the storage driver in an infoResponse.
+type validationInfo struct {
+	Ready bool `json:"ready"`
+	// Error is the message sent by /v2/health/ready if the driver is not ready, which does not
+	// expose the validation error.
+	Error     string    `json:"error,omitempty"`
+	LatencyMs float64   `json:"latencyMs"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// getInfo returns the identity of the storage driver, the version and uptime of the server, and
+// the result of the last validation of the driver, to help operators debug a deployment.
+// Drivers which do not implement storage.Describer are identified by their type.
+func (b *blobHandler) getInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := infoResponse{
+		Driver:        describeDriver(b.driver),
+		Version:       b.version,
+		UptimeSeconds: int64(time.Since(b.startedAt) / time.Second),
+	}
+	if _, ok := b.driver.(storage.Validatable); ok {
+		checkedAt, latency, err := b.readiness.last(b.driver)
+		resp.Validation = &validationInfo{
+			Ready:     err == nil,
+			LatencyMs: float64(latency) / float64(time.Millisecond),
+			CheckedAt: checkedAt.UTC(),
+		}
+		if err != nil {
+			resp.Validation.Error = errorResponse(err, http.StatusServiceUnavailable).Message
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		b.requestLogger(w).Error(err.Error())
+	}
+}
+
+// describeDriver returns the description of driver, or its type if it does not implement
+// storage.Describer.
+func describeDriver(driver storage.Driver) driverInfo {
+	if describer, ok := driver.(storage.Describer); ok {
+		description := describer.Describe()
+		return driverInfo{Name: description.Name, Config: description.Config}
+	}
+	return driverInfo{Name: fmt.Sprintf("%T", driver)}
+}
+
+// serverVersion returns the version of the server module the binary was built with, which is
+// "(devel)" for binaries built from a checkout, or "unknown" without build information.
+func serverVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == serverModulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == serverModulePath {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
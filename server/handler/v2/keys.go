@@ -0,0 +1,154 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// KeyBuilder builds the key under which a blob with the given data digest and Temporal
+// metadata is stored in the given namespace.
+//
+// Keys which do not follow the layout of ComputeKey are not understood by ParseKey, so the
+// digest of such blobs is not verified when they are sent. Authorizers are called with the
+// namespace returned by ValidateBuiltKey for requests identifying a blob by its key.
+type KeyBuilder interface {
+	BuildKey(namespace, digest string, metadata map[string][]byte) (string, error)
+}
+
+// KeyBuilderFunc is a function implementing KeyBuilder.
+type KeyBuilderFunc func(namespace, digest string, metadata map[string][]byte) (string, error)
+
+// BuildKey calls f.
+func (f KeyBuilderFunc) BuildKey(namespace, digest string, metadata map[string][]byte) (string, error) {
+	return f(namespace, digest, metadata)
+}
+
+// PrefixValidator is implemented by key builders validating the key prefix set in the
+// remote-codec/key-prefix metadata themselves. The prefixes passed to other key builders
+// are validated as by ComputeKey.
+type PrefixValidator interface {
+	ValidatePrefix(prefix string) error
+}
+
+// DefaultKeyBuilder builds keys with ComputeKey.
+var DefaultKeyBuilder KeyBuilder = KeyBuilderFunc(ComputeKey)
+
+// BuildKey returns the key built by builder for a blob with the given data digest and
+// Temporal metadata in the given namespace, once the key prefix set in the metadata is
+// validated.
+func BuildKey(builder KeyBuilder, namespace, digest string, metadata map[string][]byte) (string, error) {
+	if prefix := string(metadata[KeyPrefixMetadataKey]); prefix != "" {
+		if validator, ok := builder.(PrefixValidator); ok {
+			if err := validator.ValidatePrefix(prefix); err != nil {
+				return "", err
+			}
+		} else if err := ValidateKeyPrefix(prefix); err != nil {
+			return "", err
+		}
+	}
+	return builder.BuildKey(namespace, digest, metadata)
+}
+
+// validNamespace matches the characters of the namespaces accepted by ValidateNamespace.
+var validNamespace = regexp.MustCompile(`^[0-9a-zA-Z_\-.]+$`).MatchString
+
+// ValidateNamespace returns an error if namespace is empty, contains "..", or contains
+// characters other than letters, digits, '_', '-' and '.', as namespaces are segments of the
+// keys of blobs.
+func ValidateNamespace(namespace string) error {
+	if namespace == "" {
+		return withCode(ErrorCodeInvalidNamespace, errors.New("namespace is required"))
+	}
+	if namespace == "." || strings.Contains(namespace, "..") {
+		return withCode(ErrorCodeInvalidNamespace, fmt.Errorf("'%s' is not a valid namespace: '.' and '..' are not allowed", namespace))
+	}
+	if !validNamespace(namespace) {
+		return withCode(ErrorCodeInvalidNamespace, fmt.Errorf("'%s' is not a valid namespace: only letters, digits, '_', '-' and '.' are allowed", namespace))
+	}
+	return nil
+}
+
+// namespaceParam returns the namespace query parameter of a request, or sends an error
+// response and returns false if it is missing or invalid.
+func (b *blobHandler) namespaceParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		b.handleError(w, errors.New("namespace query parameter is required"), http.StatusBadRequest)
+		return "", false
+	}
+	if err := ValidateNamespace(namespace); err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return "", false
+	}
+	return namespace, true
+}
+
+// validKeySegment matches the segments of the keys accepted by ValidateKey.
+var validKeySegment = regexp.MustCompile(`^[0-9a-zA-Z_\-.:]+$`).MatchString
+
+// KeyValidator is implemented by key builders validating the keys of requests themselves,
+// e.g. for layouts which do not start with /blobs/<namespace>/. The keys of requests to other
+// key builders are validated with ValidateKey.
+type KeyValidator interface {
+	// ValidateKey returns the namespace of key, or an error if it is not a valid key.
+	ValidateKey(key string) (namespace string, err error)
+}
+
+// ValidateKey returns the namespace of a key with the layout /blobs/<namespace>/..., or an
+// error if key has another layout, or contains "..", empty segments, or characters other than
+// letters, digits, '_', '-', '.' and ':'.
+func ValidateKey(key string) (string, error) {
+	tokens := strings.Split(key, "/")
+	if len(tokens) < 4 || tokens[0] != "" || tokens[1] != "blobs" {
+		return "", fmt.Errorf("'%s' is not a valid key: expected /blobs/<namespace>/...", key)
+	}
+	if strings.Contains(key, "..") {
+		return "", fmt.Errorf("'%s' is not a valid key: '..' is not allowed", key)
+	}
+	for _, token := range tokens[1:] {
+		if token == "" || token == "." {
+			return "", fmt.Errorf("'%s' is not a valid key: empty segments are not allowed", key)
+		}
+		if !validKeySegment(token) {
+			return "", fmt.Errorf("'%s' is not a valid key: segment '%s' has invalid characters", key, token)
+		}
+	}
+	return tokens[2], nil
+}
+
+// ValidateBuiltKey returns the namespace of a key built by builder, validating it with
+// builder if it implements KeyValidator, or with ValidateKey otherwise.
+func ValidateBuiltKey(builder KeyBuilder, key string) (string, error) {
+	if validator, ok := builder.(KeyValidator); ok {
+		return validator.ValidateKey(key)
+	}
+	return ValidateKey(key)
+}
+
+// checkKey validates the key of a request, and checks that it belongs to the namespace of
+// the request if keys are scoped to namespaces. It returns the namespace of the key, or the
+// HTTP response status code and error of invalid keys.
+func (b *blobHandler) checkKey(r *http.Request, key string) (string, int, error) {
+	namespace, err := ValidateBuiltKey(b.keyBuilder, key)
+	if err != nil {
+		return "", http.StatusBadRequest, withCode(ErrorCodeInvalidKey, err)
+	}
+	if !b.namespaceScopedKeys {
+		return namespace, 0, nil
+	}
+	namespaceParam := r.URL.Query().Get("namespace")
+	if namespaceParam == "" {
+		return "", http.StatusBadRequest, errors.New("namespace query parameter is required")
+	}
+	if namespaceParam != namespace {
+		return "", http.StatusForbidden, fmt.Errorf("key '%s' does not belong to namespace '%s'", key, namespaceParam)
+	}
+	return namespace, 0, nil
+}
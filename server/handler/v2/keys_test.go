@@ -0,0 +1,172 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// workflowKeyBuilder builds keys grouping blobs by workflow, validating prefixes itself.
+type workflowKeyBuilder struct{}
+
+func (workflowKeyBuilder) BuildKey(namespace, digest string, metadata map[string][]byte) (string, error) {
+	return fmt.Sprintf("%s/%s/%s", namespace, metadata[KeyPrefixMetadataKey], digest), nil
+}
+
+func (workflowKeyBuilder) ValidatePrefix(prefix string) error {
+	if prefix == "forbidden" {
+		return errors.New("forbidden prefix")
+	}
+	return nil
+}
+
+func Test_BuildKey(t *testing.T) {
+	flatKeyBuilder := KeyBuilderFunc(func(namespace, digest string, _ map[string][]byte) (string, error) {
+		return namespace + "/" + digest, nil
+	})
+
+	testCase := []struct {
+		name        string
+		builder     KeyBuilder
+		meta        map[string][]byte
+		expectedKey string
+		expectError bool
+	}{
+		{
+			name:        "default",
+			builder:     DefaultKeyBuilder,
+			meta:        map[string][]byte{},
+			expectedKey: "/blobs/foo/common/sha256:1234/sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			name:        "custom",
+			builder:     flatKeyBuilder,
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("a/b")},
+			expectedKey: "foo/sha256:1234",
+		},
+		{
+			name:        "custom with invalid prefix",
+			builder:     flatKeyBuilder,
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("../../a")},
+			expectError: true,
+		},
+		{
+			name:        "custom validating prefixes",
+			builder:     workflowKeyBuilder{},
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("workflow:1")},
+			expectedKey: "foo/workflow:1/sha256:1234",
+		},
+		{
+			name:        "custom rejecting prefix",
+			builder:     workflowKeyBuilder{},
+			meta:        map[string][]byte{KeyPrefixMetadataKey: []byte("forbidden")},
+			expectError: true,
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			key, err := BuildKey(scenario.builder, "foo", "sha256:1234", scenario.meta)
+			if scenario.expectError {
+				assert.Error(t, err)
+				assert.Empty(t, key)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, scenario.expectedKey, key)
+			}
+		})
+	}
+}
+
+func Test_ValidateKey(t *testing.T) {
+	testCase := []struct {
+		name      string
+		key       string
+		namespace string
+		wantErr   string
+	}{
+		{
+			name:      "common",
+			key:       "/blobs/foo/common/sha256:1234/sha256:abcd",
+			namespace: "foo",
+		},
+		{
+			name:      "custom",
+			key:       "/blobs/foo.bar/custom/a/b_c/sha256:1234/sha256:abcd",
+			namespace: "foo.bar",
+		},
+		{
+			name:    "no namespace",
+			key:     "/blobs/foo",
+			wantErr: "'/blobs/foo' is not a valid key: expected /blobs/<namespace>/...",
+		},
+		{
+			name:    "relative",
+			key:     "blobs/foo/common/sha256:1234",
+			wantErr: "'blobs/foo/common/sha256:1234' is not a valid key: expected /blobs/<namespace>/...",
+		},
+		{
+			name:    "other object",
+			key:     "/backups/foo/dump",
+			wantErr: "'/backups/foo/dump' is not a valid key: expected /blobs/<namespace>/...",
+		},
+		{
+			name:    "traversal",
+			key:     "/blobs/foo/../../etc/passwd",
+			wantErr: "'/blobs/foo/../../etc/passwd' is not a valid key: '..' is not allowed",
+		},
+		{
+			name:    "traversal to other namespace",
+			key:     "/blobs/foo/common/../../bar/common/sha256:1234",
+			wantErr: "'/blobs/foo/common/../../bar/common/sha256:1234' is not a valid key: '..' is not allowed",
+		},
+		{
+			name:    "current directory",
+			key:     "/blobs/foo/./sha256:1234",
+			wantErr: "'/blobs/foo/./sha256:1234' is not a valid key: empty segments are not allowed",
+		},
+		{
+			name:    "empty segment",
+			key:     "/blobs/foo//sha256:1234",
+			wantErr: "'/blobs/foo//sha256:1234' is not a valid key: empty segments are not allowed",
+		},
+		{
+			name:    "empty namespace",
+			key:     "/blobs//common/sha256:1234",
+			wantErr: "'/blobs//common/sha256:1234' is not a valid key: empty segments are not allowed",
+		},
+		{
+			name:    "trailing slash",
+			key:     "/blobs/foo/common/",
+			wantErr: "'/blobs/foo/common/' is not a valid key: empty segments are not allowed",
+		},
+		{
+			name:    "invalid characters",
+			key:     "/blobs/foo/common/sha256:1234?x=1",
+			wantErr: "'/blobs/foo/common/sha256:1234?x=1' is not a valid key: segment 'sha256:1234?x=1' has invalid characters",
+		},
+		{
+			name:    "backslash",
+			key:     "/blobs/foo/common\\..\\bar",
+			wantErr: "'/blobs/foo/common\\..\\bar' is not a valid key: '..' is not allowed",
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			namespace, err := ValidateKey(scenario.key)
+			if scenario.wantErr != "" {
+				assert.EqualError(t, err, scenario.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, scenario.namespace, namespace)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"errors"
+)
+
+// errBlobTooLarge is returned when a request body exceeds its limit.
+var errBlobTooLarge = errors.New("request body exceeds its declared length")
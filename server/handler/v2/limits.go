@@ -0,0 +1,72 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// limitsResponse is the response of /v2/limits.
+type limitsResponse struct {
+	// MaxBlobBytes is the maximum size of a blob uploaded with /v2/blobs/put.
+	MaxBlobBytes uint64 `json:"maxBlobBytes"`
+	// QuotaBytes is the maximum number of bytes stored by the namespace, if it has a quota.
+	QuotaBytes uint64 `json:"quotaBytes,omitempty"`
+	// UsedBytes is the number of bytes stored by the namespace, if it has a quota.
+	UsedBytes *uint64 `json:"usedBytes,omitempty"`
+}
+
+// getLimits returns the limits of the server, which allows clients to reject payloads
+// exceeding them without uploading them first. If the namespace query parameter is set,
+// the limits of the namespace are returned, including its quota and usage if it has one.
+func (b *blobHandler) getLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	if namespace != "" {
+		if err := ValidateNamespace(namespace); err != nil {
+			b.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	resp := limitsResponse{MaxBlobBytes: b.maxBlobBytesFor(namespace)}
+	used, quota, ok, err := b.quotas.usage(r.Context(), namespace)
+	if err != nil {
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if ok {
+		resp.QuotaBytes = quota
+		resp.UsedBytes = &used
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		b.requestLogger(w).Error(err.Error())
+	}
+}
+
+// maxBlobBytesFor returns the maximum size of a blob in the given namespace.
+func (b *blobHandler) maxBlobBytesFor(namespace string) uint64 {
+	if limit := b.namespaceMaxBlobBytes[namespace]; limit != 0 {
+		return limit
+	}
+	return b.maxBlobBytes
+}
+
+// blobTooLargeError returns the error for a blob whose declared size exceeds the maximum size
+// in the given namespace, stating the limit and whether it is specific to the namespace.
+func (b *blobHandler) blobTooLargeError(namespace string, size uint64) error {
+	if limit := b.namespaceMaxBlobBytes[namespace]; limit != 0 {
+		return fmt.Errorf("payload of %d bytes exceeds the max size of %d bytes of namespace '%s'", size, limit, namespace)
+	}
+	return fmt.Errorf("payload of %d bytes exceeds the global max size of %d bytes", size, b.maxBlobBytes)
+}
@@ -0,0 +1,103 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// DefaultListLimit is the number of blobs listed by /v2/blobs/list unless the limit query
+	// parameter is set.
+	DefaultListLimit = 100
+	// MaxListLimit is the maximum number of blobs listed by /v2/blobs/list at once, larger
+	// limits are capped.
+	MaxListLimit = 1000
+)
+
+// listResponse is the response of /v2/blobs/list.
+type listResponse struct {
+	Blobs []listedBlob `json:"blobs"`
+	// Cursor continues the listing, it is empty if there are no more blobs.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// listedBlob describes a blob in a listResponse.
+type listedBlob struct {
+	Key           string    `json:"key"`
+	ContentLength uint64    `json:"contentLength"`
+	LastModified  time.Time `json:"lastModified"`
+}
+
+// listBlobs returns the blobs of a namespace, whose keys start with /blobs/<namespace>/
+// followed by the prefix query parameter, one page at a time.
+func (b *blobHandler) listBlobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+	if !b.listing {
+		b.handleError(w, errors.New("blob listing is not enabled"), http.StatusNotImplemented)
+		return
+	}
+	lister, ok := b.driver.(storage.Lister)
+	if !ok {
+		b.handleError(w, errors.New("storage driver does not support listing blobs"), http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	namespace, ok := b.namespaceParam(w, r)
+	if !ok {
+		return
+	}
+	limit := DefaultListLimit
+	if limitParam := query.Get("limit"); limitParam != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit <= 0 {
+			b.handleError(w, fmt.Errorf("limit query parameter '%s' must be a positive number", limitParam), http.StatusBadRequest)
+			return
+		}
+		if limit > MaxListLimit {
+			limit = MaxListLimit
+		}
+	}
+
+	prefix := fmt.Sprintf("/blobs/%s/%s", namespace, query.Get("prefix"))
+	if !b.authorize(w, r, OperationList, namespace, prefix) {
+		return
+	}
+
+	listed, err := lister.ListPayloads(r.Context(), &storage.ListRequest{
+		Prefix: prefix,
+		Limit:  limit,
+		Cursor: query.Get("cursor"),
+	})
+	if err != nil {
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := listResponse{Blobs: make([]listedBlob, 0, len(listed.Blobs)), Cursor: listed.NextCursor}
+	for _, blob := range listed.Blobs {
+		resp.Blobs = append(resp.Blobs, listedBlob{
+			Key:           blob.Key,
+			ContentLength: blob.ContentLength,
+			LastModified:  blob.LastModified.UTC(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		b.requestLogger(w).Error(err.Error())
+	}
+}
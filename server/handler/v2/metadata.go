@@ -0,0 +1,53 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+const (
+	// MaxMetadataKeyBytes is the size of the longest key of Temporal metadata accepted by
+	// ValidateMetadata.
+	MaxMetadataKeyBytes = 128
+	// MaxMetadataValueBytes is the size of the longest value of Temporal metadata accepted by
+	// ValidateMetadata.
+	MaxMetadataValueBytes = 4096
+)
+
+// validMetadataKey matches the characters of the metadata keys accepted by ValidateMetadata.
+var validMetadataKey = regexp.MustCompile(`^[0-9a-zA-Z_\-./]+$`).MatchString
+
+// ValidateMetadata returns an error naming the offending key if a key of the Temporal
+// metadata of a blob is empty, longer than MaxMetadataKeyBytes, or contains characters other
+// than letters, digits, '_', '-', '.' and '/', or if a value is longer than
+// MaxMetadataValueBytes. Keys are checked in order, so the first offending key is reported.
+// Values may hold any bytes: drivers record them with
+// storage.PayloadMetadata, which encodes the values object stores would not accept.
+func ValidateMetadata(metadata map[string][]byte) error {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := metadata[key]
+		switch {
+		case key == "":
+			return withCode(ErrorCodeInvalidMetadata, errors.New("metadata keys must not be empty"))
+		case len(key) > MaxMetadataKeyBytes:
+			return withCode(ErrorCodeInvalidMetadata, fmt.Errorf("metadata key '%.*s...' is longer than %d bytes", MaxMetadataKeyBytes, key, MaxMetadataKeyBytes))
+		case !validMetadataKey(key):
+			return withCode(ErrorCodeInvalidMetadata, fmt.Errorf("metadata key %q is not valid: only letters, digits, '_', '-', '.' and '/' are allowed", key))
+		case len(value) > MaxMetadataValueBytes:
+			return withCode(ErrorCodeInvalidMetadata, fmt.Errorf("the value of metadata key '%s' is %d bytes long, the maximum is %d bytes", key, len(value), MaxMetadataValueBytes))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// DefaultPresignExpiry is the period for which presigned URLs are valid unless configured
+	// otherwise.
+	DefaultPresignExpiry = 15 * time.Minute
+	// MaxPresignExpiry is the longest period for which presigned URLs are valid, which is the
+	// limit of the signatures of S3 and GCS. Longer periods are capped.
+	MaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// presignResponse is returned by the presign endpoints. URL is empty if the
+// blob already exists and does not need to be uploaded.
+type presignResponse struct {
+	Key     string              `json:"key"`
+	URL     string              `json:"url,omitempty"`
+	Method  string              `json:"method,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+}
+
+func (b *blobHandler) presignPutBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	presigner, ok := b.driver.(storage.Presigner)
+	if !ok {
+		b.handleError(w, errors.New("storage driver does not support presigned URLs"), http.StatusNotImplemented)
+		return
+	}
+
+	expectedLengthHeader := r.Header.Get("X-Payload-Expected-Content-Length")
+	if expectedLengthHeader == "" {
+		b.handleError(w, fmt.Errorf("expected content length header is required"), http.StatusBadRequest)
+		return
+	}
+	expectedLength, err := strconv.ParseUint(expectedLengthHeader, 10, 64)
+	if err != nil {
+		b.handleError(w, fmt.Errorf("expected content length header %s is invalid: %w", expectedLengthHeader, err), http.StatusBadRequest)
+		return
+	}
+
+	namespaceParam, ok := b.namespaceParam(w, r)
+	if !ok {
+		return
+	}
+	if expectedLength > b.maxBlobBytesFor(namespaceParam) {
+		b.handleError(w, b.blobTooLargeError(namespaceParam, expectedLength), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	digestParam := r.URL.Query().Get("digest")
+	if digestParam == "" {
+		b.handleError(w, errors.New("digest query parameter is required"), http.StatusBadRequest)
+		return
+	}
+	if _, _, err := b.digestAndHash(digestParam); err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	temporalMetadata, err := b.decodeTemporalMetadata(r)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	key, err := b.computeKey(namespaceParam, digestParam, temporalMetadata)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := b.blobExpiry(r, namespaceParam)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !b.authorize(w, r, OperationPut, namespaceParam, key) {
+		return
+	}
+
+	existResponse, err := b.driver.ExistPayload(r.Context(), &storage.ExistRequest{Key: key})
+	if err != nil {
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if existResponse.Exists {
+		if status, err := b.checkExisting(r, key, digestParam, expectedLength, temporalMetadata, existResponse); err != nil {
+			b.handleError(w, err, status)
+			return
+		}
+		// blobs expiring too early are uploaded again to extend their expiry
+		if !expiresBefore(existResponse.ExpiresAt, expiresAt) {
+			b.writePresignResponse(w, &presignResponse{Key: key})
+			return
+		}
+	}
+	// the blob is uploaded to the object store directly, so the size of new blobs is reserved
+	// until the URL expires
+	if !existResponse.Exists && !b.reserveQuota(w, r, namespaceParam, key, expectedLength) {
+		return
+	}
+
+	presigned, err := presigner.PresignPut(r.Context(), &storage.PresignPutRequest{
+		Key:           key,
+		Digest:        digestParam,
+		ContentLength: expectedLength,
+		ContentType:   payloadContentType(r),
+		ExpiresAt:     expiresAt,
+		Metadata:      temporalMetadata,
+		Expires:       b.presignExpiry,
+	})
+	if err != nil {
+		if !existResponse.Exists {
+			b.quotas.settle(namespaceParam, key, false)
+		}
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !existResponse.Exists && b.quotas.has(namespaceParam) {
+		time.AfterFunc(b.presignExpiry, func() { b.settlePresignedUpload(namespaceParam, key) })
+	}
+
+	b.writePresignResponse(w, &presignResponse{
+		Key:     key,
+		URL:     presigned.URL,
+		Method:  presigned.Method,
+		Headers: presigned.Header,
+	})
+}
+
+// settlePresignedUpload settles the quota reserved for a blob uploaded with a presigned URL
+// once the URL expired, releasing it unless the blob was uploaded. Blobs whose existence cannot
+// be checked are assumed to be uploaded, until the usage of the namespace is listed again.
+func (b *blobHandler) settlePresignedUpload(namespace, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	existResponse, err := b.driver.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("unable to check whether presigned blob %s was uploaded: %v", key, err))
+	}
+	b.quotas.settle(namespace, key, err != nil || existResponse.Exists)
+}
+
+func (b *blobHandler) presignGetBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	presigner, ok := b.driver.(storage.Presigner)
+	if !ok {
+		b.handleError(w, errors.New("storage driver does not support presigned URLs"), http.StatusNotImplemented)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		b.handleError(w, errors.New("key query parameter is required"), http.StatusBadRequest)
+		return
+	}
+	namespace, status, err := b.checkKey(r, key)
+	if err != nil {
+		b.handleError(w, err, status)
+		return
+	}
+	if !b.authorize(w, r, OperationGet, namespace, key) {
+		return
+	}
+
+	presigned, err := presigner.PresignGet(r.Context(), &storage.PresignGetRequest{
+		Key:     key,
+		Expires: b.presignExpiry,
+	})
+	if err != nil {
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	b.writePresignResponse(w, &presignResponse{
+		Key:     key,
+		URL:     presigned.URL,
+		Method:  presigned.Method,
+		Headers: presigned.Header,
+	})
+}
+
+func (b *blobHandler) writePresignResponse(w http.ResponseWriter, resp *presignResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		b.requestLogger(w).Error(err.Error())
+	}
+}
@@ -0,0 +1,285 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.temporal.io/sdk/client"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// metricNamespaceUsageBytes is the number of bytes stored by a namespace with a quota.
+	metricNamespaceUsageBytes = "lps_namespace_usage_bytes"
+	metricTagNamespace        = "namespace"
+
+	// quotaListPageSize is the number of blobs listed at once to compute the usage of a namespace.
+	quotaListPageSize = 1000
+)
+
+// quotas tracks the number of bytes stored by the namespaces with a quota. The usage of a
+// namespace is computed by listing its blobs when it is first needed, if the driver implements
+// storage.Lister, and then updated with the blobs stored and deleted through the handler or
+// reported to its Deletions.
+type quotas struct {
+	lister storage.Lister
+	// keyBuilder builds the keys of blobs, the blobs of a namespace are listed under
+	// /blobs/<namespace>/ unless it implements KeyValidator.
+	keyBuilder     KeyBuilder
+	metricsHandler client.MetricsHandler
+	// namespaces is not modified after the handler is created, so it is read without locking.
+	namespaces map[string]*namespaceUsage
+}
+
+// namespaceUsage is the usage of a namespace with a quota.
+type namespaceUsage struct {
+	quota uint64
+	// mu is held while the usage is computed, so that it is listed once.
+	mu     sync.Mutex
+	seeded bool
+	used   uint64
+	// uploads are the reservations of the blobs being stored by key, so that concurrent
+	// uploads of the same new blob reserve its size once.
+	uploads map[string]*quotaReservation
+}
+
+// quotaReservation is the size reserved for a blob being stored by one or more uploads.
+type quotaReservation struct {
+	size uint64
+	// holders is the number of uploads of the blob in progress.
+	holders int
+	// stored is set once one of them stored the blob.
+	stored bool
+}
+
+// newQuotas returns the quotas of the given namespaces, whose usage is computed by listing
+// the blobs stored with driver if it implements storage.Lister. Zero quotas are ignored.
+func newQuotas(driver storage.Driver, limits map[string]uint64, keyBuilder KeyBuilder, metricsHandler client.MetricsHandler) *quotas {
+	q := &quotas{keyBuilder: keyBuilder, metricsHandler: metricsHandler, namespaces: make(map[string]*namespaceUsage, len(limits))}
+	q.lister, _ = driver.(storage.Lister)
+	for namespace, quota := range limits {
+		if quota != 0 {
+			q.namespaces[namespace] = &namespaceUsage{quota: quota, uploads: make(map[string]*quotaReservation)}
+		}
+	}
+	return q
+}
+
+// Deletions relays the blobs deleted without going through the handler, e.g. expired blobs
+// deleted by the sweeper, to the handlers created with it, so that their size is credited back
+// to the quota of their namespace. The zero value is ready to use.
+type Deletions struct {
+	mu       sync.RWMutex
+	handlers []func(namespace, key string, size uint64)
+}
+
+// Deleted reports that the blob with the given key and size was deleted from namespace.
+func (d *Deletions) Deleted(namespace, key string, size uint64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, handler := range d.handlers {
+		handler(namespace, key, size)
+	}
+}
+
+// handle registers a function called with the deleted blobs.
+func (d *Deletions) handle(handler func(namespace, key string, size uint64)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers = append(d.handlers, handler)
+}
+
+// quotaExceededError is the error of requests storing more bytes than the quota of their
+// namespace allows.
+type quotaExceededError struct {
+	namespace string
+	used      uint64
+	quota     uint64
+	size      uint64
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("storing %d bytes exceeds the quota of namespace '%s', which uses %d of its %d bytes", e.size, e.namespace, e.used, e.quota)
+}
+
+// reserve adds size bytes to the usage of namespace for storing the blob with the given key,
+// unless they exceed its quota in which case a *quotaExceededError is returned. The size of a
+// blob which is being stored already is not added again. Each reservation must be settled
+// once the upload ends.
+func (q *quotas) reserve(ctx context.Context, namespace, key string, size uint64) error {
+	usage, ok := q.namespaces[namespace]
+	if !ok {
+		return nil
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	if err := q.seed(ctx, namespace, usage); err != nil {
+		return err
+	}
+	if reservation, ok := usage.uploads[key]; ok {
+		reservation.holders++
+		return nil
+	}
+	if usage.used+size > usage.quota {
+		return &quotaExceededError{namespace: namespace, used: usage.used, quota: usage.quota, size: size}
+	}
+	usage.used += size
+	usage.uploads[key] = &quotaReservation{size: size, holders: 1}
+	q.record(namespace, usage)
+	return nil
+}
+
+// settle ends a reservation made by reserve for the blob with the given key, once the upload
+// stored it or failed. The reserved size is released when the last upload of the blob ends
+// unless one of them stored it.
+func (q *quotas) settle(namespace, key string, stored bool) {
+	usage, ok := q.namespaces[namespace]
+	if !ok {
+		return
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	reservation, ok := usage.uploads[key]
+	if !ok {
+		// the usage was reset since, and is listed again when it is next needed
+		return
+	}
+	reservation.stored = reservation.stored || stored
+	reservation.holders--
+	if reservation.holders > 0 {
+		return
+	}
+	delete(usage.uploads, key)
+	if !reservation.stored {
+		q.subtract(namespace, usage, reservation.size)
+	}
+}
+
+// release subtracts size bytes from the usage of namespace, e.g. of deleted blobs.
+func (q *quotas) release(namespace string, size uint64) {
+	usage, ok := q.namespaces[namespace]
+	if !ok {
+		return
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	if !usage.seeded {
+		// the blob is accounted for when the usage is listed
+		return
+	}
+	q.subtract(namespace, usage, size)
+}
+
+// subtract subtracts size bytes from the usage of namespace. It must be called with usage.mu
+// held.
+func (q *quotas) subtract(namespace string, usage *namespaceUsage, size uint64) {
+	if size > usage.used {
+		size = usage.used
+	}
+	usage.used -= size
+	q.record(namespace, usage)
+}
+
+// reset discards the usage of namespace, which is listed again when it is next needed, e.g.
+// after deleting many of its blobs.
+func (q *quotas) reset(namespace string) {
+	usage, ok := q.namespaces[namespace]
+	if !ok {
+		return
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	usage.seeded = false
+	usage.used = 0
+	usage.uploads = make(map[string]*quotaReservation)
+}
+
+// usage returns the number of bytes stored by namespace and its quota, and whether it has one.
+func (q *quotas) usage(ctx context.Context, namespace string) (uint64, uint64, bool, error) {
+	usage, ok := q.namespaces[namespace]
+	if !ok {
+		return 0, 0, false, nil
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	if err := q.seed(ctx, namespace, usage); err != nil {
+		return 0, 0, true, err
+	}
+	return usage.used, usage.quota, true, nil
+}
+
+// has returns whether namespace has a quota.
+func (q *quotas) has(namespace string) bool {
+	_, ok := q.namespaces[namespace]
+	return ok
+}
+
+// seed computes the usage of namespace by listing its blobs unless it was computed already.
+// Without a lister, the usage starts at zero. It must be called with usage.mu held.
+//
+// Keys built by a KeyBuilder implementing KeyValidator may not share a prefix per namespace,
+// so all blobs are listed and counted for the namespace returned by ValidateKey.
+func (q *quotas) seed(ctx context.Context, namespace string, usage *namespaceUsage) error {
+	if usage.seeded {
+		return nil
+	}
+	var used uint64
+	if q.lister != nil {
+		request := &storage.ListRequest{Prefix: fmt.Sprintf("/blobs/%s/", namespace), Limit: quotaListPageSize}
+		validator, _ := q.keyBuilder.(KeyValidator)
+		if validator != nil {
+			request.Prefix = ""
+		}
+		for {
+			listed, err := q.lister.ListPayloads(ctx, request)
+			if err != nil {
+				return fmt.Errorf("unable to compute the usage of namespace '%s': %w", namespace, err)
+			}
+			for _, blob := range listed.Blobs {
+				if validator != nil {
+					if keyNamespace, err := validator.ValidateKey(blob.Key); err != nil || keyNamespace != namespace {
+						continue
+					}
+				}
+				used += blob.ContentLength
+			}
+			if listed.NextCursor == "" {
+				break
+			}
+			request.Cursor = listed.NextCursor
+		}
+	}
+	usage.seeded = true
+	usage.used = used
+	q.record(namespace, usage)
+	return nil
+}
+
+// record records the usage of namespace as a metric. It must be called with usage.mu held.
+func (q *quotas) record(namespace string, usage *namespaceUsage) {
+	q.metricsHandler.WithTags(map[string]string{metricTagNamespace: namespace}).Gauge(metricNamespaceUsageBytes).Update(float64(usage.used))
+}
+
+// reserveQuota reserves size bytes of the quota of namespace for the blob with the given key,
+// sending the error response if it is exceeded or the usage cannot be computed. It returns
+// whether the request may proceed.
+func (b *blobHandler) reserveQuota(w http.ResponseWriter, r *http.Request, namespace, key string, size uint64) bool {
+	if err := b.quotas.reserve(r.Context(), namespace, key, size); err != nil {
+		var exceeded *quotaExceededError
+		if errors.As(err, &exceeded) {
+			b.handleError(w, err, http.StatusInsufficientStorage)
+		} else {
+			b.handleError(w, err, http.StatusInternalServerError)
+		}
+		return false
+	}
+	return true
+}
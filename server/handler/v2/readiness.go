@@ -0,0 +1,101 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// DefaultReadinessCacheTTL is the period for which the result of a readiness check is
+	// reused unless configured otherwise.
+	DefaultReadinessCacheTTL = 5 * time.Second
+	// readinessTimeout bounds the validation of the storage driver in readiness checks.
+	readinessTimeout = 2 * time.Second
+)
+
+// readiness caches the result of validating the storage driver.
+type readiness struct {
+	// ttl is the period for which a result is reused, results are not cached if it is negative.
+	ttl time.Duration
+	// observer is called with the result of a check if it differs from the previous one.
+	observer func(err error)
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+	// latency is the duration of the last validation.
+	latency time.Duration
+}
+
+// check validates driver, unless it was validated less than the TTL ago.
+func (c *readiness) check(driver storage.Driver) error {
+	v, ok := driver.(storage.Validatable)
+	if !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < c.ttl {
+		return c.err
+	}
+
+	// the check is not bound to the probe, so that its result can be reused by others
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+	start := time.Now()
+	err := v.Validate(ctx)
+
+	changed := c.checked.IsZero() || (err == nil) != (c.err == nil)
+	c.checked = time.Now()
+	c.err = err
+	c.latency = c.checked.Sub(start)
+	if changed && c.observer != nil {
+		c.observer(err)
+	}
+	return err
+}
+
+// retryAfter returns the period after which the result of the last check expires, so that
+// the driver is validated again.
+func (c *readiness) retryAfter() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ttl - time.Since(c.checked)
+}
+
+// last returns the time, result and duration of the last validation, checking the driver
+// first unless it was validated less than the TTL ago. The time is zero if the driver does
+// not implement storage.Validatable.
+func (c *readiness) last(driver storage.Driver) (time.Time, time.Duration, error) {
+	_ = c.check(driver)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checked, c.latency, c.err
+}
+
+// getReadiness returns 200 if the storage driver is usable, and 503 with the validation error
+// and a Retry-After header set to the expiry of the cached result otherwise. Unlike /v2/health/head, which only tells whether the server is running, it
+// validates the storage driver if it implements storage.Validatable.
+func (b *blobHandler) getReadiness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		b.handleError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := b.readiness.check(b.driver); err != nil {
+		// failures are reported by the observer rather than logged for every probe
+		SetRetryAfter(w, b.readiness.retryAfter())
+		b.writeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
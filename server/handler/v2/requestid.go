@@ -0,0 +1,46 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+)
+
+// RequestIDHeader is the header of requests and responses holding the ID of a request, which
+// correlates the errors of clients with the log entries of the server.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a copy of ctx holding the ID of a request. The handler echoes
+// it in the RequestIDHeader of the response and in error responses, and logs it with errors.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the ID of a request set with ContextWithRequestID, or an
+// empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the logger of the handler, which logs the ID of the request echoed
+// in w with each entry.
+func (b *blobHandler) requestLogger(w http.ResponseWriter) logging.Logger {
+	return withRequestID(b.logger, w.Header().Get(RequestIDHeader))
+}
+
+// withRequestID returns logger, which logs the given request ID with each entry unless it
+// is empty.
+func withRequestID(logger logging.Logger, id string) logging.Logger {
+	if id == "" {
+		return logger
+	}
+	return logging.With(logger, "requestId", id)
+}
@@ -0,0 +1,41 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// payloadTTLHeader is the header of put requests setting the number of seconds after which the
+// blob may be deleted.
+const payloadTTLHeader = "X-Payload-TTL"
+
+// blobExpiry returns the time after which a blob of the given namespace stored by the request
+// may be deleted, or the zero time if it never expires. The X-Payload-TTL header of the
+// request overrides the default TTL of the namespace.
+func (b *blobHandler) blobExpiry(r *http.Request, namespace string) (time.Time, error) {
+	ttl := b.namespaceBlobTTL[namespace]
+	if header := r.Header.Get(payloadTTLHeader); header != "" {
+		seconds, err := strconv.ParseUint(header, 10, 32)
+		if err != nil || seconds == 0 {
+			return time.Time{}, fmt.Errorf("%s header '%s' must be a positive number of seconds", payloadTTLHeader, header)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl <= 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(ttl), nil
+}
+
+// expiresBefore tells whether a blob expiring at expiresAt expires before wanted, in which
+// case it must be stored again with the later expiry since blobs are shared by all payloads
+// with the same data and metadata. The zero time means that a blob never expires.
+func expiresBefore(expiresAt, wanted time.Time) bool {
+	return !expiresAt.IsZero() && (wanted.IsZero() || expiresAt.Before(wanted))
+}
@@ -0,0 +1,521 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package v2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/internal/limit"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// DefaultUploadSessionTTL is the period of inactivity after which upload sessions expire
+	// unless configured otherwise.
+	DefaultUploadSessionTTL = time.Hour
+	// DefaultMaxUploadBytes is the maximum size of a blob uploaded with an upload session
+	// unless configured otherwise, which is the maximum object size of S3.
+	DefaultMaxUploadBytes = 5 << 40
+	// maxUploadParts is the maximum number of parts of an upload session, which is the
+	// maximum number of parts of S3 multipart uploads.
+	maxUploadParts = 10000
+	// abortTimeout bounds aborting the multipart upload of an expired session, and checking
+	// whether the blob of an expired presigned URL was uploaded.
+	abortTimeout = time.Minute
+)
+
+// uploadSessionResponse is returned when starting an upload session.
+type uploadSessionResponse struct {
+	ID string `json:"id"`
+}
+
+// uploadSessions are the upload sessions in progress, which allow clients to upload blobs
+// larger than the maximum blob size in parts. Sessions are held in memory, so all requests of
+// a session must be served by the same server.
+type uploadSessions struct {
+	// ttl is the period of inactivity after which a session expires.
+	ttl time.Duration
+	// maxBytes is the maximum size of a blob uploaded with a session.
+	maxBytes uint64
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+// uploadSession is a multipart upload of a blob, whose fields are guarded by the mutex of
+// uploadSessions.
+type uploadSession struct {
+	namespace string
+	key       string
+	// algorithm and digest are the digest algorithm and hex encoded checksum of the blob.
+	algorithm string
+	digest    string
+	// size is the declared size of the whole blob.
+	size     uint64
+	uploadID string
+	expiry   *time.Timer
+
+	parts map[int]uploadedPart
+	// uploading is the number of parts being uploaded.
+	uploading int
+	// hash is fed with the parts uploaded in order, so that the checksum of the blob is known
+	// without reading it back. hashedParts is the number of parts fed into it, and hashValid
+	// is unset once parts are uploaded out of order or replaced with other data.
+	hash        hash.Hash
+	hashedParts int
+	hashing     bool
+	hashValid   bool
+}
+
+type uploadedPart struct {
+	size   uint64
+	digest string
+	etag   string
+}
+
+// serveUploads routes the requests of upload sessions:
+//
+//	POST   /v2/blobs/uploads                starts a session
+//	PUT    /v2/blobs/uploads/{id}?part=N    uploads the part N of a session
+//	POST   /v2/blobs/uploads/{id}/complete  assembles the blob and returns its key
+//	DELETE /v2/blobs/uploads/{id}           aborts a session
+func (b *blobHandler) serveUploads(w http.ResponseWriter, r *http.Request) {
+	uploader, ok := b.driver.(storage.MultipartUploader)
+	if !ok {
+		b.handleError(w, errors.New("storage driver does not support upload sessions"), http.StatusNotImplemented)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2/blobs/uploads"), "/"), "/")
+	switch {
+	case len(segments) == 1 && segments[0] == "":
+		if r.Method != http.MethodPost {
+			b.handleError(w, nil, http.StatusMethodNotAllowed)
+			return
+		}
+		b.startUpload(w, r, uploader)
+	case len(segments) == 1:
+		switch r.Method {
+		case http.MethodPut:
+			b.uploadPart(w, r, uploader, segments[0])
+		case http.MethodDelete:
+			b.abortUpload(w, r, uploader, segments[0])
+		default:
+			b.handleError(w, nil, http.StatusMethodNotAllowed)
+		}
+	case len(segments) == 2 && segments[1] == "complete":
+		if r.Method != http.MethodPost {
+			b.handleError(w, nil, http.StatusMethodNotAllowed)
+			return
+		}
+		b.completeUpload(w, r, uploader, segments[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// startUpload starts an upload session for a blob identified by the same parameters as for
+// /v2/blobs/put, its size being declared with the X-Payload-Expected-Content-Length header.
+func (b *blobHandler) startUpload(w http.ResponseWriter, r *http.Request, uploader storage.MultipartUploader) {
+	expectedLengthHeader := r.Header.Get("X-Payload-Expected-Content-Length")
+	if expectedLengthHeader == "" {
+		b.handleError(w, fmt.Errorf("expected content length header is required"), http.StatusBadRequest)
+		return
+	}
+	expectedLength, err := strconv.ParseUint(expectedLengthHeader, 10, 64)
+	if err != nil {
+		b.handleError(w, fmt.Errorf("expected content length header %s is invalid: %w", expectedLengthHeader, err), http.StatusBadRequest)
+		return
+	}
+	if expectedLength > b.uploads.maxBytes {
+		b.handleError(w, fmt.Errorf("payload of %d bytes exceeds the max size of %d bytes of upload sessions", expectedLength, b.uploads.maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	namespaceParam, ok := b.namespaceParam(w, r)
+	if !ok {
+		return
+	}
+
+	digestParam := r.URL.Query().Get("digest")
+	if digestParam == "" {
+		b.handleError(w, errors.New("digest query parameter is required"), http.StatusBadRequest)
+		return
+	}
+	digest, hasher, err := b.digestAndHash(digestParam)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	temporalMetadata, err := b.decodeTemporalMetadata(r)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	key, err := b.computeKey(namespaceParam, digestParam, temporalMetadata)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := b.blobExpiry(r, namespaceParam)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !b.authorize(w, r, OperationPut, namespaceParam, key) {
+		return
+	}
+	// the declared size is reserved until the session is aborted or expires
+	if !b.reserveQuota(w, r, namespaceParam, key, expectedLength) {
+		return
+	}
+
+	created, err := uploader.CreateMultipartUpload(r.Context(), &storage.CreateMultipartUploadRequest{
+		Key:         key,
+		ContentType: payloadContentType(r),
+		ExpiresAt:   expiresAt,
+		Metadata:    temporalMetadata,
+	})
+	if err != nil {
+		b.quotas.settle(namespaceParam, key, false)
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	id, err := newUploadSessionID()
+	if err != nil {
+		b.quotas.settle(namespaceParam, key, false)
+		b.handleError(w, withCode(ErrorCodeInternal, err), http.StatusInternalServerError)
+		return
+	}
+
+	b.uploads.mu.Lock()
+	if b.uploads.sessions == nil {
+		b.uploads.sessions = make(map[string]*uploadSession)
+	}
+	b.uploads.sessions[id] = &uploadSession{
+		namespace: namespaceParam,
+		key:       key,
+		algorithm: strings.SplitN(digestParam, ":", 2)[0],
+		digest:    digest,
+		size:      expectedLength,
+		uploadID:  created.UploadID,
+		expiry:    time.AfterFunc(b.uploads.ttl, func() { b.expireUpload(id) }),
+		parts:     make(map[int]uploadedPart),
+		hash:      hasher,
+		hashValid: true,
+	}
+	b.uploads.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(uploadSessionResponse{ID: id}); err != nil {
+		b.requestLogger(w).Error(err.Error())
+	}
+}
+
+// uploadPart uploads a part of an upload session, which is verified with the checksum given
+// by the digest query parameter. Parts are numbered from 1, uploading a part again replaces it.
+func (b *blobHandler) uploadPart(w http.ResponseWriter, r *http.Request, uploader storage.MultipartUploader, id string) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/octet-stream" {
+		b.handleError(w, fmt.Errorf("missing or incorrect Content-Type header"), http.StatusBadRequest)
+		return
+	}
+
+	contentLengthHeader := r.Header.Get("Content-Length")
+	if contentLengthHeader == "" {
+		b.handleError(w, nil, http.StatusLengthRequired)
+		return
+	}
+	contentLength, err := strconv.ParseUint(contentLengthHeader, 10, 64)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	partParam := r.URL.Query().Get("part")
+	part, err := strconv.Atoi(partParam)
+	if err != nil || part < 1 || part > maxUploadParts {
+		b.handleError(w, fmt.Errorf("part query parameter '%s' is not a number between 1 and %d", partParam, maxUploadParts), http.StatusBadRequest)
+		return
+	}
+
+	digestParam := r.URL.Query().Get("digest")
+	if digestParam == "" {
+		b.handleError(w, errors.New("digest query parameter is required"), http.StatusBadRequest)
+		return
+	}
+	digest, hasher, err := b.digestAndHash(digestParam)
+	if err != nil {
+		b.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	session, ok := b.uploadSession(w, r, id)
+	if !ok {
+		return
+	}
+	if contentLength > b.maxBlobBytesFor(session.namespace) {
+		b.handleError(w, b.blobTooLargeError(session.namespace, contentLength), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	b.uploads.mu.Lock()
+	total := contentLength
+	for n, p := range session.parts {
+		if n != part {
+			total += p.size
+		}
+	}
+	if total > session.size {
+		b.uploads.mu.Unlock()
+		b.handleError(w, fmt.Errorf("parts of %d bytes exceed the declared size of %d bytes", total, session.size), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// only the next part in order is fed into the checksum of the blob
+	feed := session.hashValid && !session.hashing && part == session.hashedParts+1
+	if !feed && (part > session.hashedParts || session.parts[part].digest != digestParam) {
+		session.hashValid = false
+	}
+	session.hashing = session.hashing || feed
+	session.uploading++
+	session.expiry.Reset(b.uploads.ttl)
+	b.uploads.mu.Unlock()
+
+	body := &limit.Reader{R: r.Body, Remaining: contentLength, Err: errBlobTooLarge}
+	var data io.Reader = io.TeeReader(body, hasher)
+	if feed {
+		data = io.TeeReader(body, io.MultiWriter(hasher, session.hash))
+	}
+	uploaded, err := uploader.UploadPart(r.Context(), &storage.UploadPartRequest{
+		Key:           session.key,
+		UploadID:      session.uploadID,
+		PartNumber:    part,
+		Data:          data,
+		ContentLength: contentLength,
+	})
+	checkSum := hex.EncodeToString(hasher.Sum(nil))
+
+	failed := body.Exceeded || err != nil || checkSum != digest
+	b.uploads.mu.Lock()
+	session.uploading--
+	session.hashing = session.hashing && !feed
+	if failed {
+		// the part may have been replaced with other data
+		session.hashValid = false
+		delete(session.parts, part)
+	} else {
+		if feed {
+			session.hashedParts++
+		}
+		session.parts[part] = uploadedPart{size: contentLength, digest: digestParam, etag: uploaded.ETag}
+	}
+	b.uploads.mu.Unlock()
+
+	switch {
+	case body.Exceeded:
+		b.handleError(w, fmt.Errorf("request body exceeds the declared Content-Length of %d bytes", contentLength), http.StatusRequestEntityTooLarge)
+	case err != nil:
+		b.handleError(w, err, http.StatusInternalServerError)
+	case checkSum != digest:
+		b.handleError(w, errChecksumMismatch, http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// completeUpload assembles the blob of an upload session from its parts and returns its key.
+// The parts must be numbered from 1 without gaps, and add up to the declared size.
+func (b *blobHandler) completeUpload(w http.ResponseWriter, r *http.Request, uploader storage.MultipartUploader, id string) {
+	session, ok := b.uploadSession(w, r, id)
+	if !ok {
+		return
+	}
+
+	b.uploads.mu.Lock()
+	if b.uploads.sessions[id] != session {
+		// the session was completed or aborted concurrently
+		b.uploads.mu.Unlock()
+		b.handleError(w, withCode(ErrorCodeUploadSessionNotFound, fmt.Errorf("upload session %s does not exist", id)), http.StatusNotFound)
+		return
+	}
+	if session.uploading > 0 {
+		b.uploads.mu.Unlock()
+		b.handleError(w, errors.New("parts are still being uploaded"), http.StatusConflict)
+		return
+	}
+	parts := make([]storage.CompletedPart, 0, len(session.parts))
+	var size uint64
+	for n := 1; n <= len(session.parts); n++ {
+		p, ok := session.parts[n]
+		if !ok {
+			b.uploads.mu.Unlock()
+			b.handleError(w, fmt.Errorf("part %d was not uploaded", n), http.StatusBadRequest)
+			return
+		}
+		parts = append(parts, storage.CompletedPart{PartNumber: n, ETag: p.etag})
+		size += p.size
+	}
+	if len(parts) == 0 {
+		b.uploads.mu.Unlock()
+		b.handleError(w, errors.New("no parts were uploaded"), http.StatusBadRequest)
+		return
+	}
+	if size != session.size {
+		b.uploads.mu.Unlock()
+		b.handleError(w, fmt.Errorf("parts have %d bytes, but %d bytes were declared", size, session.size), http.StatusBadRequest)
+		return
+	}
+	// the session ends here, so that no parts are uploaded while completing it
+	b.removeUpload(id)
+	var checkSum string
+	if session.hashValid && session.hashedParts == len(parts) {
+		checkSum = hex.EncodeToString(session.hash.Sum(nil))
+	}
+	b.uploads.mu.Unlock()
+
+	if checkSum != "" && checkSum != session.digest {
+		b.abortMultipartUpload(r.Context(), uploader, session)
+		b.handleError(w, errChecksumMismatch, http.StatusBadRequest)
+		return
+	}
+
+	result, err := uploader.CompleteMultipartUpload(r.Context(), &storage.CompleteMultipartUploadRequest{
+		Key:      session.key,
+		UploadID: session.uploadID,
+		Parts:    parts,
+	})
+	if err != nil {
+		b.abortMultipartUpload(r.Context(), uploader, session)
+		b.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if checkSum == "" {
+		// parts were uploaded out of order, so the blob is read back for verifying it
+		h, _ := newHash(session.algorithm)
+		if _, err := b.driver.GetPayload(r.Context(), &storage.GetRequest{Key: session.key, Writer: h}); err != nil {
+			b.quotas.settle(session.namespace, session.key, true)
+			b.handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if hex.EncodeToString(h.Sum(nil)) != session.digest {
+			b.deletePartialBlob(r, session.key)
+			b.quotas.settle(session.namespace, session.key, false)
+			b.handleError(w, errChecksumMismatch, http.StatusBadRequest)
+			return
+		}
+	}
+	b.quotas.settle(session.namespace, session.key, true)
+	b.events.send(r.Context(), Event{Operation: OperationPut, Namespace: session.namespace, Key: session.key, Size: session.size, Digest: session.algorithm + ":" + session.digest})
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		b.requestLogger(w).Error(err.Error())
+	}
+}
+
+// abortUpload aborts an upload session, discarding the parts uploaded so far.
+func (b *blobHandler) abortUpload(w http.ResponseWriter, r *http.Request, uploader storage.MultipartUploader, id string) {
+	session, ok := b.uploadSession(w, r, id)
+	if !ok {
+		return
+	}
+
+	b.uploads.mu.Lock()
+	removed := b.removeUpload(id)
+	b.uploads.mu.Unlock()
+	if removed {
+		b.abortMultipartUpload(r.Context(), uploader, session)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadSession returns the upload session with the given ID if the request is authorized to
+// access it, and sends an error response otherwise.
+func (b *blobHandler) uploadSession(w http.ResponseWriter, r *http.Request, id string) (*uploadSession, bool) {
+	b.uploads.mu.Lock()
+	session, ok := b.uploads.sessions[id]
+	b.uploads.mu.Unlock()
+	if !ok {
+		b.handleError(w, withCode(ErrorCodeUploadSessionNotFound, fmt.Errorf("upload session %s does not exist", id)), http.StatusNotFound)
+		return nil, false
+	}
+	if !b.authorize(w, r, OperationPut, session.namespace, session.key) {
+		return nil, false
+	}
+	return session, true
+}
+
+// removeUpload ends the upload session with the given ID, returning whether it was in
+// progress. It must be called with the lock of the sessions held.
+func (b *blobHandler) removeUpload(id string) bool {
+	session, ok := b.uploads.sessions[id]
+	if !ok {
+		return false
+	}
+	session.expiry.Stop()
+	delete(b.uploads.sessions, id)
+	return true
+}
+
+// expireUpload aborts the upload session with the given ID after a period of inactivity, so
+// that the parts of abandoned sessions do not remain in storage.
+func (b *blobHandler) expireUpload(id string) {
+	b.uploads.mu.Lock()
+	session, ok := b.uploads.sessions[id]
+	if ok && session.uploading > 0 {
+		// slow uploads of parts keep their session alive
+		session.expiry.Reset(b.uploads.ttl)
+		ok = false
+	}
+	if ok {
+		b.removeUpload(id)
+	}
+	b.uploads.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	b.logger.Info("upload session expired", "id", id, "key", session.key)
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	b.abortMultipartUpload(ctx, b.driver.(storage.MultipartUploader), session)
+}
+
+// abortMultipartUpload discards the parts of an upload session which ended, releasing the
+// size reserved for its blob.
+func (b *blobHandler) abortMultipartUpload(ctx context.Context, uploader storage.MultipartUploader, session *uploadSession) {
+	b.quotas.settle(session.namespace, session.key, false)
+	err := uploader.AbortMultipartUpload(ctx, &storage.AbortMultipartUploadRequest{
+		Key:      session.key,
+		UploadID: session.uploadID,
+	})
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("unable to abort multipart upload of blob %s: %v", session.key, err))
+	}
+}
+
+// newUploadSessionID returns a random ID of an upload session, which cannot be guessed.
+func newUploadSessionID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
@@ -0,0 +1,131 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// DefaultReadHeaderTimeout is the time allowed to read the headers of a request unless
+	// configured otherwise with WithReadHeaderTimeout.
+	DefaultReadHeaderTimeout = 10 * time.Second
+	// DefaultIdleTimeout is the time for which idle keep-alive connections are kept open unless
+	// configured otherwise with WithIdleTimeout.
+	DefaultIdleTimeout = 2 * time.Minute
+)
+
+// WithReadHeaderTimeout sets the time allowed to read the headers of a request to the Server
+// created by New, so that slow clients cannot hold connections indefinitely. Defaults to
+// DefaultReadHeaderTimeout, there is no timeout if it is zero.
+func WithReadHeaderTimeout(timeout time.Duration) Option {
+	return applier(func(o *options) {
+		o.readHeaderTimeout = timeout
+	})
+}
+
+// WithReadTimeout sets the time allowed to read a whole request, including its body, by the
+// Server created by New. There is no timeout by default, since uploading large blobs may
+// take long.
+func WithReadTimeout(timeout time.Duration) Option {
+	return applier(func(o *options) {
+		o.readTimeout = timeout
+	})
+}
+
+// WithWriteTimeout sets the time allowed to write a response of the Server created by New,
+// from the end of reading the request headers. There is no timeout by default, since
+// downloading large blobs may take long.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return applier(func(o *options) {
+		o.writeTimeout = timeout
+	})
+}
+
+// WithIdleTimeout sets the time for which the Server created by New keeps idle keep-alive
+// connections open. Defaults to DefaultIdleTimeout.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return applier(func(o *options) {
+		o.idleTimeout = timeout
+	})
+}
+
+// WithH2C makes the Server created by New accept HTTP/2 without TLS (h2c) from clients with
+// prior knowledge, e.g. behind a proxy terminating TLS, so that they can send many requests
+// over a single connection. HTTP/1.1 clients are served as before. Handlers created by
+// NewHttpHandlerWithOptions can be wrapped with h2c.NewHandler instead.
+func WithH2C() Option {
+	return applier(func(o *options) {
+		o.h2c = true
+	})
+}
+
+// Server serves the HTTP API of the Large Payload Service, either on an address with Start or
+// on a listener with Serve, e.g. to embed the service in another process.
+type Server struct {
+	httpServer *http.Server
+	audit      *auditLog
+}
+
+// New creates a Server storing blobs with driver, which serves the handler created by
+// NewHttpHandlerWithOptions with the same options.
+func New(driver storage.Driver, opts ...Option) *Server {
+	o := newOptions(opts)
+	audit := newAuditLog(&o)
+	httpServer := &http.Server{
+		Handler:           newHandler(driver, o, audit),
+		ReadHeaderTimeout: o.readHeaderTimeout,
+		ReadTimeout:       o.readTimeout,
+		WriteTimeout:      o.writeTimeout,
+		IdleTimeout:       o.idleTimeout,
+	}
+	if o.h2c {
+		h2s := &http2.Server{IdleTimeout: o.idleTimeout}
+		// h2c connections are hijacked from httpServer, which only closes them gracefully on
+		// shutdown once configured with h2s. This cannot fail without TLS configuration.
+		_ = http2.ConfigureServer(httpServer, h2s)
+		httpServer.Handler = h2c.NewHandler(httpServer.Handler, h2s)
+	}
+	return &Server{httpServer: httpServer, audit: audit}
+}
+
+// Start listens on the TCP address addr, e.g. ":8577", and serves requests until the server
+// is shut down, in which case it returns nil.
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves requests accepted by listener until the server is shut down, in which case it
+// returns nil. The listener is closed when Serve returns.
+func (s *Server) Serve(listener net.Listener) error {
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting requests and waits until the requests being served complete and
+// their audit entries are logged, or ctx is done, in which case the context error is returned
+// and the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		_ = s.httpServer.Close()
+		return err
+	}
+	return s.audit.flush(ctx)
+}
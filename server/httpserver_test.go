@@ -0,0 +1,135 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+func TestServer(t *testing.T) {
+	s := New(&memory.Driver{}, WithIdleTimeout(time.Minute))
+	assert.Equal(t, DefaultReadHeaderTimeout, s.httpServer.ReadHeaderTimeout)
+	assert.Equal(t, time.Minute, s.httpServer.IdleTimeout)
+	assert.Zero(t, s.httpServer.ReadTimeout)
+	assert.Zero(t, s.httpServer.WriteTimeout)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(listener)
+	}()
+
+	request, err := http.NewRequest(http.MethodHead, "http://"+listener.Addr().String()+"/v2/health/head", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// requests being served complete before the server shuts down
+	driver := &blockingDriver{started: make(chan struct{}, 1), release: make(chan struct{})}
+	s = New(driver)
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		served <- s.Serve(listener)
+	}()
+	request, err = http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/v2/blobs/get?key=/blobs/test/abc", nil)
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	responses := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		responses <- resp
+	}()
+	<-driver.started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	require.NoError(t, <-served)
+	close(driver.release)
+	resp = <-responses
+	require.NotNil(t, resp)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, <-shutdown)
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	driver := &blockingDriver{started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(driver.release)
+	s := New(driver)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = s.Serve(listener)
+	}()
+	request, err := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/v2/blobs/get?key=/blobs/test/abc", nil)
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	failed := make(chan error)
+	go func() {
+		resp, err := http.DefaultClient.Do(request)
+		if err == nil {
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-driver.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	// the remaining connections are closed
+	assert.Error(t, <-failed)
+}
+
+func TestServerH2C(t *testing.T) {
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	serve := func(opts ...Option) string {
+		s := New(&memory.Driver{}, opts...)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go func() {
+			_ = s.Serve(listener)
+		}()
+		t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+		return "http://" + listener.Addr().String() + "/v2/health/ready"
+	}
+
+	url := serve(WithH2C())
+	for client, wantProto := range map[*http.Client]int{h2cClient: 2, http.DefaultClient: 1} {
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, wantProto, resp.ProtoMajor)
+	}
+
+	// h2c is disabled by default
+	_, err := h2cClient.Get(serve())
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package limit provides a reader bounding the size of request bodies, which is shared by the
+// handlers of the server.
+package limit
+
+import (
+	"io"
+)
+
+// Reader reads at most Remaining bytes from R, failing with Err if R has more data. Unlike the
+// Content-Length check, it catches bodies longer than declared, e.g. when the handler is not
+// served by net/http, which would otherwise be stored entirely.
+type Reader struct {
+	R         io.Reader
+	Remaining uint64
+	// Err is returned once R was found to have more than the allowed bytes.
+	Err error
+	// Exceeded is set once R was found to have more than the allowed bytes.
+	Exceeded bool
+}
+
+func (l *Reader) Read(p []byte) (int, error) {
+	if l.Remaining == 0 {
+		// probe for more data, which tells a body of exactly the allowed size apart
+		var probe [1]byte
+		n, err := l.R.Read(probe[:])
+		if n > 0 {
+			l.Exceeded = true
+			return 0, l.Err
+		}
+		return 0, err
+	}
+	if uint64(len(p)) > l.Remaining {
+		p = p[:l.Remaining]
+	}
+	n, err := l.R.Read(p)
+	l.Remaining -= uint64(n)
+	return n, err
+}
@@ -0,0 +1,30 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package limit
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	errTooLarge := errors.New("too large")
+
+	r := &Reader{R: strings.NewReader("hello"), Remaining: 5, Err: errTooLarge}
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.False(t, r.Exceeded)
+
+	r = &Reader{R: strings.NewReader("hello world"), Remaining: 5, Err: errTooLarge}
+	data, err = io.ReadAll(r)
+	require.ErrorIs(t, err, errTooLarge)
+	require.Equal(t, "hello", string(data))
+	require.True(t, r.Exceeded)
+}
@@ -0,0 +1,75 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package response provides a http.ResponseWriter recording the status code and size of
+// responses, which is shared by the handlers and middlewares of the server.
+package response
+
+import (
+	"net/http"
+)
+
+// Writer is a http.ResponseWriter recording the status code and the number of bytes of the
+// body written through it.
+type Writer struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// Wrap returns a Writer writing to w. If w is a Writer already, it is returned as is.
+func Wrap(w http.ResponseWriter) *Writer {
+	if rw, ok := w.(*Writer); ok {
+		return rw
+	}
+	return &Writer{ResponseWriter: w}
+}
+
+// Started returns whether w is a Writer which sent the status code of the response, after
+// which headers and status code cannot be changed anymore.
+func Started(w http.ResponseWriter) bool {
+	rw, ok := w.(*Writer)
+	return ok && rw.status != 0
+}
+
+func (w *Writer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if supported by the underlying writer.
+func (w *Writer) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, e.g. for http.ResponseController.
+func (w *Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status returns the status code of the response, which is zero if nothing was written yet.
+func (w *Writer) Status() int {
+	return w.status
+}
+
+// BytesWritten returns the number of bytes of the body written so far.
+func (w *Writer) BytesWritten() int64 {
+	return w.bytes
+}
@@ -0,0 +1,33 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package response
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	w := Wrap(recorder)
+	require.Same(t, w, Wrap(w))
+	require.False(t, Started(w))
+	require.False(t, Started(recorder))
+
+	w.WriteHeader(http.StatusCreated)
+	require.True(t, Started(w))
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, w.Status())
+	require.Equal(t, int64(5), w.BytesWritten())
+
+	w = Wrap(httptest.NewRecorder())
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, w.Status())
+}
@@ -0,0 +1,44 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+)
+
+// KeyBuilder builds the keys under which blobs are stored, see WithKeyBuilder.
+type KeyBuilder = v2.KeyBuilder
+
+// KeyBuilderFunc is a function implementing KeyBuilder.
+type KeyBuilderFunc = v2.KeyBuilderFunc
+
+// PrefixValidator is implemented by key builders validating the key prefix set in the
+// remote-codec/key-prefix metadata themselves.
+type PrefixValidator = v2.PrefixValidator
+
+// KeyValidator is implemented by key builders validating the keys of requests themselves.
+type KeyValidator = v2.KeyValidator
+
+// WithKeyBuilder sets the builder of the keys under which blobs are stored, e.g. to match the
+// layout of an existing bucket. Defaults to v2.DefaultKeyBuilder, which builds keys with
+// v2.ComputeKey. Unless the builder implements PrefixValidator, the key prefixes it is called
+// with are validated as by v2.ComputeKey, and unless it implements KeyValidator, the keys of
+// requests are validated with v2.ValidateKey. Sweepers deleting the expired blobs of the server
+// must be given the same builder with sweeper.WithKeyBuilder.
+func WithKeyBuilder(builder KeyBuilder) Option {
+	return applier(func(o *options) {
+		o.keyBuilder = builder
+	})
+}
+
+// WithNamespaceScopedKeys requires requests identifying blobs by their key to set the
+// namespace query parameter to the namespace of the key, so that clients of a namespace cannot
+// access blobs of other namespaces by guessing their keys. Requests without it are rejected
+// with the HTTP response status code 400, and requests for keys of other namespaces with 403.
+func WithNamespaceScopedKeys() Option {
+	return applier(func(o *options) {
+		o.namespaceScopedKeys = true
+	})
+}
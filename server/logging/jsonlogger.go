@@ -0,0 +1,82 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONLogger is a logger writing one JSON object per line, with the fields level, msg and ts
+// followed by the key-value pairs. Keys which are not strings are formatted with fmt, and a
+// trailing key without value is logged with a null value. The fields level, msg and ts take
+// precedence over key-value pairs with the same keys.
+type JSONLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLogger creates a new logger writing JSON objects to w.
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+func (l *JSONLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log("debug", msg, keyvals)
+}
+
+func (l *JSONLogger) Info(msg string, keyvals ...interface{}) {
+	l.log("info", msg, keyvals)
+}
+
+func (l *JSONLogger) Error(msg string, keyvals ...interface{}) {
+	l.log("error", msg, keyvals)
+}
+
+func (l *JSONLogger) log(level string, msg string, keyvals []interface{}) {
+	fields := make(map[string]interface{}, len(keyvals)/2+3)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyvals[i])
+		}
+		var value interface{}
+		if i+1 < len(keyvals) {
+			value = jsonValue(keyvals[i+1])
+		}
+		fields[key] = value
+	}
+	fields["level"] = level
+	fields["msg"] = msg
+	fields["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	line, err := json.Marshal(fields)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": "unable to encode log line", "error": err.Error(), "ts": fields["ts"]})
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+// jsonValue returns a value which can be encoded as JSON: errors are logged with their
+// message, and values which json cannot encode, e.g. functions, are formatted with fmt.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, string, bool, int, int64, uint64, float64:
+		return v
+	case error:
+		return v.Error()
+	}
+	if _, err := json.Marshal(value); err != nil {
+		return fmt.Sprintf("%+v", value)
+	}
+	return value
+}
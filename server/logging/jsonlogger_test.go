@@ -0,0 +1,76 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLogger(t *testing.T) {
+	testCases := []struct {
+		name     string
+		log      func(l *JSONLogger)
+		expected map[string]interface{}
+	}{
+		{
+			name:     "string values",
+			log:      func(l *JSONLogger) { l.Info("stored blob", "key", "/blobs/test/abc", "namespace", "test") },
+			expected: map[string]interface{}{"level": "info", "msg": "stored blob", "key": "/blobs/test/abc", "namespace": "test"},
+		},
+		{
+			name:     "odd number of keyvals",
+			log:      func(l *JSONLogger) { l.Error("failed", "status", 500, "dangling") },
+			expected: map[string]interface{}{"level": "error", "msg": "failed", "status": float64(500), "dangling": nil},
+		},
+		{
+			name: "non-string values",
+			log: func(l *JSONLogger) {
+				l.Debug("request", "error", errors.New("boom"), "duration", time.Second, "ok", true, 7, []int{1, 2}, "callback", func() {})
+			},
+			expected: map[string]interface{}{
+				"level":    "debug",
+				"msg":      "request",
+				"error":    "boom",
+				"duration": float64(time.Second),
+				"ok":       true,
+				"7":        []interface{}{float64(1), float64(2)},
+			},
+		},
+		{
+			name:     "reserved keys",
+			log:      func(l *JSONLogger) { l.Info("hello", "msg", "other", "level", "debug") },
+			expected: map[string]interface{}{"level": "info", "msg": "hello"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tc.log(NewJSONLogger(&buf))
+
+			require.True(t, strings.HasSuffix(buf.String(), "\n"))
+			require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+			var line map[string]interface{}
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+
+			ts, err := time.Parse(time.RFC3339Nano, line["ts"].(string))
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now(), ts, time.Minute)
+			delete(line, "ts")
+			if callback, ok := line["callback"]; ok {
+				assert.IsType(t, "", callback)
+				delete(line, "callback")
+			}
+			assert.Equal(t, tc.expected, line)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package logging
+
+// With returns a logger adding keyvals to the key-value pairs of each entry logged with
+// logger, e.g. to log the ID of a request with every entry logged while serving it.
+func With(logger Logger, keyvals ...interface{}) Logger {
+	if len(keyvals) == 0 {
+		return logger
+	}
+	return &withLogger{logger: logger, keyvals: keyvals}
+}
+
+type withLogger struct {
+	logger  Logger
+	keyvals []interface{}
+}
+
+func (l *withLogger) Debug(msg string, keyvals ...interface{}) {
+	l.logger.Debug(msg, l.append(keyvals)...)
+}
+
+func (l *withLogger) Info(msg string, keyvals ...interface{}) {
+	l.logger.Info(msg, l.append(keyvals)...)
+}
+
+func (l *withLogger) Error(msg string, keyvals ...interface{}) {
+	l.logger.Error(msg, l.append(keyvals)...)
+}
+
+// append returns the key-value pairs of l followed by keyvals, which come last so that an odd
+// number of keyvals does not shift the pairs of l.
+func (l *withLogger) append(keyvals []interface{}) []interface{} {
+	all := make([]interface{}, 0, len(l.keyvals)+len(keyvals))
+	all = append(all, l.keyvals...)
+	return append(all, keyvals...)
+}
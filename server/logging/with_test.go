@@ -0,0 +1,39 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	base := NewJSONLogger(&buf)
+	require.Same(t, base, With(base))
+
+	logger := With(base, "requestId", "abc")
+	logger.Debug("debug")
+	logger.Info("info", "key", "value")
+	logger.Error("error", "dangling")
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		delete(entry, "ts")
+		lines = append(lines, entry)
+	}
+	assert.Equal(t, []map[string]interface{}{
+		{"level": "debug", "msg": "debug", "requestId": "abc"},
+		{"level": "info", "msg": "info", "requestId": "abc", "key": "value"},
+		{"level": "error", "msg": "error", "requestId": "abc", "dangling": nil},
+	}, lines)
+}
@@ -0,0 +1,34 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package metadata contains helpers for Temporal payload metadata shared by the server and the codec.
+package metadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Hash returns a canonical digest of metadata in the format sha256:<hex encoded value>.
+// The digest is computed over all keys and values, ordered by key.
+func Hash(metadata map[string][]byte) string {
+	i := 0
+	keys := make([]string, len(metadata))
+	for k := range metadata {
+		keys[i] = k
+		i++
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		v := metadata[k]
+		h.Write([]byte(k))
+		h.Write(v)
+	}
+
+	return fmt.Sprintf("sha256:%s", hex.EncodeToString(h.Sum(nil)))
+}
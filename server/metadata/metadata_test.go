@@ -0,0 +1,28 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string][]byte
+		expected string
+	}{
+		{"empty", nil, "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"single key", map[string][]byte{"foo": []byte("bar")}, "sha256:c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2"},
+		{"sorted keys", map[string][]byte{"foo": []byte("bar"), "a": []byte("b")}, "sha256:d14e3bd925a6da248bc2472a50b0f51d77d8701383247e351c9ca2f6b7892374"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, Hash(tt.metadata))
+		})
+	}
+}
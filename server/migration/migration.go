@@ -0,0 +1,243 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package migration copies the blobs stored by the v1 handler, whose keys have the form
+// blobs/<digest>, to the keys under which the v2 handler stores them, so that the v1 handler
+// can be decommissioned.
+package migration
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// v1Prefix is the prefix of the keys of the blobs stored by the v1 handler.
+	v1Prefix = "blobs/"
+	// pageSize is the number of blobs listed at once.
+	pageSize = 1000
+)
+
+// ErrListingUnsupported is returned by New for storage drivers which cannot list blobs.
+var ErrListingUnsupported = errors.New("storage driver does not support listing blobs")
+
+// Option configures the migrator created by New.
+type Option interface {
+	apply(*Migrator)
+}
+
+type applier func(*Migrator)
+
+func (a applier) apply(m *Migrator) {
+	a(m)
+}
+
+// WithLogger sets the logger, which logs each migrated blob and the progress of the migration.
+// Defaults to a noop logger.
+func WithLogger(logger logging.Logger) Option {
+	return applier(func(m *Migrator) {
+		m.logger = logger
+	})
+}
+
+// WithDeleteV1Blobs deletes the v1 blobs once their copy was verified against their digest.
+// By default, v1 blobs are kept.
+func WithDeleteV1Blobs() Option {
+	return applier(func(m *Migrator) {
+		m.deleteV1Blobs = true
+	})
+}
+
+// Result summarizes a migration.
+type Result struct {
+	// Migrated is the number of v1 blobs copied to their v2 key.
+	Migrated int
+	// Skipped is the number of v1 blobs which had been copied already, e.g. by a previous run.
+	Skipped int
+	// Deleted is the number of v1 blobs deleted, see WithDeleteV1Blobs.
+	Deleted int
+	// Failed is the number of v1 blobs which could not be migrated, the errors being logged.
+	Failed int
+}
+
+// Migrator copies v1 blobs to their v2 key.
+type Migrator struct {
+	lister        storage.Lister
+	driver        storage.Driver
+	namespace     string
+	deleteV1Blobs bool
+	logger        logging.Logger
+}
+
+// New creates a migrator copying the v1 blobs stored with driver, which must implement
+// storage.Lister, to the v2 keys of the given namespace. Since v1 blobs do not record the
+// Temporal metadata of their payload, the v2 keys are computed with empty metadata.
+func New(driver storage.Driver, namespace string, opts ...Option) (*Migrator, error) {
+	lister, ok := driver.(storage.Lister)
+	if !ok {
+		return nil, ErrListingUnsupported
+	}
+	if namespace == "" {
+		return nil, errors.New("namespace is required")
+	}
+	if _, err := v2.ValidateKey(fmt.Sprintf("/blobs/%s/common", namespace)); err != nil || strings.Contains(namespace, "/") {
+		return nil, fmt.Errorf("'%s' is not a valid namespace", namespace)
+	}
+	m := &Migrator{
+		lister:    lister,
+		driver:    driver,
+		namespace: namespace,
+		logger:    logging.NewNoopLogger(),
+	}
+	for _, opt := range opts {
+		opt.apply(m)
+	}
+	return m, nil
+}
+
+// V2Key returns the key under which the v2 handler stores the blob with the given digest in
+// namespace, if it was stored with empty Temporal metadata as v1 blobs are migrated.
+func V2Key(namespace string, digest string) (string, error) {
+	return v2.ComputeKey(namespace, digest, map[string][]byte{})
+}
+
+// Migrate copies all v1 blobs to their v2 key. Blobs whose v2 key exists already are skipped,
+// so that interrupted migrations can be run again. Failures to migrate a blob are logged and
+// counted, while failures to list blobs abort the migration.
+func (m *Migrator) Migrate(ctx context.Context) (Result, error) {
+	var result Result
+	request := &storage.ListRequest{Prefix: v1Prefix, Limit: pageSize}
+	for {
+		listed, err := m.lister.ListPayloads(ctx, request)
+		if err != nil {
+			return result, err
+		}
+		for _, blob := range listed.Blobs {
+			if err := m.migrate(ctx, blob, &result); err != nil {
+				if ctx.Err() != nil {
+					return result, ctx.Err()
+				}
+				result.Failed++
+				m.logger.Error("unable to migrate v1 blob", "key", blob.Key, "error", err)
+			}
+		}
+		m.logger.Info("migrating v1 blobs",
+			"migrated", result.Migrated,
+			"skipped", result.Skipped,
+			"deleted", result.Deleted,
+			"failed", result.Failed,
+		)
+		if listed.NextCursor == "" {
+			return result, nil
+		}
+		request.Cursor = listed.NextCursor
+	}
+}
+
+// migrate copies a v1 blob to its v2 key unless it was copied already, and deletes it if
+// configured to.
+func (m *Migrator) migrate(ctx context.Context, blob storage.BlobInfo, result *Result) error {
+	digest := strings.TrimPrefix(blob.Key, v1Prefix)
+	if strings.Contains(digest, "/") {
+		// not a v1 key, e.g. of a blob stored by a custom key layout
+		return nil
+	}
+	if _, _, err := v2.ParseDigest(digest); err != nil {
+		return err
+	}
+	v2Key, err := V2Key(m.namespace, digest)
+	if err != nil {
+		return err
+	}
+
+	exists, err := m.driver.ExistPayload(ctx, &storage.ExistRequest{Key: v2Key})
+	if err != nil {
+		return err
+	}
+	if exists.Exists && exists.ContentLength == blob.ContentLength {
+		result.Skipped++
+	} else {
+		if err := m.copy(ctx, blob, digest, v2Key); err != nil {
+			return err
+		}
+		result.Migrated++
+		m.logger.Info("migrated v1 blob", "key", blob.Key, "v2Key", v2Key)
+	}
+
+	if !m.deleteV1Blobs {
+		return nil
+	}
+	if err := m.verify(ctx, v2Key, digest); err != nil {
+		return err
+	}
+	if _, err := m.driver.DeletePayload(ctx, &storage.DeleteRequest{Key: blob.Key}); err != nil {
+		return err
+	}
+	result.Deleted++
+	return nil
+}
+
+// copy streams a v1 blob to its v2 key. The copy is deleted if the data of the v1 blob does
+// not match its digest, so that corrupted blobs are not stored under a v2 key.
+func (m *Migrator) copy(ctx context.Context, blob storage.BlobInfo, digest string, v2Key string) error {
+	value, h, err := v2.ParseDigest(digest)
+	if err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := m.driver.GetPayload(ctx, &storage.GetRequest{Key: blob.Key, Writer: writer})
+		_ = writer.CloseWithError(err)
+	}()
+	_, err = m.driver.PutPayload(ctx, &storage.PutRequest{
+		Data:          io.TeeReader(reader, h),
+		Key:           v2Key,
+		Digest:        digest,
+		ContentLength: blob.ContentLength,
+		ContentType:   "application/octet-stream",
+	})
+	// unblocks the download if the upload failed before reading all data
+	_ = reader.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return err
+	}
+
+	if !matches(h, value) {
+		if _, err := m.driver.DeletePayload(ctx, &storage.DeleteRequest{Key: v2Key}); err != nil {
+			m.logger.Error("unable to delete corrupted copy of v1 blob", "key", v2Key, "error", err)
+		}
+		return fmt.Errorf("data of v1 blob '%s' does not match its digest", blob.Key)
+	}
+	return nil
+}
+
+// verify checks that the blob stored under v2Key matches digest.
+func (m *Migrator) verify(ctx context.Context, v2Key string, digest string) error {
+	value, h, err := v2.ParseDigest(digest)
+	if err != nil {
+		return err
+	}
+	if _, err := m.driver.GetPayload(ctx, &storage.GetRequest{Key: v2Key, Writer: h}); err != nil {
+		return err
+	}
+	if !matches(h, value) {
+		return fmt.Errorf("v2 blob '%s' does not match its digest", v2Key)
+	}
+	return nil
+}
+
+// matches tells whether the data written to h matches the hex encoded digest value.
+func matches(h hash.Hash, value string) bool {
+	return hex.EncodeToString(h.Sum(nil)) == value
+}
@@ -0,0 +1,141 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package migration_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/temporal-large-payload-codec/server"
+	v1 "github.com/DataDog/temporal-large-payload-codec/server/handler/v1"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+	"github.com/DataDog/temporal-large-payload-codec/server/migration"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+func digestOf(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// putV1 stores a blob with the v1 handler.
+func putV1(t *testing.T, driver storage.Driver, data string) string {
+	digest := digestOf(data)
+	request := httptest.NewRequest(http.MethodPut, "/v1/blobs/put?digest="+url.QueryEscape(digest), strings.NewReader(data))
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Length", "5")
+	responseRecorder := httptest.NewRecorder()
+	v1.NewHandler(driver, logging.NewNoopLogger()).ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusCreated, responseRecorder.Code)
+	return digest
+}
+
+// getV2 returns the status code and body of a v2 get of the given key.
+func getV2(driver storage.Driver, key string) (int, string) {
+	request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+url.QueryEscape(key), nil)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	responseRecorder := httptest.NewRecorder()
+	server.NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+	return responseRecorder.Code, responseRecorder.Body.String()
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	driver := &memory.Driver{}
+	hello := putV1(t, driver, "hello")
+	world := putV1(t, driver, "world")
+	// blobs which are not v1 blobs are ignored
+	_, err := driver.PutPayload(ctx, &storage.PutRequest{Data: strings.NewReader("other"), Key: "blobs/custom/layout"})
+	require.NoError(t, err)
+
+	m, err := migration.New(driver, "test")
+	require.NoError(t, err)
+	result, err := m.Migrate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, migration.Result{Migrated: 2}, result)
+
+	// old histories are decoded with the v2 handler
+	for digest, data := range map[string]string{hello: "hello", world: "world"} {
+		key, err := migration.V2Key("test", digest)
+		require.NoError(t, err)
+		status, body := getV2(driver, key)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, data, body)
+
+		exists, err := driver.ExistPayload(ctx, &storage.ExistRequest{Key: "blobs/" + digest})
+		require.NoError(t, err)
+		assert.True(t, exists.Exists)
+	}
+
+	// migrations are resumable, and delete the v1 blobs if configured to
+	m, err = migration.New(driver, "test", migration.WithDeleteV1Blobs())
+	require.NoError(t, err)
+	result, err = m.Migrate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, migration.Result{Skipped: 2, Deleted: 2}, result)
+	for _, digest := range []string{hello, world} {
+		exists, err := driver.ExistPayload(ctx, &storage.ExistRequest{Key: "blobs/" + digest})
+		require.NoError(t, err)
+		assert.False(t, exists.Exists)
+	}
+
+	result, err = m.Migrate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, migration.Result{}, result)
+}
+
+func TestMigrateCorruptedBlob(t *testing.T) {
+	ctx := context.Background()
+	driver := &memory.Driver{}
+	digest := digestOf("hello")
+	_, err := driver.PutPayload(ctx, &storage.PutRequest{Data: strings.NewReader("corrupted"), Key: "blobs/" + digest})
+	require.NoError(t, err)
+	_, err = driver.PutPayload(ctx, &storage.PutRequest{Data: strings.NewReader("invalid"), Key: "blobs/md5:1234"})
+	require.NoError(t, err)
+
+	m, err := migration.New(driver, "test", migration.WithDeleteV1Blobs())
+	require.NoError(t, err)
+	result, err := m.Migrate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, migration.Result{Failed: 2}, result)
+
+	// the corrupted copy is deleted, while the v1 blobs are kept
+	key, err := migration.V2Key("test", digest)
+	require.NoError(t, err)
+	exists, err := driver.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+	require.NoError(t, err)
+	assert.False(t, exists.Exists)
+	for _, key := range []string{"blobs/" + digest, "blobs/md5:1234"} {
+		exists, err := driver.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+		require.NoError(t, err)
+		assert.True(t, exists.Exists, key)
+	}
+}
+
+// unlistableDriver is a driver which cannot list blobs.
+type unlistableDriver struct {
+	storage.Driver
+}
+
+func TestNew(t *testing.T) {
+	_, err := migration.New(unlistableDriver{}, "test")
+	require.ErrorIs(t, err, migration.ErrListingUnsupported)
+
+	_, err = migration.New(&memory.Driver{}, "")
+	require.EqualError(t, err, "namespace is required")
+
+	_, err = migration.New(&memory.Driver{}, "team/a")
+	require.EqualError(t, err, "'team/a' is not a valid namespace")
+}
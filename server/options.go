@@ -0,0 +1,295 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"go.temporal.io/sdk/client"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+)
+
+// Option configures the HTTP handler created by NewHttpHandlerWithOptions.
+type Option interface {
+	apply(*options)
+}
+
+type applier func(*options)
+
+func (a applier) apply(o *options) {
+	a(o)
+}
+
+// options is the configuration of the HTTP handler.
+type options struct {
+	logger                    logging.Logger
+	basePath                  string
+	maxBlobBytes              uint64
+	namespaceMaxBlobBytes     map[string]uint64
+	namespaceQuotas           map[string]uint64
+	middlewares               []func(http.Handler) http.Handler
+	codecServer               http.Handler
+	authorizer                Authorizer
+	requestLogging            bool
+	requestIDs                bool
+	disablePanicRecovery      bool
+	readinessCacheTTL         time.Duration
+	readinessObserver         func(err error)
+	uploadSessionTTL          time.Duration
+	idempotencyTTL            time.Duration
+	maxUploadBytes            uint64
+	presignExpiry             time.Duration
+	listing                   bool
+	namespaceBlobTTL          map[string]time.Duration
+	disableDigestVerification bool
+	verifyExisting            bool
+	skipExistCheck            bool
+	disableCompression        bool
+	compressibleEncodings     []string
+	keyBuilder                KeyBuilder
+	namespaceScopedKeys       bool
+	corsOrigins               []string
+	corsHeaders               []string
+	plainTextErrors           bool
+	maxConcurrentRequests     int
+	maxConcurrentGets         int
+	maxConcurrentPuts         int
+	concurrencyWait           time.Duration
+	metricsHandler            client.MetricsHandler
+	eventSink                 EventSink
+	deletions                 *Deletions
+	auditLogger               logging.Logger
+	auditFieldFilter          AuditFieldFilter
+	readHeaderTimeout         time.Duration
+	readTimeout               time.Duration
+	writeTimeout              time.Duration
+	idleTimeout               time.Duration
+	h2c                       bool
+}
+
+// WithLogger sets the logger of the handler. Defaults to a noop logger.
+func WithLogger(logger logging.Logger) Option {
+	return applier(func(o *options) {
+		o.logger = logger
+	})
+}
+
+// WithMaxBlobBytes sets the maximum size of a blob accepted by the handler, larger blobs are
+// rejected with the HTTP response status code 413. Defaults to v2.DefaultMaxBlobBytes.
+func WithMaxBlobBytes(maxBlobBytes uint64) Option {
+	return applier(func(o *options) {
+		o.maxBlobBytes = maxBlobBytes
+	})
+}
+
+// WithNamespaceMaxBlobBytes overrides the maximum blob size set by WithMaxBlobBytes for the
+// blobs of the given namespaces, e.g. to allow larger blobs for some teams sharing a server.
+func WithNamespaceMaxBlobBytes(limits map[string]uint64) Option {
+	return applier(func(o *options) {
+		o.namespaceMaxBlobBytes = make(map[string]uint64, len(limits))
+		for namespace, limit := range limits {
+			o.namespaceMaxBlobBytes[namespace] = limit
+		}
+	})
+}
+
+// WithNamespaceQuota limits the number of bytes stored by the blobs of the given namespaces,
+// e.g. to protect the storage budget from a single team. Puts exceeding the quota of their
+// namespace are rejected with 507 Insufficient Storage and the current usage, while deletes
+// credit the quota back. The usage of a namespace is computed by listing its blobs when it is
+// first needed, if the storage driver implements storage.Lister, and then tracked in memory,
+// so blobs stored or deleted by other servers count from the next restart. Expired blobs
+// deleted by the sweeper are credited back if it reports them to WithDeletions.
+// Blobs uploaded with presigned URLs count once the URL is issued, and are released when it
+// expires unless the blob was uploaded. The usage is recorded by the handler set with
+// WithMetricsHandler, and returned by /v2/limits for the namespace.
+// Blobs stored through the gRPC API of the server/grpc package are not counted.
+func WithNamespaceQuota(quotas map[string]uint64) Option {
+	return applier(func(o *options) {
+		o.namespaceQuotas = make(map[string]uint64, len(quotas))
+		for namespace, quota := range quotas {
+			o.namespaceQuotas[namespace] = quota
+		}
+	})
+}
+
+// WithBasePath mounts the handler under basePath, e.g. "/lps", so that its endpoints are served
+// at /lps/v2/blobs/put and so on instead of /v2/blobs/put, for ingresses routing the service
+// under a prefix without rewriting paths. Leading and trailing slashes are optional.
+func WithBasePath(basePath string) Option {
+	return applier(func(o *options) {
+		o.basePath = normalizeBasePath(basePath)
+	})
+}
+
+// normalizeBasePath returns basePath with a leading and without a trailing slash, or the empty
+// string for the root path.
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// WithReadinessCacheTTL sets the period for which the result of validating the storage driver
+// is reused by the readiness endpoint /v2/health/ready, so that frequent probes do not put
+// load on the storage. Defaults to v2.DefaultReadinessCacheTTL.
+func WithReadinessCacheTTL(ttl time.Duration) Option {
+	return applier(func(o *options) {
+		o.readinessCacheTTL = ttl
+	})
+}
+
+// WithReadinessObserver sets a function which is called when the readiness of the storage
+// driver changes, with the validation error or nil if the driver became ready, e.g. to log
+// readiness transitions. It is also called with the result of the first readiness check.
+func WithReadinessObserver(observer func(err error)) Option {
+	return applier(func(o *options) {
+		o.readinessObserver = observer
+	})
+}
+
+// WithUploadSessionTTL sets the period of inactivity after which upload sessions expire, so
+// that the parts of abandoned uploads are discarded. Defaults to v2.DefaultUploadSessionTTL.
+func WithUploadSessionTTL(ttl time.Duration) Option {
+	return applier(func(o *options) {
+		o.uploadSessionTTL = ttl
+	})
+}
+
+// WithIdempotencyTTL sets the period for which the responses of put requests with an
+// Idempotency-Key header are recorded, so that retried uploads are answered with the response
+// of the first one instead of storing the blob again. Defaults to v2.DefaultIdempotencyTTL.
+func WithIdempotencyTTL(ttl time.Duration) Option {
+	return applier(func(o *options) {
+		o.idempotencyTTL = ttl
+	})
+}
+
+// WithPresignExpiry sets the period for which the URLs returned by the presign endpoints are
+// valid. Defaults to v2.DefaultPresignExpiry, longer periods than v2.MaxPresignExpiry are capped.
+func WithPresignExpiry(expiry time.Duration) Option {
+	return applier(func(o *options) {
+		o.presignExpiry = expiry
+	})
+}
+
+// WithBlobListing enables the endpoint /v2/blobs/list, which lists the blobs of a namespace
+// with their sizes and modification times if the storage driver implements storage.Lister.
+// It is disabled by default since listing large buckets is expensive.
+func WithBlobListing() Option {
+	return applier(func(o *options) {
+		o.listing = true
+	})
+}
+
+// WithNamespaceBlobTTL sets the period after which the blobs stored in the given namespaces
+// may be deleted, e.g. the retention period of the namespace. Put requests may set another
+// period in seconds with the X-Payload-TTL header. Expired blobs are deleted by the sweeper
+// package. By default, blobs never expire, as do the blobs stored through the gRPC API of the
+// server/grpc package.
+func WithNamespaceBlobTTL(ttls map[string]time.Duration) Option {
+	return applier(func(o *options) {
+		o.namespaceBlobTTL = make(map[string]time.Duration, len(ttls))
+		for namespace, ttl := range ttls {
+			o.namespaceBlobTTL[namespace] = ttl
+		}
+	})
+}
+
+// WithoutDigestVerification disables the verification of the digest of the blobs sent by
+// /v2/blobs/get, which hashes their whole data, e.g. for performance-sensitive deployments.
+func WithoutDigestVerification() Option {
+	return applier(func(o *options) {
+		o.disableDigestVerification = true
+	})
+}
+
+// WithVerifyExisting compares the blobs already stored under the key of uploads to the uploaded
+// ones, and rejects uploads which do not match with 409 Conflict instead of returning the key of
+// the stored blob, e.g. for object stores which may be modified outside of the server. It
+// costs an additional request to the object store for uploads of existing blobs.
+func WithVerifyExisting() Option {
+	return applier(func(o *options) {
+		o.verifyExisting = true
+	})
+}
+
+// WithSkipExistCheck stores uploaded blobs without first checking whether they exist, which
+// saves a request to the object store per upload, e.g. a HeadObject request with S3, for
+// workloads whose payloads are rarely duplicated. Keys are derived from the content of blobs,
+// so overwriting an existing blob is harmless. Uploads with an expiry, to namespaces with a
+// quota, or to a server started with WithVerifyExisting are still checked.
+//
+// Uploads failing because of their body, e.g. a checksum mismatch, are then not deleted in
+// case the blob existed before, so drivers which do not store blobs atomically may keep the
+// partial data.
+//
+// The lps_put_exist_checks_total metric counts the checks which saved an upload with the
+// result hit, which tells whether skipping them is worth it.
+func WithSkipExistCheck() Option {
+	return applier(func(o *options) {
+		o.skipExistCheck = true
+	})
+}
+
+// WithoutCompression disables the gzip compression of the blobs sent by /v2/blobs/get, which
+// are otherwise compressed for clients accepting gzip if their payload encoding is compressible.
+func WithoutCompression() Option {
+	return applier(func(o *options) {
+		o.disableCompression = true
+	})
+}
+
+// WithCompressibleEncodings sets payload encodings whose blobs are compressed in addition to
+// json/plain and json/protobuf, e.g. the encodings of custom JSON payload converters.
+func WithCompressibleEncodings(encodings ...string) Option {
+	return applier(func(o *options) {
+		o.compressibleEncodings = append(o.compressibleEncodings, encodings...)
+	})
+}
+
+// WithMaxUploadBytes sets the maximum size of a blob uploaded in parts with an upload session,
+// each part being limited by WithMaxBlobBytes. Defaults to v2.DefaultMaxUploadBytes.
+func WithMaxUploadBytes(maxUploadBytes uint64) Option {
+	return applier(func(o *options) {
+		o.maxUploadBytes = maxUploadBytes
+	})
+}
+
+// WithPlainTextErrors sends the message of errors as the plain text body of error responses,
+// as in previous releases, instead of a JSON document with a machine-readable code.
+//
+// Deprecated: plain text error responses will be removed in the next release.
+func WithPlainTextErrors() Option {
+	return applier(func(o *options) {
+		o.plainTextErrors = true
+	})
+}
+
+// WithCodecServer serves handler under /codec/, e.g. the handler of package codecserver
+// implementing the remote codec server protocol of Temporal, so that the Temporal Web UI can
+// decode payloads with the endpoint /codec. Requests to the handler go through the same
+// middlewares as the API, including CORS, and their paths are relative to /codec. Its codec
+// should send requests with CodecServerTransport, so that the authorizer, the audit log, the
+// quotas, the blob TTLs and the events of the server apply to the blobs it reads and stores.
+func WithCodecServer(handler http.Handler) Option {
+	return applier(func(o *options) {
+		o.codecServer = handler
+	})
+}
+
+// WithMiddleware wraps the handler with middleware, e.g. for authentication or
+// instrumentation. Middlewares are applied in the order they are passed, the first being
+// the outermost one which sees each request first.
+func WithMiddleware(middleware func(http.Handler) http.Handler) Option {
+	return applier(func(o *options) {
+		o.middlewares = append(o.middlewares, middleware)
+	})
+}
@@ -0,0 +1,22 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+)
+
+// Deletions relays the blobs deleted without going through the server to its namespace
+// quotas, see WithDeletions. The zero value is ready to use.
+type Deletions = v2.Deletions
+
+// WithDeletions credits the blobs reported to deletions back to the quota of their namespace,
+// see WithNamespaceQuota. The sweeper reports the expired blobs it deletes when created with
+// sweeper.WithDeletionObserver(deletions.Deleted).
+func WithDeletions(deletions *Deletions) Option {
+	return applier(func(o *options) {
+		o.deletions = deletions
+	})
+}
@@ -0,0 +1,210 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/client"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/DataDog/temporal-large-payload-codec/server/sweeper"
+)
+
+func TestWithNamespaceQuota(t *testing.T) {
+	driver := &memory.Driver{}
+	// blobs stored before the server started count towards the quota
+	_, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+		Data:          bytes.NewReader([]byte("stored earlier")),
+		Key:           "/blobs/test/common/sha256:1234/sha256:abcd",
+		ContentLength: 14,
+	})
+	require.NoError(t, err)
+	metrics := &gaugeMetricsHandler{MetricsHandler: client.MetricsNopHandler, mu: &sync.Mutex{}, gauges: map[string]float64{}}
+	handler := NewHttpHandlerWithOptions(driver,
+		WithNamespaceQuota(map[string]uint64{"test": 40}),
+		WithMetricsHandler(metrics),
+	)
+
+	put := func(data string) *httptest.ResponseRecorder {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, newPutRequestV2([]byte(data), len(data)))
+		return responseRecorder
+	}
+	limits := func(namespace string) map[string]interface{} {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/limits?namespace="+namespace, nil))
+		require.Equal(t, http.StatusOK, responseRecorder.Code)
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+		return body
+	}
+
+	assert.Equal(t, float64(14), limits("test")["usedBytes"])
+	assert.Equal(t, float64(40), limits("test")["quotaBytes"])
+	assert.NotContains(t, limits("other"), "usedBytes")
+
+	response := put("hello world")
+	require.Equal(t, http.StatusCreated, response.Code)
+	var stored storage.PutResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &stored))
+	assert.Equal(t, float64(25), limits("test")["usedBytes"])
+	assert.Equal(t, float64(25), metrics.gauge("lps_namespace_usage_bytes{namespace=test}"))
+
+	// blobs stored already do not count again
+	require.Equal(t, http.StatusOK, put("hello world").Code)
+	assert.Equal(t, float64(25), limits("test")["usedBytes"])
+
+	response = put("goodbye, world!!")
+	require.Equal(t, http.StatusInsufficientStorage, response.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeQuotaExceeded, "storing 16 bytes exceeds the quota of namespace 'test', which uses 25 of its 40 bytes"), response.Body.String())
+
+	// deletes credit the quota back
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodDelete, "/v2/blobs/delete?key="+url.QueryEscape(stored.Key), nil))
+	require.Equal(t, http.StatusNoContent, responseRecorder.Code)
+	assert.Equal(t, float64(14), limits("test")["usedBytes"])
+	assert.Equal(t, float64(14), metrics.gauge("lps_namespace_usage_bytes{namespace=test}"))
+	require.Equal(t, http.StatusCreated, put("goodbye, world!!").Code)
+	assert.Equal(t, float64(30), limits("test")["usedBytes"])
+
+	// bodies exceeding their declared length are not stored
+	responseRecorder = httptest.NewRecorder()
+	request := newPutRequestV2([]byte("0123456789"), 5)
+	request.ContentLength = 5
+	handler.ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Equal(t, float64(30), limits("test")["usedBytes"])
+}
+
+func TestWithNamespaceQuotaUploadSessions(t *testing.T) {
+	handler := NewHttpHandlerWithOptions(&memory.Driver{}, WithNamespaceQuota(map[string]uint64{"test": 10}))
+	client := &uploadClient{t: t, handler: handler}
+	data := []byte("01234567")
+	usedBytes := func() float64 {
+		responseRecorder := client.do(httptest.NewRequest(http.MethodGet, "/v2/limits?namespace=test", nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+		return body["usedBytes"].(float64)
+	}
+
+	// the declared size is reserved while the session is in progress
+	id := client.start(sha256Digest(data), len(data))
+	assert.Equal(t, float64(8), usedBytes())
+	request := httptest.NewRequest(http.MethodPost, "/v2/blobs/uploads?namespace=test&digest="+sha256Digest([]byte("other")), nil)
+	request.Header.Set("X-Payload-Expected-Content-Length", "8")
+	request.Header.Set("X-Temporal-Metadata", "e30=")
+	require.Equal(t, http.StatusInsufficientStorage, client.do(request).Code)
+
+	// and released when it is aborted
+	require.Equal(t, http.StatusNoContent, client.do(httptest.NewRequest(http.MethodDelete, "/v2/blobs/uploads/"+id, nil)).Code)
+	assert.Equal(t, float64(0), usedBytes())
+
+	id = client.start(sha256Digest(data), len(data))
+	require.Equal(t, http.StatusNoContent, client.put(id, 1, data).Code)
+	require.Equal(t, http.StatusCreated, client.complete(id).Code)
+	assert.Equal(t, float64(8), usedBytes())
+}
+
+func TestWithDeletions(t *testing.T) {
+	driver := &memory.Driver{}
+	_, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+		Data:          bytes.NewReader([]byte("expired")),
+		Key:           "/blobs/test/common/sha256:1234/sha256:abcd",
+		ContentLength: 7,
+		ExpiresAt:     time.Now().Add(-time.Minute),
+	})
+	require.NoError(t, err)
+	deletions := &Deletions{}
+	handler := NewHttpHandlerWithOptions(driver,
+		WithNamespaceQuota(map[string]uint64{"test": 40}),
+		WithDeletions(deletions),
+	)
+	usedBytes := func() float64 {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/limits?namespace=test", nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+		return body["usedBytes"].(float64)
+	}
+	require.Equal(t, float64(7), usedBytes())
+
+	// expired blobs deleted by the sweeper are credited back
+	s, err := sweeper.New(driver, sweeper.WithDeletionObserver(deletions.Deleted))
+	require.NoError(t, err)
+	deleted, err := s.Sweep(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	assert.Equal(t, float64(0), usedBytes())
+}
+
+func TestWithNamespaceQuotaKeyBuilder(t *testing.T) {
+	driver := &memory.Driver{}
+	putBlob(t, driver, "/payloads/test/sha256:1234", []byte("stored earlier"), "sha256:1234", nil)
+	putBlob(t, driver, "/payloads/other/sha256:1234", []byte("stored in another namespace"), "sha256:1234", nil)
+	handler := NewHttpHandlerWithOptions(driver,
+		WithNamespaceQuota(map[string]uint64{"test": 40}),
+		WithKeyBuilder(payloadKeyBuilder{}),
+	)
+
+	// the blobs of the namespace are found under the keys built by the key builder
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/limits?namespace=test", nil))
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+	assert.Equal(t, float64(14), body["usedBytes"])
+}
+
+// barrierDriver blocks puts until the given number of them are in progress.
+type barrierDriver struct {
+	*memory.Driver
+	barrier *sync.WaitGroup
+}
+
+func (d *barrierDriver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
+	d.barrier.Done()
+	d.barrier.Wait()
+	return d.Driver.PutPayload(ctx, r)
+}
+
+func TestWithNamespaceQuotaConcurrentUploads(t *testing.T) {
+	barrier := &sync.WaitGroup{}
+	barrier.Add(2)
+	handler := NewHttpHandlerWithOptions(&barrierDriver{Driver: &memory.Driver{}, barrier: barrier},
+		WithNamespaceQuota(map[string]uint64{"test": 16}),
+	)
+	data := []byte("hello world")
+
+	// concurrent uploads of the same new blob reserve its size once
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, newPutRequestV2(data, len(data)))
+			codes <- responseRecorder.Code
+		}()
+	}
+	assert.Equal(t, http.StatusCreated, <-codes)
+	assert.Equal(t, http.StatusCreated, <-codes)
+
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/limits?namespace=test", nil))
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+	assert.Equal(t, float64(11), body["usedBytes"])
+}
@@ -0,0 +1,60 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/internal/response"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+)
+
+// WithoutPanicRecovery disables the recovery from panics of the handler, e.g. in storage
+// drivers, which are otherwise logged and answered with the HTTP response status code 500.
+func WithoutPanicRecovery() Option {
+	return applier(func(o *options) {
+		o.disablePanicRecovery = true
+	})
+}
+
+// recoverPanics returns a middleware recovering from panics of next, which are logged with
+// their stack trace. If the response was not started yet, a generic JSON error is sent.
+// Otherwise, e.g. when part of a blob was sent, the connection is aborted so that the client
+// does not mistake the truncated response for a complete one.
+func recoverPanics(logger logging.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := response.Wrap(w)
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+
+				keyvals := []interface{}{
+					"method", r.Method,
+					"path", r.URL.Path,
+					"panic", fmt.Sprint(v),
+					"stack", string(debug.Stack()),
+				}
+				if id := v2.RequestIDFromContext(r.Context()); id != "" {
+					keyvals = append(keyvals, "requestId", id)
+				}
+				logger.Error("panic serving request", keyvals...)
+				if rw.Status() != 0 {
+					panic(http.ErrAbortHandler)
+				}
+				writeError(rw, r, http.StatusInternalServerError, v2.ErrorCodeInternal, "internal server error")
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+)
+
+// maxRequestIDLength is the maximum length of the request IDs accepted from clients, longer
+// ones are replaced.
+const maxRequestIDLength = 128
+
+// WithRequestIDs assigns an ID to each request, which correlates the errors of clients with
+// the log entries of the server. The ID is taken from the X-Request-ID header of the request,
+// which the codec sets, or generated if it is missing or invalid. It is echoed in the
+// X-Request-ID header of the response and in JSON error responses, and logged with the
+// request and all errors which occur while serving it, including those of the storage driver.
+// The ID is available to middlewares with v2.RequestIDFromContext.
+func WithRequestIDs() Option {
+	return applier(func(o *options) {
+		o.requestIDs = true
+	})
+}
+
+// assignRequestIDs returns a middleware setting the ID of each request passed to next.
+func assignRequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(v2.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(v2.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(v2.ContextWithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID returns whether id is a non-empty request ID of printable ASCII characters
+// without spaces, which can be logged and echoed safely.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("unable to generate request ID: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// writeError sends a JSON error response of a middleware, including the ID of the request if
+// it has one.
+func writeError(w http.ResponseWriter, r *http.Request, statusCode int, code v2.ErrorCode, message string) {
+	body, _ := json.Marshal(v2.ErrorResponse{Code: code, Message: message, RequestID: v2.RequestIDFromContext(r.Context())})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,107 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+// fullRecordingLogger records the messages and key-value pairs logged at info and error level.
+type fullRecordingLogger struct {
+	recordingLogger
+}
+
+func (l *fullRecordingLogger) Error(msg string, keyvals ...interface{}) {
+	l.Info(msg, keyvals...)
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestWithRequestIDs(t *testing.T) {
+	key := "/blobs/test/common/sha256:12345/sha256:abcd"
+	testCase := []struct {
+		name      string
+		requestID string
+		// wantID is the expected ID, a UUID is expected if empty
+		wantID string
+	}{
+		{name: "Sent by client", requestID: "worker-1234", wantID: "worker-1234"},
+		{name: "Generated"},
+		{name: "Invalid", requestID: "with space"},
+		{name: "Too long", requestID: strings.Repeat("a", 129)},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			logger := &fullRecordingLogger{}
+			driver := &failingDriver{err: errors.New("connection reset")}
+			handler := NewHttpHandlerWithOptions(driver, WithLogger(logger), WithRequestLogging(), WithRequestIDs())
+
+			request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+key, nil)
+			if scenario.requestID != "" {
+				request.Header.Set("X-Request-ID", scenario.requestID)
+			}
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+
+			require.Equal(t, http.StatusInternalServerError, responseRecorder.Code)
+			id := responseRecorder.Header().Get("X-Request-ID")
+			if scenario.wantID != "" {
+				require.Equal(t, scenario.wantID, id)
+			} else {
+				require.Regexp(t, uuidPattern, id)
+			}
+			assert.Equal(t, fmt.Sprintf(`{"code":"STORAGE_ERROR","message":"internal storage error","requestId":"%s"}`, id), responseRecorder.Body.String())
+
+			// the driver error and the request are logged with the ID
+			require.Len(t, logger.lines, 2)
+			assert.Equal(t, "connection reset", logger.lines[0]["msg"])
+			assert.Equal(t, id, logger.lines[0]["requestId"])
+			assert.Equal(t, "request", logger.lines[1]["msg"])
+			assert.Equal(t, id, logger.lines[1]["requestId"])
+		})
+	}
+
+	t.Run("Unique", func(t *testing.T) {
+		handler := NewHttpHandlerWithOptions(&memory.Driver{}, WithRequestIDs())
+		ids := make(map[string]bool)
+		for i := 0; i < 10; i++ {
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/limits", nil))
+			ids[responseRecorder.Header().Get("X-Request-ID")] = true
+		}
+		assert.Len(t, ids, 10)
+	})
+
+	t.Run("Recovered panic", func(t *testing.T) {
+		handler := NewHttpHandlerWithOptions(&panickingDriver{}, WithRequestIDs())
+		request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+key, nil)
+		request.Header.Set("X-Request-ID", "worker-1234")
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+
+		require.Equal(t, http.StatusInternalServerError, responseRecorder.Code)
+		assert.Equal(t, `{"code":"INTERNAL_ERROR","message":"internal server error","requestId":"worker-1234"}`, responseRecorder.Body.String())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		responseRecorder := httptest.NewRecorder()
+		NewHttpHandler(&memory.Driver{}).ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+key, nil))
+		assert.Empty(t, responseRecorder.Header().Get("X-Request-ID"))
+		assert.Equal(t, errorBody(v2.ErrorCodeBlobNotFound, "blob not found: key "+key), responseRecorder.Body.String())
+	})
+}
@@ -0,0 +1,87 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/internal/response"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+)
+
+// WithRequestLogging logs each request with the logger of the handler, see WithLogger. The
+// method, path, namespace, status code, sizes of request and response body and duration of a
+// request are logged as key-value pairs; bodies are never logged. Requests are logged by the
+// outermost middleware, so that requests rejected by middlewares are logged as well.
+func WithRequestLogging() Option {
+	return applier(func(o *options) {
+		o.requestLogging = true
+	})
+}
+
+// logRequests returns a middleware logging each request passed to next with logger.
+func logRequests(logger logging.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := response.Wrap(w)
+			body := &countingReader{r: r.Body}
+			if r.Body != nil {
+				r.Body = body
+			}
+
+			next.ServeHTTP(rw, r)
+
+			status := rw.Status()
+			if status == 0 {
+				// handlers which write nothing implicitly respond with 200
+				status = http.StatusOK
+			}
+			keyvals := []interface{}{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"namespace", requestNamespace(r),
+				"status", status,
+				"requestBytes", body.n,
+				"responseBytes", rw.BytesWritten(),
+				"duration", time.Since(start),
+			}
+			if id := v2.RequestIDFromContext(r.Context()); id != "" {
+				keyvals = append(keyvals, "requestId", id)
+			}
+			logger.Info("request", keyvals...)
+		})
+	}
+}
+
+// requestNamespace returns the namespace of a request, which is passed as query parameter or
+// part of the key of the blob. It is empty for requests of other or several namespaces.
+func requestNamespace(r *http.Request) string {
+	query := r.URL.Query()
+	if namespace := query.Get("namespace"); namespace != "" {
+		return namespace
+	}
+	namespace, _, _ := v2.ParseKey(query.Get("key"))
+	return namespace
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
@@ -15,13 +15,102 @@ import (
 // NewHttpHandler creates the default HTTP handler for the Large Payload Service using a
 // noop logger.
 func NewHttpHandler(driver storage.Driver) http.Handler {
-	return NewHttpHandlerWithLogger(driver, logging.NewNoopLogger())
+	return NewHttpHandlerWithOptions(driver)
 }
 
 // NewHttpHandlerWithLogger creates a HTTP handler for the Large Payload Service using the
 // specified logger.
 func NewHttpHandlerWithLogger(driver storage.Driver, logger logging.Logger) http.Handler {
+	return NewHttpHandlerWithOptions(driver, WithLogger(logger))
+}
+
+// NewHttpHandlerWithOptions creates a HTTP handler for the Large Payload Service storing
+// blobs with driver, configured by opts. Panics of the handler are recovered unless
+// WithoutPanicRecovery is passed.
+func NewHttpHandlerWithOptions(driver storage.Driver, opts ...Option) http.Handler {
+	o := newOptions(opts)
+	return newHandler(driver, o, newAuditLog(&o))
+}
+
+// newOptions returns the options configured by opts.
+func newOptions(opts []Option) options {
+	o := options{
+		logger:            logging.NewNoopLogger(),
+		maxBlobBytes:      v2.DefaultMaxBlobBytes,
+		readHeaderTimeout: DefaultReadHeaderTimeout,
+		idleTimeout:       DefaultIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	return o
+}
+
+// newHandler creates the HTTP handler configured by o, which logs the accesses to blobs with
+// audit unless it is nil.
+func newHandler(driver storage.Driver, o options, audit *auditLog) http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/v2/", v2.NewHandler(driver, logger))
-	return mux
+	var v2Handler http.Handler = v2.NewHandlerWithConfig(v2.Config{
+		Driver:                    driver,
+		Logger:                    o.logger,
+		MaxBlobBytes:              o.maxBlobBytes,
+		NamespaceMaxBlobBytes:     o.namespaceMaxBlobBytes,
+		NamespaceQuotas:           o.namespaceQuotas,
+		MetricsHandler:            o.metricsHandler,
+		EventSink:                 o.eventSink,
+		Deletions:                 o.deletions,
+		Authorizer:                o.authorizer,
+		ReadinessCacheTTL:         o.readinessCacheTTL,
+		ReadinessObserver:         o.readinessObserver,
+		UploadSessionTTL:          o.uploadSessionTTL,
+		IdempotencyTTL:            o.idempotencyTTL,
+		MaxUploadBytes:            o.maxUploadBytes,
+		PresignExpiry:             o.presignExpiry,
+		Listing:                   o.listing,
+		NamespaceBlobTTL:          o.namespaceBlobTTL,
+		KeyBuilder:                o.keyBuilder,
+		NamespaceScopedKeys:       o.namespaceScopedKeys,
+		DisableDigestVerification: o.disableDigestVerification,
+		VerifyExisting:            o.verifyExisting,
+		SkipExistCheck:            o.skipExistCheck,
+		DisableCompression:        o.disableCompression,
+		CompressibleEncodings:     o.compressibleEncodings,
+		PlainTextErrors:           o.plainTextErrors,
+	})
+	api := v2Handler
+	if o.basePath != "" {
+		v2Handler = http.StripPrefix(o.basePath, v2Handler)
+	}
+	mux.Handle(o.basePath+"/v2/", v2Handler)
+	if o.codecServer != nil {
+		mux.Handle(o.basePath+"/codec/", http.StripPrefix(o.basePath+"/codec", serveCodecServer(api)(o.codecServer)))
+	}
+
+	var handler http.Handler = mux
+	for i := len(o.middlewares) - 1; i >= 0; i-- {
+		handler = o.middlewares[i](handler)
+	}
+	// requests are limited before middlewares, which may be expensive, e.g. authentication
+	if o.maxConcurrentRequests > 0 || o.maxConcurrentGets > 0 || o.maxConcurrentPuts > 0 || o.metricsHandler != nil {
+		handler = limitConcurrency(&o)(handler)
+	}
+	// preflight requests are answered before middlewares, e.g. authenticating requests
+	if len(o.corsOrigins) > 0 {
+		handler = handleCORS(o.corsOrigins, o.corsHeaders)(handler)
+	}
+	if !o.disablePanicRecovery {
+		handler = recoverPanics(o.logger)(handler)
+	}
+	// the principal may be set by middlewares, so accesses are recorded around them
+	if audit != nil {
+		handler = auditRequests(audit)(handler)
+	}
+	if o.requestLogging {
+		handler = logRequests(o.logger)(handler)
+	}
+	// IDs are assigned first, so that all middlewares log them
+	if o.requestIDs {
+		handler = assignRequestIDs(handler)
+	}
+	return handler
 }
@@ -6,18 +6,39 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/client"
 
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/router"
 )
 
 func TestGetBlobV2(t *testing.T) {
@@ -25,7 +46,7 @@ func TestGetBlobV2(t *testing.T) {
 	testPayloadBytes := []byte("hello world")
 	putResponse, err := driver.PutPayload(context.Background(), &storage.PutRequest{
 		Data:          bytes.NewReader(testPayloadBytes),
-		Key:           "blobs/sha256:3b336ba10c19d14d5e741d7b76957bb88620a282d92aac23e2d81c2393f1451d",
+		Key:           "/blobs/test/common/sha256:3b336ba10c19d14d5e741d7b76957bb88620a282d92aac23e2d81c2393f1451d/sha256:abcd",
 		Digest:        "sha256:3b336ba10c19d14d5e741d7b76957bb88620a282d92aac23e2d81c2393f1451d",
 		ContentLength: uint64(len(testPayloadBytes)),
 	})
@@ -39,19 +60,22 @@ func TestGetBlobV2(t *testing.T) {
 		queryParams map[string]string
 		want        string
 		statusCode  int
+		// wantLength is the Content-Length of successful responses
+		wantLength string
 	}{
 		{
 			name:   "No Content type specified",
 			target: "blobs/get",
 			method: http.MethodGet,
 			headers: map[string]string{
-				"X-Payload-Expected-Content-Length": "10",
+				"X-Payload-Expected-Content-Length": "11",
 			},
 			queryParams: map[string]string{
-				"digest": "12345",
+				"key": putResponse.Key,
 			},
-			want:       `missing or incorrect Content-Type header`,
-			statusCode: http.StatusBadRequest,
+			want:       `hello world`,
+			statusCode: http.StatusOK,
+			wantLength: "11",
 		},
 		{
 			name:   "Wrong Content type specified",
@@ -64,7 +88,7 @@ func TestGetBlobV2(t *testing.T) {
 			queryParams: map[string]string{
 				"digest": "12345",
 			},
-			want:       `missing or incorrect Content-Type header`,
+			want:       errorBody(v2.ErrorCodeInvalidRequest, "missing or incorrect Content-Type header"),
 			statusCode: http.StatusBadRequest,
 		},
 		{
@@ -76,49 +100,93 @@ func TestGetBlobV2(t *testing.T) {
 				"X-Payload-Expected-Content-Length": "10",
 			},
 			queryParams: map[string]string{},
-			want:        `key query parameter is required`,
+			want:        errorBody(v2.ErrorCodeInvalidRequest, "key query parameter is required"),
 			statusCode:  http.StatusBadRequest,
 		},
 		{
-			name:   "Missing length",
+			name:   "Invalid length",
 			target: "blobs/get",
 			method: http.MethodGet,
 			headers: map[string]string{
-				"Content-Type": "application/octet-stream",
+				"Content-Type":                      "application/octet-stream",
+				"X-Payload-Expected-Content-Length": "ten",
 			},
 			queryParams: map[string]string{
 				"key": "sha256:12345",
 			},
-			want:       `expected content length header is required`,
+			want:       errorBody(v2.ErrorCodeInvalidRequest, `expected content length header ten is invalid: strconv.ParseUint: parsing "ten": invalid syntax`),
 			statusCode: http.StatusBadRequest,
 		},
+		{
+			name:   "Successful retrieval without length",
+			target: "blobs/get",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"Content-Type": "application/octet-stream",
+			},
+			queryParams: map[string]string{
+				"key": putResponse.Key,
+			},
+			want:       `hello world`,
+			statusCode: http.StatusOK,
+			wantLength: "11",
+		},
 		{
 			name:   "Successful retrieval",
 			target: "blobs/get",
 			method: http.MethodGet,
 			headers: map[string]string{
 				"Content-Type":                      "application/octet-stream",
-				"X-Payload-Expected-Content-Length": "10",
+				"X-Payload-Expected-Content-Length": "11",
 			},
 			queryParams: map[string]string{
 				"key": putResponse.Key,
 			},
 			want:       `hello world`,
 			statusCode: http.StatusOK,
+			wantLength: "11",
 		},
 		{
-			name:   "Successful retrieval while decoding key",
+			name:   "Length mismatch",
 			target: "blobs/get",
 			method: http.MethodGet,
 			headers: map[string]string{
 				"Content-Type":                      "application/octet-stream",
 				"X-Payload-Expected-Content-Length": "10",
 			},
+			queryParams: map[string]string{
+				"key": putResponse.Key,
+			},
+			want:       errorBody(v2.ErrorCodeLengthMismatch, "stored blob has 11 bytes, but 10 bytes are expected"),
+			statusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:   "Missing blob",
+			target: "blobs/get",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"Content-Type": "application/octet-stream",
+			},
+			queryParams: map[string]string{
+				"key": "/blobs/test/common/sha256:12345/sha256:abcd",
+			},
+			want:       errorBody(v2.ErrorCodeBlobNotFound, "blob not found: key /blobs/test/common/sha256:12345/sha256:abcd"),
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:   "Successful retrieval while decoding key",
+			target: "blobs/get",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"Content-Type":                      "application/octet-stream",
+				"X-Payload-Expected-Content-Length": "11",
+			},
 			queryParams: map[string]string{
 				"key": url.QueryEscape(putResponse.Key),
 			},
 			want:       `hello world`,
 			statusCode: http.StatusOK,
+			wantLength: "11",
 		},
 	}
 
@@ -144,6 +212,2447 @@ func TestGetBlobV2(t *testing.T) {
 
 			assert.Equal(t, scenario.statusCode, responseRecorder.Code)
 			assert.Equal(t, scenario.want, responseRecorder.Body.String())
+			assert.Equal(t, scenario.wantLength, responseRecorder.Header().Get("Content-Length"))
+			if scenario.statusCode == http.StatusOK {
+				assert.Equal(t, putResponse.Key, responseRecorder.Header().Get("X-Payload-Key"))
+				assert.Equal(t, "sha256:3b336ba10c19d14d5e741d7b76957bb88620a282d92aac23e2d81c2393f1451d", responseRecorder.Header().Get("X-Payload-Digest"))
+			}
+		})
+	}
+}
+
+func TestGetBlobV2Head(t *testing.T) {
+	driver := &memory.Driver{}
+	testPayloadBytes := []byte("hello world")
+	digest := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	key := "/blobs/test/common/" + digest + "/sha256:abcd"
+	_, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+		Data:          bytes.NewReader(testPayloadBytes),
+		Key:           key,
+		ContentLength: uint64(len(testPayloadBytes)),
+	})
+	require.NoError(t, err)
+
+	testCase := []struct {
+		name        string
+		driver      storage.Driver
+		key         string
+		statusCode  int
+		wantLength  string
+		wantDigest  string
+		wantKey     string
+		contentType string
+	}{
+		{name: "Existing blob", driver: driver, key: key, statusCode: http.StatusOK, wantLength: "11", wantDigest: digest, wantKey: key, contentType: "application/octet-stream"},
+		{name: "Unknown size", driver: &existingDriver{}, key: key, statusCode: http.StatusOK, wantDigest: digest, wantKey: key, contentType: "application/octet-stream"},
+		{name: "Missing blob", driver: driver, key: "/blobs/test/common/sha256:12345/sha256:abcd", statusCode: http.StatusNotFound},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodHead, "/v2/blobs/get?key="+url.QueryEscape(scenario.key), nil)
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandler(scenario.driver).ServeHTTP(responseRecorder, request)
+
+			require.Equal(t, scenario.statusCode, responseRecorder.Code)
+			assert.Empty(t, responseRecorder.Body.String())
+			assert.Equal(t, scenario.wantLength, responseRecorder.Header().Get("Content-Length"))
+			assert.Equal(t, scenario.wantDigest, responseRecorder.Header().Get("X-Payload-Digest"))
+			assert.Equal(t, scenario.wantKey, responseRecorder.Header().Get("X-Payload-Key"))
+			assert.Equal(t, scenario.contentType, responseRecorder.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestGetBlobV2PlainClient(t *testing.T) {
+	// small responses are buffered and sent with their length
+	testPayloadBytes := bytes.Repeat([]byte("hello world"), 1000)
+	sum := sha256.Sum256(testPayloadBytes)
+	key := fmt.Sprintf("/blobs/test/common/sha256:%x/sha256:abcd", sum)
+
+	testCase := []struct {
+		name   string
+		driver storage.Driver
+		// wantLength is the Content-Length of the response, -1 if it is sent chunked
+		wantLength int64
+	}{
+		{name: "Known size", driver: &memory.Driver{}, wantLength: int64(len(testPayloadBytes))},
+		{name: "Unknown size", driver: &existingDriver{}, wantLength: -1},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			_, err := scenario.driver.PutPayload(context.Background(), &storage.PutRequest{
+				Data:          bytes.NewReader(testPayloadBytes),
+				Key:           key,
+				ContentLength: uint64(len(testPayloadBytes)),
+			})
+			require.NoError(t, err)
+			server := httptest.NewServer(NewHttpHandler(scenario.driver))
+			defer server.Close()
+
+			// the headers sent by curl
+			request, err := http.NewRequest(http.MethodGet, server.URL+"/v2/blobs/get?key="+url.QueryEscape(key), nil)
+			require.NoError(t, err)
+			request.Header.Set("User-Agent", "curl/8.4.0")
+			request.Header.Set("Accept", "*/*")
+			response, err := server.Client().Do(request)
+			require.NoError(t, err)
+			defer response.Body.Close()
+
+			require.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, scenario.wantLength, response.ContentLength)
+			if scenario.wantLength == -1 {
+				assert.Equal(t, []string{"chunked"}, response.TransferEncoding)
+			}
+			data, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, testPayloadBytes, data)
+		})
+	}
+}
+
+func TestPresignBlobV2Unsupported(t *testing.T) {
+	handler := NewHttpHandler(&memory.Driver{})
+
+	for _, target := range []string{"/v2/blobs/presign-put", "/v2/blobs/presign-get"} {
+		method := http.MethodGet
+		if strings.HasSuffix(target, "put") {
+			method = http.MethodPost
+		}
+		request := httptest.NewRequest(method, target, nil)
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+
+		assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
+	}
+}
+
+func TestPresignBlobV2UnsupportedByRoutedDriver(t *testing.T) {
+	handler := NewHttpHandler(router.New(&memory.Driver{}, nil))
+	request := httptest.NewRequest(http.MethodGet, "/v2/blobs/presign-get?key="+url.QueryEscape("/blobs/test/common/sha256:abc/sha256:def"), nil)
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeNotSupported, "operation not supported by the storage driver: the default driver does not support presigned URLs"), responseRecorder.Body.String())
+}
+
+// expiryRecorder is a driver recording the expiry of the presigned URLs it issues, and the
+// requests for presigned uploads.
+type expiryRecorder struct {
+	memory.Driver
+	mu      sync.Mutex
+	expires []time.Duration
+	puts    []*storage.PresignPutRequest
+}
+
+func (d *expiryRecorder) PresignPut(_ context.Context, r *storage.PresignPutRequest) (*storage.PresignResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expires = append(d.expires, r.Expires)
+	d.puts = append(d.puts, r)
+	return &storage.PresignResponse{URL: "https://example.com/" + r.Key, Method: http.MethodPut}, nil
+}
+
+func (d *expiryRecorder) PresignGet(_ context.Context, r *storage.PresignGetRequest) (*storage.PresignResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expires = append(d.expires, r.Expires)
+	return &storage.PresignResponse{URL: "https://example.com/" + r.Key, Method: http.MethodGet}, nil
+}
+
+func TestPresignExpiryV2(t *testing.T) {
+	testCase := []struct {
+		name string
+		opts []Option
+		want time.Duration
+	}{
+		{name: "Default", want: v2.DefaultPresignExpiry},
+		{name: "Configured", opts: []Option{WithPresignExpiry(time.Hour)}, want: time.Hour},
+		{name: "Capped", opts: []Option{WithPresignExpiry(30 * 24 * time.Hour)}, want: v2.MaxPresignExpiry},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			driver := &expiryRecorder{}
+			handler := NewHttpHandlerWithOptions(driver, scenario.opts...)
+
+			request := httptest.NewRequest(http.MethodPost, "/v2/blobs/presign-put?namespace=test&digest=sha256:"+strings.Repeat("0", 64), nil)
+			request.Header.Set("X-Payload-Expected-Content-Length", "10")
+			request.Header.Set("X-Temporal-Metadata", "e30=") // {}
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusOK, responseRecorder.Code, responseRecorder.Body.String())
+
+			request = httptest.NewRequest(http.MethodGet, "/v2/blobs/presign-get?key=/blobs/test/abc", nil)
+			responseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusOK, responseRecorder.Code, responseRecorder.Body.String())
+
+			assert.Equal(t, []time.Duration{scenario.want, scenario.want}, driver.expires)
+		})
+	}
+}
+
+func TestPresignPutV2(t *testing.T) {
+	driver := &expiryRecorder{}
+	handler := NewHttpHandlerWithOptions(driver,
+		WithNamespaceBlobTTL(map[string]time.Duration{"test": time.Hour}),
+		WithNamespaceQuota(map[string]uint64{"test": 40}),
+		WithPresignExpiry(50*time.Millisecond),
+	)
+	metadata := base64.StdEncoding.EncodeToString([]byte(`{"encoding":"anNvbi9wbGFpbg=="}`))
+	presign := func(data []byte) string {
+		request := httptest.NewRequest(http.MethodPost, "/v2/blobs/presign-put?namespace=test&digest="+sha256Digest(data), nil)
+		request.Header.Set("X-Payload-Expected-Content-Length", strconv.Itoa(len(data)))
+		request.Header.Set("X-Payload-Content-Type", "application/json")
+		request.Header.Set("X-Temporal-Metadata", metadata)
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusOK, responseRecorder.Code, responseRecorder.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+		return response["key"].(string)
+	}
+	usedBytes := func() float64 {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/limits?namespace=test", nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+		return body["usedBytes"].(float64)
+	}
+
+	// the expiry, content type and Temporal metadata of the blob are signed
+	presign([]byte("0123456789"))
+	driver.mu.Lock()
+	require.Len(t, driver.puts, 1)
+	assert.Equal(t, "application/json", driver.puts[0].ContentType)
+	assert.Equal(t, map[string][]byte{"encoding": []byte("json/plain")}, driver.puts[0].Metadata)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), driver.puts[0].ExpiresAt, time.Minute)
+	driver.mu.Unlock()
+
+	// the size of unused URLs is released once they expire
+	assert.Equal(t, float64(10), usedBytes())
+	assert.Eventually(t, func() bool { return usedBytes() == 0 }, time.Second, 10*time.Millisecond)
+
+	// and kept if the blob was uploaded
+	data := []byte("uploaded")
+	key := presign(data)
+	putBlob(t, driver, key, data, sha256Digest(data), nil)
+	assert.Never(t, func() bool { return usedBytes() != float64(len(data)) }, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestListBlobsV2(t *testing.T) {
+	driver := &memory.Driver{}
+	for _, key := range []string{"/blobs/test/common/b", "/blobs/test/common/a", "/blobs/test/custom/p/c", "/blobs/other/common/a"} {
+		_, err := driver.PutPayload(context.Background(), &storage.PutRequest{Data: strings.NewReader("data"), Key: key})
+		require.NoError(t, err)
+	}
+	var authorized []string
+	handler := NewHttpHandlerWithOptions(driver, WithBlobListing(), WithAuthorizer(func(_ *http.Request, op Operation, namespace, key string) error {
+		authorized = append(authorized, fmt.Sprintf("%s %s %s", op, namespace, key))
+		return nil
+	}))
+	list := func(query string) (int, map[string]interface{}) {
+		request := httptest.NewRequest(http.MethodGet, "/v2/blobs/list?"+query, nil)
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+		return responseRecorder.Code, body
+	}
+	keys := func(body map[string]interface{}) []string {
+		var keys []string
+		for _, blob := range body["blobs"].([]interface{}) {
+			blob := blob.(map[string]interface{})
+			assert.Equal(t, float64(4), blob["contentLength"])
+			assert.NotEmpty(t, blob["lastModified"])
+			keys = append(keys, blob["key"].(string))
+		}
+		return keys
+	}
+
+	status, body := list("namespace=test&limit=2")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, []string{"/blobs/test/common/a", "/blobs/test/common/b"}, keys(body))
+	require.NotEmpty(t, body["cursor"])
+	status, body = list("namespace=test&limit=2&cursor=" + url.QueryEscape(body["cursor"].(string)))
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, []string{"/blobs/test/custom/p/c"}, keys(body))
+	assert.Nil(t, body["cursor"])
+
+	status, body = list("namespace=test&prefix=custom/")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, []string{"/blobs/test/custom/p/c"}, keys(body))
+	assert.Equal(t, []string{
+		"list test /blobs/test/",
+		"list test /blobs/test/",
+		"list test /blobs/test/custom/",
+	}, authorized)
+
+	status, body = list("namespace=unknown")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, []interface{}{}, body["blobs"])
+
+	for _, query := range []string{"", "namespace=test&limit=0", "namespace=test&limit=x"} {
+		status, body = list(query)
+		assert.Equal(t, http.StatusBadRequest, status, query)
+		assert.Equal(t, string(v2.ErrorCodeInvalidRequest), body["code"], query)
+	}
+	status, body = list("namespace=a/b")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, string(v2.ErrorCodeInvalidNamespace), body["code"])
+
+	// listing is opt-in
+	request := httptest.NewRequest(http.MethodGet, "/v2/blobs/list?namespace=test", nil)
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+	assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
+}
+
+func TestDeleteBlobsByPrefixV2(t *testing.T) {
+	driver := &memory.Driver{}
+	for _, key := range []string{"/blobs/test/common/a", "/blobs/test/custom/p/b", "/blobs/test/custom/q/c", "/blobs/other/common/a"} {
+		_, err := driver.PutPayload(context.Background(), &storage.PutRequest{Data: strings.NewReader("data"), Key: key})
+		require.NoError(t, err)
+	}
+	var authorized []string
+	logger := &recordingLogger{}
+	handler := NewHttpHandlerWithOptions(driver, WithLogger(logger), WithAuthorizer(func(_ *http.Request, op Operation, namespace, key string) error {
+		authorized = append(authorized, fmt.Sprintf("%s %s %s", op, namespace, key))
+		if namespace == "other" {
+			return errors.New("not an admin")
+		}
+		return nil
+	}))
+	deleteByPrefix := func(handler http.Handler, method string, query string) (int, map[string]interface{}) {
+		request := httptest.NewRequest(method, "/v2/admin/blobs?"+query, nil)
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+		return responseRecorder.Code, body
+	}
+	exists := func(key string) bool {
+		exists, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: key})
+		require.NoError(t, err)
+		return exists.Exists
+	}
+
+	status, body := deleteByPrefix(handler, http.MethodDelete, "namespace=test&prefix=custom/p&confirm=true")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, map[string]interface{}{"deleted": float64(1)}, body)
+	assert.False(t, exists("/blobs/test/custom/p/b"))
+	assert.True(t, exists("/blobs/test/custom/q/c"))
+	assert.Contains(t, logger.lines, map[string]interface{}{"msg": "deleted blobs by prefix", "prefix": "/blobs/test/custom/p", "deleted": 1})
+
+	status, body = deleteByPrefix(handler, http.MethodDelete, "namespace=test&confirm=true")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, map[string]interface{}{"deleted": float64(2)}, body)
+	assert.True(t, exists("/blobs/other/common/a"))
+
+	status, body = deleteByPrefix(handler, http.MethodDelete, "namespace=other&confirm=true")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.True(t, exists("/blobs/other/common/a"))
+	assert.Equal(t, []string{
+		"delete-by-prefix test /blobs/test/custom/p",
+		"delete-by-prefix test /blobs/test/",
+		"delete-by-prefix other /blobs/other/",
+	}, authorized)
+
+	for _, query := range []string{"namespace=other", "namespace=other&confirm=1", "confirm=true"} {
+		status, body = deleteByPrefix(handler, http.MethodDelete, query)
+		assert.Equal(t, http.StatusBadRequest, status, query)
+		assert.Equal(t, string(v2.ErrorCodeInvalidRequest), body["code"], query)
+	}
+	status, body = deleteByPrefix(handler, http.MethodDelete, "namespace=a/b&confirm=true")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, string(v2.ErrorCodeInvalidNamespace), body["code"])
+	status, _ = deleteByPrefix(handler, http.MethodGet, "namespace=other&confirm=true")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+	// the endpoint requires an authorizer
+	status, body = deleteByPrefix(NewHttpHandler(driver), http.MethodDelete, "namespace=other&confirm=true")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "admin endpoints require an authorizer", body["message"])
+	assert.True(t, exists("/blobs/other/common/a"))
+}
+
+func TestLimitsV2(t *testing.T) {
+	handler := NewHttpHandler(&memory.Driver{})
+
+	request := httptest.NewRequest(http.MethodGet, "/v2/limits", nil)
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"maxBlobBytes":1073741824}`, responseRecorder.Body.String())
+
+	request = httptest.NewRequest(http.MethodPost, "/v2/limits", nil)
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Code)
+}
+
+// newPutRequestV2 returns a request uploading data with the given Content-Length header to
+// /v2/blobs/put.
+func newPutRequestV2(data []byte, contentLength int) *http.Request {
+	sum := sha256.Sum256(data)
+	request := httptest.NewRequest(http.MethodPut, "/v2/blobs/put", bytes.NewReader(data))
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Length", strconv.Itoa(contentLength))
+	request.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString([]byte(`{}`)))
+	q := request.URL.Query()
+	q.Add("namespace", "test")
+	q.Add("digest", "sha256:"+hex.EncodeToString(sum[:]))
+	request.URL.RawQuery = q.Encode()
+	return request
+}
+
+func TestPutBlobV2TTL(t *testing.T) {
+	driver := &memory.Driver{}
+	handler := NewHttpHandlerWithOptions(driver, WithNamespaceBlobTTL(map[string]time.Duration{"test": time.Hour}))
+	data := []byte("hello world")
+	put := func(ttl string) (int, time.Time) {
+		request := newPutRequestV2(data, len(data))
+		if ttl != "" {
+			request.Header.Set("X-Payload-TTL", ttl)
+		}
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		var putResponse storage.PutResponse
+		if responseRecorder.Code >= http.StatusBadRequest {
+			return responseRecorder.Code, time.Time{}
+		}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &putResponse))
+		exists, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: putResponse.Key})
+		require.NoError(t, err)
+		return responseRecorder.Code, exists.ExpiresAt
+	}
+
+	// blobs expire after the TTL of their namespace
+	status, expiresAt := put("")
+	require.Equal(t, http.StatusCreated, status)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+
+	// blobs are stored again to extend their expiry, but never to shorten it
+	status, expiresAt = put("7200")
+	require.Equal(t, http.StatusCreated, status)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), expiresAt, time.Minute)
+	status, expiresAt = put("60")
+	require.Equal(t, http.StatusOK, status)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), expiresAt, time.Minute)
+
+	for _, ttl := range []string{"0", "-1", "1h"} {
+		status, _ = put(ttl)
+		assert.Equal(t, http.StatusBadRequest, status, ttl)
+	}
+
+	// blobs without a TTL never expire
+	handler = NewHttpHandler(driver)
+	status, expiresAt = put("")
+	require.Equal(t, http.StatusCreated, status)
+	assert.True(t, expiresAt.IsZero())
+	status, expiresAt = put("60")
+	require.Equal(t, http.StatusOK, status)
+	assert.True(t, expiresAt.IsZero())
+}
+
+func TestPutBlobV2Metadata(t *testing.T) {
+	driver := &memory.Driver{}
+	data := []byte("hello world")
+	request := newPutRequestV2(data, len(data))
+	request.Header.Set("X-Temporal-Metadata", "eyJmb28iOiJZbUZ5In0=") // {"foo":"YmFy"}
+
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusCreated, responseRecorder.Code)
+	var putResponse storage.PutResponse
+	require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &putResponse))
+
+	// the metadata is stored with the blob
+	assert.Equal(t, map[string][]byte{"foo": []byte("bar")}, driver.Metadata(putResponse.Key))
+}
+
+// newMetadataPutRequestV2 returns a request uploading data with the given Temporal metadata to
+// /v2/blobs/put.
+func newMetadataPutRequestV2(t *testing.T, data []byte, metadata map[string][]byte) *http.Request {
+	rawMetadata, err := json.Marshal(metadata)
+	require.NoError(t, err)
+	request := newPutRequestV2(data, len(data))
+	request.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString(rawMetadata))
+	return request
+}
+
+func TestPutBlobV2InvalidMetadata(t *testing.T) {
+	data := []byte("hello world")
+	longKey := strings.Repeat("k", v2.MaxMetadataKeyBytes+1)
+	testCases := []struct {
+		name     string
+		metadata map[string][]byte
+		message  string
+	}{
+		{
+			name:     "Empty key",
+			metadata: map[string][]byte{"": []byte("a")},
+			message:  "metadata keys must not be empty",
+		},
+		{
+			name:     "Newline in key",
+			metadata: map[string][]byte{"encoding": []byte("json/plain"), "bad\nkey": []byte("a")},
+			message:  `metadata key "bad\nkey" is not valid: only letters, digits, '_', '-', '.' and '/' are allowed`,
+		},
+		{
+			name:     "Non-ASCII key",
+			metadata: map[string][]byte{"clé": []byte("a")},
+			message:  `metadata key "clé" is not valid: only letters, digits, '_', '-', '.' and '/' are allowed`,
+		},
+		{
+			name:     "Too long key",
+			metadata: map[string][]byte{longKey: []byte("a")},
+			message:  fmt.Sprintf("metadata key '%s...' is longer than 128 bytes", longKey[:v2.MaxMetadataKeyBytes]),
+		},
+		{
+			name:     "Too long value",
+			metadata: map[string][]byte{"encoding": bytes.Repeat([]byte("a"), v2.MaxMetadataValueBytes+1)},
+			message:  "the value of metadata key 'encoding' is 4097 bytes long, the maximum is 4096 bytes",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandler(&memory.Driver{}).ServeHTTP(responseRecorder, newMetadataPutRequestV2(t, data, tc.metadata))
+			require.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+			assert.Equal(t, errorBody(v2.ErrorCodeInvalidMetadata, tc.message), responseRecorder.Body.String())
+		})
+	}
+}
+
+// objectStoreDriver is a driver rejecting puts whose object metadata would be rejected by
+// object stores, as S3 does for non-ASCII values or values with leading or trailing spaces.
+type objectStoreDriver struct {
+	memory.Driver
+}
+
+func (d *objectStoreDriver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
+	size := 0
+	for key, value := range storage.ObjectMetadata(r) {
+		size += len(key) + len(value)
+		if strings.TrimSpace(value) != value {
+			return nil, fmt.Errorf("object metadata %q has leading or trailing spaces", key)
+		}
+		for _, c := range []byte(key + value) {
+			if c < ' ' || c > '~' {
+				return nil, fmt.Errorf("object metadata %q is not printable ASCII", key)
+			}
+		}
+	}
+	if size > 2048 {
+		return nil, fmt.Errorf("object metadata exceeds 2 KB")
+	}
+	return d.Driver.PutPayload(ctx, r)
+}
+
+// TestPutBlobV2RandomMetadata checks that puts with random metadata are either rejected with
+// INVALID_METADATA or stored, but never fail at the driver layer.
+func TestPutBlobV2RandomMetadata(t *testing.T) {
+	// the seed is fixed so that failures are reproducible
+	random := rand.New(rand.NewSource(1))
+	const keyCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./"
+	randomBytes := func(max int) []byte {
+		b := make([]byte, random.Intn(max+1))
+		random.Read(b)
+		return b
+	}
+	randomKey := func() string {
+		if random.Intn(4) == 0 {
+			return string(randomBytes(16))
+		}
+		key := make([]byte, 1+random.Intn(32))
+		for i := range key {
+			key[i] = keyCharacters[random.Intn(len(keyCharacters))]
+		}
+		return string(key)
+	}
+
+	handler := NewHttpHandler(&objectStoreDriver{})
+	stored := 0
+	for i := 0; i < 500; i++ {
+		metadata := make(map[string][]byte)
+		for j := random.Intn(6); j > 0; j-- {
+			metadata[randomKey()] = randomBytes(512)
+		}
+		data := randomBytes(64)
+
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, newMetadataPutRequestV2(t, data, metadata))
+		switch responseRecorder.Code {
+		case http.StatusCreated, http.StatusOK:
+			stored++
+		case http.StatusBadRequest:
+			var body v2.ErrorResponse
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+			require.Equal(t, v2.ErrorCodeInvalidMetadata, body.Code, body.Message)
+		default:
+			require.Failf(t, "unexpected response", "%d %s for metadata %q", responseRecorder.Code, responseRecorder.Body.String(), metadata)
+		}
+	}
+	assert.Greater(t, stored, 0)
+}
+
+func TestPutBlobV2VerifyExisting(t *testing.T) {
+	data := []byte("hello world")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	wrongData := []byte("hello there, world")
+	wrongDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(wrongData))
+	metadata := map[string][]byte{"encoding": []byte("json/plain")}
+	key, err := v2.ComputeKey("test", digest, metadata)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name string
+		// seed stores a blob under the key of the upload, if set
+		seed func(t *testing.T, driver *memory.Driver)
+		// basic hides the optional interfaces of the driver
+		basic        bool
+		status       int
+		storedDigest string
+		message      string
+	}{
+		{
+			name:   "Matching blob",
+			seed:   func(t *testing.T, driver *memory.Driver) { putBlob(t, driver, key, data, digest, metadata) },
+			status: http.StatusOK,
+		},
+		{
+			name:         "Other digest",
+			seed:         func(t *testing.T, driver *memory.Driver) { putBlob(t, driver, key, wrongData, wrongDigest, metadata) },
+			status:       http.StatusConflict,
+			storedDigest: wrongDigest,
+			message:      fmt.Sprintf("stored digest %s does not match %s", wrongDigest, digest),
+		},
+		{
+			name:    "Other size without digest",
+			seed:    func(t *testing.T, driver *memory.Driver) { putBlob(t, driver, key, wrongData, "", metadata) },
+			status:  http.StatusConflict,
+			message: "stored size of 18 bytes does not match 11 bytes",
+		},
+		{
+			name: "Other metadata",
+			seed: func(t *testing.T, driver *memory.Driver) {
+				putBlob(t, driver, key, data, digest, map[string][]byte{"encoding": []byte("binary/plain")})
+			},
+			status:       http.StatusConflict,
+			storedDigest: digest,
+			message:      "stored Temporal metadata does not match",
+		},
+		{
+			name:    "Other size with a basic driver",
+			seed:    func(t *testing.T, driver *memory.Driver) { putBlob(t, driver, key, wrongData, wrongDigest, metadata) },
+			basic:   true,
+			status:  http.StatusConflict,
+			message: "stored size of 18 bytes does not match 11 bytes",
+		},
+		{
+			name:   "New blob",
+			status: http.StatusCreated,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			memoryDriver := &memory.Driver{}
+			if tc.seed != nil {
+				tc.seed(t, memoryDriver)
+			}
+			seeded, _ := memoryDriver.HeadPayload(context.Background(), &storage.HeadRequest{Key: key})
+			var driver storage.Driver = memoryDriver
+			if tc.basic {
+				driver = struct{ storage.Driver }{memoryDriver}
+			}
+
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandlerWithOptions(driver, WithVerifyExisting()).ServeHTTP(responseRecorder, newMetadataPutRequestV2(t, data, metadata))
+			require.Equal(t, tc.status, responseRecorder.Code, responseRecorder.Body.String())
+			if tc.status != http.StatusConflict {
+				assert.Contains(t, responseRecorder.Body.String(), key)
+				return
+			}
+			var body v2.ErrorResponse
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+			assert.Equal(t, v2.ErrorResponse{
+				Code:            v2.ErrorCodeKeyCollision,
+				Message:         fmt.Sprintf("blob %s already exists with different content: %s", key, tc.message),
+				RequestedDigest: digest,
+				StoredDigest:    tc.storedDigest,
+			}, body)
+
+			// the stored blob is left untouched
+			stored, err := memoryDriver.HeadPayload(context.Background(), &storage.HeadRequest{Key: key})
+			require.NoError(t, err)
+			assert.Equal(t, seeded, stored)
 		})
 	}
+
+	// existing blobs are not verified by default
+	driver := &memory.Driver{}
+	putBlob(t, driver, key, wrongData, wrongDigest, metadata)
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(driver).ServeHTTP(responseRecorder, newMetadataPutRequestV2(t, data, metadata))
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+}
+
+// blockingPutDriver is a driver counting the calls to PutPayload, which block until release is
+// closed once they are signaled on started.
+type blockingPutDriver struct {
+	memory.Driver
+	puts    atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingPutDriver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
+	d.puts.Add(1)
+	d.started <- struct{}{}
+	<-d.release
+	return d.Driver.PutPayload(ctx, r)
+}
+
+func TestPutBlobV2IdempotencyKey(t *testing.T) {
+	data := []byte("hello world")
+	put := func(handler http.Handler, data []byte, idempotencyKey string) *httptest.ResponseRecorder {
+		request := newPutRequestV2(data, len(data))
+		if idempotencyKey != "" {
+			request.Header.Set(v2.IdempotencyKeyHeader, idempotencyKey)
+		}
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	t.Run("Concurrent uploads", func(t *testing.T) {
+		driver := &blockingPutDriver{started: make(chan struct{}, 2), release: make(chan struct{})}
+		handler := NewHttpHandler(driver)
+		responses := make([]*httptest.ResponseRecorder, 2)
+		var wg sync.WaitGroup
+		for i := range responses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				responses[i] = put(handler, data, "upload-1")
+			}(i)
+			if i == 0 {
+				<-driver.started
+			}
+		}
+		// give the second upload the time to reach the driver if it is not held back
+		time.Sleep(50 * time.Millisecond)
+		close(driver.release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), driver.puts.Load())
+		assert.Equal(t, http.StatusCreated, responses[0].Code)
+		assert.Equal(t, http.StatusCreated, responses[1].Code)
+		assert.JSONEq(t, responses[0].Body.String(), responses[1].Body.String())
+		assert.Empty(t, responses[0].Header().Get(v2.IdempotentReplayedHeader))
+		assert.Equal(t, "true", responses[1].Header().Get(v2.IdempotentReplayedHeader))
+	})
+
+	t.Run("Retried uploads", func(t *testing.T) {
+		driver := &blockingPutDriver{started: make(chan struct{}, 4), release: make(chan struct{})}
+		close(driver.release)
+		handler := NewHttpHandler(driver)
+
+		// failed uploads are not recorded
+		corrupted := newPutRequestV2(data, len(data))
+		corrupted.Body = io.NopCloser(strings.NewReader("hello wOrld"))
+		corrupted.Header.Set(v2.IdempotencyKeyHeader, "upload-1")
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, corrupted)
+		require.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+		first := put(handler, data, "upload-1")
+		require.Equal(t, http.StatusCreated, first.Code)
+		require.Equal(t, int32(2), driver.puts.Load())
+
+		// retries are answered with the recorded response, even if the blob was deleted since
+		var putResponse storage.PutResponse
+		require.NoError(t, json.Unmarshal(first.Body.Bytes(), &putResponse))
+		_, err := driver.DeletePayload(context.Background(), &storage.DeleteRequest{Key: putResponse.Key})
+		require.NoError(t, err)
+		retry := put(handler, data, "upload-1")
+		assert.Equal(t, http.StatusCreated, retry.Code)
+		assert.JSONEq(t, first.Body.String(), retry.Body.String())
+		assert.Equal(t, "true", retry.Header().Get(v2.IdempotentReplayedHeader))
+		assert.Equal(t, int32(2), driver.puts.Load())
+
+		// idempotency keys are scoped to blobs, uploads without one are stored again
+		other := put(handler, []byte("other data"), "upload-1")
+		assert.Equal(t, http.StatusCreated, other.Code)
+		assert.Empty(t, other.Header().Get(v2.IdempotentReplayedHeader))
+		assert.Equal(t, http.StatusCreated, put(handler, data, "").Code)
+		assert.Equal(t, int32(4), driver.puts.Load())
+	})
+}
+
+// countingDriver counts the calls to ExistPayload and PutPayload.
+type countingDriver struct {
+	memory.Driver
+	exists atomic.Int32
+	puts   atomic.Int32
+}
+
+func (d *countingDriver) ExistPayload(ctx context.Context, r *storage.ExistRequest) (*storage.ExistResponse, error) {
+	d.exists.Add(1)
+	return d.Driver.ExistPayload(ctx, r)
+}
+
+func (d *countingDriver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
+	d.puts.Add(1)
+	return d.Driver.PutPayload(ctx, r)
+}
+
+// counterMetricsHandler records the values of counters by name and sorted tags.
+type counterMetricsHandler struct {
+	client.MetricsHandler
+	mu       *sync.Mutex
+	tags     string
+	counters map[string]int64
+}
+
+func (h *counterMetricsHandler) WithTags(tags map[string]string) client.MetricsHandler {
+	var pairs []string
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return &counterMetricsHandler{MetricsHandler: h.MetricsHandler, mu: h.mu, tags: strings.Join(pairs, ","), counters: h.counters}
+}
+
+func (h *counterMetricsHandler) Counter(name string) client.MetricsCounter {
+	return counter(func(v int64) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.counters[name+"{"+h.tags+"}"] += v
+	})
+}
+
+type counter func(int64)
+
+func (c counter) Inc(v int64) {
+	c(v)
+}
+
+func TestPutBlobV2SkipExistCheck(t *testing.T) {
+	data := []byte("hello world")
+	testCases := []struct {
+		name        string
+		opts        []Option
+		ttl         string
+		wantExists  int32
+		wantPuts    int32
+		wantStatus  []int
+		wantResults map[string]int64
+	}{
+		{
+			name:        "Checked by default",
+			wantExists:  2,
+			wantPuts:    1,
+			wantStatus:  []int{http.StatusCreated, http.StatusOK},
+			wantResults: map[string]int64{"miss": 1, "hit": 1},
+		},
+		{
+			name:        "Skipped",
+			opts:        []Option{WithSkipExistCheck()},
+			wantPuts:    2,
+			wantStatus:  []int{http.StatusCreated, http.StatusCreated},
+			wantResults: map[string]int64{"skipped": 2},
+		},
+		{
+			name:       "Checked with an expiry",
+			opts:       []Option{WithSkipExistCheck()},
+			ttl:        "60",
+			wantExists: 2,
+			// the blob is stored again to extend its expiry
+			wantPuts:    2,
+			wantStatus:  []int{http.StatusCreated, http.StatusCreated},
+			wantResults: map[string]int64{"miss": 2},
+		},
+		{
+			name:        "Checked with a quota",
+			opts:        []Option{WithSkipExistCheck(), WithNamespaceQuota(map[string]uint64{"test": 1 << 20})},
+			wantExists:  2,
+			wantPuts:    1,
+			wantStatus:  []int{http.StatusCreated, http.StatusOK},
+			wantResults: map[string]int64{"miss": 1, "hit": 1},
+		},
+		{
+			name:        "Checked when verifying existing blobs",
+			opts:        []Option{WithSkipExistCheck(), WithVerifyExisting()},
+			wantExists:  2,
+			wantPuts:    1,
+			wantStatus:  []int{http.StatusCreated, http.StatusOK},
+			wantResults: map[string]int64{"miss": 1, "hit": 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			driver := &countingDriver{}
+			metrics := &counterMetricsHandler{MetricsHandler: client.MetricsNopHandler, mu: &sync.Mutex{}, counters: map[string]int64{}}
+			handler := NewHttpHandlerWithOptions(driver, append(tc.opts, WithMetricsHandler(metrics))...)
+			for _, status := range tc.wantStatus {
+				request := newPutRequestV2(data, len(data))
+				if tc.ttl != "" {
+					request.Header.Set("X-Payload-TTL", tc.ttl)
+				}
+				responseRecorder := httptest.NewRecorder()
+				handler.ServeHTTP(responseRecorder, request)
+				require.Equal(t, status, responseRecorder.Code, responseRecorder.Body.String())
+			}
+
+			assert.Equal(t, tc.wantExists, driver.exists.Load())
+			assert.Equal(t, tc.wantPuts, driver.puts.Load())
+			wantCounters := make(map[string]int64)
+			for result, n := range tc.wantResults {
+				wantCounters["lps_put_exist_checks_total{namespace=test,result="+result+"}"] = n
+			}
+			assert.Equal(t, wantCounters, metrics.counters)
+		})
+	}
+}
+
+// putBlob stores data under key with driver, bypassing the handler.
+func putBlob(t *testing.T, driver storage.Driver, key string, data []byte, digest string, metadata map[string][]byte) {
+	_, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+		Data:          bytes.NewReader(data),
+		Key:           key,
+		Digest:        digest,
+		ContentLength: uint64(len(data)),
+		Metadata:      metadata,
+	})
+	require.NoError(t, err)
+}
+
+// payloadKeyBuilder stores blobs under /payloads/<namespace>/<digest>.
+type payloadKeyBuilder struct{}
+
+func (payloadKeyBuilder) BuildKey(namespace, digest string, _ map[string][]byte) (string, error) {
+	return fmt.Sprintf("/payloads/%s/%s", namespace, digest), nil
+}
+
+func (payloadKeyBuilder) ValidateKey(key string) (string, error) {
+	tokens := strings.Split(key, "/")
+	if len(tokens) != 4 || tokens[1] != "payloads" {
+		return "", fmt.Errorf("'%s' is not a valid key", key)
+	}
+	return tokens[2], nil
+}
+
+func TestPutBlobV2KeyBuilder(t *testing.T) {
+	driver := &memory.Driver{}
+	var authorized []string
+	handler := NewHttpHandlerWithOptions(driver, WithKeyBuilder(payloadKeyBuilder{}), WithAuthorizer(func(_ *http.Request, op Operation, namespace, key string) error {
+		authorized = append(authorized, fmt.Sprintf("%s %s %s", op, namespace, key))
+		return nil
+	}))
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, newPutRequestV2(data, len(data)))
+	require.Equal(t, http.StatusCreated, responseRecorder.Code)
+	var putResponse storage.PutResponse
+	require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &putResponse))
+	assert.Equal(t, "/payloads/test/sha256:"+hex.EncodeToString(sum[:]), putResponse.Key)
+
+	request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get", nil)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	q := request.URL.Query()
+	q.Add("key", putResponse.Key)
+	request.URL.RawQuery = q.Encode()
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, data, responseRecorder.Body.Bytes())
+	// keys in other layouts are not parsed for their digest
+	assert.Equal(t, putResponse.Key, responseRecorder.Header().Get("X-Payload-Key"))
+	assert.Empty(t, responseRecorder.Header().Get("X-Payload-Digest"))
+
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodDelete, "/v2/blobs/delete?key="+url.QueryEscape(putResponse.Key), nil))
+	require.Equal(t, http.StatusNoContent, responseRecorder.Code)
+	// but authorizers are called with their namespace
+	assert.Equal(t, []string{
+		"put test " + putResponse.Key,
+		"get test " + putResponse.Key,
+		"delete test " + putResponse.Key,
+	}, authorized)
+}
+
+func TestPutBlobV2MaxBlobBytes(t *testing.T) {
+	const maxBlobBytes = 16
+
+	testCase := []struct {
+		name          string
+		size          int
+		contentLength int
+		statusCode    int
+		message       string
+	}{
+		{name: "Under the limit", size: maxBlobBytes - 1, contentLength: maxBlobBytes - 1, statusCode: http.StatusCreated},
+		{name: "At the limit", size: maxBlobBytes, contentLength: maxBlobBytes, statusCode: http.StatusCreated},
+		{
+			name:          "Over the limit",
+			size:          maxBlobBytes + 1,
+			contentLength: maxBlobBytes + 1,
+			statusCode:    http.StatusRequestEntityTooLarge,
+			message:       "payload of 17 bytes exceeds the global max size of 16 bytes",
+		},
+		{
+			name:          "Body over the limit",
+			size:          maxBlobBytes + 1,
+			contentLength: maxBlobBytes,
+			statusCode:    http.StatusRequestEntityTooLarge,
+			message:       "request body exceeds the declared Content-Length of 16 bytes",
+		},
+		{
+			name:          "Body over the declaration",
+			size:          maxBlobBytes,
+			contentLength: maxBlobBytes - 1,
+			statusCode:    http.StatusRequestEntityTooLarge,
+			message:       "request body exceeds the declared Content-Length of 15 bytes",
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			driver := &memory.Driver{}
+			handler := NewHttpHandlerWithOptions(driver, WithMaxBlobBytes(maxBlobBytes))
+			data := bytes.Repeat([]byte("a"), scenario.size)
+
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, newPutRequestV2(data, scenario.contentLength))
+			require.Equal(t, scenario.statusCode, responseRecorder.Code, responseRecorder.Body.String())
+			if scenario.message != "" {
+				assert.Equal(t, errorBody(v2.ErrorCodePayloadTooLarge, scenario.message), responseRecorder.Body.String())
+			}
+		})
+	}
+
+	// the configured limit is advertised to clients
+	request := httptest.NewRequest(http.MethodGet, "/v2/limits", nil)
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandlerWithOptions(&memory.Driver{}, WithMaxBlobBytes(maxBlobBytes)).ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.JSONEq(t, `{"maxBlobBytes":16}`, responseRecorder.Body.String())
+}
+
+func TestPutBlobV2NamespaceMaxBlobBytes(t *testing.T) {
+	handler := NewHttpHandlerWithOptions(&memory.Driver{},
+		WithMaxBlobBytes(16),
+		WithNamespaceMaxBlobBytes(map[string]uint64{"small": 8, "large": 32}),
+	)
+
+	testCase := []struct {
+		namespace  string
+		size       int
+		statusCode int
+		message    string
+	}{
+		{namespace: "small", size: 8, statusCode: http.StatusCreated},
+		{namespace: "small", size: 9, statusCode: http.StatusRequestEntityTooLarge, message: "payload of 9 bytes exceeds the max size of 8 bytes of namespace 'small'"},
+		{namespace: "large", size: 32, statusCode: http.StatusCreated},
+		{namespace: "large", size: 33, statusCode: http.StatusRequestEntityTooLarge, message: "payload of 33 bytes exceeds the max size of 32 bytes of namespace 'large'"},
+		{namespace: "other", size: 16, statusCode: http.StatusCreated},
+		{namespace: "other", size: 17, statusCode: http.StatusRequestEntityTooLarge, message: "payload of 17 bytes exceeds the global max size of 16 bytes"},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(fmt.Sprintf("%s/%d", scenario.namespace, scenario.size), func(t *testing.T) {
+			request := newPutRequestV2(bytes.Repeat([]byte("a"), scenario.size), scenario.size)
+			q := request.URL.Query()
+			q.Set("namespace", scenario.namespace)
+			request.URL.RawQuery = q.Encode()
+
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, scenario.statusCode, responseRecorder.Code, responseRecorder.Body.String())
+			if scenario.message != "" {
+				assert.Equal(t, errorBody(v2.ErrorCodePayloadTooLarge, scenario.message), responseRecorder.Body.String())
+			}
+		})
+	}
+
+	// the limits of a namespace are advertised to clients
+	for namespace, want := range map[string]string{"small": `{"maxBlobBytes":8}`, "other": `{"maxBlobBytes":16}`, "": `{"maxBlobBytes":16}`} {
+		request := httptest.NewRequest(http.MethodGet, "/v2/limits?namespace="+namespace, nil)
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusOK, responseRecorder.Code)
+		assert.JSONEq(t, want, responseRecorder.Body.String())
+	}
+}
+
+// partialUploadDriver is a driver which stores the data received up to a failed upload.
+type partialUploadDriver struct {
+	memory.Driver
+}
+
+func (d *partialUploadDriver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
+	data, err := io.ReadAll(r.Data)
+	if _, putErr := d.Driver.PutPayload(ctx, &storage.PutRequest{Key: r.Key, Data: bytes.NewReader(data)}); putErr != nil {
+		return nil, putErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &storage.PutResponse{Key: r.Key}, nil
+}
+
+func TestPutBlobV2BodyExceedingContentLength(t *testing.T) {
+	driver := &partialUploadDriver{}
+	data := []byte("hello world")
+	request := newPutRequestV2(data, len(data)-1)
+
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodePayloadTooLarge, "request body exceeds the declared Content-Length of 10 bytes"), responseRecorder.Body.String())
+
+	// the partially written blob is deleted
+	key, err := v2.ComputeKey("test", request.URL.Query().Get("digest"), map[string][]byte{})
+	require.NoError(t, err)
+	exists, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: key})
+	require.NoError(t, err)
+	assert.False(t, exists.Exists)
+}
+
+func TestPutBlobV2Methods(t *testing.T) {
+	data := []byte("hello world")
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			handler := NewHttpHandler(&memory.Driver{})
+			request := newPutRequestV2(data, len(data))
+			request.Method = method
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusCreated, responseRecorder.Code)
+			var putResponse storage.PutResponse
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &putResponse))
+
+			request = httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+url.QueryEscape(putResponse.Key), nil)
+			responseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusOK, responseRecorder.Code)
+			assert.Equal(t, data, responseRecorder.Body.Bytes())
+		})
+	}
+
+	request := newPutRequestV2(data, len(data))
+	request.Method = http.MethodPatch
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(&memory.Driver{}).ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Code)
+	assert.Equal(t, "PUT, POST", responseRecorder.Header().Get("Allow"))
+	assert.Equal(t, errorBody(v2.ErrorCodeMethodNotAllowed, "method PATCH is not allowed, use PUT or POST"), responseRecorder.Body.String())
+}
+
+func TestPutBlobV2InvalidNamespace(t *testing.T) {
+	data := []byte("hello world")
+	digest := "sha256:" + strings.Repeat("0", 64)
+	for _, namespace := range []string{"..", ".", "../etc", "a/../b", "a/b", "/", "a b", "team:a", "tést"} {
+		t.Run(namespace, func(t *testing.T) {
+			handler := NewHttpHandler(&memory.Driver{})
+			request := newPutRequestV2(data, len(data))
+			q := request.URL.Query()
+			q.Set("namespace", namespace)
+			request.URL.RawQuery = q.Encode()
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+			var body map[string]interface{}
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+			assert.Equal(t, string(v2.ErrorCodeInvalidNamespace), body["code"])
+
+			// other endpoints taking a namespace reject it as well
+			query := url.Values{"namespace": {namespace}, "digest": {digest}}.Encode()
+			head := httptest.NewRequest(http.MethodHead, "/v2/blobs/head?"+query, nil)
+			upload := httptest.NewRequest(http.MethodPost, "/v2/blobs/uploads?"+query, nil)
+			upload.Header.Set("X-Payload-Expected-Content-Length", "11")
+			upload.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString([]byte(`{}`)))
+			limits := httptest.NewRequest(http.MethodGet, "/v2/limits?"+query, nil)
+			for _, request := range []*http.Request{head, upload, limits} {
+				responseRecorder = httptest.NewRecorder()
+				handler.ServeHTTP(responseRecorder, request)
+				assert.Equal(t, http.StatusBadRequest, responseRecorder.Code, request.URL.Path)
+			}
+		})
+	}
+
+	// dots are allowed within namespaces
+	request := newPutRequestV2(data, len(data))
+	q := request.URL.Query()
+	q.Set("namespace", "team.a-b_c")
+	request.URL.RawQuery = q.Encode()
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(&memory.Driver{}).ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusCreated, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), "/blobs/team.a-b_c/")
+}
+
+// unreadableBody is a request body failing the test if it is read.
+type unreadableBody struct {
+	t *testing.T
+}
+
+func (b unreadableBody) Read([]byte) (int, error) {
+	b.t.Error("the request body must not be read")
+	return 0, io.EOF
+}
+
+func (b unreadableBody) Close() error {
+	return nil
+}
+
+// TestPutBlobV2RejectsBeforeReadingBody checks that requests are validated before their body
+// is read, so that clients sending Expect: 100-continue do not transmit rejected blobs.
+func TestPutBlobV2RejectsBeforeReadingBody(t *testing.T) {
+	data := []byte("hello world")
+	existing := &memory.Driver{}
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(existing).ServeHTTP(responseRecorder, newPutRequestV2(data, len(data)))
+	require.Equal(t, http.StatusCreated, responseRecorder.Code)
+
+	testCases := []struct {
+		name       string
+		driver     storage.Driver
+		opts       []Option
+		modify     func(r *http.Request)
+		statusCode int
+	}{
+		{
+			name:       "missing digest",
+			modify:     func(r *http.Request) { r.URL.RawQuery = "namespace=test" },
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid metadata",
+			modify:     func(r *http.Request) { r.Header.Set("X-Temporal-Metadata", "not base64") },
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "blob too large",
+			opts:       []Option{WithMaxBlobBytes(4)},
+			statusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "unauthenticated",
+			opts:       []Option{WithAuthorizer(BearerTokenAuthorizer("secret"))},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "quota exceeded",
+			opts:       []Option{WithNamespaceQuota(map[string]uint64{"test": 4})},
+			statusCode: http.StatusInsufficientStorage,
+		},
+		{
+			name:       "existing blob",
+			driver:     existing,
+			statusCode: http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			driver := tc.driver
+			if driver == nil {
+				driver = &memory.Driver{}
+			}
+			request := newPutRequestV2(data, len(data))
+			request.Header.Set("Expect", "100-continue")
+			request.Body = unreadableBody{t: t}
+			if tc.modify != nil {
+				tc.modify(request)
+			}
+
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandlerWithOptions(driver, tc.opts...).ServeHTTP(responseRecorder, request)
+			assert.Equal(t, tc.statusCode, responseRecorder.Code)
+		})
+	}
+}
+
+func TestPutBlobV2ChecksumMismatch(t *testing.T) {
+	handler := NewHttpHandler(&memory.Driver{})
+	data := []byte("hello world")
+
+	// corrupt data stored under the digest of data
+	request := newPutRequestV2(data, len(data))
+	request.Body = io.NopCloser(bytes.NewReader([]byte("hello there")))
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeChecksumMismatch, "checksum mismatch"), responseRecorder.Body.String())
+
+	// is deleted, so that data is stored rather than found to exist already
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, newPutRequestV2(data, len(data)))
+	require.Equal(t, http.StatusCreated, responseRecorder.Code)
+	var putResponse storage.PutResponse
+	require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &putResponse))
+
+	request = httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+url.QueryEscape(putResponse.Key), nil)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, data, responseRecorder.Body.Bytes())
+}
+
+func TestPutBlobV2FailedUploadKeepsExistingBlob(t *testing.T) {
+	data := []byte("hello world")
+	testCases := []struct {
+		name       string
+		opts       []Option
+		ttl        string
+		request    func() *http.Request
+		wantStatus int
+	}{
+		{
+			name:       "Body exceeding Content-Length with the exist check skipped",
+			opts:       []Option{WithSkipExistCheck()},
+			request:    func() *http.Request { return newPutRequestV2(data, len(data)-1) },
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "Checksum mismatch with the exist check skipped",
+			opts: []Option{WithSkipExistCheck()},
+			request: func() *http.Request {
+				request := newPutRequestV2(data, len(data))
+				request.Body = io.NopCloser(bytes.NewReader([]byte("hello there")))
+				return request
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Checksum mismatch when stored again to extend its expiry",
+			opts: []Option{WithNamespaceQuota(map[string]uint64{"test": 1 << 20})},
+			ttl:  "60",
+			request: func() *http.Request {
+				request := newPutRequestV2(data, len(data))
+				request.Header.Set("X-Payload-TTL", "120")
+				request.Body = io.NopCloser(bytes.NewReader([]byte("hello there")))
+				return request
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := NewHttpHandlerWithOptions(&memory.Driver{}, tc.opts...)
+			request := newPutRequestV2(data, len(data))
+			if tc.ttl != "" {
+				request.Header.Set("X-Payload-TTL", tc.ttl)
+			}
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusCreated, responseRecorder.Code, responseRecorder.Body.String())
+			var putResponse storage.PutResponse
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &putResponse))
+
+			responseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, tc.request())
+			require.Equal(t, tc.wantStatus, responseRecorder.Code, responseRecorder.Body.String())
+
+			request = httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+url.QueryEscape(putResponse.Key), nil)
+			responseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusOK, responseRecorder.Code)
+			assert.Equal(t, data, responseRecorder.Body.Bytes())
+
+			// the blob still counts towards the quota of its namespace, and only once
+			request = httptest.NewRequest(http.MethodGet, "/v2/limits?namespace=test", nil)
+			responseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusOK, responseRecorder.Code)
+			var limits struct{ UsedBytes *uint64 }
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &limits))
+			if limits.UsedBytes != nil {
+				assert.Equal(t, uint64(len(data)), *limits.UsedBytes)
+			}
+		})
+	}
+}
+
+// contentTypeRecorder is a driver recording the content types of the stored blobs.
+type contentTypeRecorder struct {
+	memory.Driver
+	contentTypes []string
+}
+
+func (d *contentTypeRecorder) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
+	d.contentTypes = append(d.contentTypes, r.ContentType)
+	return d.Driver.PutPayload(ctx, r)
+}
+
+func TestPutBlobV2ContentType(t *testing.T) {
+	testCase := []struct {
+		name        string
+		contentType string
+		want        string
+	}{
+		{name: "JSON", contentType: "application/json", want: "application/json"},
+		{name: "Parameters", contentType: "application/json; Charset=utf-8", want: "application/json; charset=utf-8"},
+		{name: "Invalid", contentType: "application/json; =", want: ""},
+		{name: "Missing", want: ""},
+	}
+
+	for i, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			driver := &contentTypeRecorder{}
+			data := []byte(fmt.Sprintf(`{"hello":%d}`, i))
+			request := newPutRequestV2(data, len(data))
+			if scenario.contentType != "" {
+				request.Header.Set("X-Payload-Content-Type", scenario.contentType)
+			}
+
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusCreated, responseRecorder.Code, responseRecorder.Body.String())
+			assert.Equal(t, []string{scenario.want}, driver.contentTypes)
+		})
+	}
+}
+
+func TestPutBlobV2DigestAlgorithms(t *testing.T) {
+	data := []byte("hello world")
+	sha256Sum := sha256.Sum256(data)
+	sha512Sum := sha512.Sum512(data)
+	digests := []string{
+		"sha256:" + hex.EncodeToString(sha256Sum[:]),
+		"sha512:" + hex.EncodeToString(sha512Sum[:]),
+	}
+
+	driver := &memory.Driver{}
+	handler := NewHttpHandler(driver)
+	keys := map[string]bool{}
+	for _, digest := range digests {
+		t.Run(digest[:6], func(t *testing.T) {
+			request := newPutRequestV2(data, len(data))
+			q := request.URL.Query()
+			q.Set("digest", digest)
+			request.URL.RawQuery = q.Encode()
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusCreated, responseRecorder.Code, responseRecorder.Body.String())
+			var putResponse storage.PutResponse
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &putResponse))
+			assert.Contains(t, putResponse.Key, digest)
+			keys[putResponse.Key] = true
+
+			request = httptest.NewRequest(http.MethodGet, "/v2/blobs/get", nil)
+			request.Header.Set("Content-Type", "application/octet-stream")
+			q = request.URL.Query()
+			q.Set("key", putResponse.Key)
+			request.URL.RawQuery = q.Encode()
+			responseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusOK, responseRecorder.Code)
+			assert.Equal(t, data, responseRecorder.Body.Bytes())
+
+			// the checksum is verified with the hash of the digest algorithm
+			request = newPutRequestV2([]byte("hello there"), len(data))
+			q = request.URL.Query()
+			q.Set("digest", digest)
+			q.Set("namespace", "other")
+			request.URL.RawQuery = q.Encode()
+			responseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+			assert.Equal(t, errorBody(v2.ErrorCodeChecksumMismatch, "checksum mismatch"), responseRecorder.Body.String())
+		})
+	}
+	assert.Len(t, keys, len(digests))
+}
+
+func TestHeadBlobV2(t *testing.T) {
+	driver := &memory.Driver{}
+	testPayloadBytes := []byte("hello world")
+	digest := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	putResponse, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+		Data:          bytes.NewReader(testPayloadBytes),
+		Key:           "/blobs/test/common/" + digest + "/sha256:c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2",
+		Digest:        digest,
+		ContentLength: uint64(len(testPayloadBytes)),
+	})
+	require.NoError(t, err)
+
+	testCase := []struct {
+		name        string
+		method      string
+		headers     map[string]string
+		queryParams map[string]string
+		wantKey     string
+		statusCode  int
+	}{
+		{
+			name:       "Wrong method",
+			method:     http.MethodPost,
+			statusCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "Missing key and namespace",
+			method:     http.MethodHead,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:   "Existing key",
+			method: http.MethodHead,
+			queryParams: map[string]string{
+				"key": putResponse.Key,
+			},
+			wantKey:    putResponse.Key,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:   "Existing key with GET",
+			method: http.MethodGet,
+			queryParams: map[string]string{
+				"key": putResponse.Key,
+			},
+			wantKey:    putResponse.Key,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:   "Missing key",
+			method: http.MethodHead,
+			queryParams: map[string]string{
+				"key": "/blobs/test/common/sha256:5678/sha256:abcd",
+			},
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:   "Existing digest and metadata",
+			method: http.MethodHead,
+			headers: map[string]string{
+				"X-Temporal-Metadata": "eyJmb28iOiJZbUZ5In0=", // {"foo":"YmFy"}
+			},
+			queryParams: map[string]string{
+				"namespace": "test",
+				"digest":    digest,
+			},
+			wantKey:    putResponse.Key,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:   "Missing digest and metadata",
+			method: http.MethodHead,
+			headers: map[string]string{
+				"X-Temporal-Metadata": "e30=", // {}
+			},
+			queryParams: map[string]string{
+				"namespace": "test",
+				"digest":    digest,
+			},
+			statusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			request := httptest.NewRequest(scenario.method, "/v2/blobs/head", nil)
+			for k, v := range scenario.headers {
+				request.Header.Set(k, v)
+			}
+			q := request.URL.Query()
+			for k, v := range scenario.queryParams {
+				q.Add(k, v)
+			}
+			request.URL.RawQuery = q.Encode()
+
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+
+			assert.Equal(t, scenario.statusCode, responseRecorder.Code)
+			assert.Equal(t, scenario.wantKey, responseRecorder.Header().Get("X-Payload-Key"))
+			if scenario.statusCode == http.StatusOK {
+				assert.Equal(t, digest, responseRecorder.Header().Get("X-Payload-Digest"))
+				assert.Equal(t, strconv.Itoa(len(testPayloadBytes)), responseRecorder.Header().Get("Content-Length"))
+				assert.Empty(t, responseRecorder.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestGetBlobV2Gzip(t *testing.T) {
+	driver := &memory.Driver{}
+	testPayloadBytes := []byte(`{"hello":"world"}`)
+	putResponse, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+		Data:          bytes.NewReader(testPayloadBytes),
+		Key:           "/blobs/test/common/sha256:1234/sha256:abcd",
+		Digest:        "sha256:1234",
+		ContentLength: uint64(len(testPayloadBytes)),
+	})
+	require.NoError(t, err)
+
+	testCase := []struct {
+		name           string
+		acceptEncoding string
+		encoding       string
+		opts           []Option
+		wantGzip       bool
+	}{
+		{name: "Compressible encoding", acceptEncoding: "gzip", encoding: "json/plain", wantGzip: true},
+		{name: "Compressible encoding with quality", acceptEncoding: "br, gzip;q=0.8", encoding: "json/protobuf", wantGzip: true},
+		{name: "Incompressible encoding", acceptEncoding: "gzip", encoding: "binary/plain"},
+		{name: "Missing encoding", acceptEncoding: "gzip"},
+		{name: "Gzip not accepted", encoding: "json/plain"},
+		{name: "Gzip refused", acceptEncoding: "br, gzip;q=0", encoding: "json/plain"},
+		{name: "Compression disabled", acceptEncoding: "gzip", encoding: "json/plain", opts: []Option{WithoutCompression()}},
+		{name: "Custom compressible encoding", acceptEncoding: "gzip", encoding: "json/custom", opts: []Option{WithCompressibleEncodings("json/custom")}, wantGzip: true},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get", nil)
+			request.Header.Set("Content-Type", "application/octet-stream")
+			request.Header.Set("X-Payload-Expected-Content-Length", strconv.Itoa(len(testPayloadBytes)))
+			if scenario.acceptEncoding != "" {
+				request.Header.Set("Accept-Encoding", scenario.acceptEncoding)
+			}
+			if scenario.encoding != "" {
+				request.Header.Set("X-Payload-Encoding", scenario.encoding)
+			}
+			q := request.URL.Query()
+			q.Add("key", putResponse.Key)
+			request.URL.RawQuery = q.Encode()
+
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandlerWithOptions(driver, scenario.opts...).ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusOK, responseRecorder.Code)
+
+			assert.Equal(t, "application/octet-stream", responseRecorder.Header().Get("Content-Type"))
+			body := responseRecorder.Body.Bytes()
+			if scenario.wantGzip {
+				assert.Equal(t, "gzip", responseRecorder.Header().Get("Content-Encoding"))
+				assert.Empty(t, responseRecorder.Header().Get("Content-Length"))
+				r, err := gzip.NewReader(bytes.NewReader(body))
+				require.NoError(t, err)
+				body, err = io.ReadAll(r)
+				require.NoError(t, err)
+			} else {
+				assert.Empty(t, responseRecorder.Header().Get("Content-Encoding"))
+				assert.Equal(t, strconv.Itoa(len(testPayloadBytes)), responseRecorder.Header().Get("Content-Length"))
+			}
+			assert.Equal(t, testPayloadBytes, body)
+		})
+	}
+}
+
+func TestGetBlobV2Range(t *testing.T) {
+	driver := &memory.Driver{}
+	testPayloadBytes := []byte(`{"hello":"world"}`)
+	putResponse, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+		Data:          bytes.NewReader(testPayloadBytes),
+		Key:           "/blobs/test/common/sha256:1234/sha256:abcd",
+		Digest:        "sha256:1234",
+		ContentLength: uint64(len(testPayloadBytes)),
+	})
+	require.NoError(t, err)
+
+	testCase := []struct {
+		name             string
+		rangeHeader      string
+		wantStatus       int
+		wantBody         []byte
+		wantContentRange string
+	}{
+		{name: "Remainder", rangeHeader: "bytes=9-", wantStatus: http.StatusPartialContent, wantBody: testPayloadBytes[9:], wantContentRange: "bytes 9-16/17"},
+		{name: "Last byte", rangeHeader: "bytes=16-", wantStatus: http.StatusPartialContent, wantBody: testPayloadBytes[16:], wantContentRange: "bytes 16-16/17"},
+		{name: "Beyond end", rangeHeader: "bytes=17-", wantStatus: http.StatusRequestedRangeNotSatisfiable, wantContentRange: "bytes */17"},
+		{name: "Unsupported range", rangeHeader: "bytes=0-8", wantStatus: http.StatusOK, wantBody: testPayloadBytes},
+		{name: "No range", wantStatus: http.StatusOK, wantBody: testPayloadBytes},
+	}
+
+	for _, scenario := range testCase {
+		// the size of the blob is known from storage, regardless of the expected length
+		for _, expectedLength := range []string{"", strconv.Itoa(len(testPayloadBytes))} {
+			t.Run(fmt.Sprintf("%s/expected length %q", scenario.name, expectedLength), func(t *testing.T) {
+				request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get", nil)
+				request.Header.Set("Content-Type", "application/octet-stream")
+				if expectedLength != "" {
+					request.Header.Set("X-Payload-Expected-Content-Length", expectedLength)
+				}
+				request.Header.Set("Accept-Encoding", "gzip")
+				request.Header.Set("X-Payload-Encoding", "json/plain")
+				if scenario.rangeHeader != "" {
+					request.Header.Set("Range", scenario.rangeHeader)
+				}
+				q := request.URL.Query()
+				q.Add("key", putResponse.Key)
+				request.URL.RawQuery = q.Encode()
+
+				responseRecorder := httptest.NewRecorder()
+				NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+				require.Equal(t, scenario.wantStatus, responseRecorder.Code)
+				assert.Equal(t, "bytes", responseRecorder.Header().Get("Accept-Ranges"))
+				assert.Equal(t, scenario.wantContentRange, responseRecorder.Header().Get("Content-Range"))
+				if scenario.wantStatus == http.StatusPartialContent {
+					assert.Empty(t, responseRecorder.Header().Get("Content-Encoding"))
+					assert.Equal(t, strconv.Itoa(len(scenario.wantBody)), responseRecorder.Header().Get("Content-Length"))
+					assert.Equal(t, scenario.wantBody, responseRecorder.Body.Bytes())
+				}
+			})
+		}
+	}
+}
+
+func TestGetBlobBatchV2(t *testing.T) {
+	driver := &memory.Driver{}
+	testPayloadBytes := []byte("hello world")
+	putResponse, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+		Data:          bytes.NewReader(testPayloadBytes),
+		Key:           "/blobs/test/common/sha256:1234/sha256:abcd",
+		Digest:        "sha256:1234",
+		ContentLength: uint64(len(testPayloadBytes)),
+	})
+	require.NoError(t, err)
+
+	testCase := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		want        string
+		statusCode  int
+	}{
+		{
+			name:        "Wrong method",
+			method:      http.MethodGet,
+			contentType: "application/json",
+			body:        `{"keys":["a"]}`,
+			want:        errorBody(v2.ErrorCodeMethodNotAllowed, "Method Not Allowed"),
+			statusCode:  http.StatusMethodNotAllowed,
+		},
+		{
+			name:        "Wrong Content type specified",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        `{"keys":["a"]}`,
+			want:        errorBody(v2.ErrorCodeInvalidRequest, "missing or incorrect Content-Type header"),
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:        "Missing keys",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `{"keys":[]}`,
+			want:        errorBody(v2.ErrorCodeInvalidRequest, "keys are required"),
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:        "Too many keys",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `{"keys":[` + strings.Repeat(`"a",`, 1000) + `"a"]}`,
+			want:        errorBody(v2.ErrorCodeInvalidRequest, "batch exceeds max size of 1000 keys"),
+			statusCode:  http.StatusBadRequest,
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			request := httptest.NewRequest(scenario.method, "/v2/blobs/get-batch", strings.NewReader(scenario.body))
+			request.Header.Set("Content-Type", scenario.contentType)
+
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+
+			assert.Equal(t, scenario.statusCode, responseRecorder.Code)
+			assert.Equal(t, scenario.want, responseRecorder.Body.String())
+		})
+	}
+
+	t.Run("Successful retrieval", func(t *testing.T) {
+		body := fmt.Sprintf(`{"keys":[%q,"/blobs/test/common/unknown",%q]}`, putResponse.Key, putResponse.Key)
+		request := httptest.NewRequest(http.MethodPost, "/v2/blobs/get-batch", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+
+		responseRecorder := httptest.NewRecorder()
+		NewHttpHandler(driver).ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusOK, responseRecorder.Code)
+
+		mediaType, params, err := mime.ParseMediaType(responseRecorder.Header().Get("Content-Type"))
+		require.NoError(t, err)
+		require.Equal(t, "multipart/mixed", mediaType)
+
+		type part struct {
+			key, status, digest string
+			data                []byte
+		}
+		var parts []part
+		mr := multipart.NewReader(responseRecorder.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(p)
+			require.NoError(t, err)
+			parts = append(parts, part{
+				key:    p.Header.Get("X-Payload-Key"),
+				status: p.Header.Get("X-Payload-Status"),
+				digest: p.Header.Get("X-Payload-Digest"),
+				data:   data,
+			})
+		}
+
+		digest := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+		assert.Equal(t, []part{
+			{key: putResponse.Key, status: "200", digest: digest, data: testPayloadBytes},
+			{key: "/blobs/test/common/unknown", status: "404", data: []byte(errorBody(v2.ErrorCodeBlobNotFound, "blob not found: key /blobs/test/common/unknown"))},
+			{key: putResponse.Key, status: "200", digest: digest, data: testPayloadBytes},
+		}, parts)
+	})
+}
+
+func TestKeyValidationV2(t *testing.T) {
+	const (
+		testKey  = "/blobs/test/common/sha256:1234/sha256:abcd"
+		otherKey = "/blobs/other/common/sha256:1234/sha256:abcd"
+	)
+
+	testCase := []struct {
+		name       string
+		method     string
+		target     string
+		key        string
+		namespace  string
+		scoped     bool
+		wantStatus int
+		wantCode   v2.ErrorCode
+	}{
+		{name: "Get", method: http.MethodGet, target: "get", key: testKey, wantStatus: http.StatusOK},
+		{name: "Get other namespace", method: http.MethodGet, target: "get", key: otherKey, wantStatus: http.StatusOK},
+		{name: "Get traversal", method: http.MethodGet, target: "get", key: "/blobs/test/../other/common/sha256:1234/sha256:abcd", wantStatus: http.StatusBadRequest, wantCode: v2.ErrorCodeInvalidKey},
+		{name: "Get outside blobs", method: http.MethodGet, target: "get", key: "/backups/dump", wantStatus: http.StatusBadRequest, wantCode: v2.ErrorCodeInvalidKey},
+		{name: "Get empty segment", method: http.MethodGet, target: "get", key: "/blobs/test//sha256:1234", wantStatus: http.StatusBadRequest, wantCode: v2.ErrorCodeInvalidKey},
+		{name: "Get invalid characters", method: http.MethodGet, target: "get", key: "/blobs/test/common/*", wantStatus: http.StatusBadRequest, wantCode: v2.ErrorCodeInvalidKey},
+		{name: "Scoped get", method: http.MethodGet, target: "get", key: testKey, namespace: "test", scoped: true, wantStatus: http.StatusOK},
+		{name: "Scoped get other namespace", method: http.MethodGet, target: "get", key: otherKey, namespace: "test", scoped: true, wantStatus: http.StatusForbidden, wantCode: v2.ErrorCodeForbidden},
+		{name: "Scoped get without namespace", method: http.MethodGet, target: "get", key: testKey, scoped: true, wantStatus: http.StatusBadRequest, wantCode: v2.ErrorCodeInvalidRequest},
+		{name: "Scoped head other namespace", method: http.MethodHead, target: "head", key: otherKey, namespace: "test", scoped: true, wantStatus: http.StatusForbidden},
+		{name: "Delete traversal", method: http.MethodDelete, target: "delete", key: "/blobs/test/common/../../other/common/sha256:1234/sha256:abcd", wantStatus: http.StatusBadRequest, wantCode: v2.ErrorCodeInvalidKey},
+		{name: "Scoped delete", method: http.MethodDelete, target: "delete", key: testKey, namespace: "test", scoped: true, wantStatus: http.StatusNoContent},
+		{name: "Scoped delete other namespace", method: http.MethodDelete, target: "delete", key: otherKey, namespace: "test", scoped: true, wantStatus: http.StatusForbidden, wantCode: v2.ErrorCodeForbidden},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			driver := &memory.Driver{}
+			for _, key := range []string{testKey, otherKey} {
+				_, err := driver.PutPayload(context.Background(), &storage.PutRequest{Data: strings.NewReader("hello"), Key: key, ContentLength: 5})
+				require.NoError(t, err)
+			}
+			var opts []Option
+			if scenario.scoped {
+				opts = append(opts, WithNamespaceScopedKeys())
+			}
+
+			request := httptest.NewRequest(scenario.method, "/v2/blobs/"+scenario.target, nil)
+			request.Header.Set("Content-Type", "application/octet-stream")
+			q := request.URL.Query()
+			q.Set("key", scenario.key)
+			if scenario.namespace != "" {
+				q.Set("namespace", scenario.namespace)
+			}
+			request.URL.RawQuery = q.Encode()
+			responseRecorder := httptest.NewRecorder()
+			NewHttpHandlerWithOptions(driver, opts...).ServeHTTP(responseRecorder, request)
+
+			require.Equal(t, scenario.wantStatus, responseRecorder.Code)
+			if scenario.wantCode != "" {
+				var errorResponse v2.ErrorResponse
+				require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &errorResponse))
+				assert.Equal(t, scenario.wantCode, errorResponse.Code)
+			}
+			if scenario.wantStatus >= http.StatusBadRequest {
+				// rejected requests do not access the storage
+				for _, key := range []string{testKey, otherKey} {
+					exists, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: key})
+					require.NoError(t, err)
+					assert.True(t, exists.Exists)
+				}
+			}
+		})
+	}
+
+	t.Run("Batch", func(t *testing.T) {
+		driver := &memory.Driver{}
+		for _, key := range []string{testKey, otherKey} {
+			_, err := driver.PutPayload(context.Background(), &storage.PutRequest{Data: strings.NewReader("hello"), Key: key, ContentLength: 5})
+			require.NoError(t, err)
+		}
+		body := fmt.Sprintf(`{"keys":[%q,%q,"/blobs/test/../other"]}`, testKey, otherKey)
+		request := httptest.NewRequest(http.MethodPost, "/v2/blobs/get-batch?namespace=test", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		responseRecorder := httptest.NewRecorder()
+		NewHttpHandlerWithOptions(driver, WithNamespaceScopedKeys()).ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusOK, responseRecorder.Code)
+
+		_, params, err := mime.ParseMediaType(responseRecorder.Header().Get("Content-Type"))
+		require.NoError(t, err)
+		var statuses []string
+		mr := multipart.NewReader(responseRecorder.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			statuses = append(statuses, p.Header.Get("X-Payload-Status"))
+		}
+		assert.Equal(t, []string{"200", "403", "400"}, statuses)
+	})
+}
+
+func TestNewHttpHandlerWithOptions(t *testing.T) {
+	var calls []string
+	middleware := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	handler := NewHttpHandlerWithOptions(&memory.Driver{},
+		WithLogger(logging.NewNoopLogger()),
+		WithMaxBlobBytes(64),
+		WithMiddleware(middleware("outer")),
+		WithMiddleware(middleware("inner")),
+	)
+
+	request := httptest.NewRequest(http.MethodGet, "/v2/limits", nil)
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.JSONEq(t, `{"maxBlobBytes":64}`, responseRecorder.Body.String())
+	assert.Equal(t, []string{"outer", "inner"}, calls)
+}
+
+// recordingLogger records the messages and key-value pairs logged at info level.
+type recordingLogger struct {
+	logging.NoopLogger
+	mu    sync.Mutex
+	lines []map[string]interface{}
+}
+
+func (l *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	l.mu.Lock()
+	l.lines = append(l.lines, logLine(msg, keyvals))
+	l.mu.Unlock()
+}
+
+// logLine returns a logged message and its key-value pairs as a map.
+func logLine(msg string, keyvals []interface{}) map[string]interface{} {
+	line := map[string]interface{}{"msg": msg}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line[keyvals[i].(string)] = keyvals[i+1]
+	}
+	return line
+}
+
+func TestWithBasePath(t *testing.T) {
+	for _, basePath := range []string{"/lps", "lps", "/lps/"} {
+		t.Run(basePath, func(t *testing.T) {
+			handler := NewHttpHandlerWithOptions(&memory.Driver{}, WithBasePath(basePath))
+			for path, want := range map[string]int{
+				"/lps/v2/health/ready": http.StatusOK,
+				"/lps/v2/limits":       http.StatusOK,
+				"/lps/v2/blobs/get":    http.StatusBadRequest,
+				"/v2/health/ready":     http.StatusNotFound,
+				"/lpsv2/health/ready":  http.StatusNotFound,
+				"/other/v2/limits":     http.StatusNotFound,
+				"/lps/lps/v2/limits":   http.StatusNotFound,
+				"/lps/v2/unknown/path": http.StatusNotFound,
+			} {
+				responseRecorder := httptest.NewRecorder()
+				handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, path, nil))
+				assert.Equal(t, want, responseRecorder.Code, path)
+			}
+		})
+	}
+
+	// requests are classified by their path under the base path
+	class, limited := classifyRequest(httptest.NewRequest(http.MethodGet, "/lps/v2/blobs/get", nil), "/lps")
+	assert.True(t, limited)
+	assert.Equal(t, requestClassGet, class)
+	_, limited = classifyRequest(httptest.NewRequest(http.MethodHead, "/lps/v2/health/head", nil), "/lps")
+	assert.False(t, limited)
+}
+
+func TestWithCodecServer(t *testing.T) {
+	var paths []string
+	codecServer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := NewHttpHandlerWithOptions(&memory.Driver{},
+		WithBasePath("/lps"),
+		WithCodecServer(codecServer),
+		WithCORS([]string{"https://ui.example.com"}, nil),
+	)
+	for path, want := range map[string]int{
+		"/lps/codec/decode": http.StatusOK,
+		"/lps/codec/encode": http.StatusOK,
+		"/codec/decode":     http.StatusNotFound,
+		"/lps/v2/codec":     http.StatusNotFound,
+	} {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodPost, path, nil))
+		assert.Equal(t, want, responseRecorder.Code, path)
+	}
+	// paths are relative to /codec
+	assert.ElementsMatch(t, []string{"/decode", "/encode"}, paths)
+
+	// the Temporal Web UI may send the namespace header from other origins
+	request := httptest.NewRequest(http.MethodOptions, "/lps/codec/decode", nil)
+	request.Header.Set("Origin", "https://ui.example.com")
+	request.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	request.Header.Set("Access-Control-Request-Headers", "content-type,x-namespace")
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, http.StatusNoContent, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Header().Get("Access-Control-Allow-Headers"), "X-Namespace")
+	assert.Len(t, paths, 2)
+}
+
+func TestWithRequestLogging(t *testing.T) {
+	logger := &recordingLogger{}
+	reject := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	handler := NewHttpHandlerWithOptions(&memory.Driver{}, WithLogger(logger), WithRequestLogging(), WithMiddleware(reject))
+
+	data := []byte("hello world")
+	request := newPutRequestV2(data, len(data))
+	request.Header.Set("Authorization", "Bearer token")
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusCreated, responseRecorder.Code)
+	putResponseBytes := int64(responseRecorder.Body.Len())
+	var putResponse storage.PutResponse
+	require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &putResponse))
+
+	request = httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key="+url.QueryEscape(putResponse.Key), nil)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Authorization", "Bearer token")
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodHead, "/v2/health/head", nil))
+	require.Equal(t, http.StatusUnauthorized, responseRecorder.Code)
+
+	require.Len(t, logger.lines, 3)
+	for _, line := range logger.lines {
+		require.Equal(t, "request", line["msg"])
+		require.IsType(t, time.Duration(0), line["duration"])
+		delete(line, "duration")
+	}
+	assert.Equal(t, []map[string]interface{}{
+		{
+			"msg":           "request",
+			"method":        http.MethodPut,
+			"path":          "/v2/blobs/put",
+			"namespace":     "test",
+			"status":        http.StatusCreated,
+			"requestBytes":  int64(len(data)),
+			"responseBytes": putResponseBytes,
+		},
+		{
+			"msg":           "request",
+			"method":        http.MethodGet,
+			"path":          "/v2/blobs/get",
+			"namespace":     "test",
+			"status":        http.StatusOK,
+			"requestBytes":  int64(0),
+			"responseBytes": int64(len(data)),
+		},
+		{
+			"msg":           "request",
+			"method":        http.MethodHead,
+			"path":          "/v2/health/head",
+			"namespace":     "",
+			"status":        http.StatusUnauthorized,
+			"requestBytes":  int64(0),
+			"responseBytes": int64(0),
+		},
+	}, logger.lines)
+}
+
+// existingDriver is a driver reporting every blob to exist with an unknown size.
+type existingDriver struct {
+	memory.Driver
+}
+
+func (d *existingDriver) ExistPayload(context.Context, *storage.ExistRequest) (*storage.ExistResponse, error) {
+	return &storage.ExistResponse{Exists: true}, nil
+}
+
+// partialDriver is a driver failing after writing part of a blob.
+type partialDriver struct {
+	existingDriver
+}
+
+func (d *partialDriver) GetPayload(_ context.Context, r *storage.GetRequest) (*storage.GetResponse, error) {
+	_, _ = r.Writer.Write([]byte("hello"))
+	return nil, fmt.Errorf("connection reset")
+}
+
+func TestGetBlobV2ErrorAfterData(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key=/blobs/test/abc", nil)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(&partialDriver{}).ServeHTTP(responseRecorder, request)
+
+	// the error is not appended to the data sent already
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "hello", responseRecorder.Body.String())
+}
+
+// corruptingDriver is a driver sending blobs whose first byte was altered.
+type corruptingDriver struct {
+	memory.Driver
+}
+
+func (d *corruptingDriver) GetPayload(ctx context.Context, r *storage.GetRequest) (*storage.GetResponse, error) {
+	var buf bytes.Buffer
+	resp, err := d.Driver.GetPayload(ctx, &storage.GetRequest{Key: r.Key, Writer: &buf})
+	if err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	data[0]++
+	_, err = r.Writer.Write(data)
+	return resp, err
+}
+
+func TestGetBlobV2DigestVerification(t *testing.T) {
+	testPayloadBytes := []byte(`{"hello":"world"}`)
+	sum := sha256.Sum256(testPayloadBytes)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	key := fmt.Sprintf("/blobs/test/common/%s/sha256:abcd", digest)
+
+	testCase := []struct {
+		name         string
+		corrupt      bool
+		trailers     bool
+		gzip         bool
+		opts         []Option
+		wantVerified string
+		wantLogged   bool
+	}{
+		{name: "Verified", trailers: true, wantVerified: "true"},
+		{name: "Verified with compression", trailers: true, gzip: true, wantVerified: "true"},
+		{name: "Mismatch", corrupt: true, trailers: true, wantVerified: "false", wantLogged: true},
+		{name: "Mismatch without trailers", corrupt: true, wantLogged: true},
+		{name: "Trailers not accepted"},
+		{name: "Verification disabled", corrupt: true, trailers: true, opts: []Option{WithoutDigestVerification()}},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			driver := &corruptingDriver{}
+			_, err := driver.PutPayload(context.Background(), &storage.PutRequest{
+				Data:          bytes.NewReader(testPayloadBytes),
+				Key:           key,
+				Digest:        digest,
+				ContentLength: uint64(len(testPayloadBytes)),
+			})
+			require.NoError(t, err)
+			var storageDriver storage.Driver = &driver.Driver
+			if scenario.corrupt {
+				storageDriver = driver
+			}
+
+			request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get", nil)
+			request.Header.Set("Content-Type", "application/octet-stream")
+			request.Header.Set("X-Payload-Expected-Content-Length", strconv.Itoa(len(testPayloadBytes)))
+			if scenario.trailers {
+				request.Header.Set("TE", "trailers")
+			}
+			if scenario.gzip {
+				request.Header.Set("Accept-Encoding", "gzip")
+				request.Header.Set("X-Payload-Encoding", "json/plain")
+			}
+			q := request.URL.Query()
+			q.Add("key", key)
+			request.URL.RawQuery = q.Encode()
+
+			logger := &errorLogger{}
+			responseRecorder := httptest.NewRecorder()
+			opts := append([]Option{WithLogger(logger)}, scenario.opts...)
+			NewHttpHandlerWithOptions(storageDriver, opts...).ServeHTTP(responseRecorder, request)
+			require.Equal(t, http.StatusOK, responseRecorder.Code)
+
+			response := responseRecorder.Result()
+			assert.Equal(t, scenario.wantVerified, response.Trailer.Get("X-Payload-Digest-Verified"))
+			if scenario.wantVerified != "" {
+				// trailers require chunked encoding
+				assert.Empty(t, response.Header.Get("Content-Length"))
+			} else {
+				assert.Equal(t, strconv.Itoa(len(testPayloadBytes)), response.Header.Get("Content-Length"))
+			}
+			if scenario.gzip {
+				// the digest is verified against the uncompressed data
+				assert.Equal(t, "gzip", response.Header.Get("Content-Encoding"))
+				r, err := gzip.NewReader(response.Body)
+				require.NoError(t, err)
+				body, err := io.ReadAll(r)
+				require.NoError(t, err)
+				assert.Equal(t, testPayloadBytes, body)
+			}
+			if scenario.wantLogged {
+				require.Len(t, logger.lines, 1)
+				assert.Equal(t, "stored blob does not match its digest", logger.lines[0]["msg"])
+				assert.Equal(t, key, logger.lines[0]["key"])
+			} else {
+				assert.Empty(t, logger.lines)
+			}
+		})
+	}
+}
+
+// panickingDriver is a driver panicking on get, optionally after writing part of the blob.
+type panickingDriver struct {
+	existingDriver
+	partial bool
+}
+
+func (d *panickingDriver) GetPayload(_ context.Context, r *storage.GetRequest) (*storage.GetResponse, error) {
+	if d.partial {
+		_, _ = r.Writer.Write([]byte("hello"))
+	}
+	panic("not implemented")
+}
+
+// errorLogger records the messages and key-value pairs logged at error level.
+type errorLogger struct {
+	logging.NoopLogger
+	lines []map[string]interface{}
+}
+
+func (l *errorLogger) Error(msg string, keyvals ...interface{}) {
+	l.lines = append(l.lines, logLine(msg, keyvals))
+}
+
+func TestPanicRecovery(t *testing.T) {
+	newRequest := func() *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key=/blobs/test/abc", nil)
+		request.Header.Set("Content-Type", "application/octet-stream")
+		return request
+	}
+
+	logger := &errorLogger{}
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandlerWithLogger(&panickingDriver{}, logger).ServeHTTP(responseRecorder, newRequest())
+	require.Equal(t, http.StatusInternalServerError, responseRecorder.Code)
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, errorBody(v2.ErrorCodeInternal, "internal server error"), responseRecorder.Body.String())
+	require.Len(t, logger.lines, 1)
+	assert.Equal(t, "panic serving request", logger.lines[0]["msg"])
+	assert.Equal(t, "not implemented", logger.lines[0]["panic"])
+	assert.Contains(t, logger.lines[0]["stack"], "panickingDriver")
+
+	// responses which were started already are aborted
+	responseRecorder = httptest.NewRecorder()
+	handler := NewHttpHandlerWithLogger(&panickingDriver{partial: true}, logging.NewNoopLogger())
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(responseRecorder, newRequest())
+	})
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "hello", responseRecorder.Body.String())
+
+	handler = NewHttpHandlerWithOptions(&panickingDriver{}, WithoutPanicRecovery())
+	assert.PanicsWithValue(t, "not implemented", func() {
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest())
+	})
+}
+
+// validatingDriver is a driver counting its validations, which fail with err if set.
+type validatingDriver struct {
+	memory.Driver
+	validations int
+	err         error
+}
+
+func (d *validatingDriver) Validate(_ context.Context) error {
+	d.validations++
+	return d.err
+}
+
+func TestReadinessV2(t *testing.T) {
+	ready := func(handler http.Handler) *httptest.ResponseRecorder {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/health/ready", nil))
+		return responseRecorder
+	}
+
+	// drivers which cannot be validated are always ready
+	require.Equal(t, http.StatusOK, ready(NewHttpHandler(&memory.Driver{})).Code)
+
+	driver := &validatingDriver{}
+	var transitions []error
+	handler := NewHttpHandlerWithOptions(driver,
+		WithReadinessCacheTTL(-1),
+		WithReadinessObserver(func(err error) { transitions = append(transitions, err) }),
+	)
+	require.Equal(t, http.StatusOK, ready(handler).Code)
+	require.Equal(t, http.StatusOK, ready(handler).Code)
+
+	driver.err = errors.New("expired credentials")
+	response := ready(handler)
+	require.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeStorageUnavailable, "storage driver is not ready"), response.Body.String())
+	// results are not cached, so the driver may be ready again at any time
+	assert.Equal(t, "1", response.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusServiceUnavailable, ready(handler).Code)
+
+	driver.err = nil
+	require.Equal(t, http.StatusOK, ready(handler).Code)
+	assert.Equal(t, 5, driver.validations)
+	assert.Equal(t, []error{nil, errors.New("expired credentials"), nil}, transitions)
+
+	// results are cached
+	driver = &validatingDriver{}
+	handler = NewHttpHandlerWithOptions(driver, WithReadinessCacheTTL(time.Hour))
+	require.Equal(t, http.StatusOK, ready(handler).Code)
+	driver.err = errors.New("expired credentials")
+	require.Equal(t, http.StatusOK, ready(handler).Code)
+	assert.Equal(t, 1, driver.validations)
+
+	// clients are asked to retry once a cached failure expires
+	driver = &validatingDriver{err: errors.New("expired credentials")}
+	handler = NewHttpHandlerWithOptions(driver, WithReadinessCacheTTL(30*time.Second))
+	response = ready(handler)
+	require.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Equal(t, "30", response.Header().Get("Retry-After"))
+
+	// the liveness check does not validate the driver
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(driver).ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodHead, "/v2/health/head", nil))
+	require.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, 1, driver.validations)
+}
+
+// undescribedDriver is a driver which does not implement storage.Describer.
+type undescribedDriver struct {
+	storage.Driver
+}
+
+func TestInfoV2(t *testing.T) {
+	info := func(handler http.Handler) map[string]interface{} {
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/v2/health/info", nil))
+		require.Equal(t, http.StatusOK, responseRecorder.Code)
+		require.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &body))
+		return body
+	}
+
+	// drivers which cannot be validated have no validation
+	body := info(NewHttpHandler(&memory.Driver{}))
+	assert.Equal(t, map[string]interface{}{"name": "memory"}, body["driver"])
+	assert.NotEmpty(t, body["version"])
+	assert.Equal(t, float64(0), body["uptimeSeconds"])
+	assert.NotContains(t, body, "validation")
+
+	body = info(NewHttpHandler(&undescribedDriver{Driver: &memory.Driver{}}))
+	assert.Equal(t, map[string]interface{}{"name": "*server.undescribedDriver"}, body["driver"])
+
+	driver := &validatingDriver{}
+	handler := NewHttpHandlerWithOptions(driver, WithReadinessCacheTTL(time.Hour))
+	validation := info(handler)["validation"].(map[string]interface{})
+	assert.Equal(t, true, validation["ready"])
+	assert.NotContains(t, validation, "error")
+	assert.Contains(t, validation, "latencyMs")
+	checkedAt, err := time.Parse(time.RFC3339Nano, validation["checkedAt"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), checkedAt, time.Minute)
+
+	// the result of the last validation is reused
+	driver.err = errors.New("expired credentials for bucket secret-bucket")
+	info(handler)
+	assert.Equal(t, 1, driver.validations)
+
+	// validation errors are not exposed
+	handler = NewHttpHandlerWithOptions(driver, WithReadinessCacheTTL(-1))
+	validation = info(handler)["validation"].(map[string]interface{})
+	assert.Equal(t, false, validation["ready"])
+	assert.Equal(t, "storage driver is not ready", validation["error"])
+
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodPost, "/v2/health/info", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Code)
+}
+
+// errorBody returns the body of an error response with the given code and message.
+func errorBody(code v2.ErrorCode, message string) string {
+	body, _ := json.Marshal(v2.ErrorResponse{Code: code, Message: message})
+	return string(body)
+}
+
+// failingDriver is a driver whose lookups fail with err.
+type failingDriver struct {
+	memory.Driver
+	err error
+}
+
+func (d *failingDriver) ExistPayload(_ context.Context, _ *storage.ExistRequest) (*storage.ExistResponse, error) {
+	return nil, d.err
+}
+
+func TestErrorResponsesV2(t *testing.T) {
+	driver := &failingDriver{err: errors.New("bucket 'secret' is unreachable")}
+	newRequest := func() *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "/v2/blobs/get?key=/blobs/test/abc", nil)
+		request.Header.Set("Content-Type", "application/octet-stream")
+		return request
+	}
+
+	// the details of storage errors are logged, but not sent
+	logger := &errorLogger{}
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandlerWithLogger(driver, logger).ServeHTTP(responseRecorder, newRequest())
+	require.Equal(t, http.StatusInternalServerError, responseRecorder.Code)
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, errorBody(v2.ErrorCodeStorageError, "internal storage error"), responseRecorder.Body.String())
+	require.Len(t, logger.lines, 1)
+	assert.Equal(t, "bucket 'secret' is unreachable", logger.lines[0]["msg"])
+
+	// errors are sent as plain text in the legacy mode
+	responseRecorder = httptest.NewRecorder()
+	NewHttpHandlerWithOptions(driver, WithPlainTextErrors()).ServeHTTP(responseRecorder, newRequest())
+	require.Equal(t, http.StatusInternalServerError, responseRecorder.Code)
+	assert.NotEqual(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "bucket 'secret' is unreachable", responseRecorder.Body.String())
+
+	responseRecorder = httptest.NewRecorder()
+	NewHttpHandlerWithOptions(driver, WithPlainTextErrors()).ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodPut, "/v2/blobs/get", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Code)
+	assert.Empty(t, responseRecorder.Body.String())
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 )
 
@@ -23,6 +24,11 @@ type Config struct {
 	ServiceURL string
 }
 
+var _ storage.Lister = &Driver{}
+var _ storage.PrefixDeleter = &Driver{}
+var _ storage.Describer = &Driver{}
+var _ storage.Inspector = &Driver{}
+
 type Driver struct {
 	client    *azblob.Client
 	container string
@@ -62,8 +68,33 @@ func (d *Driver) GetPayload(ctx context.Context, r *storage.GetRequest) (*storag
 	}, nil
 }
 
+func (d *Driver) GetPayloadRange(ctx context.Context, r *storage.GetRangeRequest) (*storage.GetResponse, error) {
+	resp, err := d.client.DownloadStream(ctx, d.container, r.Key, &azblob.DownloadStreamOptions{
+		Range: azblob.HTTPRange{Offset: int64(r.Offset)},
+	})
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, &storage.ErrBlobNotFound{Err: err}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	numBytes, err := io.Copy(r.Writer, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.GetResponse{
+		ContentLength: uint64(numBytes),
+	}, nil
+}
+
 func (d *Driver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
-	_, err := d.client.UploadStream(ctx, d.container, r.Key, r.Data, nil)
+	opts := &azblob.UploadStreamOptions{Metadata: toAzureMetadata(storage.ObjectMetadata(r))}
+	if r.ContentType != "" {
+		opts.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: &r.ContentType}
+	}
+	_, err := d.client.UploadStream(ctx, d.container, r.Key, r.Data, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -74,21 +105,65 @@ func (d *Driver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storag
 }
 
 func (d *Driver) ExistPayload(ctx context.Context, r *storage.ExistRequest) (*storage.ExistResponse, error) {
-	exists := true
-	_, err := d.client.ServiceClient().NewContainerClient(d.container).NewBlobClient(r.Key).GetProperties(ctx, nil)
+	props, err := d.client.ServiceClient().NewContainerClient(d.container).NewBlobClient(r.Key).GetProperties(ctx, nil)
 	if err != nil {
 		if bloberror.HasCode(err, bloberror.BlobNotFound) {
-			exists = false
-		} else {
-			return nil, err
+			return &storage.ExistResponse{Exists: false}, nil
 		}
+		return nil, err
 	}
 
+	var contentLength uint64
+	if props.ContentLength != nil {
+		contentLength = uint64(*props.ContentLength)
+	}
 	return &storage.ExistResponse{
-		Exists: exists,
+		Exists:        true,
+		ContentLength: contentLength,
+		ExpiresAt:     storage.ParseExpiry(fromAzureMetadata(props.Metadata)),
 	}, nil
 }
 
+func (d *Driver) HeadPayload(ctx context.Context, r *storage.HeadRequest) (*storage.HeadResponse, error) {
+	props, err := d.client.ServiceClient().NewContainerClient(d.container).NewBlobClient(r.Key).GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, &storage.ErrBlobNotFound{Err: err}
+		}
+		return nil, err
+	}
+
+	var contentLength uint64
+	if props.ContentLength != nil {
+		contentLength = uint64(*props.ContentLength)
+	}
+	return storage.HeadResponseFromMetadata(contentLength, fromAzureMetadata(props.Metadata)), nil
+}
+
+// toAzureMetadata returns object metadata in the format of the Azure SDK.
+func toAzureMetadata(metadata map[string]string) map[string]*string {
+	if metadata == nil {
+		return nil
+	}
+	azureMetadata := make(map[string]*string, len(metadata))
+	for key, value := range metadata {
+		value := value
+		azureMetadata[key] = &value
+	}
+	return azureMetadata
+}
+
+// fromAzureMetadata returns object metadata in the format of the Azure SDK as a plain map.
+func fromAzureMetadata(azureMetadata map[string]*string) map[string]string {
+	metadata := make(map[string]string, len(azureMetadata))
+	for key, value := range azureMetadata {
+		if value != nil {
+			metadata[key] = *value
+		}
+	}
+	return metadata
+}
+
 func (d *Driver) DeletePayload(ctx context.Context, r *storage.DeleteRequest) (*storage.DeleteResponse, error) {
 	_, err := d.client.DeleteBlob(ctx, d.container, r.Key, nil)
 	if err != nil {
@@ -98,6 +173,83 @@ func (d *Driver) DeletePayload(ctx context.Context, r *storage.DeleteRequest) (*
 	return &storage.DeleteResponse{}, nil
 }
 
+// ListPayloads lists blobs with a flat listing, whose marker is the cursor.
+func (d *Driver) ListPayloads(ctx context.Context, r *storage.ListRequest) (*storage.ListResponse, error) {
+	options := &azblob.ListBlobsFlatOptions{
+		Prefix:  &r.Prefix,
+		Include: azblob.ListBlobsInclude{Metadata: r.IncludeExpiry},
+	}
+	if r.Limit > 0 {
+		limit := int32(r.Limit)
+		options.MaxResults = &limit
+	}
+	if r.Cursor != "" {
+		options.Marker = &r.Cursor
+	}
+	page, err := d.client.NewListBlobsFlatPager(d.container, options).NextPage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &storage.ListResponse{}
+	if page.Segment != nil {
+		for _, item := range page.Segment.BlobItems {
+			info := storage.BlobInfo{Key: *item.Name}
+			if r.IncludeExpiry {
+				info.ExpiresAt = storage.ParseExpiry(fromAzureMetadata(item.Metadata))
+			}
+			if item.Properties != nil {
+				if item.Properties.ContentLength != nil {
+					info.ContentLength = uint64(*item.Properties.ContentLength)
+				}
+				if item.Properties.LastModified != nil {
+					info.LastModified = *item.Properties.LastModified
+				}
+			}
+			response.Blobs = append(response.Blobs, info)
+		}
+	}
+	if page.NextMarker != nil {
+		response.NextCursor = *page.NextMarker
+	}
+	return response, nil
+}
+
+// DeleteByPrefix deletes the blobs whose keys start with the prefix one at a time, page by
+// page of a flat listing.
+func (d *Driver) DeleteByPrefix(ctx context.Context, r *storage.DeleteByPrefixRequest) (*storage.DeleteByPrefixResponse, error) {
+	response := &storage.DeleteByPrefixResponse{}
+	pager := d.client.NewListBlobsFlatPager(d.container, &azblob.ListBlobsFlatOptions{Prefix: &r.Prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if page.Segment == nil {
+			continue
+		}
+		for _, item := range page.Segment.BlobItems {
+			if _, err := d.client.DeleteBlob(ctx, d.container, *item.Name, nil); err != nil {
+				if bloberror.HasCode(err, bloberror.BlobNotFound) {
+					// deleted concurrently
+					continue
+				}
+				return nil, err
+			}
+			response.Deleted++
+		}
+		if r.Progress != nil {
+			r.Progress(response.Deleted)
+		}
+	}
+	return response, nil
+}
+
+// Describe returns the name of the container used by the driver.
+func (d *Driver) Describe() storage.Description {
+	return storage.Description{Name: "azure", Config: map[string]string{"container": d.container}}
+}
+
 func (d *Driver) Validate(ctx context.Context) error {
 	_, err := d.client.ServiceClient().NewContainerClient(d.container).GetProperties(ctx, nil)
 	if err != nil {
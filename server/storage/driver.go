@@ -6,10 +6,17 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
+// ErrNotSupported is wrapped by the errors of drivers implementing an optional interface for
+// operations which they cannot perform for a blob, e.g. a router.Driver for blobs stored by a
+// driver which does not implement the interface.
+var ErrNotSupported = errors.New("operation not supported by the storage driver")
+
 type ErrBlobNotFound struct {
 	Err error
 }
@@ -29,11 +36,82 @@ type Validatable interface {
 	Validate(context.Context) error
 }
 
+// Describer is implemented by drivers which are able to describe themselves, allowing
+// operators to tell which object store a server uses.
+type Describer interface {
+	Describe() Description
+}
+
+// Description identifies a driver and the object store it uses.
+type Description struct {
+	// Name is the name of the driver, e.g. s3.
+	Name string
+	// Config is the non-sensitive configuration of the driver, such as the name of its bucket.
+	// It must not include credentials or endpoints.
+	Config map[string]string
+}
+
+// Presigner is implemented by drivers which are able to issue presigned URLs, allowing
+// clients to transfer blobs directly to and from the backing object store.
+type Presigner interface {
+	PresignPut(context.Context, *PresignPutRequest) (*PresignResponse, error)
+	PresignGet(context.Context, *PresignGetRequest) (*PresignResponse, error)
+}
+
+// RangeGetter is implemented by drivers which are able to read a blob starting at an offset,
+// allowing clients to resume interrupted downloads.
+type RangeGetter interface {
+	GetPayloadRange(context.Context, *GetRangeRequest) (*GetResponse, error)
+}
+
+// MultipartUploader is implemented by drivers which are able to assemble a blob from parts
+// uploaded separately, allowing clients to upload blobs in chunks.
+type MultipartUploader interface {
+	CreateMultipartUpload(context.Context, *CreateMultipartUploadRequest) (*CreateMultipartUploadResponse, error)
+	UploadPart(context.Context, *UploadPartRequest) (*UploadPartResponse, error)
+	// CompleteMultipartUpload stores the blob assembled from the given parts.
+	CompleteMultipartUpload(context.Context, *CompleteMultipartUploadRequest) (*PutResponse, error)
+	// AbortMultipartUpload discards the parts uploaded so far.
+	AbortMultipartUpload(context.Context, *AbortMultipartUploadRequest) error
+}
+
+// Lister is implemented by drivers which are able to list the stored blobs, allowing operators
+// to inspect the blobs of a namespace.
+type Lister interface {
+	// ListPayloads returns the blobs whose keys start with a prefix in the lexicographic order
+	// of their keys, one page at a time.
+	ListPayloads(context.Context, *ListRequest) (*ListResponse, error)
+}
+
+// PrefixDeleter is implemented by drivers which are able to delete all blobs whose keys start
+// with a prefix, allowing operators to wipe the blobs of a decommissioned namespace.
+type PrefixDeleter interface {
+	// DeleteByPrefix deletes the blobs whose keys start with a prefix, in batches.
+	DeleteByPrefix(context.Context, *DeleteByPrefixRequest) (*DeleteByPrefixResponse, error)
+}
+
+// Inspector is implemented by drivers which are able to return what was recorded with a stored
+// blob, allowing the server to tell whether an existing blob matches the one being uploaded.
+type Inspector interface {
+	// HeadPayload describes the blob with the given key, or returns an ErrBlobNotFound error if
+	// it does not exist.
+	HeadPayload(context.Context, *HeadRequest) (*HeadResponse, error)
+}
+
 type PutRequest struct {
 	Data          io.Reader
 	Key           string
 	Digest        string
 	ContentLength uint64
+	// ContentType is the informational content type of the blob, if known. Drivers set it on
+	// the stored object, so that blobs can be told apart when inspecting the object store.
+	ContentType string
+	// ExpiresAt is the time after which the blob may be deleted, or zero if it never expires.
+	// Drivers record it with the stored object, see ExpiryMetadataKey.
+	ExpiresAt time.Time
+	// Metadata is the Temporal metadata of the payload stored in the blob, if known. Drivers
+	// record it with the stored object, see PayloadMetadata.
+	Metadata map[string][]byte
 }
 
 type PutResponse struct {
@@ -46,6 +124,13 @@ type GetRequest struct {
 	Writer io.Writer
 }
 
+type GetRangeRequest struct {
+	Key    string
+	Writer io.Writer
+	// Offset is the number of bytes skipped at the start of the blob.
+	Offset uint64
+}
+
 type GetResponse struct {
 	ContentLength uint64
 }
@@ -56,6 +141,26 @@ type ExistRequest struct {
 
 type ExistResponse struct {
 	Exists bool
+	// ContentLength is the size of the blob in bytes if it exists, or zero if the driver
+	// cannot tell.
+	ContentLength uint64
+	// ExpiresAt is the time after which the blob may be deleted, or zero if it never expires.
+	ExpiresAt time.Time
+}
+
+type HeadRequest struct {
+	Key string
+}
+
+type HeadResponse struct {
+	// ContentLength is the size of the blob in bytes.
+	ContentLength uint64
+	// Digest is the digest the blob was stored with, or empty if none was recorded, e.g. for
+	// blobs uploaded with presigned URLs, see DigestMetadataKey.
+	Digest string
+	// Metadata is the Temporal metadata recorded with the blob, as returned by
+	// RestorePayloadMetadata, or nil if none was recorded.
+	Metadata map[string][]byte
 }
 
 type DeleteRequest struct {
@@ -64,3 +169,127 @@ type DeleteRequest struct {
 
 type DeleteResponse struct {
 }
+
+type ListRequest struct {
+	// Prefix selects the blobs whose keys start with it.
+	Prefix string
+	// Limit is the maximum number of blobs returned. Drivers may return fewer blobs even if
+	// more blobs remain.
+	Limit int
+	// Cursor is the NextCursor of the previous page, or empty for the first page.
+	Cursor string
+	// IncludeExpiry fills the ExpiresAt of the listed blobs, which takes a request per blob
+	// with some drivers.
+	IncludeExpiry bool
+}
+
+type DeleteByPrefixRequest struct {
+	// Prefix selects the blobs whose keys start with it.
+	Prefix string
+	// Progress is called with the number of blobs deleted so far after each batch, if set.
+	Progress func(deleted int)
+}
+
+type DeleteByPrefixResponse struct {
+	// Deleted is the number of deleted blobs.
+	Deleted int
+}
+
+type ListResponse struct {
+	Blobs []BlobInfo
+	// NextCursor continues the listing with the next page, or is empty if there are no more
+	// blobs. Its format depends on the driver.
+	NextCursor string
+}
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key           string
+	ContentLength uint64
+	LastModified  time.Time
+	// ExpiresAt is the time after which the blob may be deleted, or zero if it never expires.
+	// It is only set if ListRequest.IncludeExpiry is.
+	ExpiresAt time.Time
+}
+
+type PresignPutRequest struct {
+	Key           string
+	Digest        string
+	ContentLength uint64
+	// ContentType is the informational content type of the blob, if known, see PutRequest.
+	// Drivers sign it, so that uploads must set it.
+	ContentType string
+	// ExpiresAt is the time after which the blob may be deleted, or zero if it never expires.
+	// Drivers sign it as object metadata along with the digest and Metadata, see
+	// ObjectMetadata, so that uploads must record them.
+	ExpiresAt time.Time
+	// Metadata is the Temporal metadata of the payload stored in the blob, if known, see
+	// PutRequest.
+	Metadata map[string][]byte
+	// Expires is the duration for which the presigned URL is valid.
+	Expires time.Duration
+}
+
+type PresignGetRequest struct {
+	Key string
+	// Expires is the duration for which the presigned URL is valid.
+	Expires time.Duration
+}
+
+type PresignResponse struct {
+	// URL is the presigned URL of the blob.
+	URL string
+	// Method is the HTTP method to use with URL.
+	Method string
+	// Header contains the headers which were signed and must be sent along with the request.
+	Header map[string][]string
+}
+
+type CreateMultipartUploadRequest struct {
+	Key string
+	// ContentType is the informational content type of the blob, if known.
+	ContentType string
+	// ExpiresAt is the time after which the blob may be deleted, or zero if it never expires,
+	// see PutRequest.
+	ExpiresAt time.Time
+	// Metadata is the Temporal metadata of the payload stored in the blob, if known, see
+	// PutRequest.
+	Metadata map[string][]byte
+}
+
+type CreateMultipartUploadResponse struct {
+	// UploadID identifies the upload in the requests for its parts.
+	UploadID string
+}
+
+type UploadPartRequest struct {
+	Key      string
+	UploadID string
+	// PartNumber is the position of the part in the blob, counting from 1. Uploading a part
+	// with the same number again replaces it.
+	PartNumber    int
+	Data          io.Reader
+	ContentLength uint64
+}
+
+type UploadPartResponse struct {
+	// ETag identifies the uploaded data of the part when completing the upload.
+	ETag string
+}
+
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type CompleteMultipartUploadRequest struct {
+	Key      string
+	UploadID string
+	// Parts are the parts of the blob in ascending order of their numbers.
+	Parts []CompletedPart
+}
+
+type AbortMultipartUploadRequest struct {
+	Key      string
+	UploadID string
+}
@@ -0,0 +1,39 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// ExpiryMetadataKey is the key of the object metadata in which drivers record the expiry of a
+// blob as an RFC 3339 timestamp. It is a valid metadata key with all object stores.
+const ExpiryMetadataKey = "lps_expires_at"
+
+// ParseExpiry returns the expiry recorded in the given object metadata, whose keys are matched
+// case-insensitively since some object stores change their case. It returns the zero time if
+// no valid expiry is recorded, so that such blobs never expire.
+func ParseExpiry(metadata map[string]string) time.Time {
+	for key, value := range metadata {
+		if strings.EqualFold(key, ExpiryMetadataKey) {
+			expiresAt, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return time.Time{}
+			}
+			return expiresAt
+		}
+	}
+	return time.Time{}
+}
+
+// ExpiryMetadata returns the object metadata recording that a blob expires at expiresAt, or
+// nil if it never expires.
+func ExpiryMetadata(expiresAt time.Time) map[string]string {
+	if expiresAt.IsZero() {
+		return nil
+	}
+	return map[string]string{ExpiryMetadataKey: expiresAt.UTC().Format(time.RFC3339)}
+}
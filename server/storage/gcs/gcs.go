@@ -10,12 +10,26 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"time"
 
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 
 	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 )
 
+var _ storage.Presigner = &Driver{}
+var _ storage.RangeGetter = &Driver{}
+var _ storage.Lister = &Driver{}
+var _ storage.PrefixDeleter = &Driver{}
+var _ storage.Describer = &Driver{}
+var _ storage.Inspector = &Driver{}
+
+// prefixDeletionBatch is the number of blobs deleted by DeleteByPrefix between two calls of
+// its progress function.
+const prefixDeletionBatch = 1000
+
 type Driver struct {
 	client *gcs.Client
 	bucket string
@@ -56,11 +70,37 @@ func (d *Driver) GetPayload(ctx context.Context, r *storage.GetRequest) (*storag
 	}, nil
 }
 
+func (d *Driver) GetPayloadRange(ctx context.Context, r *storage.GetRangeRequest) (*storage.GetResponse, error) {
+	reader, err := d.client.Bucket(d.bucket).Object(r.Key).NewRangeReader(ctx, int64(r.Offset), -1)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return nil, &storage.ErrBlobNotFound{Err: err}
+		}
+		return nil, err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Printf("unable to close bucket reader: %v", err)
+		}
+	}()
+
+	numBytes, err := io.Copy(r.Writer, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.GetResponse{
+		ContentLength: uint64(numBytes),
+	}, nil
+}
+
 func (d *Driver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
 	o := d.client.Bucket(d.bucket).Object(r.Key)
 
 	// Upload an object with storage.Writer.
 	wc := o.NewWriter(ctx)
+	wc.ContentType = r.ContentType
+	wc.Metadata = storage.ObjectMetadata(r)
 
 	if _, err := io.Copy(wc, r.Data); err != nil {
 		return nil, fmt.Errorf("io.Copy: %v", err)
@@ -76,21 +116,33 @@ func (d *Driver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storag
 func (d *Driver) ExistPayload(ctx context.Context, r *storage.ExistRequest) (*storage.ExistResponse, error) {
 	o := d.client.Bucket(d.bucket).Object(r.Key)
 
-	exists := true
-	_, err := o.Attrs(ctx)
+	attrs, err := o.Attrs(ctx)
 	if err != nil {
 		if errors.Is(err, gcs.ErrObjectNotExist) {
-			exists = false
-		} else {
-			return nil, err
+			return &storage.ExistResponse{Exists: false}, nil
 		}
+		return nil, err
 	}
 
 	return &storage.ExistResponse{
-		Exists: exists,
+		Exists:        true,
+		ContentLength: uint64(attrs.Size),
+		ExpiresAt:     storage.ParseExpiry(attrs.Metadata),
 	}, nil
 }
 
+func (d *Driver) HeadPayload(ctx context.Context, r *storage.HeadRequest) (*storage.HeadResponse, error) {
+	attrs, err := d.client.Bucket(d.bucket).Object(r.Key).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return nil, &storage.ErrBlobNotFound{Err: err}
+		}
+		return nil, err
+	}
+
+	return storage.HeadResponseFromMetadata(uint64(attrs.Size), attrs.Metadata), nil
+}
+
 func (d *Driver) DeletePayload(ctx context.Context, request *storage.DeleteRequest) (*storage.DeleteResponse, error) {
 	o := d.client.Bucket(d.bucket).Object(request.Key)
 	if err := o.Delete(ctx); err != nil {
@@ -100,6 +152,119 @@ func (d *Driver) DeletePayload(ctx context.Context, request *storage.DeleteReque
 	return &storage.DeleteResponse{}, nil
 }
 
+// ListPayloads lists blobs with the objects iterator, whose page token is the cursor.
+func (d *Driver) ListPayloads(ctx context.Context, r *storage.ListRequest) (*storage.ListResponse, error) {
+	it := d.client.Bucket(d.bucket).Objects(ctx, &gcs.Query{Prefix: r.Prefix})
+	limit := r.Limit
+	if limit <= 0 {
+		// the default page size of the other object stores
+		limit = 1000
+	}
+	var objects []*gcs.ObjectAttrs
+	nextCursor, err := iterator.NewPager(it, limit, r.Cursor).NextPage(&objects)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &storage.ListResponse{NextCursor: nextCursor}
+	for _, object := range objects {
+		info := storage.BlobInfo{
+			Key:           object.Name,
+			ContentLength: uint64(object.Size),
+			LastModified:  object.Updated,
+		}
+		if r.IncludeExpiry {
+			info.ExpiresAt = storage.ParseExpiry(object.Metadata)
+		}
+		response.Blobs = append(response.Blobs, info)
+	}
+	return response, nil
+}
+
+// DeleteByPrefix deletes the blobs whose keys start with the prefix one at a time while
+// iterating over them, since Cloud Storage does not delete objects in batches.
+func (d *Driver) DeleteByPrefix(ctx context.Context, r *storage.DeleteByPrefixRequest) (*storage.DeleteByPrefixResponse, error) {
+	bucket := d.client.Bucket(d.bucket)
+	it := bucket.Objects(ctx, &gcs.Query{Prefix: r.Prefix})
+	response := &storage.DeleteByPrefixResponse{}
+	for {
+		object, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := bucket.Object(object.Name).Delete(ctx); err != nil {
+			if errors.Is(err, gcs.ErrObjectNotExist) {
+				// deleted concurrently
+				continue
+			}
+			return nil, err
+		}
+		response.Deleted++
+		if r.Progress != nil && response.Deleted%prefixDeletionBatch == 0 {
+			r.Progress(response.Deleted)
+		}
+	}
+	if r.Progress != nil && response.Deleted%prefixDeletionBatch != 0 {
+		r.Progress(response.Deleted)
+	}
+	return response, nil
+}
+
+// PresignPut returns a V4 signed URL for uploading a blob. The size of the upload is limited
+// to the declared length by a signed x-goog-content-length-range header, and its content type
+// and object metadata are signed as well.
+func (d *Driver) PresignPut(_ context.Context, r *storage.PresignPutRequest) (*storage.PresignResponse, error) {
+	lengthRange := fmt.Sprintf("0,%d", r.ContentLength)
+	signed := []string{"x-goog-content-length-range:" + lengthRange}
+	header := map[string][]string{"X-Goog-Content-Length-Range": {lengthRange}}
+	for key, value := range storage.PresignedObjectMetadata(r) {
+		signed = append(signed, "x-goog-meta-"+key+":"+value)
+		header["X-Goog-Meta-"+key] = []string{value}
+	}
+	if r.ContentType != "" {
+		header["Content-Type"] = []string{r.ContentType}
+	}
+	url, err := d.client.Bucket(d.bucket).SignedURL(r.Key, &gcs.SignedURLOptions{
+		Scheme:      gcs.SigningSchemeV4,
+		Method:      http.MethodPut,
+		Expires:     time.Now().Add(r.Expires),
+		ContentType: r.ContentType,
+		Headers:     signed,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign URL: %w", err)
+	}
+	return &storage.PresignResponse{
+		URL:    url,
+		Method: http.MethodPut,
+		Header: header,
+	}, nil
+}
+
+// PresignGet returns a V4 signed URL for downloading a blob.
+func (d *Driver) PresignGet(_ context.Context, r *storage.PresignGetRequest) (*storage.PresignResponse, error) {
+	url, err := d.client.Bucket(d.bucket).SignedURL(r.Key, &gcs.SignedURLOptions{
+		Scheme:  gcs.SigningSchemeV4,
+		Method:  http.MethodGet,
+		Expires: time.Now().Add(r.Expires),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign URL: %w", err)
+	}
+	return &storage.PresignResponse{
+		URL:    url,
+		Method: http.MethodGet,
+	}, nil
+}
+
+// Describe returns the name of the bucket used by the driver.
+func (d *Driver) Describe() storage.Description {
+	return storage.Description{Name: "gcs", Config: map[string]string{"bucket": d.bucket}}
+}
+
 func (d *Driver) Validate(ctx context.Context) error {
 	bucketHandle := d.client.Bucket(d.bucket)
 	if _, err := bucketHandle.Attrs(ctx); err != nil {
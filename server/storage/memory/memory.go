@@ -7,33 +7,63 @@ package memory
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 )
 
 var _ storage.Driver = &Driver{}
+var _ storage.RangeGetter = &Driver{}
+var _ storage.MultipartUploader = &Driver{}
+var _ storage.Lister = &Driver{}
+var _ storage.PrefixDeleter = &Driver{}
+var _ storage.Describer = &Driver{}
+var _ storage.Inspector = &Driver{}
 
 type Driver struct {
 	mux sync.RWMutex
 	// Map of blob digests (in the form `sha256:deadbeef`) to data
 	blobs map[string][]byte
+	// Map of blob digests to the time they were stored
+	modified map[string]time.Time
+	// Map of blob digests to the time they expire, for blobs which expire
+	expires map[string]time.Time
+	// Map of blob digests to their Temporal metadata, for blobs stored with metadata
+	metadata map[string]map[string][]byte
+	// Map of blob digests to the digests they were stored with, for blobs stored with a digest
+	digests map[string]string
+	// Map of upload IDs to the buffered parts of multipart uploads
+	uploads    map[string]*upload
+	nextUpload int
 }
 
-func (d *Driver) PutPayload(_ context.Context, request *storage.PutRequest) (*storage.PutResponse, error) {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+// upload is a multipart upload whose parts are buffered until it is completed.
+type upload struct {
+	key       string
+	expiresAt time.Time
+	metadata  map[string][]byte
+	parts     map[int][]byte
+}
 
+func (d *Driver) PutPayload(_ context.Context, request *storage.PutRequest) (*storage.PutResponse, error) {
+	// the data is read before locking, since it may be streamed from another blob of the driver
 	b, err := io.ReadAll(request.Data)
 	if err != nil {
 		return nil, err
 	}
 
-	if d.blobs == nil {
-		d.blobs = make(map[string][]byte)
-	}
-	d.blobs[request.Key] = b
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.store(request.Key, b, request.Digest, request.ExpiresAt, request.Metadata)
 
 	return &storage.PutResponse{
 		Key: request.Key,
@@ -57,14 +87,54 @@ func (d *Driver) GetPayload(_ context.Context, request *storage.GetRequest) (*st
 	return nil, &storage.ErrBlobNotFound{}
 }
 
+func (d *Driver) GetPayloadRange(_ context.Context, request *storage.GetRangeRequest) (*storage.GetResponse, error) {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+
+	if b, ok := d.blobs[request.Key]; ok {
+		if request.Offset > uint64(len(b)) {
+			return nil, fmt.Errorf("offset %d exceeds blob size %d", request.Offset, len(b))
+		}
+		n, err := io.Copy(request.Writer, bytes.NewReader(b[request.Offset:]))
+		if err != nil {
+			return nil, err
+		}
+
+		return &storage.GetResponse{
+			ContentLength: uint64(n),
+		}, nil
+	}
+
+	return nil, &storage.ErrBlobNotFound{}
+}
+
 func (d *Driver) ExistPayload(_ context.Context, request *storage.ExistRequest) (*storage.ExistResponse, error) {
 	d.mux.RLock()
 	defer d.mux.RUnlock()
 
-	_, ok := d.blobs[request.Key]
+	b, ok := d.blobs[request.Key]
 
 	return &storage.ExistResponse{
-		Exists: ok,
+		Exists:        ok,
+		ContentLength: uint64(len(b)),
+		ExpiresAt:     d.expires[request.Key],
+	}, nil
+}
+
+// HeadPayload describes a blob, returning its Temporal metadata as it would be restored from
+// the object metadata of object stores.
+func (d *Driver) HeadPayload(_ context.Context, request *storage.HeadRequest) (*storage.HeadResponse, error) {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+
+	b, ok := d.blobs[request.Key]
+	if !ok {
+		return nil, &storage.ErrBlobNotFound{}
+	}
+	return &storage.HeadResponse{
+		ContentLength: uint64(len(b)),
+		Digest:        d.digests[request.Key],
+		Metadata:      storage.RestorePayloadMetadata(storage.PayloadMetadata(d.metadata[request.Key])),
 	}, nil
 }
 
@@ -73,5 +143,193 @@ func (d *Driver) DeletePayload(_ context.Context, request *storage.DeleteRequest
 	defer d.mux.Unlock()
 
 	delete(d.blobs, request.Key)
+	delete(d.modified, request.Key)
+	delete(d.expires, request.Key)
+	delete(d.metadata, request.Key)
+	delete(d.digests, request.Key)
 	return &storage.DeleteResponse{}, nil
 }
+
+// DeleteByPrefix deletes the blobs whose keys start with the prefix at once.
+func (d *Driver) DeleteByPrefix(_ context.Context, request *storage.DeleteByPrefixRequest) (*storage.DeleteByPrefixResponse, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	deleted := 0
+	for key := range d.blobs {
+		if !strings.HasPrefix(key, request.Prefix) {
+			continue
+		}
+		delete(d.blobs, key)
+		delete(d.modified, key)
+		delete(d.expires, key)
+		delete(d.metadata, key)
+		delete(d.digests, key)
+		deleted++
+	}
+	if request.Progress != nil {
+		request.Progress(deleted)
+	}
+	return &storage.DeleteByPrefixResponse{Deleted: deleted}, nil
+}
+
+func (d *Driver) CreateMultipartUpload(_ context.Context, request *storage.CreateMultipartUploadRequest) (*storage.CreateMultipartUploadResponse, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.uploads == nil {
+		d.uploads = make(map[string]*upload)
+	}
+	d.nextUpload++
+	id := strconv.Itoa(d.nextUpload)
+	d.uploads[id] = &upload{key: request.Key, expiresAt: request.ExpiresAt, metadata: request.Metadata, parts: make(map[int][]byte)}
+
+	return &storage.CreateMultipartUploadResponse{
+		UploadID: id,
+	}, nil
+}
+
+func (d *Driver) UploadPart(_ context.Context, request *storage.UploadPartRequest) (*storage.UploadPartResponse, error) {
+	// the data is read before locking, so that parts can be uploaded concurrently
+	b, err := io.ReadAll(request.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	u, err := d.upload(request.Key, request.UploadID)
+	if err != nil {
+		return nil, err
+	}
+	u.parts[request.PartNumber] = b
+
+	sum := sha256.Sum256(b)
+	return &storage.UploadPartResponse{
+		ETag: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func (d *Driver) CompleteMultipartUpload(_ context.Context, request *storage.CompleteMultipartUploadRequest) (*storage.PutResponse, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	u, err := d.upload(request.Key, request.UploadID)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, part := range request.Parts {
+		b, ok := u.parts[part.PartNumber]
+		sum := sha256.Sum256(b)
+		if !ok || hex.EncodeToString(sum[:]) != part.ETag {
+			return nil, fmt.Errorf("part %d of upload %s was not uploaded", part.PartNumber, request.UploadID)
+		}
+		buf.Write(b)
+	}
+
+	d.store(request.Key, buf.Bytes(), "", u.expiresAt, u.metadata)
+	delete(d.uploads, request.UploadID)
+
+	return &storage.PutResponse{
+		Key: request.Key,
+	}, nil
+}
+
+func (d *Driver) AbortMultipartUpload(_ context.Context, request *storage.AbortMultipartUploadRequest) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if _, err := d.upload(request.Key, request.UploadID); err != nil {
+		return err
+	}
+	delete(d.uploads, request.UploadID)
+	return nil
+}
+
+// ListPayloads returns the blobs whose keys start with the requested prefix. The cursor is the
+// key of the last blob of the previous page.
+func (d *Driver) ListPayloads(_ context.Context, request *storage.ListRequest) (*storage.ListResponse, error) {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+
+	var keys []string
+	for key := range d.blobs {
+		if strings.HasPrefix(key, request.Prefix) && key > request.Cursor {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	response := &storage.ListResponse{}
+	if request.Limit > 0 && len(keys) > request.Limit {
+		keys = keys[:request.Limit]
+		response.NextCursor = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		info := storage.BlobInfo{
+			Key:           key,
+			ContentLength: uint64(len(d.blobs[key])),
+			LastModified:  d.modified[key],
+		}
+		if request.IncludeExpiry {
+			info.ExpiresAt = d.expires[key]
+		}
+		response.Blobs = append(response.Blobs, info)
+	}
+	return response, nil
+}
+
+// store stores a blob, which never expires if expiresAt is zero. It must be called with the
+// lock held.
+func (d *Driver) store(key string, b []byte, digest string, expiresAt time.Time, metadata map[string][]byte) {
+	if d.blobs == nil {
+		d.blobs = make(map[string][]byte)
+		d.modified = make(map[string]time.Time)
+		d.expires = make(map[string]time.Time)
+		d.metadata = make(map[string]map[string][]byte)
+		d.digests = make(map[string]string)
+	}
+	d.blobs[key] = b
+	d.modified[key] = time.Now()
+	if expiresAt.IsZero() {
+		delete(d.expires, key)
+	} else {
+		d.expires[key] = expiresAt
+	}
+	if metadata == nil {
+		delete(d.metadata, key)
+	} else {
+		d.metadata[key] = metadata
+	}
+	if digest == "" {
+		delete(d.digests, key)
+	} else {
+		d.digests[key] = digest
+	}
+}
+
+// Metadata returns the Temporal metadata the blob with the given key was stored with, or nil
+// if it does not exist or was stored without metadata.
+func (d *Driver) Metadata(key string) map[string][]byte {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+
+	return d.metadata[key]
+}
+
+// upload returns the multipart upload with the given key and ID. It must be called with the
+// lock held.
+func (d *Driver) upload(key string, id string) (*upload, error) {
+	u, ok := d.uploads[id]
+	if !ok || u.key != key {
+		return nil, fmt.Errorf("no multipart upload %s of blob %s", id, key)
+	}
+	return u, nil
+}
+
+// Describe identifies the driver, which has no configuration.
+func (d *Driver) Describe() storage.Description {
+	return storage.Description{Name: "memory"}
+}
@@ -41,6 +41,7 @@ func TestDriver(t *testing.T) {
 		Key:           "blobs/sha256:test",
 		Digest:        "sha256:test",
 		ContentLength: uint64(len(testPayloadBytes)),
+		Metadata:      map[string][]byte{"encoding": []byte("json/plain")},
 	})
 	require.NoError(t, err)
 	require.NotEmpty(t, putResponse.Key)
@@ -49,6 +50,19 @@ func TestDriver(t *testing.T) {
 	resp, err = d.ExistPayload(ctx, &storage.ExistRequest{Key: putResponse.Key})
 	require.NoError(t, err)
 	require.True(t, resp.Exists)
+	require.Equal(t, uint64(len(testPayloadBytes)), resp.ContentLength)
+	require.Equal(t, map[string][]byte{"encoding": []byte("json/plain")}, d.Metadata(putResponse.Key))
+
+	// Describe the payload
+	head, err := d.HeadPayload(ctx, &storage.HeadRequest{Key: putResponse.Key})
+	require.NoError(t, err)
+	require.Equal(t, &storage.HeadResponse{
+		ContentLength: uint64(len(testPayloadBytes)),
+		Digest:        "sha256:test",
+		Metadata:      map[string][]byte{"encoding": []byte("json/plain")},
+	}, head)
+	_, err = d.HeadPayload(ctx, &storage.HeadRequest{Key: "sha256:foobar"})
+	require.True(t, errors.As(err, &blobNotFound))
 
 	// Get the payload back out and compare to original bytes
 	_, err = d.GetPayload(ctx, &storage.GetRequest{Key: putResponse.Key, Writer: &buf})
@@ -66,6 +80,12 @@ func TestDriver(t *testing.T) {
 		t.Errorf("expected payload data %q, got %q", testPayloadBytes, b)
 	}
 
+	// Get the payload starting at an offset
+	_, err = d.GetPayloadRange(ctx, &storage.GetRangeRequest{Key: putResponse.Key, Writer: &buf, Offset: 6})
+	require.NoError(t, err)
+	require.Equal(t, "world", buf.String())
+	buf.Reset()
+
 	// Delete the payload
 	_, err = d.DeletePayload(ctx, &storage.DeleteRequest{
 		Key: "sha256:test",
@@ -79,3 +99,110 @@ func TestDriver(t *testing.T) {
 	require.False(t, resp.Exists)
 
 }
+
+func TestDriverMultipartUpload(t *testing.T) {
+	var (
+		ctx = context.Background()
+		d   = memory.Driver{}
+		buf = bytes.Buffer{}
+		key = "blobs/sha256:test"
+	)
+
+	metadata := map[string][]byte{"encoding": []byte("json/plain")}
+	created, err := d.CreateMultipartUpload(ctx, &storage.CreateMultipartUploadRequest{Key: key, Metadata: metadata})
+	require.NoError(t, err)
+
+	// parts are assembled in the order of their numbers, regardless of the upload order
+	etags := map[int]string{}
+	for _, part := range []struct {
+		number int
+		data   string
+	}{{2, "world"}, {1, "hello "}, {2, "world!"}} {
+		uploaded, err := d.UploadPart(ctx, &storage.UploadPartRequest{
+			Key:           key,
+			UploadID:      created.UploadID,
+			PartNumber:    part.number,
+			Data:          bytes.NewReader([]byte(part.data)),
+			ContentLength: uint64(len(part.data)),
+		})
+		require.NoError(t, err)
+		etags[part.number] = uploaded.ETag
+	}
+	parts := []storage.CompletedPart{{PartNumber: 1, ETag: etags[1]}, {PartNumber: 2, ETag: etags[2]}}
+
+	// the blob does not exist until the upload is completed
+	resp, err := d.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+	require.NoError(t, err)
+	require.False(t, resp.Exists)
+
+	_, err = d.CompleteMultipartUpload(ctx, &storage.CompleteMultipartUploadRequest{Key: key, UploadID: created.UploadID, Parts: parts})
+	require.NoError(t, err)
+	_, err = d.GetPayload(ctx, &storage.GetRequest{Key: key, Writer: &buf})
+	require.NoError(t, err)
+	require.Equal(t, "hello world!", buf.String())
+	require.Equal(t, metadata, d.Metadata(key))
+
+	// completed uploads cannot be used anymore
+	err = d.AbortMultipartUpload(ctx, &storage.AbortMultipartUploadRequest{Key: key, UploadID: created.UploadID})
+	require.Error(t, err)
+
+	// aborted uploads discard their parts
+	created, err = d.CreateMultipartUpload(ctx, &storage.CreateMultipartUploadRequest{Key: "blobs/sha256:other"})
+	require.NoError(t, err)
+	_, err = d.UploadPart(ctx, &storage.UploadPartRequest{Key: "blobs/sha256:other", UploadID: created.UploadID, PartNumber: 1, Data: bytes.NewReader([]byte("a"))})
+	require.NoError(t, err)
+	require.NoError(t, d.AbortMultipartUpload(ctx, &storage.AbortMultipartUploadRequest{Key: "blobs/sha256:other", UploadID: created.UploadID}))
+	_, err = d.UploadPart(ctx, &storage.UploadPartRequest{Key: "blobs/sha256:other", UploadID: created.UploadID, PartNumber: 2, Data: bytes.NewReader([]byte("b"))})
+	require.Error(t, err)
+}
+
+func TestDriverListPayloads(t *testing.T) {
+	ctx := context.Background()
+	d := memory.Driver{}
+	for _, key := range []string{"/blobs/a/3", "/blobs/a/1", "/blobs/b/1", "/blobs/a/2"} {
+		_, err := d.PutPayload(ctx, &storage.PutRequest{Data: bytes.NewReader([]byte(key)), Key: key})
+		require.NoError(t, err)
+	}
+
+	var keys []string
+	var pages int
+	request := &storage.ListRequest{Prefix: "/blobs/a/", Limit: 2}
+	for {
+		resp, err := d.ListPayloads(ctx, request)
+		require.NoError(t, err)
+		pages++
+		for _, blob := range resp.Blobs {
+			keys = append(keys, blob.Key)
+			require.Equal(t, uint64(len(blob.Key)), blob.ContentLength)
+			require.False(t, blob.LastModified.IsZero())
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		request.Cursor = resp.NextCursor
+	}
+	require.Equal(t, []string{"/blobs/a/1", "/blobs/a/2", "/blobs/a/3"}, keys)
+	require.Equal(t, 2, pages)
+}
+
+func TestDriverDeleteByPrefix(t *testing.T) {
+	ctx := context.Background()
+	d := memory.Driver{}
+	for _, key := range []string{"/blobs/a/1", "/blobs/a/2", "/blobs/b/1"} {
+		_, err := d.PutPayload(ctx, &storage.PutRequest{Data: bytes.NewReader([]byte(key)), Key: key})
+		require.NoError(t, err)
+	}
+
+	var progress []int
+	resp, err := d.DeleteByPrefix(ctx, &storage.DeleteByPrefixRequest{Prefix: "/blobs/a/", Progress: func(deleted int) {
+		progress = append(progress, deleted)
+	}})
+	require.NoError(t, err)
+	require.Equal(t, 2, resp.Deleted)
+	require.Equal(t, []int{2}, progress)
+
+	listed, err := d.ListPayloads(ctx, &storage.ListRequest{Prefix: "/blobs/"})
+	require.NoError(t, err)
+	require.Len(t, listed.Blobs, 1)
+	require.Equal(t, "/blobs/b/1", listed.Blobs[0].Key)
+}
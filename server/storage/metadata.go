@@ -0,0 +1,172 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package storage
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+)
+
+// PayloadMetadataPrefix prefixes the keys of the object metadata in which drivers record the
+// Temporal metadata of a blob, see PayloadMetadata.
+const PayloadMetadataPrefix = "lps_meta_"
+
+// DigestMetadataKey is the key of the object metadata in which drivers record the digest of a
+// blob, in the format <algorithm>:<hex encoded value>. It is a valid metadata key with all
+// object stores.
+const DigestMetadataKey = "lps_digest"
+
+// EncodedMetadataMarker prefixes the values of object metadata which PayloadMetadata base64
+// encoded, see RestorePayloadMetadata.
+const EncodedMetadataMarker = "b64:"
+
+const (
+	// MaxPayloadMetadataValueBytes is the size of the longest value of object metadata
+	// recorded by PayloadMetadata once encoded, longer values are dropped.
+	MaxPayloadMetadataValueBytes = 256
+	// MaxPayloadMetadataBytes is the total size of the keys and values of the object metadata
+	// returned by PayloadMetadata, which leaves room for other metadata within the 2 KB of
+	// user-defined metadata accepted by S3.
+	MaxPayloadMetadataBytes = 1024
+)
+
+// PayloadMetadata returns the object metadata recording the given Temporal metadata, to be
+// stored with the blob by drivers. It is valid object metadata with all object stores:
+//   - keys are prefixed with PayloadMetadataPrefix, lower cased, and characters other than
+//     letters, digits and underscores are replaced with underscores,
+//   - values which are not printable ASCII, start or end with a space, or start with
+//     EncodedMetadataMarker are base64 encoded and prefixed with EncodedMetadataMarker, so that
+//     they are restored by RestorePayloadMetadata,
+//   - values longer than MaxPayloadMetadataValueBytes once encoded are dropped, as they could
+//     not be restored if truncated,
+//   - entries are added in the order of their keys while their total size does not exceed
+//     MaxPayloadMetadataBytes, the others are dropped.
+//
+// It returns nil if there is no metadata.
+func PayloadMetadata(metadata map[string][]byte) map[string]string {
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var objectMetadata map[string]string
+	size := 0
+	for _, name := range names {
+		key := PayloadMetadataPrefix + strings.Map(sanitizeMetadataKey, strings.ToLower(name))
+		value := encodeMetadataValue(metadata[name])
+		if len(value) > MaxPayloadMetadataValueBytes {
+			continue
+		}
+		if _, ok := objectMetadata[key]; ok || size+len(key)+len(value) > MaxPayloadMetadataBytes {
+			continue
+		}
+		if objectMetadata == nil {
+			objectMetadata = make(map[string]string)
+		}
+		objectMetadata[key] = value
+		size += len(key) + len(value)
+	}
+	return objectMetadata
+}
+
+// PresignedObjectMetadata returns the object metadata which drivers sign in the presigned URLs
+// uploading a blob, see ObjectMetadata.
+func PresignedObjectMetadata(r *PresignPutRequest) map[string]string {
+	return ObjectMetadata(&PutRequest{Digest: r.Digest, ExpiresAt: r.ExpiresAt, Metadata: r.Metadata})
+}
+
+// ObjectMetadata returns the object metadata which drivers store with a blob: its digest, its
+// expiry and its Temporal metadata, see DigestMetadataKey, ExpiryMetadata and PayloadMetadata.
+// It returns nil if there is no metadata.
+func ObjectMetadata(r *PutRequest) map[string]string {
+	objectMetadata := PayloadMetadata(r.Metadata)
+	for key, value := range ExpiryMetadata(r.ExpiresAt) {
+		if objectMetadata == nil {
+			objectMetadata = make(map[string]string)
+		}
+		objectMetadata[key] = value
+	}
+	if r.Digest != "" {
+		if objectMetadata == nil {
+			objectMetadata = make(map[string]string)
+		}
+		objectMetadata[DigestMetadataKey] = r.Digest
+	}
+	return objectMetadata
+}
+
+// HeadResponseFromMetadata returns the description of a blob of the given size stored with the
+// given object metadata, whose keys are matched case-insensitively since some object stores
+// change their case.
+func HeadResponseFromMetadata(contentLength uint64, objectMetadata map[string]string) *HeadResponse {
+	response := &HeadResponse{
+		ContentLength: contentLength,
+		Metadata:      RestorePayloadMetadata(objectMetadata),
+	}
+	for key, value := range objectMetadata {
+		if strings.EqualFold(key, DigestMetadataKey) {
+			response.Digest = value
+		}
+	}
+	return response
+}
+
+func sanitizeMetadataKey(r rune) rune {
+	if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+		return r
+	}
+	return '_'
+}
+
+// RestorePayloadMetadata returns the Temporal metadata recorded in object metadata by
+// PayloadMetadata, keyed by the sanitized keys without PayloadMetadataPrefix. Other object
+// metadata, and values which cannot be decoded, are ignored. It returns nil if there is no
+// such metadata.
+func RestorePayloadMetadata(objectMetadata map[string]string) map[string][]byte {
+	var metadata map[string][]byte
+	for key, value := range objectMetadata {
+		// object stores may not preserve the case of metadata keys
+		name := strings.ToLower(key)
+		if !strings.HasPrefix(name, PayloadMetadataPrefix) {
+			continue
+		}
+		decoded, ok := decodeMetadataValue(value)
+		if !ok {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string][]byte)
+		}
+		metadata[strings.TrimPrefix(name, PayloadMetadataPrefix)] = decoded
+	}
+	return metadata
+}
+
+// encodeMetadataValue returns value as is if it is valid object metadata with all object
+// stores, or base64 encoded and prefixed with EncodedMetadataMarker otherwise.
+func encodeMetadataValue(value []byte) string {
+	plain := !strings.HasPrefix(string(value), EncodedMetadataMarker)
+	for i, c := range value {
+		// leading and trailing spaces are trimmed from HTTP headers
+		if c < ' ' || c > '~' || c == ' ' && (i == 0 || i == len(value)-1) {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return string(value)
+	}
+	return EncodedMetadataMarker + base64.StdEncoding.EncodeToString(value)
+}
+
+func decodeMetadataValue(value string) ([]byte, bool) {
+	if !strings.HasPrefix(value, EncodedMetadataMarker) {
+		return []byte(value), true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, EncodedMetadataMarker))
+	return decoded, err == nil
+}
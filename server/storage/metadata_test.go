@@ -0,0 +1,201 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package storage
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadMetadata(t *testing.T) {
+	testCase := []struct {
+		name     string
+		metadata map[string][]byte
+		want     map[string]string
+	}{
+		{
+			name: "No metadata",
+		},
+		{
+			name:     "Plain",
+			metadata: map[string][]byte{"encoding": []byte("json/plain")},
+			want:     map[string]string{"lps_meta_encoding": "json/plain"},
+		},
+		{
+			name: "Sanitized",
+			metadata: map[string][]byte{
+				"messageType":             []byte("temporal.api.common.v1.Payload"),
+				"remote-codec/key-prefix": []byte("wf/run"),
+				"binary":                  {0x0a, 'a', 0xff, '\n'},
+			},
+			want: map[string]string{
+				"lps_meta_messagetype":             "temporal.api.common.v1.Payload",
+				"lps_meta_remote_codec_key_prefix": "wf/run",
+				"lps_meta_binary":                  "b64:CmH/Cg==",
+			},
+		},
+		{
+			name: "Encoded",
+			metadata: map[string][]byte{
+				"leading":  []byte(" a"),
+				"trailing": []byte("a "),
+				"inner":    []byte("a b"),
+				"marker":   []byte("b64:YQ=="),
+				"unicode":  []byte("é"),
+				"empty":    {},
+			},
+			want: map[string]string{
+				"lps_meta_leading":  "b64:IGE=",
+				"lps_meta_trailing": "b64:YSA=",
+				"lps_meta_inner":    "a b",
+				"lps_meta_marker":   "b64:YjY0OllRPT0=",
+				"lps_meta_unicode":  "b64:w6k=",
+				"lps_meta_empty":    "",
+			},
+		},
+		{
+			name: "Too long",
+			metadata: map[string][]byte{
+				"long":    []byte(strings.Repeat("a", 300)),
+				"encoded": []byte(strings.Repeat("\n", 200)),
+				"short":   []byte("a"),
+			},
+			want: map[string]string{"lps_meta_short": "a"},
+		},
+		{
+			name: "Colliding keys",
+			metadata: map[string][]byte{
+				"key-prefix": []byte("first"),
+				"key_prefix": []byte("second"),
+			},
+			want: map[string]string{"lps_meta_key_prefix": "first"},
+		},
+		{
+			name: "Exceeding the total size",
+			metadata: map[string][]byte{
+				"a": []byte(strings.Repeat("a", 250)),
+				"b": []byte(strings.Repeat("b", 250)),
+				"c": []byte(strings.Repeat("c", 250)),
+				"d": []byte(strings.Repeat("d", 250)),
+				"e": []byte("e"),
+			},
+			want: map[string]string{
+				"lps_meta_a": strings.Repeat("a", 250),
+				"lps_meta_b": strings.Repeat("b", 250),
+				"lps_meta_c": strings.Repeat("c", 250),
+				"lps_meta_e": "e",
+			},
+		},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			assert.Equal(t, scenario.want, PayloadMetadata(scenario.metadata))
+		})
+	}
+}
+
+func TestRestorePayloadMetadata(t *testing.T) {
+	assert.Nil(t, RestorePayloadMetadata(nil))
+	assert.Nil(t, RestorePayloadMetadata(map[string]string{ExpiryMetadataKey: "2022-10-01T12:00:00Z"}))
+
+	metadata := map[string][]byte{
+		"encoding": []byte("json/plain"),
+		"binary":   {0x0a, 'a', 0xff, '\n'},
+		"marker":   []byte("b64:YQ=="),
+		"spaces":   []byte(" a "),
+	}
+	objectMetadata := PayloadMetadata(metadata)
+	objectMetadata[ExpiryMetadataKey] = "2022-10-01T12:00:00Z"
+	assert.Equal(t, metadata, RestorePayloadMetadata(objectMetadata))
+
+	// object stores may return keys in another case, invalid encodings are ignored
+	assert.Equal(t, map[string][]byte{"encoding": []byte("json/plain")}, RestorePayloadMetadata(map[string]string{
+		"Lps_meta_encoding": "json/plain",
+		"lps_meta_invalid":  "b64:not base64",
+	}))
+}
+
+// TestPayloadMetadataRandom checks that random metadata is recorded as object metadata accepted
+// by all object stores, and restored as is.
+func TestPayloadMetadataRandom(t *testing.T) {
+	// the seed is fixed so that failures are reproducible
+	random := rand.New(rand.NewSource(1))
+	randomBytes := func(max int) []byte {
+		b := make([]byte, random.Intn(max+1))
+		random.Read(b)
+		return b
+	}
+
+	for i := 0; i < 1000; i++ {
+		metadata := make(map[string][]byte)
+		for j := random.Intn(8); j > 0; j-- {
+			metadata[string(randomBytes(32))] = randomBytes(256)
+		}
+
+		objectMetadata := PayloadMetadata(metadata)
+		size := 0
+		for key, value := range objectMetadata {
+			size += len(key) + len(value)
+			for _, c := range []byte(strings.TrimPrefix(key, PayloadMetadataPrefix)) {
+				require.True(t, c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_', "key %q", key)
+			}
+			require.True(t, utf8.ValidString(value), "value %q", value)
+			require.Equal(t, strings.TrimSpace(value), value)
+			for _, c := range []byte(value) {
+				require.True(t, c >= ' ' && c <= '~', "value %q", value)
+			}
+			require.LessOrEqual(t, len(value), MaxPayloadMetadataValueBytes)
+		}
+		require.LessOrEqual(t, size, MaxPayloadMetadataBytes)
+
+		// values are restored as is, colliding keys record the value of one of their keys
+		restored := RestorePayloadMetadata(objectMetadata)
+		require.Len(t, restored, len(objectMetadata))
+		candidates := make(map[string][][]byte)
+		for name, value := range metadata {
+			key := strings.Map(sanitizeMetadataKey, strings.ToLower(name))
+			candidates[key] = append(candidates[key], value)
+		}
+		for key, value := range restored {
+			require.Contains(t, candidates[key], value, "key %q", key)
+		}
+	}
+}
+
+func TestObjectMetadata(t *testing.T) {
+	assert.Nil(t, ObjectMetadata(&PutRequest{}))
+	assert.Equal(t, map[string]string{DigestMetadataKey: "sha256:abc"}, ObjectMetadata(&PutRequest{Digest: "sha256:abc"}))
+
+	expiresAt := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, map[string]string{
+		ExpiryMetadataKey:   "2022-10-01T12:00:00Z",
+		"lps_meta_encoding": "json/plain",
+	}, ObjectMetadata(&PutRequest{
+		ExpiresAt: expiresAt,
+		Metadata:  map[string][]byte{"encoding": []byte("json/plain")},
+	}))
+}
+
+func TestPresignedObjectMetadata(t *testing.T) {
+	expiresAt := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, map[string]string{
+		DigestMetadataKey:   "sha256:abc",
+		ExpiryMetadataKey:   "2022-10-01T12:00:00Z",
+		"lps_meta_encoding": "json/plain",
+	}, PresignedObjectMetadata(&PresignPutRequest{
+		Key:           "/blobs/test/common/sha256:abc",
+		Digest:        "sha256:abc",
+		ContentLength: 10,
+		ExpiresAt:     expiresAt,
+		Metadata:      map[string][]byte{"encoding": []byte("json/plain")},
+	}))
+}
@@ -0,0 +1,323 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package router provides a storage driver storing the blobs of some namespaces with other
+// drivers than the blobs of the remaining namespaces, e.g. in a bucket of another region.
+package router
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+// blobsPrefix is the prefix of the keys of all blobs attributed to a namespace, followed by
+// the namespace, see v2.ComputeKey.
+const blobsPrefix = "/blobs/"
+
+var _ storage.Driver = &Driver{}
+var _ storage.Validatable = &Driver{}
+var _ storage.Describer = &Driver{}
+var _ storage.RangeGetter = &Driver{}
+var _ storage.Presigner = &Driver{}
+var _ storage.MultipartUploader = &Driver{}
+var _ storage.Lister = &Driver{}
+var _ storage.PrefixDeleter = &Driver{}
+var _ storage.Inspector = &Driver{}
+
+// Driver routes each request to the driver of the namespace of its key, which is the path
+// segment following /blobs/, or to the default driver for other namespaces and for keys in
+// other layouts. Requests for a key are always routed to the driver which stored it.
+//
+// Driver implements all optional interfaces of the storage package. Its methods wrap
+// storage.ErrNotSupported if the driver a request is routed to does not implement them.
+type Driver struct {
+	defaultDriver storage.Driver
+	drivers       map[string]storage.Driver
+	// namespaces are the namespaces with a driver in lexicographic order.
+	namespaces []string
+}
+
+// New creates a driver storing the blobs of the namespaces in drivers with their driver, and
+// the blobs of all other namespaces with defaultDriver.
+func New(defaultDriver storage.Driver, drivers map[string]storage.Driver) *Driver {
+	d := &Driver{defaultDriver: defaultDriver, drivers: make(map[string]storage.Driver, len(drivers))}
+	for namespace, driver := range drivers {
+		d.drivers[namespace] = driver
+		d.namespaces = append(d.namespaces, namespace)
+	}
+	sort.Strings(d.namespaces)
+	return d
+}
+
+// namespaceOf returns the namespace of a key or prefix, and whether it has one.
+func namespaceOf(key string) (string, bool) {
+	if !strings.HasPrefix(key, blobsPrefix) {
+		return "", false
+	}
+	namespace, _, found := strings.Cut(key[len(blobsPrefix):], "/")
+	return namespace, found && namespace != ""
+}
+
+// route returns the driver storing the blob with the given key, and the namespace it is
+// configured for, which is empty for the default driver.
+func (d *Driver) route(key string) (storage.Driver, string) {
+	if namespace, ok := namespaceOf(key); ok {
+		if driver, ok := d.drivers[namespace]; ok {
+			return driver, namespace
+		}
+	}
+	return d.defaultDriver, ""
+}
+
+// unsupported returns the error of operations which the driver configured for namespace does
+// not support.
+func unsupported(namespace string, operation string) error {
+	if namespace == "" {
+		return fmt.Errorf("%w: the default driver does not support %s", storage.ErrNotSupported, operation)
+	}
+	return fmt.Errorf("%w: the driver of namespace '%s' does not support %s", storage.ErrNotSupported, namespace, operation)
+}
+
+func (d *Driver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
+	driver, _ := d.route(r.Key)
+	return driver.PutPayload(ctx, r)
+}
+
+func (d *Driver) GetPayload(ctx context.Context, r *storage.GetRequest) (*storage.GetResponse, error) {
+	driver, _ := d.route(r.Key)
+	return driver.GetPayload(ctx, r)
+}
+
+func (d *Driver) ExistPayload(ctx context.Context, r *storage.ExistRequest) (*storage.ExistResponse, error) {
+	driver, _ := d.route(r.Key)
+	return driver.ExistPayload(ctx, r)
+}
+
+func (d *Driver) DeletePayload(ctx context.Context, r *storage.DeleteRequest) (*storage.DeleteResponse, error) {
+	driver, _ := d.route(r.Key)
+	return driver.DeletePayload(ctx, r)
+}
+
+func (d *Driver) HeadPayload(ctx context.Context, r *storage.HeadRequest) (*storage.HeadResponse, error) {
+	driver, namespace := d.route(r.Key)
+	inspector, ok := driver.(storage.Inspector)
+	if !ok {
+		return nil, unsupported(namespace, "head requests")
+	}
+	return inspector.HeadPayload(ctx, r)
+}
+
+func (d *Driver) GetPayloadRange(ctx context.Context, r *storage.GetRangeRequest) (*storage.GetResponse, error) {
+	driver, namespace := d.route(r.Key)
+	rangeGetter, ok := driver.(storage.RangeGetter)
+	if !ok {
+		return nil, unsupported(namespace, "range requests")
+	}
+	return rangeGetter.GetPayloadRange(ctx, r)
+}
+
+func (d *Driver) PresignPut(ctx context.Context, r *storage.PresignPutRequest) (*storage.PresignResponse, error) {
+	driver, namespace := d.route(r.Key)
+	presigner, ok := driver.(storage.Presigner)
+	if !ok {
+		return nil, unsupported(namespace, "presigned URLs")
+	}
+	return presigner.PresignPut(ctx, r)
+}
+
+func (d *Driver) PresignGet(ctx context.Context, r *storage.PresignGetRequest) (*storage.PresignResponse, error) {
+	driver, namespace := d.route(r.Key)
+	presigner, ok := driver.(storage.Presigner)
+	if !ok {
+		return nil, unsupported(namespace, "presigned URLs")
+	}
+	return presigner.PresignGet(ctx, r)
+}
+
+// uploader returns the multipart uploader storing the blob with the given key.
+func (d *Driver) uploader(key string) (storage.MultipartUploader, error) {
+	driver, namespace := d.route(key)
+	uploader, ok := driver.(storage.MultipartUploader)
+	if !ok {
+		return nil, unsupported(namespace, "upload sessions")
+	}
+	return uploader, nil
+}
+
+func (d *Driver) CreateMultipartUpload(ctx context.Context, r *storage.CreateMultipartUploadRequest) (*storage.CreateMultipartUploadResponse, error) {
+	uploader, err := d.uploader(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.CreateMultipartUpload(ctx, r)
+}
+
+func (d *Driver) UploadPart(ctx context.Context, r *storage.UploadPartRequest) (*storage.UploadPartResponse, error) {
+	uploader, err := d.uploader(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.UploadPart(ctx, r)
+}
+
+func (d *Driver) CompleteMultipartUpload(ctx context.Context, r *storage.CompleteMultipartUploadRequest) (*storage.PutResponse, error) {
+	uploader, err := d.uploader(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.CompleteMultipartUpload(ctx, r)
+}
+
+func (d *Driver) AbortMultipartUpload(ctx context.Context, r *storage.AbortMultipartUploadRequest) error {
+	uploader, err := d.uploader(r.Key)
+	if err != nil {
+		return err
+	}
+	return uploader.AbortMultipartUpload(ctx, r)
+}
+
+// target is the part of a listing or deletion by prefix performed by one driver.
+type target struct {
+	driver storage.Driver
+	// namespace is the namespace the driver is configured for, or empty for the default driver.
+	namespace string
+	prefix    string
+}
+
+// targets returns the drivers storing the blobs whose keys start with prefix. Prefixes within
+// a namespace are handled by its driver, while others span the default driver followed by the
+// drivers of the namespaces they include.
+func (d *Driver) targets(prefix string) []target {
+	if _, ok := namespaceOf(prefix); ok {
+		driver, namespace := d.route(prefix)
+		return []target{{driver: driver, namespace: namespace, prefix: prefix}}
+	}
+	targets := []target{{driver: d.defaultDriver, prefix: prefix}}
+	for _, namespace := range d.namespaces {
+		if namespacePrefix := blobsPrefix + namespace + "/"; strings.HasPrefix(namespacePrefix, prefix) {
+			targets = append(targets, target{driver: d.drivers[namespace], namespace: namespace, prefix: namespacePrefix})
+		}
+	}
+	return targets
+}
+
+// ListPayloads lists the blobs of one driver per page. Listings spanning several drivers, see
+// targets, return the blobs of each driver in turn, so keys are only sorted per driver, and
+// their cursors record the driver being listed. Blobs of namespaces with a driver are not
+// listed from the default driver, which may hold them from before they were routed.
+func (d *Driver) ListPayloads(ctx context.Context, r *storage.ListRequest) (*storage.ListResponse, error) {
+	targets := d.targets(r.Prefix)
+	step, cursor := 0, r.Cursor
+	if len(targets) > 1 && r.Cursor != "" {
+		s, c, found := strings.Cut(r.Cursor, "/")
+		var err error
+		if step, err = strconv.Atoi(s); !found || err != nil || step < 0 || step >= len(targets) {
+			return nil, fmt.Errorf("invalid cursor '%s'", r.Cursor)
+		}
+		cursor = c
+	}
+
+	t := targets[step]
+	lister, ok := t.driver.(storage.Lister)
+	if !ok {
+		return nil, unsupported(t.namespace, "listing blobs")
+	}
+	request := *r
+	request.Prefix = t.prefix
+	request.Cursor = cursor
+	listed, err := lister.ListPayloads(ctx, &request)
+	if err != nil || len(targets) == 1 {
+		return listed, err
+	}
+
+	response := &storage.ListResponse{}
+	for _, blob := range listed.Blobs {
+		if _, namespace := d.route(blob.Key); namespace == t.namespace {
+			response.Blobs = append(response.Blobs, blob)
+		}
+	}
+	if listed.NextCursor != "" {
+		response.NextCursor = fmt.Sprintf("%d/%s", step, listed.NextCursor)
+	} else if step+1 < len(targets) {
+		response.NextCursor = fmt.Sprintf("%d/", step+1)
+	}
+	return response, nil
+}
+
+// DeleteByPrefix deletes the blobs with each driver storing blobs whose keys start with the
+// prefix, see targets. The default driver deletes all blobs with the prefix, including blobs
+// of namespaces with a driver which it holds from before they were routed.
+func (d *Driver) DeleteByPrefix(ctx context.Context, r *storage.DeleteByPrefixRequest) (*storage.DeleteByPrefixResponse, error) {
+	targets := d.targets(r.Prefix)
+	for _, t := range targets {
+		if _, ok := t.driver.(storage.PrefixDeleter); !ok {
+			return nil, unsupported(t.namespace, "deleting blobs by prefix")
+		}
+	}
+
+	response := &storage.DeleteByPrefixResponse{}
+	for _, t := range targets {
+		request := &storage.DeleteByPrefixRequest{Prefix: t.prefix}
+		if r.Progress != nil {
+			deleted := response.Deleted
+			request.Progress = func(n int) {
+				r.Progress(deleted + n)
+			}
+		}
+		deletedByTarget, err := t.driver.(storage.PrefixDeleter).DeleteByPrefix(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		response.Deleted += deletedByTarget.Deleted
+	}
+	return response, nil
+}
+
+// Validate validates the default driver and the driver of each namespace, if they can be
+// validated.
+func (d *Driver) Validate(ctx context.Context) error {
+	if v, ok := d.defaultDriver.(storage.Validatable); ok {
+		if err := v.Validate(ctx); err != nil {
+			return fmt.Errorf("default driver: %w", err)
+		}
+	}
+	for _, namespace := range d.namespaces {
+		if v, ok := d.drivers[namespace].(storage.Validatable); ok {
+			if err := v.Validate(ctx); err != nil {
+				return fmt.Errorf("driver of namespace '%s': %w", namespace, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Describe describes the default driver as "default" and the driver of each namespace as
+// "namespace:<namespace>", e.g. "s3 bucket=payloads-eu".
+func (d *Driver) Describe() storage.Description {
+	config := map[string]string{"default": describe(d.defaultDriver)}
+	for namespace, driver := range d.drivers {
+		config["namespace:"+namespace] = describe(driver)
+	}
+	return storage.Description{Name: "router", Config: config}
+}
+
+// describe returns the name of a driver followed by its configuration in lexicographic order.
+func describe(driver storage.Driver) string {
+	describer, ok := driver.(storage.Describer)
+	if !ok {
+		return fmt.Sprintf("%T", driver)
+	}
+	description := describer.Describe()
+	entries := []string{description.Name}
+	for key, value := range description.Config {
+		entries = append(entries, key+"="+value)
+	}
+	sort.Strings(entries[1:])
+	return strings.Join(entries, " ")
+}
@@ -0,0 +1,196 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package router_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/router"
+)
+
+// basicDriver is a driver implementing none of the optional interfaces.
+type basicDriver struct {
+	storage.Driver
+}
+
+// invalidDriver is a driver failing validation.
+type invalidDriver struct {
+	memory.Driver
+}
+
+func (d *invalidDriver) Validate(context.Context) error {
+	return errors.New("bucket not found")
+}
+
+func put(t *testing.T, driver storage.Driver, key string) {
+	data := []byte("hello world")
+	_, err := driver.PutPayload(context.Background(), &storage.PutRequest{Data: bytes.NewReader(data), Key: key, ContentLength: uint64(len(data))})
+	require.NoError(t, err)
+}
+
+func exists(t *testing.T, driver storage.Driver, key string) bool {
+	response, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: key})
+	require.NoError(t, err)
+	return response.Exists
+}
+
+func TestDriver(t *testing.T) {
+	ctx := context.Background()
+	us, eu := &memory.Driver{}, &memory.Driver{}
+	d := router.New(us, map[string]storage.Driver{"team-eu": eu})
+
+	for key, want := range map[string]*memory.Driver{
+		"/blobs/team-eu/common/sha256:abc/sha256:def": eu,
+		"/blobs/team-eu/custom/p/sha256:abc/sha256:d": eu,
+		"/blobs/team-us/common/sha256:abc/sha256:def": us,
+		"/blobs/team-eu2/common/sha256:abc/sha256:de": us,
+		"/payloads/team-eu/sha256:abc":                us,
+		"sha256:abc":                                  us,
+	} {
+		put(t, d, key)
+		assert.True(t, exists(t, want, key), key)
+		assert.True(t, exists(t, d, key), key)
+
+		var buf bytes.Buffer
+		_, err := d.GetPayload(ctx, &storage.GetRequest{Key: key, Writer: &buf})
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", buf.String())
+		buf.Reset()
+		_, err = d.GetPayloadRange(ctx, &storage.GetRangeRequest{Key: key, Writer: &buf, Offset: 6})
+		require.NoError(t, err)
+		assert.Equal(t, "world", buf.String())
+
+		_, err = d.DeletePayload(ctx, &storage.DeleteRequest{Key: key})
+		require.NoError(t, err)
+		assert.False(t, exists(t, want, key), key)
+	}
+
+	// upload sessions are routed by key as well
+	key := "/blobs/team-eu/common/sha256:abc/sha256:def"
+	upload, err := d.CreateMultipartUpload(ctx, &storage.CreateMultipartUploadRequest{Key: key})
+	require.NoError(t, err)
+	part, err := d.UploadPart(ctx, &storage.UploadPartRequest{Key: key, UploadID: upload.UploadID, PartNumber: 1, Data: bytes.NewReader([]byte("hello")), ContentLength: 5})
+	require.NoError(t, err)
+	_, err = d.CompleteMultipartUpload(ctx, &storage.CompleteMultipartUploadRequest{Key: key, UploadID: upload.UploadID, Parts: []storage.CompletedPart{{PartNumber: 1, ETag: part.ETag}}})
+	require.NoError(t, err)
+	assert.True(t, exists(t, eu, key))
+	assert.False(t, exists(t, us, key))
+}
+
+func TestDriverUnsupported(t *testing.T) {
+	ctx := context.Background()
+	d := router.New(&memory.Driver{}, map[string]storage.Driver{"team-eu": basicDriver{&memory.Driver{}}})
+	key := "/blobs/team-eu/common/sha256:abc/sha256:def"
+
+	_, err := d.PresignGet(ctx, &storage.PresignGetRequest{Key: key})
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+	assert.EqualError(t, err, "operation not supported by the storage driver: the driver of namespace 'team-eu' does not support presigned URLs")
+	_, err = d.PresignPut(ctx, &storage.PresignPutRequest{Key: "/blobs/team-us/common/sha256:abc/sha256:def"})
+	assert.EqualError(t, err, "operation not supported by the storage driver: the default driver does not support presigned URLs")
+	_, err = d.GetPayloadRange(ctx, &storage.GetRangeRequest{Key: key})
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+	_, err = d.CreateMultipartUpload(ctx, &storage.CreateMultipartUploadRequest{Key: key})
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+	_, err = d.ListPayloads(ctx, &storage.ListRequest{Prefix: "/blobs/team-eu/"})
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+	_, err = d.DeleteByPrefix(ctx, &storage.DeleteByPrefixRequest{Prefix: "/blobs/"})
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+	_, err = d.HeadPayload(ctx, &storage.HeadRequest{Key: key})
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+
+	// blobs of namespaces with a driver supporting them are not affected
+	_, err = d.ListPayloads(ctx, &storage.ListRequest{Prefix: "/blobs/team-us/"})
+	assert.NoError(t, err)
+}
+
+func TestDriverListPayloads(t *testing.T) {
+	ctx := context.Background()
+	us, eu, apac := &memory.Driver{}, &memory.Driver{}, &memory.Driver{}
+	d := router.New(us, map[string]storage.Driver{"team-eu": eu, "team-apac": apac})
+	keys := []string{
+		"/blobs/team-us/common/sha256:1/sha256:1",
+		"/blobs/team-us/common/sha256:2/sha256:2",
+		"/blobs/team-eu/common/sha256:1/sha256:1",
+		"/blobs/team-eu/common/sha256:2/sha256:2",
+		"/blobs/team-eu/common/sha256:3/sha256:3",
+		"/blobs/team-apac/common/sha256:1/sha256:1",
+	}
+	for _, key := range keys {
+		put(t, d, key)
+	}
+	// stored before the namespace was routed, so it cannot be reached anymore
+	put(t, us, "/blobs/team-eu/common/sha256:4/sha256:4")
+
+	list := func(prefix string) []string {
+		var listed []string
+		request := &storage.ListRequest{Prefix: prefix, Limit: 2}
+		for {
+			response, err := d.ListPayloads(ctx, request)
+			require.NoError(t, err)
+			for _, blob := range response.Blobs {
+				listed = append(listed, blob.Key)
+			}
+			if response.NextCursor == "" {
+				return listed
+			}
+			request.Cursor = response.NextCursor
+		}
+	}
+
+	assert.ElementsMatch(t, keys, list("/blobs/"))
+	assert.ElementsMatch(t, keys[2:5], list("/blobs/team-eu/"))
+	assert.ElementsMatch(t, keys[2:5], list("/blobs/team-e"))
+	assert.ElementsMatch(t, keys[:2], list("/blobs/team-us/"))
+
+	_, err := d.ListPayloads(ctx, &storage.ListRequest{Prefix: "/blobs/", Cursor: "7/abc"})
+	assert.Error(t, err)
+}
+
+func TestDriverDeleteByPrefix(t *testing.T) {
+	ctx := context.Background()
+	us, eu := &memory.Driver{}, &memory.Driver{}
+	d := router.New(us, map[string]storage.Driver{"team-eu": eu})
+	put(t, d, "/blobs/team-us/common/sha256:1/sha256:1")
+	put(t, d, "/blobs/team-eu/common/sha256:1/sha256:1")
+	put(t, d, "/blobs/team-eu/common/sha256:2/sha256:2")
+
+	response, err := d.DeleteByPrefix(ctx, &storage.DeleteByPrefixRequest{Prefix: "/blobs/team-eu/"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, response.Deleted)
+	assert.True(t, exists(t, us, "/blobs/team-us/common/sha256:1/sha256:1"))
+
+	put(t, d, "/blobs/team-eu/common/sha256:1/sha256:1")
+	var progress []int
+	response, err = d.DeleteByPrefix(ctx, &storage.DeleteByPrefixRequest{Prefix: "/blobs/", Progress: func(deleted int) {
+		progress = append(progress, deleted)
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, response.Deleted)
+	assert.Equal(t, []int{1, 2}, progress)
+	assert.False(t, exists(t, us, "/blobs/team-us/common/sha256:1/sha256:1"))
+	assert.False(t, exists(t, eu, "/blobs/team-eu/common/sha256:1/sha256:1"))
+}
+
+func TestDriverValidate(t *testing.T) {
+	assert.NoError(t, router.New(&memory.Driver{}, map[string]storage.Driver{"team-eu": &memory.Driver{}}).Validate(context.Background()))
+	err := router.New(&memory.Driver{}, map[string]storage.Driver{"team-eu": &invalidDriver{}}).Validate(context.Background())
+	assert.EqualError(t, err, "driver of namespace 'team-eu': bucket not found")
+}
+
+func TestDriverDescribe(t *testing.T) {
+	d := router.New(&memory.Driver{}, map[string]storage.Driver{"team-eu": basicDriver{&memory.Driver{}}})
+	assert.Equal(t, storage.Description{Name: "router", Config: map[string]string{
+		"default":           "memory",
+		"namespace:team-eu": "router_test.basicDriver",
+	}}, d.Describe())
+}
@@ -6,14 +6,18 @@ package s3
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 	"github.com/aws/smithy-go"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -48,17 +52,27 @@ func New(config *Config) *Driver {
 		downloader: manager.NewDownloader(cli, func(d *manager.Downloader) {
 			d.Concurrency = 1 // disable concurrent downloads so that we can write directly to the http response stream
 		}),
-		bucket:       config.Bucket,
-		storageClass: s3types.StorageClassIntelligentTiering,
+		presignClient: s3.NewPresignClient(cli),
+		bucket:        config.Bucket,
+		storageClass:  s3types.StorageClassIntelligentTiering,
 	}
 }
 
+var _ storage.Presigner = &Driver{}
+var _ storage.RangeGetter = &Driver{}
+var _ storage.MultipartUploader = &Driver{}
+var _ storage.Lister = &Driver{}
+var _ storage.PrefixDeleter = &Driver{}
+var _ storage.Describer = &Driver{}
+var _ storage.Inspector = &Driver{}
+
 type Driver struct {
-	client       *s3.Client
-	uploader     *manager.Uploader
-	downloader   *manager.Downloader
-	bucket       string
-	storageClass s3types.StorageClass
+	client        *s3.Client
+	presignClient *s3.PresignClient
+	uploader      *manager.Uploader
+	downloader    *manager.Downloader
+	bucket        string
+	storageClass  s3types.StorageClass
 }
 
 func (d *Driver) GetPayload(ctx context.Context, r *storage.GetRequest) (*storage.GetResponse, error) {
@@ -82,13 +96,38 @@ func (d *Driver) GetPayload(ctx context.Context, r *storage.GetRequest) (*storag
 	}, nil
 }
 
+func (d *Driver) GetPayloadRange(ctx context.Context, r *storage.GetRangeRequest) (*storage.GetResponse, error) {
+	// the downloader sends a single request for the range instead of downloading parts concurrently
+	w := sequentialWriterAt{w: r.Writer}
+	numBytes, err := d.downloader.Download(ctx, &w, &s3.GetObjectInput{
+		Bucket: &d.bucket,
+		Key:    aws.String(r.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", r.Offset)),
+	})
+	if err != nil {
+		var nsk *s3types.NoSuchKey
+		if errors.As(err, &nsk) {
+			err = &storage.ErrBlobNotFound{
+				Err: err,
+			}
+		}
+		return nil, err
+	}
+
+	return &storage.GetResponse{
+		ContentLength: uint64(numBytes),
+	}, nil
+}
+
 func (d *Driver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storage.PutResponse, error) {
 	_, err := d.uploader.Upload(ctx, &s3.PutObjectInput{
 		Bucket:        &d.bucket,
 		Key:           aws.String(r.Key),
 		Body:          r.Data,
 		ContentLength: aws.Int64(int64(r.ContentLength)),
+		ContentType:   contentType(r.ContentType),
 		StorageClass:  d.storageClass,
+		Metadata:      storage.ObjectMetadata(r),
 	})
 	if err != nil {
 		return nil, err
@@ -99,29 +138,52 @@ func (d *Driver) PutPayload(ctx context.Context, r *storage.PutRequest) (*storag
 	}, nil
 }
 
+// contentType returns the content type of a stored object, leaving it to S3 if it is unknown.
+func contentType(ct string) *string {
+	if ct == "" {
+		return nil
+	}
+	return aws.String(ct)
+}
+
 func (d *Driver) ExistPayload(ctx context.Context, r *storage.ExistRequest) (*storage.ExistResponse, error) {
-	_, err := d.client.HeadObject(ctx, &s3.HeadObjectInput{
+	out, err := d.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: &d.bucket,
 		Key:    &r.Key,
 	})
-
-	exists := true
 	if err != nil {
 		// I would expect the API to return s3types.NoSuchKey, but that is not the case.
 		// This might change in upcoming releases.
 		var ae smithy.APIError
 		if errors.As(err, &ae) && ae.ErrorCode() == "NotFound" {
-			exists = false
-		} else {
-			return nil, err
+			return &storage.ExistResponse{Exists: false}, nil
 		}
+		return nil, err
 	}
 
 	return &storage.ExistResponse{
-		Exists: exists,
+		Exists:        true,
+		ContentLength: uint64(aws.ToInt64(out.ContentLength)),
+		ExpiresAt:     storage.ParseExpiry(out.Metadata),
 	}, nil
 }
 
+func (d *Driver) HeadPayload(ctx context.Context, r *storage.HeadRequest) (*storage.HeadResponse, error) {
+	out, err := d.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &d.bucket,
+		Key:    &r.Key,
+	})
+	if err != nil {
+		var ae smithy.APIError
+		if errors.As(err, &ae) && ae.ErrorCode() == "NotFound" {
+			return nil, &storage.ErrBlobNotFound{Err: err}
+		}
+		return nil, err
+	}
+
+	return storage.HeadResponseFromMetadata(uint64(aws.ToInt64(out.ContentLength)), out.Metadata), nil
+}
+
 func (d *Driver) DeletePayload(ctx context.Context, request *storage.DeleteRequest) (*storage.DeleteResponse, error) {
 	_, err := d.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: &d.bucket,
@@ -133,6 +195,204 @@ func (d *Driver) DeletePayload(ctx context.Context, request *storage.DeleteReque
 	return &storage.DeleteResponse{}, nil
 }
 
+// ListPayloads lists blobs with ListObjectsV2, whose continuation token is the cursor. Listings
+// do not include the metadata of objects, so their expiry takes a HeadObject request per blob.
+func (d *Driver) ListPayloads(ctx context.Context, r *storage.ListRequest) (*storage.ListResponse, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: &d.bucket,
+		Prefix: aws.String(r.Prefix),
+	}
+	if r.Limit > 0 {
+		input.MaxKeys = aws.Int32(int32(r.Limit))
+	}
+	if r.Cursor != "" {
+		input.ContinuationToken = aws.String(r.Cursor)
+	}
+	output, err := d.client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &storage.ListResponse{}
+	for _, object := range output.Contents {
+		info := storage.BlobInfo{
+			Key:           aws.ToString(object.Key),
+			ContentLength: uint64(aws.ToInt64(object.Size)),
+			LastModified:  aws.ToTime(object.LastModified),
+		}
+		if r.IncludeExpiry {
+			exists, err := d.ExistPayload(ctx, &storage.ExistRequest{Key: info.Key})
+			if err != nil {
+				return nil, err
+			}
+			info.ExpiresAt = exists.ExpiresAt
+		}
+		response.Blobs = append(response.Blobs, info)
+	}
+	if aws.ToBool(output.IsTruncated) {
+		response.NextCursor = aws.ToString(output.NextContinuationToken)
+	}
+	return response, nil
+}
+
+// DeleteByPrefix deletes the blobs whose keys start with the prefix with a DeleteObjects
+// request per page of ListObjectsV2, which lists up to 1000 objects as DeleteObjects accepts.
+func (d *Driver) DeleteByPrefix(ctx context.Context, r *storage.DeleteByPrefixRequest) (*storage.DeleteByPrefixResponse, error) {
+	response := &storage.DeleteByPrefixResponse{}
+	paginator := s3.NewListObjectsV2Paginator(d.client, &s3.ListObjectsV2Input{
+		Bucket: &d.bucket,
+		Prefix: aws.String(r.Prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+		objects := make([]s3types.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, s3types.ObjectIdentifier{Key: object.Key})
+		}
+		output, err := d.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &d.bucket,
+			Delete: &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// quiet deletions only report the objects which could not be deleted
+		response.Deleted += len(objects) - len(output.Errors)
+		if r.Progress != nil {
+			r.Progress(response.Deleted)
+		}
+		if len(output.Errors) > 0 {
+			return nil, fmt.Errorf("unable to delete %d objects, e.g. '%s': %s", len(output.Errors), aws.ToString(output.Errors[0].Key), aws.ToString(output.Errors[0].Message))
+		}
+	}
+	return response, nil
+}
+
+func (d *Driver) PresignPut(ctx context.Context, r *storage.PresignPutRequest) (*storage.PresignResponse, error) {
+	input := &s3.PutObjectInput{
+		Bucket:        &d.bucket,
+		Key:           aws.String(r.Key),
+		ContentLength: aws.Int64(int64(r.ContentLength)),
+		ContentType:   contentType(r.ContentType),
+		StorageClass:  d.storageClass,
+		Metadata:      storage.PresignedObjectMetadata(r),
+	}
+	// Let S3 verify the integrity of the uploaded data
+	if strings.HasPrefix(r.Digest, "sha256:") {
+		rawDigest, err := hex.DecodeString(strings.TrimPrefix(r.Digest, "sha256:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest '%s': %w", r.Digest, err)
+		}
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(rawDigest))
+	}
+
+	req, err := d.presignClient.PresignPutObject(ctx, input, s3.WithPresignExpires(r.Expires))
+	if err != nil {
+		return nil, err
+	}
+	return &storage.PresignResponse{
+		URL:    req.URL,
+		Method: req.Method,
+		Header: req.SignedHeader,
+	}, nil
+}
+
+func (d *Driver) PresignGet(ctx context.Context, r *storage.PresignGetRequest) (*storage.PresignResponse, error) {
+	req, err := d.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &d.bucket,
+		Key:    aws.String(r.Key),
+	}, s3.WithPresignExpires(r.Expires))
+	if err != nil {
+		return nil, err
+	}
+	return &storage.PresignResponse{
+		URL:    req.URL,
+		Method: req.Method,
+		Header: req.SignedHeader,
+	}, nil
+}
+
+func (d *Driver) CreateMultipartUpload(ctx context.Context, r *storage.CreateMultipartUploadRequest) (*storage.CreateMultipartUploadResponse, error) {
+	out, err := d.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       &d.bucket,
+		Key:          aws.String(r.Key),
+		ContentType:  contentType(r.ContentType),
+		StorageClass: d.storageClass,
+		Metadata:     storage.ObjectMetadata(&storage.PutRequest{ExpiresAt: r.ExpiresAt, Metadata: r.Metadata}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.CreateMultipartUploadResponse{
+		UploadID: aws.ToString(out.UploadId),
+	}, nil
+}
+
+func (d *Driver) UploadPart(ctx context.Context, r *storage.UploadPartRequest) (*storage.UploadPartResponse, error) {
+	out, err := d.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        &d.bucket,
+		Key:           aws.String(r.Key),
+		UploadId:      aws.String(r.UploadID),
+		PartNumber:    aws.Int32(int32(r.PartNumber)),
+		Body:          r.Data,
+		ContentLength: aws.Int64(int64(r.ContentLength)),
+	}, s3.WithAPIOptions(
+		// the data is streamed from the http request body, which cannot be read twice for signing it
+		v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.UploadPartResponse{
+		ETag: aws.ToString(out.ETag),
+	}, nil
+}
+
+func (d *Driver) CompleteMultipartUpload(ctx context.Context, r *storage.CompleteMultipartUploadRequest) (*storage.PutResponse, error) {
+	parts := make([]s3types.CompletedPart, 0, len(r.Parts))
+	for _, part := range r.Parts {
+		parts = append(parts, s3types.CompletedPart{
+			PartNumber: aws.Int32(int32(part.PartNumber)),
+			ETag:       aws.String(part.ETag),
+		})
+	}
+	_, err := d.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &d.bucket,
+		Key:             aws.String(r.Key),
+		UploadId:        aws.String(r.UploadID),
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.PutResponse{
+		Key: r.Key,
+	}, nil
+}
+
+func (d *Driver) AbortMultipartUpload(ctx context.Context, r *storage.AbortMultipartUploadRequest) error {
+	_, err := d.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &d.bucket,
+		Key:      aws.String(r.Key),
+		UploadId: aws.String(r.UploadID),
+	})
+	return err
+}
+
+// Describe returns the name of the bucket used by the driver.
+func (d *Driver) Describe() storage.Description {
+	return storage.Description{Name: "s3", Config: map[string]string{"bucket": d.bucket}}
+}
+
 func (d *Driver) Validate(ctx context.Context) error {
 	input := &s3.HeadBucketInput{
 		Bucket: &d.bucket,
@@ -17,6 +17,7 @@ import (
 	"github.com/DataDog/temporal-large-payload-codec/server/storage"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/orlangure/gnomock"
 	"github.com/orlangure/gnomock/preset/localstack"
 	"github.com/stretchr/testify/require"
@@ -58,6 +59,7 @@ func TestS3Driver(t *testing.T) {
 		Key:           "blobs/sha256:test",
 		Digest:        "sha256:test",
 		ContentLength: uint64(len(testPayloadBytes)),
+		Metadata:      map[string][]byte{"encoding": []byte("json/plain")},
 	})
 	require.NoError(t, err)
 	require.NotEmpty(t, putResponse.Key)
@@ -67,6 +69,21 @@ func TestS3Driver(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, resp.Exists)
 
+	// The Temporal metadata is stored as object metadata
+	head, err := s3Driver.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("lps-test"), Key: aws.String(putResponse.Key)})
+	require.NoError(t, err)
+	require.Equal(t, "json/plain", head.Metadata["lps_meta_encoding"])
+	require.Equal(t, "sha256:test", head.Metadata["lps_digest"])
+
+	// The digest and Temporal metadata are described by the driver
+	described, err := s3Driver.HeadPayload(ctx, &storage.HeadRequest{Key: putResponse.Key})
+	require.NoError(t, err)
+	require.Equal(t, &storage.HeadResponse{
+		ContentLength: uint64(len(testPayloadBytes)),
+		Digest:        "sha256:test",
+		Metadata:      map[string][]byte{"encoding": []byte("json/plain")},
+	}, described)
+
 	// Get the payload back out and compare to original bytes
 	_, err = s3Driver.GetPayload(ctx, &storage.GetRequest{Key: putResponse.Key, Writer: &buf})
 	require.NoError(t, err)
@@ -84,6 +101,47 @@ func TestS3Driver(t *testing.T) {
 	resp, err = s3Driver.ExistPayload(ctx, &storage.ExistRequest{Key: putResponse.Key})
 	require.False(t, resp.Exists)
 
+	// Upload a payload in parts, the last of which may be smaller than the minimum part size
+	created, err := s3Driver.CreateMultipartUpload(ctx, &storage.CreateMultipartUploadRequest{Key: "blobs/sha256:parts"})
+	require.NoError(t, err)
+	partBytes := [][]byte{bytes.Repeat([]byte("a"), 5<<20), []byte("hello world")}
+	var parts []storage.CompletedPart
+	for i, data := range partBytes {
+		uploaded, err := s3Driver.UploadPart(ctx, &storage.UploadPartRequest{
+			Key:           "blobs/sha256:parts",
+			UploadID:      created.UploadID,
+			PartNumber:    i + 1,
+			Data:          bytes.NewReader(data),
+			ContentLength: uint64(len(data)),
+		})
+		require.NoError(t, err)
+		parts = append(parts, storage.CompletedPart{PartNumber: i + 1, ETag: uploaded.ETag})
+	}
+	_, err = s3Driver.CompleteMultipartUpload(ctx, &storage.CompleteMultipartUploadRequest{Key: "blobs/sha256:parts", UploadID: created.UploadID, Parts: parts})
+	require.NoError(t, err)
+	resp, err = s3Driver.ExistPayload(ctx, &storage.ExistRequest{Key: "blobs/sha256:parts"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5<<20+len("hello world")), resp.ContentLength)
+
+	// Abort an upload
+	created, err = s3Driver.CreateMultipartUpload(ctx, &storage.CreateMultipartUploadRequest{Key: "blobs/sha256:aborted"})
+	require.NoError(t, err)
+	require.NoError(t, s3Driver.AbortMultipartUpload(ctx, &storage.AbortMultipartUploadRequest{Key: "blobs/sha256:aborted", UploadID: created.UploadID}))
+
+	// Delete the payloads of a prefix
+	for _, key := range []string{"/blobs/wipe/a", "/blobs/wipe/b", "/blobs/keep/a"} {
+		_, err = s3Driver.PutPayload(ctx, &storage.PutRequest{Data: bytes.NewReader(testPayloadBytes), Key: key, ContentLength: uint64(len(testPayloadBytes))})
+		require.NoError(t, err)
+	}
+	var progress []int
+	deleted, err := s3Driver.DeleteByPrefix(ctx, &storage.DeleteByPrefixRequest{Prefix: "/blobs/wipe/", Progress: func(n int) { progress = append(progress, n) }})
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted.Deleted)
+	require.Equal(t, []int{2}, progress)
+	resp, err = s3Driver.ExistPayload(ctx, &storage.ExistRequest{Key: "/blobs/keep/a"})
+	require.NoError(t, err)
+	require.True(t, resp.Exists)
+
 	time.Sleep(1 * time.Second)
 }
 
@@ -0,0 +1,220 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+// Package sweeper deletes the blobs whose expiry passed, see server.WithNamespaceBlobTTL.
+// Blobs without an expiry are never deleted.
+package sweeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.temporal.io/sdk/client"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/logging"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+)
+
+const (
+	// DefaultInterval is the period between two sweeps unless configured otherwise.
+	DefaultInterval = time.Hour
+
+	// metricDeletedTotal counts the expired blobs deleted by the sweeper.
+	metricDeletedTotal = "lps_sweeper_deleted_total"
+	// metricErrorsTotal counts the sweeps and deletions which failed.
+	metricErrorsTotal = "lps_sweeper_errors_total"
+
+	metricTagNamespace = "namespace"
+
+	// blobsPrefix is the prefix of the keys of all blobs, see v2.ComputeKey.
+	blobsPrefix = "/blobs/"
+	// pageSize is the number of blobs listed at once.
+	pageSize = 1000
+)
+
+// ErrListingUnsupported is returned by New for storage drivers which cannot list blobs.
+var ErrListingUnsupported = errors.New("storage driver does not support listing blobs")
+
+// Option configures the sweeper created by New.
+type Option interface {
+	apply(*Sweeper)
+}
+
+type applier func(*Sweeper)
+
+func (a applier) apply(s *Sweeper) {
+	a(s)
+}
+
+// WithInterval sets the period between two sweeps. Defaults to DefaultInterval.
+func WithInterval(interval time.Duration) Option {
+	return applier(func(s *Sweeper) {
+		s.interval = interval
+	})
+}
+
+// WithLogger sets the logger, which logs each deleted blob. Defaults to a noop logger.
+func WithLogger(logger logging.Logger) Option {
+	return applier(func(s *Sweeper) {
+		s.logger = logger
+	})
+}
+
+// WithMetricsHandler sets the handler recording the number of deleted blobs by namespace, and
+// of failures. Defaults to client.MetricsNopHandler.
+func WithMetricsHandler(handler client.MetricsHandler) Option {
+	return applier(func(s *Sweeper) {
+		s.metricsHandler = handler
+	})
+}
+
+// WithKeyBuilder sets the key builder of the server, see server.WithKeyBuilder. Blobs are
+// listed under /blobs/ unless it implements v2.KeyValidator, in which case all blobs are listed,
+// and the namespace of deleted blobs is the one returned by ValidateKey.
+func WithKeyBuilder(builder v2.KeyBuilder) Option {
+	return applier(func(s *Sweeper) {
+		s.keyBuilder = builder
+	})
+}
+
+// WithDeletionObserver sets a function called with the namespace, key and size of each deleted
+// blob, e.g. server.Deletions.Deleted to credit them back to the namespace quotas.
+func WithDeletionObserver(observer func(namespace, key string, size uint64)) Option {
+	return applier(func(s *Sweeper) {
+		s.observer = observer
+	})
+}
+
+// WithEventSink sets a function called with an Event for each deleted blob, e.g. the sink set
+// with server.WithEventSink so that inventories fed by the events learn about expired blobs.
+// The sink is called from the goroutine of the sweep, so slow sinks delay it.
+func WithEventSink(sink v2.EventSink) Option {
+	return applier(func(s *Sweeper) {
+		s.eventSink = sink
+	})
+}
+
+// Sweeper periodically deletes the blobs whose expiry passed.
+type Sweeper struct {
+	lister         storage.Lister
+	driver         storage.Driver
+	interval       time.Duration
+	logger         logging.Logger
+	metricsHandler client.MetricsHandler
+	// keyBuilder builds the keys of blobs, v2.DefaultKeyBuilder is used if nil.
+	keyBuilder v2.KeyBuilder
+	// observer is called with the deleted blobs, it is nil if there is none.
+	observer func(namespace, key string, size uint64)
+	// eventSink is called with the events of the deleted blobs, it is nil if there is none.
+	eventSink v2.EventSink
+}
+
+// New creates a sweeper deleting the expired blobs stored with driver, which must implement
+// storage.Lister. Each sweep lists all blobs with their expiry, which takes a request per
+// blob with the s3 driver.
+func New(driver storage.Driver, opts ...Option) (*Sweeper, error) {
+	lister, ok := driver.(storage.Lister)
+	if !ok {
+		return nil, ErrListingUnsupported
+	}
+	s := &Sweeper{
+		lister:         lister,
+		driver:         driver,
+		interval:       DefaultInterval,
+		logger:         logging.NewNoopLogger(),
+		metricsHandler: client.MetricsNopHandler,
+	}
+	for _, opt := range opts {
+		opt.apply(s)
+	}
+	if s.interval <= 0 {
+		return nil, fmt.Errorf("invalid sweep interval %v: must be positive", s.interval)
+	}
+	return s, nil
+}
+
+// Run sweeps once per interval until ctx is done. Failed sweeps are logged and retried at the
+// next interval.
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Sweep(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Error("unable to sweep expired blobs", "error", err)
+			}
+		}
+	}
+}
+
+// Sweep deletes the blobs whose expiry passed and returns how many were deleted.
+func (s *Sweeper) Sweep(ctx context.Context) (int, error) {
+	deleted := 0
+	request := &storage.ListRequest{Prefix: blobsPrefix, Limit: pageSize, IncludeExpiry: true}
+	if _, ok := s.keyBuilder.(v2.KeyValidator); ok {
+		// custom key layouts may not start with the prefix
+		request.Prefix = ""
+	}
+	for {
+		listed, err := s.lister.ListPayloads(ctx, request)
+		if err != nil {
+			s.metricsHandler.Counter(metricErrorsTotal).Inc(1)
+			return deleted, err
+		}
+		for _, blob := range listed.Blobs {
+			if blob.ExpiresAt.IsZero() || time.Now().Before(blob.ExpiresAt) {
+				continue
+			}
+			ok, err := s.deleteExpired(ctx, blob.Key)
+			if err != nil {
+				if ctx.Err() != nil {
+					return deleted, ctx.Err()
+				}
+				s.metricsHandler.Counter(metricErrorsTotal).Inc(1)
+				s.logger.Error("unable to delete expired blob", "key", blob.Key, "error", err)
+				continue
+			}
+			if ok {
+				deleted++
+			}
+		}
+		if listed.NextCursor == "" {
+			return deleted, nil
+		}
+		request.Cursor = listed.NextCursor
+	}
+}
+
+// deleteExpired deletes the blob with the given key if it is still expired, since it may have
+// been stored again with a later expiry after it was listed. It tells whether it was deleted.
+func (s *Sweeper) deleteExpired(ctx context.Context, key string) (bool, error) {
+	exists, err := s.driver.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+	if err != nil {
+		return false, err
+	}
+	if !exists.Exists || exists.ExpiresAt.IsZero() || time.Now().Before(exists.ExpiresAt) {
+		return false, nil
+	}
+	if _, err := s.driver.DeletePayload(ctx, &storage.DeleteRequest{Key: key}); err != nil {
+		return false, err
+	}
+
+	namespace, _ := v2.ValidateBuiltKey(s.keyBuilder, key)
+	s.logger.Info("deleted expired blob", "key", key, "expiredAt", exists.ExpiresAt)
+	s.metricsHandler.WithTags(map[string]string{metricTagNamespace: namespace}).Counter(metricDeletedTotal).Inc(1)
+	if s.observer != nil {
+		s.observer(namespace, key, exists.ContentLength)
+	}
+	if s.eventSink != nil {
+		_, digest, _ := v2.ParseKey(key)
+		s.eventSink(ctx, v2.Event{Operation: v2.OperationDelete, Namespace: namespace, Key: key, Size: exists.ContentLength, Digest: digest, Time: time.Now()})
+	}
+	return true, nil
+}
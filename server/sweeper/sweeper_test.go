@@ -0,0 +1,149 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package sweeper_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/client"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+	"github.com/DataDog/temporal-large-payload-codec/server/sweeper"
+)
+
+// countingMetricsHandler records the values of counters by name and tags.
+type countingMetricsHandler struct {
+	client.MetricsHandler
+	mu       *sync.Mutex
+	tags     string
+	counters map[string]int64
+}
+
+func (h *countingMetricsHandler) WithTags(tags map[string]string) client.MetricsHandler {
+	var pairs []string
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	return &countingMetricsHandler{mu: h.mu, tags: strings.Join(pairs, ","), counters: h.counters}
+}
+
+func (h *countingMetricsHandler) Counter(name string) client.MetricsCounter {
+	return counter(func(v int64) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.counters[name+"{"+h.tags+"}"] += v
+	})
+}
+
+type counter func(int64)
+
+func (c counter) Inc(v int64) {
+	c(v)
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	driver := &memory.Driver{}
+	expiries := map[string]time.Time{
+		"/blobs/test/common/sha256:expired/hash": time.Now().Add(-time.Minute),
+		"/blobs/test/common/sha256:future/hash":  time.Now().Add(time.Hour),
+		"/blobs/test/common/sha256:never/hash":   {},
+	}
+	for key, expiresAt := range expiries {
+		_, err := driver.PutPayload(ctx, &storage.PutRequest{Data: strings.NewReader("data"), Key: key, ExpiresAt: expiresAt})
+		require.NoError(t, err)
+	}
+	metrics := &countingMetricsHandler{mu: &sync.Mutex{}, counters: map[string]int64{}}
+
+	var observed []string
+	var events []v2.Event
+	s, err := sweeper.New(driver,
+		sweeper.WithMetricsHandler(metrics),
+		sweeper.WithDeletionObserver(func(namespace, key string, size uint64) {
+			observed = append(observed, fmt.Sprintf("%s %s %d", namespace, key, size))
+		}),
+		sweeper.WithEventSink(func(_ context.Context, event v2.Event) {
+			events = append(events, event)
+		}),
+	)
+	require.NoError(t, err)
+	deleted, err := s.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	require.Equal(t, []string{"test /blobs/test/common/sha256:expired/hash 4"}, observed)
+	require.Len(t, events, 1)
+	require.WithinDuration(t, time.Now(), events[0].Time, time.Minute)
+	events[0].Time = time.Time{}
+	require.Equal(t, v2.Event{
+		Operation: v2.OperationDelete,
+		Namespace: "test",
+		Key:       "/blobs/test/common/sha256:expired/hash",
+		Size:      4,
+		Digest:    "sha256:expired",
+	}, events[0])
+
+	for key := range expiries {
+		exists, err := driver.ExistPayload(ctx, &storage.ExistRequest{Key: key})
+		require.NoError(t, err)
+		require.Equal(t, !strings.Contains(key, "expired"), exists.Exists, key)
+	}
+	require.Equal(t, map[string]int64{"lps_sweeper_deleted_total{namespace=test}": 1}, metrics.counters)
+
+	deleted, err = s.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, deleted)
+}
+
+// payloadKeyBuilder stores blobs under /payloads/<namespace>/<digest>.
+type payloadKeyBuilder struct{}
+
+func (payloadKeyBuilder) BuildKey(namespace, digest string, _ map[string][]byte) (string, error) {
+	return fmt.Sprintf("/payloads/%s/%s", namespace, digest), nil
+}
+
+func (payloadKeyBuilder) ValidateKey(key string) (string, error) {
+	tokens := strings.Split(key, "/")
+	if len(tokens) != 4 || tokens[1] != "payloads" {
+		return "", fmt.Errorf("'%s' is not a valid key", key)
+	}
+	return tokens[2], nil
+}
+
+func TestSweepKeyBuilder(t *testing.T) {
+	ctx := context.Background()
+	driver := &memory.Driver{}
+	_, err := driver.PutPayload(ctx, &storage.PutRequest{Data: strings.NewReader("data"), Key: "/payloads/test/sha256:expired", ExpiresAt: time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+	metrics := &countingMetricsHandler{mu: &sync.Mutex{}, counters: map[string]int64{}}
+
+	// blobs outside of /blobs/ are found with a key builder validating their keys
+	s, err := sweeper.New(driver, sweeper.WithMetricsHandler(metrics), sweeper.WithKeyBuilder(payloadKeyBuilder{}))
+	require.NoError(t, err)
+	deleted, err := s.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	require.Equal(t, map[string]int64{"lps_sweeper_deleted_total{namespace=test}": 1}, metrics.counters)
+}
+
+// unlistableDriver is a driver which cannot list blobs.
+type unlistableDriver struct {
+	storage.Driver
+}
+
+func TestNew(t *testing.T) {
+	_, err := sweeper.New(unlistableDriver{})
+	require.ErrorIs(t, err, sweeper.ErrListingUnsupported)
+
+	_, err = sweeper.New(&memory.Driver{}, sweeper.WithInterval(0))
+	require.EqualError(t, err, "invalid sweep interval 0s: must be positive")
+}
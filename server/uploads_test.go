@@ -0,0 +1,258 @@
+// Unless explicitly stated otherwise all files in this repository are licensed under the MIT License.
+//
+// This product includes software developed at Datadog (https://www.datadoghq.com/). Copyright 2021 Datadog, Inc.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v2 "github.com/DataDog/temporal-large-payload-codec/server/handler/v2"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage"
+	"github.com/DataDog/temporal-large-payload-codec/server/storage/memory"
+)
+
+// uploadClient sends the requests of upload sessions to handler.
+type uploadClient struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+func (c *uploadClient) do(request *http.Request) *httptest.ResponseRecorder {
+	responseRecorder := httptest.NewRecorder()
+	c.handler.ServeHTTP(responseRecorder, request)
+	return responseRecorder
+}
+
+// start starts a session for a blob of size bytes with the given digest, returning its ID.
+func (c *uploadClient) start(digest string, size int) string {
+	request := httptest.NewRequest(http.MethodPost, "/v2/blobs/uploads", nil)
+	request.Header.Set("X-Payload-Expected-Content-Length", strconv.Itoa(size))
+	request.Header.Set("X-Temporal-Metadata", base64.StdEncoding.EncodeToString([]byte(`{}`)))
+	q := request.URL.Query()
+	q.Add("namespace", "test")
+	q.Add("digest", digest)
+	request.URL.RawQuery = q.Encode()
+
+	responseRecorder := c.do(request)
+	require.Equal(c.t, http.StatusCreated, responseRecorder.Code, responseRecorder.Body.String())
+	var session struct {
+		ID string `json:"id"`
+	}
+	require.NoError(c.t, json.Unmarshal(responseRecorder.Body.Bytes(), &session))
+	require.NotEmpty(c.t, session.ID)
+	return session.ID
+}
+
+// put uploads data as the given part of a session.
+func (c *uploadClient) put(id string, part int, data []byte) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPut, "/v2/blobs/uploads/"+id, bytes.NewReader(data))
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	q := request.URL.Query()
+	q.Add("part", strconv.Itoa(part))
+	q.Add("digest", sha256Digest(data))
+	request.URL.RawQuery = q.Encode()
+	return c.do(request)
+}
+
+func (c *uploadClient) complete(id string) *httptest.ResponseRecorder {
+	return c.do(httptest.NewRequest(http.MethodPost, "/v2/blobs/uploads/"+id+"/complete", nil))
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestUploadSessionsV2(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5)
+	digest := sha256Digest(data)
+
+	// the key is the same as for a single upload
+	singleDriver := &memory.Driver{}
+	responseRecorder := httptest.NewRecorder()
+	NewHttpHandler(singleDriver).ServeHTTP(responseRecorder, newPutRequestV2(data, len(data)))
+	require.Equal(t, http.StatusCreated, responseRecorder.Code)
+	var single storage.PutResponse
+	require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &single))
+
+	testCase := []struct {
+		name   string
+		digest string
+		// parts are the numbers of the parts of 20 bytes in the order they are uploaded
+		parts      []int
+		statusCode int
+		want       string
+	}{
+		{name: "In order", digest: digest, parts: []int{1, 2, 3}, statusCode: http.StatusCreated},
+		{name: "Out of order", digest: digest, parts: []int{3, 1, 2}, statusCode: http.StatusCreated},
+		{name: "Uploaded again", digest: digest, parts: []int{1, 2, 1, 3, 2}, statusCode: http.StatusCreated},
+		{name: "Missing part", digest: digest, parts: []int{1, 3}, statusCode: http.StatusBadRequest, want: errorBody(v2.ErrorCodeInvalidRequest, "part 2 was not uploaded")},
+		{name: "Incomplete", digest: digest, parts: []int{1, 2}, statusCode: http.StatusBadRequest, want: errorBody(v2.ErrorCodeInvalidRequest, "parts have 40 bytes, but 50 bytes were declared")},
+		{name: "Checksum mismatch", digest: sha256Digest([]byte("other")), parts: []int{1, 2, 3}, statusCode: http.StatusBadRequest, want: errorBody(v2.ErrorCodeChecksumMismatch, "checksum mismatch")},
+		{name: "Checksum mismatch out of order", digest: sha256Digest([]byte("other")), parts: []int{2, 1, 3}, statusCode: http.StatusBadRequest, want: errorBody(v2.ErrorCodeChecksumMismatch, "checksum mismatch")},
+	}
+
+	for _, scenario := range testCase {
+		t.Run(scenario.name, func(t *testing.T) {
+			driver := &memory.Driver{}
+			client := &uploadClient{t: t, handler: NewHttpHandlerWithOptions(driver, WithMaxBlobBytes(20))}
+
+			id := client.start(scenario.digest, len(data))
+			for _, part := range scenario.parts {
+				end := part * 20
+				if end > len(data) {
+					end = len(data)
+				}
+				responseRecorder := client.put(id, part, data[(part-1)*20:end])
+				require.Equal(t, http.StatusNoContent, responseRecorder.Code, responseRecorder.Body.String())
+			}
+
+			responseRecorder := client.complete(id)
+			require.Equal(t, scenario.statusCode, responseRecorder.Code)
+			if scenario.statusCode != http.StatusCreated {
+				assert.Equal(t, scenario.want, responseRecorder.Body.String())
+				if scenario.want == errorBody(v2.ErrorCodeChecksumMismatch, "checksum mismatch") {
+					exists, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: single.Key})
+					require.NoError(t, err)
+					assert.False(t, exists.Exists)
+				}
+				return
+			}
+
+			var result storage.PutResponse
+			require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &result))
+			assert.Contains(t, result.Key, scenario.digest)
+			var buf bytes.Buffer
+			_, err := driver.GetPayload(context.Background(), &storage.GetRequest{Key: single.Key, Writer: &buf})
+			require.NoError(t, err)
+			assert.Equal(t, data, buf.Bytes())
+
+			// completed sessions end
+			responseRecorder = client.complete(id)
+			assert.Equal(t, http.StatusNotFound, responseRecorder.Code)
+		})
+	}
+}
+
+func TestUploadSessionsV2TTL(t *testing.T) {
+	driver := &memory.Driver{}
+	client := &uploadClient{t: t, handler: NewHttpHandlerWithOptions(driver, WithNamespaceBlobTTL(map[string]time.Duration{"test": time.Hour}))}
+	data := []byte("0123456789")
+
+	// blobs uploaded in parts expire as blobs uploaded at once
+	id := client.start(sha256Digest(data), len(data))
+	require.Equal(t, http.StatusNoContent, client.put(id, 1, data).Code)
+	responseRecorder := client.complete(id)
+	require.Equal(t, http.StatusCreated, responseRecorder.Code, responseRecorder.Body.String())
+	var result storage.PutResponse
+	require.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &result))
+
+	exists, err := driver.ExistPayload(context.Background(), &storage.ExistRequest{Key: result.Key})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), exists.ExpiresAt, time.Minute)
+}
+
+func TestUploadSessionsV2Errors(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5)
+	digest := sha256Digest(data)
+
+	driver := &memory.Driver{}
+	client := &uploadClient{t: t, handler: NewHttpHandlerWithOptions(driver, WithMaxBlobBytes(20), WithMaxUploadBytes(64))}
+	id := client.start(digest, len(data))
+
+	// parts are limited by the maximum blob size, and sessions by the maximum upload size
+	responseRecorder := client.put(id, 1, data[:21])
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodePayloadTooLarge, "payload of 21 bytes exceeds the global max size of 20 bytes"), responseRecorder.Body.String())
+	request := httptest.NewRequest(http.MethodPost, "/v2/blobs/uploads?namespace=test&digest="+digest, nil)
+	request.Header.Set("X-Payload-Expected-Content-Length", "65")
+	responseRecorder = client.do(request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodePayloadTooLarge, "payload of 65 bytes exceeds the max size of 64 bytes of upload sessions"), responseRecorder.Body.String())
+
+	// parts cannot exceed the declared size
+	for part := 1; part <= 2; part++ {
+		require.Equal(t, http.StatusNoContent, client.put(id, part, data[:20]).Code)
+	}
+	responseRecorder = client.put(id, 3, data[:20])
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodePayloadTooLarge, "parts of 60 bytes exceed the declared size of 50 bytes"), responseRecorder.Body.String())
+
+	// parts are verified with their checksum
+	request = httptest.NewRequest(http.MethodPut, "/v2/blobs/uploads/"+id+"?part=3&digest="+digest, bytes.NewReader(data[40:]))
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Length", "10")
+	responseRecorder = client.do(request)
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeChecksumMismatch, "checksum mismatch"), responseRecorder.Body.String())
+
+	for _, part := range []string{"0", "10001", "one"} {
+		request = httptest.NewRequest(http.MethodPut, "/v2/blobs/uploads/"+id+"?part="+part+"&digest="+digest, bytes.NewReader(data[40:]))
+		request.Header.Set("Content-Type", "application/octet-stream")
+		request.Header.Set("Content-Length", "10")
+		responseRecorder = client.do(request)
+		assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+		assert.Equal(t, errorBody(v2.ErrorCodeInvalidRequest, "part query parameter '"+part+"' is not a number between 1 and 10000"), responseRecorder.Body.String())
+	}
+
+	// aborted sessions end
+	responseRecorder = client.do(httptest.NewRequest(http.MethodDelete, "/v2/blobs/uploads/"+id, nil))
+	assert.Equal(t, http.StatusNoContent, responseRecorder.Code)
+	responseRecorder = client.put(id, 3, data[40:])
+	assert.Equal(t, http.StatusNotFound, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeUploadSessionNotFound, "upload session "+id+" does not exist"), responseRecorder.Body.String())
+
+	responseRecorder = client.do(httptest.NewRequest(http.MethodGet, "/v2/blobs/uploads", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Code)
+	responseRecorder = client.do(httptest.NewRequest(http.MethodGet, "/v2/blobs/uploads/"+id+"/parts", nil))
+	assert.Equal(t, http.StatusNotFound, responseRecorder.Code)
+
+	// drivers without multipart uploads do not offer upload sessions
+	unsupported := &uploadClient{t: t, handler: NewHttpHandler(struct{ storage.Driver }{&memory.Driver{}})}
+	responseRecorder = unsupported.do(httptest.NewRequest(http.MethodPost, "/v2/blobs/uploads", nil))
+	assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
+	assert.Equal(t, errorBody(v2.ErrorCodeNotSupported, "storage driver does not support upload sessions"), responseRecorder.Body.String())
+}
+
+// abortRecorder is a driver recording the aborted multipart uploads.
+type abortRecorder struct {
+	memory.Driver
+	aborted chan string
+}
+
+func (d *abortRecorder) AbortMultipartUpload(ctx context.Context, r *storage.AbortMultipartUploadRequest) error {
+	d.aborted <- r.UploadID
+	return d.Driver.AbortMultipartUpload(ctx, r)
+}
+
+func TestUploadSessionsV2Expiry(t *testing.T) {
+	data := []byte("hello world")
+	driver := &abortRecorder{aborted: make(chan string, 1)}
+	client := &uploadClient{t: t, handler: NewHttpHandlerWithOptions(driver, WithUploadSessionTTL(50*time.Millisecond))}
+
+	id := client.start(sha256Digest(data), len(data))
+	require.Equal(t, http.StatusNoContent, client.put(id, 1, data).Code)
+
+	select {
+	case <-driver.aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upload of the expired session was not aborted")
+	}
+	responseRecorder := client.complete(id)
+	assert.Equal(t, http.StatusNotFound, responseRecorder.Code)
+}